@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// adoptedClient returns the client configuration of an adopted server peer. The client keeps its
+// external private key, only its tunnel address and the server peer are known.
+//
+// Parameters:
+//     peer (Peer): The server peer of the client.
+//     subnet (net.IPNet): The tunnel subnet, used to find the client address in the peer AllowedIPs.
+//     serverPublicKey (string): The public key of the server.
+//     endpoint (string): The server endpoint the client connects to.
+//     defaults (clientDefaults): The DNS, MTU, AllowedIPs and keepalive of the client.
+//
+// Returns:
+//     WireguardConfig: The client configuration, without a private key.
+//     error: A validation error if no AllowedIPs entry is a single address of the subnet.
+func adoptedClient(peer Peer, subnet net.IPNet, serverPublicKey string, endpoint string,
+	defaults clientDefaults) (WireguardConfig, error) {
+	for _, allowed := range peer.AllowedIPs {
+		ones, bits := allowed.Mask.Size()
+		if ones == bits && subnet.Contains(allowed.IP) {
+			client := NewWireguardClientConfig("", []net.IPNet{{IP: allowed.IP, Mask: subnet.Mask}},
+				serverPublicKey, nil, endpoint)
+			defaults.applyTo(&client)
+			// Both sides of a peer need the same preshared key
+			for _, line := range peer.Unknown {
+				if key, _, _ := strings.Cut(line, "="); strings.EqualFold(strings.TrimSpace(key), "PresharedKey") {
+					client.Peers[0].Unknown = append(client.Peers[0].Unknown, line)
+				}
+			}
+			return client, nil
+		}
+	}
+
+	return WireguardConfig{}, newError(errValidation, "peer %s has no tunnel address in %s", peer.PublicKey, subnet.String())
+}
+
+// checkAdoptedListenPort reports whether the listen port of an adopted server is in use by the
+// running Wireguard instance, as expected, and whether the Windows firewall lets it in.
+func checkAdoptedListenPort(ps Executor, port int) {
+	if _, err := CheckUdpPort(udpFamilyDual, port); err == nil {
+		fmt.Printf("UDP port %d is not in use, the adopted server doesn't seem to be running.\n", port)
+	} else if name, found := wireguardPortOwner(ps, port); found {
+		fmt.Printf("UDP port %d is held by the running Wireguard instance '%s'.\n", port, name)
+	} else if owner, found := udpPortOwner(ps, port); found {
+		fmt.Printf("Warning: UDP port %d is in use by %s.\n", port, owner)
+	} else {
+		fmt.Printf("Warning: UDP port %d is in use by another application.\n", port)
+	}
+
+	script := fmt.Sprintf("Get-NetFirewallPortFilter -Protocol UDP | Where-Object { $_.LocalPort -eq '%d' } | "+
+		"Get-NetFirewallRule | Where-Object { $_.Enabled -eq 'True' -and $_.Direction -eq 'Inbound' } | "+
+		"Select-Object -First 1 -ExpandProperty DisplayName", port)
+	result := ps.Execute(context.Background(), script)
+	switch {
+	case result.Err != nil:
+		fmt.Println("Couldn't check the Windows firewall rules.")
+	case strings.TrimSpace(result.StdOut) == "":
+		fmt.Printf("No inbound firewall rule allows UDP port %d, see %s for the command to add one.\n",
+			port, defaultSummaryTextFile)
+	default:
+		fmt.Printf("Inbound firewall rule '%s' allows UDP port %d.\n", strings.TrimSpace(result.StdOut), port)
+	}
+}
+
+// runAdoptCommand implements the 'adopt' command, which takes over the management of an existing
+// hand-made server configuration:
+//
+//     adopt C:\wiresock\wiresock.conf --endpoint vpn.example.com:51820
+//     adopt wg0.dump --address 10.9.0.1/24 --endpoint vpn.example.com:51820
+//
+// The server configuration is parsed and validated, the tunnel subnet is inferred from the
+// interface address and every peer becomes a client with an external key. Besides configuration
+// files, the output of 'wg showconf' and 'wg show <interface> dump' of a live Linux server is
+// accepted, see readServerToAdopt: both lack the interface address, which is then given with
+// --address or asked for. The networks a peer routes besides its tunnel address stay on its
+// server peer, where they are the networks behind a site-to-site client, see clientSites.
+//
+// Adoption is refused if the file fails validation or a configuration already exists, unless
+// --merge is given: the peers unknown to the existing configuration are then added as clients of
+// its server, and the interface of the file is ignored. Without --merge the adopted file itself is
+// not rewritten, the configuration files are generated by the next mutating command.
+func runAdoptCommand(configPath string, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return newError(errUsage, "usage: adopt <server.conf|dump> [--endpoint host:port] [--address cidr] [--merge]")
+	}
+
+	flags := flag.NewFlagSet("adopt", flag.ContinueOnError)
+	endpoint := flags.String("endpoint", "", "Server endpoint the clients connect to, host:port")
+	address := flags.String("address", "", "Tunnel address of the server with its prefix, for files without Address")
+	merge := flags.Bool("merge", false, "Add the peers to the existing configuration as clients")
+	if err := parseFlags(flags, "adopt", args[1:]); err != nil {
+		return err
+	}
+
+	server, warnings, err := readServerToAdopt(args[0])
+	if err != nil {
+		return fmt.Errorf("can't adopt %s: %w", args[0], err)
+	}
+	for _, warning := range warnings {
+		fmt.Println("Warning:", warning)
+	}
+
+	if _, err := os.Stat(configPath + defaultAppConfigFile); err == nil {
+		if !*merge {
+			return newError(errConflict, "a configuration already exists in %s, use --merge to add the peers to it", configPath)
+		}
+		return mergeAdoptedPeers(configPath, args[0], server)
+	}
+	if *merge {
+		return newError(errUsage, "there is no configuration in %s to merge the peers into, adopt it without --merge", configPath)
+	}
+
+	if len(server.Address) == 0 {
+		if *address == "" {
+			*address = readInput("Enter the tunnel address of the server with its prefix, e.g. 10.9.0.1/24:")
+		}
+		if *address != "" {
+			if server.Address, err = parseInterfaceAddresses(*address); err != nil {
+				return fmt.Errorf("can't adopt %s: %w", args[0], err)
+			}
+		}
+	}
+	serverPublicKey, err := base64PublicKeyFromPrivate(server.PrivateKey)
+	if err != nil || server.ListenPort == 0 || len(server.Address) == 0 {
+		return newError(errValidation, "can't adopt %s: a server needs a PrivateKey, ListenPort and Address", args[0])
+	}
+
+	subnet := net.IPNet{IP: server.Address[0].IP.Mask(server.Address[0].Mask), Mask: server.Address[0].Mask}
+	fmt.Printf("Adopting server %s with %d peers in subnet %s.\n", serverPublicKey, len(server.Peers), subnet.String())
+
+	if *endpoint == "" {
+		*endpoint = readInput("Enter the server host name or IP address the clients connect to:")
+		if *endpoint == "" {
+			return newError(errUsage, "the server endpoint is required, see --endpoint")
+		}
+	}
+	if *endpoint, err = parseEndpoint(*endpoint, server.ListenPort); err != nil {
+		return err
+	}
+
+	config := appConfig{Server: server}
+	if name := filepath.Base(args[0]); name != defaultServerConfigFile && strings.HasSuffix(name, ".conf") &&
+		validateServerConfigFileName(name) == nil {
+		// Keep the tunnel name, e.g. wg0 for an adopted wg0.conf
+		config.ServerConfigFile = name
+	}
+	defaults := config.effectiveDefaults()
+	for _, peer := range server.Peers {
+		client, err := adoptedClient(peer, subnet, serverPublicKey, *endpoint, defaults)
+		if err != nil {
+			return fmt.Errorf("can't adopt %s: %w", args[0], err)
+		}
+		config.Clients = append(config.Clients, client)
+	}
+	if problems := config.Validate(); len(problems) > 0 {
+		return fmt.Errorf("can't adopt %s: %w", args[0], validationFailure(problems))
+	}
+	config.printAdoptedSites(0)
+
+	checkAdoptedListenPort(newExecutor(), int(server.ListenPort))
+
+	if err = config.saveWithHistory(configPath, "adopt", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+	fmt.Printf("Adopted %d clients with external keys. %s is left untouched until the next change.\n",
+		len(config.Clients), args[0])
+
+	return appendAuditLog(configPath, "adopt", map[string]interface{}{"File": args[0], "Clients": len(config.Clients)})
+}
+
+// mergeAdoptedPeers implements 'adopt --merge': the peers of the adopted server that the existing
+// configuration doesn't know yet become clients with external keys of its server, connecting to
+// its endpoint. The configuration files are written right away since the server gains peers.
+func mergeAdoptedPeers(configPath string, fileName string, server WireguardConfig) error {
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	if len(config.Server.Address) == 0 || len(config.Clients) == 0 || len(config.Clients[0].Peers) == 0 {
+		return newError(errValidation, "the existing configuration has no clients to take the server endpoint from")
+	}
+	serverPublicKey, _ := base64PublicKeyFromPrivate(config.Server.PrivateKey)
+	endpoint := config.Clients[0].Peers[0].Endpoint
+
+	known := map[string]bool{}
+	for _, peer := range config.Server.Peers {
+		known[peer.PublicKey] = true
+	}
+	first := len(config.Clients)
+	defaults := config.effectiveDefaults()
+	for _, peer := range server.Peers {
+		if known[peer.PublicKey] {
+			fmt.Printf("Peer %s is already a client, skipped.\n", keyFingerprint(peer.PublicKey))
+			continue
+		}
+		client, err := adoptedClient(peer, config.serverSubnet(), serverPublicKey, endpoint, defaults)
+		if err != nil {
+			return fmt.Errorf("can't adopt %s: %w", fileName, err)
+		}
+		config.Server.Peers = append(config.Server.Peers, peer)
+		config.Clients = append(config.Clients, client)
+	}
+	if len(config.Clients) == first {
+		fmt.Println("All the peers are clients already, nothing to merge.")
+		return nil
+	}
+	if problems := config.Validate(); len(problems) > 0 {
+		return fmt.Errorf("can't adopt %s: %w", fileName, validationFailure(problems))
+	}
+	config.printAdoptedSites(first)
+
+	if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+		return err
+	}
+	if err = config.saveWithHistory(configPath, "adopt --merge", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+	fmt.Printf("Merged %d clients with external keys from %s, they now connect to %s.\n",
+		len(config.Clients)-first, fileName, endpoint)
+
+	return appendAuditLog(configPath, "adopt", map[string]interface{}{
+		"File": fileName, "Clients": len(config.Clients) - first, "Merge": true})
+}
+
+// printAdoptedSites tells which adopted clients, from the given zero-based index on, route more
+// networks than their tunnel address: they are kept as the networks behind a site-to-site client.
+func (config *appConfig) printAdoptedSites(first int) {
+	for i := first; i < len(config.Clients); i++ {
+		if sites := config.clientSites(i); len(sites) > 0 {
+			fmt.Printf("Client %d routes %s behind it, kept as a site-to-site client.\n", i+1, joinIPNets(sites))
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// denseQrContentSize is the configuration size in bytes above which QR codes get dense enough to be
+// hard to scan on small screens, roughly QR code version 15.
+const denseQrContentSize = 400
+
+// normalizeIPNet returns the network with its host bits cleared and IPv4 addresses in 4-byte form.
+func normalizeIPNet(ipNet net.IPNet) net.IPNet {
+	ones, bits := ipNet.Mask.Size()
+	ip := ipNet.IP.To4()
+	if ip == nil || bits == 128 {
+		ip = ipNet.IP.To16()
+	}
+
+	return net.IPNet{IP: ip.Mask(net.CIDRMask(ones, len(ip)*8)), Mask: net.CIDRMask(ones, len(ip)*8)}
+}
+
+// collapseAllowedIPs returns the smallest equivalent list of networks: duplicates and networks
+// contained in another one are removed, and sibling networks are merged into their parent, e.g.
+// 10.0.0.0/25 and 10.0.0.128/25 into 10.0.0.0/24. The result is sorted.
+//
+// Parameters:
+//     networks ([]net.IPNet): The AllowedIPs to collapse.
+//
+// Returns:
+//     []net.IPNet: The collapsed networks, covering exactly the same addresses.
+//
+// Usage:
+//     collapsed := collapseAllowedIPs(client.Peers[0].AllowedIPs)
+func collapseAllowedIPs(networks []net.IPNet) []net.IPNet {
+	var result []net.IPNet
+	for _, network := range networks {
+		result = append(result, normalizeIPNet(network))
+	}
+
+	for changed := true; changed; {
+		changed = false
+
+		// Wider networks first, so that contained ones are found after their container
+		sort.Slice(result, func(i, j int) bool {
+			if len(result[i].IP) != len(result[j].IP) {
+				return len(result[i].IP) < len(result[j].IP)
+			}
+			onesI, _ := result[i].Mask.Size()
+			onesJ, _ := result[j].Mask.Size()
+			if onesI != onesJ {
+				return onesI < onesJ
+			}
+			return bytes.Compare(result[i].IP, result[j].IP) < 0
+		})
+
+		var kept []net.IPNet
+		for _, network := range result {
+			contained := false
+			for _, container := range kept {
+				if len(container.IP) == len(network.IP) && container.Contains(network.IP) {
+					ones, _ := network.Mask.Size()
+					containerOnes, _ := container.Mask.Size()
+					contained = containerOnes <= ones
+				}
+				if contained {
+					break
+				}
+			}
+			if !contained {
+				kept = append(kept, network)
+			}
+		}
+
+		// Merge siblings, which share the parent network one bit shorter
+		result = nil
+		merged := make([]bool, len(kept))
+		for i := range kept {
+			if merged[i] {
+				continue
+			}
+			ones, bits := kept[i].Mask.Size()
+			for j := i + 1; j < len(kept) && ones > 0; j++ {
+				onesJ, bitsJ := kept[j].Mask.Size()
+				if merged[j] || onesJ != ones || bitsJ != bits {
+					continue
+				}
+				parent := net.CIDRMask(ones-1, bits)
+				if kept[i].IP.Mask(parent).Equal(kept[j].IP.Mask(parent)) {
+					result = append(result, net.IPNet{IP: kept[i].IP.Mask(parent), Mask: parent})
+					merged[i], merged[j], changed = true, true, true
+					break
+				}
+			}
+			if !merged[i] {
+				result = append(result, kept[i])
+			}
+		}
+	}
+
+	return result
+}
+
+// allowedIPsQrHint explains when a dense QR code is mostly caused by a long AllowedIPs list, and
+// suggests the collapsed list if it is shorter. It returns an empty string otherwise.
+func (config *appConfig) allowedIPsQrHint(index int) string {
+	client := config.Clients[index]
+	if len(client.Peers) == 0 || len(client.String()) <= denseQrContentSize {
+		return ""
+	}
+
+	allowedIPs := client.Peers[0].AllowedIPs
+	var entries []string
+	for _, network := range allowedIPs {
+		entries = append(entries, network.String())
+	}
+	size := len(strings.Join(entries, ", "))
+	if size*3 < len(client.String()) {
+		return ""
+	}
+
+	hint := fmt.Sprintf("The %d AllowedIPs entries make up %d of the %d bytes of the configuration, "+
+		"which makes the QR code dense.\n", len(allowedIPs), size, len(client.String()))
+
+	collapsed := collapseAllowedIPs(allowedIPs)
+	if len(collapsed) < len(allowedIPs) {
+		entries = nil
+		for _, network := range collapsed {
+			entries = append(entries, network.String())
+		}
+		hint += fmt.Sprintf("They collapse into %d equivalent entries:\n\twg-quick-config set-client %d allowedips=%s\n",
+			len(collapsed), index+1, strings.Join(entries, ","))
+	} else {
+		hint += "Consider routing fewer, wider networks through the tunnel.\n"
+	}
+
+	return hint
+}
@@ -1,16 +1,83 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
+	"path/filepath"
 	"strings"
 )
 
 type appConfig struct {
-	Server  WireguardConfig
-	Clients []WireguardConfig
+	// SchemaVersion is the version of the config.json layout, see stateSchemaVersion.
+	SchemaVersion int `json:",omitempty"`
+	Server        WireguardConfig
+	Clients       []WireguardConfig
+	ClientsInfo   []clientInfo    `json:",omitempty"`
+	Defaults      *clientDefaults `json:",omitempty"`
+	// WrittenBy is the version of wg-quick-config that last saved the configuration.
+	WrittenBy string `json:",omitempty"`
+	// FileHashes maps the names of the generated files to the SHA-256 hash of their content.
+	FileHashes map[string]string `json:",omitempty"`
+	// Template is the path of the text/template used to render the configuration files, if any.
+	Template string `json:",omitempty"`
+	// ServerConfigFile is the file name of the server configuration if chosen explicitly, see
+	// serverConfigFile.
+	ServerConfigFile string `json:",omitempty"`
+	// Instance is the name of the instance the artifacts of namingSchemeInstance carry.
+	Instance string `json:",omitempty"`
+	// NamingScheme is the naming scheme of the artifacts on the host, e.g. the tunnel service. It is
+	// namingSchemeLegacy for profiles created before instances were named, see artifactName.
+	NamingScheme int `json:",omitempty"`
+	// NotesInConfig stores the notes of 'set-note' as peer comments in the server configuration
+	// file instead of config.json only.
+	NotesInConfig bool `json:",omitempty"`
+	// PortSelection records how the server port was chosen, e.g. from the service range, for the
+	// setup summary. See selectServerPort.
+	PortSelection string `json:",omitempty"`
+	// EndpointSource records where the address of the endpoint came from, e.g. the cloud metadata
+	// service, for the setup summary. See detectExternalIPWithSource.
+	EndpointSource string `json:",omitempty"`
+	// BindAddress is the local address the server is meant to listen on, for hosts with several
+	// network interfaces. Empty listens on all addresses. See CheckUdpPortOnAddress.
+	BindAddress string `json:",omitempty"`
+	// SecondaryEndpoints are alternate endpoints of the server, e.g. a static IPv6 address next to
+	// a DDNS name, documented as comments in the client configurations. See set-endpoint.
+	SecondaryEndpoints []string `json:",omitempty"`
+	// ClientFileEncryption is set when the client config files are encrypted at rest, see
+	// encrypt-files.
+	ClientFileEncryption *clientFileEncryption `json:",omitempty"`
+	// AllowOutOfTunnelDns silences the warnings about client DNS servers not routed through the
+	// tunnel, for setups that intentionally resolve outside of it. See dnsWarnings.
+	AllowOutOfTunnelDns bool `json:",omitempty"`
+	// NatInterface is the outbound interface of the masquerade rules emitted as PostUp and
+	// PostDown commands of a Linux server, no rules are emitted if empty. See natRules.
+	NatInterface string `json:",omitempty"`
+	// AllocationOffset is the host number of the first address assigned by addClient, reserving
+	// the addresses below it, e.g. for infrastructure. 0 allocates right after the server.
+	AllocationOffset int `json:",omitempty"`
+	// Groups are the client groups with their defaults, see clientGroup.
+	Groups []clientGroup `json:",omitempty"`
+	// DDNS configures the dynamic DNS hostname updated by 'ddns update', see ddnsSettings.
+	DDNS *ddnsSettings `json:",omitempty"`
+	// EndpointManagedBy is the endpoint policy set with 'set-server endpoint-managed-by=...', empty
+	// to derive it from the endpoint. See endpointPolicy.
+	EndpointManagedBy string `json:",omitempty"`
+	// Relay is set when the clients reach the server through a relay, e.g. a VPS forwarding the
+	// UDP traffic to a server behind carrier-grade NAT. See relaySettings.
+	Relay *relaySettings `json:",omitempty"`
+	// DetectedIP is the external IP address seen by the last check of 'watch-endpoint'.
+	DetectedIP string `json:",omitempty"`
+	// ServiceInstalled is set once the tunnel service has been installed with -start.
+	ServiceInstalled bool `json:",omitempty"`
+	// SystemChanges records the modifications of the system reverted by 'cleanup', oldest first.
+	SystemChanges []SystemChange `json:",omitempty"`
+	// PendingSteps are the privileged steps deferred until 'finish --elevated', oldest first.
+	PendingSteps []PendingStep `json:",omitempty"`
+	// Unapplied are the operations staged with -apply=false, oldest first, see stageChange.
+	Unapplied []unappliedChange `json:",omitempty"`
 }
 
 const defaultWireguardSubnet = "10.9.0.0/24"
@@ -20,10 +87,53 @@ const defaultMtu = 1420
 const defaultPersistentKeepalive = 25
 const defaultClientConfigFile = "wsclient_%d.conf"
 const defaultServerConfigFile = "wiresock.conf"
+const defaultAppConfigFile = "config.json"
+
+// loadAppConfig reads and decodes the application configuration stored as config.json in the
+// given configuration directory and migrates it to the current schema version. Comments added
+// to the server peers by hand are picked up from the server configuration file.
+func loadAppConfig(configPath string) (appConfig, error) {
+	var config appConfig
+
+	jsonConfig, err := ioutil.ReadFile(configPath + defaultAppConfigFile)
+	if err != nil {
+		return config, err
+	}
+
+	if err = json.Unmarshal(jsonConfig, &config); err != nil {
+		return config, err
+	}
+
+	if err = migrateAppConfig(&config); err != nil {
+		return config, err
+	}
+
+	config.absorbServerFileComments(configPath)
+	return config, nil
+}
+
+// save encodes the application configuration and stores it as config.json in the given
+// configuration directory, always using the current schema version. The setup summary files
+// are regenerated along with it.
+func (config *appConfig) save(configPath string) error {
+	config.SchemaVersion = stateSchemaVersion
+	config.WrittenBy = version
+	jsonConfig, err := json.MarshalIndent(config, "", " ")
+	if err != nil {
+		return err
+	}
+
+	if err = writeFileAtomic(configPath+defaultAppConfigFile, jsonConfig, 0666); err != nil {
+		return err
+	}
+
+	return config.writeSetupSummary(configPath)
+}
 
 // clientIpNetToPeer converts a slice of IP networks into a slice of peer IP addresses.
-// This function takes each IP network in the address slice, applies a /32 subnet mask to it
-// to create a peer IP address (indicating a single host), and then appends it to the new slice.
+// This function takes each IP network in the address slice, applies a /32 subnet mask to it,
+// /128 for an IPv6 address, to create a peer IP address (indicating a single host), and then
+// appends it to the new slice.
 //
 // Parameters:
 //     address ([]net.IPNet): Slice of IP networks that are to be converted to peer IP addresses.
@@ -40,6 +150,9 @@ func clientIpNetToPeer(address []net.IPNet) []net.IPNet {
 			IP:   ip.IP,
 			Mask: net.CIDRMask(32, 32),
 		}
+		if ip.IP.To4() == nil {
+			ipNet.Mask = net.CIDRMask(128, 128)
+		}
 		peerIpAddress = append(peerIpAddress, ipNet)
 	}
 
@@ -56,17 +169,9 @@ func clientIpNetToPeer(address []net.IPNet) []net.IPNet {
 // It then asks the user to input a Wireguard IPv4 subnet, using a default subnet if the user
 // does not input anything.
 //
-// It determines the server and client IP addresses within the Wireguard subnet and parses
-// the default allowed IPs which the client can connect to when the VPN is active.
-//
-// It generates a pair of private keys for the server and the client using the
-// newWireguardPrivateKey function.
-//
-// The function then uses the generated keys, IP addresses, endpoint, and other parameters to
-// create the server and client configurations.
-//
-// For the client configuration, it sets the DNS servers, the Maximum Transmission Unit (MTU),
-// and the persistent keepalive interval.
+// The server and the first client are then created by initialize, and the user is asked for the
+// name of the server configuration file unless the configuration already has one. In a named
+// profile the file, and so the tunnel, is named after the instance by default, see setInstance.
 //
 // It then updates the appConfig structure with the new server and client configurations.
 //
@@ -78,65 +183,117 @@ func clientIpNetToPeer(address []net.IPNet) []net.IPNet {
 //   works correctly, it returns nil.
 func newConfig(config *appConfig) error {
 
-	endpoint, serverPort := configureWireguardEndpoint()
+	endpoint, serverPort, portSelection, endpointSource := configureWireguardEndpoint()
 
-	subnetAddressIpv4, subnetAddressIpv4Net, err := configureWireguardSubnet()
+	serverAddressIpv4, subnetAddressIpv4Net, err := configureWireguardSubnet()
 
 	if err != nil {
 		return err
 	}
 
+	created := appConfig{
+		Defaults:       config.Defaults,
+		PortSelection:  portSelection,
+		EndpointSource: endpointSource,
+		BindAddress:    bindAddress,
+	}
+	if err = created.initialize(endpoint, serverPort, serverAddressIpv4, subnetAddressIpv4Net); err != nil {
+		return err
+	}
+
+	// A named profile is an instance next to the default one, its artifacts carry its name
+	if profileName != "" && profileName != defaultProfileName && configPathOverride == "" {
+		created.setInstance(profileName)
+	}
+
+	serverConfigFile := config.ServerConfigFile
+	if serverConfigFile == "" {
+		serverConfigFile = configureServerConfigFile(created.serverConfigFile())
+	}
+	if serverConfigFile == created.serverConfigFile() {
+		serverConfigFile = ""
+	}
+	created.ServerConfigFile = serverConfigFile
+
+	*config = created
+
+	return nil
+}
+
+// initialize creates the server and the first client of a new configuration without any user
+// interaction, replacing the server and the clients of the configuration. The server gets the
+// given address and the first client the address following it.
+//
+// It generates a pair of private keys for the server and the client using the
+// newWireguardPrivateKey function.
+//
+// For the client configuration, it sets the DNS servers, the Maximum Transmission Unit (MTU),
+// the allowed IPs and the persistent keepalive interval from the instance defaults (see
+// effectiveDefaults). The server uses the same MTU as the clients to avoid fragmentation.
+//
+// Parameters:
+//     endpoint (string): The server endpoint the client connects to, host:port.
+//     serverPort (int): The UDP port the server listens on.
+//     serverAddress (net.IP): The tunnel address of the server within the subnet.
+//     subnet (*net.IPNet): The Wireguard IPv4 subnet.
+//
+// Returns:
+//     error: A validation error if the port is invalid, the server address isn't a host address of
+//         the subnet or the subnet has no room for a client, see checkHostAddress.
+//
+// Usage:
+//     err := config.initialize("vpn.example.com:51820", 51820, serverIP, subnet)
+func (config *appConfig) initialize(endpoint string, serverPort int, serverAddress net.IP, subnet *net.IPNet) error {
 	serverAddressIpv4Net := net.IPNet{
-		IP:   NextIP(subnetAddressIpv4),
-		Mask: subnetAddressIpv4Net.Mask,
+		IP:   serverAddress,
+		Mask: subnet.Mask,
 	}
 
 	clientAddressIpv4Net := net.IPNet{
 		IP:   NextIP(serverAddressIpv4Net.IP),
-		Mask: subnetAddressIpv4Net.Mask,
+		Mask: subnet.Mask,
 	}
 
-	_, allowedIpv4Net, _ := net.ParseCIDR(defaultAllowedIps)
-
-	allowedIPs := make([]net.IPNet, 1, 1)
-	allowedIPs[0] = *allowedIpv4Net
+	// Every derived address must be a host address of the subnet, checked before any key is generated
+	if ones, bits := subnet.Mask.Size(); bits-ones < 2 {
+		return newError(errValidation, "the subnet %s is too small, it needs room for the server and a client", subnet.String())
+	}
+	if err := checkHostAddress("server address", serverAddress, *subnet); err != nil {
+		return err
+	}
+	if checkHostAddress("client address", clientAddressIpv4Net.IP, *subnet) != nil {
+		return newError(errValidation, "server address %s leaves no room for clients in %s",
+			serverAddress.String(), subnet.String())
+	}
 
 	clientAddress := make([]net.IPNet, 1, 1)
 	clientAddress[0] = clientAddressIpv4Net
 
 	peerIpAddress := clientIpNetToPeer(clientAddress)
 
-	serverAddress := make([]net.IPNet, 1, 1)
-	serverAddress[0] = serverAddressIpv4Net
+	serverAddresses := make([]net.IPNet, 1, 1)
+	serverAddresses[0] = serverAddressIpv4Net
 
 	server, _ := newWireguardPrivateKey()
 	client, _ := newWireguardPrivateKey()
 
-	serverConfig := NewWireguardServerConfig(server.base64PrivateKey(), serverAddress, uint16(serverPort))
+	serverConfig := NewWireguardServerConfig(server.base64PrivateKey(), serverAddresses, 0)
+	if err := serverConfig.SetListenPort(serverPort); err != nil {
+		return err
+	}
 	serverConfig.AddPeer(client.base64PublicKey(), peerIpAddress)
 
 	clientConfig := NewWireguardClientConfig(client.base64PrivateKey(), clientAddress,
-		server.base64PublicKey(), allowedIPs, endpoint)
-
-	dns := strings.Split(defaultDns, ",")
-	clientConfig.DNS = make([]net.IP, 0, len(dns))
-	for i := range dns {
-		dns[i] = strings.TrimSpace(dns[i])
-		ip := net.ParseIP(dns[i])
-		if ip != nil && ip.To4() != nil {
-			clientConfig.DNS = append(clientConfig.DNS, net.ParseIP(dns[i]))
-		}
-	}
-
-	clientConfig.MTU = defaultMtu
-	clientConfig.Peers[0].PersistentKeepalive = defaultPersistentKeepalive
+		server.base64PublicKey(), nil, endpoint)
 
-	*config = appConfig{
-		Server:  serverConfig,
-		Clients: nil,
-	}
+	// Apply DNS, MTU, AllowedIPs and keepalive from the instance defaults
+	config.effectiveDefaults().applyTo(&clientConfig)
+	serverConfig.MTU = clientConfig.MTU
 
-	config.Clients = append(config.Clients, clientConfig)
+	config.Server = serverConfig
+	config.Clients = []WireguardConfig{clientConfig}
+	config.ClientsInfo = nil
+	config.ensureServerAddressAllowed(&config.Clients[0])
 
 	return nil
 }
@@ -144,35 +301,43 @@ func newConfig(config *appConfig) error {
 // addClient is a method on the appConfig struct that adds a new client to the Wireguard VPN setup.
 // It first retrieves the configuration of the last client in the list to use as a base for the new client configuration.
 // A new private key is generated for the new client using the newWireguardPrivateKey function.
-// The IP address for the new client is calculated based on the IP of the last client, ensuring that it remains within the allowed subnet.
-// If the new IP address falls outside the subnet's capacity, the program is terminated with an error message.
+// The IP address for the new client follows the highest address in use in every tunnel subnet of the server, IPv4 and IPv6 for dual-stack (see nextFreeAddress).
+// Addresses below the start of the client pool (see allocationStart) are skipped, and addresses freed below the highest one are reused once the subnet end is reached.
+// If a subnet has no free address left, a resource conflict error is returned and the configuration is left unchanged.
 // Once the IP address is successfully allocated, a new client configuration is created. This configuration includes the new IP address and subnet mask,
 // and the private key generated earlier. The new client is then added as a peer to the server configuration.
 // Finally, the newly created client configuration is added to the list of clients in the appConfig.
-func (config *appConfig) addClient() {
+func (config *appConfig) addClient() error {
 	// Get the configuration of the last client
 	clientConfig := config.Clients[len(config.Clients)-1]
+	clientConfig.Peers = append([]Peer(nil), clientConfig.Peers...)
 
 	// Generate a new private key for the new client
 	client, _ := newWireguardPrivateKey()
 
-	// Compute the IP address of the new client
-	clientIpNet := net.IPNet{
-		IP:   nil,
-		Mask: nil,
-	}
-	clientIpNet.IP = NextIP(clientConfig.Address[0].IP)
-	clientIpNet.Mask = clientConfig.Address[0].Mask
+	// Allocate an address in every tunnel subnet of the server, both families for dual-stack
+	addresses := make([]net.IPNet, 0, len(config.Server.Address))
+	for _, subnet := range config.serverSubnets() {
+		ip, err := config.nextFreeAddress(subnet)
+		if err != nil {
+			return err
+		}
 
-	// Check if the new IP address is within the allowed subnet
-	if !clientConfig.Address[0].Contains(clientIpNet.IP) ||
-		!clientConfig.Address[0].Contains(NextIP(clientIpNet.IP)) {
-		log.Fatalf("Cant't allocate IP address. Subnet capacity has been reached!")
+		// Keep the prefix length and the address form the clients have in this subnet
+		clientIpNet := net.IPNet{IP: ip, Mask: subnet.Mask}
+		for _, address := range clientConfig.Address {
+			if subnet.Contains(address.IP) {
+				clientIpNet.Mask = address.Mask
+				if len(address.IP) == net.IPv6len {
+					clientIpNet.IP = ip.To16()
+				}
+			}
+		}
+		addresses = append(addresses, clientIpNet)
 	}
 
 	// Create the client configuration for the new client
-	clientConfig.Address = make([]net.IPNet, 0, 1)
-	clientConfig.Address = append(clientConfig.Address, clientIpNet)
+	clientConfig.Address = addresses
 
 	peerIpAddress := clientIpNetToPeer(clientConfig.Address)
 
@@ -182,8 +347,14 @@ func (config *appConfig) addClient() {
 	// Set the private key of the new client
 	clientConfig.PrivateKey = client.base64PrivateKey()
 
+	// Apply DNS, MTU, AllowedIPs and keepalive from the instance defaults
+	config.effectiveDefaults().applyTo(&clientConfig)
+	config.ensureServerAddressAllowed(&clientConfig)
+
 	// Add the new client to the Clients list
 	config.Clients = append(config.Clients, clientConfig)
+
+	return nil
 }
 
 // updateWireguardConfigFiles is a method on the appConfig struct that updates the Wireguard VPN configuration files.
@@ -194,39 +365,216 @@ func (config *appConfig) addClient() {
 // If the operation is successful, a confirmation message is printed to the console.
 // The same process is then repeated for the server configuration.
 // As a result, both the client and server configuration files in the specified path are updated with the latest information.
+// Nothing is written if the configuration fails validation, see Validate, or uses WireSock features
+// the installed version lacks, see checkWireSockFeatures.
 func (config *appConfig) updateWireguardConfigFiles(configPath string) {
-	clientFileName := fmt.Sprintf(defaultClientConfigFile, len(config.Clients))
+	if problems := config.Validate(); len(problems) > 0 {
+		fatal(fmt.Errorf("refusing to write a configuration that isn't deployable: %w", validationFailure(problems)))
+	}
+	if err := config.checkWireSockFeatures(); err != nil {
+		fatal(fmt.Errorf("refusing to write a configuration the installed WireSock rejects: %w", err))
+	}
 
-	err := ioutil.WriteFile(configPath+clientFileName, []byte(config.Clients[len(config.Clients)-1].String()), 0666)
+	clientFileName, err := config.writeClientConfigFile(configPath, len(config.Clients)-1)
 
 	if err != nil {
-		log.Fatalf("\nCant't write client config into %s!", configPath+clientFileName)
+		fatal(newError(errIO, "can't write client config into %s: %w", clientFileName, err))
 	} else {
-		fmt.Println("\nSuccessfully saved client configuration:", configPath+clientFileName)
+		fmt.Println("\n" + config.savedMessage("client configuration", clientFileName))
 	}
 
-	err = ioutil.WriteFile(configPath+defaultServerConfigFile, []byte(config.Server.String()), 0666)
+	serverFileName, err := config.writeServerConfigFile(configPath)
 
 	if err != nil {
-		log.Fatalf("\nCant't update server config in %s!", configPath+defaultServerConfigFile)
+		fatal(newError(errIO, "can't update server config in %s: %w", serverFileName, err))
 	} else {
-		fmt.Println("\nSuccessfully saved server configuration:", configPath+defaultServerConfigFile)
+		fmt.Println("\n" + config.savedMessage("server configuration", serverFileName))
+	}
+}
+
+// writeClientConfigFile writes the configuration file of the client with the given zero-based
+// index into the specified path and returns the full name of the written file. The file is
+// encrypted if client file encryption is on, see sealClientFile. A staged change is only rendered
+// and checked, the file is written by 'apply', see staged. Behind a relay a client without
+// PersistentKeepalive is refused, see checkRelayKeepalive.
+func (config *appConfig) writeClientConfigFile(configPath string, index int) (string, error) {
+	clientFileName := configPath + fmt.Sprintf(defaultClientConfigFile, index+1)
+	if err := config.checkRelayKeepalive(index); err != nil {
+		return clientFileName, fmt.Errorf("client %d: %w", index+1, err)
+	}
+
+	client := config.clientFileConfig(index)
+	content, err := config.renderConfig(client)
+	if err == nil {
+		err = config.checkRenderedConfig(clientFileName, client, content)
+	}
+	if err == nil && config.ClientFileEncryption != nil {
+		content, err = config.sealClientFile(filepath.Base(clientFileName), provenanceHeader+content, index)
+	}
+	if err != nil {
+		return clientFileName, err
+	}
+
+	if config.staged() {
+		return clientFileName, nil
+	}
+
+	hash, err := writeGeneratedFile(clientFileName, content, 0666)
+	if err != nil {
+		return clientFileName, fmt.Errorf("can't write client config into %s: %w", clientFileName, err)
+	}
+	config.recordFileHash(clientFileName, hash)
+
+	return clientFileName, nil
+}
+
+// writeServerConfigFile writes the server configuration file into the specified path and returns
+// the full name of the written file. Like writeClientConfigFile it leaves the file of a staged
+// change to 'apply'.
+func (config *appConfig) writeServerConfigFile(configPath string) (string, error) {
+	serverFileName := configPath + config.serverConfigFile()
+
+	server := config.serverFileConfig()
+	content, err := config.renderConfig(server)
+	if err == nil {
+		err = config.checkRenderedConfig(serverFileName, server, content)
+	}
+	if err != nil {
+		return serverFileName, err
+	}
+
+	if config.staged() {
+		return serverFileName, nil
+	}
+
+	hash, err := writeGeneratedFile(serverFileName, content, 0666)
+	if err != nil {
+		return serverFileName, fmt.Errorf("can't update server config in %s: %w", serverFileName, err)
+	}
+	config.recordFileHash(serverFileName, hash)
+
+	return serverFileName, nil
+}
+
+// writeAllWireguardConfigFiles regenerates the server configuration file and the configuration
+// files of all the clients in the specified path. The configuration is validated first, along with
+// the WireSock features it uses (see checkWireSockFeatures), and unlike
+// updateWireguardConfigFiles it does not terminate the program on failure but returns the first
+// error encountered. The files of pinned clients are left alone, see skipPinned.
+func (config *appConfig) writeAllWireguardConfigFiles(configPath string) error {
+	if problems := config.Validate(); len(problems) > 0 {
+		return fmt.Errorf("refusing to regenerate a configuration that isn't deployable, see 'fsck': %w",
+			validationFailure(problems))
+	}
+	if err := config.checkWireSockFeatures(); err != nil {
+		return fmt.Errorf("refusing to regenerate a configuration the installed WireSock rejects: %w", err)
+	}
+
+	for i := range config.Clients {
+		if config.skipPinned(configPath, i) {
+			continue
+		}
+		clientFileName, err := config.writeClientConfigFile(configPath, i)
+		if err != nil {
+			return err
+		}
+		fmt.Println(config.savedMessage("client configuration", clientFileName))
+	}
+
+	serverFileName, err := config.writeServerConfigFile(configPath)
+	if err != nil {
+		return err
 	}
+	fmt.Println(config.savedMessage("server configuration", serverFileName))
+
+	return nil
 }
 
 // showClientQrCode is a method on the appConfig struct that generates and displays a QR code from a client's configuration.
 // It takes an integer parameter, index, which corresponds to the index of the client in the Clients slice of the appConfig instance.
-// It starts by encoding the client configuration into a QR code string using the QREncodeToSmallString function.
+// It starts by encoding the client configuration into QR code art with EncodeQR, at error correction low, which keeps
+// the code small enough to scan from a terminal.
+// The QR code holds the wg-quick profile of the configuration (see ForProfile), since the mobile apps reject unknown keys.
 // If there is no error in the encoding process, it prints the generated QR code to the console.
-// If there is an error, it prints an error message indicating that the QR code could not be generated.
+// If the QR code would exceed the version cap set with -qrmaxversion, it recommends transferring the file instead,
+// and offers to show the configuration as a multi-part QR code, see splitQrFrames.
+// If the configuration is dense mostly because of its AllowedIPs, it suggests collapsing them first (see allowedIPsQrHint).
+// If there is another error, it prints an error message indicating that the QR code could not be generated.
+// In verbose mode the payload size, QR code version and a redacted preview are printed first, see printQrPayloadDetails.
+// For a client with an external key it explains why and prints the peer stub of the configuration instead, everything
+// but the PrivateKey, to be completed on the device.
 func (config *appConfig) showClientQrCode(index int) {
-	qr, err := QREncodeToSmallString(config.Clients[index].String(), false, false)
+	if config.Clients[index].PrivateKey == "" {
+		fmt.Printf("\nClient %d has an external key, %s, so its complete configuration can't be shown as QR code.\n",
+			index+1, config.externalKeyReason(index))
+		fmt.Println("Peer stub to complete on the device, add its PrivateKey to the [Interface] section:")
+		fmt.Print(config.clientFileConfig(index).String())
+		return
+	}
+
+	content, warnings := config.mobileQrContent(index)
+	for _, warning := range warnings {
+		fmt.Println("Note:", warning)
+	}
+	qr, err := EncodeQR(content, QROptions{Level: qrCodeLevel, MinLevel: qrCodeLevel, MaxVersion: maxQrVersion})
+
+	// A dense QR code is usually caused by a long AllowedIPs list
+	if hint := config.allowedIPsQrHint(index); hint != "" {
+		fmt.Print("\n" + hint)
+	}
+
+	if verboseMode {
+		fmt.Println()
+		printQrPayloadDetails(content)
+	}
 
 	fmt.Println("\nClient configuration QR code to scan on mobile device:")
 
 	if err == nil {
-		fmt.Print(qr)
+		fmt.Print(qr.Art)
+	} else if errors.Is(err, errQrCodeTooLarge) {
+		fmt.Printf("The client configuration is too long for a scannable QR code (%s).\n", err)
+		fmt.Printf("Transfer the %s file to the device instead, or print it with -text.\n",
+			fmt.Sprintf(defaultClientConfigFile, index+1))
+		// The parts are reassembled with 'join-qr' on the receiving side, the mobile apps can't
+		frames := splitQrFrames(content, qrFrameSize)
+		if !quietMode && askConfirmation(fmt.Sprintf("Show it as %d QR codes to scan one after another?", len(frames))) {
+			if err = showQrFrames(frames); err != nil {
+				fmt.Println("Failed to generate the QR codes from the client configuration!")
+			}
+		}
 	} else {
 		fmt.Println("Failed to generate the QR code from the client configuration!")
 	}
 }
+
+// showClientConfigAndQrCode is a method on the appConfig struct that prints both the configuration text
+// and the QR code of a client, for onboarding remote devices over a terminal session where the QR code
+// may not scan and the text has to be copied instead.
+// The two parts are delimited by separators, preceded by a warning that the text contains the private key.
+// The text is the client file as writeClientConfigFile renders it, through the config template and
+// with the provenance header, before it is encrypted for ClientFileEncryption.
+func (config *appConfig) showClientConfigAndQrCode(index int) {
+	separator := strings.Repeat("=", 64)
+	if config.Clients[index].PrivateKey == "" {
+		// There is no private key to warn about, the stub is printed instead of the QR code
+		config.showClientQrCode(index)
+		return
+	}
+	content, err := config.renderConfig(config.clientFileConfig(index))
+	if err != nil {
+		fmt.Println("Failed to render the client configuration:", err)
+		return
+	}
+
+	fmt.Println("\n" + separator)
+	fmt.Println("WARNING: the configuration below contains the client private key.")
+	fmt.Println("Only share it over a trusted channel and clear your terminal afterwards.")
+	fmt.Println(separator)
+	fmt.Print(provenanceHeader + content)
+	fmt.Println(separator)
+
+	config.showClientQrCode(index)
+
+	fmt.Println(separator)
+}
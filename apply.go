@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// appliedStateFile keeps the last applied config.json while changes are staged, the state the
+// configuration files on disk and the running tunnel match. See stageChange.
+const appliedStateFile = "config.applied.json"
+
+// unappliedChange is a mutating operation staged with -apply=false: config.json holds its result,
+// its configuration files aren't written until 'apply'.
+type unappliedChange struct {
+	Operation string
+	Time      time.Time
+}
+
+// staged tells whether the changes to the configuration are staged rather than written to the
+// configuration files right away: with -apply=false, and as long as earlier staged changes are
+// pending, so that the files never mix applied and unapplied changes.
+func (config *appConfig) staged() bool {
+	return !applyChanges || len(config.Unapplied) > 0
+}
+
+// savedMessage returns the message printed once a configuration file is written, or found valid
+// and left for 'apply' when the change is staged.
+func (config *appConfig) savedMessage(kind string, fileName string) string {
+	if config.staged() {
+		return fmt.Sprintf("Staged %s: %s", kind, fileName)
+	}
+
+	return fmt.Sprintf("Successfully saved %s: %s", kind, fileName)
+}
+
+// stageChange records a staged operation before config.json is saved, see saveWithHistory. The
+// first staged change keeps the applied config.json as appliedStateFile, which 'discard' restores.
+//
+// Parameters:
+//     configPath (string): The profile directory.
+//     operation (string): The name of the mutating operation.
+//     previous (appConfig): The configuration stored before the operation.
+//
+// Returns:
+//     error: An error if the applied state can't be kept.
+//
+// Usage:
+//     err := config.stageChange(configPath, "set-client", previous)
+func (config *appConfig) stageChange(configPath string, operation string, previous appConfig) error {
+	if len(previous.Unapplied) == 0 {
+		content, err := ioutil.ReadFile(configPath + defaultAppConfigFile)
+		if err != nil {
+			return err
+		}
+		if err = writeFileAtomic(configPath+appliedStateFile, content, 0600); err != nil {
+			return fmt.Errorf("can't keep the applied configuration: %w", err)
+		}
+	}
+	config.Unapplied = append(previous.Unapplied, unappliedChange{Operation: operation, Time: time.Now().UTC()})
+
+	fmt.Printf("Staged '%s', %d changes pending: run 'apply' to write the configuration files or 'discard' to drop them.\n",
+		operation, len(config.Unapplied))
+	return nil
+}
+
+// loadAppliedState reads the configuration kept by stageChange, the last applied one.
+func loadAppliedState(configPath string) (appConfig, error) {
+	var config appConfig
+
+	content, err := ioutil.ReadFile(configPath + appliedStateFile)
+	if err != nil {
+		return config, err
+	}
+	if err = json.Unmarshal(content, &config); err != nil {
+		return config, err
+	}
+
+	return config, migrateAppConfig(&config)
+}
+
+// pendingChanges describes the staged changes for 'status': the operations and what they change
+// in the configuration files, compared to the applied configuration.
+type pendingChanges struct {
+	Operations []unappliedChange
+	// Clients lists the clients whose configuration file changes, e.g. "client 3 added".
+	Clients []string
+	// ServerDiff is the unified diff of the server configuration file.
+	ServerDiff string `json:",omitempty"`
+	// PendingSteps are the privileged steps waiting for 'finish --elevated'.
+	PendingSteps []string `json:",omitempty"`
+}
+
+// String prints the operations, the changed files and the server configuration diff.
+func (pending pendingChanges) String() string {
+	result := ""
+	if len(pending.Operations) == 0 {
+		result += "No unapplied changes, the configuration files match config.json.\n"
+	} else {
+		result += fmt.Sprintf("%d unapplied changes, run 'apply' to write them or 'discard' to drop them:\n",
+			len(pending.Operations))
+		for _, change := range pending.Operations {
+			result += fmt.Sprintf("  %s  %s\n", change.Time.Local().Format("2006-01-02 15:04:05"), change.Operation)
+		}
+		for _, client := range pending.Clients {
+			result += "  " + client + "\n"
+		}
+		if pending.ServerDiff != "" {
+			result += "Server configuration:\n" + pending.ServerDiff
+		}
+	}
+	for _, step := range pending.PendingSteps {
+		result += "Deferred until elevated: " + step + "\n"
+	}
+
+	return result
+}
+
+// pendingChanges compares the working configuration with the applied one kept by stageChange.
+func (config *appConfig) pendingChanges(configPath string) pendingChanges {
+	pending := pendingChanges{Operations: config.Unapplied}
+	for _, step := range config.PendingSteps {
+		pending.PendingSteps = append(pending.PendingSteps, step.String())
+	}
+	applied, err := loadAppliedState(configPath)
+	if len(config.Unapplied) == 0 || err != nil {
+		return pending
+	}
+
+	render := func(c *appConfig, index int) string {
+		if index >= len(c.Clients) {
+			return ""
+		}
+		content, _ := c.renderConfig(c.clientFileConfig(index))
+		return content
+	}
+	clients := len(config.Clients)
+	if len(applied.Clients) > clients {
+		clients = len(applied.Clients)
+	}
+	for i := 0; i < clients; i++ {
+		switch before, after := render(&applied, i), render(config, i); {
+		case before == "":
+			pending.Clients = append(pending.Clients, fmt.Sprintf("client %d added", i+1))
+		case after == "":
+			pending.Clients = append(pending.Clients, fmt.Sprintf("client %d removed", i+1))
+		case before != after:
+			pending.Clients = append(pending.Clients, fmt.Sprintf("client %d changed", i+1))
+		}
+	}
+
+	before, _ := applied.renderConfig(applied.serverFileConfig())
+	after, _ := config.renderConfig(config.serverFileConfig())
+	if before != after {
+		pending.ServerDiff = unifiedDiff(applied.serverConfigFile(), config.serverConfigFile(), before, after)
+	}
+
+	return pending
+}
+
+// runStatusCommand implements the 'status' command, which lists the changes staged with
+// -apply=false that 'apply' would write, and the privileged steps waiting for 'finish':
+//
+//     status
+//     -format json status
+func runStatusCommand(configPath string, args []string) error {
+	if len(args) != 0 {
+		return newError(errUsage, "usage: status")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	pending := config.pendingChanges(configPath)
+	printResult(pending.String(), pending)
+	return nil
+}
+
+// runApplyCommand implements the 'apply' command, which writes the changes staged with
+// -apply=false in one step: every configuration file is rendered and validated, written
+// atomically, the files of removed clients are deleted, and an installed tunnel service is
+// restarted once to load the new server configuration:
+//
+//     -apply=false set-client 2 dns=10.9.0.1
+//     -apply=false set-client 3 mtu=1280
+//     apply
+//     apply --no-restart
+//
+// Nothing is written if the configuration fails validation, the changes stay staged.
+func runApplyCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("apply", flag.ContinueOnError)
+	noRestart := flags.Bool("no-restart", false, "Don't restart the tunnel service, e.g. to restart it later with -restart")
+	if err := parseFlags(flags, "apply", args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return newError(errUsage, "usage: apply [--no-restart]")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	if len(config.Unapplied) == 0 {
+		fmt.Println("Nothing to apply, the configuration files match config.json.")
+		return nil
+	}
+	applied, appliedErr := loadAppliedState(configPath)
+
+	// The files are written from the working copy, which becomes the applied state
+	operations := config.Unapplied
+	config.Unapplied = nil
+	applyChanges = true
+	if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+		return err
+	}
+	if appliedErr == nil {
+		// The files of removed clients still hold their private keys
+		for i := len(config.Clients); i < len(applied.Clients); i++ {
+			secureDelete(configPath + fmt.Sprintf(defaultClientConfigFile, i+1))
+		}
+		if applied.serverConfigFile() != config.serverConfigFile() {
+			os.Remove(configPath + applied.serverConfigFile())
+		}
+	}
+	if err = config.save(configPath); err != nil {
+		return newError(errIO, "failed to store the application configuration: %w", err)
+	}
+	os.Remove(configPath + appliedStateFile)
+
+	var names []string
+	for _, change := range operations {
+		names = append(names, change.Operation)
+	}
+	if err = appendAuditLog(configPath, "apply", map[string]interface{}{"Operations": names}); err != nil {
+		return newError(errIO, "failed to write the audit log: %w", err)
+	}
+	fmt.Printf("Applied %d changes: %s.\n", len(operations), strings.Join(names, ", "))
+
+	if !config.ServiceInstalled || *noRestart {
+		return nil
+	}
+	if err = checkTunnelDependencies(); err != nil {
+		return err
+	}
+	config.runPrivilegedStep(configPath, stepStopTunnel)
+	time.Sleep(time.Second)
+	startErr := config.runPrivilegedStep(configPath, stepStartTunnel)
+	if err = config.save(configPath); err != nil {
+		return newError(errIO, "failed to store the application configuration: %w", err)
+	}
+
+	return startErr
+}
+
+// runDiscardCommand implements the 'discard' command, which drops the changes staged with
+// -apply=false by restoring the last applied configuration. The configuration files were never
+// written, so only config.json changes; 'undo' brings the discarded changes back.
+func runDiscardCommand(configPath string, args []string) error {
+	if len(args) != 0 {
+		return newError(errUsage, "usage: discard")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	if len(config.Unapplied) == 0 {
+		fmt.Println("Nothing to discard, there are no unapplied changes.")
+		return nil
+	}
+	applied, err := loadAppliedState(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read the applied configuration %s: %w", appliedStateFile, err)
+	}
+
+	applyChanges = true
+	if err = applied.saveWithHistory(configPath, "discard", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+	os.Remove(configPath + appliedStateFile)
+
+	fmt.Printf("Discarded %d unapplied changes, 'undo' restores them.\n", len(config.Unapplied))
+	return appendAuditLog(configPath, "discard", map[string]int{"Changes": len(config.Unapplied)})
+}
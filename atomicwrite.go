@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// tempFilePrefix starts the name of the temporary files of writeFileAtomic, so that the orphans a
+// crash leaves behind can be recognized, see removeStaleTempFiles.
+const tempFilePrefix = ".wgqc-tmp-"
+
+// staleTempFileAge is the age after which a temporary file of writeFileAtomic is considered
+// orphaned. No write takes that long, a younger file may belong to a running instance.
+const staleTempFileAge = time.Hour
+
+// isTempFile tells whether the file is named like a temporary file of writeFileAtomic.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempFilePrefix)
+}
+
+// createTempFile creates a new temporary file for the content of a file, in the directory of the
+// file so that the rename of writeFileAtomic doesn't cross volumes. The name carries a random
+// suffix and the file is created exclusively, concurrent writes of the same file, e.g. the workers
+// of 'export-qr' or two instances saving the same profile, never share a temporary file.
+func createTempFile(fileName string, perm os.FileMode) (*os.File, error) {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		suffix := make([]byte, 8)
+		if _, err = rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(filepath.Dir(fileName), tempFilePrefix+filepath.Base(fileName)+"."+hex.EncodeToString(suffix))
+
+		var file *os.File
+		file, err = os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+		if !os.IsExist(err) {
+			return file, err
+		}
+	}
+
+	return nil, err
+}
+
+// writeFileAtomic writes the content of a file, like ioutil.WriteFile, so that the file is never
+// left truncated or half written: the content goes to a temporary file next to it, see
+// createTempFile, which is flushed to disk and then replaces the file in a single rename, see
+// replaceFile. A crash at any point leaves either the previous or the new content, and at worst an
+// orphaned temporary file, see removeStaleTempFiles. Every configuration, state file, QR code image
+// and export of the tool is written this way. An existing file keeps its permissions.
+//
+// Parameters:
+//     fileName (string): The file to write.
+//     data ([]byte): The content.
+//     perm (os.FileMode): The permissions of the file if it doesn't exist yet.
+//
+// Returns:
+//     error: An error if the file can't be written, the previous content is then unchanged.
+//
+// Usage:
+//     err := writeFileAtomic(configPath+"config.json", content, 0600)
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(fileName); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	file, err := createTempFile(fileName, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = replaceFile(file.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	// On Windows MoveFileEx flushes the rename, elsewhere the directory entry has to be synced
+	if runtime.GOOS != "windows" {
+		if dir, err := os.Open(filepath.Dir(fileName)); err == nil {
+			dir.Sync()
+			dir.Close()
+		}
+	}
+
+	return nil
+}
+
+// removeStaleTempFiles removes the temporary files of writeFileAtomic older than staleTempFileAge
+// from a directory, the orphans of an instance that crashed or was killed during a write. They may
+// hold private keys, so they are overwritten first, see secureDelete.
+//
+// Parameters:
+//     dir (string): The directory, e.g. the profile directory.
+//
+// Returns:
+//     int: The number of files removed.
+//
+// Usage:
+//     removeStaleTempFiles(configPath)
+func removeStaleTempFiles(dir string) int {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !isTempFile(entry.Name()) || time.Since(entry.ModTime()) < staleTempFileAge {
+			continue
+		}
+		if secureDelete(filepath.Join(dir, entry.Name())) == nil {
+			removed++
+		}
+	}
+
+	return removed
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// atomicWriteSize is the size of the content written by the tests of writeFileAtomic, large enough
+// for a process to be killed in the middle of a write.
+const atomicWriteSize = 1 << 20
+
+// generationContent returns the content of a write of the tests, a single repeated letter per
+// generation, so that a mix of two writes or a truncated file is recognized.
+func generationContent(generation int) []byte {
+	return bytes.Repeat([]byte{byte('a' + generation%26)}, atomicWriteSize)
+}
+
+// checkComplete fails the test unless the file holds the complete content of a single write.
+func checkComplete(t *testing.T, fileName string) {
+	t.Helper()
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != atomicWriteSize || !bytes.Equal(content, bytes.Repeat(content[:1], len(content))) {
+		t.Fatalf("%s is truncated or mixed: %d bytes", filepath.Base(fileName), len(content))
+	}
+}
+
+// tempFiles returns the names of the temporary files of writeFileAtomic in a directory.
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if isTempFile(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "wg0.conf")
+
+	if err := writeFileAtomic(fileName, generationContent(0), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(fileName, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(fileName, generationContent(1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkComplete(t, fileName)
+	if info, _ := os.Stat(fileName); runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("the file got the permissions %v, want the previous 0600", info.Mode().Perm())
+	}
+
+	// A failed replacement leaves the target and no temporary file behind
+	target := filepath.Join(dir, "wsclient_1.png")
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(target, generationContent(2), 0600); err == nil {
+		t.Error("replacing a directory succeeded")
+	}
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		t.Errorf("the failed write changed the target: %v", err)
+	}
+	if names := tempFiles(t, dir); len(names) != 0 {
+		t.Errorf("temporary files left behind: %q", names)
+	}
+}
+
+func TestWriteFileAtomicConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "config.json")
+
+	// Writers of the same file and of files of their own, as the workers of 'export-qr'
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for w := 0; w < 32; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- writeFileAtomic(shared, generationContent(w), 0600)
+			errs <- writeFileAtomic(filepath.Join(dir, fmt.Sprintf("wsclient_%d.png", w+1)), generationContent(w), 0600)
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkComplete(t, shared)
+	for w := 0; w < 32; w++ {
+		checkComplete(t, filepath.Join(dir, fmt.Sprintf("wsclient_%d.png", w+1)))
+	}
+	if names := tempFiles(t, dir); len(names) != 0 {
+		t.Errorf("temporary files left behind: %q", names)
+	}
+}
+
+func TestRemoveStaleTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * staleTempFileAge)
+	files := []struct {
+		name        string
+		old         bool
+		wantRemoved bool
+	}{
+		{tempFilePrefix + "wg0.conf.0123456789abcdef", true, true},
+		// A younger file may belong to a running instance
+		{tempFilePrefix + "config.json.fedcba9876543210", false, false},
+		{"wg0.conf", true, false},
+	}
+	for _, file := range files {
+		fileName := filepath.Join(dir, file.name)
+		if err := ioutil.WriteFile(fileName, []byte("PrivateKey = ..."), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if file.old {
+			if err := os.Chtimes(fileName, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if removed := removeStaleTempFiles(dir); removed != 1 {
+		t.Errorf("removed %d files, want 1", removed)
+	}
+	for _, file := range files {
+		if _, err := os.Stat(filepath.Join(dir, file.name)); os.IsNotExist(err) != file.wantRemoved {
+			t.Errorf("%s removed %t, want %t", file.name, !file.wantRemoved, file.wantRemoved)
+		}
+	}
+}
+
+// crashWriteVariable passes the file to write to the test binary TestWriteFileAtomicCrash runs
+// and kills while it writes.
+const crashWriteVariable = "WGQ_TEST_CRASH_WRITE"
+
+// TestWriteFileAtomicCrash kills a process rewriting a file in a loop at random points, including
+// between the write of the temporary file and the rename, and checks that the file always holds
+// the complete content of one of the writes.
+func TestWriteFileAtomicCrash(t *testing.T) {
+	if fileName, found := os.LookupEnv(crashWriteVariable); found {
+		fmt.Println("ready")
+		for generation := 1; ; generation++ {
+			if err := writeFileAtomic(fileName, generationContent(generation), 0600); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+	}
+	if testing.Short() {
+		t.Skip("kills a process repeatedly")
+	}
+
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "config.json")
+	if err := writeFileAtomic(fileName, generationContent(0), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 0; run < 20; run++ {
+		cmd := exec.Command(os.Args[0], "-test.run", "^TestWriteFileAtomicCrash$")
+		cmd.Env = append(os.Environ(), crashWriteVariable+"="+fileName)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if line, _ := bufio.NewReader(stdout).ReadString('\n'); line != "ready\n" {
+			cmd.Process.Kill()
+			cmd.Wait()
+			t.Fatalf("the writer didn't start: %q", line)
+		}
+		time.Sleep(time.Duration(rand.Intn(30)) * time.Millisecond)
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		checkComplete(t, fileName)
+	}
+
+	// The orphans of the killed writers are removed once they are old enough
+	old := time.Now().Add(-2 * staleTempFileAge)
+	orphans := tempFiles(t, dir)
+	for _, name := range orphans {
+		os.Chtimes(filepath.Join(dir, name), old, old)
+	}
+	if removed := removeStaleTempFiles(dir); removed != len(orphans) {
+		t.Errorf("removed %d of %d orphaned temporary files", removed, len(orphans))
+	}
+	checkComplete(t, fileName)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+const defaultAuditLogFile = "audit.log"
+
+// auditRecord is a single entry of the audit log. Records are stored one JSON document per line
+// and must never contain private keys.
+type auditRecord struct {
+	Time      time.Time
+	Operation string
+	Details   interface{} `json:",omitempty"`
+}
+
+// appendAuditLog appends a record of a mutating operation to the audit log in the given
+// configuration directory.
+//
+// Parameters:
+//     configPath (string): The configuration directory holding the audit log.
+//     operation (string): The name of the operation, usually the command that performed it.
+//     details (interface{}): Operation specific details encoded as JSON, without any secrets.
+//
+// Returns:
+//     error: An error object indicating any errors that occurred while writing the record.
+//
+// Usage:
+//     err := appendAuditLog(configPath, "apply-defaults", changes)
+func appendAuditLog(configPath string, operation string, details interface{}) error {
+	record, err := json.Marshal(auditRecord{
+		Time:      time.Now(),
+		Operation: operation,
+		Details:   details,
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(configPath+defaultAuditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(record, '\n'))
+	return err
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// bundleQrCodeSize is the width and height in pixels of the QR code images in a deployment bundle.
+const bundleQrCodeSize = 512
+
+// bundleWriter stores the files of a deployment bundle, either into a directory or a zip archive.
+type bundleWriter interface {
+	add(name string, data []byte) error
+	close() error
+	// discard gives up an incomplete bundle, what was stored so far is left as is or dropped.
+	discard()
+}
+
+// dirBundle writes the bundle files into a directory.
+type dirBundle struct {
+	dir string
+}
+
+func (b *dirBundle) add(name string, data []byte) error {
+	return writeFileAtomic(filepath.Join(b.dir, name), data, 0666)
+}
+
+func (b *dirBundle) close() error {
+	return nil
+}
+
+func (b *dirBundle) discard() {}
+
+// zipBundle writes the bundle files into a zip archive. The archive is written into a temporary
+// file which replaces the target once complete, like writeFileAtomic does.
+type zipBundle struct {
+	target string
+	file   *os.File
+	writer *zip.Writer
+}
+
+func (b *zipBundle) add(name string, data []byte) error {
+	w, err := b.writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+func (b *zipBundle) close() error {
+	err := b.writer.Close()
+	if err == nil {
+		err = b.file.Sync()
+	}
+	if closeErr := b.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = replaceFile(b.file.Name(), b.target)
+	}
+	if err != nil {
+		os.Remove(b.file.Name())
+	}
+
+	return err
+}
+
+func (b *zipBundle) discard() {
+	b.file.Close()
+	os.Remove(b.file.Name())
+}
+
+// newBundleWriter creates a zip archive if the target ends with .zip, and a directory otherwise.
+func newBundleWriter(target string) (bundleWriter, error) {
+	if strings.EqualFold(filepath.Ext(target), ".zip") {
+		file, err := createTempFile(target, 0666)
+		if err != nil {
+			return nil, err
+		}
+		return &zipBundle{target: target, file: file, writer: zip.NewWriter(file)}, nil
+	}
+
+	if err := os.MkdirAll(target, 0777); err != nil {
+		return nil, err
+	}
+	return &dirBundle{dir: target}, nil
+}
+
+// clientName returns the Name metadata of the client, or a generic name if it has none.
+func (config *appConfig) clientName(index int) string {
+	for _, entry := range config.clientInfo(index).Metadata {
+		if strings.EqualFold(entry.Key, "Name") {
+			return entry.Value
+		}
+	}
+
+	return fmt.Sprintf("client %d", index+1)
+}
+
+// bundleReadme returns the README of a deployment bundle, listing the server and every client
+// with basic import instructions.
+func (config *appConfig) bundleReadme() string {
+	server := config.serverInfo()
+
+	result := "Wireguard deployment\n\n"
+	result += "Server (" + config.serverConfigFile() + ")\n\n" + server.String()
+	result += "\nClients\n\n"
+	for i, entry := range config.clientEntries() {
+		result += fmt.Sprintf("%3d  %-20s  %-18s  %s\n     %s, %s\n", entry.Client, config.clientName(i),
+			entry.Address, entry.PublicKey, entry.ConfigFile, strings.TrimSuffix(entry.ConfigFile, ".conf")+".png")
+	}
+
+	result += "\nImporting a client configuration\n\n" +
+		"Windows, macOS, Linux: in the Wireguard or WireSock client choose 'Import tunnel(s) from file'\n" +
+		"    and select the client .conf file.\n" +
+		"Android, iOS: in the Wireguard app tap '+', choose 'Scan from QR code' and scan the client .png.\n" +
+		fmt.Sprintf("\nForward UDP port %d to the server and keep the .conf files private, they contain private keys.\n",
+			server.ListenPort)
+
+	return result
+}
+
+// writeBundle writes the server configuration, all client configurations, a QR code image per
+// client and a README into the bundle. The QR codes use the given version, 0 for automatic
+// sizing, and recovery level, see qrCodeImages. The client configurations are written in the
+// given output profile, see ForProfile, the QR codes always in the wg-quick one. With automatic
+// sizing, a configuration too large for a QR code within -qrmaxversion is written as a multi-part
+// QR code instead, one image per part, see splitQrFrames.
+func (config *appConfig) writeBundle(bundle bundleWriter, qrVersion int, qrLevel qrcode.RecoveryLevel, profile int) error {
+	content, err := config.renderConfig(config.serverFileConfig())
+	if err != nil {
+		return err
+	}
+	if err = bundle.add(config.serverConfigFile(), []byte(provenanceHeader+content)); err != nil {
+		return err
+	}
+
+	progress := startSpinner("Writing client configurations")
+	defer progress.Stop()
+
+	for i := range config.Clients {
+		progress.SetProgress(i+1, len(config.Clients), "clients")
+
+		fileName := fmt.Sprintf(defaultClientConfigFile, i+1)
+		client, warnings, err := config.clientFileConfig(i).ForProfile(profile)
+		if err != nil {
+			return fmt.Errorf("client %d: %w", i+1, err)
+		}
+		for _, warning := range warnings {
+			fmt.Printf("Warning: client %d: %s\n", i+1, warning)
+		}
+		content, err := config.renderConfig(client)
+		if err != nil {
+			return err
+		}
+		if err = bundle.add(fileName, []byte(provenanceHeader+content)); err != nil {
+			return err
+		}
+
+		if config.Clients[i].PrivateKey == "" {
+			// The device owner holds the private key, a QR code without it is useless
+			continue
+		}
+
+		qrContent, _ := config.mobileQrContent(i)
+		names, images, err := qrCodeImages(strings.TrimSuffix(fileName, ".conf"), qrContent, qrVersion, qrLevel)
+		if err != nil {
+			return fmt.Errorf("can't generate the QR code of client %d: %w", i+1, err)
+		}
+		for part, png := range images {
+			if err = bundle.add(names[part], png); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bundle.add("README.txt", []byte(config.bundleReadme()))
+}
+
+// qrCodeImages encodes a configuration into the QR code images of a bundle, named after the
+// client file. The recovery level steps down towards low when the configuration doesn't fit at the
+// requested one, see EncodeQR, which is noted. With automatic sizing, a configuration too large for
+// a QR code within -qrmaxversion even then gives one image per part, see splitQrFrames.
+//
+// Parameters:
+//     baseName (string): The name of the client file without extension, e.g. "wsclient_3".
+//     content (string): The QR code payload, see mobileQrContent.
+//     qrVersion (int): The QR code version, 0 for automatic sizing.
+//     qrLevel (qrcode.RecoveryLevel): The recovery level.
+//
+// Returns:
+//     []string: The image file names, e.g. "wsclient_3.png" or "wsclient_3.part1of2.png".
+//     [][]byte: The PNG images, in the order of the names.
+//     error: An error if the content can't be encoded.
+//
+// Usage:
+//     names, images, err := qrCodeImages("wsclient_3", content, 0, qrcode.Medium)
+func qrCodeImages(baseName string, content string, qrVersion int, qrLevel qrcode.RecoveryLevel) ([]string, [][]byte, error) {
+	opts := QROptions{Level: qrLevel, MinLevel: qrcode.Low, Version: qrVersion, PNGSize: bundleQrCodeSize}
+	if qrVersion == 0 {
+		opts.MaxVersion = maxQrVersion
+	}
+	qr, err := EncodeQR(content, opts)
+	if errors.Is(err, errQrCodeTooLarge) && qrVersion == 0 {
+		// Too large for a single scannable code, one image per part for 'join-qr'
+		images, err := qrFramePNGs(splitQrFrames(content, qrFrameSize), bundleQrCodeSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		names := make([]string, len(images))
+		for part := range images {
+			names[part] = fmt.Sprintf("%s.part%dof%d.png", baseName, part+1, len(images))
+		}
+		return names, images, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+	if qr.SteppedDown {
+		fmt.Printf("Note: %s.png uses error correction %s, the configuration doesn't fit at %s.\n", baseName,
+			qrRecoveryLevelName(qr.Level), qrRecoveryLevelName(qrLevel))
+	}
+
+	return []string{baseName + ".png"}, [][]byte{qr.PNG}, nil
+}
+
+// runBundleCommand implements the 'bundle' command, which exports a complete deployment into a
+// directory, or a zip archive if the target ends with .zip:
+//
+//     bundle C:\handoff\office
+//     bundle C:\handoff\office.zip
+//     bundle --qr-version 20 --qr-level highest C:\handoff\cards
+//     bundle --compat wgquick /srv/handoff/linux
+//
+// --qr-version and --qr-level make the QR code images deterministic and robust for printing, the
+// export fails if a client configuration doesn't fit the requested version. --compat wgquick
+// leaves the WireSock and AmneziaWG extensions out of the client configurations for stock
+// wg-quick, --compat strict fails instead if a client uses any.
+func runBundleCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	qrVersion := flags.Int("qr-version", 0, "QR code version (1-40) of the images, automatic if 0")
+	qrLevelName := flags.String("qr-level", "medium", "QR code recovery level, low, medium, high or highest")
+	compat := flags.String("compat", "wiresock", "Output profile of the client configurations, wiresock, wgquick or strict")
+	if err := parseFlags(flags, "bundle", args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return newError(errUsage, "usage: bundle [--qr-version 1-40] [--qr-level low|medium|high|highest] "+
+			"[--compat wiresock|wgquick|strict] <directory | file.zip>")
+	}
+	if *qrVersion < 0 || *qrVersion > 40 {
+		return newError(errValidation, "invalid QR code version %d, expected a number between 1 and 40", *qrVersion)
+	}
+	qrLevel, err := parseQrRecoveryLevel(*qrLevelName)
+	if err != nil {
+		return err
+	}
+	profile, err := parseOutputProfile(*compat)
+	if err != nil {
+		return err
+	}
+	target := flags.Arg(0)
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	bundle, err := newBundleWriter(target)
+	if err != nil {
+		return err
+	}
+	if err = config.writeBundle(bundle, *qrVersion, qrLevel, profile); err != nil {
+		bundle.discard()
+		return err
+	}
+	if err = bundle.close(); err != nil {
+		return err
+	}
+
+	fmt.Println("Deployment bundle written to", target)
+	delivered := false
+	for i := range config.Clients {
+		delivered = config.recordStatus(configPath, i, statusDelivered, "bundle exported", time.Now()) || delivered
+	}
+	if delivered {
+		config.saveStatus(configPath)
+	}
+	fmt.Println("Warning: the bundle contains private keys, only share it over a trusted channel.")
+	return nil
+}
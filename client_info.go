@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientInfo holds the metadata the tool keeps about a client beyond its Wireguard configuration.
+// It is stored in config.json alongside the client, at the same index of appConfig.ClientsInfo.
+type clientInfo struct {
+	// Overrides lists the defaults fields (see defaultsFields) explicitly set for this client.
+	Overrides []string `json:",omitempty"`
+	// Metadata holds free-form annotations emitted as comments in the configuration files.
+	Metadata []metadataEntry `json:",omitempty"`
+	// Notes holds the notes of 'set-note' kept in config.json only, see appConfig.NotesInConfig.
+	Notes []string `json:",omitempty"`
+	// Group is the name of the client group the client belongs to, see clientGroup.
+	Group string `json:",omitempty"`
+	// Role is the reachability role of the client, clientRolePublic for clients with a public
+	// endpoint, empty for mobile clients behind NAT. See applyClientRole.
+	Role string `json:",omitempty"`
+	// FullTunnelSite confirms that a site-to-site client routes everything into the tunnel, the WAN
+	// traffic of its LAN included. Without it a site-to-site client doesn't get a full tunnel by
+	// default, see siteAllowedIPs.
+	FullTunnelSite bool `json:",omitempty"`
+	// Pinned freezes the config file of the client, regenerations leave it alone. See runPinCommand.
+	Pinned bool `json:",omitempty"`
+	// Provisioning records the provisioning status transitions of the client, see recordStatus.
+	Provisioning []statusTransition `json:",omitempty"`
+	// ExternalKey records when the key of the client was replaced with a public key generated on its
+	// device, see updateClientPublicKey. Clients adopted with external keys don't have it.
+	ExternalKey *time.Time `json:",omitempty"`
+	// Expires is when the client is due for removal, set at its creation from the expiry default
+	// of its group or of the instance, see setClientExpiry. Nil for clients that don't expire.
+	Expires *time.Time `json:",omitempty"`
+}
+
+// clientInfo returns the metadata of the client with the given zero-based index, extending
+// ClientsInfo as needed for configurations created before the metadata was introduced.
+func (config *appConfig) clientInfo(index int) *clientInfo {
+	for len(config.ClientsInfo) < len(config.Clients) {
+		config.ClientsInfo = append(config.ClientsInfo, clientInfo{})
+	}
+
+	return &config.ClientsInfo[index]
+}
+
+// hasOverride reports whether the given defaults field is explicitly set for the client.
+func (info *clientInfo) hasOverride(field string) bool {
+	for _, override := range info.Overrides {
+		if override == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addOverride records that the given defaults field is explicitly set for the client.
+func (info *clientInfo) addOverride(field string) {
+	if !info.hasOverride(field) {
+		info.Overrides = append(info.Overrides, field)
+	}
+}
+
+// parseClientSelection parses a comma-separated list of one-based client numbers, as shown by
+// the client configuration file names, into zero-based client indexes.
+func (config *appConfig) parseClientSelection(selection string) ([]int, error) {
+	var indexes []int
+
+	for _, token := range strings.Split(selection, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+
+		number, err := strconv.Atoi(token)
+		if err != nil || number < 1 || number > len(config.Clients) {
+			return nil, newError(errUsage, "client '%s' does not exist", token)
+		}
+		indexes = append(indexes, number-1)
+	}
+
+	if len(indexes) == 0 {
+		return nil, newError(errUsage, "no clients selected")
+	}
+
+	return indexes, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Values of the -cloud-metadata option besides the names of cloudProviders.
+const (
+	// cloudMetadataAuto asks the metadata service of the cloud the SMBIOS vendor of the host
+	// belongs to, and none on other machines. See detectCloudVendor.
+	cloudMetadataAuto = "auto"
+	// cloudMetadataOff always uses the public IP services.
+	cloudMetadataOff = "off"
+)
+
+// cloudMetadataAddress is the link-local address of the instance metadata services.
+const cloudMetadataAddress = "169.254.169.254"
+
+// cloudMetadataTimeout bounds every request to a metadata service. They answer from the
+// hypervisor within milliseconds and the link-local address is unreachable elsewhere, so a probe
+// delays a machine outside the cloud by this much at most.
+const cloudMetadataTimeout = 500 * time.Millisecond
+
+// consensusSource describes the public IP services of externalIPConsensus, see
+// detectExternalIPWithSource.
+const consensusSource = "a consensus of public IP services"
+
+// cloudProvider is a cloud whose instance metadata service tells the public IP address of the
+// server, faster and more reliably than the public IP services.
+type cloudProvider struct {
+	// Name is the value of -cloud-metadata selecting the provider.
+	Name string
+	// Description names the metadata service in the setup summary and the doctor output.
+	Description string
+	// Vendor is the SMBIOS system manufacturer of the instances, see detectCloudVendor.
+	Vendor string
+	// PublicIP asks the metadata service at the base URL, e.g. http://169.254.169.254.
+	PublicIP func(client *http.Client, baseUrl string) (net.IP, error)
+}
+
+// cloudProviders are the clouds -cloud-metadata knows. Hyper-V hosts outside Azure share its
+// vendor, a probe there costs cloudMetadataTimeout before the public IP services are asked.
+var cloudProviders = []cloudProvider{
+	{"aws", "the AWS instance metadata service", "Amazon EC2", awsPublicIP},
+	{"azure", "the Azure instance metadata service", "Microsoft Corporation", azurePublicIP},
+	{"gcp", "the Google Cloud metadata server", "Google", gcpPublicIP},
+	{"hetzner", "the Hetzner Cloud metadata service", "Hetzner", hetznerPublicIP},
+}
+
+// checkCloudMetadataSetting validates a -cloud-metadata value.
+func checkCloudMetadataSetting(setting string) error {
+	names := []string{cloudMetadataAuto, cloudMetadataOff}
+	for _, provider := range cloudProviders {
+		names = append(names, provider.Name)
+	}
+	for _, name := range names {
+		if setting == name {
+			return nil
+		}
+	}
+
+	return newError(errUsage, "invalid -cloud-metadata '%s', expected %s", setting, strings.Join(names, ", "))
+}
+
+// cloudMetadataClient returns the client of the metadata requests. Unlike httpClient it never
+// uses a proxy, the metadata services are only reachable from the instance itself.
+func cloudMetadataClient() *http.Client {
+	transport := &http.Transport{
+		DialContext:       (&net.Dialer{Timeout: cloudMetadataTimeout}).DialContext,
+		DisableKeepAlives: true,
+	}
+
+	return &http.Client{Timeout: cloudMetadataTimeout, Transport: transport}
+}
+
+// metadataRequest performs a request to a metadata service and returns the response body,
+// failing on HTTP error statuses.
+func metadataRequest(client *http.Client, method string, requestUrl string, headers map[string]string) ([]byte, error) {
+	request, err := http.NewRequest(method, requestUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", request.URL.Path, response.Status)
+	}
+
+	return content, nil
+}
+
+// parsePublicIPText parses the plain text answer of a metadata service, which must be a public
+// address: an instance without one gets the address of its NAT gateway from the public IP
+// services instead.
+func parsePublicIPText(content []byte) (net.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(string(content)))
+	if ip == nil {
+		return nil, fmt.Errorf("no IP address in the answer '%s'", strings.TrimSpace(string(content)))
+	}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil, fmt.Errorf("%s is not a public IP address", ip.String())
+	}
+
+	return ip, nil
+}
+
+// awsPublicIP asks the EC2 instance metadata service, with an IMDSv2 session token so that
+// instances requiring IMDSv2 answer as well. Instances without a public IPv4 address answer 404.
+func awsPublicIP(client *http.Client, baseUrl string) (net.IP, error) {
+	token, err := metadataRequest(client, http.MethodPut, baseUrl+"/latest/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := metadataRequest(client, http.MethodGet, baseUrl+"/latest/meta-data/public-ipv4",
+		map[string]string{"X-aws-ec2-metadata-token": strings.TrimSpace(string(token))})
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePublicIPText(content)
+}
+
+// azureNetwork is the part of the answer of the Azure instance metadata service holding the
+// addresses of the network interfaces.
+type azureNetwork struct {
+	Interface []struct {
+		IPv4 struct {
+			IPAddress []struct {
+				PrivateIPAddress string `json:"privateIpAddress"`
+				PublicIPAddress  string `json:"publicIpAddress"`
+			} `json:"ipAddress"`
+		} `json:"ipv4"`
+	} `json:"interface"`
+}
+
+// parseAzureNetwork returns the first public IP address of an answer of the Azure instance
+// metadata service.
+func parseAzureNetwork(content []byte) (net.IP, error) {
+	var network azureNetwork
+	if err := json.Unmarshal(content, &network); err != nil {
+		return nil, fmt.Errorf("invalid answer: %w", err)
+	}
+	for _, networkInterface := range network.Interface {
+		for _, address := range networkInterface.IPv4.IPAddress {
+			if address.PublicIPAddress != "" {
+				return parsePublicIPText([]byte(address.PublicIPAddress))
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("the instance has no public IP address")
+}
+
+// azurePublicIP asks the Azure instance metadata service. Only basic public IP addresses are
+// listed there, instances behind a load balancer fall back to the public IP services.
+func azurePublicIP(client *http.Client, baseUrl string) (net.IP, error) {
+	content, err := metadataRequest(client, http.MethodGet, baseUrl+"/metadata/instance/network?api-version=2021-02-01",
+		map[string]string{"Metadata": "true"})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseAzureNetwork(content)
+}
+
+// gcpPublicIP asks the Google Cloud metadata server for the external IP address of the first
+// access configuration of the first network interface.
+func gcpPublicIP(client *http.Client, baseUrl string) (net.IP, error) {
+	content, err := metadataRequest(client, http.MethodGet,
+		baseUrl+"/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip",
+		map[string]string{"Metadata-Flavor": "Google"})
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePublicIPText(content)
+}
+
+// hetznerPublicIP asks the Hetzner Cloud metadata service.
+func hetznerPublicIP(client *http.Client, baseUrl string) (net.IP, error) {
+	content, err := metadataRequest(client, http.MethodGet, baseUrl+"/hetzner/v1/metadata/public-ipv4", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePublicIPText(content)
+}
+
+// detectCloudVendor returns the SMBIOS system manufacturer of this host, e.g. "Amazon EC2", read
+// from the registry on Windows and from sysfs elsewhere, empty if it can't be read.
+//
+// Parameters:
+//     ps (Executor): Runs the registry query, see NewPowerShell.
+//
+// Returns:
+//     string: The system manufacturer.
+//
+// Usage:
+//     vendor := detectCloudVendor(NewPowerShell())
+func detectCloudVendor(ps Executor) string {
+	if !windowsHost {
+		content, _ := ioutil.ReadFile("/sys/class/dmi/id/sys_vendor")
+		return strings.TrimSpace(string(content))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := ps.Execute(ctx, `(Get-ItemProperty 'HKLM:\HARDWARE\DESCRIPTION\System\BIOS' `+
+		`-ErrorAction SilentlyContinue).SystemManufacturer`)
+	if result.Err != nil {
+		return ""
+	}
+	return strings.TrimSpace(result.StdOut)
+}
+
+// cloudMetadataIP returns the public IP address of the server from the instance metadata service
+// selected by -cloud-metadata, see cloudProviders. With the default, auto, only the service of the
+// cloud the host belongs to is asked, see detectCloudVendor, so that machines outside the cloud
+// never wait for a link-local address. No address and no error means no service was asked.
+//
+// Returns:
+//     net.IP: The public IP address, nil if no service was asked or none answered.
+//     string: The description of the service that answered.
+//     error: An error if the service asked didn't answer with a public address.
+//
+// Usage:
+//     ip, source, err := cloudMetadataIP()
+func cloudMetadataIP() (net.IP, string, error) {
+	var candidates []cloudProvider
+	switch cloudMetadataSetting {
+	case cloudMetadataOff:
+		return nil, "", nil
+	case cloudMetadataAuto:
+		vendor := strings.ToLower(detectCloudVendor(newExecutor()))
+		for _, provider := range cloudProviders {
+			if vendor != "" && strings.Contains(vendor, strings.ToLower(provider.Vendor)) {
+				candidates = append(candidates, provider)
+			}
+		}
+	default:
+		for _, provider := range cloudProviders {
+			if provider.Name == cloudMetadataSetting {
+				candidates = append(candidates, provider)
+			}
+		}
+	}
+
+	var err error
+	client := cloudMetadataClient()
+	for _, provider := range candidates {
+		var ip net.IP
+		if ip, err = provider.PublicIP(client, "http://"+cloudMetadataAddress); err == nil {
+			return ip, provider.Description, nil
+		}
+		err = fmt.Errorf("%s: %w", provider.Description, err)
+	}
+
+	return nil, "", err
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metadataRoute is an answer of the fake metadata service of newMetadataServer: the captured
+// response of testdata/cloud given to a request with the method and header of the real service.
+type metadataRoute struct {
+	Method string
+	Header string
+	Value  string
+	File   string
+}
+
+// newMetadataServer starts a metadata service replaying captured responses by request URI.
+// Requests without the method or header the real service requires are refused like it does.
+func newMetadataServer(t *testing.T, routes map[string]metadataRoute) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, found := routes[r.URL.RequestURI()]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != route.Method || (route.Header != "" && r.Header.Get(route.Header) != route.Value) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		content, err := ioutil.ReadFile(filepath.Join("testdata", "cloud", route.File))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func TestCloudProviderProbes(t *testing.T) {
+	const awsToken = "AQAEAFKkSmv8YwBAJcS0xfvyRIrXbHq0dzgwS9JPFq6EyHzEU0wq4Q=="
+	tests := []struct {
+		provider string
+		routes   map[string]metadataRoute
+		want     string
+	}{
+		{"aws", map[string]metadataRoute{
+			"/latest/api/token":             {http.MethodPut, "X-aws-ec2-metadata-token-ttl-seconds", "60", "aws-token.txt"},
+			"/latest/meta-data/public-ipv4": {http.MethodGet, "X-aws-ec2-metadata-token", awsToken, "aws-public-ipv4.txt"},
+		}, "203.0.113.25"},
+		{"azure", map[string]metadataRoute{
+			"/metadata/instance/network?api-version=2021-02-01": {http.MethodGet, "Metadata", "true", "azure-network.json"},
+		}, "203.0.113.26"},
+		{"gcp", map[string]metadataRoute{
+			"/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip": {http.MethodGet,
+				"Metadata-Flavor", "Google", "gcp-external-ip.txt"},
+		}, "203.0.113.27"},
+		{"hetzner", map[string]metadataRoute{
+			"/hetzner/v1/metadata/public-ipv4": {http.MethodGet, "", "", "hetzner-public-ipv4.txt"},
+		}, "203.0.113.28"},
+	}
+
+	for i, test := range tests {
+		provider := cloudProviders[i]
+		if provider.Name != test.provider {
+			t.Fatalf("provider %d is %s, want %s", i, provider.Name, test.provider)
+		}
+		baseUrl := newMetadataServer(t, test.routes)
+		ip, err := provider.PublicIP(cloudMetadataClient(), baseUrl)
+		if err != nil || ip.String() != test.want {
+			t.Errorf("%s: %v, %v, want %s", test.provider, ip, err, test.want)
+		}
+
+		// The other services don't answer the requests of this one
+		for j, other := range cloudProviders {
+			if j != i {
+				if ip, err = other.PublicIP(cloudMetadataClient(), baseUrl); err == nil {
+					t.Errorf("%s answered the %s probe with %v", test.provider, other.Name, ip)
+				}
+			}
+		}
+	}
+}
+
+func TestCloudProviderProbeErrors(t *testing.T) {
+	// AWS answers 404 to instances without a public IPv4 address
+	baseUrl := newMetadataServer(t, map[string]metadataRoute{
+		"/latest/api/token": {http.MethodPut, "X-aws-ec2-metadata-token-ttl-seconds", "60", "aws-token.txt"},
+	})
+	if _, err := awsPublicIP(cloudMetadataClient(), baseUrl); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("AWS without a public address = %v, want the 404", err)
+	}
+
+	baseUrl = newMetadataServer(t, map[string]metadataRoute{
+		"/metadata/instance/network?api-version=2021-02-01": {http.MethodGet, "Metadata", "true",
+			"azure-network-private.json"},
+		"/hetzner/v1/metadata/public-ipv4": {http.MethodGet, "", "", "azure-network.json"},
+	})
+	if _, err := azurePublicIP(cloudMetadataClient(), baseUrl); err == nil ||
+		err.Error() != "the instance has no public IP address" {
+		t.Errorf("Azure without a public address = %v", err)
+	}
+	if _, err := hetznerPublicIP(cloudMetadataClient(), baseUrl); err == nil ||
+		!strings.Contains(err.Error(), "no IP address in the answer") {
+		t.Errorf("an answer that isn't an address = %v", err)
+	}
+	if _, err := parseAzureNetwork([]byte("<html>")); err == nil || !strings.HasPrefix(err.Error(), "invalid answer") {
+		t.Errorf("parseAzureNetwork(<html>) = %v", err)
+	}
+
+	for _, answer := range []string{"10.0.0.4", "169.254.1.1", "127.0.0.1", "0.0.0.0", "fd00::1"} {
+		if ip, err := parsePublicIPText([]byte(answer + "\n")); err == nil {
+			t.Errorf("parsePublicIPText(%s) = %v, want an error", answer, ip)
+		}
+	}
+	if ip, err := parsePublicIPText([]byte(" 2001:db8::1\n")); err != nil || ip.String() != "2001:db8::1" {
+		t.Errorf("parsePublicIPText(2001:db8::1) = %v, %v", ip, err)
+	}
+}
+
+func TestCloudProviderProbeTimeout(t *testing.T) {
+	// A service that never answers, or an address nothing listens on, delays the probe by the
+	// timeout at most
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hanging.Close()
+	defer close(release)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "http://" + listener.Addr().String()
+	listener.Close()
+
+	for _, baseUrl := range []string{hanging.URL, closed} {
+		for _, provider := range cloudProviders {
+			started := time.Now()
+			if _, err := provider.PublicIP(cloudMetadataClient(), baseUrl); err == nil {
+				t.Errorf("%s answered from %s", provider.Name, baseUrl)
+			}
+			// The AWS probe makes two requests, but the token request is the one that fails
+			if elapsed := time.Since(started); elapsed > cloudMetadataTimeout+250*time.Millisecond {
+				t.Errorf("%s probe of %s took %v", provider.Name, baseUrl, elapsed)
+			}
+		}
+	}
+}
+
+func TestCloudMetadataSetting(t *testing.T) {
+	for _, setting := range []string{"auto", "off", "aws", "azure", "gcp", "hetzner"} {
+		if err := checkCloudMetadataSetting(setting); err != nil {
+			t.Errorf("checkCloudMetadataSetting(%s) = %v", setting, err)
+		}
+	}
+	err := checkCloudMetadataSetting("oracle")
+	if exitCode(err) != exitUsage || !strings.HasSuffix(err.Error(), "expected auto, off, aws, azure, gcp, hetzner") {
+		t.Errorf("checkCloudMetadataSetting(oracle) = %v", err)
+	}
+
+	previous := cloudMetadataSetting
+	defer func() { cloudMetadataSetting = previous }()
+
+	// Neither off nor auto on a host of another vendor asks a metadata service
+	fakeWindowsHost(t)
+	ps := &fakeExecutor{Rules: []fakeRule{{Match: "SystemManufacturer", Result: Result{StdOut: "Dell Inc.\r\n"}}}}
+	previousExecutor := newExecutor
+	newExecutor = func() Executor { return ps }
+	defer func() { newExecutor = previousExecutor }()
+
+	for _, setting := range []string{cloudMetadataOff, cloudMetadataAuto} {
+		cloudMetadataSetting = setting
+		started := time.Now()
+		if ip, source, err := cloudMetadataIP(); ip != nil || source != "" || err != nil {
+			t.Errorf("%s: %v, %q, %v, want no probe", setting, ip, source, err)
+		}
+		if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+			t.Errorf("%s took %v", setting, elapsed)
+		}
+	}
+	if len(ps.Scripts) != 1 {
+		t.Errorf("the vendor was read %d times, want only for auto", len(ps.Scripts))
+	}
+
+	for _, vendor := range []string{"Amazon EC2", "Microsoft Corporation", "Google", "Hetzner"} {
+		ps := &fakeExecutor{Rules: []fakeRule{{Match: "SystemManufacturer", Result: Result{StdOut: vendor + "\r\n"}}}}
+		if got := detectCloudVendor(ps); got != vendor {
+			t.Errorf("detectCloudVendor() = %q, want %q", got, vendor)
+		}
+	}
+	if got := detectCloudVendor(&fakeExecutor{Rules: []fakeRule{{Match: "SystemManufacturer",
+		Result: Result{Err: context.DeadlineExceeded}}}}); got != "" {
+		t.Errorf("detectCloudVendor() of a failed query = %q", got)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// command describes a subcommand that may be given as the first command line argument
+// instead of the legacy flags. readOnly tells whether an invocation leaves the profile unchanged,
+// nil for commands that always change it: the others run even if the profile isn't writable, see
+// checkProfileWritable.
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(configPath string, args []string) error
+	readOnly    func(args []string) bool
+}
+
+// alwaysReadOnly is the readOnly function of commands that never change the profile.
+func alwaysReadOnly(args []string) bool {
+	return true
+}
+
+// readOnlyMode returns the readOnly function of commands whose first argument selects a mode,
+// read-only for the given modes.
+func readOnlyMode(modes ...string) func(args []string) bool {
+	return func(args []string) bool {
+		for _, mode := range modes {
+			if len(args) > 0 && args[0] == mode {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// hasFlagArg tells whether the boolean flag of the command is set, either in the arguments as
+// -name or --name, possibly with =true, or with its WGQC_ environment variable, see parseFlags.
+func hasFlagArg(args []string, command string, name string) bool {
+	for _, arg := range args {
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if arg == name || arg == name+"=true" {
+			return true
+		}
+	}
+
+	set, _ := strconv.ParseBool(os.Getenv(flagEnvName(command, name)))
+	return set
+}
+
+// commands lists all the supported subcommands.
+var commands = []command{
+	{
+		name:        "server-info",
+		usage:       "server-info",
+		description: "Shows the server endpoint, UDP port, tunnel subnet and public key.",
+		run:         runServerInfoCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "list",
+		usage:       "list [--group name] [--drift] [--status issued|delivered|connected|unknown]",
+		description: "Lists the clients with their address, config file, public key, group, metadata and provisioning status, --drift marks changed files.",
+		run:         runListCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "show",
+		usage:       "show [--diff] <client>",
+		description: "Prints the generated config of a client, or with --diff how its file on disk differs from it.",
+		run:         runShowCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "analyze",
+		usage:       "analyze <client> [--qrmaxversion n]",
+		description: "Shows the QR code payload size of a client per section, without secrets, to see what to trim.",
+		run:         runAnalyzeCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "accept-drift",
+		usage:       "accept-drift <client>",
+		description: "Takes the changes made by hand to the config file of a client over into the configuration.",
+		run:         runAcceptDriftCommand,
+	},
+	{
+		name:        "inspect",
+		usage:       "inspect <file>",
+		description: "Parses an existing Wireguard config file and prints its interface settings and peers, read-only.",
+		run:         runInspectCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "lint",
+		usage:       "lint <file>...",
+		description: "Checks Wireguard config files against best practices and reports each finding with its severity.",
+		run:         runLintCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "adopt",
+		usage:       "adopt <server.conf|dump> [--endpoint host:port] [--address cidr] [--merge]",
+		description: "Takes over an existing server config or 'wg show dump' output, its peers become clients with external keys.",
+		run:         runAdoptCommand,
+	},
+	{
+		name:        "provision",
+		usage:       "provision --endpoint host:port [--port n] [--subnet cidr] [--dns list] [--clients a,b | --count n] [--add-instance name | --reset | --force]",
+		description: "Sets up a new configuration without any questions, for provisioning scripts.",
+		run:         runProvisionCommand,
+	},
+	{
+		name:        "join-qr",
+		usage:       "join-qr <part.txt>... --out file.conf",
+		description: "Reassembles a configuration shown as a multi-part QR code from the scanned text of its parts.",
+		run:         runJoinQrCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "list-profiles",
+		usage:       "list-profiles",
+		description: "Lists the default and named profiles and the directories used with -config-path.",
+		run:         runListProfilesCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "defaults",
+		usage:       "defaults show | set key=value... | apply --existing",
+		description: "Shows or edits the DNS, MTU, keepalive and AllowedIPs used for new clients.",
+		run:         runDefaultsCommand,
+		readOnly:    readOnlyMode("show"),
+	},
+	{
+		name:        "apply-defaults",
+		usage:       "apply-defaults [--clients 1,2,3 | --all] [--fields dns,mtu,keepalive] [--override]",
+		description: "Updates selected fields of existing clients to the current defaults after confirmation.",
+		run:         runApplyDefaultsCommand,
+	},
+	{
+		name:        "set-client",
+		usage:       "set-client <client> key=value...",
+		description: "Explicitly sets dns, mtu, keepalive or allowedips, dnsonly=true, junk, serverkeepalive, role or publickey, for a single client.",
+		run:         runSetClientCommand,
+	},
+	{
+		name:        "set-server",
+		usage:       "set-server mtu=<number>|auto | file=<name>.conf | nat=auto|off|<interface> | pool=<start>|off | bind=<address>|any | dnscheck=on|off | endpoint-managed-by=detection|ddns|manual|auto",
+		description: "Sets the server MTU ('auto' matches the client defaults), renames the server config file, sets the Linux NAT rules or the client address pool start.",
+		run:         runSetServerCommand,
+	},
+	{
+		name:        "set-endpoint",
+		usage:       "set-endpoint [host:port] [--secondary host:port,... | --secondary none]",
+		description: "Changes the endpoint of all clients, or the alternate endpoints documented as comments in their configs.",
+		run:         runSetEndpointCommand,
+	},
+	{
+		name:        "group",
+		usage:       "group list | create <name> [key=value...] | set <name> key=value... | assign <name> <clients> | unassign <clients> | delete <name>",
+		description: "Manages client groups and their defaults, layered on top of the instance defaults.",
+		run:         runGroupCommand,
+		readOnly:    readOnlyMode("list"),
+	},
+	{
+		name:        "remove",
+		usage:       "remove <client>[,<client>...] | --group name | --expired",
+		description: "Removes clients after confirming the affected ones, the later clients are renumbered.",
+		run:         runRemoveCommand,
+	},
+	{
+		name:        "rotate",
+		usage:       "rotate <client>[,<client>...] | --group name | --expired",
+		description: "Gives clients new keys after confirming the affected ones, their devices need the new configurations.",
+		run:         runRotateCommand,
+	},
+	{
+		name:        "metadata",
+		usage:       "metadata <client> [--file path] [--clear] [Key=Value...]",
+		description: "Shows or edits client annotations emitted as comments in the config files.",
+		run:         runMetadataCommand,
+		readOnly:    func(args []string) bool { return len(args) == 1 },
+	},
+	{
+		name:        "pin",
+		usage:       "pin <client> [--unpin]",
+		description: "Freezes the config file of a client, regenerations skip it and warn once it is out of sync.",
+		run:         runPinCommand,
+	},
+	{
+		name:        "set-note",
+		usage:       "set-note <client> [--clear] [text] | --store config|state",
+		description: "Attaches a note to a client, optionally stored as a comment in the server config.",
+		run:         runSetNoteCommand,
+	},
+	{
+		name:        "template",
+		usage:       "template <file> | --clear",
+		description: "Renders the configuration files through a user-supplied Go text/template.",
+		run:         runTemplateCommand,
+	},
+	{
+		name:        "ddns",
+		usage:       "ddns set --provider generic|duckdns|cloudflare --hostname name [--token t] [--url u] [--zone id] | update [--ip a] | status | clear",
+		description: "Keeps a dynamic DNS hostname pointed at the external IP address of the server.",
+		run:         runDdnsCommand,
+		readOnly:    readOnlyMode("status"),
+	},
+	{
+		name:        "relay",
+		usage:       "relay set <host:port> [--target host:port] | show | export socat|systemd|nftables [--out file] | clear",
+		description: "Declares a relay the clients dial, e.g. a VPS forwarding to a server behind CGNAT, and exports its forwarding.",
+		run:         runRelayCommand,
+		readOnly:    readOnlyMode("show", "export"),
+	},
+	{
+		name:        "watch-endpoint",
+		usage:       "watch-endpoint [--interval duration] | --once [--ip address]",
+		description: "Watches the external IP address and keeps the endpoint current as set with 'set-server endpoint-managed-by='.",
+		run:         runWatchEndpointCommand,
+	},
+	{
+		name:        "handshake",
+		usage:       "handshake <client> [--endpoint host:port] [--timeout 5s]",
+		description: "Verifies end to end that the server answers a Wireguard handshake with the keys of a client.",
+		run:         runHandshakeCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "doctor",
+		usage:       "doctor [--probe-mtu] [--probe-host host] [--loopback]",
+		description: "Checks the configuration is deployable and the MTUs fit, optionally probing the path MTU or testing the running server.",
+		run:         runDoctorCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "troubleshoot",
+		usage:       "troubleshoot client <client> [--lan cidr]",
+		description: "Checks the LAN subnet a client device reports against its tunnel subnet, AllowedIPs and DNS.",
+		run:         runTroubleshootCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "report",
+		usage:       "report routes",
+		description: "Reports what every client reaches through the tunnel, which clients reach it and conflicting routes.",
+		run:         runReportCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "route-test",
+		usage:       "route-test <client> <destination-ip>",
+		description: "Explains step by step where the AllowedIPs route a packet from a client and whether the replies come back.",
+		run:         runRouteTestCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "cleanup",
+		usage:       "cleanup [--dry-run]",
+		description: "Reverts the recorded system changes, such as the tunnel service, newest first.",
+		run:         runCleanupCommand,
+		readOnly:    func(args []string) bool { return hasFlagArg(args, "cleanup", "dry-run") },
+	},
+	{
+		name:        "finish",
+		usage:       "finish [--elevated | --discard]",
+		description: "Lists or runs the privileged steps deferred while not elevated, e.g. installing the tunnel service.",
+		run:         runFinishCommand,
+		readOnly: func(args []string) bool {
+			return !hasFlagArg(args, "finish", "elevated") && !hasFlagArg(args, "finish", "discard")
+		},
+	},
+	{
+		name:        "fsck",
+		usage:       "fsck [--repair] [--files]",
+		description: "Verifies the stored configuration, e.g. that server peers match the client keys.",
+		run:         runFsckCommand,
+		readOnly:    func(args []string) bool { return !hasFlagArg(args, "fsck", "repair") },
+	},
+	{
+		name:        "gc",
+		usage:       "gc [--dry-run] [--include-foreign]",
+		description: "Securely deletes the files of the profile no client uses anymore, e.g. configs of removed clients.",
+		run:         runGcCommand,
+		readOnly:    func(args []string) bool { return hasFlagArg(args, "gc", "dry-run") },
+	},
+	{
+		name:        "status",
+		usage:       "status",
+		description: "Lists the changes staged with -apply=false and the privileged steps waiting for 'finish'.",
+		run:         runStatusCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "apply",
+		usage:       "apply [--no-restart]",
+		description: "Writes the staged changes to the configuration files and restarts the tunnel service once.",
+		run:         runApplyCommand,
+	},
+	{
+		name:        "discard",
+		usage:       "discard",
+		description: "Drops the staged changes, restoring the last applied configuration.",
+		run:         runDiscardCommand,
+	},
+	{
+		name:        "undo",
+		usage:       "undo",
+		description: "Restores the configuration saved before the last change and regenerates the files.",
+		run:         runUndoCommand,
+	},
+	{
+		name:        "history",
+		usage:       "history [--state]",
+		description: "Shows the audit log, or with --state the configuration snapshots available to undo.",
+		run:         runHistoryCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "config",
+		usage:       "config sources",
+		description: "Shows each effective setting and whether it came from a flag, WGQC_ variable or default.",
+		run:         runConfigCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "version",
+		usage:       "version",
+		description: "Prints the version, build metadata and supported config.json schema version.",
+		run:         runVersionCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "mesh",
+		usage:       "mesh <subnet> <endpoint> <endpoint>...",
+		description: "Generates full mesh configs where every node has every other node as a peer.",
+		run:         runMeshCommand,
+	},
+	{
+		name:        "bundle",
+		usage:       "bundle [--qr-version 1-40] [--qr-level low|medium|high|highest] [--compat wiresock|wgquick|strict] <directory | file.zip>",
+		description: "Exports all configs, a QR code PNG per client and a README for handing off a deployment.",
+		run:         runBundleCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "export-qr",
+		usage:       "export-qr [--workers n] [--qr-version 1-40] [--qr-level low|medium|high|highest] [--force] <directory>",
+		description: "Writes a QR code PNG per client and an index.csv in parallel, keeping the images still up to date, same as 'export qr'.",
+		run:         runExportQrCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "export-handout",
+		usage:       "export-handout <client> --out file.html | --all --out dir [--org name] [--logo image] [--support contact] [--template file]",
+		description: "Writes a printable one-page HTML onboarding handout with the QR code and import instructions, same as 'export handout'.",
+		run:         runExportHandoutCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "export",
+		usage:       "export qr|handout|client|networkd|relay|windows-import [arguments]",
+		description: "Writes QR codes, handouts, client bundles, networkd files, relay forwarding or Windows import scripts, see 'export' for the arguments of each.",
+		run:         runExportCommand,
+		readOnly:    exportReadOnly,
+	},
+	{
+		name:        "export-client",
+		usage:       "export-client <client> --out file.bundle [--passphrase text]",
+		description: "Exports a client with its keys, metadata, notes and group for moving it to another server, same as 'export client'.",
+		run:         runExportClientCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "import-client",
+		usage:       "import-client <file> [--passphrase text] [--rotate]",
+		description: "Adds a client exported from another server, with a local address, endpoint and server key.",
+		run:         runImportClientCommand,
+	},
+	{
+		name:        "encrypt-files",
+		usage:       "encrypt-files on|off",
+		description: "Encrypts the client config files at rest with a passphrase, or decrypts them again.",
+		run:         runEncryptFilesCommand,
+	},
+	{
+		name:        "decrypt",
+		usage:       "decrypt <client> --out file.conf",
+		description: "Writes the plaintext config file of a client, e.g. for handing it to the device.",
+		run:         runDecryptCommand,
+		readOnly:    alwaysReadOnly,
+	},
+	{
+		name:        "export-networkd",
+		usage:       "export-networkd [--name wg0] [--private-key-file path]",
+		description: "Exports the server config as systemd-networkd .netdev and .network files, same as 'export networkd'.",
+		run:         runExportNetworkdCommand,
+	},
+}
+
+// findCommand returns the subcommand with the given name or nil if there is none.
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+
+	return nil
+}
+
+// printCommandsUsage prints the list of supported subcommands to stderr.
+func printCommandsUsage() {
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", cmd.usage, cmd.description)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+)
+
+// Output profiles of WireguardConfig.Render. WireSock output keeps every key of the model, wg-quick
+// output drops the keys stock wg-quick and the official mobile apps don't know, and strict output
+// refuses to drop anything.
+const (
+	outputWireSock = iota
+	outputWgQuick
+	outputStrict
+)
+
+// wgQuickConfigKeys are the lowercase keys stock wg-quick accepts, by section. The official mobile
+// apps reject configurations with any other key.
+var wgQuickConfigKeys = map[string]map[string]bool{
+	"interface": {
+		"privatekey": true, "listenport": true, "fwmark": true, "address": true, "dns": true, "mtu": true,
+		"table": true, "preup": true, "postup": true, "predown": true, "postdown": true, "saveconfig": true,
+	},
+	"peer": {
+		"publickey": true, "presharedkey": true, "allowedips": true, "endpoint": true, "persistentkeepalive": true,
+	},
+}
+
+// parseOutputProfile parses the name of an output profile: wiresock, wgquick or strict.
+func parseOutputProfile(name string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "wiresock", "":
+		return outputWireSock, nil
+	case "wgquick", "wg-quick":
+		return outputWgQuick, nil
+	case "strict":
+		return outputStrict, nil
+	}
+
+	return 0, newError(errValidation, "invalid output profile '%s', expected wiresock, wgquick or strict", name)
+}
+
+// wgQuickLines returns the "Key = Value" lines wg-quick accepts in the section, and the keys of
+// the ones it doesn't.
+func wgQuickLines(lines []string, section string) ([]string, []string) {
+	var kept, dropped []string
+	for _, line := range lines {
+		key, _, _ := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if wgQuickConfigKeys[section][strings.ToLower(key)] {
+			kept = append(kept, line)
+		} else {
+			dropped = append(dropped, key)
+		}
+	}
+
+	return kept, dropped
+}
+
+// ForProfile returns a copy of the configuration restricted to the given output profile. With
+// outputWgQuick the WireSock and AmneziaWG extensions, such as the junk packet parameters and
+// unknown keys kept by lenient parsing, are dropped and named in the warnings. With outputStrict
+// the same extensions are a validation error instead. Comments are always kept.
+//
+// Parameters:
+//     profile (int): outputWireSock, outputWgQuick or outputStrict.
+//
+// Returns:
+//     WireguardConfig: The configuration without the keys the profile doesn't allow.
+//     []string: A warning per dropped key.
+//     error: A validation error listing the extensions for outputStrict, nil otherwise.
+//
+// Usage:
+//     mobile, warnings, _ := config.Clients[0].ForProfile(outputWgQuick)
+func (wc WireguardConfig) ForProfile(profile int) (WireguardConfig, []string, error) {
+	if profile == outputWireSock {
+		return wc, nil, nil
+	}
+
+	var dropped []string
+	if wc.Jc != 0 {
+		dropped = append(dropped, "[Interface] Jc, Jmin and Jmax (AmneziaWG junk packets)")
+		wc.Jc, wc.Jmin, wc.Jmax = 0, 0, 0
+	}
+
+	var keys []string
+	wc.Unknown, keys = wgQuickLines(wc.Unknown, "interface")
+	for _, key := range keys {
+		dropped = append(dropped, "[Interface] "+key)
+	}
+
+	wc.Peers = append([]Peer(nil), wc.Peers...)
+	for i := range wc.Peers {
+		wc.Peers[i].Unknown, keys = wgQuickLines(wc.Peers[i].Unknown, "peer")
+		for _, key := range keys {
+			dropped = append(dropped, "[Peer] "+key)
+		}
+	}
+
+	if profile == outputStrict && len(dropped) > 0 {
+		return wc, nil, newError(errValidation, "the configuration uses keys stock wg-quick doesn't support: %s",
+			strings.Join(dropped, ", "))
+	}
+
+	warnings := make([]string, 0, len(dropped))
+	for _, key := range dropped {
+		warnings = append(warnings, key+" left out, stock wg-quick and the mobile apps don't support it")
+	}
+
+	return wc, warnings, nil
+}
+
+// Render returns the configuration file content for the given output profile, see ForProfile.
+//
+// Usage:
+//     content, warnings, err := client.Render(outputWgQuick)
+func (wc WireguardConfig) Render(profile int) (string, []string, error) {
+	filtered, warnings, err := wc.ForProfile(profile)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return filtered.String(), warnings, nil
+}
+
+// mobileQrContent returns the configuration of the client with the given zero-based index as
+// encoded into QR codes, always in the wg-quick profile since the mobile apps reject unknown keys.
+// The junk packet parameters are kept: clients using them are meant for the AmneziaWG app.
+func (config *appConfig) mobileQrContent(index int) (string, []string) {
+	mobile, warnings := config.mobileQrConfig(index)
+	return mobile.String(), warnings
+}
+
+// mobileQrConfig returns the configuration encoded by mobileQrContent, for 'analyze' to measure
+// its sections.
+func (config *appConfig) mobileQrConfig(index int) (WireguardConfig, []string) {
+	client := config.Clients[index]
+	client.Jc = 0
+	mobile, warnings, _ := client.ForProfile(outputWgQuick)
+	mobile.Jc, mobile.Jmin, mobile.Jmax = config.Clients[index].Jc, config.Clients[index].Jmin, config.Clients[index].Jmax
+
+	return mobile, warnings
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// extensionKeys are the WireSock and AmneziaWG extensions used by testdata/compat/extensions.conf,
+// as named by ForProfile.
+var extensionKeys = []string{
+	"[Interface] Jc, Jmin and Jmax (AmneziaWG junk packets)",
+	"[Interface] AllowedApps",
+	"[Interface] DisallowedApps",
+	"[Peer] DisallowedIPs",
+	"[Peer] Socks5Proxy",
+	"[Peer] Socks5ProxyUsername",
+	"[Peer] Socks5ProxyPassword",
+}
+
+// compatFixture parses a configuration of testdata/compat leniently, keeping its extensions.
+func compatFixture(t *testing.T, name string) WireguardConfig {
+	t.Helper()
+	wc, _, err := parseWireguardConfigText(readTestdata(t, "compat", name), name, parseLenient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wc
+}
+
+func TestParseOutputProfile(t *testing.T) {
+	tests := []struct {
+		name string
+		want int
+	}{
+		{"", outputWireSock},
+		{"wiresock", outputWireSock},
+		{"WgQuick", outputWgQuick},
+		{"wg-quick", outputWgQuick},
+		{" strict ", outputStrict},
+	}
+
+	for _, test := range tests {
+		if got, err := parseOutputProfile(test.name); err != nil || got != test.want {
+			t.Errorf("parseOutputProfile(%q) = %d, %v, want %d", test.name, got, err, test.want)
+		}
+	}
+	if _, err := parseOutputProfile("android"); exitCode(err) != exitValidation {
+		t.Errorf("parseOutputProfile(\"android\") = %v, want a validation error", err)
+	}
+}
+
+func TestRenderOutputProfiles(t *testing.T) {
+	wc := compatFixture(t, "extensions.conf")
+	original := wc.String()
+
+	content, warnings, err := wc.Render(outputWireSock)
+	if err != nil || content != original || len(warnings) != 0 {
+		t.Errorf("WireSock profile changed the configuration: %q, %v\n%s", warnings, err, content)
+	}
+
+	content, warnings, err = wc.Render(outputWgQuick)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readTestdata(t, "compat", "extensions-wgquick.conf")
+	if content != want {
+		t.Errorf("wg-quick profile:\n%s\nwant:\n%s", content, want)
+	}
+	var wantWarnings []string
+	for _, key := range extensionKeys {
+		wantWarnings = append(wantWarnings, key+" left out, stock wg-quick and the mobile apps don't support it")
+	}
+	if !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("wg-quick warnings = %q, want %q", warnings, wantWarnings)
+	}
+	// The output parses strictly, as stock wg-quick would read it
+	if _, _, err = parseWireguardConfigText(content, "wg0.conf", parseStrict); err != nil {
+		t.Errorf("wg-quick output doesn't parse strictly: %v", err)
+	}
+
+	_, _, err = wc.Render(outputStrict)
+	if exitCode(err) != exitValidation || !strings.HasSuffix(err.Error(), strings.Join(extensionKeys, ", ")) {
+		t.Errorf("strict profile = %v, want a validation error listing %q", err, extensionKeys)
+	}
+
+	// Filtering works on a copy
+	if wc.String() != original {
+		t.Error("rendering a profile changed the configuration")
+	}
+	if content, warnings, err = compatFixture(t, "extensions-wgquick.conf").Render(outputStrict); err != nil ||
+		content != want || len(warnings) != 0 {
+		t.Errorf("strict profile of a wg-quick configuration: %q, %v", warnings, err)
+	}
+}
+
+func TestBundleOutputProfiles(t *testing.T) {
+	config, _ := newTestProfile(t, 2)
+	extended := compatFixture(t, "extensions.conf")
+	client := &config.Clients[1]
+	client.Jc, client.Jmin, client.Jmax = extended.Jc, extended.Jmin, extended.Jmax
+	client.Unknown = extended.Unknown
+	client.Peers[0].Unknown = extended.Peers[0].Unknown
+
+	for _, test := range []struct {
+		profile int
+		keep    bool
+	}{{outputWireSock, true}, {outputWgQuick, false}} {
+		dir := t.TempDir()
+		if err := config.writeBundle(&dirBundle{dir: dir}, 0, qrcode.Medium, test.profile); err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, "wsclient_2.conf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"Jc = 4", "AllowedApps", "Socks5Proxy"} {
+			if strings.Contains(string(content), key) != test.keep {
+				t.Errorf("profile %d: %s kept %t, want %t", test.profile, key, !test.keep, test.keep)
+			}
+		}
+	}
+
+	if err := config.writeBundle(&dirBundle{dir: t.TempDir()}, 0, qrcode.Medium, outputStrict); err == nil ||
+		!strings.HasPrefix(err.Error(), "client 2:") {
+		t.Errorf("strict bundle = %v, want an error about client 2", err)
+	}
+
+	// QR codes are for the mobile apps, which reject unknown keys but AmneziaWG needs the junk packets
+	qrContent, warnings := config.mobileQrContent(1)
+	if strings.Contains(qrContent, "AllowedApps") || strings.Contains(qrContent, "Socks5Proxy") ||
+		!strings.Contains(qrContent, "Jc = 4") {
+		t.Errorf("QR code content:\n%s", qrContent)
+	}
+	if len(warnings) != len(extensionKeys)-1 {
+		t.Errorf("QR code warnings = %q", warnings)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// verifyConsistency checks the application configuration for problems that would make the
+// generated configuration files misbehave in ways that are hard to diagnose.
+//
+// Wireguard identifies peers solely by their keys, so two clients sharing a private key (or two
+// server peers sharing a public key) result in devices that can't be connected simultaneously.
+// Such a collision should never happen, but a broken import or random number generator would
+// produce it, so it is reported as soon as possible. Server peers whose public key doesn't match
+// the private key of their client (see verifyClientKeys) are reported as well.
+//
+// Returns:
+//     error: An error identifying the first problem found, or nil if the configuration is consistent.
+//
+// Usage:
+//     err := config.verifyConsistency()
+func (config *appConfig) verifyConsistency() error {
+	privateKeys := make(map[string]int, len(config.Clients))
+	for i, client := range config.Clients {
+		if client.PrivateKey == "" {
+			continue
+		}
+		if j, found := privateKeys[client.PrivateKey]; found {
+			return newError(errValidation, "clients %d and %d share the same private key", j+1, i+1)
+		}
+		privateKeys[client.PrivateKey] = i
+	}
+
+	publicKeys := make(map[string]int, len(config.Server.Peers))
+	for i, peer := range config.Server.Peers {
+		if j, found := publicKeys[peer.PublicKey]; found {
+			return newError(errValidation, "server peers %d and %d share the same public key %s", j+1, i+1, peer.PublicKey)
+		}
+		publicKeys[peer.PublicKey] = i
+	}
+
+	if mismatches := config.verifyClientKeys(); len(mismatches) > 0 {
+		return mismatches[0]
+	}
+
+	return nil
+}
+
+// keyMismatch describes a server peer whose public key doesn't correspond to the private key
+// stored for its client.
+type keyMismatch struct {
+	Client          int    // Zero-based index of the client and of its server peer
+	PeerPublicKey   string // Public key of the server peer entry
+	ClientPublicKey string // Public key derived from the client private key
+}
+
+// Error implements the error interface.
+func (m keyMismatch) Error() string {
+	return fmt.Sprintf("server peer of client %d has public key %s but the client private key gives %s",
+		m.Client+1, keyFingerprint(m.PeerPublicKey), keyFingerprint(m.ClientPublicKey))
+}
+
+// keyFingerprint returns a short fingerprint of a base64 encoded key, which identifies the key
+// in messages without printing it in full.
+func keyFingerprint(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return "SHA256:" + hex.EncodeToString(hash[:6])
+}
+
+// verifyClientKeys derives the public key from each stored client private key and compares it
+// with the matching server peer entry. Clients and server peers are matched by index, the way
+// addClient creates them. Clients without a stored private key (imported with external keys)
+// are skipped.
+//
+// Returns:
+//     []keyMismatch: The mismatches found, empty if all keys correspond.
+//
+// Usage:
+//     mismatches := config.verifyClientKeys()
+func (config *appConfig) verifyClientKeys() []keyMismatch {
+	var mismatches []keyMismatch
+
+	for i, client := range config.Clients {
+		if client.PrivateKey == "" || i >= len(config.Server.Peers) {
+			continue
+		}
+
+		publicKey, err := base64PublicKeyFromPrivate(client.PrivateKey)
+		if err != nil || publicKey != config.Server.Peers[i].PublicKey {
+			mismatches = append(mismatches, keyMismatch{
+				Client:          i,
+				PeerPublicKey:   config.Server.Peers[i].PublicKey,
+				ClientPublicKey: publicKey,
+			})
+		}
+	}
+
+	return mismatches
+}
+
+// verifyFiles checks that the configuration files in the profile directory are what the stored
+// configuration generates: every file is parsed back and compared with the model it is rendered
+// from, like checkRoundTrip does before writing. It catches files lost, edited by hand or left
+// behind by an interrupted change, and is the check an integration harness runs after every step.
+// A missing file is only lost if it was written before, see FileHashes: 'adopt' leaves the files
+// to the next change.
+// Pinned clients are skipped, their files are frozen on purpose, and so is everything while changes
+// are staged, since the files wait for 'apply'.
+//
+// Parameters:
+//     configPath (string): The profile directory.
+//
+// Returns:
+//     []string: The files that don't match, with the mismatching fields.
+//
+// Usage:
+//     for _, problem := range config.verifyFiles(configPath) { ... }
+func (config *appConfig) verifyFiles(configPath string) []string {
+	if config.staged() {
+		return nil
+	}
+
+	var problems []string
+	compare := func(fileName string, content []byte, err error, expected WireguardConfig) {
+		if _, recorded := config.FileHashes[fileName]; os.IsNotExist(err) && !recorded {
+			// Not generated yet, e.g. right after 'adopt'
+			return
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s can't be read: %v", fileName, err))
+			return
+		}
+		parsed, _, err := parseWireguardConfigText(string(content), fileName, parseLenient)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s doesn't parse: %v", fileName, err))
+			return
+		}
+		if mismatches := diffLines(modelLines(expected), modelLines(parsed)); len(mismatches) > 0 {
+			problems = append(problems, fmt.Sprintf("%s doesn't match the configuration:\n%s", fileName,
+				strings.Join(mismatches, "\n")))
+		}
+	}
+
+	for i := range config.Clients {
+		if config.isPinned(i) {
+			continue
+		}
+		content, err := config.readClientFile(configPath, i)
+		compare(fmt.Sprintf(defaultClientConfigFile, i+1), content, err, config.clientFileConfig(i))
+	}
+	content, err := ioutil.ReadFile(configPath + config.serverConfigFile())
+	compare(config.serverConfigFile(), content, err, config.serverFileConfig())
+
+	return problems
+}
+
+// runFsckCommand implements the 'fsck' command, which checks the stored configuration for
+// inconsistencies and reports all of them. With --repair, server peers whose public key doesn't
+// match their client private key are regenerated from the client key and the server
+// configuration file is rewritten. All the other problems found by Validate are reported too.
+// With --files the configuration files on disk are checked against the configuration as well, see
+// verifyFiles:
+//
+//     fsck
+//     fsck --repair
+//     fsck --files
+func runFsckCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "Regenerate mismatching server peers from the client keys")
+	files := flags.Bool("files", false, "Check that the configuration files on disk match the configuration")
+
+	if err := parseFlags(flags, "fsck", args); err != nil {
+		return err
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	for i, client := range config.Clients {
+		if client.PrivateKey == "" {
+			fmt.Printf("Note: client %d has an external key, %s; its server peer can't be verified.\n", i+1,
+				config.externalKeyReason(i))
+		}
+	}
+	if len(config.Server.Peers) != len(config.Clients) {
+		fmt.Printf("Warning: the server has %d peers but there are %d clients.\n",
+			len(config.Server.Peers), len(config.Clients))
+	}
+
+	mismatches := config.verifyClientKeys()
+	for _, mismatch := range mismatches {
+		fmt.Println("Error:", mismatch.Error())
+	}
+
+	if len(mismatches) > 0 && *repair {
+		for _, mismatch := range mismatches {
+			config.Server.Peers[mismatch.Client].PublicKey = mismatch.ClientPublicKey
+		}
+		serverFileName, err := config.writeServerConfigFile(configPath)
+		if err != nil {
+			return err
+		}
+		fmt.Println(config.savedMessage("server configuration", serverFileName))
+
+		if err = config.saveWithHistory(configPath, "fsck --repair", false); err != nil {
+			return fmt.Errorf("failed to store the application configuration: %w", err)
+		}
+		appendAuditLog(configPath, "fsck --repair", mismatches)
+	}
+
+	if len(mismatches) > 0 && !*repair {
+		return newError(errValidation, "configuration is inconsistent, run 'fsck --repair' to fix the server peers")
+	}
+	if problems := config.Validate(); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println("Error:", problem.Error())
+		}
+		return newError(errValidation, "configuration is not deployable, %d problems found", len(problems))
+	}
+	if *files {
+		if problems := config.verifyFiles(configPath); len(problems) > 0 {
+			for _, problem := range problems {
+				fmt.Println("Error:", problem)
+			}
+			return newError(errValidation, "%d configuration files don't match the configuration, see 'show --diff' and "+
+				"'accept-drift'", len(problems))
+		}
+	}
+	for _, warning := range config.Warnings() {
+		fmt.Println("Warning:", warning)
+	}
+
+	fmt.Println("Configuration is consistent.")
+	return nil
+}
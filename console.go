@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// Global options, accepted anywhere on the command line before or after the command.
+var (
+	// quietMode suppresses all informational output and never prompts, for cron and scripting.
+	quietMode bool
+	// verboseMode prints details for debugging, e.g. the QR code payload measurements.
+	verboseMode bool
+	// assumeYes answers yes to every confirmation.
+	assumeYes bool
+	// skipRoundTrip disables the self-check of the generated files, see checkRoundTrip.
+	skipRoundTrip bool
+	// proxySetting selects the proxy of the outbound HTTP requests, see httpClient.
+	proxySetting string
+	// cloudMetadataSetting selects the instance metadata service asked for the external IP address
+	// first, see cloudMetadataIP.
+	cloudMetadataSetting = cloudMetadataAuto
+	// outputFormat selects how command results are printed, "text" or "json".
+	outputFormat = "text"
+	// applyChanges writes the configuration files of a change right away, -apply=false stages the
+	// change until 'apply', see staged.
+	applyChanges = true
+)
+
+// resultOutput is where command results are printed. It stays the real stdout in quiet mode,
+// when informational output sent to os.Stdout is discarded.
+var resultOutput = os.Stdout
+
+// stdinReader is shared by all the prompts, so that input buffered by one prompt is not lost to
+// the next one when answers are piped in.
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// stdinExhausted is set once the end of the input has been reached, e.g. when piped answers run out.
+var stdinExhausted bool
+
+// globalFlags declares the global options, so that they are parsed with the flag syntax and can be
+// set from the environment like every other flag.
+func globalFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("global", flag.ContinueOnError)
+	flags.BoolVar(&quietMode, "quiet", false, "")
+	flags.BoolVar(&quietMode, "q", false, "")
+	flags.BoolVar(&verboseMode, "verbose", false, "")
+	flags.BoolVar(&verboseMode, "v", false, "")
+	flags.BoolVar(&assumeYes, "yes", false, "")
+	flags.BoolVar(&assumeYes, "y", false, "")
+	flags.BoolVar(&skipRoundTrip, "no-roundtrip", false, "")
+	flags.BoolVar(&applyChanges, "apply", true, "")
+	flags.StringVar(&outputFormat, "format", "text", "")
+	flags.StringVar(&configPathOverride, "config-path", "", "")
+	flags.StringVar(&profileName, "profile", "", "")
+	flags.StringVar(&proxySetting, "proxy", "", "")
+	flags.StringVar(&cloudMetadataSetting, "cloud-metadata", cloudMetadataAuto, "")
+
+	return flags
+}
+
+// parseGlobalFlags removes the global options (-quiet, -verbose, -yes, -no-roundtrip, -apply, -format json, -config-path,
+// -profile, -proxy and -cloud-metadata, with one or two dashes) from the arguments, applies them together with their WGQC_ environment
+// variables and returns the remaining arguments.
+func parseGlobalFlags(args []string) ([]string, error) {
+	var remaining, global []string
+
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") {
+			remaining = append(remaining, args[i])
+			continue
+		}
+
+		switch name {
+		case "quiet", "q", "verbose", "v", "yes", "y", "no-roundtrip", "apply":
+			global = append(global, args[i])
+		case "format", "config-path", "profile", "proxy", "cloud-metadata":
+			global = append(global, args[i])
+			if !hasValue {
+				if i+1 == len(args) {
+					return nil, newError(errUsage, "-%s requires a value", name)
+				}
+				i++
+				global = append(global, args[i])
+			}
+		default:
+			remaining = append(remaining, args[i])
+		}
+	}
+
+	if err := parseFlags(globalFlags(), "", global); err != nil {
+		return nil, err
+	}
+	if outputFormat != "text" && outputFormat != "json" {
+		return nil, newError(errUsage, "invalid output format '%s', expected text or json", outputFormat)
+	}
+	if err := checkProxySetting(proxySetting); err != nil {
+		return nil, err
+	}
+	if err := checkCloudMetadataSetting(cloudMetadataSetting); err != nil {
+		return nil, err
+	}
+
+	if quietMode {
+		// Informational output is discarded, errors are still reported through log on stderr
+		if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			os.Stdout = devNull
+		}
+	} else if outputFormat == "json" {
+		// Keep stdout parseable, informational output and prompts move to stderr
+		os.Stdout = os.Stderr
+	}
+
+	return remaining, nil
+}
+
+// readInput prints the prompt and reads a line of user input from the console. In quiet mode
+// nothing is printed nor read and an empty answer is returned, so every prompt falls back to
+// its default.
+//
+// A last line without a trailing newline, as left by a file or a here-doc, is a valid answer.
+// Once the input has ended, e.g. because fewer answers than questions were piped in, the
+// remaining prompts fall back to their defaults with -yes and terminate the program with a usage
+// error otherwise, instead of answering every question with an empty line.
+func readInput(prompt string) string {
+	if quietMode {
+		return ""
+	}
+
+	fmt.Print(prompt)
+	if !stdinExhausted {
+		input, err := stdinReader.ReadString('\n')
+		if err == io.EOF {
+			stdinExhausted = true
+			if input != "" {
+				fmt.Println()
+				return strings.TrimSpace(input)
+			}
+		} else if err != nil {
+			fatal(newError(errDependency, "failed to read the answer from the console: %w", err))
+		} else {
+			return strings.TrimSpace(input)
+		}
+	}
+
+	fmt.Println()
+	if !assumeYes {
+		fatal(newError(errUsage, "the input ended before the question was answered, "+
+			"use -yes to accept the defaults of the remaining questions"))
+	}
+
+	return ""
+}
+
+// readSecret asks for a secret such as a passphrase like readInput, without echoing it on the
+// console, see disableConsoleEcho. Piped answers and consoles whose echo can't be turned off are
+// read by readInput. The echo is turned back on even if the user interrupts the prompt.
+func readSecret(prompt string) string {
+	if quietMode || stdinExhausted || !isTerminal(os.Stdin) {
+		return readInput(prompt)
+	}
+	restore, err := disableConsoleEcho(os.Stdin)
+	if err != nil {
+		return readInput(prompt)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	answered := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupt:
+			restore()
+			fmt.Println()
+			os.Exit(exitInterrupted)
+		case <-answered:
+		}
+	}()
+
+	fmt.Print(prompt)
+	input, err := stdinReader.ReadString('\n')
+	close(answered)
+	signal.Stop(interrupt)
+	restore()
+	// The Enter key isn't echoed either
+	fmt.Println()
+
+	if err == io.EOF {
+		stdinExhausted = true
+	} else if err != nil {
+		fatal(newError(errDependency, "failed to read the answer from the console: %w", err))
+	}
+	return strings.TrimSpace(input)
+}
+
+// printResult prints the result of a command. With -format json the value is encoded as JSON,
+// otherwise the text is printed. Results are printed even in quiet mode.
+//
+// Parameters:
+//     text (string): The human readable result.
+//     value (interface{}): The result encoded with -format json.
+//
+// Usage:
+//     printResult(defaults.String(), defaults)
+func printResult(text string, value interface{}) {
+	if outputFormat == "json" {
+		encoder := json.NewEncoder(resultOutput)
+		encoder.SetIndent("", " ")
+		encoder.Encode(value)
+		return
+	}
+
+	fmt.Fprint(resultOutput, text)
+}
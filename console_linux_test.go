@@ -0,0 +1,71 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPseudoTerminal opens a new pseudo-terminal and returns its terminal side.
+func openPseudoTerminal(t *testing.T) *os.File {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("no pseudo-terminals:", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	if err = unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatal(err)
+	}
+	number, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	terminal, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { terminal.Close() })
+
+	return terminal
+}
+
+func TestDisableConsoleEcho(t *testing.T) {
+	terminal := openPseudoTerminal(t)
+	lflag := func() uint32 {
+		termios, err := unix.IoctlGetTermios(int(terminal.Fd()), unix.TCGETS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return termios.Lflag
+	}
+	if lflag()&unix.ECHO == 0 {
+		t.Fatal("a new terminal doesn't echo")
+	}
+
+	restore, err := disableConsoleEcho(terminal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := lflag(); mode&unix.ECHO != 0 || mode&unix.ICANON == 0 || mode&unix.ISIG == 0 {
+		t.Errorf("mode while hidden %#x, want no ECHO with ICANON and ISIG", mode)
+	}
+	restore()
+	if lflag()&unix.ECHO == 0 {
+		t.Error("the echo wasn't restored")
+	}
+
+	// Files and pipes have no echo to turn off, readSecret reads them like readInput
+	file, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = disableConsoleEcho(file); err == nil {
+		t.Errorf("disabling the echo of %s succeeded", os.DevNull)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scriptedInput makes the prompts of the test read the given input, as if it was piped in, and
+// answer the confirmations with -yes or not.
+func scriptedInput(t *testing.T, input string, yes bool) {
+	t.Helper()
+	previousReader, previousExhausted := stdinReader, stdinExhausted
+	previousYes, previousQuiet := assumeYes, quietMode
+	stdinReader = bufio.NewReader(strings.NewReader(input))
+	stdinExhausted, assumeYes, quietMode = false, yes, false
+	t.Cleanup(func() {
+		stdinReader, stdinExhausted = previousReader, previousExhausted
+		assumeYes, quietMode = previousYes, previousQuiet
+	})
+}
+
+// initAnswers holds the answers to the questions of initFlow.
+type initAnswers struct {
+	Subnet   string
+	FileName string
+	Metadata []metadataEntry
+}
+
+// initFlow asks the questions of the first run that don't depend on the network: the subnet, the
+// server configuration file name and the metadata of the first client.
+func initFlow() (initAnswers, error) {
+	_, subnet, err := configureWireguardSubnet()
+	if err != nil {
+		return initAnswers{}, err
+	}
+	fileName := configureServerConfigFile("wiresock.conf")
+
+	return initAnswers{Subnet: subnet.String(), FileName: fileName, Metadata: askClientMetadata()}, nil
+}
+
+func TestReadInputPipedAnswers(t *testing.T) {
+	entered := initAnswers{Subnet: "10.20.0.0/24", FileName: "wg0.conf",
+		Metadata: []metadataEntry{{Key: "Owner", Value: "alice"}}}
+	defaults := initAnswers{Subnet: defaultWireguardSubnet, FileName: "wiresock.conf"}
+
+	tests := []struct {
+		name  string
+		input string
+		yes   bool
+		want  initAnswers
+	}{
+		{"every answer", "10.20.0.0/24\nwg0.conf\nOwner=alice\n", false, entered},
+		{"last line without newline", "10.20.0.0/24\nwg0.conf\nOwner=alice", false, entered},
+		{"CRLF line endings", "10.20.0.0/24\r\nwg0.conf\r\nOwner=alice\r\n", false, entered},
+		{"one answer short with -yes", "10.20.0.0/24\nwg0.conf\n", true,
+			initAnswers{Subnet: "10.20.0.0/24", FileName: "wg0.conf"}},
+		{"no answers with -yes", "", true, defaults},
+		{"empty answers", "\n\n\n", false, defaults},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scriptedInput(t, test.input, test.yes)
+			got, err := initFlow()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("answers = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadInputAfterEndOfInput(t *testing.T) {
+	scriptedInput(t, "wg0.conf", true)
+	if got := configureServerConfigFile("wiresock.conf"); got != "wg0.conf" {
+		t.Fatalf("unterminated answer = %q", got)
+	}
+
+	// Every later prompt accepts its default instead of reading again
+	for i := 0; i < 3; i++ {
+		if got := readInput("Question:"); got != "" {
+			t.Errorf("prompt %d after the end of the input = %q, want the default", i+1, got)
+		}
+	}
+	if !stdinExhausted {
+		t.Error("the end of the input wasn't recorded")
+	}
+}
+
+// initInputVariable passes the scripted input of TestReadInputEndedWithoutYes to the test binary
+// it runs, since readInput terminates the program when the input ends too early.
+const initInputVariable = "WGQ_TEST_INIT_INPUT"
+
+func TestReadInputEndedWithoutYes(t *testing.T) {
+	if input, found := os.LookupEnv(initInputVariable); found {
+		scriptedInput(t, input, false)
+		answers, err := initFlow()
+		fmt.Printf("answers %+v, error %v\n", answers, err)
+		os.Exit(0)
+	}
+
+	for _, input := range []string{"", "10.20.0.0/24\nwg0.conf\n"} {
+		cmd := exec.Command(os.Args[0], "-test.run", "^TestReadInputEndedWithoutYes$")
+		cmd.Env = append(os.Environ(), initInputVariable+"="+input)
+		output, err := cmd.CombinedOutput()
+
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.ExitCode() != exitUsage {
+			t.Errorf("input %q: %v, want exit code %d\n%s", input, err, exitUsage, output)
+			continue
+		}
+		if !strings.Contains(string(output), "the input ended before the question was answered") {
+			t.Errorf("input %q: the error doesn't explain the end of the input:\n%s", input, output)
+		}
+	}
+}
+
+func TestReadSecretPiped(t *testing.T) {
+	scriptedInput(t, "correct horse\r\nbattery staple\n", false)
+	for _, want := range []string{"correct horse", "battery staple"} {
+		if got := readSecret("Passphrase:"); got != want {
+			t.Errorf("readSecret() = %q, want %q", got, want)
+		}
+	}
+
+	scriptedInput(t, "", true)
+	if got := readSecret("Passphrase:"); got != "" || !stdinExhausted {
+		t.Errorf("readSecret() after the end of the input = %q", got)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Dynamic DNS providers supported by 'ddns'.
+const (
+	ddnsGeneric    = "generic"
+	ddnsDuckDns    = "duckdns"
+	ddnsCloudflare = "cloudflare"
+)
+
+// ddnsTokenFile stores the API token of the DDNS provider in the profile directory, readable by the
+// owner only. It is kept out of config.json, its history and all generated files.
+const ddnsTokenFile = "ddns-token"
+
+// ddnsTokenEnv overrides the stored DDNS API token, e.g. for tokens kept in a secret store.
+const ddnsTokenEnv = envPrefix + "DDNS_TOKEN"
+
+// ddnsSettings configures the dynamic DNS hostname the clients use as endpoint, which 'ddns update'
+// points at the current external IP address of the server. The API token is stored separately,
+// see ddnsToken.
+type ddnsSettings struct {
+	Provider string // One of ddnsGeneric, ddnsDuckDns or ddnsCloudflare
+	Hostname string
+	// URL is the update URL of the generic provider, {hostname}, {ip} and {token} are replaced.
+	URL string `json:",omitempty"`
+	// ZoneID is the Cloudflare zone holding the hostname.
+	ZoneID     string     `json:",omitempty"`
+	LastIP     string     `json:",omitempty"`
+	LastUpdate *time.Time `json:",omitempty"`
+}
+
+// detectExternalIP returns the external IP address of this host, see detectExternalIPWithSource.
+func detectExternalIP() (net.IP, error) {
+	ip, _, err := detectExternalIPWithSource()
+	return ip, err
+}
+
+// detectExternalIPWithSource returns the external IP address of this host and where it came from,
+// see externalIPResolver.
+func detectExternalIPWithSource() (net.IP, string, error) {
+	return externalIPResolver()
+}
+
+// externalIPResolver detects the external IP address, lookupExternalIP unless replaced, e.g. by a
+// fixed address for an integration harness without network access.
+var externalIPResolver = lookupExternalIP
+
+// lookupExternalIP returns the external IP address of this host and where it came from:
+// the instance metadata service of the cloud the server runs in, see cloudMetadataIP, and
+// otherwise a consensus of public IP services, asked through the proxy of httpClient. A metadata
+// service selected with -cloud-metadata that doesn't answer is reported before falling back.
+//
+// Returns:
+//     net.IP: The external IP address, never nil when the error is nil.
+//     string: The source of the address, e.g. "the AWS instance metadata service".
+//     error: An error if no source answered.
+//
+// Usage:
+//     ip, source, err := lookupExternalIP()
+func lookupExternalIP() (net.IP, string, error) {
+	ip, source, err := cloudMetadataIP()
+	if ip != nil {
+		return ip, source, nil
+	}
+	if err != nil && (cloudMetadataSetting != cloudMetadataAuto || verboseMode) {
+		fmt.Printf("Warning: %s, asking public IP services instead.\n", err)
+	}
+
+	progress := startSpinner("Detecting external IP address")
+	defer progress.Stop()
+
+	ip, err = externalIPConsensus().ExternalIP()
+	if proxy := proxyInUse("https://icanhazip.com/"); err != nil && proxy != "" {
+		return nil, "", fmt.Errorf("%w, asked through the proxy %s", err, proxy)
+	}
+
+	return ip, consensusSource, err
+}
+
+// ddnsToken returns the API token of the DDNS provider, from WGQC_DDNS_TOKEN or the token file of
+// the profile.
+func ddnsToken(configPath string) (string, error) {
+	if token, found := os.LookupEnv(ddnsTokenEnv); found {
+		return strings.TrimSpace(token), nil
+	}
+
+	content, err := ioutil.ReadFile(configPath + ddnsTokenFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	return strings.TrimSpace(string(content)), err
+}
+
+// ddnsRequest performs a provider API request and returns the response body, failing on HTTP
+// error statuses. DuckDNS and generic update URLs carry the token in the query string, so the
+// errors name the host of the provider, never the URL.
+func ddnsRequest(method string, requestUrl string, token string, body interface{}) ([]byte, error) {
+	var content []byte
+	if body != nil {
+		var err error
+		if content, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	request, err := http.NewRequest(method, requestUrl, bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("invalid update URL")
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" && strings.HasPrefix(requestUrl, "https://api.cloudflare.com/") {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := httpClient().Do(request)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return nil, fmt.Errorf("%s: %w", request.URL.Host, urlErr.Err)
+	} else if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	answer, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return answer, fmt.Errorf("%s answered %s", request.URL.Host, response.Status)
+	}
+
+	return answer, nil
+}
+
+// cloudflareResponse is the envelope of the Cloudflare API responses.
+type cloudflareResponse struct {
+	Success bool
+	Errors  []struct {
+		Message string
+	}
+	Result json.RawMessage
+}
+
+// cloudflareUpdate points the A record of the hostname in the zone at the address.
+func cloudflareUpdate(zoneID string, hostname string, ip net.IP, token string) error {
+	records := "https://api.cloudflare.com/client/v4/zones/" + url.PathEscape(zoneID) + "/dns_records"
+
+	answer, err := ddnsRequest(http.MethodGet, records+"?type=A&name="+url.QueryEscape(hostname), token, nil)
+	if err != nil {
+		return err
+	}
+	var response cloudflareResponse
+	var found []struct {
+		ID string
+	}
+	if err = json.Unmarshal(answer, &response); err != nil || json.Unmarshal(response.Result, &found) != nil {
+		return fmt.Errorf("unexpected Cloudflare response")
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("there is no A record for %s in the Cloudflare zone, create it first", hostname)
+	}
+
+	answer, err = ddnsRequest(http.MethodPatch, records+"/"+url.PathEscape(found[0].ID), token,
+		map[string]string{"content": ip.String()})
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(answer, &response); err != nil || !response.Success {
+		return fmt.Errorf("Cloudflare refused the update: %v", response.Errors)
+	}
+
+	return nil
+}
+
+// update points the hostname at the given address through the provider API.
+//
+// Parameters:
+//     ip (net.IP): The external IP address of the server.
+//     token (string): The API token of the provider, see ddnsToken.
+//
+// Returns:
+//     error: An error if the provider can't be reached or refuses the update.
+//
+// Usage:
+//     err := config.DDNS.update(externalIP, token)
+func (settings *ddnsSettings) update(ip net.IP, token string) error {
+	switch settings.Provider {
+	case ddnsDuckDns:
+		domain := strings.TrimSuffix(settings.Hostname, ".duckdns.org")
+		answer, err := ddnsRequest(http.MethodGet, "https://www.duckdns.org/update?domains="+url.QueryEscape(domain)+
+			"&token="+url.QueryEscape(token)+"&ip="+url.QueryEscape(ip.String()), token, nil)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(answer)) != "OK" {
+			return fmt.Errorf("DuckDNS refused the update, check the domain and the token")
+		}
+		return nil
+
+	case ddnsCloudflare:
+		return cloudflareUpdate(settings.ZoneID, settings.Hostname, ip, token)
+
+	case ddnsGeneric:
+		requestUrl := strings.NewReplacer("{hostname}", url.QueryEscape(settings.Hostname),
+			"{ip}", url.QueryEscape(ip.String()), "{token}", url.QueryEscape(token)).Replace(settings.URL)
+		_, err := ddnsRequest(http.MethodGet, requestUrl, token, nil)
+		return err
+	}
+
+	return newError(errValidation, "unknown DDNS provider '%s'", settings.Provider)
+}
+
+// ddnsStatus describes whether the DDNS hostname currently resolves to the external IP address, as
+// shown by 'ddns status' and 'doctor', and reports whether it does. It returns an empty string and
+// true if DDNS isn't configured.
+func (config *appConfig) ddnsStatus(externalIP net.IP) (string, bool) {
+	if config.DDNS == nil {
+		return "", true
+	}
+
+	addresses, err := net.LookupIP(config.DDNS.Hostname)
+	if err != nil {
+		return fmt.Sprintf("DDNS hostname %s doesn't resolve: %s", config.DDNS.Hostname, err), false
+	}
+	if externalIP == nil {
+		return fmt.Sprintf("DDNS hostname %s resolves to %s, the external IP address is unknown",
+			config.DDNS.Hostname, joinIPs(addresses)), false
+	}
+	for _, address := range addresses {
+		if address.Equal(externalIP) {
+			return fmt.Sprintf("DDNS hostname %s resolves to the external IP address %s", config.DDNS.Hostname, externalIP), true
+		}
+	}
+
+	return fmt.Sprintf("DDNS hostname %s resolves to %s but the external IP address is %s, run 'ddns update'",
+		config.DDNS.Hostname, joinIPs(addresses), externalIP), false
+}
+
+// ddnsEndpointWarnings reports clients whose endpoint isn't the DDNS hostname, they break when the
+// external IP address changes.
+func (config *appConfig) ddnsEndpointWarnings() []string {
+	var warnings []string
+	if config.DDNS == nil {
+		return nil
+	}
+
+	for i, client := range config.Clients {
+		for _, peer := range client.Peers {
+			host, _, err := net.SplitHostPort(peer.Endpoint)
+			if err == nil && !sameHost(host, config.DDNS.Hostname) {
+				warnings = append(warnings, fmt.Sprintf("client %d connects to %s instead of the DDNS hostname %s",
+					i+1, host, config.DDNS.Hostname))
+			}
+		}
+	}
+
+	return warnings
+}
+
+// runDdnsCommand implements the 'ddns' command, which keeps a dynamic DNS hostname pointed at the
+// external IP address of the server:
+//
+//     ddns set --provider duckdns --hostname myvpn.duckdns.org --token <token>
+//     ddns set --provider cloudflare --hostname vpn.example.com --zone <zone id> --token <token>
+//     ddns set --provider generic --hostname vpn.example.com --url "https://dyn.example.com/update?host={hostname}&ip={ip}&key={token}"
+//     ddns update [--ip 203.0.113.7]
+//     ddns status
+//     ddns clear
+//
+// The token is stored in the ddns-token file of the profile, readable by the owner only, or taken
+// from WGQC_DDNS_TOKEN. It never ends up in config.json or the generated configuration files.
+func runDdnsCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: ddns set --provider generic|duckdns|cloudflare --hostname name "+
+		"[--token token] [--url template] [--zone id] | update [--ip address] | status | clear")
+	if len(args) == 0 {
+		return usage
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	switch args[0] {
+	case "set":
+		flags := flag.NewFlagSet("ddns", flag.ContinueOnError)
+		provider := flags.String("provider", "", "DDNS provider, generic, duckdns or cloudflare")
+		hostname := flags.String("hostname", "", "Hostname the clients use as endpoint")
+		token := flags.String("token", "", "API token of the provider, stored outside of config.json")
+		updateUrl := flags.String("url", "", "Update URL of the generic provider, with {hostname}, {ip} and {token}")
+		zone := flags.String("zone", "", "Cloudflare zone ID of the hostname")
+		if err = parseFlags(flags, "ddns", args[1:]); err != nil {
+			return err
+		}
+
+		settings := ddnsSettings{Provider: strings.ToLower(*provider), Hostname: strings.TrimSpace(*hostname),
+			URL: *updateUrl, ZoneID: *zone}
+		if settings.Hostname != "" {
+			if settings.Hostname, err = normalizeHostname(settings.Hostname); err != nil {
+				return err
+			}
+		}
+		switch {
+		case flags.NArg() != 0 || settings.Hostname == "":
+			return usage
+		case settings.Provider != ddnsGeneric && settings.Provider != ddnsDuckDns && settings.Provider != ddnsCloudflare:
+			return newError(errValidation, "unknown DDNS provider '%s', expected generic, duckdns or cloudflare", *provider)
+		case settings.Provider == ddnsGeneric && !strings.HasPrefix(settings.URL, "https://") && !strings.HasPrefix(settings.URL, "http://"):
+			return newError(errValidation, "the generic provider needs an update URL, see --url")
+		case settings.Provider == ddnsCloudflare && settings.ZoneID == "":
+			return newError(errValidation, "the cloudflare provider needs the zone ID of the hostname, see --zone")
+		case settings.Provider == ddnsDuckDns && !strings.HasSuffix(settings.Hostname, ".duckdns.org"):
+			return newError(errValidation, "DuckDNS hostnames end with .duckdns.org")
+		}
+
+		if *token != "" {
+			if err = writeFileAtomic(configPath+ddnsTokenFile, []byte(*token+"\n"), 0600); err != nil {
+				return fmt.Errorf("can't store the DDNS token: %w", err)
+			}
+		}
+		config.DDNS = &settings
+
+		for _, warning := range config.ddnsEndpointWarnings() {
+			fmt.Println("Warning:", warning)
+		}
+
+	case "update":
+		flags := flag.NewFlagSet("ddns", flag.ContinueOnError)
+		address := flags.String("ip", "", "Address to publish instead of the detected external IP")
+		if err = parseFlags(flags, "ddns", args[1:]); err != nil {
+			return err
+		}
+		if config.DDNS == nil {
+			return newError(errValidation, "DDNS is not configured, see 'ddns set'")
+		}
+
+		ip := net.ParseIP(*address)
+		if *address == "" {
+			if ip, err = detectExternalIP(); err != nil {
+				return newError(errDependency, "failed to detect the external IP address: %w", err)
+			}
+		} else if ip == nil {
+			return newError(errValidation, "invalid IP address '%s'", *address)
+		}
+
+		token, err := ddnsToken(configPath)
+		if err != nil {
+			return err
+		}
+		if err = config.DDNS.update(ip, token); err != nil {
+			return newError(errDependency, "failed to update %s: %w", config.DDNS.Hostname, err)
+		}
+		fmt.Printf("Updated %s to %s.\n", config.DDNS.Hostname, ip)
+		now := time.Now().UTC()
+		config.DDNS.LastIP, config.DDNS.LastUpdate = ip.String(), &now
+
+	case "status":
+		if config.DDNS == nil {
+			fmt.Println("DDNS is not configured.")
+			return nil
+		}
+		externalIP, err := detectExternalIP()
+		if err != nil {
+			fmt.Println("Warning: failed to detect the external IP address:", err)
+		}
+		status, _ := config.ddnsStatus(externalIP)
+		text := fmt.Sprintf("Provider:    %s\nHostname:    %s\n", config.DDNS.Provider, config.DDNS.Hostname)
+		if config.DDNS.LastUpdate != nil {
+			text += fmt.Sprintf("Last update: %s to %s\n", config.DDNS.LastUpdate.Local().Format("2006-01-02 15:04:05"),
+				config.DDNS.LastIP)
+		}
+		printResult(text+status+"\n", config.DDNS)
+		return nil
+
+	case "clear":
+		config.DDNS = nil
+		if err = os.Remove(configPath + ddnsTokenFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+	default:
+		return usage
+	}
+
+	operation := "ddns " + args[0]
+	if err = config.saveWithHistory(configPath, operation, false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, operation, config.DDNS)
+}
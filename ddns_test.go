@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestDdnsUpdateErrorHidesToken checks that a provider that can't be reached is reported without
+// the update URL, which carries the token in its query string.
+func TestDdnsUpdateErrorHidesToken(t *testing.T) {
+	_, configPath := newTestProfile(t, 1)
+
+	// Nothing listens on the port once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	const token = "s3cret-ddns-token"
+	err = runDdnsCommand(configPath, []string{"set", "--provider", "generic", "--hostname", "vpn.example.com",
+		"--url", "http://" + address + "/update?host={hostname}&ip={ip}&key={token}", "--token", token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runDdnsCommand(configPath, []string{"update", "--ip", "203.0.113.7"})
+	if exitCode(err) != exitDependency {
+		t.Fatalf("update of an unreachable provider = %v, want a dependency error", err)
+	}
+	if strings.Contains(err.Error(), token) || !strings.Contains(err.Error(), address) {
+		t.Errorf("error %q, want the host of the provider without the token", err)
+	}
+
+	// Neither is the token in the error of a request that can't be sent
+	if _, err = ddnsRequest("GET", "http://"+address+"/update?key="+token+"\n", token, nil); err == nil ||
+		strings.Contains(err.Error(), token) {
+		t.Errorf("invalid update URL = %v, want an error without the token", err)
+	}
+}
@@ -0,0 +1,924 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const minMtu = 576
+const maxMtu = 65535
+const maxPersistentKeepalive = 65535
+
+// clientDefaults holds the per-instance baseline applied to every newly created client.
+// It is stored in config.json and replaces the compiled-in defaults once edited.
+type clientDefaults struct {
+	DNS                 dnsList
+	MTU                 uint16
+	PersistentKeepalive uint32
+	AllowedIPs          []net.IPNet
+	// IncludeServerAddress makes sure the server tunnel address is always routed through the
+	// tunnel, so split-tunnel clients can still reach the gateway itself.
+	IncludeServerAddress bool `json:",omitempty"`
+	// ExpiryDays is the lifetime of new clients in days, see clientInfo.Expires. 0 lets them live
+	// until they are removed.
+	ExpiryDays int `json:",omitempty"`
+}
+
+// builtinClientDefaults returns the client defaults derived from the compiled-in constants.
+func builtinClientDefaults() clientDefaults {
+	dns, _ := parseDnsList(defaultDns)
+	allowedIPs, _ := parseAllowedIps(defaultAllowedIps)
+
+	return clientDefaults{
+		DNS:                 dns,
+		MTU:                 defaultMtu,
+		PersistentKeepalive: defaultPersistentKeepalive,
+		AllowedIPs:          allowedIPs,
+	}
+}
+
+// effectiveDefaults returns the client defaults stored in the configuration, or the
+// compiled-in defaults if none have been set yet.
+func (config *appConfig) effectiveDefaults() clientDefaults {
+	if config.Defaults == nil {
+		return builtinClientDefaults()
+	}
+
+	return *config.Defaults
+}
+
+// dnsList is the DNS setting of an Interface: DNS server addresses and search domains, e.g.
+// "10.9.0.1, corp.local", kept in the given order since they are written on a single DNS line.
+// It is stored in config.json as a list of strings, like the address list it replaces.
+type dnsList []string
+
+// servers returns the DNS server addresses of the list, without the search domains.
+func (dns dnsList) servers() []net.IP {
+	var servers []net.IP
+	for _, entry := range dns {
+		if ip := net.ParseIP(entry); ip != nil {
+			servers = append(servers, ip)
+		}
+	}
+
+	return servers
+}
+
+// searchDomains returns the search domains of the list.
+func (dns dnsList) searchDomains() []string {
+	var domains []string
+	for _, entry := range dns {
+		if net.ParseIP(entry) == nil {
+			domains = append(domains, entry)
+		}
+	}
+
+	return domains
+}
+
+// String returns the list as written on the DNS line, e.g. "10.9.0.1, corp.local".
+func (dns dnsList) String() string {
+	return strings.Join(dns, ", ")
+}
+
+// isSearchDomain reports whether the token is a valid DNS search domain such as corp.local. A
+// numeric last label is rejected, so that mistyped addresses like 10.9.0 aren't taken for domains.
+func isSearchDomain(token string) bool {
+	labels := strings.Split(strings.TrimSuffix(token, "."), ".")
+	if len(token) > 253 {
+		return false
+	}
+
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	_, err := strconv.Atoi(labels[len(labels)-1])
+	return err != nil
+}
+
+// parseDnsList parses a comma-separated list of DNS server IPv4 addresses and search domains,
+// keeping their order, e.g. "10.9.0.1, corp.local".
+func parseDnsList(input string) (dnsList, error) {
+	var dns dnsList
+
+	for _, token := range strings.Split(input, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(token); ip != nil {
+			if ip.To4() == nil {
+				return nil, newError(errValidation, "invalid DNS server IPv4 address '%s'", token)
+			}
+			dns = append(dns, ip.String())
+		} else if isSearchDomain(token) {
+			dns = append(dns, token)
+		} else {
+			return nil, newError(errValidation, "invalid DNS server IPv4 address or search domain '%s'", token)
+		}
+	}
+
+	return dns, nil
+}
+
+// parseMtu parses an interface MTU and checks it is within the range accepted by Wireguard.
+func parseMtu(input string) (uint16, error) {
+	mtu, err := strconv.Atoi(strings.TrimSpace(input))
+	if err != nil {
+		return 0, newError(errValidation, "invalid MTU '%s', expected a number between %d and %d",
+			input, minMtu, maxMtu)
+	}
+
+	if err = checkRange("MTU", mtu, minMtu, maxMtu); err != nil {
+		return 0, err
+	}
+
+	return uint16(mtu), nil
+}
+
+// parsePersistentKeepalive parses a persistent keepalive interval in seconds, 0 disables it, see
+// Peer.SetKeepalive.
+func parsePersistentKeepalive(input string) (uint32, error) {
+	keepalive, err := strconv.Atoi(strings.TrimSpace(input))
+	if err != nil {
+		return 0, newError(errValidation, "invalid persistent keepalive '%s', expected a number between 0 and %d",
+			input, maxPersistentKeepalive)
+	}
+
+	var peer Peer
+	err = peer.SetKeepalive(keepalive)
+	return peer.PersistentKeepalive, err
+}
+
+// parseAllowedIps parses a comma-separated list of CIDR networks.
+func parseAllowedIps(input string) ([]net.IPNet, error) {
+	var allowedIPs []net.IPNet
+
+	for _, token := range strings.Split(input, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(token)
+		if err != nil {
+			return nil, newError(errValidation, "invalid CIDR '%s'", token)
+		}
+		allowedIPs = append(allowedIPs, *ipNet)
+	}
+
+	if len(allowedIPs) == 0 {
+		return nil, newError(errValidation, "AllowedIPs must contain at least one network")
+	}
+
+	return allowedIPs, nil
+}
+
+// parseExpiryDays parses the lifetime of new clients, a number of days such as 90 or 90d, where 0
+// or never disables the expiry.
+func parseExpiryDays(input string) (int, error) {
+	input = strings.ToLower(strings.TrimSpace(input))
+	if input == "never" {
+		return 0, nil
+	}
+
+	days, err := strconv.Atoi(strings.TrimSuffix(input, "d"))
+	if err != nil || days < 0 {
+		return 0, newError(errValidation, "invalid expiry '%s', expected a number of days such as 90d, or never", input)
+	}
+
+	return days, nil
+}
+
+// set updates a single default from its textual key and value, using the same validation
+// as the interactive configuration.
+func (defaults *clientDefaults) set(key string, value string) (err error) {
+	switch strings.ToLower(strings.TrimSpace(key)) {
+	case "dns":
+		defaults.DNS, err = parseDnsList(value)
+	case "mtu":
+		defaults.MTU, err = parseMtu(value)
+	case "keepalive":
+		defaults.PersistentKeepalive, err = parsePersistentKeepalive(value)
+	case "allowedips":
+		defaults.AllowedIPs, err = parseAllowedIps(value)
+	case "includeserver":
+		defaults.IncludeServerAddress, err = strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			err = newError(errValidation, "invalid includeserver '%s', expected true or false", value)
+		}
+	case "expiry":
+		defaults.ExpiryDays, err = parseExpiryDays(value)
+	default:
+		err = newError(errUsage, "unknown default '%s', expected one of %s, includeserver, expiry", key,
+			strings.Join(defaultsFields, ", "))
+	}
+
+	return err
+}
+
+// defaultsFields lists the keys of the client fields covered by the defaults.
+var defaultsFields = []string{"dns", "mtu", "keepalive", "allowedips"}
+
+// isDefaultsField reports whether the key names one of the client fields covered by the defaults.
+func isDefaultsField(field string) bool {
+	for _, defaultsField := range defaultsFields {
+		if field == defaultsField {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyTo copies the defaults into the client configuration and its server peer entry.
+func (defaults clientDefaults) applyTo(client *WireguardConfig) {
+	for _, field := range defaultsFields {
+		defaults.applyFieldTo(client, field)
+	}
+}
+
+// applyFieldTo copies a single default, identified by its key, into the client configuration.
+func (defaults clientDefaults) applyFieldTo(client *WireguardConfig, field string) {
+	switch field {
+	case "dns":
+		client.DNS = append(dnsList(nil), defaults.DNS...)
+	case "mtu":
+		client.MTU = defaults.MTU
+	case "keepalive":
+		for i := range client.Peers {
+			client.Peers[i].PersistentKeepalive = defaults.PersistentKeepalive
+		}
+	case "allowedips":
+		for i := range client.Peers {
+			client.Peers[i].AllowedIPs = append([]net.IPNet(nil), defaults.AllowedIPs...)
+		}
+	}
+}
+
+// ensureServerAddressAllowed adds the /32 of every server tunnel address to the AllowedIPs of the
+// client peers that don't already route it through the tunnel, if the IncludeServerAddress
+// default is set. It must be called whenever the AllowedIPs of a client are changed.
+func (config *appConfig) ensureServerAddressAllowed(client *WireguardConfig) {
+	if !config.effectiveDefaults().IncludeServerAddress {
+		return
+	}
+
+	for i := range client.Peers {
+		for _, serverAddress := range clientIpNetToPeer(config.Server.Address) {
+			covered := false
+			for _, allowed := range client.Peers[i].AllowedIPs {
+				if allowed.Contains(serverAddress.IP) {
+					covered = true
+					break
+				}
+			}
+
+			if !covered {
+				client.Peers[i].AllowedIPs = append(client.Peers[i].AllowedIPs, serverAddress)
+			}
+		}
+	}
+}
+
+// clientFieldValue returns the textual value of a client field covered by the defaults.
+func clientFieldValue(client WireguardConfig, field string) string {
+	var values []string
+
+	switch field {
+	case "dns":
+		values = append(values, client.DNS...)
+	case "mtu":
+		values = append(values, strconv.Itoa(int(client.MTU)))
+	case "keepalive":
+		if len(client.Peers) > 0 {
+			values = append(values, strconv.Itoa(int(client.Peers[0].PersistentKeepalive)))
+		}
+	case "allowedips":
+		if len(client.Peers) > 0 {
+			for _, ipNet := range client.Peers[0].AllowedIPs {
+				values = append(values, ipNet.String())
+			}
+		}
+	}
+
+	return strings.Join(values, ",")
+}
+
+// String returns the defaults in the same key=value form accepted by 'defaults set'.
+func (defaults clientDefaults) String() string {
+	allowedIPs := make([]string, 0, len(defaults.AllowedIPs))
+	for _, ipNet := range defaults.AllowedIPs {
+		allowedIPs = append(allowedIPs, ipNet.String())
+	}
+
+	expiry := "never"
+	if defaults.ExpiryDays > 0 {
+		expiry = fmt.Sprintf("%dd", defaults.ExpiryDays)
+	}
+
+	return fmt.Sprintf("dns=%s\nmtu=%d\nkeepalive=%d\nallowedips=%s\nincludeserver=%t\nexpiry=%s\n",
+		strings.Join(defaults.DNS, ","), defaults.MTU, defaults.PersistentKeepalive, strings.Join(allowedIPs, ","),
+		defaults.IncludeServerAddress, expiry)
+}
+
+// runDefaultsCommand implements the 'defaults' command:
+//
+//     defaults show
+//     defaults set dns=1.1.1.1 mtu=1380 keepalive=15
+//     defaults apply --existing
+//
+// Changing defaults only affects clients created afterwards. 'defaults apply --existing' rolls
+// them out to every existing client, it is 'apply-defaults --all': fields set for a single client
+// with 'set-client' are kept, and the changes are shown, confirmed and recorded in the audit log.
+func runDefaultsCommand(configPath string, args []string) error {
+	if len(args) == 0 {
+		return newError(errUsage, "usage: defaults show | set key=value... | apply --existing")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	switch args[0] {
+	case "show":
+		if config.Defaults == nil {
+			fmt.Println("Using built-in defaults:")
+		}
+		defaults := config.effectiveDefaults()
+		printResult(defaults.String(), defaults)
+		return nil
+
+	case "set":
+		if len(args) < 2 {
+			return newError(errUsage, "usage: defaults set key=value...")
+		}
+
+		defaults := config.effectiveDefaults()
+		for _, arg := range args[1:] {
+			key, value, found := strings.Cut(arg, "=")
+			if !found {
+				return newError(errUsage, "invalid argument '%s', expected key=value", arg)
+			}
+			if err = defaults.set(key, value); err != nil {
+				return err
+			}
+		}
+
+		config.Defaults = &defaults
+		if err = config.saveWithHistory(configPath, "defaults set", false); err != nil {
+			return fmt.Errorf("failed to store the application configuration: %w", err)
+		}
+		fmt.Println("Defaults updated. Existing clients are unchanged, use 'defaults apply --existing' to update them.")
+		return nil
+
+	case "apply":
+		if len(args) != 2 || args[1] != "--existing" {
+			return newError(errUsage, "usage: defaults apply --existing")
+		}
+
+		return runApplyDefaultsCommand(configPath, []string{"--all"})
+	}
+
+	return newError(errUsage, "unknown defaults action '%s'", args[0])
+}
+
+// fieldChange records the before and after values of a client field for the audit log.
+type fieldChange struct {
+	Client int
+	Field  string
+	Before string
+	After  string
+}
+
+// runApplyDefaultsCommand implements the 'apply-defaults' command, which rolls the current
+// defaults out to existing clients selectively:
+//
+//     apply-defaults [--clients 1,2,3 | --group name | --all] [--fields dns,mtu,keepalive] [--override]
+//
+// Every client gets the defaults of its group, if any, layered on top of the instance defaults.
+// Only the named fields (all of them when --fields is omitted) of the selected clients are
+// updated. Fields explicitly set for a client with 'set-client' are skipped unless --override is
+// given. The diff of every affected configuration is shown and must be confirmed before the
+// touched client files are regenerated.
+func runApplyDefaultsCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("apply-defaults", flag.ContinueOnError)
+	clients := flags.String("clients", "", "Comma-separated list of client numbers to update")
+	group := flags.String("group", "", "Update the clients of this group")
+	all := flags.Bool("all", false, "Update all clients")
+	fields := flags.String("fields", strings.Join(defaultsFields, ","), "Comma-separated list of fields to update")
+	override := flags.Bool("override", false, "Also update fields explicitly set for a client")
+
+	if err := parseFlags(flags, "apply-defaults", args); err != nil {
+		return err
+	}
+	selections := 0
+	for _, given := range []bool{*clients != "", *group != "", *all} {
+		if given {
+			selections++
+		}
+	}
+	if selections != 1 {
+		return newError(errUsage, "exactly one of --clients, --group or --all must be given")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	var selected []int
+	if *all {
+		for i := range config.Clients {
+			selected = append(selected, i)
+		}
+	} else if *group != "" {
+		if config.findGroup(*group) == nil {
+			return newError(errValidation, "group '%s' does not exist", *group)
+		}
+		if selected = config.groupMembers(*group); len(selected) == 0 {
+			return newError(errUsage, "group '%s' has no clients", *group)
+		}
+	} else if selected, err = config.parseClientSelection(*clients); err != nil {
+		return err
+	}
+
+	var selectedFields []string
+	for _, field := range strings.Split(*fields, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if !isDefaultsField(field) {
+			return newError(errUsage, "unknown field '%s', expected one of %s", field, strings.Join(defaultsFields, ", "))
+		}
+		selectedFields = append(selectedFields, field)
+	}
+
+	var changes []fieldChange
+	var touched []int
+
+	for _, index := range selected {
+		defaults := config.defaultsForClient(index)
+		client := &config.Clients[index]
+		info := config.clientInfo(index)
+		before := client.String()
+		changed := false
+
+		for _, field := range selectedFields {
+			if info.hasOverride(field) && !*override {
+				fmt.Printf("Skipping %s of client %d, it is explicitly set for this client.\n", field, index+1)
+				continue
+			}
+
+			oldValue := clientFieldValue(*client, field)
+			defaults.applyFieldTo(client, field)
+			config.ensureServerAddressAllowed(client)
+			newValue := clientFieldValue(*client, field)
+
+			if oldValue != newValue {
+				changes = append(changes, fieldChange{Client: index + 1, Field: field, Before: oldValue, After: newValue})
+				changed = true
+			}
+		}
+
+		if changed {
+			fmt.Printf("\nClient %d (%s):\n", index+1, fmt.Sprintf(defaultClientConfigFile, index+1))
+			for _, line := range diffLines(before, client.String()) {
+				fmt.Println(line)
+			}
+			touched = append(touched, index)
+		}
+	}
+
+	if len(touched) == 0 {
+		fmt.Println("All selected clients already match the defaults.")
+		return nil
+	}
+
+	if !askConfirmation(fmt.Sprintf("\nApply these changes to %d client(s)?", len(touched))) {
+		fmt.Println("No changes applied.")
+		return nil
+	}
+
+	for _, index := range touched {
+		if config.skipPinned(configPath, index) {
+			continue
+		}
+		clientFileName, err := config.writeClientConfigFile(configPath, index)
+		if err != nil {
+			return err
+		}
+		fmt.Println(config.savedMessage("client configuration", clientFileName))
+	}
+	config.printDnsWarnings(touched...)
+
+	if err = config.saveWithHistory(configPath, "apply-defaults", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, "apply-defaults", changes)
+}
+
+// runSetClientCommand implements the 'set-client' command, which explicitly sets defaults fields
+// for a single client and regenerates its configuration file:
+//
+//     set-client 2 dns=10.9.0.1 mtu=1280
+//     set-client 3 dnsonly=true
+//     set-client 4 junk=true
+//     set-client 5 serverkeepalive=25
+//     set-client 6 role=public
+//     set-client 7 publickey=Xh2Lq...=
+//     set-client 8 lan=192.168.50.0/24
+//     set-client 8 fulltunnel=true
+//
+// Fields set this way are recorded as client overrides and are left alone by 'apply-defaults'
+// unless --override is given. 'serverkeepalive' sets the PersistentKeepalive of the server peer
+// entry of the client instead, so that the server keeps the NAT mapping towards a client behind
+// NAT open, e.g. a site-to-site peer; 0 disables it. 'role' tells whether the client is a mobile
+// client behind NAT, the default, or has a public endpoint, and adjusts the keepalives of both
+// sides accordingly, see applyClientRole. 'publickey' replaces the key of the client with one
+// generated on its device: the stored private key is erased and the client has an external key
+// from then on, see updateClientPublicKey. 'lan' declares the networks behind a site-to-site client,
+// routed to it by the server, 'lan=none' removes them. A site-to-site client gets the tunnel subnet
+// and the LANs of the other sites as AllowedIPs instead of a full tunnel, which would send the whole
+// WAN traffic of its site through the server; 'fulltunnel=true' confirms that this is intended, see
+// adjustSiteAllowedIPs.
+func runSetClientCommand(configPath string, args []string) error {
+	if len(args) < 2 {
+		return newError(errUsage, "usage: set-client <client> key=value...")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	selected, err := config.parseClientSelection(args[0])
+	if err != nil {
+		return err
+	}
+	if len(selected) != 1 {
+		return newError(errUsage, "set-client updates a single client")
+	}
+	index := selected[0]
+	client := &config.Clients[index]
+
+	var changes []fieldChange
+	serverChanged, dropped := false, ""
+	sitesChanged, explicitAllowedIPs := false, false
+	for _, arg := range args[1:] {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			return newError(errUsage, "invalid argument '%s', expected key=value", arg)
+		}
+
+		if strings.ToLower(strings.TrimSpace(key)) == "dnsonly" {
+			if strings.TrimSpace(value) != "true" {
+				return newError(errUsage, "invalid argument '%s', expected dnsonly=true", arg)
+			}
+			oldValue := clientFieldValue(*client, "allowedips")
+			if err = config.makeDnsOnlyClient(index); err != nil {
+				return err
+			}
+			changes = append(changes, fieldChange{Client: index + 1, Field: "allowedips", Before: oldValue,
+				After: clientFieldValue(*client, "allowedips")})
+			continue
+		}
+
+		if strings.ToLower(strings.TrimSpace(key)) == "junk" {
+			oldValue := client.junkString()
+			if client.Jc, client.Jmin, client.Jmax, err = parseJunkSetting(value); err != nil {
+				return err
+			}
+			changes = append(changes, fieldChange{Client: index + 1, Field: "junk", Before: oldValue,
+				After: client.junkString()})
+			continue
+		}
+
+		if strings.ToLower(strings.TrimSpace(key)) == "serverkeepalive" {
+			keepalive, err := parsePersistentKeepalive(value)
+			if err != nil {
+				return err
+			}
+			if index >= len(config.Server.Peers) {
+				return newError(errValidation, "client %d has no server peer, run 'fsck --repair'", index+1)
+			}
+			peer := &config.Server.Peers[index]
+			changes = append(changes, fieldChange{Client: index + 1, Field: "serverkeepalive",
+				Before: strconv.Itoa(int(peer.PersistentKeepalive)), After: strconv.Itoa(int(keepalive))})
+			if err = peer.SetKeepalive(int(keepalive)); err != nil {
+				return err
+			}
+			config.clientInfo(index).addOverride("serverkeepalive")
+			serverChanged = true
+			continue
+		}
+
+		if strings.ToLower(strings.TrimSpace(key)) == "publickey" {
+			if index >= len(config.Server.Peers) {
+				return newError(errValidation, "client %d has no server peer, run 'fsck --repair'", index+1)
+			}
+			oldKey := config.Server.Peers[index].PublicKey
+			privateKey, err := config.updateClientPublicKey(index, strings.TrimSpace(value))
+			if err != nil {
+				return err
+			}
+			if privateKey != "" {
+				dropped = privateKey
+			}
+			changes = append(changes, fieldChange{Client: index + 1, Field: "publickey", Before: keyFingerprint(oldKey),
+				After: keyFingerprint(config.Server.Peers[index].PublicKey)})
+			serverChanged = true
+			continue
+		}
+
+		if strings.ToLower(strings.TrimSpace(key)) == "lan" {
+			if index >= len(config.Server.Peers) {
+				return newError(errValidation, "client %d has no server peer, run 'fsck --repair'", index+1)
+			}
+			var lans []net.IPNet
+			if value = strings.TrimSpace(value); value != "" && value != "none" {
+				if lans, err = parseAllowedIps(value); err != nil {
+					return err
+				}
+			}
+			if routesEverything(lans) {
+				return newError(errValidation, "invalid LAN '%s', the default route can't be behind a client", value)
+			}
+			changes = append(changes, fieldChange{Client: index + 1, Field: "lan",
+				Before: joinIPNets(config.clientSites(index)), After: joinIPNets(lans)})
+			config.Server.Peers[index].AllowedIPs = append(clientIpNetToPeer(client.Address), lans...)
+			serverChanged, sitesChanged = true, true
+			continue
+		}
+
+		if strings.ToLower(strings.TrimSpace(key)) == "fulltunnel" {
+			fullTunnel, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				return newError(errUsage, "invalid argument '%s', expected fulltunnel=true|false", arg)
+			}
+			info := config.clientInfo(index)
+			changes = append(changes, fieldChange{Client: index + 1, Field: "fulltunnel",
+				Before: strconv.FormatBool(info.FullTunnelSite), After: strconv.FormatBool(fullTunnel)})
+			info.FullTunnelSite = fullTunnel
+			sitesChanged = true
+			continue
+		}
+
+		if strings.ToLower(strings.TrimSpace(key)) == "role" {
+			role, err := parseClientRole(value)
+			if err != nil {
+				return err
+			}
+			if index >= len(config.Server.Peers) {
+				return newError(errValidation, "client %d has no server peer, run 'fsck --repair'", index+1)
+			}
+			oldKeepalive, oldServerKeepalive := clientFieldValue(*client, "keepalive"), config.Server.Peers[index].PersistentKeepalive
+			changes = append(changes, fieldChange{Client: index + 1, Field: "role", Before: config.role(index), After: role})
+			config.setClientRole(index, role)
+			changes = append(changes, fieldChange{Client: index + 1, Field: "keepalive", Before: oldKeepalive,
+				After: clientFieldValue(*client, "keepalive")})
+			serverChanged = serverChanged || oldServerKeepalive != config.Server.Peers[index].PersistentKeepalive
+			continue
+		}
+
+		// Parse the value with the defaults validation, then copy just this field
+		var values clientDefaults
+		if err = values.set(key, value); err != nil {
+			return err
+		}
+		field := strings.ToLower(strings.TrimSpace(key))
+		if !isDefaultsField(field) {
+			return newError(errUsage, "'%s' can't be set for a single client", key)
+		}
+
+		oldValue := clientFieldValue(*client, field)
+		values.applyFieldTo(client, field)
+		config.ensureServerAddressAllowed(client)
+		config.clientInfo(index).addOverride(field)
+		changes = append(changes, fieldChange{Client: index + 1, Field: field, Before: oldValue,
+			After: clientFieldValue(*client, field)})
+		explicitAllowedIPs = explicitAllowedIPs || field == "allowedips"
+	}
+	if sitesChanged || explicitAllowedIPs {
+		oldValue := clientFieldValue(*client, "allowedips")
+		if err = config.adjustSiteAllowedIPs(index, explicitAllowedIPs); err != nil {
+			return err
+		}
+		if newValue := clientFieldValue(*client, "allowedips"); newValue != oldValue {
+			changes = append(changes, fieldChange{Client: index + 1, Field: "allowedips", Before: oldValue, After: newValue})
+		}
+	}
+
+	if dropped != "" {
+		zeroizeFile(configPath + fmt.Sprintf(defaultClientConfigFile, index+1))
+	}
+	clientFileName, err := config.writeClientConfigFile(configPath, index)
+	if err != nil {
+		return err
+	}
+	fmt.Println(config.savedMessage("client configuration", clientFileName))
+	if serverChanged {
+		serverFileName, err := config.writeServerConfigFile(configPath)
+		if err != nil {
+			return err
+		}
+		fmt.Println(config.savedMessage("server configuration", serverFileName))
+	}
+	if sitesChanged {
+		// The other sites route to the LANs of this one
+		for j := range config.Clients {
+			oldValue := clientFieldValue(config.Clients[j], "allowedips")
+			if j == index || len(config.clientSites(j)) == 0 || config.adjustSiteAllowedIPs(j, false) != nil ||
+				clientFieldValue(config.Clients[j], "allowedips") == oldValue {
+				continue
+			}
+			changes = append(changes, fieldChange{Client: j + 1, Field: "allowedips", Before: oldValue,
+				After: clientFieldValue(config.Clients[j], "allowedips")})
+			fileName, err := config.writeClientConfigFile(configPath, j)
+			if err != nil {
+				return err
+			}
+			fmt.Println(config.savedMessage("client configuration", fileName))
+		}
+	}
+	config.printDnsWarnings(index)
+
+	if err = config.saveWithHistory(configPath, "set-client", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+	if dropped != "" {
+		scrubbed := config.eraseClientKey(configPath, index, dropped)
+		fmt.Printf("The private key of client %d was erased, %d history snapshots were rewritten without it. "+
+			"The client now has an external key, %s holds a stub to complete on the device.\n",
+			index+1, scrubbed, clientFileName)
+		appendAuditLog(configPath, "erase-private-key", map[string]interface{}{"Client": index + 1,
+			"PrivateKey": keyFingerprint(dropped), "Snapshots": scrubbed})
+	}
+
+	return appendAuditLog(configPath, "set-client", changes)
+}
+
+// runSetServerCommand implements the 'set-server' command, which sets the MTU or the NAT rules
+// of the server Interface and regenerates the server configuration file, or renames the server
+// configuration file:
+//
+//     set-server mtu=1380
+//     set-server mtu=auto
+//     set-server file=wg0.conf
+//     set-server nat=auto
+//     set-server nat=ens3
+//     set-server nat=off
+//     set-server pool=11
+//     set-server pool=off
+//     set-server bind=192.168.1.10
+//     set-server bind=any
+//     set-server dnscheck=off
+//     set-server endpoint-managed-by=ddns
+//
+// 'mtu=auto' matches the MTU of the client defaults, mismatched MTUs between the server and the
+// clients cause fragmentation. The file name is also the name of the tunnel service. 'nat' emits
+// iptables masquerade rules for a Linux server as PostUp and PostDown commands, through the
+// default-route interface with 'auto' or the given one. 'pool' reserves the addresses below the
+// given host number or address for infrastructure, new clients are allocated from there upward.
+// 'bind' records the local address the server is meant to listen on, after checking that the
+// listen port is free there, so that the firewall rule of the setup summary covers that interface.
+// 'dnscheck=off' silences the warnings about client DNS servers outside the tunnel, see dnsWarnings.
+// 'endpoint-managed-by' sets what 'watch-endpoint' does when the external IP address changes, 'auto'
+// derives it from the endpoint again, see endpointPolicy.
+func runSetServerCommand(configPath string, args []string) error {
+	if len(args) != 1 {
+		return newError(errUsage, "usage: set-server mtu=<number>|auto | file=<name>.conf | nat=auto|off|<interface> | "+
+			"pool=<start>|off | bind=<address>|any | dnscheck=on|off | endpoint-managed-by=detection|ddns|manual|auto")
+	}
+
+	key, value, found := strings.Cut(args[0], "=")
+	key = strings.ToLower(strings.TrimSpace(key))
+	if !found || (key != "mtu" && key != "file" && key != "nat" && key != "pool" && key != "bind" && key != "dnscheck" &&
+		key != "endpoint-managed-by") {
+		return newError(errUsage, "invalid argument '%s', expected mtu=<number>|auto, file=<name>.conf, "+
+			"nat=auto|off|<interface>, pool=<start>|off, bind=<address>|any, dnscheck=on|off or "+
+			"endpoint-managed-by=detection|ddns|manual|auto", args[0])
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	if key == "file" {
+		change := fieldChange{Field: "file", Before: config.serverConfigFile(), After: strings.TrimSpace(value)}
+		if err = config.renameServerConfigFile(configPath, strings.TrimSpace(value)); err != nil {
+			return err
+		}
+		if err = config.saveWithHistory(configPath, "set-server", false); err != nil {
+			return fmt.Errorf("failed to store the application configuration: %w", err)
+		}
+		return appendAuditLog(configPath, "set-server", []fieldChange{change})
+	}
+
+	if key == "dnscheck" {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value != "on" && value != "off" {
+			return newError(errUsage, "invalid argument '%s', expected dnscheck=on|off", args[0])
+		}
+		change := fieldChange{Field: "dnscheck", Before: strconv.FormatBool(!config.AllowOutOfTunnelDns),
+			After: strconv.FormatBool(value == "on")}
+		config.AllowOutOfTunnelDns = value == "off"
+		for _, warning := range config.Warnings() {
+			fmt.Println("Warning:", warning)
+		}
+		if err = config.saveWithHistory(configPath, "set-server", false); err != nil {
+			return fmt.Errorf("failed to store the application configuration: %w", err)
+		}
+		return appendAuditLog(configPath, "set-server", []fieldChange{change})
+	}
+
+	if key == "endpoint-managed-by" {
+		policy, err := parseEndpointPolicy(value)
+		if err != nil {
+			return err
+		}
+		before, _ := config.endpointPolicy()
+		config.EndpointManagedBy = policy
+		after, explicit := config.endpointPolicy()
+		if after == endpointByDdns && config.DDNS == nil {
+			fmt.Println("Warning: DDNS is not configured, 'watch-endpoint' fails until it is, see 'ddns set'")
+		}
+		if !explicit {
+			fmt.Printf("The endpoint policy is derived from the endpoint again: %s.\n", after)
+		}
+		if err = config.saveWithHistory(configPath, "set-server", false); err != nil {
+			return fmt.Errorf("failed to store the application configuration: %w", err)
+		}
+		return appendAuditLog(configPath, "set-server", []fieldChange{{Field: "endpoint-managed-by", Before: before, After: after}})
+	}
+
+	if key == "pool" {
+		offset, err := config.parseAllocationOffset(value)
+		if err != nil {
+			return err
+		}
+		change := fieldChange{Field: "pool", Before: strconv.Itoa(config.AllocationOffset), After: strconv.Itoa(offset)}
+		config.AllocationOffset = offset
+		if start := config.allocationStart(); start != nil {
+			fmt.Printf("New clients are allocated from %s upward, existing clients keep their addresses.\n", start)
+		}
+		if err = config.saveWithHistory(configPath, "set-server", false); err != nil {
+			return fmt.Errorf("failed to store the application configuration: %w", err)
+		}
+		return appendAuditLog(configPath, "set-server", []fieldChange{change})
+	}
+
+	var change fieldChange
+	if key == "bind" {
+		address, err := config.checkBindAddress(value)
+		if err != nil {
+			return err
+		}
+		change = fieldChange{Field: "bind", Before: config.BindAddress, After: address}
+		config.BindAddress = address
+		fmt.Println("Update the inbound firewall rule of the listen port to the new address, see", defaultSummaryTextFile)
+	} else if key == "nat" {
+		outbound, err := resolveNatSetting(value)
+		if err != nil {
+			return err
+		}
+		change = fieldChange{Field: "nat", Before: config.NatInterface, After: outbound}
+		config.NatInterface = outbound
+	} else {
+		mtu := config.effectiveDefaults().MTU
+		if strings.TrimSpace(value) != "auto" {
+			if mtu, err = parseMtu(value); err != nil {
+				return err
+			}
+		}
+		change = fieldChange{Field: "mtu", Before: strconv.Itoa(int(config.Server.MTU)), After: strconv.Itoa(int(mtu))}
+		if err = config.Server.SetMTU(int(mtu)); err != nil {
+			return err
+		}
+	}
+
+	serverFileName, err := config.writeServerConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println(config.savedMessage("server configuration", serverFileName))
+
+	if err = config.saveWithHistory(configPath, "set-server", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, "set-server", []fieldChange{change})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// TestSetClientWithoutServerPeer checks that set-client refuses the fields of the server peer of a
+// client whose peer is missing from the state, the case 'fsck --repair' handles, instead of
+// panicking.
+func TestSetClientWithoutServerPeer(t *testing.T) {
+	config, configPath := newTestProfile(t, 3)
+	config.Server.Peers = config.Server.Peers[:2]
+	if err := config.save(configPath); err != nil {
+		t.Fatal(err)
+	}
+	key, err := newWireguardPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{"publickey=" + key.base64PublicKey(), "serverkeepalive=25", "lan=192.168.50.0/24", "role=public"} {
+		err := runSetClientCommand(configPath, []string{"3", field})
+		if exitCode(err) != exitValidation || !strings.Contains(err.Error(), "client 3 has no server peer") {
+			t.Errorf("set-client 3 %s = %v, want a validation error", field, err)
+		}
+	}
+}
+
+// TestDefaultsApplyExisting checks that 'defaults apply --existing' rolls the defaults out like
+// 'apply-defaults --all': after confirmation, keeping the fields set for a single client, and
+// audited.
+func TestDefaultsApplyExisting(t *testing.T) {
+	// Without the relay of the fixture, behind which the public client 2 would need a keepalive
+	config, configPath := newTestProfile(t, 3)
+	config.Relay = nil
+	if err := config.save(configPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSetClientCommand(configPath, []string{"2", "mtu=1280"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runDefaultsCommand(configPath, []string{"set", "mtu=1380"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changes unless confirmed
+	answer(t, false)
+	if err := runDefaultsCommand(configPath, []string{"apply", "--existing"}); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged, _ := loadAppConfig(configPath); unchanged.Clients[0].MTU == 1380 {
+		t.Fatal("the defaults were applied without confirmation")
+	}
+
+	answer(t, true)
+	if err := runDefaultsCommand(configPath, []string{"apply", "--existing"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Clients[0].MTU != 1380 || config.Clients[2].MTU != 1380 || config.Clients[1].MTU != 1280 {
+		t.Errorf("client MTUs %d, %d and %d, want 1380 except the 1280 set for client 2",
+			config.Clients[0].MTU, config.Clients[1].MTU, config.Clients[2].MTU)
+	}
+	audit, err := ioutil.ReadFile(configPath + defaultAuditLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(audit)), "\n")
+	if last := lines[len(lines)-1]; !strings.Contains(last, `"Operation":"apply-defaults"`) || !strings.Contains(last, `"After":"1380"`) {
+		t.Errorf("last audit record %s, want the applied defaults", last)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContextLines is the number of unchanged lines shown around the changes of a unified diff.
+const diffContextLines = 3
+
+// diffLine is a line of a diff: ' ' for lines common to both texts, '-' for lines only present in
+// the first and '+' for lines only present in the second.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// diffScript compares two texts line by line and returns every line of both, marked as common,
+// removed or added. The comparison uses the longest common subsequence of lines, which is more
+// than fast enough for Wireguard configuration files.
+func diffScript(before string, after string) []diffLine {
+	a := strings.Split(strings.TrimRight(before, "\n"), "\n")
+	b := strings.Split(strings.TrimRight(after, "\n"), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var script []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			script = append(script, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			script = append(script, diffLine{'-', a[i]})
+			i++
+		default:
+			script = append(script, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		script = append(script, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		script = append(script, diffLine{'+', b[j]})
+	}
+
+	return script
+}
+
+// diffLines compares two texts line by line and returns the lines that differ, prefixed with
+// "- " for lines only present in before and "+ " for lines only present in after. Lines common
+// to both texts are omitted.
+func diffLines(before string, after string) []string {
+	var diff []string
+	for _, line := range diffScript(before, after) {
+		if line.op != ' ' {
+			diff = append(diff, string(line.op)+" "+line.text)
+		}
+	}
+
+	return diff
+}
+
+// unifiedDiff returns the differences between two texts in the unified diff format, with the
+// changes grouped into hunks surrounded by diffContextLines unchanged lines.
+//
+// Parameters:
+//     beforeName (string): The name of the first text, shown in the --- header.
+//     afterName (string): The name of the second text, shown in the +++ header.
+//     before (string): The first text.
+//     after (string): The second text.
+//
+// Returns:
+//     string: The unified diff, empty if the texts have the same lines.
+//
+// Usage:
+//     fmt.Print(unifiedDiff("generated", "wsclient_2.conf", rendered, onDisk))
+func unifiedDiff(beforeName string, afterName string, before string, after string) string {
+	script := diffScript(before, after)
+
+	var changed []int
+	for k, line := range script {
+		if line.op != ' ' {
+			changed = append(changed, k)
+		}
+	}
+	if len(changed) == 0 {
+		return ""
+	}
+
+	result := fmt.Sprintf("--- %s\n+++ %s\n", beforeName, afterName)
+	for h := 0; h < len(changed); {
+		// Extend the hunk while the next change is close enough to share its context
+		first, last := changed[h], changed[h]
+		for h++; h < len(changed) && changed[h]-last-1 <= 2*diffContextLines; h++ {
+			last = changed[h]
+		}
+		start, end := first-diffContextLines, last+diffContextLines+1
+		if start < 0 {
+			start = 0
+		}
+		if end > len(script) {
+			end = len(script)
+		}
+
+		// Line numbers of the hunk start in both texts, counted over the lines before it
+		beforeLine, afterLine := 1, 1
+		for _, line := range script[:start] {
+			if line.op != '+' {
+				beforeLine++
+			}
+			if line.op != '-' {
+				afterLine++
+			}
+		}
+		beforeCount, afterCount := 0, 0
+		body := ""
+		for _, line := range script[start:end] {
+			if line.op != '+' {
+				beforeCount++
+			}
+			if line.op != '-' {
+				afterCount++
+			}
+			body += string(line.op) + line.text + "\n"
+		}
+		result += fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", beforeLine, beforeCount, afterLine, afterCount) + body
+	}
+
+	return result
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+)
+
+// dnsOnlyAllowedIPs returns the AllowedIPs routing only the given DNS servers through the tunnel,
+// a /32 per server.
+func dnsOnlyAllowedIPs(dns []net.IP) []net.IPNet {
+	allowedIPs := make([]net.IPNet, 0, len(dns))
+	for _, ip := range dns {
+		allowedIPs = append(allowedIPs, net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+	}
+
+	return allowedIPs
+}
+
+// makeDnsOnlyClient turns the client into a DNS-only client, which uses the tunnel purely as an
+// encrypted DNS transport: only its DNS servers are routed through the tunnel while all other
+// traffic stays direct. A client without DNS servers gets the default ones. Both fields are
+// recorded as client overrides, so that 'apply-defaults' leaves them alone.
+//
+// The DNS servers must be reachable from the server, e.g. the server tunnel address running a
+// resolver or public resolvers with the server forwarding the traffic.
+//
+// Parameters:
+//     index (int): The zero-based index of the client.
+//
+// Returns:
+//     error: A validation error if neither the client nor the defaults have DNS servers.
+//
+// Usage:
+//     err := config.makeDnsOnlyClient(len(config.Clients) - 1)
+func (config *appConfig) makeDnsOnlyClient(index int) error {
+	client := &config.Clients[index]
+	if len(client.DNS) == 0 {
+		client.DNS = append(dnsList(nil), config.defaultsForClient(index).DNS...)
+	}
+	if len(client.DNS.servers()) == 0 {
+		return newError(errValidation, "client %d has no DNS servers to route through the tunnel", index+1)
+	}
+
+	for i := range client.Peers {
+		client.Peers[i].AllowedIPs = dnsOnlyAllowedIPs(client.DNS.servers())
+	}
+	config.clientInfo(index).addOverride("dns")
+	config.clientInfo(index).addOverride("allowedips")
+
+	return nil
+}
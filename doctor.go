@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+)
+
+// runDoctorCommand implements the 'doctor' command, which checks whether the stored
+// configuration is deployable, whether the MTUs of the server and the clients fit together,
+// whether other running Wireguard implementations or tunnels on overlapping subnets clash with the
+// tunnel, whether the installed WireSock supports the extensions the configuration uses, whether
+// the server configuration file, the client endpoints, the firewall rule and the running tunnel
+// agree on the listen port, see checkListenPorts, and, with DDNS configured, whether the hostname
+// resolves to the external IP address:
+//
+//     doctor
+//     doctor --probe-mtu
+//     doctor --probe-mtu --probe-host 1.1.1.1
+//     doctor --loopback
+//
+// With --probe-mtu the path MTU towards the server endpoint, or the given host, is probed and the
+// client MTUs are compared with the MTU it allows. The probe is opt-in because it sends a few dozen
+// pings and takes up to half a minute. With --loopback the running server tunnel is tested end to
+// end from the server machine with a temporary peer, see loopbackTest; this changes the running
+// tunnel for a few seconds and needs administrator rights.
+func runDoctorCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	probeMtu := flags.Bool("probe-mtu", false, "Probe the path MTU and check the client MTUs against it (best effort)")
+	probeHost := flags.String("probe-host", "", "Host to probe the path MTU towards, the server endpoint by default")
+	loopback := flags.Bool("loopback", false, "Handshake with the running server and ping it through a temporary peer")
+	if err := parseFlags(flags, "doctor", args); err != nil {
+		return err
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	problems := config.Validate()
+	for _, problem := range problems {
+		fmt.Println("Error:", problem.Error())
+	}
+
+	suggestion := 0
+	if *probeMtu {
+		host := *probeHost
+		if host == "" && len(config.Clients) > 0 && len(config.Clients[0].Peers) > 0 {
+			host, _, _ = net.SplitHostPort(config.Clients[0].Peers[0].Endpoint)
+		}
+		if host == "" {
+			return newError(errUsage, "no endpoint to probe, see --probe-host")
+		}
+
+		pathMtu, ipv6, err := probePathMtu(newExecutor(), host)
+		if err != nil {
+			fmt.Println("Path MTU probe:", err)
+		}
+		if pathMtu > 0 {
+			suggestion = suggestedMtu(pathMtu, ipv6)
+			fmt.Printf("Path MTU towards %s: %d, suggested tunnel MTU: %d (best effort).\n", host, pathMtu, suggestion)
+		}
+	}
+
+	warnings := append(config.mtuWarnings(suggestion), config.wireguardConflicts(newExecutor())...)
+	warnings = append(warnings, config.subnetConflicts(newExecutor())...)
+	warnings = append(warnings, config.Warnings()...)
+	warnings = append(warnings, config.ddnsEndpointWarnings()...)
+	ports := config.checkListenPorts(configPath, newExecutor())
+	if finding := ports.String(); finding != "" {
+		warnings = append(warnings, finding)
+	}
+	for _, source := range ports.Unverified {
+		fmt.Println("Note: couldn't verify the listen port in", source)
+	}
+	installed := detectWireSockVersion(newExecutor())
+	wireSockProblems, wireSockNotes := config.wireSockFeatureReport(installed)
+	for _, problem := range wireSockProblems {
+		fmt.Println("Error:", problem)
+	}
+	if installed != "" {
+		fmt.Printf("WireSock %s is installed.\n", installed)
+		warnings = append(warnings, wireSockNotes...)
+	} else {
+		for _, note := range wireSockNotes {
+			fmt.Println("Note:", note)
+		}
+	}
+	if config.EndpointSource != "" {
+		fmt.Printf("Endpoint address %s.\n", config.EndpointSource)
+	}
+	if config.DDNS != nil {
+		externalIP, source, err := detectExternalIPWithSource()
+		if err != nil {
+			externalIP = nil
+		} else {
+			fmt.Printf("External IP address %s, from %s.\n", externalIP.String(), source)
+		}
+		if status, ok := config.ddnsStatus(externalIP); ok {
+			fmt.Println(status)
+		} else {
+			warnings = append(warnings, status)
+		}
+	}
+	for _, warning := range warnings {
+		fmt.Println("Warning:", warning)
+	}
+	var loopbackFailed bool
+	if *loopback && len(problems) == 0 {
+		result := config.loopbackTest(defaultHandshakeTimeout)
+		fmt.Println(result)
+		loopbackFailed = !result.Passed
+	}
+
+	if len(problems) > 0 {
+		return newError(errValidation, "configuration is not deployable, %d problems found", len(problems))
+	}
+	if len(wireSockProblems) > 0 {
+		return newError(errDependency, "the installed WireSock %s doesn't support the server configuration", installed)
+	}
+	if loopbackFailed {
+		return newError(errDependency, "the loopback test of the running server failed")
+	}
+	if len(warnings) == 0 {
+		fmt.Println("No problems found.")
+	}
+
+	return nil
+}
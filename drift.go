@@ -0,0 +1,263 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Drift states of a generated file, see fileDrift.
+const (
+	driftModified = "modified"
+	driftMissing  = "missing"
+	// driftPinnedStale is the file of a pinned client left unchanged while the configuration moved on.
+	driftPinnedStale = "pinned and stale"
+)
+
+// fileDrift tells whether a file in the profile directory still holds what this tool last wrote
+// into it, comparing its hash with the one recorded in FileHashes.
+//
+// Parameters:
+//     configPath (string): The profile directory.
+//     name (string): The file name, e.g. wsclient_2.conf.
+//
+// Returns:
+//     string: driftModified or driftMissing, empty if the file is unchanged or was never recorded.
+//
+// Usage:
+//     if config.fileDrift(configPath, "wsclient_2.conf") == driftModified { ... }
+func (config *appConfig) fileDrift(configPath string, name string) string {
+	recorded, found := config.FileHashes[name]
+	if !found {
+		return ""
+	}
+
+	content, err := ioutil.ReadFile(configPath + name)
+	if os.IsNotExist(err) {
+		return driftMissing
+	}
+	if err != nil || contentHash(content) != recorded {
+		return driftModified
+	}
+
+	return ""
+}
+
+// clientDrift tells whether the config file of the client with the given zero-based index was
+// changed on disk since it was generated, see fileDrift. The unchanged file of a pinned client
+// that no longer matches the configuration is driftPinnedStale, which is intended, unlike a
+// modified file.
+func (config *appConfig) clientDrift(configPath string, index int) string {
+	drift := config.fileDrift(configPath, fmt.Sprintf(defaultClientConfigFile, index+1))
+	if drift == "" && config.pinnedStale(configPath, index) {
+		return driftPinnedStale
+	}
+
+	return drift
+}
+
+// clientRendering returns the content this tool writes into the config file of the client with
+// the given zero-based index, including the provenance header.
+func (config *appConfig) clientRendering(index int) (string, error) {
+	content, err := config.renderConfig(config.clientFileConfig(index))
+	if err != nil {
+		return "", err
+	}
+
+	return provenanceHeader + content, nil
+}
+
+// acceptClientDrift folds the changes made by hand to the config file of a client back into the
+// state: DNS, MTU, keepalive and AllowedIPs, recorded as overrides like 'set-client' does, as well
+// as the endpoint, junk packets, PostUp and PostDown commands, and the unknown keys kept by
+// lenient parsing. Changes to the keys or the address are refused, since the server peer would
+// have to change with them. Comments aren't taken over, they're generated from the metadata.
+//
+// Parameters:
+//     index (int): The zero-based index of the client.
+//     parsed (WireguardConfig): The configuration parsed from the file.
+//
+// Returns:
+//     []fieldChange: The changed fields.
+//     error: A validation error if the file changes what can't be accepted.
+//
+// Usage:
+//     changes, err := config.acceptClientDrift(1, parsed)
+func (config *appConfig) acceptClientDrift(index int, parsed WireguardConfig) ([]fieldChange, error) {
+	client := &config.Clients[index]
+	switch {
+	case client.PrivateKey != "" && parsed.PrivateKey != client.PrivateKey:
+		return nil, newError(errValidation, "client %d: the private key was changed, which the server peer "+
+			"would have to follow; restore it in the file or add a new client", index+1)
+	case joinIPNets(parsed.Address) != joinIPNets(client.Address):
+		return nil, newError(errValidation, "client %d: the address was changed from %s to %s, which the server "+
+			"peer would have to follow; restore it in the file", index+1, joinIPNets(client.Address), joinIPNets(parsed.Address))
+	case len(parsed.Peers) != 1 || len(client.Peers) == 0 || parsed.Peers[0].PublicKey != client.Peers[0].PublicKey:
+		return nil, newError(errValidation, "client %d: the file must keep a single [Peer] section with the server "+
+			"public key", index+1)
+	}
+
+	info := config.clientInfo(index)
+	var changes []fieldChange
+	record := func(field string, before string, after string) {
+		if before != after {
+			changes = append(changes, fieldChange{Client: index + 1, Field: field, Before: before, After: after})
+		}
+	}
+
+	before := *client
+	peer, parsedPeer := &client.Peers[0], parsed.Peers[0]
+	client.DNS, client.MTU = parsed.DNS, parsed.MTU
+	peer.PersistentKeepalive, peer.AllowedIPs = parsedPeer.PersistentKeepalive, parsedPeer.AllowedIPs
+	for _, field := range []string{"dns", "mtu", "keepalive", "allowedips"} {
+		if clientFieldValue(before, field) != clientFieldValue(*client, field) {
+			record(field, clientFieldValue(before, field), clientFieldValue(*client, field))
+			info.addOverride(field)
+		}
+	}
+
+	record("endpoint", peer.Endpoint, parsedPeer.Endpoint)
+	peer.Endpoint = parsedPeer.Endpoint
+	record("junk", before.junkString(), parsed.junkString())
+	client.Jc, client.Jmin, client.Jmax = parsed.Jc, parsed.Jmin, parsed.Jmax
+	record("postup", strings.Join(client.PostUp, "; "), strings.Join(parsed.PostUp, "; "))
+	record("postdown", strings.Join(client.PostDown, "; "), strings.Join(parsed.PostDown, "; "))
+	client.PostUp, client.PostDown = parsed.PostUp, parsed.PostDown
+	record("extras", strings.Join(append(append([]string(nil), client.Unknown...), peer.Unknown...), "; "),
+		strings.Join(append(append([]string(nil), parsed.Unknown...), parsedPeer.Unknown...), "; "))
+	client.Unknown, peer.Unknown = parsed.Unknown, parsedPeer.Unknown
+
+	return changes, nil
+}
+
+// runShowCommand implements the 'show' command, which prints the configuration of a client as
+// this tool generates it, or with --diff the changes made to its file on disk since:
+//
+//     show 2
+//     show --diff 2
+//
+// The configuration includes the private key of the client, except for a client with an external
+// key, whose configuration is a stub to complete on the device.
+func runShowCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: show [--diff] <client>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	var client string
+	if !strings.HasPrefix(args[0], "-") {
+		client, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("show", flag.ContinueOnError)
+	diff := flags.Bool("diff", false, "Print the changes of the file on disk against the generated configuration")
+	if err := parseFlags(flags, "show", args); err != nil {
+		return err
+	}
+	if client == "" && flags.NArg() == 1 {
+		client = flags.Arg(0)
+	} else if client == "" || flags.NArg() != 0 {
+		return usage
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	index, err := config.findClient(client)
+	if err != nil {
+		return err
+	}
+
+	rendering, err := config.renderConfig(config.clientFileConfig(index))
+	if err != nil {
+		return err
+	}
+	if !*diff {
+		if config.Clients[index].PrivateKey == "" {
+			// On stderr, so that the stub can still be redirected into a file
+			fmt.Fprintf(os.Stderr, "Note: client %d has an external key, %s. This is the peer stub to complete on the device.\n",
+				index+1, config.externalKeyReason(index))
+		}
+		fmt.Print(rendering)
+		return nil
+	}
+
+	fileName := fmt.Sprintf(defaultClientConfigFile, index+1)
+	content, err := config.readClientFile(configPath, index)
+	if err != nil {
+		return newError(errValidation, "can't read the config file of client %d: %w", index+1, err)
+	}
+	patch := unifiedDiff("generated/"+fileName, configPath+fileName, provenanceHeader+rendering, string(content))
+	if patch == "" {
+		fmt.Printf("%s matches the generated configuration.\n", fileName)
+		return nil
+	}
+
+	fmt.Print(patch)
+	return nil
+}
+
+// runAcceptDriftCommand implements the 'accept-drift' command, which takes the changes made by
+// hand to the config file of a client over into the state, so that the next regeneration keeps
+// them, see acceptClientDrift:
+//
+//     accept-drift 2
+//
+// The file is parsed leniently: unknown keys are kept, malformed optional values are skipped with
+// a warning. The file is then rewritten from the updated state.
+func runAcceptDriftCommand(configPath string, args []string) error {
+	if len(args) != 1 {
+		return newError(errUsage, "usage: accept-drift <client>")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	index, err := config.findClient(args[0])
+	if err != nil {
+		return err
+	}
+	if config.clientDrift(configPath, index) != driftModified {
+		fmt.Printf("The config file of client %d has no changes to accept.\n", index+1)
+		return nil
+	}
+
+	content, err := config.readClientFile(configPath, index)
+	if err != nil {
+		return err
+	}
+	parsed, warnings, err := parseWireguardConfigText(string(content), fmt.Sprintf(defaultClientConfigFile, index+1), parseLenient)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Println("Warning:", warning)
+	}
+
+	changes, err := config.acceptClientDrift(index, parsed)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		fmt.Printf("Client %d %s: '%s' -> '%s'\n", change.Client, change.Field, change.Before, change.After)
+	}
+	if problems := config.Validate(); len(problems) > 0 {
+		return validationFailure(problems)
+	}
+	config.printDnsWarnings(index)
+
+	clientFileName, err := config.writeClientConfigFile(configPath, index)
+	if err != nil {
+		return err
+	}
+	fmt.Println(config.savedMessage("client configuration", clientFileName))
+
+	if err = config.saveWithHistory(configPath, "accept-drift", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, "accept-drift", changes)
+}
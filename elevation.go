@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// elevatedScriptFile is the PowerShell script of the profile completing the queued privileged
+// steps from an elevated prompt, see writeElevatedScript.
+const elevatedScriptFile = "elevated-followup.ps1"
+
+// Privileged steps that can be queued until an elevated process runs them, see runPrivilegedStep.
+const (
+	stepStartTunnel = "start-tunnel"
+	stepStopTunnel  = "stop-tunnel"
+	stepCleanup     = "cleanup"
+)
+
+// changeNeedsElevation tells which kinds of system changes need an elevated process to be made or
+// reverted. Kinds missing here are made and reverted right away.
+var changeNeedsElevation = map[string]bool{
+	changeTunnelService:   true,
+	changeNetworkCategory: true,
+}
+
+// PendingStep is a privileged step deferred because the process wasn't elevated, recorded in
+// config.json until 'finish --elevated' runs it.
+type PendingStep struct {
+	Step     string    // One of the privileged steps, e.g. stepStartTunnel
+	Target   string    // Name of the affected object, e.g. the tunnel name
+	QueuedAt time.Time // When the step was deferred
+}
+
+// String describes the step for the 'finish' output and the follow-up script.
+func (step PendingStep) String() string {
+	description := map[string]string{
+		stepStartTunnel: "install and start the tunnel service " + step.Target,
+		stepStopTunnel:  "stop and uninstall the tunnel service " + step.Target,
+		stepCleanup:     "revert the system changes of the tunnel " + step.Target,
+	}[step.Step]
+
+	return fmt.Sprintf("%s (queued %s)", description, step.QueuedAt.Local().Format("2006-01-02 15:04:05"))
+}
+
+// runPrivilegedStep runs a step that needs an elevated process, checking the elevation right
+// before running it rather than once at startup. Without elevation the step is queued in the
+// configuration and the follow-up script is written, so that the unprivileged part of the work
+// completes and only the privileged tail is deferred to 'finish --elevated'. The caller saves the
+// configuration either way.
+//
+// Parameters:
+//     configPath (string): The profile directory.
+//     step (string): The step, e.g. stepStartTunnel.
+//
+// Returns:
+//     error: The error of the step if it ran and failed, nil if it succeeded or was queued.
+//
+// Usage:
+//     err := config.runPrivilegedStep(configPath, stepStartTunnel)
+func (config *appConfig) runPrivilegedStep(configPath string, step string) error {
+	if !isElevated() {
+		return config.queuePrivilegedStep(configPath, step)
+	}
+
+	return config.executeStep(configPath, step)
+}
+
+// executeStep runs a privileged step in the current process, which must be elevated.
+func (config *appConfig) executeStep(configPath string, step string) error {
+	switch step {
+	case stepStopTunnel:
+		if err := stopWireguardTunnel(newExecutor(), config.tunnelName()); err != nil {
+			return err
+		}
+		// Uninstalling the tunnel service removes its network profile as well
+		config.ServiceInstalled = false
+		config.forgetSystemChanges(changeTunnelService, changeNetworkCategory)
+	case stepStartTunnel:
+		// Another instance may have installed a tunnel service under the same name since
+		if err := checkArtifactCollisions(configPath, *config); err != nil {
+			return err
+		}
+		// An installed tunnel service holds the port itself
+		if !config.ServiceInstalled {
+			if err := checkListenPortAvailable(newExecutor(), config.BindAddress, int(config.Server.ListenPort),
+				config.tunnelName(), portRetry); err != nil {
+				return err
+			}
+		}
+		changes, err := startWireguardTunnel(newExecutor(), configPath, config.serverConfigFile())
+		config.SystemChanges = append(config.SystemChanges, changes...)
+		if err != nil {
+			return err
+		}
+		config.ServiceInstalled = true
+	case stepCleanup:
+		config.revertSystemChanges(newExecutor(), false)
+		if len(config.SystemChanges) > 0 {
+			return fmt.Errorf("%d system changes couldn't be reverted", len(config.SystemChanges))
+		}
+	default:
+		return fmt.Errorf("unknown privileged step '%s'", step)
+	}
+
+	return nil
+}
+
+// queuePrivilegedStep records a step for 'finish --elevated' and rewrites the follow-up script.
+// A step already queued isn't queued twice.
+func (config *appConfig) queuePrivilegedStep(configPath string, step string) error {
+	pending := PendingStep{Step: step, Target: config.tunnelName(), QueuedAt: time.Now().UTC()}
+	queued := false
+	for _, other := range config.PendingSteps {
+		if other.Step == step {
+			pending, queued = other, true
+		}
+	}
+	if !queued {
+		config.PendingSteps = append(config.PendingSteps, pending)
+	}
+
+	fmt.Printf("Deferred until elevated: %s. Run 'wg-quick-config finish --elevated' or %s from an elevated "+
+		"prompt to complete it.\n", pending.String(), configPath+elevatedScriptFile)
+	return config.writeElevatedScript(configPath)
+}
+
+// writeElevatedScript writes the follow-up script listing the queued privileged steps and running
+// them with 'finish --elevated', or removes it once nothing is queued.
+func (config *appConfig) writeElevatedScript(configPath string) error {
+	if len(config.PendingSteps) == 0 {
+		if err := os.Remove(configPath + elevatedScriptFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		executable = "wg-quick-config.exe"
+	}
+
+	script := "#Requires -RunAsAdministrator\n"
+	script += "# Generated by wg-quick-config, completes the steps that need an elevated prompt:\n"
+	for i, step := range config.PendingSteps {
+		script += fmt.Sprintf("#   %d. %s\n", i+1, step.String())
+	}
+	script += fmt.Sprintf("& %s -config-path %s finish --elevated\n",
+		quotePowerShell(executable), quotePowerShell(strings.TrimRight(configPath, `\/`)))
+
+	return writeFileAtomic(configPath+elevatedScriptFile, []byte(script), 0600)
+}
+
+// quotePowerShell quotes a string as a PowerShell literal. PowerShell takes the typographic single
+// quotes for quotes as well, they are doubled like the plain one.
+func quotePowerShell(value string) string {
+	for _, quote := range []string{"'", "\u2018", "\u2019", "\u201a", "\u201b"} {
+		value = strings.ReplaceAll(value, quote, quote+quote)
+	}
+	return "'" + value + "'"
+}
+
+// relaunchElevated runs 'finish --elevated' for the profile in a new process started through UAC
+// and waits for it to exit.
+func relaunchElevated(ps Executor, configPath string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	arguments := fmt.Sprintf(`-config-path "%s" finish --elevated`, strings.TrimRight(configPath, `\/`))
+	result := ps.Execute(context.Background(), fmt.Sprintf("Start-Process -FilePath %s -ArgumentList %s -Verb RunAs -Wait",
+		quotePowerShell(executable), quotePowerShell(arguments)))
+	if result.Err != nil {
+		return newError(errPrivilege, "the elevated process couldn't be started, was the UAC prompt declined? %s",
+			strings.TrimSpace(result.StdErr))
+	}
+
+	return nil
+}
+
+// runFinishCommand implements the 'finish' command, which completes the privileged steps deferred
+// while the process wasn't elevated, e.g. installing the tunnel service with -start:
+//
+//     finish               lists the queued steps
+//     finish --elevated    runs them, relaunching through UAC if needed
+//     finish --discard     drops them
+//
+// The steps run in the order they were queued. Completed steps are removed from the queue, failed
+// ones stay for the next attempt.
+func runFinishCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("finish", flag.ContinueOnError)
+	elevated := flags.Bool("elevated", false, "Run the queued steps, relaunching through UAC if needed")
+	discard := flags.Bool("discard", false, "Drop the queued steps without running them")
+	if err := parseFlags(flags, "finish", args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || (*elevated && *discard) {
+		return newError(errUsage, "usage: finish [--elevated | --discard]")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	if len(config.PendingSteps) == 0 {
+		fmt.Println("There are no queued privileged steps.")
+		return config.writeElevatedScript(configPath)
+	}
+
+	switch {
+	case *discard:
+		for _, step := range config.PendingSteps {
+			fmt.Println("Dropped:", step.String())
+		}
+		config.PendingSteps = nil
+	case *elevated && !isElevated():
+		if err = relaunchElevated(newExecutor(), configPath); err != nil {
+			return err
+		}
+		if config, err = loadAppConfig(configPath); err != nil {
+			return fmt.Errorf("failed to load existing configuration: %w", err)
+		}
+		for _, step := range config.PendingSteps {
+			fmt.Println("Still queued:", step.String())
+		}
+		if len(config.PendingSteps) > 0 {
+			return fmt.Errorf("%d privileged steps failed in the elevated process, run 'finish --elevated' again to retry",
+				len(config.PendingSteps))
+		}
+		fmt.Println("The elevated process completed the queued steps.")
+		return nil
+	case *elevated:
+		var failed []PendingStep
+		for _, step := range config.PendingSteps {
+			if err := config.executeStep(configPath, step.Step); err != nil {
+				fmt.Printf("Failed: %s: %s\n", step.String(), err)
+				failed = append(failed, step)
+				continue
+			}
+			fmt.Println("Completed:", step.String())
+		}
+		config.PendingSteps = failed
+	default:
+		text := "Queued privileged steps, run them with 'finish --elevated':\n"
+		for i, step := range config.PendingSteps {
+			text += fmt.Sprintf("  %d. %s\n", i+1, step.String())
+		}
+		printResult(text, config.PendingSteps)
+		return nil
+	}
+
+	if err = config.writeElevatedScript(configPath); err != nil {
+		return err
+	}
+	if err = config.saveWithHistory(configPath, "finish", true); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+	appendAuditLog(configPath, "finish", map[string]interface{}{"Discard": *discard, "Remaining": len(config.PendingSteps)})
+
+	if len(config.PendingSteps) > 0 {
+		return fmt.Errorf("%d privileged steps failed, run 'finish --elevated' again to retry", len(config.PendingSteps))
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+)
+
+// Scopes of an endpoint address, see classifyEndpointAddress.
+const (
+	endpointPublic      = "public"
+	endpointPrivate     = "private"
+	endpointSharedNat   = "shared"
+	endpointLoopback    = "loopback"
+	endpointLinkLocal   = "link-local"
+	endpointReserved    = "reserved"
+	endpointUnspecified = "unspecified"
+)
+
+// sharedAddressSpace is the RFC 6598 range used by carrier-grade NAT.
+var sharedAddressSpace = net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// reservedAddressSpaces are the special-purpose ranges of the IANA registries that aren't routed
+// on the Internet: documentation (RFC 5737, RFC 3849), benchmarking (RFC 2544), IETF protocol
+// assignments (RFC 6890) and the former class E (RFC 1112), including the broadcast address.
+var reservedAddressSpaces = []net.IPNet{
+	{IP: net.IPv4(192, 0, 0, 0), Mask: net.CIDRMask(24, 32)},
+	{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(24, 32)},
+	{IP: net.IPv4(198, 51, 100, 0), Mask: net.CIDRMask(24, 32)},
+	{IP: net.IPv4(203, 0, 113, 0), Mask: net.CIDRMask(24, 32)},
+	{IP: net.IPv4(198, 18, 0, 0), Mask: net.CIDRMask(15, 32)},
+	{IP: net.IPv4(240, 0, 0, 0), Mask: net.CIDRMask(4, 32)},
+	{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 128)},
+}
+
+// classifyEndpointAddress tells whether remote clients can reach an endpoint address: only
+// endpointPublic addresses are reachable from the Internet. RFC 1918 and ULA addresses are
+// endpointPrivate, RFC 6598 addresses endpointSharedNat, and the documentation, benchmarking and
+// other special-purpose ranges of reservedAddressSpaces endpointReserved.
+//
+// Parameters:
+//     ip (net.IP): The endpoint address.
+//
+// Returns:
+//     string: One of the endpoint scopes.
+//
+// Usage:
+//     scope := classifyEndpointAddress(net.ParseIP("192.168.1.10")) // endpointPrivate
+func classifyEndpointAddress(ip net.IP) string {
+	switch {
+	case ip == nil || ip.IsUnspecified():
+		return endpointUnspecified
+	case ip.IsLoopback():
+		return endpointLoopback
+	case ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast():
+		return endpointLinkLocal
+	case ip.IsPrivate():
+		return endpointPrivate
+	case sharedAddressSpace.Contains(ip):
+		return endpointSharedNat
+	}
+	for _, reserved := range reservedAddressSpaces {
+		if reserved.Contains(ip) {
+			return endpointReserved
+		}
+	}
+
+	return endpointPublic
+}
+
+// endpointScopeWarnings explains why remote clients won't reach an endpoint of the given scope.
+var endpointScopeWarnings = map[string]string{
+	endpointPrivate: "%s is a private (LAN) address, only clients inside the same network can reach it. " +
+		"Remote clients need your public IP address or a DNS name.",
+	endpointSharedNat: "%s is a carrier-grade NAT address of your provider, remote clients can't reach it. " +
+		"Ask your provider for a public IP address or use a relay.",
+	endpointLoopback:    "%s is a loopback address, only this machine can reach it.",
+	endpointLinkLocal:   "%s is a link-local address, only devices on the same link can reach it.",
+	endpointReserved: "%s is a reserved address for documentation, benchmarking or future use, it isn't " +
+		"routed on the Internet.",
+	endpointUnspecified: "%s is not a valid endpoint address.",
+}
+
+// confirmEndpointReachable resolves the endpoint host and warns when remote clients won't reach
+// it, asking the user to confirm such an endpoint. Public addresses pass silently.
+//
+// Parameters:
+//     host (string): The host part of the endpoint, an IP address or a host name.
+//
+// Returns:
+//     bool: True if the endpoint is public or the user confirmed it.
+//
+// Usage:
+//     if confirmEndpointReachable("192.168.1.10") { ... }
+func confirmEndpointReachable(host string) bool {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		resolved, err := net.LookupIP(host)
+		if err != nil || len(resolved) == 0 {
+			fmt.Printf("Warning: the host name %s can't be resolved.\n", host)
+			return askConfirmation("Use this endpoint anyway?")
+		}
+		ips = resolved
+	}
+
+	warned := false
+	for _, ip := range ips {
+		scope := classifyEndpointAddress(ip)
+		if scope == endpointPublic {
+			continue
+		}
+
+		name := ip.String()
+		if name != host {
+			name = fmt.Sprintf("%s (%s)", host, ip.String())
+		}
+		fmt.Printf("Warning: "+endpointScopeWarnings[scope]+"\n", name)
+		warned = true
+	}
+
+	return !warned || askConfirmation("Use this endpoint anyway?")
+}
+
+// localAddresses lists the addresses of the network interfaces of this host, net.InterfaceAddrs
+// unless replaced, e.g. by an integration harness that must not depend on the interfaces of the
+// machine it runs on.
+var localAddresses = net.InterfaceAddrs
+
+// externalAddressCandidates returns the addresses the server may be reachable at: the address
+// detected by the external IP consensus first, followed by the public addresses of the local
+// network interfaces. On multi-homed servers each uplink contributes its own address.
+//
+// Parameters:
+//     detected (net.IP): The address detected by the consensus, or nil if detection failed.
+//
+// Returns:
+//     []net.IP: The distinct candidate addresses, possibly empty.
+//
+// Usage:
+//     candidates := externalAddressCandidates(externalIP)
+func externalAddressCandidates(detected net.IP) []net.IP {
+	var candidates []net.IP
+	add := func(ip net.IP) {
+		for _, candidate := range candidates {
+			if candidate.Equal(ip) {
+				return
+			}
+		}
+		candidates = append(candidates, ip)
+	}
+
+	if detected != nil {
+		add(detected)
+	}
+
+	addresses, err := localAddresses()
+	if err != nil {
+		return candidates
+	}
+	for _, address := range addresses {
+		if ipNet, ok := address.(*net.IPNet); ok && classifyEndpointAddress(ipNet.IP) == endpointPublic {
+			add(ipNet.IP)
+		}
+	}
+
+	return candidates
+}
+
+// selectExternalAddress lets the user pick the endpoint address when several candidates were
+// found, presenting them as a numbered list. Pressing Enter, -yes and quiet mode select the first.
+func selectExternalAddress(candidates []net.IP, detected net.IP) net.IP {
+	if len(candidates) == 0 {
+		return detected
+	}
+	if len(candidates) == 1 || quietMode || assumeYes {
+		return candidates[0]
+	}
+
+	fmt.Println("\nThis server has several public IP addresses:")
+	for i, candidate := range candidates {
+		source := "local interface"
+		if candidate.Equal(detected) {
+			source = "detected external IP"
+		}
+		fmt.Printf("\t%d. %s (%s)\n", i+1, candidate.String(), source)
+	}
+
+	for {
+		input := readInput("Select the address clients connect to [1]:")
+		if input == "" {
+			return candidates[0]
+		}
+		if choice, err := strconv.Atoi(input); err == nil && choice >= 1 && choice <= len(candidates) {
+			return candidates[choice-1]
+		}
+		fmt.Printf("Please enter a number between 1 and %d.\n", len(candidates))
+	}
+}
+
+// alternateEndpointPrefix starts the comment lines listing the secondary endpoints above the
+// [Peer] section of the client configurations, see clientFileConfig.
+const alternateEndpointPrefix = "Alternate endpoint: "
+
+// endpointSchemes are the URL schemes endpoints are pasted with, which cleanEndpointInput strips.
+var endpointSchemes = []string{"udp://", "wireguard://", "wg://", "https://", "http://"}
+
+// cleanEndpointInput removes what pasting adds to an endpoint: surrounding whitespace, including
+// no-break spaces, the zero-width characters chat applications insert, a URL scheme such as
+// udp:// with a trailing slash, and the spaces around the port separator, e.g. "vpn.example.com
+// :51820". A space or invisible character left within the endpoint is rejected with its position.
+//
+// Parameters:
+//     value (string): The endpoint as entered or pasted.
+//
+// Returns:
+//     string: The endpoint, e.g. vpn.example.com:51820.
+//     error: A validation error naming the first rejected character.
+//
+// Usage:
+//     endpoint, err := cleanEndpointInput("udp://vpn.example.com:51820\u200b")
+func cleanEndpointInput(value string) (string, error) {
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\u200b' || r == '\u200c' || r == '\u200d' || r == '\u2060' || r == '\ufeff':
+			return -1
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return r
+	}, value)
+	value = strings.TrimSpace(value)
+	for _, scheme := range endpointSchemes {
+		if len(value) >= len(scheme) && strings.EqualFold(value[:len(scheme)], scheme) {
+			value = strings.TrimSpace(strings.TrimSuffix(value[len(scheme):], "/"))
+			break
+		}
+	}
+	if separator := strings.LastIndex(value, ":"); separator >= 0 {
+		value = strings.TrimSpace(value[:separator]) + ":" + strings.TrimSpace(value[separator+1:])
+	}
+
+	for position, r := range []rune(value) {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return "", newError(errValidation, "invalid endpoint '%s': character %U at position %d isn't allowed",
+				value, r, position+1)
+		}
+	}
+
+	return value, nil
+}
+
+// parseEndpoint checks an endpoint given as host:port, an IPv6 address in brackets, and appends
+// the listen port of the server to a bare host name or address. The input is cleaned first, see
+// cleanEndpointInput, and the host name is normalized, see normalizeHostname.
+//
+// Parameters:
+//     value (string): The endpoint, e.g. vpn.example.com:51820, [2001:db8::1]:51820 or 2001:db8::1.
+//     listenPort (uint16): The port appended to a bare host.
+//
+// Returns:
+//     string: The endpoint as host:port.
+//     error: A validation error if the endpoint or its port is invalid.
+//
+// Usage:
+//     endpoint, err := parseEndpoint("2001:db8::1", config.Server.ListenPort) // [2001:db8::1]:51820
+func parseEndpoint(value string, listenPort uint16) (string, error) {
+	value, err := cleanEndpointInput(value)
+	if err != nil {
+		return "", err
+	}
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		host, port = strings.Trim(value, "[]"), strconv.Itoa(int(listenPort))
+	}
+	number, err := strconv.Atoi(port)
+	if err != nil {
+		return "", newError(errValidation, "invalid port in endpoint '%s'", value)
+	}
+	var iface Interface
+	if err = iface.SetListenPort(number); err != nil {
+		return "", newError(errValidation, "endpoint '%s': %w", value, err)
+	}
+	if host == "" || strings.ContainsAny(host, " ,[]") {
+		return "", newError(errValidation, "invalid endpoint '%s', expected host:port", value)
+	}
+	host, err = normalizeHostname(host)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// normalizeHostname returns the form of a host name stored in the configurations, so that the
+// same server is always spelled the same way: lowercase, without a trailing dot, and
+// internationalized names in punycode, e.g. xn--bcher-kva.example for bücher.example. IP
+// addresses are returned unchanged.
+//
+// Parameters:
+//     host (string): The host name or IP address, e.g. VPN.Example.COM.
+//
+// Returns:
+//     string: The normalized host name, e.g. vpn.example.com.
+//     error: A validation error if the name isn't a valid internationalized domain name.
+//
+// Usage:
+//     host, err := normalizeHostname("bücher.example.")
+func normalizeHostname(host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(strings.ToLower(host), "."))
+	if err != nil || ascii == "" {
+		return "", newError(errValidation, "invalid host name '%s'", host)
+	}
+
+	return ascii, nil
+}
+
+// displayEndpoint returns the endpoint with an internationalized host name in its Unicode form,
+// for the summaries. The configurations keep the punycode form, see normalizeHostname.
+func displayEndpoint(endpoint string) string {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil || net.ParseIP(host) != nil {
+		return endpoint
+	}
+	unicode, err := idna.Display.ToUnicode(host)
+	if err != nil {
+		return endpoint
+	}
+
+	return net.JoinHostPort(unicode, port)
+}
+
+// sameHost tells whether two host names or addresses name the same server, comparing their
+// normalized forms.
+func sameHost(a string, b string) bool {
+	normalizedA, errA := normalizeHostname(a)
+	normalizedB, errB := normalizeHostname(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+
+	return normalizedA == normalizedB
+}
+
+// sameEndpoint tells whether two host:port endpoints are the same, see sameHost.
+func sameEndpoint(a string, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+
+	return portA == portB && sameHost(hostA, hostB)
+}
+
+// alternateEndpointComments returns the comment lines documenting the secondary endpoints in the
+// client configurations, e.g. "Alternate endpoint: [2001:db8::1]:51820". ParseWireguardConfig
+// keeps them as comments of the peer.
+func (config *appConfig) alternateEndpointComments() []string {
+	comments := make([]string, 0, len(config.SecondaryEndpoints))
+	for _, endpoint := range config.SecondaryEndpoints {
+		comments = append(comments, alternateEndpointPrefix+endpoint)
+	}
+
+	return comments
+}
+
+// setServerEndpoint points every client at a new endpoint of the server.
+//
+// Returns:
+//     []fieldChange: The changed endpoints.
+func (config *appConfig) setServerEndpoint(endpoint string) []fieldChange {
+	var changes []fieldChange
+	for i := range config.Clients {
+		for j := range config.Clients[i].Peers {
+			peer := &config.Clients[i].Peers[j]
+			if !sameEndpoint(peer.Endpoint, endpoint) {
+				changes = append(changes, fieldChange{Client: i + 1, Field: "endpoint", Before: peer.Endpoint, After: endpoint})
+			}
+			// The same endpoint in another spelling is rewritten in the normalized form
+			peer.Endpoint = endpoint
+		}
+	}
+
+	return changes
+}
+
+// runSetEndpointCommand implements the 'set-endpoint' command, which changes the endpoint the
+// clients connect to and the secondary endpoints documented in their configurations:
+//
+//     set-endpoint vpn.example.com:51820
+//     set-endpoint --secondary [2001:db8::1]:51820,203.0.113.7:51820
+//     set-endpoint --secondary none
+//
+// The primary endpoint goes into the Endpoint of every client, the secondary ones into comment
+// lines above the [Peer] section, so that users can switch quickly when a path fails. All the
+// configuration files are regenerated.
+func runSetEndpointCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: set-endpoint [host:port] [--secondary host:port,... | --secondary none]")
+	var primary string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		primary, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet("set-endpoint", flag.ContinueOnError)
+	secondary := flags.String("secondary", "", "Comma-separated alternate endpoints documented in the client configs, none to remove them")
+	if err := parseFlags(flags, "set-endpoint", args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 || (primary == "" && *secondary == "") {
+		return usage
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	var changes []fieldChange
+	if primary != "" {
+		endpoint, err := parseEndpoint(primary, config.Server.ListenPort)
+		if err != nil {
+			return err
+		}
+		if host, _, _ := net.SplitHostPort(endpoint); !confirmEndpointReachable(host) {
+			return newError(errValidation, "endpoint %s rejected", endpoint)
+		}
+		changes = config.setServerEndpoint(endpoint)
+	}
+
+	if *secondary != "" {
+		var endpoints []string
+		if strings.TrimSpace(*secondary) != "none" {
+			for _, value := range strings.Split(*secondary, ",") {
+				endpoint, err := parseEndpoint(value, config.Server.ListenPort)
+				if err != nil {
+					return err
+				}
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+		changes = append(changes, fieldChange{Field: "secondary", Before: strings.Join(config.SecondaryEndpoints, ","),
+			After: strings.Join(endpoints, ",")})
+		config.SecondaryEndpoints = endpoints
+	}
+
+	if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+		return err
+	}
+	for _, warning := range config.ddnsEndpointWarnings() {
+		fmt.Println("Warning:", warning)
+	}
+
+	if err = config.saveWithHistory(configPath, "set-endpoint", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, "set-endpoint", changes)
+}
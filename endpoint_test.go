@@ -0,0 +1,304 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestClassifyEndpointAddress(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"8.8.8.8", endpointPublic},
+		{"93.184.216.34", endpointPublic},
+		{"2001:4860:4860::8888", endpointPublic},
+		{"10.0.0.1", endpointPrivate},
+		{"172.16.0.1", endpointPrivate},
+		{"172.31.255.254", endpointPrivate},
+		{"172.32.0.1", endpointPublic},
+		{"192.168.1.10", endpointPrivate},
+		{"fd00::1", endpointPrivate},
+		{"fc00::1", endpointPrivate},
+		{"100.64.0.1", endpointSharedNat},
+		{"100.127.255.254", endpointSharedNat},
+		{"100.128.0.1", endpointPublic},
+		{"127.0.0.1", endpointLoopback},
+		{"127.255.0.1", endpointLoopback},
+		{"::1", endpointLoopback},
+		{"169.254.10.20", endpointLinkLocal},
+		{"fe80::1", endpointLinkLocal},
+		{"0.0.0.0", endpointUnspecified},
+		{"::", endpointUnspecified},
+		{"::ffff:192.168.1.10", endpointPrivate},
+		{"192.0.0.8", endpointReserved},
+		{"192.0.2.1", endpointReserved},
+		{"192.0.3.1", endpointPublic},
+		{"198.51.100.7", endpointReserved},
+		{"203.0.113.10", endpointReserved},
+		{"198.18.0.1", endpointReserved},
+		{"198.19.255.254", endpointReserved},
+		{"198.20.0.1", endpointPublic},
+		{"240.0.0.1", endpointReserved},
+		{"255.255.255.255", endpointReserved},
+		{"2001:db8::1", endpointReserved},
+		{"2001:db9::1", endpointPublic},
+	}
+
+	for _, test := range tests {
+		if got := classifyEndpointAddress(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("classifyEndpointAddress(%s) = %s, want %s", test.ip, got, test.want)
+		}
+	}
+	if got := classifyEndpointAddress(nil); got != endpointUnspecified {
+		t.Errorf("classifyEndpointAddress(nil) = %s, want %s", got, endpointUnspecified)
+	}
+}
+
+func TestExternalAddressCandidates(t *testing.T) {
+	previous := localAddresses
+	t.Cleanup(func() { localAddresses = previous })
+	localAddresses = func() ([]net.Addr, error) {
+		var addresses []net.Addr
+		for _, cidr := range []string{"93.184.216.34/24", "192.168.1.10/24", "192.0.2.5/24", "198.18.0.5/15",
+			"2001:db8::5/64", "2606:4700:10::6816:1/64", "100.64.1.1/10"} {
+			ip, ipNet, _ := net.ParseCIDR(cidr)
+			addresses = append(addresses, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+		}
+		return addresses, nil
+	}
+
+	// Only the public interface addresses follow the detected one
+	candidates := externalAddressCandidates(net.ParseIP("8.8.8.8"))
+	var got []string
+	for _, candidate := range candidates {
+		got = append(got, candidate.String())
+	}
+	if want := "8.8.8.8 93.184.216.34 2606:4700:10::6816:1"; strings.Join(got, " ") != want {
+		t.Errorf("externalAddressCandidates() = %s, want %s", strings.Join(got, " "), want)
+	}
+}
+
+func TestEndpointScopeWarnings(t *testing.T) {
+	for _, scope := range []string{endpointPrivate, endpointSharedNat, endpointLoopback, endpointLinkLocal,
+		endpointReserved, endpointUnspecified} {
+		if endpointScopeWarnings[scope] == "" {
+			t.Errorf("no warning for endpoints of scope %s", scope)
+		}
+	}
+}
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		host    string
+		want    string
+		wantErr bool
+	}{
+		{"vpn.example.com", "vpn.example.com", false},
+		{"VPN.Example.COM.", "vpn.example.com", false},
+		{"bücher.example", "xn--bcher-kva.example", false},
+		{"BÜCHER.Example.", "xn--bcher-kva.example", false},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", false},
+		{"203.0.113.7", "203.0.113.7", false},
+		{"2001:db8::1", "2001:db8::1", false},
+		{".", "", true},
+		{"vpn_example.com", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := normalizeHostname(test.host)
+		if test.wantErr {
+			if exitCode(err) != exitValidation {
+				t.Errorf("normalizeHostname(%q) = %q, %v, want a validation error", test.host, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("normalizeHostname(%q) = %q, %v, want %q", test.host, got, err, test.want)
+		}
+	}
+}
+
+func TestParseEndpointNormalizes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"VPN.Example.COM.:51821", "vpn.example.com:51821"},
+		{"bücher.example", "xn--bcher-kva.example:51820"},
+		{"Bücher.Example.:443", "xn--bcher-kva.example:443"},
+		{"[2001:db8::1]:51821", "[2001:db8::1]:51821"},
+	}
+
+	for _, test := range tests {
+		if got, err := parseEndpoint(test.value, 51820); err != nil || got != test.want {
+			t.Errorf("parseEndpoint(%q) = %q, %v, want %q", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestCleanEndpointInput(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr string
+	}{
+		{"udp://vpn.example.com:51820", "vpn.example.com:51820", ""},
+		{"UDP://vpn.example.com:51820/", "vpn.example.com:51820", ""},
+		{"wireguard://203.0.113.7:51820", "203.0.113.7:51820", ""},
+		{"https://vpn.example.com", "vpn.example.com", ""},
+		{"vpn.example.com :51820", "vpn.example.com:51820", ""},
+		{"vpn.example.com : 51820", "vpn.example.com:51820", ""},
+		{"\u200bvpn.example.com:51820\u200b", "vpn.example.com:51820", ""},
+		{"vpn.exa\u200cmple.com:518\u200d20", "vpn.example.com:51820", ""},
+		{"\ufeffvpn.example.com:51820", "vpn.example.com:51820", ""},
+		{"\u00a0 vpn.example.com:51820\u00a0\t\r\n", "vpn.example.com:51820", ""},
+		{"\u2003udp://vpn.example.com\u00a0:\u00a051820\u2060", "vpn.example.com:51820", ""},
+		{"[2001:db8::1] :51820", "[2001:db8::1]:51820", ""},
+		{"vpn example.com:51820", "", "character U+0020 at position 4 isn't allowed"},
+		{"vpn.example.com\u00a0x:51820", "", "character U+0020 at position 16"},
+		{"vpn.example\u200e.com:51820", "", "character U+200E at position 12"},
+		{"vpn.example.com:518\x0020", "", "character U+0000 at position 20"},
+	}
+
+	for _, test := range tests {
+		got, err := cleanEndpointInput(test.value)
+		if test.wantErr != "" {
+			if exitCode(err) != exitValidation || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("cleanEndpointInput(%q) = %q, %v, want %q", test.value, got, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("cleanEndpointInput(%q) = %q, %v, want %q", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestParseEndpointPasted(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr string
+	}{
+		{"udp://vpn.example.com:51820", "vpn.example.com:51820", ""},
+		{"vpn.example.com :51821", "vpn.example.com:51821", ""},
+		{"\u200bVPN.Example.com:51820\u200b", "vpn.example.com:51820", ""},
+		{"udp://\u00a0vpn.example.com\u00a0", "vpn.example.com:51820", ""},
+		{"wg://[2001:db8::1]/", "[2001:db8::1]:51820", ""},
+		{"udp://vpn.example.com:port", "", "invalid port in endpoint 'vpn.example.com:port'"},
+		{"udp://vpn.example.com:70000", "", "endpoint 'vpn.example.com:70000'"},
+		{"udp://vpn.exa mple.com", "", "character U+0020 at position 8"},
+	}
+
+	for _, test := range tests {
+		got, err := parseEndpoint(test.value, 51820)
+		if test.wantErr != "" {
+			if exitCode(err) != exitValidation || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("parseEndpoint(%q) = %q, %v, want %q", test.value, got, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseEndpoint(%q) = %q, %v, want %q", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestDisplayEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{"xn--bcher-kva.example:51820", "bücher.example:51820"},
+		{"vpn.example.com:51820", "vpn.example.com:51820"},
+		{"[2001:db8::1]:51820", "[2001:db8::1]:51820"},
+		{"not an endpoint", "not an endpoint"},
+	}
+
+	for _, test := range tests {
+		if got := displayEndpoint(test.endpoint); got != test.want {
+			t.Errorf("displayEndpoint(%q) = %q, want %q", test.endpoint, got, test.want)
+		}
+	}
+}
+
+func TestSameEndpoint(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"vpn.example.com:51820", "VPN.Example.COM.:51820", true},
+		{"xn--bcher-kva.example:51820", "bücher.example:51820", true},
+		{"vpn.example.com:51820", "vpn.example.com:51821", false},
+		{"vpn.example.com:51820", "vpn.example.org:51820", false},
+		{"[2001:db8::1]:51820", "[2001:db8::1]:51820", true},
+	}
+
+	for _, test := range tests {
+		if got := sameEndpoint(test.a, test.b); got != test.want {
+			t.Errorf("sameEndpoint(%q, %q) = %t, want %t", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSetServerEndpointRoundTrip(t *testing.T) {
+	config, configPath := newTestProfile(t, 2)
+	endpoint, err := parseEndpoint("Bücher.Example.:51820", config.Server.ListenPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := config.setServerEndpoint(endpoint); len(changes) != 2 {
+		t.Errorf("%d changes, want one per client", len(changes))
+	}
+	if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+		t.Fatal(err)
+	}
+	if err = config.save(configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client files and the state keep the punycode form
+	client, _, err := readWireguardConfigFile(configPath+"wsclient_2.conf", parseStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Peers[0].Endpoint != "xn--bcher-kva.example:51820" {
+		t.Errorf("wsclient_2.conf endpoint = %s", client.Peers[0].Endpoint)
+	}
+	loaded, err := loadAppConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Clients[0].Peers[0].Endpoint != endpoint {
+		t.Errorf("stored endpoint = %s, want %s", loaded.Clients[0].Peers[0].Endpoint, endpoint)
+	}
+
+	// The same endpoint in another spelling isn't a change
+	if changes := loaded.setServerEndpoint("BÜCHER.example.:51820"); len(changes) != 0 {
+		t.Errorf("another spelling changed %v", changes)
+	}
+}
+
+func TestProvisionCommandPastedEndpoint(t *testing.T) {
+	isolateProfiles(t)
+	configPath := t.TempDir() + string(os.PathSeparator)
+	err := runProvisionCommand(configPath, []string{"--endpoint", "\u200budp://203.0.113.7 :51820/ "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint := config.Clients[0].Peers[0].Endpoint; endpoint != "203.0.113.7:51820" {
+		t.Errorf("client endpoint %q, want 203.0.113.7:51820", endpoint)
+	}
+
+	err = runProvisionCommand(t.TempDir()+string(os.PathSeparator), []string{"--endpoint", "203.0.113\u200e.7:51820"})
+	if exitCode(err) != exitValidation || !strings.Contains(err.Error(), "character U+200E at position 10") {
+		t.Errorf("provisioning with an invisible mark = %v, want a validation error", err)
+	}
+}
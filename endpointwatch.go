@@ -0,0 +1,240 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Policies telling who keeps the endpoint of the clients current when the external IP address of
+// the server changes, see endpointPolicy.
+const (
+	// endpointByDetection rewrites IP address endpoints with the detected external IP address.
+	endpointByDetection = "detection"
+	// endpointByDdns points the DDNS hostname at the detected address and leaves the clients alone.
+	endpointByDdns = "ddns"
+	// endpointByManual only reports the change, the user updates the endpoint.
+	endpointByManual = "manual"
+)
+
+// defaultWatchInterval is the time between two checks of 'watch-endpoint'.
+const defaultWatchInterval = 5 * time.Minute
+
+// currentEndpoint returns the endpoint the clients connect to, empty if there is no client.
+func (config *appConfig) currentEndpoint() string {
+	if len(config.Clients) == 0 || len(config.Clients[0].Peers) == 0 {
+		return ""
+	}
+
+	return config.Clients[0].Peers[0].Endpoint
+}
+
+// endpointPolicy returns the policy 'watch-endpoint' applies when the external IP address changes:
+// the one set with 'set-server endpoint-managed-by=...', otherwise the one matching how the
+// endpoint was configured. An endpoint that is the DDNS hostname is managed by ddns, an IP address
+// by detection and any other host name, e.g. one the user updates separately, manually.
+//
+// Returns:
+//     string: endpointByDetection, endpointByDdns or endpointByManual.
+//     bool: Whether the policy was set explicitly.
+//
+// Usage:
+//     policy, _ := config.endpointPolicy()
+func (config *appConfig) endpointPolicy() (string, bool) {
+	if config.EndpointManagedBy != "" {
+		return config.EndpointManagedBy, true
+	}
+
+	host, _, err := net.SplitHostPort(config.currentEndpoint())
+	switch {
+	case err != nil:
+		return endpointByManual, false
+	case config.DDNS != nil && sameHost(host, config.DDNS.Hostname):
+		return endpointByDdns, false
+	case net.ParseIP(host) != nil:
+		return endpointByDetection, false
+	}
+
+	return endpointByManual, false
+}
+
+// parseEndpointPolicy parses the value of 'set-server endpoint-managed-by=...', auto returning an
+// empty policy so that endpointPolicy derives it again.
+func parseEndpointPolicy(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case endpointByDetection, endpointByDdns, endpointByManual:
+		return value, nil
+	case "auto":
+		return "", nil
+	}
+
+	return "", newError(errValidation, "invalid endpoint policy '%s', expected detection, ddns, manual or auto", value)
+}
+
+// rewriteDetectedEndpoint points the IP address endpoints of the clients at the new external IP
+// address, keeping their ports. Peers connecting to a host name, or to an address of the other IP
+// family, are left alone.
+//
+// Returns:
+//     []fieldChange: The rewritten endpoints.
+func (config *appConfig) rewriteDetectedEndpoint(ip net.IP) []fieldChange {
+	var changes []fieldChange
+	current := config.currentEndpoint()
+	for i := range config.Clients {
+		for j := range config.Clients[i].Peers {
+			peer := &config.Clients[i].Peers[j]
+			host, port, err := net.SplitHostPort(peer.Endpoint)
+			old := net.ParseIP(host)
+			// Mesh peers connect to other clients, only the server endpoint is rewritten
+			if err != nil || old == nil || !sameEndpoint(peer.Endpoint, current) || (old.To4() == nil) != (ip.To4() == nil) {
+				continue
+			}
+			endpoint := net.JoinHostPort(ip.String(), port)
+			if endpoint != peer.Endpoint {
+				changes = append(changes, fieldChange{Client: i + 1, Field: "endpoint", Before: peer.Endpoint, After: endpoint})
+				peer.Endpoint = endpoint
+			}
+		}
+	}
+
+	return changes
+}
+
+// watchLog prints a line of the 'watch-endpoint' log with a timestamp.
+func watchLog(format string, args ...interface{}) {
+	fmt.Printf("%s "+format+"\n", append([]interface{}{time.Now().Format("2006-01-02 15:04:05")}, args...)...)
+}
+
+// checkEndpoint runs one check of 'watch-endpoint': it detects the external IP address and, if it
+// changed since the previous check, applies the endpoint policy of the profile, logging which one.
+// Behind a relay the relay host is checked instead, see checkRelay.
+// The profile is loaded and saved by every check, so that changes made in between are kept.
+//
+// Parameters:
+//     configPath (string): The profile directory.
+//     address (string): The address to use instead of the detected one, empty to detect it.
+//
+// Returns:
+//     error: An error if the address can't be detected or the policy fails to be applied.
+//
+// Usage:
+//     err := checkEndpoint(configPath, "")
+func checkEndpoint(configPath string, address string) error {
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	if config.Relay != nil {
+		if address != "" {
+			return newError(errUsage, "the clients connect through the relay %s, --ip doesn't apply",
+				displayEndpoint(config.Relay.Endpoint))
+		}
+		return config.checkRelay(configPath)
+	}
+
+	ip := net.ParseIP(address)
+	if address == "" {
+		if ip, err = detectExternalIP(); err != nil {
+			return newError(errDependency, "failed to detect the external IP address: %w", err)
+		}
+	} else if ip == nil {
+		return newError(errValidation, "invalid IP address '%s'", address)
+	}
+	if ip.Equal(net.ParseIP(config.DetectedIP)) {
+		return nil
+	}
+
+	previous := config.DetectedIP
+	if previous == "" {
+		previous = "unknown"
+	}
+	policy, explicit := config.endpointPolicy()
+	origin := "derived from the endpoint " + displayEndpoint(config.currentEndpoint())
+	if explicit {
+		origin = "set with set-server"
+	}
+	watchLog("External IP address changed from %s to %s, applying the endpoint policy %s (%s).", previous, ip, policy, origin)
+
+	var changes []fieldChange
+	switch policy {
+	case endpointByDetection:
+		changes = config.rewriteDetectedEndpoint(ip)
+		if len(changes) == 0 {
+			watchLog("Policy detection: no client connects to an IP address endpoint to rewrite, nothing changed.")
+			break
+		}
+		if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+			return err
+		}
+		watchLog("Policy detection: rewrote %d client endpoints to %s, redistribute the client configurations.", len(changes), ip)
+	case endpointByDdns:
+		if config.DDNS == nil {
+			return newError(errValidation, "policy ddns: DDNS is not configured, see 'ddns set'")
+		}
+		token, err := ddnsToken(configPath)
+		if err != nil {
+			return err
+		}
+		if err = config.DDNS.update(ip, token); err != nil {
+			return newError(errDependency, "policy ddns: failed to update %s: %w", config.DDNS.Hostname, err)
+		}
+		now := time.Now().UTC()
+		config.DDNS.LastIP, config.DDNS.LastUpdate = ip.String(), &now
+		watchLog("Policy ddns: updated %s to %s, the client configurations are unchanged.", config.DDNS.Hostname, ip)
+	default:
+		watchLog("Policy manual: nothing changed, update the endpoint %s yourself if needed.",
+			displayEndpoint(config.currentEndpoint()))
+	}
+
+	config.DetectedIP = ip.String()
+	if err = config.saveWithHistory(configPath, "watch-endpoint", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, "watch-endpoint", map[string]interface{}{
+		"Policy": policy, "Previous": previous, "IP": ip.String(), "Changes": changes})
+}
+
+// runWatchEndpointCommand implements the 'watch-endpoint' command, which watches the external IP
+// address of the server and keeps the endpoint of the clients current according to the endpoint
+// policy of the profile, see endpointPolicy:
+//
+//     watch-endpoint [--interval 5m]
+//     watch-endpoint --once [--ip 203.0.113.7]
+//
+// The policy avoids fighting over the endpoint: with a DDNS hostname the clients never need new
+// files, so only the provider is updated, and a host name the user maintains separately is never
+// rewritten. --once runs a single check, e.g. from a scheduled task. Failed checks are logged and
+// retried at the next interval. Behind a relay, see 'relay', the addresses of the relay host are
+// watched instead.
+func runWatchEndpointCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("watch-endpoint", flag.ContinueOnError)
+	once := flags.Bool("once", false, "Run a single check and exit")
+	interval := flags.Duration("interval", defaultWatchInterval, "Time between two checks")
+	address := flags.String("ip", "", "Address to use instead of the detected external IP, with --once")
+	if err := parseFlags(flags, "watch-endpoint", args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || *interval <= 0 || (*address != "" && !*once) {
+		return newError(errUsage, "usage: watch-endpoint [--interval duration] | --once [--ip address]")
+	}
+
+	if *once {
+		return checkEndpoint(configPath, *address)
+	}
+
+	if config, err := loadAppConfig(configPath); err == nil && config.Relay != nil {
+		watchLog("Watching the addresses of the relay %s every %s.", displayEndpoint(config.Relay.Endpoint), interval.String())
+	} else {
+		watchLog("Watching the external IP address every %s.", interval.String())
+	}
+	for {
+		if err := checkEndpoint(configPath, ""); err != nil {
+			watchLog("Check failed: %s", err)
+		}
+		time.Sleep(*interval)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Exit codes of the program, printed by -help so that wrapping scripts can tell failures apart.
+const (
+	exitOK          = 0
+	exitFailure     = 1 // Any failure not covered by a more specific code
+	exitUsage       = 2
+	exitValidation  = 3
+	exitPrivilege   = 4
+	exitConflict    = 5
+	exitDependency  = 6
+	exitInterrupted = 130
+)
+
+// Error kinds, matched with errors.Is to select the exit code in exitCode.
+var (
+	errUsage      = errors.New("usage error")
+	errValidation = errors.New("validation failure")
+	errPrivilege  = errors.New("privilege required")
+	errConflict   = errors.New("resource conflict")
+	errDependency = errors.New("external dependency missing")
+	// errIO is a failure to read or write the files of the profile, a plain failure
+	errIO = errors.New("I/O failure")
+)
+
+// kindError is an error of one of the kinds above. It reports the underlying message unchanged.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string { return e.err.Error() }
+
+func (e *kindError) Unwrap() error { return e.err }
+
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
+// newError formats an error message like fmt.Errorf and tags the error with the given kind.
+//
+// Usage:
+//     return newError(errConflict, "UDP port %d is already in use", port)
+func newError(kind error, format string, a ...interface{}) error {
+	return &kindError{kind: kind, err: fmt.Errorf(format, a...)}
+}
+
+// exitCode maps an error to the exit code of the program. This is the one place where error kinds
+// are translated into exit codes.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, errValidation), errors.Is(err, errUnsupportedSchema):
+		return exitValidation
+	case errors.Is(err, errPrivilege):
+		return exitPrivilege
+	case errors.Is(err, errConflict):
+		return exitConflict
+	case errors.Is(err, errDependency):
+		return exitDependency
+	case errors.Is(err, errIO):
+		return exitFailure
+	}
+
+	return exitFailure
+}
+
+// fatal logs the error on stderr and terminates the program with the matching exit code.
+func fatal(err error) {
+	log.Print(err)
+	os.Exit(exitCode(err))
+}
+
+// printExitCodes prints the documented exit codes to stderr, as part of the usage.
+func printExitCodes() {
+	fmt.Fprintf(os.Stderr, "\nExit codes:\n"+
+		"  %-3d  success\n  %-3d  failure\n  %-3d  usage error\n  %-3d  validation failure\n"+
+		"  %-3d  privilege required (run as Administrator)\n  %-3d  resource conflict (UDP port, IP address)\n"+
+		"  %-3d  external dependency missing (wireguard.exe, PowerShell)\n  %-3d  interrupted\n",
+		exitOK, exitFailure, exitUsage, exitValidation, exitPrivilege, exitConflict, exitDependency, exitInterrupted)
+}
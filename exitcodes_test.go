@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mustParseCIDR returns the address with the subnet mask of a CIDR notation, e.g. 10.9.0.1/24.
+func mustParseCIDR(t testing.TB, cidr string) net.IPNet {
+	t.Helper()
+	ip, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return net.IPNet{IP: ip, Mask: subnet.Mask}
+}
+
+func TestExitCode(t *testing.T) {
+	port := holdUdpPort(t)
+	notADirectory := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(notADirectory, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		err  func() error
+		want int
+	}{
+		{"success", func() error { return nil }, exitOK},
+		{"unclassified failure", func() error { return errors.New("something failed") }, exitFailure},
+		{"usage error", func() error {
+			_, err := parsePortRange("51820-")
+			return err
+		}, exitUsage},
+		{"newer schema", func() error {
+			return migrateAppConfig(&appConfig{SchemaVersion: stateSchemaVersion + 1})
+		}, exitValidation},
+		{"invalid configuration", func() error {
+			return validationFailure([]error{errors.New("the server has no address")})
+		}, exitValidation},
+		{"profile not writable", func() error { return checkProfileWritable(notADirectory + string(os.PathSeparator)) },
+			exitPrivilege},
+		{"subnet exhausted", func() error {
+			config := appConfig{}
+			config.Server.Address = []net.IPNet{mustParseCIDR(t, "10.9.0.1/30")}
+			config.Clients = []WireguardConfig{{Interface: Interface{Address: []net.IPNet{mustParseCIDR(t, "10.9.0.2/32")}}}}
+			_, err := config.nextFreeAddress(config.serverSubnet())
+			return err
+		}, exitConflict},
+		{"port busy", func() error {
+			_, err := CheckUdpPortOnAddress(udpFamilyIPv4, "127.0.0.1", port)
+			return err
+		}, exitConflict},
+		{"dependency missing", func() error {
+			t.Setenv("PATH", t.TempDir())
+			return checkTunnelDependencies()
+		}, exitDependency},
+		{"file not written", func() error { return newError(errIO, "can't write %s", "wsclient_1.conf") }, exitFailure},
+		{"wrapped", func() error {
+			return fmt.Errorf("Failed to add new client: %w", newError(errConflict, "subnet is full"))
+		}, exitConflict},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.err()
+			if got := exitCode(err); got != test.want {
+				t.Errorf("exitCode(%v) = %d, want %d", err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestKindErrorMessage(t *testing.T) {
+	err := newError(errConflict, "UDP port %d is already in use", 51820)
+	if err.Error() != "UDP port 51820 is already in use" {
+		t.Errorf("Error() = %q, the kind must not change the message", err.Error())
+	}
+	if !errors.Is(err, errConflict) || errors.Is(err, errUsage) {
+		t.Errorf("errors.Is doesn't match the kind of %v", err)
+	}
+}
+
+func TestPrintExitCodes(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = writer
+	printExitCodes()
+	os.Stderr = stderr
+	writer.Close()
+	output, _ := ioutil.ReadAll(reader)
+
+	for _, code := range []int{exitOK, exitFailure, exitUsage, exitValidation, exitPrivilege, exitConflict,
+		exitDependency, exitInterrupted} {
+		if !strings.Contains(string(output), fmt.Sprintf("  %-3d  ", code)) {
+			t.Errorf("exit code %d isn't documented:\n%s", code, output)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import "strings"
+
+// exportKind is a kind of file the 'export' command writes, run by the command that exports it.
+type exportKind struct {
+	name     string
+	usage    string
+	run      func(configPath string, args []string) error
+	readOnly func(args []string) bool
+}
+
+// exportKinds lists the kinds of the 'export' command. The commands predating it, such as
+// 'export-qr' and 'relay export', remain as aliases of their kind.
+var exportKinds = []exportKind{
+	{
+		name:     "qr",
+		usage:    "export qr [--workers n] [--qr-version 1-40] [--qr-level low|medium|high|highest] [--force] <directory>",
+		run:      runExportQrCommand,
+		readOnly: alwaysReadOnly,
+	},
+	{
+		name:     "handout",
+		usage:    "export handout <client> --out file.html | --all --out dir [--org name] [--logo image] [--support contact] [--template file]",
+		run:      runExportHandoutCommand,
+		readOnly: alwaysReadOnly,
+	},
+	{
+		name:     "client",
+		usage:    "export client <client> --out file.bundle [--passphrase text]",
+		run:      runExportClientCommand,
+		readOnly: alwaysReadOnly,
+	},
+	{
+		name:  "networkd",
+		usage: "export networkd [--name wg0] [--private-key-file path]",
+		run:   runExportNetworkdCommand,
+	},
+	{
+		name:  "relay",
+		usage: "export relay socat|systemd|nftables [--out file]",
+		run: func(configPath string, args []string) error {
+			return runRelayCommand(configPath, append([]string{"export"}, args...))
+		},
+		readOnly: alwaysReadOnly,
+	},
+	{
+		name:     "windows-import",
+		usage:    "export windows-import <client>[,<client>...] | --all --out file.ps1|dir [--tunnel name] [--drop]",
+		run:      runExportWindowsImportCommand,
+		readOnly: alwaysReadOnly,
+	},
+}
+
+// findExportKind returns the export kind with the given name or nil if there is none.
+func findExportKind(name string) *exportKind {
+	for i := range exportKinds {
+		if exportKinds[i].name == name {
+			return &exportKinds[i]
+		}
+	}
+	return nil
+}
+
+// runExportCommand implements the 'export' command, the single entry point for every file written
+// for use outside of the profile. The first argument selects the kind, the remaining ones are
+// those of the kind:
+//
+//     export qr C:\rollout\qr
+//     export handout 2 --out laptop.html
+//     export client 2 --out laptop.bundle
+//     export networkd --name wg0
+//     export relay systemd --out wg-relay.service
+//     export windows-import --all --out C:\rollout\scripts
+//
+// 'export-qr', 'export-handout', 'export-client', 'export-networkd' and 'relay export' do the same
+// and are kept for existing scripts.
+func runExportCommand(configPath string, args []string) error {
+	if len(args) == 0 {
+		return exportUsage()
+	}
+	kind := findExportKind(args[0])
+	if kind == nil {
+		return exportUsage()
+	}
+
+	return kind.run(configPath, args[1:])
+}
+
+// exportUsage returns the usage error of the 'export' command, listing its kinds.
+func exportUsage() error {
+	lines := make([]string, len(exportKinds))
+	for i, kind := range exportKinds {
+		lines[i] = "\t" + kind.usage
+	}
+
+	return newError(errUsage, "usage: export <kind> [arguments], where kind is one of:\n%s", strings.Join(lines, "\n"))
+}
+
+// exportReadOnly is the readOnly function of the 'export' command, that of the selected kind.
+func exportReadOnly(args []string) bool {
+	if len(args) == 0 {
+		return true
+	}
+	kind := findExportKind(args[0])
+
+	return kind == nil || (kind.readOnly != nil && kind.readOnly(args[1:]))
+}
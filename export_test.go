@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportCommand(t *testing.T) {
+	config, configPath := newTestProfile(t, 3)
+	config.Relay = &relaySettings{Endpoint: "relay.example.com:443", Target: "vpn.example.com:51820"}
+	if err := config.save(configPath); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	// Every kind writes what its alias writes
+	tests := []struct {
+		kind  []string
+		alias []string
+		file  string
+		same  bool
+	}{
+		{[]string{"qr", filepath.Join(dir, "qr")}, []string{"export-qr", filepath.Join(dir, "qr-alias")},
+			filepath.Join("qr", "wsclient_2.png"), true},
+		{[]string{"handout", "2", "--out", filepath.Join(dir, "handout.html")},
+			[]string{"export-handout", "2", "--out", filepath.Join(dir, "handout-alias.html")}, "handout.html", false},
+		{[]string{"client", "2", "--out", filepath.Join(dir, "client.bundle")},
+			[]string{"export-client", "2", "--out", filepath.Join(dir, "client-alias.bundle")}, "client.bundle", false},
+		{[]string{"relay", "systemd", "--out", filepath.Join(dir, "relay.service")},
+			[]string{"relay", "export", "systemd", "--out", filepath.Join(dir, "relay-alias.service")}, "relay.service", true},
+		{[]string{"windows-import", "2", "--out", filepath.Join(dir, "office.ps1")}, nil, "office.ps1", false},
+	}
+	for _, test := range tests {
+		if err := runExportCommand(configPath, test.kind); err != nil {
+			t.Fatalf("export %s: %v", strings.Join(test.kind, " "), err)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, test.file))
+		if err != nil || len(content) == 0 {
+			t.Fatalf("export %s wrote no %s: %v", test.kind[0], test.file, err)
+		}
+		if test.alias == nil {
+			continue
+		}
+		if err = findCommand(test.alias[0]).run(configPath, test.alias[1:]); err != nil {
+			t.Fatalf("%s: %v", strings.Join(test.alias, " "), err)
+		}
+		aliasFile := strings.Replace(test.file, test.kind[0], test.kind[0]+"-alias", 1)
+		aliasContent, err := ioutil.ReadFile(filepath.Join(dir, aliasFile))
+		if err != nil {
+			t.Fatalf("%s wrote no %s: %v", test.alias[0], aliasFile, err)
+		}
+		if test.same && !bytes.Equal(content, aliasContent) {
+			t.Errorf("export %s and %s wrote different files", test.kind[0], test.alias[0])
+		}
+	}
+
+	// networkd writes into the profile, the alias overwrites the same files
+	if err := runExportCommand(configPath, []string{"networkd", "--name", "wg7"}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(configPath + "wg7.netdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(configPath + "wg7.netdev"); err != nil {
+		t.Fatal(err)
+	}
+	if err = runExportNetworkdCommand(configPath, []string{"--name", "wg7"}); err != nil {
+		t.Fatal(err)
+	}
+	if aliasContent, _ := ioutil.ReadFile(configPath + "wg7.netdev"); !bytes.Equal(content, aliasContent) {
+		t.Error("export networkd and export-networkd wrote different files")
+	}
+
+	// Without a known kind the usage lists them all
+	for _, args := range [][]string{nil, {"pdf"}, {"--all"}} {
+		err := runExportCommand(configPath, args)
+		if exitCode(err) != exitUsage {
+			t.Fatalf("export %q = %v, want the usage", args, err)
+		}
+		for _, kind := range exportKinds {
+			if !strings.Contains(err.Error(), "\texport "+kind.name+" ") {
+				t.Errorf("the usage doesn't list %s:\n%s", kind.name, err)
+			}
+		}
+	}
+}
+
+func TestExportReadOnly(t *testing.T) {
+	export := findCommand("export")
+	for _, kind := range exportKinds {
+		want := kind.name != "networkd"
+		if got := export.readOnly([]string{kind.name}); got != want {
+			t.Errorf("export %s read-only = %t, want %t", kind.name, got, want)
+		}
+	}
+	if !export.readOnly(nil) || !export.readOnly([]string{"pdf"}) {
+		t.Error("the usage of export isn't read-only")
+	}
+}
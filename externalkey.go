@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// updateClientPublicKey replaces the key of a client with a public key generated on its device,
+// e.g. after the device owner rotated the keys on the device. The server peer of the client gets
+// the new public key and the stored private key is dropped: it no longer connects anyway and would
+// only be a liability. From then on the client has an external key, like the clients of 'adopt',
+// and its configuration file is a stub to be completed on the device, see clientFileConfig. The
+// caller erases the copies of the dropped key left on disk, see eraseClientKey.
+//
+// Parameters:
+//     index (int): The zero-based index of the client.
+//     publicKey (string): The base64 encoded public key generated on the device.
+//
+// Returns:
+//     string: The dropped private key, empty if the client already had an external key.
+//     error: A validation error if the key is invalid, a conflict error if another peer of the
+//         server uses it.
+//
+// Usage:
+//     dropped, err := config.updateClientPublicKey(index, "Xh2Lq...=")
+func (config *appConfig) updateClientPublicKey(index int, publicKey string) (string, error) {
+	if err := validateBase64Key(publicKey); err != nil {
+		return "", newError(errValidation, "invalid public key '%s'", publicKey)
+	}
+	if index >= len(config.Server.Peers) {
+		return "", newError(errValidation, "client %d has no server peer, run 'fsck --repair'", index+1)
+	}
+	if serverKey, err := base64PublicKeyFromPrivate(config.Server.PrivateKey); err == nil && serverKey == publicKey {
+		return "", newError(errConflict, "the public key is the one of the server")
+	}
+	for i, peer := range config.Server.Peers {
+		if i != index && peer.PublicKey == publicKey {
+			return "", newError(errConflict, "the public key is already used by client %d", i+1)
+		}
+	}
+
+	dropped := config.Clients[index].PrivateKey
+	config.Server.Peers[index].PublicKey = publicKey
+	config.Clients[index].PrivateKey = ""
+	now := time.Now().UTC()
+	config.clientInfo(index).ExternalKey = &now
+
+	return dropped, nil
+}
+
+// externalKeyReason explains why the private key of a client with an external key isn't known, for
+// the messages of the commands that can't render its complete configuration.
+func (config *appConfig) externalKeyReason(index int) string {
+	if since := config.clientInfo(index).ExternalKey; since != nil {
+		return fmt.Sprintf("its key was replaced on %s with one generated on the device, and the private key "+
+			"was erased from this profile", since.Local().Format("2006-01-02"))
+	}
+
+	return "its private key was generated on the device and is unknown to this tool"
+}
+
+// deleteBundleImages deletes the QR code images of 'bundle' of the client with the given
+// zero-based index, which hold its private key.
+func deleteBundleImages(configPath string, index int) {
+	entries, err := ioutil.ReadDir(configPath)
+	if err != nil {
+		return
+	}
+
+	clientFile := fmt.Sprintf(defaultClientConfigFile, index+1)
+	for _, entry := range entries {
+		if isBundleImage(entry.Name()) && strings.SplitN(entry.Name(), ".", 2)[0]+".conf" == clientFile {
+			secureDelete(configPath + entry.Name())
+		}
+	}
+}
+
+// zeroizeFile overwrites the content of the file with zeros in place and flushes it to disk, so
+// that the private keys it holds don't survive in the blocks a rewrite or a removal frees. This
+// is best-effort: journaling, copy-on-write file systems and SSD wear leveling may keep copies
+// the overwrite doesn't reach.
+func zeroizeFile(fileName string) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return
+	}
+	if file, err := os.OpenFile(fileName, os.O_WRONLY, 0); err == nil {
+		file.Write(make([]byte, info.Size()))
+		file.Sync()
+		file.Close()
+	}
+}
+
+// eraseClientKey erases the copies of a private key dropped by updateClientPublicKey that are left
+// in the profile directory once the configuration is saved: the QR code images of 'bundle', which
+// are deleted, and the history snapshots, which are rewritten without the key. Restoring such a
+// snapshot with 'undo' gives the client its former public key back as an external key. The
+// configuration file of the client is zeroized before it is rewritten, see zeroizeFile.
+//
+// Parameters:
+//     configPath (string): The profile directory.
+//     index (int): The zero-based index of the client.
+//     privateKey (string): The dropped private key.
+//
+// Returns:
+//     int: The number of snapshots rewritten.
+//
+// Usage:
+//     scrubbed := config.eraseClientKey(configPath, index, dropped)
+func (config *appConfig) eraseClientKey(configPath string, index int, privateKey string) int {
+	deleteBundleImages(configPath, index)
+
+	scrubbed := 0
+	snapshots, _ := listSnapshotFiles(configPath)
+	for _, file := range snapshots {
+		snapshot, err := readSnapshot(configPath, file)
+		if err != nil {
+			continue
+		}
+		found := false
+		for i := range snapshot.Config.Clients {
+			if snapshot.Config.Clients[i].PrivateKey == privateKey {
+				snapshot.Config.Clients[i].PrivateKey = ""
+				found = true
+			}
+		}
+		if !found {
+			continue
+		}
+
+		// The snapshot is named after its time, the rewritten one replaces it under the same name
+		secureDelete(configPath + file.name)
+		if err = writeSnapshot(configPath, snapshot); err != nil {
+			fmt.Printf("Failed to rewrite snapshot %s without the key, it is lost: %s\n", file.name, err)
+			continue
+		}
+		scrubbed++
+	}
+
+	return scrubbed
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// clientFilePassphraseEnv holds the passphrase of encrypted client files for scripts, instead of
+// asking for it.
+const clientFilePassphraseEnv = "WGQC_FILE_PASSPHRASE"
+
+// Markers of the armored ciphertext in an encrypted client file, see sealClientFile.
+const (
+	encryptedFileBegin = "-----BEGIN WG-QUICK-CONFIG ENCRYPTED FILE-----"
+	encryptedFileEnd   = "-----END WG-QUICK-CONFIG ENCRYPTED FILE-----"
+)
+
+// clientFileCheck is encrypted into clientFileEncryption.Check to tell a wrong passphrase from a
+// damaged file.
+const clientFileCheck = "wg-quick-config client file key"
+
+// clientFileEncryption holds, in config.json, what is needed to derive the profile key encrypting
+// the client files from the passphrase. The passphrase and the key are never stored.
+type clientFileEncryption struct {
+	Salt []byte
+	// Check is clientFileCheck encrypted under the key, prefixed with its nonce.
+	Check []byte
+}
+
+// clientFileKey caches the profile key once the passphrase has been entered.
+var clientFileKey []byte
+
+// readFilePassphrase returns the passphrase of the client files from WGQC_FILE_PASSPHRASE, or
+// asks for it without echoing it, see readSecret.
+func readFilePassphrase(prompt string) string {
+	if passphrase := os.Getenv(clientFilePassphraseEnv); passphrase != "" {
+		return passphrase
+	}
+
+	return readSecret(prompt)
+}
+
+// sealData encrypts the plaintext with XChaCha20-Poly1305 under the key, authenticating the
+// additional data, and returns the random nonce followed by the ciphertext.
+func sealData(key []byte, plaintext []byte, additional string) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, []byte(additional)), nil
+}
+
+// openData decrypts what sealData returned, failing if the key, the additional data or the data is wrong.
+func openData(key []byte, sealed []byte, additional string) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(additional))
+}
+
+// newClientFileEncryption derives a new profile key from the passphrase with a fresh salt.
+func newClientFileEncryption(passphrase string) (*clientFileEncryption, []byte, error) {
+	encryption := &clientFileEncryption{Salt: make([]byte, 16)}
+	if _, err := rand.Read(encryption.Salt); err != nil {
+		return nil, nil, err
+	}
+
+	key, err := bundleKey(passphrase, encryption.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if encryption.Check, err = sealData(key, []byte(clientFileCheck), ""); err != nil {
+		return nil, nil, err
+	}
+
+	return encryption, key, nil
+}
+
+// fileKey returns the key encrypting the client files of the profile, asking for the passphrase
+// the first time it is needed.
+func (config *appConfig) fileKey() ([]byte, error) {
+	if clientFileKey != nil {
+		return clientFileKey, nil
+	}
+	if config.ClientFileEncryption == nil {
+		return nil, newError(errValidation, "the client files of this profile are not encrypted")
+	}
+
+	passphrase := readFilePassphrase("Enter the passphrase of the client files:")
+	if passphrase == "" {
+		return nil, newError(errUsage, "the client files are encrypted, enter their passphrase or set %s", clientFilePassphraseEnv)
+	}
+	key, err := bundleKey(passphrase, config.ClientFileEncryption.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if check, err := openData(key, config.ClientFileEncryption.Check, ""); err != nil || string(check) != clientFileCheck {
+		return nil, newError(errValidation, "wrong passphrase of the client files")
+	}
+
+	clientFileKey = key
+	return key, nil
+}
+
+// sealClientFile encrypts the content of a client file under the profile key, bound to the file
+// name so that encrypted files can't be swapped. The result is armored text, starting with a
+// comment telling how to get the plaintext.
+func (config *appConfig) sealClientFile(fileName string, content string, index int) (string, error) {
+	key, err := config.fileKey()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := sealData(key, []byte(content), fileName)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(sealed)
+	result := fmt.Sprintf("# Encrypted client configuration, get the plaintext with: wg-quick-config decrypt %d --out %s\n",
+		index+1, fileName)
+	result += encryptedFileBegin + "\n"
+	for len(encoded) > 64 {
+		result += encoded[:64] + "\n"
+		encoded = encoded[64:]
+	}
+
+	return result + encoded + "\n" + encryptedFileEnd + "\n", nil
+}
+
+// isEncryptedClientFile reports whether the file content was written by sealClientFile.
+func isEncryptedClientFile(content []byte) bool {
+	return strings.Contains(string(content), encryptedFileBegin)
+}
+
+// readClientFile reads the config file of the client with the given zero-based index, decrypting
+// it if it is encrypted. Encrypted and plaintext files can be mixed in a profile, e.g. while the
+// files are rewritten after encryption was turned on or off.
+func (config *appConfig) readClientFile(configPath string, index int) ([]byte, error) {
+	fileName := fmt.Sprintf(defaultClientConfigFile, index+1)
+	content, err := ioutil.ReadFile(configPath + fileName)
+	if err != nil || !isEncryptedClientFile(content) {
+		return content, err
+	}
+
+	text := string(content)
+	begin := strings.Index(text, encryptedFileBegin) + len(encryptedFileBegin)
+	end := strings.Index(text, encryptedFileEnd)
+	if end < begin {
+		return nil, newError(errValidation, "%s is damaged", fileName)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text[begin:end]), ""))
+	if err != nil {
+		return nil, newError(errValidation, "%s is damaged", fileName)
+	}
+
+	key, err := config.fileKey()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openData(key, sealed, fileName)
+	if err != nil {
+		return nil, newError(errValidation, "%s can't be decrypted, it is damaged or belongs to another profile", fileName)
+	}
+
+	return plaintext, nil
+}
+
+// runEncryptFilesCommand implements the 'encrypt-files' command, which turns the encryption of
+// the client config files at rest on or off and rewrites them accordingly:
+//
+//     encrypt-files on
+//     encrypt-files off
+//
+// The key is derived from a passphrase, asked for or taken from WGQC_FILE_PASSPHRASE, and every
+// command reading or writing the client files needs it afterwards. The server config is never
+// encrypted since WireSock must read it, and config.json still holds the private keys.
+func runEncryptFilesCommand(configPath string, args []string) error {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return newError(errUsage, "usage: encrypt-files on|off")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	enable := args[0] == "on"
+	if enable == (config.ClientFileEncryption != nil) {
+		fmt.Printf("Client file encryption is already %s.\n", args[0])
+		return nil
+	}
+
+	if enable {
+		passphrase := os.Getenv(clientFilePassphraseEnv)
+		if passphrase == "" {
+			passphrase = readSecret("Enter a passphrase for the client files:")
+			if passphrase != readSecret("Enter the passphrase again:") {
+				return newError(errUsage, "the passphrases don't match")
+			}
+		}
+		if passphrase == "" {
+			return newError(errUsage, "the passphrase can't be empty")
+		}
+		if config.ClientFileEncryption, clientFileKey, err = newClientFileEncryption(passphrase); err != nil {
+			return err
+		}
+	} else {
+		// Decrypting the files needs the key of the current passphrase
+		if _, err = config.fileKey(); err != nil {
+			return err
+		}
+		config.ClientFileEncryption = nil
+	}
+
+	for i := range config.Clients {
+		clientFileName, err := config.writeClientConfigFile(configPath, i)
+		if err != nil {
+			return err
+		}
+		fmt.Println(config.savedMessage("client configuration", clientFileName))
+	}
+
+	if err = config.saveWithHistory(configPath, "encrypt-files "+args[0], false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+	if enable {
+		fmt.Printf("The client files are encrypted. %s is not, WireSock must be able to read it.\n", config.serverConfigFile())
+	}
+
+	return appendAuditLog(configPath, "encrypt-files", map[string]interface{}{"Enabled": enable})
+}
+
+// runDecryptCommand implements the 'decrypt' command, which writes the plaintext config file of a
+// client, e.g. for handing it to the device:
+//
+//     decrypt 2 --out C:\handoff\laptop.conf
+//
+// Plaintext client files are copied unchanged.
+func runDecryptCommand(configPath string, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return newError(errUsage, "usage: decrypt <client> --out file.conf")
+	}
+
+	flags := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	out := flags.String("out", "", "File to write the plaintext client config into")
+	if err := parseFlags(flags, "decrypt", args[1:]); err != nil {
+		return err
+	}
+	if *out == "" {
+		return newError(errUsage, "usage: decrypt <client> --out file.conf")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	index, err := config.findClient(args[0])
+	if err != nil {
+		return err
+	}
+
+	content, err := config.readClientFile(configPath, index)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(*out, content, 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("Plaintext configuration of client %d written to %s, it contains the private key.\n", index+1, *out)
+	if config.recordStatus(configPath, index, statusDelivered, "file exported", time.Now()) {
+		config.saveStatus(configPath)
+	}
+	return nil
+}
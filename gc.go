@@ -0,0 +1,273 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// orphanFile is a file of the profile directory that the configuration doesn't reference, as
+// listed by 'gc'.
+type orphanFile struct {
+	File string
+	// Generated tells whether the file bears the provenance header, or for a QR code image the name
+	// 'bundle' gives it, see isGeneratedFile.
+	Generated bool
+	// Key describes whose private key the file holds, e.g. "former client", see orphanKeyOwner.
+	Key     string
+	Deleted bool
+}
+
+// String describes the orphan for the 'gc' output.
+func (orphan orphanFile) String() string {
+	origin := "foreign"
+	if orphan.Generated {
+		origin = "generated"
+	}
+	result := fmt.Sprintf("%-28s %-9s %s", orphan.File, origin, orphan.Key)
+	if orphan.Deleted {
+		result += ", deleted"
+	}
+
+	return result
+}
+
+// referencedFiles returns the names of the files of the profile directory the configuration uses:
+// the state, audit log, summary and history files, the server and client configuration files and
+// the configuration template if it is kept in the profile.
+func (config *appConfig) referencedFiles(configPath string) map[string]bool {
+	referenced := map[string]bool{
+		defaultAppConfigFile:      true,
+		defaultAuditLogFile:       true,
+		defaultSummaryTextFile:    true,
+		defaultSummaryJsonFile:    true,
+		elevatedScriptFile:        true,
+		ddnsTokenFile:             true,
+		knownProfilesFile:         true,
+		config.serverConfigFile(): true,
+	}
+	for i := range config.Clients {
+		referenced[fmt.Sprintf(defaultClientConfigFile, i+1)] = true
+	}
+	if config.Template != "" && filepath.Clean(filepath.Dir(config.Template)) == filepath.Clean(configPath) {
+		referenced[filepath.Base(config.Template)] = true
+	}
+	if applied, err := loadAppliedState(configPath); err == nil {
+		// The files of the applied configuration stay in use until the staged changes are applied
+		referenced[appliedStateFile] = true
+		referenced[applied.serverConfigFile()] = true
+		for i := range applied.Clients {
+			referenced[fmt.Sprintf(defaultClientConfigFile, i+1)] = true
+		}
+	}
+	if snapshots, err := listSnapshotFiles(configPath); err == nil {
+		for _, snapshot := range snapshots {
+			referenced[snapshot.name] = true
+		}
+	}
+
+	return referenced
+}
+
+// isExportFile tells whether the file is an output of 'mesh', 'export-networkd' or 'export
+// windows-import'. These are independent of the configuration and never orphaned, 'gc' leaves them
+// alone.
+func isExportFile(name string) bool {
+	var node int
+	if _, err := fmt.Sscanf(name, defaultMeshConfigFile, &node); err == nil && name == fmt.Sprintf(defaultMeshConfigFile, node) {
+		return true
+	}
+	extension := strings.ToLower(filepath.Ext(name))
+
+	return extension == ".netdev" || extension == ".network" || extension == ".ps1"
+}
+
+// isBundleImage tells whether the file is named like a QR code image of 'bundle', e.g.
+// wsclient_3.png or wsclient_3.part1of2.png.
+func isBundleImage(name string) bool {
+	if !strings.HasSuffix(name, ".png") {
+		return false
+	}
+	configFile := strings.SplitN(name, ".", 2)[0] + ".conf"
+	var client int
+	_, err := fmt.Sscanf(configFile, defaultClientConfigFile, &client)
+
+	return err == nil && configFile == fmt.Sprintf(defaultClientConfigFile, client)
+}
+
+// orphanKeyOwner tells whose private key an orphaned file holds, by matching its public key with
+// the server and the current clients, and with the clients of the history snapshots, which were
+// removed since. A file holding the key of a removed client still lets anyone connect until the
+// key is gone from the server, and is worth deleting first.
+//
+// Parameters:
+//     configPath (string): The profile directory holding the history snapshots.
+//     content ([]byte): The content of the orphaned file.
+//
+// Returns:
+//     string: A description such as "key of current client 3", "key of former client" or "no
+//         private key".
+//
+// Usage:
+//     owner := config.orphanKeyOwner(configPath, content)
+func (config *appConfig) orphanKeyOwner(configPath string, content []byte) string {
+	if isEncryptedClientFile(content) {
+		return "encrypted, key not checked"
+	}
+	wc, _, err := parseWireguardConfigText(string(content), "", parseLenient)
+	if err != nil {
+		return "not a Wireguard config"
+	}
+	publicKey, err := base64PublicKeyFromPrivate(wc.PrivateKey)
+	if wc.PrivateKey == "" || err != nil {
+		return "no private key"
+	}
+
+	if serverKey, err := base64PublicKeyFromPrivate(config.Server.PrivateKey); err == nil && serverKey == publicKey {
+		return "key of the server"
+	}
+	for i, peer := range config.Server.Peers {
+		if peer.PublicKey == publicKey {
+			return fmt.Sprintf("key of current client %d", i+1)
+		}
+	}
+	snapshots, _ := listSnapshotFiles(configPath)
+	for _, file := range snapshots {
+		snapshot, err := readSnapshot(configPath, file)
+		if err != nil {
+			continue
+		}
+		for _, peer := range snapshot.Config.Server.Peers {
+			if peer.PublicKey == publicKey {
+				return "key of former client"
+			}
+		}
+	}
+
+	return "unknown key"
+}
+
+// findOrphanFiles lists the files of the profile directory that the configuration doesn't
+// reference, see referencedFiles, with whose key they hold.
+func (config *appConfig) findOrphanFiles(configPath string) ([]orphanFile, error) {
+	entries, err := ioutil.ReadDir(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := config.referencedFiles(configPath)
+	orphans := make([]orphanFile, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || referenced[name] || isExportFile(name) || isTempFile(name) {
+			continue
+		}
+
+		orphan := orphanFile{File: name, Key: "image"}
+		if isBundleImage(name) {
+			orphan.Generated = true
+		} else if content, err := ioutil.ReadFile(configPath + name); err != nil {
+			orphan.Key = "unreadable"
+		} else {
+			orphan.Generated = isGeneratedFile(content)
+			orphan.Key = config.orphanKeyOwner(configPath, content)
+		}
+		orphans = append(orphans, orphan)
+	}
+
+	return orphans, nil
+}
+
+// secureDelete overwrites the file with zeros before removing it, so that the private keys it may
+// hold don't linger in the freed blocks, see zeroizeFile.
+func secureDelete(fileName string) error {
+	zeroizeFile(fileName)
+
+	return os.Remove(fileName)
+}
+
+// runGcCommand implements the 'gc' command, which deletes the files of the profile directory that
+// no longer belong to any client, e.g. the config files of removed clients, which still hold
+// valid private keys:
+//
+//     gc --dry-run
+//     gc
+//     gc --include-foreign
+//
+// Every file the configuration doesn't reference is listed with whether this tool generated it
+// and whose key it holds, a current or a former client, see orphanKeyOwner. Generated files are
+// deleted after confirmation, overwritten first, see secureDelete; files of another origin only
+// with --include-foreign. --dry-run lists the files without deleting anything.
+func runGcCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "List the orphaned files without deleting them")
+	includeForeign := flags.Bool("include-foreign", false, "Also delete files not generated by wg-quick-config")
+	if err := parseFlags(flags, "gc", args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return newError(errUsage, "usage: gc [--dry-run] [--include-foreign]")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	orphans, err := config.findOrphanFiles(configPath)
+	if err != nil {
+		return err
+	}
+
+	var eligible []int
+	for i, orphan := range orphans {
+		if orphan.Generated || *includeForeign {
+			eligible = append(eligible, i)
+		}
+	}
+
+	if !*dryRun && len(eligible) > 0 {
+		fmt.Println("Files to delete:")
+		for _, i := range eligible {
+			fmt.Println("\t" + configPath + orphans[i].File)
+		}
+		if !askConfirmation(fmt.Sprintf("Delete %d files?", len(eligible))) {
+			return newError(errConflict, "aborted, no file was deleted")
+		}
+
+		var deleted []string
+		for _, i := range eligible {
+			if err = secureDelete(configPath + orphans[i].File); err != nil {
+				fmt.Printf("Failed to delete %s: %s\n", orphans[i].File, err)
+				continue
+			}
+			orphans[i].Deleted = true
+			deleted = append(deleted, orphans[i].File)
+			delete(config.FileHashes, orphans[i].File)
+		}
+		if err = config.save(configPath); err != nil {
+			return fmt.Errorf("failed to store the application configuration: %w", err)
+		}
+		appendAuditLog(configPath, "gc", map[string]interface{}{"Deleted": deleted})
+	}
+
+	text := ""
+	for _, orphan := range orphans {
+		text += orphan.String() + "\n"
+	}
+	switch {
+	case len(orphans) == 0:
+		text = "The profile directory holds no orphaned files.\n"
+	case *dryRun:
+		text += fmt.Sprintf("%d of %d files would be deleted, run 'gc' without --dry-run to delete them.\n",
+			len(eligible), len(orphans))
+	}
+	if len(eligible) < len(orphans) && !*includeForeign {
+		text += "Foreign files are kept, --include-foreign deletes them as well.\n"
+	}
+	printResult(text, orphans)
+
+	return nil
+}
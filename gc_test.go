@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestIsExportFile(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"wsmesh_2.conf", true},
+		{"25-wg0.netdev", true},
+		{"25-wg0.network", true},
+		{"office.ps1", true},
+		{"wsclient_3.PS1", true},
+		{"wsmesh_x.conf", false},
+		{"wsclient_3.conf", false},
+		{"wsclient_3.png", false},
+		{"notes.txt", false},
+	}
+
+	for _, test := range tests {
+		if got := isExportFile(test.name); got != test.want {
+			t.Errorf("isExportFile(%s) = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFindOrphanFilesKeepsExports(t *testing.T) {
+	config, configPath := newTestProfile(t, 3)
+	if err := runExportCommand(configPath, []string{"windows-import", "2", "--out", configPath + "office.ps1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runExportCommand(configPath, []string{"windows-import", "--all", "--out", configPath}); err != nil {
+		t.Fatal(err)
+	}
+	// The file of a removed client is an orphan holding its key
+	content, err := ioutil.ReadFile(configPath + "wsclient_3.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(configPath+"wsclient_9.conf", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := config.findOrphanFiles(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].File != "wsclient_9.conf" || !orphans[0].Generated ||
+		orphans[0].Key != "key of current client 3" {
+		t.Errorf("orphans = %+v, want only wsclient_9.conf", orphans)
+	}
+}
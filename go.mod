@@ -3,9 +3,12 @@ module github.com/wiresock/wg-quick-config
 go 1.18
 
 require (
-	github.com/glendc/go-external-ip v0.1.0 // indirect
-	github.com/gonutz/w32/v2 v2.9.0 // indirect
-	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e // indirect
-	golang.org/x/crypto v0.10.0 // indirect
-	golang.org/x/sys v0.9.0 // indirect
+	github.com/glendc/go-external-ip v0.1.0
+	github.com/gonutz/w32/v2 v2.9.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.10.0
+	golang.org/x/net v0.10.0
+	golang.org/x/sys v0.9.0
 )
+
+require golang.org/x/text v0.10.0 // indirect
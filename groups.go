@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// groupNamePattern matches the names accepted for client groups.
+var groupNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,32}$`)
+
+// groupDefaultsFields lists the keys of the group defaults: the defaults fields of the client
+// configurations, see defaultsFields, and the expiry of the clients created in the group.
+var groupDefaultsFields = append(append([]string(nil), defaultsFields...), "expiry")
+
+// clientGroup is a named set of clients, e.g. staff or contractors, with defaults layered on top of
+// the instance defaults. Groups only exist in config.json, the configuration files merely mention
+// the group of a client as a comment.
+type clientGroup struct {
+	Name string
+	// Defaults maps the defaults fields (see groupDefaultsFields) set for the group to their value, in
+	// the syntax of 'defaults set'.
+	Defaults map[string]string `json:",omitempty"`
+}
+
+// String returns the group with its defaults, as printed by 'group list'.
+func (group clientGroup) String() string {
+	var settings []string
+	for _, field := range groupDefaultsFields {
+		if value, found := group.Defaults[field]; found {
+			settings = append(settings, field+"="+value)
+		}
+	}
+
+	return strings.TrimRight(fmt.Sprintf("%-16s %s", group.Name, strings.Join(settings, " ")), " ")
+}
+
+// findGroup returns the group with the given name, nil if there is none.
+func (config *appConfig) findGroup(name string) *clientGroup {
+	for i := range config.Groups {
+		if config.Groups[i].Name == name {
+			return &config.Groups[i]
+		}
+	}
+
+	return nil
+}
+
+// groupMembers returns the zero-based indexes of the clients in the given group.
+func (config *appConfig) groupMembers(name string) []int {
+	var members []int
+	for i := range config.ClientsInfo {
+		if i < len(config.Clients) && config.ClientsInfo[i].Group == name {
+			members = append(members, i)
+		}
+	}
+
+	return members
+}
+
+// defaultsForGroup returns the instance defaults with the defaults of the given group applied on
+// top. Clients without a group use the instance defaults unchanged.
+//
+// Parameters:
+//     name (string): The group name, empty for no group.
+//
+// Returns:
+//     clientDefaults: The defaults for the clients of the group.
+//
+// Usage:
+//     config.defaultsForGroup("contractors").applyTo(&client)
+func (config *appConfig) defaultsForGroup(name string) clientDefaults {
+	defaults := config.effectiveDefaults()
+
+	if group := config.findGroup(name); group != nil {
+		for _, field := range groupDefaultsFields {
+			if value, found := group.Defaults[field]; found {
+				// Validated when the group default was set
+				defaults.set(field, value)
+			}
+		}
+	}
+
+	return defaults
+}
+
+// defaultsForClient returns the defaults for the client with the given zero-based index, see
+// defaultsForGroup. Clients with a public endpoint get no keepalive, see applyClientRole.
+func (config *appConfig) defaultsForClient(index int) clientDefaults {
+	defaults := config.defaultsForGroup(config.clientInfo(index).Group)
+	if config.role(index) == clientRolePublic {
+		defaults.PersistentKeepalive = 0
+	}
+	if routesEverything(defaults.AllowedIPs) && len(config.clientSites(index)) > 0 && !config.clientInfo(index).FullTunnelSite {
+		defaults.AllowedIPs = config.siteAllowedIPs(index)
+	}
+
+	return defaults
+}
+
+// ensureGroup makes sure a group exists before clients are added to it, offering to create it
+// otherwise.
+func (config *appConfig) ensureGroup(name string) error {
+	if config.findGroup(name) != nil {
+		return nil
+	}
+	if !groupNamePattern.MatchString(name) {
+		return newError(errValidation, "invalid group name '%s', expected up to 32 letters, digits or _.- characters", name)
+	}
+	if !askConfirmation(fmt.Sprintf("Group '%s' does not exist. Create it?", name)) {
+		return newError(errValidation, "group '%s' does not exist, create it with 'group create %s'", name, name)
+	}
+
+	config.Groups = append(config.Groups, clientGroup{Name: name})
+	return nil
+}
+
+// setGroupDefaults sets defaults of a group from key=value arguments, an empty value removing the
+// group default so that the instance default applies again.
+func (group *clientGroup) setGroupDefaults(args []string) error {
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !found || (!isDefaultsField(key) && key != "expiry") {
+			return newError(errUsage, "invalid argument '%s', expected key=value with a key out of %s", arg,
+				strings.Join(groupDefaultsFields, ", "))
+		}
+
+		value = strings.TrimSpace(value)
+		if value == "" {
+			delete(group.Defaults, key)
+			continue
+		}
+
+		var scratch clientDefaults
+		if err := scratch.set(key, value); err != nil {
+			return err
+		}
+		if group.Defaults == nil {
+			group.Defaults = map[string]string{}
+		}
+		group.Defaults[key] = value
+	}
+
+	return nil
+}
+
+// runGroupCommand implements the 'group' command, which manages the client groups:
+//
+//     group list
+//     group create contractors dns=10.9.0.1 allowedips=10.0.0.0/8 expiry=90d
+//     group set contractors mtu=1280 dns=
+//     group assign contractors 3,4
+//     group unassign 4
+//     group delete contractors
+//
+// Group defaults apply to clients created with '-add -group' and are rolled out to existing
+// members with 'apply-defaults --group', except the expiry, which is only given to new clients. An
+// empty value removes a group default. Deleting a group removes its clients from it after
+// confirmation, the clients themselves are kept. 'remove --group' and 'rotate --group' remove the
+// clients of a group or give them new keys.
+func runGroupCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: group list | create <name> [key=value...] | set <name> key=value... | "+
+		"assign <name> <clients> | unassign <clients> | delete <name>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	var details interface{}
+	rewrite := false
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		result := ""
+		for _, group := range config.Groups {
+			result += fmt.Sprintf("%s  (%d clients)\n", group.String(), len(config.groupMembers(group.Name)))
+		}
+		if result == "" {
+			result = "There are no client groups.\n"
+		}
+		printResult(result, config.Groups)
+		return nil
+
+	case args[0] == "create" && len(args) >= 2:
+		if config.findGroup(args[1]) != nil {
+			return newError(errConflict, "group '%s' already exists", args[1])
+		}
+		if !groupNamePattern.MatchString(args[1]) {
+			return newError(errValidation, "invalid group name '%s', expected up to 32 letters, digits or _.- characters", args[1])
+		}
+		group := clientGroup{Name: args[1]}
+		if err = group.setGroupDefaults(args[2:]); err != nil {
+			return err
+		}
+		config.Groups = append(config.Groups, group)
+		details = group
+
+	case args[0] == "set" && len(args) >= 3:
+		group := config.findGroup(args[1])
+		if group == nil {
+			return newError(errValidation, "group '%s' does not exist", args[1])
+		}
+		if err = group.setGroupDefaults(args[2:]); err != nil {
+			return err
+		}
+		fmt.Printf("Group defaults updated. Existing members are unchanged, use 'apply-defaults --group %s' to update them.\n",
+			group.Name)
+		details = *group
+
+	case args[0] == "assign" && len(args) == 3:
+		if config.findGroup(args[1]) == nil {
+			return newError(errValidation, "group '%s' does not exist", args[1])
+		}
+		selected, err := config.parseClientSelection(args[2])
+		if err != nil {
+			return err
+		}
+		for _, index := range selected {
+			config.clientInfo(index).Group = args[1]
+		}
+		fmt.Printf("Use 'apply-defaults --group %s' to apply the group defaults to the assigned clients.\n", args[1])
+		details = map[string]interface{}{"Group": args[1], "Clients": args[2]}
+		rewrite = true
+
+	case args[0] == "unassign" && len(args) == 2:
+		selected, err := config.parseClientSelection(args[1])
+		if err != nil {
+			return err
+		}
+		for _, index := range selected {
+			config.clientInfo(index).Group = ""
+		}
+		details = map[string]interface{}{"Clients": args[1]}
+		rewrite = true
+
+	case args[0] == "delete" && len(args) == 2:
+		if config.findGroup(args[1]) == nil {
+			return newError(errValidation, "group '%s' does not exist", args[1])
+		}
+		members := config.groupMembers(args[1])
+		if len(members) > 0 {
+			fmt.Printf("Clients in group '%s':\n", args[1])
+			entries := config.clientEntries()
+			for _, index := range members {
+				fmt.Print(formatClientEntries(entries[index : index+1]))
+			}
+			if !askConfirmation(fmt.Sprintf("Remove these %d clients from the group and delete it?", len(members))) {
+				fmt.Println("No changes applied.")
+				return nil
+			}
+		}
+		for _, index := range members {
+			config.clientInfo(index).Group = ""
+		}
+		remaining := config.Groups[:0]
+		for _, group := range config.Groups {
+			if group.Name != args[1] {
+				remaining = append(remaining, group)
+			}
+		}
+		config.Groups = remaining
+		details = map[string]interface{}{"Group": args[1], "Members": len(members)}
+		rewrite = len(members) > 0
+
+	default:
+		return usage
+	}
+
+	// The group of a client is emitted as a comment in the configuration files
+	if rewrite {
+		if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+			return err
+		}
+	}
+
+	operation := "group " + args[0]
+	if err = config.saveWithHistory(configPath, operation, false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, operation, details)
+}
+
+// groupNames returns the sorted names of the groups, for error messages.
+func (config *appConfig) groupNames() []string {
+	var names []string
+	for _, group := range config.Groups {
+		names = append(names, group.Name)
+	}
+	sort.Strings(names)
+
+	return names
+}
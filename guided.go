@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// firstRunAction is an entry of the menu of the guided mode: a recommended next step and the
+// command line it stands for, run exactly as if it had been typed.
+type firstRunAction struct {
+	Label string
+	Args  []string
+}
+
+// firstRunEnvironment is what the guided mode found out about this host, see inspectFirstRun.
+type firstRunEnvironment struct {
+	ConfigPath string
+	// Config is the configuration of the profile, nil if there is none or it can't be loaded.
+	Config *appConfig
+	// LoadError is why an existing config.json can't be loaded.
+	LoadError error
+	// Adoptable are the server configurations not created by this tool found on this host.
+	Adoptable []string
+	// WireSock is the installed WireSock version, WireGuard the path of wireguard.exe (wg-quick
+	// outside Windows), both empty if not installed.
+	WireSock  string
+	WireGuard string
+	Elevated  bool
+}
+
+// adoptSearchDirs returns the directories searched for server configurations to adopt besides the
+// profile directory: where WireSock setups are usually kept on Windows, /etc/wireguard elsewhere.
+func adoptSearchDirs() []string {
+	if runtime.GOOS != "windows" {
+		return []string{"/etc/wireguard"}
+	}
+
+	dirs := []string{`C:\wiresock`}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, "Documents"), filepath.Join(home, "Downloads"))
+	}
+	return dirs
+}
+
+// findAdoptableConfigs returns the Wireguard server configurations in the profile directory and
+// the adoptSearchDirs that this tool didn't generate: files with a PrivateKey and a ListenPort.
+// Client configurations and unreadable files are left out.
+func findAdoptableConfigs(configPath string) []string {
+	var found []string
+	seen := make(map[string]bool)
+	for _, dir := range append([]string{configPath}, adoptSearchDirs()...) {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".conf") {
+				continue
+			}
+			fileName := filepath.Join(dir, entry.Name())
+			if seen[strings.ToLower(fileName)] {
+				continue
+			}
+			seen[strings.ToLower(fileName)] = true
+
+			content, err := ioutil.ReadFile(fileName)
+			if err != nil || isGeneratedFile(content) {
+				continue
+			}
+			server, _, err := parseWireguardConfigText(string(content), fileName, parseLenient)
+			if err == nil && server.PrivateKey != "" && server.ListenPort != 0 {
+				found = append(found, fileName)
+			}
+		}
+	}
+
+	return found
+}
+
+// detectWireguardProgram returns the path of wireguard.exe, which installs the tunnel services,
+// or of wg-quick outside Windows, empty if it isn't installed.
+func detectWireguardProgram() string {
+	if runtime.GOOS != "windows" {
+		path, _ := exec.LookPath("wg-quick")
+		return path
+	}
+
+	if path, err := exec.LookPath("wireguard.exe"); err == nil {
+		return path
+	}
+	path := filepath.Join(os.Getenv("ProgramFiles"), "WireGuard", "wireguard.exe")
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	return ""
+}
+
+// inspectFirstRun gathers what the guided mode recommends its actions from: the configuration of
+// the profile, the server configurations that could be adopted instead, the installed WireSock and
+// WireGuard, and whether the process is elevated. Detection is best-effort like in 'doctor'.
+//
+// Parameters:
+//     configPath (string): The profile directory.
+//     ps (Executor): Runs the WireSock detection, see NewPowerShell.
+//
+// Returns:
+//     firstRunEnvironment: The findings.
+//
+// Usage:
+//     env := inspectFirstRun(configPath, newExecutor())
+func inspectFirstRun(configPath string, ps Executor) firstRunEnvironment {
+	env := firstRunEnvironment{ConfigPath: configPath, WireSock: detectWireSockVersion(ps),
+		WireGuard: detectWireguardProgram()}
+	if _, elevated, err := IsAdminElevated(); err == nil {
+		env.Elevated = elevated
+	}
+
+	config, err := loadAppConfig(configPath)
+	switch {
+	case err == nil:
+		env.Config = &config
+	case !os.IsNotExist(err):
+		env.LoadError = err
+	default:
+		env.Adoptable = findAdoptableConfigs(configPath)
+	}
+
+	return env
+}
+
+// String describes the findings, one line each.
+func (env firstRunEnvironment) String() string {
+	var result string
+	switch {
+	case env.Config != nil:
+		result = fmt.Sprintf("  Profile %s: %d clients, tunnel %s\n", env.ConfigPath, len(env.Config.Clients),
+			env.Config.tunnelName())
+	case env.LoadError != nil:
+		result = fmt.Sprintf("  Profile %s: config.json can't be loaded: %v\n", env.ConfigPath, env.LoadError)
+	default:
+		result = fmt.Sprintf("  Profile %s: no configuration yet\n", env.ConfigPath)
+	}
+	for _, fileName := range env.Adoptable {
+		result += fmt.Sprintf("  Server configuration not created by this tool: %s\n", fileName)
+	}
+
+	if env.WireSock != "" {
+		result += fmt.Sprintf("  WireSock %s is installed\n", env.WireSock)
+	} else if runtime.GOOS == "windows" {
+		result += "  WireSock is not installed\n"
+	}
+	if env.WireGuard != "" {
+		result += fmt.Sprintf("  WireGuard: %s\n", env.WireGuard)
+	} else {
+		result += "  WireGuard is not installed, starting the tunnel needs it\n"
+	}
+	if env.Elevated {
+		result += "  Running as Administrator\n"
+	} else {
+		result += "  Not running as Administrator, privileged steps are queued for 'finish'\n"
+	}
+
+	return result
+}
+
+// recommendedActions returns the menu of the guided mode for the findings, the most likely next
+// step first: adopting an existing server or creating a new one without a configuration, adding a
+// client to an existing one. Every action is a command line of an existing flag or subcommand.
+func (env firstRunEnvironment) recommendedActions() []firstRunAction {
+	var actions []firstRunAction
+	switch {
+	case env.LoadError != nil:
+		actions = append(actions, firstRunAction{"Check the profile for damage", []string{"fsck"}})
+	case env.Config == nil:
+		for _, fileName := range env.Adoptable {
+			actions = append(actions, firstRunAction{"Adopt the config found at " + fileName, []string{"adopt", fileName}})
+		}
+		actions = append(actions, firstRunAction{"Create a new VPN server", []string{"-add"}})
+	default:
+		if env.Config.staged() {
+			actions = append(actions, firstRunAction{"Apply the staged changes", []string{"apply"}})
+		}
+		if len(env.Config.PendingSteps) > 0 {
+			actions = append(actions, firstRunAction{"Complete the queued privileged steps", []string{"finish", "--elevated"}})
+		}
+		actions = append(actions, firstRunAction{"Just add a client to the existing setup", []string{"-add"}})
+		actions = append(actions, firstRunAction{"Start or restart the VPN server", []string{"-restart"}})
+		actions = append(actions, firstRunAction{"Check the setup for problems", []string{"doctor"}})
+	}
+
+	return append(actions, firstRunAction{"Show all flags and commands", []string{"-help"}})
+}
+
+// runGuidedMode is the entry point of the bare executable on a console: it shows what it found on
+// this host and a short menu of recommended actions, and returns the command line of the chosen
+// one, which main then runs like any other, so that an action behaves exactly as the flag or
+// subcommand typed directly. Nil is returned if the user quits.
+//
+// Parameters:
+//     configPath (string): The profile directory.
+//
+// Returns:
+//     []string: The arguments of the chosen action, nil to quit.
+//
+// Usage:
+//     args = runGuidedMode(configFilePath)
+func runGuidedMode(configPath string) []string {
+	progress := startSpinner("Inspecting this host")
+	env := inspectFirstRun(configPath, newExecutor())
+	progress.Stop()
+
+	fmt.Println("Found on this host:")
+	fmt.Print(env.String())
+	fmt.Println("\nWhat do you want to do?")
+	actions := env.recommendedActions()
+	for i, action := range actions {
+		fmt.Printf("  %d. %s\n", i+1, action.Label)
+	}
+	fmt.Println("  0. Quit")
+
+	for {
+		answer := readInput("Choose an action [1]: ")
+		if answer == "" {
+			answer = "1"
+		}
+		choice, err := strconv.Atoi(answer)
+		if err == nil && choice == 0 {
+			return nil
+		}
+		if err == nil && choice >= 1 && choice <= len(actions) {
+			fmt.Printf("Running: %s %s\n\n", filepath.Base(os.Args[0]), strings.Join(actions[choice-1].Args, " "))
+			return actions[choice-1].Args
+		}
+		fmt.Printf("Please enter a number between 0 and %d.\n", len(actions))
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// handoutQrCodeSize is the width and height in pixels of the QR code embedded in a handout. It is
+// shown at 7 cm, which keeps the whole handout on one printed page.
+const handoutQrCodeSize = 512
+
+// defaultHandoutTemplate is the html/template of the onboarding handouts, used unless another one
+// is given with --template. It is self-contained and prints on a single page.
+const defaultHandoutTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Organization}} VPN access for {{.Name}}</title>
+<style>
+  @page { size: A4; margin: 15mm; }
+  body { font-family: "Segoe UI", Arial, sans-serif; color: #222; max-width: 180mm; margin: 0 auto; }
+  header { display: flex; align-items: center; gap: 12px; border-bottom: 2px solid #444; padding-bottom: 6px; }
+  header img { max-height: 48px; }
+  h1 { font-size: 20px; margin: 0; }
+  .warning { border: 3px solid #b00020; background: #fdecea; color: #b00020; padding: 8px 12px; margin: 12px 0; font-weight: bold; }
+  .qr { text-align: center; margin: 12px 0; }
+  .qr img { width: 70mm; height: 70mm; image-rendering: pixelated; }
+  ol { margin: 6px 0 6px 20px; padding: 0; }
+  pre { font-size: 10px; background: #f4f4f4; padding: 6px; white-space: pre-wrap; word-break: break-all; }
+  footer { font-size: 11px; color: #555; border-top: 1px solid #ccc; margin-top: 12px; padding-top: 6px; }
+  @media print { details { display: none; } .warning { -webkit-print-color-adjust: exact; print-color-adjust: exact; } }
+</style>
+</head>
+<body>
+<header>
+  {{if .Logo}}<img src="{{.Logo}}" alt="">{{end}}
+  <h1>{{.Organization}} VPN access for {{.Name}}</h1>
+</header>
+<div class="warning">This page contains your private VPN key. Anyone holding it, printed or as a file, can connect as you.
+Keep it private, do not forward it, and destroy it after setting up your device.</div>
+{{if .QrCode}}<div class="qr"><img src="{{.QrCode}}" alt="Wireguard configuration QR code"></div>
+{{else}}<p><b>Your device generated its own key.</b> Add its private key to the [Interface] section of the configuration below, no QR code is provided.</p>
+{{end}}<h2>Setting up your device</h2>
+<ol>
+  <li>Install the Wireguard app: on Android and iOS from the app store, on Windows, macOS and Linux from https://www.wireguard.com/install/.</li>
+  <li>On a phone, tap "+" in the Wireguard app, choose "Scan from QR code" and scan the code above.</li>
+  <li>On a computer, save the configuration below as {{.ConfigFile}} and choose "Import tunnel(s) from file".</li>
+  <li>Activate the tunnel.</li>
+</ol>
+{{if .Alternates}}<p>If the tunnel doesn't connect, edit it and replace its Endpoint with one of the alternate server addresses:
+{{range $i, $endpoint := .Alternates}}{{if $i}}, {{end}}<b>{{$endpoint}}</b>{{end}}.</p>
+{{end}}<details>
+<summary>Show the configuration text</summary>
+<pre>{{.Config}}</pre>
+</details>
+<footer>
+  {{if .Support}}Support: {{.Support}}<br>{{end}}
+  {{if .Relay}}Connects through the relay {{.Relay}}<br>{{end}}
+  Client {{.Client}}, address {{.Address}}, generated {{.Generated}}
+</footer>
+</body>
+</html>
+`
+
+// handoutData is the data the handout template is executed with.
+type handoutData struct {
+	Organization string
+	Logo         template.URL // Data URI of the logo image, empty without a logo
+	Support      string
+	Client       int
+	Name         string // Name metadata of the client, see clientName
+	Address      string
+	ConfigFile   string
+	Config       string
+	QrCode       template.URL // Data URI of the QR code PNG, empty for clients with an external key
+	Generated    string
+	Alternates   []string // Secondary endpoints of the server, see set-endpoint
+	Relay        string   // Relay the client connects through, empty without a relay, see relaySettings
+}
+
+// dataURI embeds the content of a file into a data URI, so that a handout needs no other files.
+func dataURI(content []byte) template.URL {
+	return template.URL("data:" + http.DetectContentType(content) + ";base64," +
+		base64.StdEncoding.EncodeToString(content))
+}
+
+// loadHandoutTemplate parses the handout template stored in the given file, or the built-in one if
+// the file name is empty.
+func loadHandoutTemplate(fileName string) (*template.Template, error) {
+	if fileName == "" {
+		return template.New("handout").Parse(defaultHandoutTemplate)
+	}
+
+	return template.New(filepath.Base(fileName)).ParseFiles(fileName)
+}
+
+// renderHandout renders the onboarding handout of the client with the given zero-based index: the
+// QR code as an embedded PNG, import instructions and the configuration in a collapsible section.
+//
+// Parameters:
+//     tmpl (*template.Template): The handout template, see loadHandoutTemplate.
+//     index (int): The zero-based index of the client.
+//     data (handoutData): The organization, logo and support contact, the client fields are filled in.
+//
+// Returns:
+//     []byte: The self-contained HTML page.
+//     error: An error if the QR code or the template can't be rendered.
+//
+// Usage:
+//     page, err := config.renderHandout(tmpl, 0, handoutData{Organization: "Example Corp"})
+func (config *appConfig) renderHandout(tmpl *template.Template, index int, data handoutData) ([]byte, error) {
+	content, err := config.renderConfig(config.clientFileConfig(index))
+	if err != nil {
+		return nil, err
+	}
+
+	data.Client = index + 1
+	data.Name = config.clientName(index)
+	data.Address = joinIPNets(config.Clients[index].Address)
+	data.ConfigFile = fmt.Sprintf(defaultClientConfigFile, index+1)
+	data.Config = content
+	data.Generated = time.Now().Format("2006-01-02")
+	data.Alternates = config.SecondaryEndpoints
+	if config.Relay != nil {
+		data.Relay = config.Relay.String()
+	}
+
+	if config.Clients[index].PrivateKey != "" {
+		qrContent, _ := config.mobileQrContent(index)
+		qr, err := EncodeQR(qrContent, QROptions{Level: qrcode.Medium, MinLevel: qrcode.Low, PNGSize: handoutQrCodeSize})
+		if err != nil {
+			return nil, fmt.Errorf("can't generate the QR code of client %d: %w", index+1, err)
+		}
+		data.QrCode = dataURI(qr.PNG)
+	}
+
+	var page bytes.Buffer
+	if err = tmpl.Execute(&page, data); err != nil {
+		return nil, fmt.Errorf("can't render the handout of client %d: %w", index+1, err)
+	}
+
+	return page.Bytes(), nil
+}
+
+// runExportHandoutCommand implements 'export handout' and its alias 'export-handout', which writes
+// a printable, self-contained HTML onboarding handout for a client, or for all clients into a
+// directory:
+//
+//     export-handout 2 --out handout.html
+//     export-handout --all --out C:\handouts --org "Example Corp" --logo logo.png --support help@example.com
+//     export-handout 2 --out handout.html --template corporate-handout.html
+//
+// --template replaces the built-in html/template, see handoutData for the available fields. The
+// handouts contain private keys and are written readable by the owner only.
+func runExportHandoutCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: export-handout <client> --out file.html | --all --out directory "+
+		"[--org name] [--logo image] [--support contact] [--template file]")
+
+	selection := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		selection, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet("export-handout", flag.ContinueOnError)
+	out := flags.String("out", "", "File of the handout, or directory of the handouts with --all")
+	all := flags.Bool("all", false, "Write a handout for every client")
+	organization := flags.String("org", "Wireguard", "Organization name shown in the title")
+	logo := flags.String("logo", "", "Image file of the organization logo")
+	support := flags.String("support", "", "Support contact shown at the bottom")
+	templateFile := flags.String("template", "", "html/template replacing the built-in handout layout")
+	if err := parseFlags(flags, "export-handout", args); err != nil {
+		return err
+	}
+	if *out == "" || flags.NArg() != 0 || (selection == "") == !*all {
+		return usage
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	var selected []int
+	if *all {
+		for i := range config.Clients {
+			selected = append(selected, i)
+		}
+	} else if selected, err = config.parseClientSelection(selection); err != nil {
+		return err
+	} else if len(selected) != 1 {
+		return newError(errUsage, "export-handout writes a single client, use --all for a directory of handouts")
+	}
+
+	tmpl, err := loadHandoutTemplate(*templateFile)
+	if err != nil {
+		return newError(errValidation, "invalid handout template: %w", err)
+	}
+
+	data := handoutData{Organization: *organization, Support: *support}
+	if *logo != "" {
+		image, err := ioutil.ReadFile(*logo)
+		if err != nil {
+			return newError(errValidation, "can't read the logo: %w", err)
+		}
+		data.Logo = dataURI(image)
+	}
+
+	if *all {
+		if err = os.MkdirAll(*out, 0700); err != nil {
+			return err
+		}
+	}
+
+	delivered := false
+	for _, index := range selected {
+		page, err := config.renderHandout(tmpl, index, data)
+		if err != nil {
+			return err
+		}
+
+		fileName := *out
+		if *all {
+			fileName = filepath.Join(*out, strings.TrimSuffix(fmt.Sprintf(defaultClientConfigFile, index+1), ".conf")+".html")
+		}
+		if err = writeFileAtomic(fileName, page, 0600); err != nil {
+			return fmt.Errorf("can't write %s: %w", fileName, err)
+		}
+		fmt.Println("Successfully saved handout:", fileName)
+		delivered = config.recordStatus(configPath, index, statusDelivered, "handout exported", time.Now()) || delivered
+	}
+	if delivered {
+		config.saveStatus(configPath)
+	}
+
+	fmt.Println("Warning: the handouts contain private keys, hand them over personally and destroy them after use.")
+	return nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"hash"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Constants of the Wireguard Noise_IKpsk2 handshake, see https://www.wireguard.com/protocol/.
+const (
+	noiseConstruction   = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wireguardIdentifier = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	labelMac1           = "mac1----"
+
+	messageInitiationType   = 1
+	messageResponseType     = 2
+	messageCookieReplyType  = 3
+	messageInitiationSize   = 148
+	messageResponseSize     = 92
+	messageCookieReplySize  = 64
+	defaultHandshakeTimeout = 5 * time.Second
+)
+
+// errNoHandshakeResponse is returned by probeHandshake when the server doesn't answer in time.
+var errNoHandshakeResponse = fmt.Errorf("no handshake response")
+
+// blake2sHash returns the BLAKE2s-256 hash of the concatenated inputs.
+func blake2sHash(inputs ...[]byte) []byte {
+	h, _ := blake2s.New256(nil)
+	for _, input := range inputs {
+		h.Write(input)
+	}
+
+	return h.Sum(nil)
+}
+
+// hmacBlake2s returns HMAC-BLAKE2s-256 of the input, the building block of the handshake KDF.
+func hmacBlake2s(key []byte, input []byte) []byte {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	mac.Write(input)
+
+	return mac.Sum(nil)
+}
+
+// kdf2 derives two keys from the chaining key and the input, KDF2 of the Wireguard protocol.
+func kdf2(chainingKey []byte, input []byte) ([]byte, []byte) {
+	t0 := hmacBlake2s(chainingKey, input)
+	t1 := hmacBlake2s(t0, []byte{1})
+	t2 := hmacBlake2s(t0, append(append([]byte(nil), t1...), 2))
+
+	return t1, t2
+}
+
+// aeadSeal encrypts the plaintext with ChaCha20Poly1305 and a zero counter, authenticating the hash.
+func aeadSeal(key []byte, plaintext []byte, authenticated []byte) []byte {
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), plaintext, authenticated)
+}
+
+// tai64n returns the TAI64N timestamp of the time, which the server requires to increase with every
+// handshake of a peer.
+func tai64n(t time.Time) []byte {
+	timestamp := make([]byte, 12)
+	binary.BigEndian.PutUint64(timestamp, uint64(0x400000000000000a+t.Unix()))
+	binary.BigEndian.PutUint32(timestamp[8:], uint32(t.Nanosecond()))
+
+	return timestamp
+}
+
+// decodeKey decodes a base64 Wireguard key.
+func decodeKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != WireguardPublicKeySize {
+		return nil, newError(errValidation, "invalid key")
+	}
+
+	return decoded, nil
+}
+
+// handshakeState is what the initiator keeps of its handshake initiation to process the response
+// of the server, see consumeHandshakeResponse.
+type handshakeState struct {
+	privateKey    []byte
+	ephemeral     WireguardPrivateKey
+	chainingKey   []byte
+	handshakeHash []byte
+	senderIndex   uint32
+}
+
+// handshakeInitiation builds a handshake initiation message of the peer with the given private key
+// towards the server with the given public key. The message has no cookie, mac2 is zero.
+//
+// Parameters:
+//     privateKey ([]byte): The private key of the initiating client.
+//     serverPublicKey ([]byte): The public key of the server.
+//     senderIndex (uint32): The index the server echoes in its response.
+//
+// Returns:
+//     []byte: The 148 byte initiation message.
+//     error: An error if a Diffie-Hellman operation fails, e.g. for a low order public key.
+//
+// Usage:
+//     message, err := handshakeInitiation(privateKey, serverPublicKey, 1)
+func handshakeInitiation(privateKey []byte, serverPublicKey []byte, senderIndex uint32) ([]byte, error) {
+	message, _, err := initiateHandshake(privateKey, serverPublicKey, senderIndex)
+	return message, err
+}
+
+// initiateHandshake builds a handshake initiation message like handshakeInitiation and also returns
+// the state of the initiator, to complete the handshake with the response of the server.
+func initiateHandshake(privateKey []byte, serverPublicKey []byte, senderIndex uint32) ([]byte, handshakeState, error) {
+	state := handshakeState{privateKey: privateKey, senderIndex: senderIndex}
+	if _, err := rand.Read(state.ephemeral[:]); err != nil {
+		return nil, state, err
+	}
+	state.ephemeral.clamp()
+	ephemeralPublic := state.ephemeral.publicKey()
+
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, state, err
+	}
+
+	chainingKey := blake2sHash([]byte(noiseConstruction))
+	handshakeHash := blake2sHash(chainingKey, []byte(wireguardIdentifier))
+	handshakeHash = blake2sHash(handshakeHash, serverPublicKey)
+
+	message := make([]byte, messageInitiationSize)
+	message[0] = messageInitiationType
+	binary.LittleEndian.PutUint32(message[4:], senderIndex)
+	copy(message[8:40], ephemeralPublic[:])
+
+	chainingKey = hmacBlake2s(hmacBlake2s(chainingKey, ephemeralPublic[:]), []byte{1})
+	handshakeHash = blake2sHash(handshakeHash, ephemeralPublic[:])
+
+	shared, err := curve25519.X25519(state.ephemeral[:], serverPublicKey)
+	if err != nil {
+		return nil, state, err
+	}
+	chainingKey, key := kdf2(chainingKey, shared)
+	encryptedStatic := aeadSeal(key, publicKey, handshakeHash)
+	copy(message[40:88], encryptedStatic)
+	handshakeHash = blake2sHash(handshakeHash, encryptedStatic)
+
+	if shared, err = curve25519.X25519(privateKey, serverPublicKey); err != nil {
+		return nil, state, err
+	}
+	chainingKey, key = kdf2(chainingKey, shared)
+	encryptedTimestamp := aeadSeal(key, tai64n(time.Now()), handshakeHash)
+	copy(message[88:116], encryptedTimestamp)
+	state.chainingKey = chainingKey
+	state.handshakeHash = blake2sHash(handshakeHash, encryptedTimestamp)
+
+	mac1Key := blake2sHash([]byte(labelMac1), serverPublicKey)
+	mac, _ := blake2s.New128(mac1Key)
+	mac.Write(message[:116])
+	copy(message[116:132], mac.Sum(nil))
+
+	return message, state, nil
+}
+
+// probeHandshake sends a Wireguard handshake initiation with the client private key to the server
+// endpoint and waits for the handshake response. Unlike a port check, a response proves that a
+// Wireguard server listens on the endpoint and accepts the client key: the server only answers
+// initiations of known peers, encrypted for its own public key. A cookie reply, sent by servers
+// under load, proves at least the server public key.
+//
+// A successful probe makes the server send the traffic of the client to the probing host until the
+// client itself handshakes again, which takes up to two minutes for idle clients.
+//
+// Parameters:
+//     privateKey (string): The base64 private key of the client.
+//     serverPublicKey (string): The base64 public key of the server.
+//     endpoint (string): The host:port of the server.
+//     timeout (time.Duration): How long to wait for the response.
+//
+// Returns:
+//     time.Duration: The round trip time of the handshake.
+//     error: errNoHandshakeResponse if the server doesn't answer in time, or a network error.
+//
+// Usage:
+//     rtt, err := probeHandshake(client.PrivateKey, peer.PublicKey, peer.Endpoint, 5*time.Second)
+func probeHandshake(privateKey string, serverPublicKey string, endpoint string, timeout time.Duration) (time.Duration, error) {
+	clientKey, err := decodeKey(privateKey)
+	if err != nil {
+		return 0, newError(errValidation, "invalid client private key")
+	}
+	serverKey, err := decodeKey(serverPublicKey)
+	if err != nil {
+		return 0, newError(errValidation, "invalid server public key")
+	}
+
+	var index [4]byte
+	if _, err = rand.Read(index[:]); err != nil {
+		return 0, err
+	}
+	senderIndex := binary.LittleEndian.Uint32(index[:])
+
+	message, err := handshakeInitiation(clientKey, serverKey, senderIndex)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := net.Dial("udp", endpoint)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+	conn.SetDeadline(deadline)
+	if _, err = conn.Write(message); err != nil {
+		return 0, err
+	}
+
+	response := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		n, err := conn.Read(response)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			// e.g. an ICMP port unreachable, reported as connection refused
+			return 0, err
+		}
+		// The response carries our index after the sender index of the server, the cookie reply
+		// right after the header
+		switch {
+		case response[0] == messageResponseType && n == messageResponseSize &&
+			binary.LittleEndian.Uint32(response[8:12]) == senderIndex:
+			return time.Since(start), nil
+		case response[0] == messageCookieReplyType && n == messageCookieReplySize &&
+			binary.LittleEndian.Uint32(response[4:8]) == senderIndex:
+			return time.Since(start), fmt.Errorf("the server is under load and answered with a cookie reply, " +
+				"its public key is correct but the client key couldn't be verified")
+		}
+	}
+
+	return 0, errNoHandshakeResponse
+}
+
+// runHandshakeCommand implements the 'handshake' command, which verifies end to end that the server
+// answers a Wireguard handshake of a client, using the keys and the endpoint of the client
+// configuration:
+//
+//     handshake 2
+//     handshake 2 --endpoint 192.168.1.10:51820 --timeout 10s
+//
+// The probe temporarily takes over the session of the client on the server, see probeHandshake.
+func runHandshakeCommand(configPath string, args []string) error {
+	if len(args) == 0 {
+		return newError(errUsage, "usage: handshake <client> [--endpoint host:port] [--timeout 5s]")
+	}
+
+	flags := flag.NewFlagSet("handshake", flag.ContinueOnError)
+	endpoint := flags.String("endpoint", "", "Endpoint to probe instead of the one of the client configuration")
+	timeout := flags.Duration("timeout", defaultHandshakeTimeout, "How long to wait for the handshake response")
+	if err := parseFlags(flags, "handshake", args[1:]); err != nil {
+		return err
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	selected, err := config.parseClientSelection(args[0])
+	if err != nil {
+		return err
+	}
+	if len(selected) != 1 {
+		return newError(errUsage, "handshake probes a single client")
+	}
+	client := config.Clients[selected[0]]
+	if client.PrivateKey == "" {
+		return newError(errValidation, "client %d uses an external key, its handshake can only be tested on the device", selected[0]+1)
+	}
+	if len(client.Peers) == 0 {
+		return newError(errValidation, "client %d has no server peer", selected[0]+1)
+	}
+
+	peer := client.Peers[0]
+	if *endpoint == "" {
+		*endpoint = peer.Endpoint
+	}
+
+	progress := startSpinner("Sending a handshake initiation to " + *endpoint)
+	rtt, err := probeHandshake(client.PrivateKey, peer.PublicKey, *endpoint, *timeout)
+	progress.Stop()
+
+	if err == errNoHandshakeResponse {
+		return newError(errDependency, "no handshake response from %s within %s: the server is down or unreachable, "+
+			"the UDP port is blocked, or the server doesn't know the key of client %d", *endpoint, *timeout, selected[0]+1)
+	}
+	if err != nil {
+		return newError(errDependency, "handshake with %s failed: %w", *endpoint, err)
+	}
+
+	fmt.Printf("Handshake with %s completed in %s, the keys and the endpoint of client %d are correct.\n",
+		*endpoint, rtt.Round(time.Millisecond), selected[0]+1)
+	return nil
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// harnessArgsVariable passes the command line of a harness step, as a JSON array, to the test
+// binary running it as wg-quick-config, see TestHarnessCLI.
+const harnessArgsVariable = "WGQ_TEST_HARNESS_ARGS"
+
+// harnessExternalIPVariable passes the external IP address the step detects, none if empty.
+const harnessExternalIPVariable = "WGQ_TEST_HARNESS_EXTERNAL_IP"
+
+// harnessExternalIP is the external IP address of the fake host the harness runs the steps on,
+// unless the scenario sets another one, see harness.externalIP. It is public: the documentation
+// ranges aren't suggested as endpoints, see classifyEndpointAddress.
+const harnessExternalIP = "93.184.216.34"
+
+// harnessHost is the fake Windows host of the harness steps: no Wireguard instance or other
+// program holds a UDP port, and every other query succeeds without output.
+var harnessHost = fakeRule{Match: "Get-NetUDPEndpoint", Result: Result{}}
+
+// TestHarnessCLI is wg-quick-config itself when run by a harness step: main with the arguments of
+// the step, on the fake host of the harness. Replacing newExecutor, externalIPResolver and
+// localAddresses makes the steps independent of the machine and the network the tests run on.
+func TestHarnessCLI(t *testing.T) {
+	encoded, found := os.LookupEnv(harnessArgsVariable)
+	if !found {
+		t.Skip("runs wg-quick-config for the harness scenarios")
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(encoded), &args); err != nil {
+		t.Fatal(err)
+	}
+
+	windowsHost = true
+	newExecutor = func() Executor { return &fakeExecutor{Rules: []fakeRule{harnessHost}} }
+	externalIPResolver = func() (net.IP, string, error) {
+		if ip := net.ParseIP(os.Getenv(harnessExternalIPVariable)); ip != nil {
+			return ip, "the harness", nil
+		}
+		return nil, "", fmt.Errorf("the harness has no external IP address")
+	}
+	localAddresses = func() ([]net.Addr, error) { return nil, nil }
+
+	os.Args = append([]string{"wg-quick-config"}, args...)
+	main()
+	os.Exit(exitOK)
+}
+
+// harness drives wg-quick-config end to end against a temporary profile. Every step runs the
+// test binary as the program, see TestHarnessCLI, with the answers to its questions scripted on
+// stdin, and every successful step is followed by check, so that a step leaving the state, the
+// configuration files and the configurations parsed back from them inconsistent fails the step
+// that did it.
+type harness struct {
+	t          *testing.T
+	configPath string
+	env        []string
+	// externalIP is the external IP address the steps detect, none if empty.
+	externalIP string
+}
+
+// newHarness returns a harness with an empty profile, its profiles root isolated from the host.
+func newHarness(t *testing.T) *harness {
+	root := t.TempDir()
+	configPath := filepath.Join(root, "profile") + string(os.PathSeparator)
+	if err := os.Mkdir(configPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	return &harness{
+		t:          t,
+		configPath: configPath,
+		env:        append(os.Environ(), "XDG_CONFIG_HOME="+root, "HOME="+root, "PROGRAMDATA="+root),
+		externalIP: harnessExternalIP,
+	}
+}
+
+// exec runs a step and returns its output and exit code.
+func (h *harness) exec(input string, args ...string) (string, int) {
+	h.t.Helper()
+	encoded, _ := json.Marshal(append([]string{"-config-path", h.configPath}, args...))
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestHarnessCLI$")
+	cmd.Env = append(h.env, harnessArgsVariable+"="+string(encoded), harnessExternalIPVariable+"="+h.externalIP)
+	cmd.Stdin = strings.NewReader(input)
+	output, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(output), exitErr.ExitCode()
+	} else if err != nil {
+		h.t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+
+	return string(output), exitOK
+}
+
+// run runs a step that must succeed, checks the profile after it and returns its output.
+func (h *harness) run(input string, args ...string) string {
+	h.t.Helper()
+	output, code := h.exec(input, args...)
+	if code != exitOK {
+		h.t.Fatalf("%s exited with %d:\n%s", strings.Join(args, " "), code, output)
+	}
+	h.check(strings.Join(args, " "))
+
+	return output
+}
+
+// fail runs a step that must fail with the exit code and leave the profile consistent, and
+// returns its output.
+func (h *harness) fail(code int, input string, args ...string) string {
+	h.t.Helper()
+	output, got := h.exec(input, args...)
+	if got != code {
+		h.t.Fatalf("%s exited with %d, want %d:\n%s", strings.Join(args, " "), got, code, output)
+	}
+	h.check(strings.Join(args, " "))
+
+	return output
+}
+
+// check verifies the profile after a step with 'fsck --files': the state is deployable, the
+// server peers match the client keys, and every configuration file parses back to what the state
+// generates. On top of it the client addresses and keys must be distinct.
+func (h *harness) check(step string) appConfig {
+	h.t.Helper()
+	if output, code := h.exec("", "fsck", "--files"); code != exitOK {
+		h.t.Fatalf("after %s, fsck --files exited with %d:\n%s", step, code, output)
+	}
+	config := h.load()
+
+	addresses, keys := map[string]int{}, map[string]int{}
+	for i, peer := range config.Server.Peers {
+		for _, allowed := range peer.AllowedIPs {
+			if other, found := addresses[allowed.String()]; found {
+				h.t.Fatalf("after %s, clients %d and %d share the address %s", step, other, i+1, allowed.String())
+			}
+			addresses[allowed.String()] = i + 1
+		}
+		if other, found := keys[peer.PublicKey]; found {
+			h.t.Fatalf("after %s, clients %d and %d share a key", step, other, i+1)
+		}
+		keys[peer.PublicKey] = i + 1
+	}
+
+	return config
+}
+
+// load returns the stored configuration of the profile.
+func (h *harness) load() appConfig {
+	h.t.Helper()
+	config, err := loadAppConfig(h.configPath)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return config
+}
+
+// clientAddress returns the tunnel address of the client with the given one-based number.
+func clientAddress(config appConfig, client int) string {
+	return config.Clients[client-1].Address[0].IP.String()
+}
+
+// addAnswers are the answers to the questions of '-add' for an existing configuration: no
+// metadata.
+const addAnswers = "\n"
+
+func TestScenarioSingleUser(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs wg-quick-config for every step")
+	}
+	h := newHarness(t)
+
+	// The first -add sets up the server: the detected endpoint, a subnet of its own, the default
+	// server file name and the metadata of the first client
+	output := h.run("\n10.20.0.0/24\n\nOwner=alice\n", "-add")
+	config := h.load()
+	endpoint := config.Clients[0].Peers[0].Endpoint
+	if !strings.HasPrefix(endpoint, harnessExternalIP+":") || !strings.Contains(output, "from the harness") {
+		t.Fatalf("endpoint %s, want the detected %s:\n%s", endpoint, harnessExternalIP, output)
+	}
+	if len(config.Clients) != 1 || clientAddress(config, 1) != "10.20.0.2" || config.clientName(0) != "client 1" {
+		t.Fatalf("clients %d, first at %s", len(config.Clients), clientAddress(config, 1))
+	}
+
+	// The client is listed and shown as written
+	if output = h.run("", "list"); !strings.Contains(output, "10.20.0.2") || !strings.Contains(output, "Owner: alice") {
+		t.Errorf("list doesn't show the client:\n%s", output)
+	}
+	if output = h.run("", "show", "1"); !strings.Contains(output, "PrivateKey = "+config.Clients[0].PrivateKey) {
+		t.Errorf("show 1 doesn't show the client configuration:\n%s", output)
+	}
+
+	// The text shown to copy by hand is the client file, with the metadata comments of the client
+	content, err := ioutil.ReadFile(h.configPath + "wsclient_1.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output = h.run("", "-qrcode", "1", "-text"); !strings.Contains(output, string(content)) {
+		t.Errorf("-qrcode 1 -text doesn't show the client file\n%s\nbut:\n%s", content, output)
+	}
+
+	// The device lost its key: rotating it replaces the key, undo brings the previous one back
+	previousKey := config.Clients[0].PrivateKey
+	h.run("y\n", "rotate", "1")
+	if config = h.load(); config.Clients[0].PrivateKey == previousKey {
+		t.Fatal("rotate kept the key")
+	}
+	h.run("y\n", "undo")
+	if config = h.load(); config.Clients[0].PrivateKey != previousKey {
+		t.Fatal("undo didn't restore the key")
+	}
+
+	// Handing the client out
+	handout := filepath.Join(t.TempDir(), "alice.html")
+	h.run("", "export", "handout", "1", "--out", handout)
+	if page, err := ioutil.ReadFile(handout); err != nil || !strings.Contains(string(page), "Address = 10.20.0.2/24") {
+		t.Errorf("the handout doesn't hold the configuration of the client: %v", err)
+	}
+
+	// A generated file that went missing is reported
+	if err := os.Remove(h.configPath + config.serverConfigFile()); err != nil {
+		t.Fatal(err)
+	}
+	if output, code := h.exec("", "fsck", "--files"); code != exitValidation {
+		t.Errorf("fsck --files without the server file exited with %d:\n%s", code, output)
+	}
+}
+
+func TestScenarioBulk(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs wg-quick-config for every step")
+	}
+	h := newHarness(t)
+
+	// 50 clients in a /26, whose 62 host addresses leave room for 11 more
+	h.run("", "provision", "--endpoint", "vpn.example.com:51820", "--subnet", "10.30.0.0/26", "--count", "50")
+	config := h.load()
+	if len(config.Clients) != 50 || clientAddress(config, 50) != "10.30.0.51" {
+		t.Fatalf("provisioned %d clients, the last at %s", len(config.Clients), clientAddress(config, 50))
+	}
+
+	// Removing clients renumbers the ones after them, their files follow
+	removed := []string{clientAddress(config, 7), clientAddress(config, 23), clientAddress(config, 41)}
+	h.run("y\n", "remove", "7,23,41")
+	config = h.load()
+	if len(config.Clients) != 47 || clientAddress(config, 7) != "10.30.0.9" || clientAddress(config, 47) != "10.30.0.51" {
+		t.Fatalf("after removing 3 clients: %d clients, client 7 at %s", len(config.Clients), clientAddress(config, 7))
+	}
+	if _, err := os.Stat(h.configPath + "wsclient_48.conf"); !os.IsNotExist(err) {
+		t.Errorf("the file of the last client number was kept: %v", err)
+	}
+
+	// New clients take the addresses after the last one first, then the freed ones
+	for len(config.Clients) < 58 {
+		h.run(addAnswers, "-quiet", "-add")
+		config = h.load()
+	}
+	if clientAddress(config, 58) != "10.30.0.62" {
+		t.Fatalf("client 58 at %s, want the last host address", clientAddress(config, 58))
+	}
+	for i := 0; i < len(removed); i++ {
+		h.run(addAnswers, "-quiet", "-add")
+	}
+	config = h.load()
+	for i, address := range removed {
+		if got := clientAddress(config, 59+i); got != address {
+			t.Errorf("client %d at %s, want the freed %s", 59+i, got, address)
+		}
+	}
+
+	// The subnet is full now, the next client is refused and nothing changes
+	if output := h.fail(exitConflict, addAnswers, "-quiet", "-add"); !strings.Contains(output, "capacity has been reached") {
+		t.Errorf("adding to a full subnet:\n%s", output)
+	}
+	if config = h.load(); len(config.Clients) != 61 {
+		t.Errorf("%d clients after the refused add, want 61", len(config.Clients))
+	}
+}
+
+func TestScenarioAdopt(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs wg-quick-config for every step")
+	}
+	h := newHarness(t)
+
+	// A server set up by hand, with two peers and no client configurations
+	foreign := filepath.Join(t.TempDir(), "wg0.conf")
+	var server strings.Builder
+	serverKey, _ := newWireguardPrivateKey()
+	fmt.Fprintf(&server, "[Interface]\nPrivateKey = %s\nAddress = 10.40.0.1/24\nListenPort = 51999\n", serverKey.base64PrivateKey())
+	var peerKeys []string
+	for i := 0; i < 2; i++ {
+		peerKey, _ := newWireguardPrivateKey()
+		peerKeys = append(peerKeys, peerKey.base64PublicKey())
+		fmt.Fprintf(&server, "\n# Ticket %d\n[Peer]\nPublicKey = %s\nAllowedIPs = 10.40.0.%d/32\n", i+1,
+			peerKeys[i], i+2)
+	}
+	if err := ioutil.WriteFile(foreign, []byte(server.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The files are left to the next change
+	output := h.run("", "adopt", foreign, "--endpoint", "vpn.example.com:51999")
+	config := h.load()
+	if len(config.Clients) != 2 || config.Server.PrivateKey != serverKey.base64PrivateKey() || config.Server.ListenPort != 51999 {
+		t.Fatalf("adopted %d clients, port %d:\n%s", len(config.Clients), config.Server.ListenPort, output)
+	}
+	if _, err := os.Stat(h.configPath + config.serverConfigFile()); !os.IsNotExist(err) {
+		t.Errorf("adopt wrote %s: %v", config.serverConfigFile(), err)
+	}
+
+	// The adopted server is managed like any other: a new client, a changed client, a removed one
+	h.run(addAnswers, "-quiet", "-add")
+	if config = h.load(); len(config.Clients) != 3 || clientAddress(config, 3) != "10.40.0.4" ||
+		config.Clients[2].Peers[0].Endpoint != "vpn.example.com:51999" {
+		t.Fatalf("added client %d at %s", len(config.Clients), clientAddress(config, len(config.Clients)))
+	}
+	h.run("", "set-client", "3", "mtu=1380")
+	if config = h.load(); config.Clients[2].MTU != 1380 {
+		t.Errorf("client 3 has MTU %d after set-client", config.Clients[2].MTU)
+	}
+	h.run("y\n", "remove", "1")
+	config = h.load()
+	if len(config.Clients) != 2 || config.Server.Peers[0].PublicKey != peerKeys[1] {
+		t.Fatalf("after removing client 1: %d clients, the first isn't the second adopted peer", len(config.Clients))
+	}
+
+	// The comments of the hand-made file stay with their peer in the regenerated server file
+	content, err := ioutil.ReadFile(h.configPath + config.serverConfigFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "# Ticket 1") || !strings.Contains(string(content), "# Ticket 2\n[Peer]\nPublicKey = "+peerKeys[1]) {
+		t.Errorf("the server file lost the comment of the remaining peer:\n%s", content)
+	}
+}
+
+func TestScenarioEndpointDetection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs wg-quick-config for every step")
+	}
+
+	// A detected IPv6 address is suggested in brackets
+	h := newHarness(t)
+	h.externalIP = "2606:4700:10::6816:1"
+	h.run("\n\n\n\n", "-add")
+	config := h.load()
+	if endpoint := config.Clients[0].Peers[0].Endpoint; endpoint != fmt.Sprintf("[%s]:%d", h.externalIP, config.Server.ListenPort) {
+		t.Errorf("endpoint %s, want the detected address in brackets", endpoint)
+	}
+}
+
+func TestScenarioEndpointNotDetected(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs wg-quick-config for every step")
+	}
+
+	// Nothing is accepted without questions when there is no address to suggest
+	for _, flag := range []string{"-quiet", "-yes"} {
+		h := newHarness(t)
+		h.externalIP = ""
+		output, code := h.exec("", flag, "-add")
+		if code != exitUsage || !strings.Contains(output, "no external IP address was detected") {
+			t.Errorf("%s -add without an address exited with %d:\n%s", flag, code, output)
+		}
+		if _, err := os.Stat(h.configPath + defaultAppConfigFile); !os.IsNotExist(err) {
+			t.Errorf("%s -add without an address stored a configuration: %v", flag, err)
+		}
+	}
+
+	// Interactively the endpoint is asked for until one is entered
+	h := newHarness(t)
+	h.externalIP = ""
+	output := h.run("\nvpn.example.com\ny\n\n\n\n", "-add")
+	config := h.load()
+	if endpoint := config.Clients[0].Peers[0].Endpoint; endpoint != fmt.Sprintf("vpn.example.com:%d", config.Server.ListenPort) {
+		t.Errorf("endpoint %s, want the entered one", endpoint)
+	}
+	if strings.Contains(output, "<nil>") || !strings.Contains(output, "Please enter the endpoint") {
+		t.Errorf("the empty answer wasn't asked again:\n%s", output)
+	}
+}
+
+func TestScenarioAddStoreFailure(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs wg-quick-config for every step")
+	}
+	h := newHarness(t)
+	h.run("\n\n\n\n", "-add")
+
+	// A directory in place of a file of the profile can't be written, as if the disk were full
+	for _, test := range []struct {
+		file    string
+		message string
+	}{
+		{defaultSummaryJsonFile, "failed to store the application configuration"},
+		{defaultAuditLogFile, "failed to write the audit log"},
+	} {
+		if err := os.Remove(h.configPath + test.file); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(h.configPath+test.file, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if output, code := h.exec(addAnswers, "-add"); code != exitFailure || !strings.Contains(output, test.message) {
+			t.Errorf("-add without %s exited with %d:\n%s", test.file, code, output)
+		}
+		if err := os.Remove(h.configPath + test.file); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScenarioApplyStoreFailure(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs wg-quick-config for every step")
+	}
+	h := newHarness(t)
+	h.run("\n\n\n\n", "-add")
+	h.run(addAnswers, "-apply=false", "-add")
+
+	if err := os.Remove(h.configPath + defaultAuditLogFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(h.configPath+defaultAuditLogFile, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if output, code := h.exec("", "apply"); code != exitFailure || !strings.Contains(output, "failed to write the audit log") {
+		t.Errorf("apply without the audit log exited with %d:\n%s", code, output)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultHistoryFile = "config_history_%d.json.gz"
+const maxHistorySnapshots = 10
+
+// stateSnapshot is a compressed copy of config.json taken right before a mutating operation
+// replaced it. Restoring the snapshot undoes that operation.
+type stateSnapshot struct {
+	Time      time.Time
+	Operation string
+	// SideEffects is set when the operation also touched the live tunnel or the system, which is
+	// not reverted by restoring the snapshot.
+	SideEffects bool
+	Config      appConfig
+}
+
+// snapshotFile describes a snapshot stored in the configuration directory.
+type snapshotFile struct {
+	name string
+	id   int64
+}
+
+// listSnapshotFiles returns the snapshots stored in the configuration directory, newest first.
+func listSnapshotFiles(configPath string) ([]snapshotFile, error) {
+	entries, err := ioutil.ReadDir(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []snapshotFile
+	for _, entry := range entries {
+		var id int64
+		if _, err := fmt.Sscanf(entry.Name(), defaultHistoryFile, &id); err == nil &&
+			entry.Name() == fmt.Sprintf(defaultHistoryFile, id) {
+			snapshots = append(snapshots, snapshotFile{name: entry.Name(), id: id})
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].id > snapshots[j].id })
+	return snapshots, nil
+}
+
+// readSnapshot reads and decompresses a snapshot from the configuration directory.
+func readSnapshot(configPath string, file snapshotFile) (stateSnapshot, error) {
+	var snapshot stateSnapshot
+
+	f, err := os.Open(configPath + file.name)
+	if err != nil {
+		return snapshot, err
+	}
+	defer f.Close()
+
+	reader, err := gzip.NewReader(f)
+	if err != nil {
+		return snapshot, err
+	}
+	defer reader.Close()
+
+	err = json.NewDecoder(reader).Decode(&snapshot)
+	return snapshot, err
+}
+
+// writeSnapshot compresses the snapshot into a new file in the configuration directory and drops
+// the oldest snapshots beyond maxHistorySnapshots.
+func writeSnapshot(configPath string, snapshot stateSnapshot) error {
+	fileName := configPath + fmt.Sprintf(defaultHistoryFile, snapshot.Time.UnixNano())
+
+	var content bytes.Buffer
+	writer := gzip.NewWriter(&content)
+	err := json.NewEncoder(writer).Encode(snapshot)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = writeFileAtomic(fileName, content.Bytes(), 0600)
+	}
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := listSnapshotFiles(configPath)
+	if err != nil {
+		return err
+	}
+	for i := maxHistorySnapshots; i < len(snapshots); i++ {
+		os.Remove(configPath + snapshots[i].name)
+	}
+
+	return nil
+}
+
+// saveWithHistory stores the application configuration like save, but first keeps a snapshot of
+// the configuration it replaces so that the operation can be reverted with 'undo'. A staged
+// operation is recorded as unapplied, see stageChange.
+//
+// Parameters:
+//     configPath (string): The configuration directory holding config.json.
+//     operation (string): The name of the mutating operation, shown by 'history --state'.
+//     sideEffects (bool): Whether the operation also touched the live tunnel or the system.
+//
+// Returns:
+//     error: An error object indicating any errors that occurred while storing the configuration.
+//
+// Usage:
+//     err := config.saveWithHistory(configPath, "add", false)
+func (config *appConfig) saveWithHistory(configPath string, operation string, sideEffects bool) error {
+	previous, err := loadAppConfig(configPath)
+	if err == nil {
+		err = writeSnapshot(configPath, stateSnapshot{
+			Time:        time.Now(),
+			Operation:   operation,
+			SideEffects: sideEffects,
+			Config:      previous,
+		})
+		if err != nil {
+			fmt.Println("Failed to keep a snapshot of the previous configuration:", err)
+		}
+		if config.staged() {
+			if err = config.stageChange(configPath, operation, previous); err != nil {
+				return err
+			}
+		}
+	}
+
+	return config.save(configPath)
+}
+
+// runUndoCommand implements the 'undo' command, which restores the configuration saved before the
+// last mutating operation and regenerates the configuration files to match it.
+func runUndoCommand(configPath string, args []string) error {
+	if len(args) != 0 {
+		return newError(errUsage, "usage: undo")
+	}
+
+	snapshots, err := listSnapshotFiles(configPath)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return newError(errValidation, "there is no operation to undo")
+	}
+
+	snapshot, err := readSnapshot(configPath, snapshots[0])
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %s: %w", snapshots[0].name, err)
+	}
+
+	current, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	// The snapshot may predate an upgrade of the tool, it is restored in the current schema
+	config := snapshot.Config
+	if err = migrateAppConfig(&config); err != nil {
+		return fmt.Errorf("failed to restore snapshot %s: %w", snapshots[0].name, err)
+	}
+	if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+		return err
+	}
+	if len(config.Unapplied) > 0 && len(current.Unapplied) == 0 {
+		// Undoing 'discard' or 'apply' stages the changes again, the current files are the applied ones
+		if content, err := ioutil.ReadFile(configPath + defaultAppConfigFile); err == nil {
+			writeFileAtomic(configPath+appliedStateFile, content, 0600)
+		}
+	}
+
+	// Client files beyond the restored clients still hold the private keys of undone clients
+	for i := len(config.Clients); i < len(current.Clients); i++ {
+		fileName := configPath + fmt.Sprintf(defaultClientConfigFile, i+1)
+		if err = secureDelete(fileName); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %s of an undone client: %w", fileName, err)
+		}
+	}
+
+	if err = config.save(configPath); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+	os.Remove(configPath + snapshots[0].name)
+	if !config.staged() {
+		// The files were regenerated, nothing staged is left
+		os.Remove(configPath + appliedStateFile)
+	}
+
+	fmt.Printf("Undone '%s' from %s.\n", snapshot.Operation, snapshot.Time.Format(time.RFC1123))
+	if snapshot.SideEffects {
+		fmt.Println("Warning: the undone operation also changed the running tunnel, which is not reverted " +
+			"automatically. Use -restart to apply the restored configuration.")
+	}
+
+	return appendAuditLog(configPath, "undo", map[string]interface{}{
+		"Operation": snapshot.Operation,
+		"Time":      snapshot.Time,
+	})
+}
+
+// runHistoryCommand implements the 'history' command, which prints the audit log, or with
+// --state the snapshots available to 'undo'.
+func runHistoryCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	state := flags.Bool("state", false, "List the configuration snapshots available to undo")
+
+	if err := parseFlags(flags, "history", args); err != nil {
+		return err
+	}
+
+	if *state {
+		snapshots, err := listSnapshotFiles(configPath)
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			fmt.Println("There are no configuration snapshots.")
+		}
+
+		for i, file := range snapshots {
+			snapshot, err := readSnapshot(configPath, file)
+			if err != nil {
+				fmt.Printf("%2d. %s: unreadable (%s)\n", i+1, file.name, err)
+				continue
+			}
+			fmt.Printf("%2d. %s  before '%s' (%d clients)\n", i+1,
+				snapshot.Time.Format(time.RFC1123), snapshot.Operation, len(snapshot.Config.Clients))
+		}
+		return nil
+	}
+
+	f, err := os.Open(configPath + defaultAuditLogFile)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("The audit log is empty.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record auditRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		details, _ := json.Marshal(record.Details)
+		fmt.Printf("%s  %s %s\n", record.Time.Format(time.RFC1123), record.Operation,
+			strings.TrimSuffix(string(details), "null"))
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	externalip "github.com/glendc/go-external-ip"
+)
+
+// httpTimeout bounds every outbound HTTP request, including reading the response.
+const httpTimeout = 15 * time.Second
+
+// Special values of the -proxy option, any other value is the URL of the proxy.
+const (
+	// proxySystem uses the proxy configured in Windows, see systemProxy.
+	proxySystem = "system"
+	// proxyNone connects directly, ignoring HTTP_PROXY and HTTPS_PROXY.
+	proxyNone = "none"
+)
+
+var (
+	sharedHttpClient     *http.Client
+	sharedHttpClientOnce sync.Once
+)
+
+// httpClient returns the client of all the outbound HTTP requests of the tool, the external IP
+// detection and the DDNS provider APIs, so that they share the proxy, timeout and TLS settings.
+// The proxy is taken from -proxy: by default from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables, with -proxy system from the Windows settings and with -proxy none
+// nowhere.
+//
+// Usage:
+//     response, err := httpClient().Do(request)
+func httpClient() *http.Client {
+	sharedHttpClientOnce.Do(func() {
+		transport := &http.Transport{
+			Proxy:               proxyFunc(proxySetting),
+			DialContext:         (&net.Dialer{Timeout: httpTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+			TLSHandshakeTimeout: httpTimeout,
+			IdleConnTimeout:     30 * time.Second,
+		}
+		sharedHttpClient = &http.Client{Timeout: httpTimeout, Transport: transport}
+	})
+
+	return sharedHttpClient
+}
+
+// proxyFunc returns the proxy selection of the transport for a -proxy value.
+func proxyFunc(setting string) func(*http.Request) (*url.URL, error) {
+	switch strings.ToLower(strings.TrimSpace(setting)) {
+	case "":
+		return http.ProxyFromEnvironment
+	case proxyNone:
+		return nil
+	case proxySystem:
+		proxy := systemProxy()
+		if proxy == "" {
+			return http.ProxyFromEnvironment
+		}
+		setting = proxy
+	}
+
+	proxyUrl, err := parseProxyUrl(setting)
+	return func(*http.Request) (*url.URL, error) {
+		return proxyUrl, err
+	}
+}
+
+// proxyInUse returns the proxy httpClient sends a request for the URL through, empty when it
+// connects directly, for error messages.
+func proxyInUse(requestUrl string) string {
+	request, err := http.NewRequest(http.MethodGet, requestUrl, nil)
+	proxy := httpClient().Transport.(*http.Transport).Proxy
+	if err != nil || proxy == nil {
+		return ""
+	}
+	if proxyUrl, err := proxy(request); err == nil && proxyUrl != nil {
+		return proxyUrl.Redacted()
+	}
+
+	return ""
+}
+
+// checkProxySetting validates the value of -proxy, so that an invalid proxy fails right away
+// rather than every request.
+func checkProxySetting(setting string) error {
+	switch strings.ToLower(strings.TrimSpace(setting)) {
+	case "", proxyNone, proxySystem:
+		return nil
+	}
+	_, err := parseProxyUrl(setting)
+
+	return err
+}
+
+// parseProxyUrl parses a proxy given as URL or as host:port, which is an HTTP proxy.
+func parseProxyUrl(proxy string) (*url.URL, error) {
+	proxy = strings.TrimSpace(proxy)
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyUrl, err := url.Parse(proxy)
+	if err != nil || proxyUrl.Host == "" {
+		return nil, newError(errUsage, "invalid proxy '%s', expected a URL such as http://proxy.example.com:8080, system or none", proxy)
+	}
+
+	return proxyUrl, nil
+}
+
+// systemProxy returns the proxy configured in Windows, the Internet Options proxy of the user if
+// enabled, otherwise the WinHTTP proxy set with 'netsh winhttp set proxy', empty if there is none.
+// Proxy auto-configuration scripts aren't evaluated.
+func systemProxy() string {
+	if runtime.GOOS != "windows" {
+		return ""
+	}
+
+	script := `$settings = Get-ItemProperty 'HKCU:\Software\Microsoft\Windows\CurrentVersion\Internet Settings' -ErrorAction SilentlyContinue
+		if ($settings.ProxyEnable -eq 1 -and $settings.ProxyServer) {
+			$settings.ProxyServer
+		} else {
+			netsh winhttp show proxy | Select-String -Pattern 'Proxy Server\(s\)\s*:\s*(\S+)' |
+				ForEach-Object { $_.Matches[0].Groups[1].Value }
+		}`
+	result := newExecutor().Execute(context.Background(), script)
+	if result.Err != nil {
+		return ""
+	}
+
+	return selectProxyServer(strings.TrimSpace(result.StdOut))
+}
+
+// selectProxyServer picks the proxy of HTTPS requests from a Windows proxy setting, which is either
+// a single host:port or per protocol, e.g. "http=proxy:8080;https=proxy:8443".
+func selectProxyServer(setting string) string {
+	if !strings.Contains(setting, "=") {
+		return setting
+	}
+
+	servers := make(map[string]string)
+	for _, entry := range strings.Split(setting, ";") {
+		if protocol, server, found := strings.Cut(strings.TrimSpace(entry), "="); found {
+			servers[strings.ToLower(protocol)] = server
+		}
+	}
+	if servers["https"] != "" {
+		return servers["https"]
+	}
+
+	return servers["http"]
+}
+
+// httpIPSource is a source of the external IP address consensus that asks a web service through
+// httpClient, unlike the sources of the externalip package, which ignore any proxy.
+type httpIPSource struct {
+	url string
+}
+
+// IP implements externalip.Source. The timeout of httpClient applies, and the IP protocol can't
+// be chosen through a proxy, so both parameters are ignored.
+func (source httpIPSource) IP(timeout time.Duration, logger *log.Logger, protocol uint) (net.IP, error) {
+	request, err := http.NewRequest(http.MethodGet, source.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", "wg-quick-config")
+
+	response, err := httpClient().Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", request.URL.Host, response.Status)
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(content)))
+	if ip == nil {
+		return nil, fmt.Errorf("%s answered no IP address", request.URL.Host)
+	}
+
+	return ip, nil
+}
+
+// externalIPConsensus returns the consensus of public IP services detectExternalIP asks, the same
+// services and weights as externalip.DefaultConsensus, reached through httpClient. Services
+// protected by TLS get more weight.
+func externalIPConsensus() *externalip.Consensus {
+	consensus := externalip.NewConsensus(&externalip.ConsensusConfig{Timeout: httpTimeout}, nil)
+
+	consensus.AddVoter(httpIPSource{"https://icanhazip.com/"}, 3)
+	consensus.AddVoter(httpIPSource{"https://myexternalip.com/raw"}, 3)
+
+	consensus.AddVoter(httpIPSource{"http://ifconfig.io/ip"}, 1)
+	consensus.AddVoter(httpIPSource{"http://checkip.amazonaws.com/"}, 1)
+	consensus.AddVoter(httpIPSource{"http://ident.me/"}, 1)
+	consensus.AddVoter(httpIPSource{"http://whatismyip.akamai.com/"}, 1)
+	consensus.AddVoter(httpIPSource{"http://myip.dnsomatic.com/"}, 1)
+	consensus.AddVoter(httpIPSource{"http://diagnostic.opendns.com/myip"}, 1)
+
+	return consensus
+}
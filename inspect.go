@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// inspectPeer describes a [Peer] section, as printed by 'inspect'.
+type inspectPeer struct {
+	PublicKey           string
+	AllowedIPs          string
+	Endpoint            string   `json:",omitempty"`
+	PersistentKeepalive uint32   `json:",omitempty"`
+	Comments            []string `json:",omitempty"`
+}
+
+// inspectResult describes a Wireguard configuration file, as printed by 'inspect'. It never holds
+// the private key, only the public key derived from it.
+type inspectResult struct {
+	File       string
+	PublicKey  string
+	Address    string
+	ListenPort uint16   `json:",omitempty"`
+	DNS        string   `json:",omitempty"`
+	MTU        uint16   `json:",omitempty"`
+	Junk       string   `json:",omitempty"`
+	PostUp     []string `json:",omitempty"`
+	PostDown   []string `json:",omitempty"`
+	Peers      []inspectPeer
+}
+
+// newInspectResult summarizes a parsed configuration read from the given file.
+func newInspectResult(file string, wc WireguardConfig) inspectResult {
+	result := inspectResult{
+		File:       file,
+		PublicKey:  "(none, external key)",
+		Address:    joinIPNets(wc.Address),
+		ListenPort: wc.ListenPort,
+		DNS:        wc.DNS.String(),
+		MTU:        wc.MTU,
+		PostUp:     wc.PostUp,
+		PostDown:   wc.PostDown,
+		Peers:      make([]inspectPeer, 0, len(wc.Peers)),
+	}
+	if publicKey, err := base64PublicKeyFromPrivate(wc.PrivateKey); err == nil {
+		result.PublicKey = publicKey
+	}
+	if wc.Jc != 0 {
+		result.Junk = wc.junkString()
+	}
+
+	for _, peer := range wc.Peers {
+		result.Peers = append(result.Peers, inspectPeer{
+			PublicKey:           peer.PublicKey,
+			AllowedIPs:          joinIPNets(peer.AllowedIPs),
+			Endpoint:            peer.Endpoint,
+			PersistentKeepalive: peer.PersistentKeepalive,
+			Comments:            peer.Comments,
+		})
+	}
+
+	return result
+}
+
+// String returns the summary as printed by 'inspect': the interface settings followed by a table
+// of the peers.
+func (result inspectResult) String() string {
+	text := fmt.Sprintf("File:        %s\nPublic key:  %s\nAddress:     %s\n", result.File, result.PublicKey, result.Address)
+	if result.ListenPort != 0 {
+		text += fmt.Sprintf("Listen port: %d\n", result.ListenPort)
+	}
+	if result.DNS != "" {
+		text += fmt.Sprintf("DNS:         %s\n", result.DNS)
+	}
+	if result.MTU != 0 {
+		text += fmt.Sprintf("MTU:         %d\n", result.MTU)
+	}
+	if result.Junk != "" {
+		text += fmt.Sprintf("Junk:        %s\n", result.Junk)
+	}
+	for _, command := range result.PostUp {
+		text += fmt.Sprintf("PostUp:      %s\n", command)
+	}
+	for _, command := range result.PostDown {
+		text += fmt.Sprintf("PostDown:    %s\n", command)
+	}
+
+	text += fmt.Sprintf("\n%d peers:\n", len(result.Peers))
+	if len(result.Peers) > 0 {
+		text += fmt.Sprintf("%3s  %-44s  %-24s  %-22s  %s\n", "#", "Public key", "Allowed IPs", "Endpoint", "Keepalive")
+	}
+	for i, peer := range result.Peers {
+		keepalive := "-"
+		if peer.PersistentKeepalive != 0 {
+			keepalive = fmt.Sprintf("%ds", peer.PersistentKeepalive)
+		}
+		endpoint := peer.Endpoint
+		if endpoint == "" {
+			endpoint = "-"
+		}
+		line := fmt.Sprintf("%3d  %-44s  %-24s  %-22s  %s", i+1, peer.PublicKey, peer.AllowedIPs, endpoint, keepalive)
+		if len(peer.Comments) > 0 {
+			line += "  # " + strings.Join(peer.Comments, "; ")
+		}
+		text += line + "\n"
+	}
+
+	return text
+}
+
+// runInspectCommand implements the 'inspect' command, which parses an existing Wireguard
+// configuration file, e.g. one inherited from another tool, and prints a summary of its interface
+// and peers without changing anything:
+//
+//     inspect C:\wireguard\wg0.conf
+//
+// The private key is never printed, only the public key derived from it. Files that don't parse
+// are reported with the line of the first problem, see ParseWireguardConfig.
+func runInspectCommand(configPath string, args []string) error {
+	if len(args) != 1 {
+		return newError(errUsage, "usage: inspect <file>")
+	}
+
+	wc, _, err := readWireguardConfigFile(args[0], parseStrict)
+	if err != nil {
+		return err
+	}
+
+	result := newInspectResult(args[0], wc)
+	printResult(result.String(), result)
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Ranges accepted for the junk packet parameters of AmneziaWG.
+const (
+	maxJunkCount = 128
+	maxJunkSize  = 1280
+)
+
+// randomJunkBetween returns a random number in [low, high].
+func randomJunkBetween(low int, high int) uint16 {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(high-low+1)))
+	if err != nil {
+		return uint16(low)
+	}
+
+	return uint16(low + int(n.Int64()))
+}
+
+// randomJunkParameters returns randomized junk packet parameters within conservative ranges:
+// 3 to 10 packets of 40 to 70 bytes minimum and up to 250 bytes more maximum. Every client gets
+// its own values, so there is no fixed pattern for a censor to match.
+func randomJunkParameters() (jc uint16, jmin uint16, jmax uint16) {
+	jc = randomJunkBetween(3, 10)
+	jmin = randomJunkBetween(40, 70)
+	jmax = jmin + randomJunkBetween(50, 250)
+
+	return jc, jmin, jmax
+}
+
+// validateJunkParameters checks the junk packet parameters: Jc between 1 and 128 and
+// 0 <= Jmin < Jmax <= 1280. All zero means junk packets are disabled.
+func validateJunkParameters(jc uint16, jmin uint16, jmax uint16) error {
+	if jc == 0 && jmin == 0 && jmax == 0 {
+		return nil
+	}
+	if jc < 1 || jc > maxJunkCount {
+		return newError(errValidation, "invalid Jc %d, expected a number between 1 and %d", jc, maxJunkCount)
+	}
+	if jmin >= jmax || jmax > maxJunkSize {
+		return newError(errValidation, "invalid Jmin %d and Jmax %d, expected 0 <= Jmin < Jmax <= %d",
+			jmin, jmax, maxJunkSize)
+	}
+
+	return nil
+}
+
+// parseJunkSetting parses the value of the 'junk' setting: "true" for randomized parameters,
+// "false" to disable junk packets, or explicit "Jc,Jmin,Jmax" values.
+//
+// Parameters:
+//     value (string): The setting value.
+//
+// Returns:
+//     uint16, uint16, uint16: The Jc, Jmin and Jmax parameters, all zero when disabled.
+//     error: A validation error for an invalid value or out of range parameters.
+//
+// Usage:
+//     jc, jmin, jmax, err := parseJunkSetting("5,40,120")
+func parseJunkSetting(value string) (uint16, uint16, uint16, error) {
+	value = strings.TrimSpace(value)
+	switch value {
+	case "true":
+		jc, jmin, jmax := randomJunkParameters()
+		return jc, jmin, jmax, nil
+	case "false":
+		return 0, 0, 0, nil
+	}
+
+	tokens := strings.Split(value, ",")
+	if len(tokens) != 3 {
+		return 0, 0, 0, newError(errValidation, "invalid junk setting '%s', expected true, false or Jc,Jmin,Jmax", value)
+	}
+	var parameters [3]uint16
+	for i, token := range tokens {
+		n, err := strconv.ParseUint(strings.TrimSpace(token), 10, 16)
+		if err != nil {
+			return 0, 0, 0, newError(errValidation, "invalid junk setting '%s', expected true, false or Jc,Jmin,Jmax", value)
+		}
+		parameters[i] = uint16(n)
+	}
+
+	return parameters[0], parameters[1], parameters[2], validateJunkParameters(parameters[0], parameters[1], parameters[2])
+}
+
+// junkString returns the "Jc,Jmin,Jmax" value of the interface, or "false" if junk packets are
+// disabled.
+func (iface Interface) junkString() string {
+	if iface.Jc == 0 {
+		return "false"
+	}
+
+	return strconv.Itoa(int(iface.Jc)) + "," + strconv.Itoa(int(iface.Jmin)) + "," + strconv.Itoa(int(iface.Jmax))
+}
@@ -50,3 +50,19 @@ func (sk *WireguardPrivateKey) base64PublicKey() (pks string) {
 	pks = base64.StdEncoding.EncodeToString(pk[:])
 	return
 }
+
+// base64PublicKeyFromPrivate derives the base64 encoded public key from a base64 encoded private key.
+func base64PublicKeyFromPrivate(privateKey string) (string, error) {
+	var sk WireguardPrivateKey
+
+	decoded, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", err
+	}
+	if len(decoded) != WireguardPrivateKeySize {
+		return "", newError(errValidation, "invalid private key size")
+	}
+
+	copy(sk[:], decoded)
+	return sk.base64PublicKey(), nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// setClientExpiry sets when the new client with the given zero-based index expires, from the
+// expiry default of its group layered on top of the instance defaults, see defaultsForGroup.
+// Without an expiry default the client doesn't expire.
+//
+// Parameters:
+//     index (int): The zero-based index of the client.
+//     now (time.Time): When the client was created.
+//
+// Usage:
+//     config.setClientExpiry(len(config.Clients)-1, time.Now())
+func (config *appConfig) setClientExpiry(index int, now time.Time) {
+	info := config.clientInfo(index)
+	info.Expires = nil
+	if days := config.defaultsForGroup(info.Group).ExpiryDays; days > 0 {
+		expires := now.AddDate(0, 0, days).UTC()
+		info.Expires = &expires
+	}
+}
+
+// expired reports whether the client is past its expiry date at the given time.
+func (info *clientInfo) expired(now time.Time) bool {
+	return info.Expires != nil && !now.Before(*info.Expires)
+}
+
+// expiredClients returns the zero-based indexes of the clients past their expiry date.
+func (config *appConfig) expiredClients(now time.Time) []int {
+	var expired []int
+	for i := range config.Clients {
+		if config.clientInfo(i).expired(now) {
+			expired = append(expired, i)
+		}
+	}
+
+	return expired
+}
+
+// expiryWarnings returns a warning per expired client, which the server keeps accepting until the
+// client is removed.
+func (config *appConfig) expiryWarnings(now time.Time) []string {
+	var warnings []string
+	for _, index := range config.expiredClients(now) {
+		warnings = append(warnings, fmt.Sprintf("client %d expired on %s but is still accepted by the server, "+
+			"remove it with 'remove %d' or 'remove --expired'", index+1,
+			config.clientInfo(index).Expires.Local().Format("2006-01-02"), index+1))
+	}
+
+	return warnings
+}
+
+// selectClients returns the zero-based indexes of the clients a group-wide operation applies to,
+// in ascending order: the clients of the selection, e.g. "2,3", the members of the group, or the
+// expired clients. Exactly one of them must be given.
+//
+// Parameters:
+//     selection (string): A comma-separated list of client numbers, see parseClientSelection.
+//     group (string): The name of a group, see groupMembers.
+//     expired (bool): Whether to select the expired clients, see expiredClients.
+//
+// Returns:
+//     []int: The selected clients.
+//     error: A usage error if no or several selections are given or nothing is selected, a
+//         validation error if the group doesn't exist.
+//
+// Usage:
+//     selected, err := config.selectClients("", "contractors", false)
+func (config *appConfig) selectClients(selection string, group string, expired bool) ([]int, error) {
+	selections := 0
+	for _, given := range []bool{selection != "", group != "", expired} {
+		if given {
+			selections++
+		}
+	}
+	if selections != 1 {
+		return nil, newError(errUsage, "exactly one of a client list, --group or --expired must be given")
+	}
+
+	var selected []int
+	switch {
+	case group != "":
+		if config.findGroup(group) == nil {
+			return nil, newError(errValidation, "group '%s' does not exist, existing groups: %s", group,
+				strings.Join(config.groupNames(), ", "))
+		}
+		if selected = config.groupMembers(group); len(selected) == 0 {
+			return nil, newError(errUsage, "group '%s' has no clients", group)
+		}
+	case expired:
+		if selected = config.expiredClients(time.Now()); len(selected) == 0 {
+			return nil, newError(errUsage, "no client has expired")
+		}
+	default:
+		indexes, err := config.parseClientSelection(selection)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[int]bool)
+		for _, index := range indexes {
+			if !seen[index] {
+				seen[index] = true
+				selected = append(selected, index)
+			}
+		}
+		sort.Ints(selected)
+	}
+
+	return selected, nil
+}
+
+// confirmClients lists the clients an operation affects and asks to confirm it.
+func (config *appConfig) confirmClients(selected []int, question string) bool {
+	entries := config.clientEntries()
+	for _, index := range selected {
+		fmt.Print(formatClientEntries(entries[index : index+1]))
+	}
+
+	return askConfirmation(fmt.Sprintf(question, len(selected)))
+}
+
+// parseSelectionFlags parses the arguments of the commands taking a client list or the --group
+// and --expired flags, e.g. "2,3" or "--group contractors".
+func parseSelectionFlags(name string, args []string) (string, string, bool, error) {
+	usage := newError(errUsage, "usage: %s <client>[,<client>...] | --group name | --expired", name)
+	selection := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		selection, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	group := flags.String("group", "", "Select the clients of this group")
+	expired := flags.Bool("expired", false, "Select the clients past their expiry date")
+	if err := parseFlags(flags, name, args); err != nil {
+		return "", "", false, err
+	}
+	if flags.NArg() != 0 {
+		return "", "", false, usage
+	}
+
+	return selection, *group, *expired, nil
+}
+
+// removeClients deletes the clients with the given zero-based indexes, given in ascending order,
+// together with their server peers and metadata. The clients after a removed one move up and are
+// renumbered, their configuration files are rewritten by the caller.
+func (config *appConfig) removeClients(selected []int) {
+	// Extends the metadata of configurations created before it was introduced
+	config.clientInfo(0)
+	for i := len(selected) - 1; i >= 0; i-- {
+		index := selected[i]
+		config.Clients = append(config.Clients[:index], config.Clients[index+1:]...)
+		config.ClientsInfo = append(config.ClientsInfo[:index], config.ClientsInfo[index+1:]...)
+		if index < len(config.Server.Peers) {
+			config.Server.Peers = append(config.Server.Peers[:index], config.Server.Peers[index+1:]...)
+		}
+	}
+}
+
+// runRemoveCommand implements the 'remove' command, which removes clients from the server after
+// confirming the list of affected clients:
+//
+//     remove 3
+//     remove 2,5
+//     remove --group old-laptops
+//     remove --expired
+//
+// The clients after a removed one are renumbered and their configuration files rewritten, the
+// files left over at the end are zeroized and deleted, see secureDelete. At least one client has
+// to remain, new clients are derived from the last one. Pinned clients can't be renumbered, since
+// their frozen files would no longer match their numbers; unpin them first. 'undo' brings the
+// removed clients back.
+func runRemoveCommand(configPath string, args []string) error {
+	selection, group, expired, err := parseSelectionFlags("remove", args)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	selected, err := config.selectClients(selection, group, expired)
+	if err != nil {
+		return err
+	}
+	if len(selected) == len(config.Clients) {
+		return newError(errValidation, "can't remove every client, new clients are derived from the last remaining one")
+	}
+	removed := make(map[int]bool)
+	for _, index := range selected {
+		removed[index] = true
+	}
+	for i := selected[0] + 1; i < len(config.Clients); i++ {
+		if !removed[i] && config.isPinned(i) {
+			return newError(errValidation, "client %d is pinned and would be renumbered, unpin it first with 'pin %d --unpin'",
+				i+1, i+1)
+		}
+	}
+
+	fmt.Println("Clients to remove:")
+	if !config.confirmClients(selected, "Remove these %d clients from the server?") {
+		fmt.Println("No changes applied.")
+		return nil
+	}
+
+	var numbers, publicKeys []string
+	for _, index := range selected {
+		numbers = append(numbers, fmt.Sprint(index+1))
+		if index < len(config.Server.Peers) {
+			publicKeys = append(publicKeys, keyFingerprint(config.Server.Peers[index].PublicKey))
+		}
+	}
+	count := len(config.Clients)
+	config.removeClients(selected)
+
+	if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+		return err
+	}
+	if !config.staged() {
+		// The files left over at the end hold the private keys of clients that moved up or are gone
+		for i := len(config.Clients); i < count; i++ {
+			fileName := fmt.Sprintf(defaultClientConfigFile, i+1)
+			if err = secureDelete(configPath + fileName); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("can't delete %s: %w", fileName, err)
+			}
+			delete(config.FileHashes, fileName)
+		}
+		for i := selected[0]; i < count; i++ {
+			deleteBundleImages(configPath, i)
+		}
+	}
+
+	if err = config.saveWithHistory(configPath, "remove", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+	fmt.Printf("Removed %d clients: %s.\n", len(selected), strings.Join(numbers, ", "))
+	if selected[0] < len(config.Clients) {
+		fmt.Printf("The clients after client %d were renumbered, see 'list'.\n", selected[0]+1)
+	}
+
+	return appendAuditLog(configPath, "remove", map[string]interface{}{"Clients": numbers, "PublicKeys": publicKeys})
+}
+
+// runRotateCommand implements the 'rotate' command, which gives clients new keys after confirming
+// the list of affected clients, e.g. when the devices of a group may have been compromised:
+//
+//     rotate 3
+//     rotate --group contractors
+//     rotate --expired
+//
+// The server peers get the new public keys, so the old configurations stop connecting once the
+// server configuration is loaded, and the devices have to be provisioned again: their status goes
+// back to issued. Clients with an external key can only be rotated on the device and pinned
+// clients would keep their frozen files, both are skipped.
+func runRotateCommand(configPath string, args []string) error {
+	selection, group, expired, err := parseSelectionFlags("rotate", args)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	candidates, err := config.selectClients(selection, group, expired)
+	if err != nil {
+		return err
+	}
+	var selected []int
+	for _, index := range candidates {
+		switch {
+		case config.Clients[index].PrivateKey == "":
+			fmt.Printf("Skipped: client %d has an external key, which can only be rotated on the device, "+
+				"see 'set-client %d publickey=...'\n", index+1, index+1)
+		case config.isPinned(index):
+			fmt.Printf("Skipped: client %d is pinned, unpin it first with 'pin %d --unpin'\n", index+1, index+1)
+		case index >= len(config.Server.Peers):
+			fmt.Printf("Skipped: client %d has no server peer, run 'fsck --repair'\n", index+1)
+		default:
+			selected = append(selected, index)
+		}
+	}
+	if len(selected) == 0 {
+		return newError(errValidation, "none of the selected clients can be rotated")
+	}
+
+	fmt.Println("Clients to rotate:")
+	if !config.confirmClients(selected, "Give these %d clients new keys?") {
+		fmt.Println("No changes applied.")
+		return nil
+	}
+
+	var changes []fieldChange
+	now := time.Now()
+	for _, index := range selected {
+		key, err := newWireguardPrivateKey()
+		if err != nil {
+			return err
+		}
+		oldKey := config.Server.Peers[index].PublicKey
+		config.Clients[index].PrivateKey = key.base64PrivateKey()
+		config.Server.Peers[index].PublicKey = key.base64PublicKey()
+		changes = append(changes, fieldChange{Client: index + 1, Field: "publickey", Before: keyFingerprint(oldKey),
+			After: keyFingerprint(config.Server.Peers[index].PublicKey)})
+
+		// The device has to get the new configuration, unlike recordStatus the status moves back
+		info := config.clientInfo(index)
+		info.Provisioning = append(info.Provisioning, statusTransition{Status: statusIssued, Via: "key rotated",
+			Time: now.UTC()})
+		if !config.staged() {
+			zeroizeFile(configPath + fmt.Sprintf(defaultClientConfigFile, index+1))
+			deleteBundleImages(configPath, index)
+		}
+	}
+
+	if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+		return err
+	}
+	if err = config.saveWithHistory(configPath, "rotate", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+	fmt.Printf("Rotated the keys of %d clients. Hand out their new configurations, e.g. with 'export handout', "+
+		"and restart the server with -restart to drop the old keys.\n", len(selected))
+
+	return appendAuditLog(configPath, "rotate", changes)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// isolateProfiles moves the profiles root of the test into a new directory, so that the profiles
+// of this host don't take part in the checks across profiles, see checkArtifactCollisions.
+func isolateProfiles(t *testing.T) {
+	t.Helper()
+	root := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", root)
+	t.Setenv("HOME", root)
+	t.Setenv("PROGRAMDATA", root)
+}
+
+// newTestProfile writes a profile with the given number of clients into a new directory, from the
+// current schema fixture without its staged operations, file encryption and pinned clients.
+func newTestProfile(t *testing.T, clients int) (appConfig, string) {
+	t.Helper()
+	isolateProfiles(t)
+	config, configPath, err := loadFixture(t, fmt.Sprintf("schema-%d.json", stateSchemaVersion-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Unapplied, config.ClientFileEncryption = nil, nil
+	for i := range config.ClientsInfo {
+		config.ClientsInfo[i].Pinned = false
+	}
+	for len(config.Clients) < clients {
+		if err = config.addClient(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+		t.Fatal(err)
+	}
+	if err = config.save(configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	return config, configPath
+}
+
+// answer makes the confirmations of the test answer yes or no.
+func answer(t *testing.T, yes bool) {
+	t.Helper()
+	previousYes, previousReader := assumeYes, stdinReader
+	assumeYes = yes
+	stdinReader = bufio.NewReader(strings.NewReader("n\n"))
+	t.Cleanup(func() { assumeYes, stdinReader = previousYes, previousReader })
+}
+
+func TestSelectClients(t *testing.T) {
+	config, _ := newTestProfile(t, 4)
+	past := time.Now().Add(-time.Hour)
+	config.Groups = append(config.Groups, clientGroup{Name: "empty"})
+	config.clientInfo(2).Group = "staff"
+	config.clientInfo(3).Expires = &past
+
+	tests := []struct {
+		selection string
+		group     string
+		expired   bool
+		want      []int
+		wantErr   string
+	}{
+		{selection: "3,1,3", want: []int{0, 2}},
+		{group: "staff", want: []int{0, 2}},
+		{expired: true, want: []int{3}},
+		{wantErr: "exactly one of"},
+		{selection: "1", group: "staff", wantErr: "exactly one of"},
+		{selection: "5", wantErr: "client '5' does not exist"},
+		{group: "laptops", wantErr: "group 'laptops' does not exist"},
+		{group: "empty", wantErr: "group 'empty' has no clients"},
+	}
+
+	for _, test := range tests {
+		selected, err := config.selectClients(test.selection, test.group, test.expired)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("selectClients(%q, %q, %t) = %v, want %q", test.selection, test.group, test.expired, err,
+					test.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(selected, test.want) {
+			t.Errorf("selectClients(%q, %q, %t) = %v, %v, want %v", test.selection, test.group, test.expired,
+				selected, err, test.want)
+		}
+	}
+}
+
+func TestSetClientExpiry(t *testing.T) {
+	config, _ := newTestProfile(t, 3)
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	config.setClientExpiry(2, now)
+	if config.clientInfo(2).Expires != nil {
+		t.Errorf("client without expiry default expires on %v", config.clientInfo(2).Expires)
+	}
+
+	config.Defaults.ExpiryDays = 30
+	config.setClientExpiry(2, now)
+	if want := now.AddDate(0, 0, 30); config.clientInfo(2).Expires == nil || !config.clientInfo(2).Expires.Equal(want) {
+		t.Errorf("instance default: Expires = %v, want %v", config.clientInfo(2).Expires, want)
+	}
+
+	// The group default is layered on top of the instance default
+	if err := config.findGroup("staff").setGroupDefaults([]string{"expiry=7d"}); err != nil {
+		t.Fatal(err)
+	}
+	config.clientInfo(2).Group = "staff"
+	config.setClientExpiry(2, now)
+	if want := now.AddDate(0, 0, 7); config.clientInfo(2).Expires == nil || !config.clientInfo(2).Expires.Equal(want) {
+		t.Errorf("group default: Expires = %v, want %v", config.clientInfo(2).Expires, want)
+	}
+	if config.clientInfo(2).expired(now.AddDate(0, 0, 6)) || !config.clientInfo(2).expired(now.AddDate(0, 0, 7)) {
+		t.Error("expired() doesn't switch at the expiry date")
+	}
+	if warnings := config.expiryWarnings(now.AddDate(0, 0, 8)); len(warnings) != 1 ||
+		!strings.Contains(warnings[0], "client 3 expired") {
+		t.Errorf("expiryWarnings() = %q", warnings)
+	}
+
+	for _, value := range []string{"-1", "90x", "soon"} {
+		if err := config.findGroup("staff").setGroupDefaults([]string{"expiry=" + value}); err == nil {
+			t.Errorf("expiry=%s accepted", value)
+		}
+	}
+	if err := config.findGroup("staff").setGroupDefaults([]string{"expiry=never"}); err != nil ||
+		config.defaultsForGroup("staff").ExpiryDays != 0 {
+		t.Errorf("expiry=never: %v, ExpiryDays = %d", err, config.defaultsForGroup("staff").ExpiryDays)
+	}
+}
+
+func TestRemoveCommand(t *testing.T) {
+	answer(t, true)
+	config, configPath := newTestProfile(t, 5)
+	fourth, fifth := config.Clients[3].PrivateKey, config.Server.Peers[4].PublicKey
+
+	if err := runRemoveCommand(configPath, []string{"2,3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := loadAppConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed.Clients) != 3 || len(removed.Server.Peers) != 3 || len(removed.ClientsInfo) != 3 {
+		t.Fatalf("%d clients, %d peers and %d infos left, want 3", len(removed.Clients), len(removed.Server.Peers),
+			len(removed.ClientsInfo))
+	}
+	if removed.Clients[1].PrivateKey != fourth || removed.Server.Peers[2].PublicKey != fifth {
+		t.Error("the clients after the removed ones weren't renumbered with their peers")
+	}
+	if removed.clientInfo(0).Group != "staff" {
+		t.Error("the metadata of the first client was lost")
+	}
+	content, err := ioutil.ReadFile(configPath + "wsclient_2.conf")
+	if err != nil || !strings.Contains(string(content), fourth) {
+		t.Errorf("wsclient_2.conf doesn't hold the renumbered client 4: %v", err)
+	}
+	for _, fileName := range []string{"wsclient_4.conf", "wsclient_5.conf"} {
+		if _, err := os.Stat(configPath + fileName); !os.IsNotExist(err) {
+			t.Errorf("%s is left over: %v", fileName, err)
+		}
+		if _, found := removed.FileHashes[fileName]; found {
+			t.Errorf("the hash of %s is left over", fileName)
+		}
+	}
+	if problems := removed.verifyFiles(configPath); len(problems) > 0 {
+		t.Errorf("verifyFiles() = %v", problems)
+	}
+}
+
+func TestRemoveCommandRefusals(t *testing.T) {
+	answer(t, true)
+	config, configPath := newTestProfile(t, 3)
+
+	if err := runRemoveCommand(configPath, []string{"1,2,3"}); exitCode(err) != exitValidation {
+		t.Errorf("removing every client: %v", err)
+	}
+
+	config.clientInfo(2).Pinned = true
+	if err := config.save(configPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRemoveCommand(configPath, []string{"2"}); err == nil || !strings.Contains(err.Error(), "client 3 is pinned") {
+		t.Errorf("renumbering a pinned client: %v", err)
+	}
+	if err := runRemoveCommand(configPath, []string{"3"}); err != nil {
+		t.Errorf("removing the pinned client itself: %v", err)
+	}
+
+	answer(t, false)
+	if err := runRemoveCommand(configPath, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if declined, _ := loadAppConfig(configPath); len(declined.Clients) != 2 {
+		t.Errorf("%d clients left after declining, want 2", len(declined.Clients))
+	}
+}
+
+func TestRotateCommand(t *testing.T) {
+	answer(t, true)
+	config, configPath := newTestProfile(t, 4)
+	config.clientInfo(2).Group = "staff"
+	config.Clients[2].PrivateKey = ""
+	config.clientInfo(3).Group = "staff"
+	if err := config.save(configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runRotateCommand(configPath, []string{"--group", "staff"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := loadAppConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false, false, true} {
+		changed := rotated.Clients[i].PrivateKey != config.Clients[i].PrivateKey
+		if changed != want {
+			t.Errorf("client %d rotated = %t, want %t", i+1, changed, want)
+		}
+		if changed && rotated.Server.Peers[i].PublicKey == config.Server.Peers[i].PublicKey {
+			t.Errorf("the server peer of client %d kept the old public key", i+1)
+		}
+		if status, _ := rotated.clientInfo(i).status(); changed && status != statusIssued {
+			t.Errorf("client %d is %s after the rotation, want %s", i+1, status, statusIssued)
+		}
+	}
+	content, err := ioutil.ReadFile(configPath + "wsclient_4.conf")
+	if err != nil || !strings.Contains(string(content), rotated.Clients[3].PrivateKey) {
+		t.Errorf("wsclient_4.conf doesn't hold the new key: %v", err)
+	}
+	if problems := rotated.verifyFiles(configPath); len(problems) > 0 {
+		t.Errorf("verifyFiles() = %v", problems)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Severities of a lint finding: errors break the tunnel, warnings likely don't work as intended.
+const (
+	lintError   = "error"
+	lintWarning = "warning"
+)
+
+// lintFinding is a single best-practice violation reported by 'lint'.
+type lintFinding struct {
+	Severity string
+	Check    string
+	Message  string
+}
+
+// lintReport lists the findings of a configuration file, as printed by 'lint'.
+type lintReport struct {
+	File     string
+	Findings []lintFinding
+}
+
+// reservedNetworks are address ranges that never belong into AllowedIPs: routing them into the
+// tunnel breaks local traffic or sends packets nobody answers.
+var reservedNetworks = []struct {
+	network net.IPNet
+	name    string
+}{
+	{net.IPNet{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)}, "\"this network\""},
+	{net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}, "loopback"},
+	{net.IPNet{IP: net.IPv4(169, 254, 0, 0), Mask: net.CIDRMask(16, 32)}, "link-local"},
+	{net.IPNet{IP: net.IPv4(224, 0, 0, 0), Mask: net.CIDRMask(4, 32)}, "multicast"},
+	{net.IPNet{IP: net.IPv4(240, 0, 0, 0), Mask: net.CIDRMask(4, 32)}, "reserved"},
+	{net.IPNet{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)}, "loopback"},
+	{net.IPNet{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(10, 128)}, "link-local"},
+	{net.IPNet{IP: net.ParseIP("ff00::"), Mask: net.CIDRMask(8, 128)}, "multicast"},
+}
+
+// reservedNetworkName returns the kind of reserved range the network lies in, empty if it's none.
+// Default routes such as 0.0.0.0/0 contain every range and aren't reported.
+func reservedNetworkName(network net.IPNet) string {
+	if ones, _ := network.Mask.Size(); ones == 0 {
+		return ""
+	}
+	for _, reserved := range reservedNetworks {
+		if reserved.network.Contains(network.IP) {
+			return reserved.name
+		}
+	}
+
+	return ""
+}
+
+// isDefaultRoute tells whether the network is the IPv4 or, with ipv6 set, the IPv6 default route.
+func isDefaultRoute(network net.IPNet, ipv6 bool) bool {
+	ones, _ := network.Mask.Size()
+	return ones == 0 && (network.IP.To4() == nil) == ipv6
+}
+
+// lintWireguardConfig checks a parsed configuration against best practices, combining the
+// individual checks of the tool into one opinionated report for inherited configurations:
+//
+//   - full-tunnel peers routing 0.0.0.0/0 without ::/0, which lets IPv6 traffic bypass the tunnel
+//     on dual-stack networks;
+//   - DNS servers not covered by AllowedIPs, see unroutedDnsServers;
+//   - peers with an endpoint but no keepalive on a client, which loses the tunnel behind NAT;
+//   - MTUs that fragment on a 1500 byte path or are too small for IPv6;
+//   - reserved ranges such as loopback, link-local or multicast in AllowedIPs;
+//   - peers without an endpoint on a configuration that has no listen port either.
+//
+// A configuration without a ListenPort is treated as a client, one with a ListenPort as a server.
+//
+// Parameters:
+//     wc (WireguardConfig): The configuration to check.
+//
+// Returns:
+//     []lintFinding: The findings, errors first, empty if the configuration follows all practices.
+//
+// Usage:
+//     findings := lintWireguardConfig(wc)
+func lintWireguardConfig(wc WireguardConfig) []lintFinding {
+	var findings []lintFinding
+	report := func(severity string, check string, format string, args ...interface{}) {
+		findings = append(findings, lintFinding{Severity: severity, Check: check, Message: fmt.Sprintf(format, args...)})
+	}
+
+	isClient := wc.ListenPort == 0
+	hasIPv6 := false
+	for _, address := range wc.Address {
+		if address.IP.To4() == nil {
+			hasIPv6 = true
+		}
+	}
+
+	for i, peer := range wc.Peers {
+		ipv4Default, ipv6Default := false, false
+		for _, allowed := range peer.AllowedIPs {
+			ipv4Default = ipv4Default || isDefaultRoute(allowed, false)
+			ipv6Default = ipv6Default || isDefaultRoute(allowed, true)
+			if name := reservedNetworkName(allowed); name != "" {
+				report(lintWarning, "reserved-allowedips", "peer %d routes the %s range %s into the tunnel, "+
+					"which breaks local traffic or reaches nobody: remove it from AllowedIPs", i+1, name, allowed.String())
+			}
+		}
+		if ipv4Default && !ipv6Default {
+			severity := lintWarning
+			if hasIPv6 {
+				severity = lintError
+			}
+			report(severity, "full-tunnel-ipv6", "peer %d routes all IPv4 traffic through the tunnel but not IPv6: on "+
+				"dual-stack networks IPv6 traffic bypasses the tunnel, add ::/0 to AllowedIPs to tunnel or block it", i+1)
+		}
+
+		switch {
+		case peer.Endpoint == "" && isClient:
+			report(lintError, "missing-endpoint", "peer %d has no endpoint and the interface no listen port, "+
+				"so neither side can start the handshake: set the Endpoint of the peer", i+1)
+		case peer.Endpoint != "" && isClient && peer.PersistentKeepalive == 0:
+			report(lintWarning, "missing-keepalive", "peer %d has no PersistentKeepalive: behind NAT the tunnel "+
+				"stops receiving after the NAT mapping expires, set PersistentKeepalive = 25", i+1)
+		}
+	}
+
+	for _, dns := range unroutedDnsServers(wc) {
+		report(lintWarning, "dns-outside-tunnel", "DNS server %s isn't covered by the AllowedIPs of any peer, "+
+			"so DNS queries leave outside the tunnel: add %s/32 to AllowedIPs or use a resolver inside the tunnel",
+			dns.String(), dns.String())
+	}
+
+	switch mtu := effectiveMtu(wc.MTU); {
+	case mtu < minMtu:
+		report(lintError, "mtu", "MTU %d is below the minimum of %d", mtu, minMtu)
+	case mtu < 1280 && hasIPv6:
+		report(lintError, "mtu", "MTU %d is below 1280, the minimum of IPv6, the IPv6 tunnel addresses won't work", mtu)
+	case mtu > 1500-wireguardOverheadIPv4:
+		report(lintWarning, "mtu", "MTU %d exceeds the %d bytes that fit into a 1500 byte path with the Wireguard "+
+			"overhead, packets get fragmented or dropped: use %d or less", mtu, 1500-wireguardOverheadIPv4, wireguardDefaultMtu)
+	}
+
+	sorted := make([]lintFinding, 0, len(findings))
+	for _, severity := range []string{lintError, lintWarning} {
+		for _, finding := range findings {
+			if finding.Severity == severity {
+				sorted = append(sorted, finding)
+			}
+		}
+	}
+
+	return sorted
+}
+
+// String returns the report as printed by 'lint', a line per finding.
+func (report lintReport) String() string {
+	if len(report.Findings) == 0 {
+		return fmt.Sprintf("%s: no findings\n", report.File)
+	}
+
+	text := fmt.Sprintf("%s: %d findings\n", report.File, len(report.Findings))
+	for _, finding := range report.Findings {
+		text += fmt.Sprintf("  %-8s %-19s %s\n", finding.Severity, finding.Check, finding.Message)
+	}
+
+	return text
+}
+
+// runLintCommand implements the 'lint' command, which checks existing Wireguard configuration
+// files, e.g. inherited ones, against best practices and reports every finding with its severity:
+//
+//     lint C:\wireguard\wg0.conf
+//     lint client1.conf client2.conf
+//
+// Nothing is changed. The command fails with a validation error if any file has error findings, so
+// that it can gate scripts.
+func runLintCommand(configPath string, args []string) error {
+	if len(args) == 0 {
+		return newError(errUsage, "usage: lint <file>...")
+	}
+
+	var reports []lintReport
+	var text strings.Builder
+	errorFiles := 0
+	for _, file := range args {
+		wc, _, err := readWireguardConfigFile(file, parseStrict)
+		if err != nil {
+			return err
+		}
+
+		report := lintReport{File: file, Findings: lintWireguardConfig(wc)}
+		if len(report.Findings) > 0 && report.Findings[0].Severity == lintError {
+			errorFiles++
+		}
+		reports = append(reports, report)
+		text.WriteString(report.String())
+	}
+
+	printResult(text.String(), reports)
+	if errorFiles > 0 {
+		return newError(errValidation, "%d of %d files have errors", errorFiles, len(args))
+	}
+
+	return nil
+}
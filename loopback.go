@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Transport data messages of the Wireguard protocol, which carry the tunneled IP packets.
+const (
+	messageTransportType       = 4
+	messageTransportHeaderSize = 16
+)
+
+// loopbackPingPayload is the payload of the ICMP echo request of the loopback test.
+const loopbackPingPayload = "wg-quick-config loopback test"
+
+// kdf3 derives three keys from the chaining key and the input, KDF3 of the Wireguard protocol.
+func kdf3(chainingKey []byte, input []byte) ([]byte, []byte, []byte) {
+	t0 := hmacBlake2s(chainingKey, input)
+	t1 := hmacBlake2s(t0, []byte{1})
+	t2 := hmacBlake2s(t0, append(append([]byte(nil), t1...), 2))
+	t3 := hmacBlake2s(t0, append(append([]byte(nil), t2...), 3))
+
+	return t1, t2, t3
+}
+
+// transportSession is the data channel of a completed handshake: the keys of both directions and
+// the indexes that address the messages, see consumeHandshakeResponse.
+type transportSession struct {
+	send        cipher.AEAD
+	receive     cipher.AEAD
+	localIndex  uint32
+	remoteIndex uint32
+	counter     uint64
+}
+
+// consumeHandshakeResponse completes the handshake of the initiator with the response of the
+// server and derives the keys of the data channel. The response is authenticated on the way, a
+// response that doesn't decrypt wasn't made for this initiation.
+//
+// Parameters:
+//     state (handshakeState): The state of the initiator, see initiateHandshake.
+//     response ([]byte): The 92 byte handshake response of the server.
+//
+// Returns:
+//     transportSession: The data channel of the handshake.
+//     error: An error if the response doesn't belong to the initiation or doesn't authenticate.
+//
+// Usage:
+//     session, err := consumeHandshakeResponse(state, response[:n])
+func consumeHandshakeResponse(state handshakeState, response []byte) (transportSession, error) {
+	if len(response) != messageResponseSize || response[0] != messageResponseType ||
+		binary.LittleEndian.Uint32(response[8:12]) != state.senderIndex {
+		return transportSession{}, fmt.Errorf("not a handshake response to the initiation")
+	}
+	responderEphemeral := response[12:44]
+
+	chainingKey := hmacBlake2s(hmacBlake2s(state.chainingKey, responderEphemeral), []byte{1})
+	handshakeHash := blake2sHash(state.handshakeHash, responderEphemeral)
+	shared, err := curve25519.X25519(state.ephemeral[:], responderEphemeral)
+	if err != nil {
+		return transportSession{}, err
+	}
+	chainingKey, _ = kdf2(chainingKey, shared)
+	if shared, err = curve25519.X25519(state.privateKey, responderEphemeral); err != nil {
+		return transportSession{}, err
+	}
+	chainingKey, _ = kdf2(chainingKey, shared)
+
+	// No preshared key, the zero key takes its place
+	chainingKey, tau, key := kdf3(chainingKey, make([]byte, WireguardPrivateKeySize))
+	handshakeHash = blake2sHash(handshakeHash, tau)
+	aead, _ := chacha20poly1305.New(key)
+	if _, err = aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), response[44:60], handshakeHash); err != nil {
+		return transportSession{}, fmt.Errorf("the handshake response doesn't authenticate")
+	}
+
+	sendKey, receiveKey := kdf2(chainingKey, nil)
+	session := transportSession{localIndex: state.senderIndex, remoteIndex: binary.LittleEndian.Uint32(response[4:8])}
+	session.send, _ = chacha20poly1305.New(sendKey)
+	session.receive, _ = chacha20poly1305.New(receiveKey)
+
+	return session, nil
+}
+
+// seal encrypts an IP packet into a transport data message for the server.
+func (session *transportSession) seal(packet []byte) []byte {
+	message := make([]byte, messageTransportHeaderSize, messageTransportHeaderSize+len(packet)+chacha20poly1305.Overhead)
+	message[0] = messageTransportType
+	binary.LittleEndian.PutUint32(message[4:], session.remoteIndex)
+	binary.LittleEndian.PutUint64(message[8:], session.counter)
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], session.counter)
+	session.counter++
+
+	return session.send.Seal(message, nonce, packet, nil)
+}
+
+// open decrypts a transport data message of the server, an empty packet is a keepalive.
+func (session *transportSession) open(message []byte) ([]byte, error) {
+	if len(message) < messageTransportHeaderSize+chacha20poly1305.Overhead || message[0] != messageTransportType ||
+		binary.LittleEndian.Uint32(message[4:8]) != session.localIndex {
+		return nil, fmt.Errorf("not a transport data message of the session")
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(nonce[4:], message[8:16])
+	return session.receive.Open(nil, nonce, message[messageTransportHeaderSize:], nil)
+}
+
+// internetChecksum returns the checksum of the IPv4 and ICMP headers, RFC 1071.
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return ^uint16(sum)
+}
+
+// icmpEchoRequest builds the IPv4 packet of an ICMP echo request, a ping, from the source to the
+// destination address.
+func icmpEchoRequest(source net.IP, destination net.IP, id uint16, sequence uint16) []byte {
+	icmp := make([]byte, 8+len(loopbackPingPayload))
+	icmp[0] = 8
+	binary.BigEndian.PutUint16(icmp[4:], id)
+	binary.BigEndian.PutUint16(icmp[6:], sequence)
+	copy(icmp[8:], loopbackPingPayload)
+	binary.BigEndian.PutUint16(icmp[2:], internetChecksum(icmp))
+
+	header := make([]byte, 20)
+	header[0] = 0x45
+	binary.BigEndian.PutUint16(header[2:], uint16(len(header)+len(icmp)))
+	header[8] = 64
+	header[9] = 1
+	copy(header[12:16], source.To4())
+	copy(header[16:20], destination.To4())
+	binary.BigEndian.PutUint16(header[10:], internetChecksum(header))
+
+	return append(header, icmp...)
+}
+
+// isIcmpEchoReply tells whether the IPv4 packet is the reply of the destination to the echo request
+// of icmpEchoRequest.
+func isIcmpEchoReply(packet []byte, source net.IP, destination net.IP, id uint16, sequence uint16) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 || packet[9] != 1 {
+		return false
+	}
+	headerSize := int(packet[0]&0x0f) * 4
+	if len(packet) < headerSize+8 || !net.IP(packet[12:16]).Equal(destination) || !net.IP(packet[16:20]).Equal(source) {
+		return false
+	}
+	icmp := packet[headerSize:]
+
+	return icmp[0] == 0 && binary.BigEndian.Uint16(icmp[4:]) == id && binary.BigEndian.Uint16(icmp[6:]) == sequence
+}
+
+// setLoopbackPeer adds the temporary peer of the loopback test to the running server tunnel with
+// 'wg set', or removes it. This works with the backends whose tunnels 'wg' manages, WireGuard for
+// Windows and wg-quick.
+func setLoopbackPeer(tunnel string, publicKey string, address net.IP, remove bool) error {
+	args := []string{"set", tunnel, "peer", publicKey, "allowed-ips", address.String() + "/32"}
+	if remove {
+		args = []string{"set", tunnel, "peer", publicKey, "remove"}
+	}
+
+	output, err := exec.Command("wg", args...).CombinedOutput()
+	if err != nil {
+		if message := strings.TrimSpace(string(output)); message != "" {
+			return fmt.Errorf("wg %s: %s", strings.Join(args[:4], " "), message)
+		}
+		return fmt.Errorf("wg %s: %w", strings.Join(args[:4], " "), err)
+	}
+
+	return nil
+}
+
+// loopbackResult is the outcome of the loopback test of 'doctor --loopback'.
+type loopbackResult struct {
+	Tunnel  string
+	Address string
+	Passed  bool
+	// Handshake and Ping are the round trip times of the handshake and of the ping of the server
+	// tunnel address, zero for the steps that weren't reached.
+	Handshake time.Duration
+	Ping      time.Duration
+	Failure   string `json:",omitempty"`
+}
+
+// String prints PASS or FAIL with the timings or the reason.
+func (result loopbackResult) String() string {
+	if !result.Passed {
+		text := "Loopback test: FAIL, " + result.Failure
+		if result.Handshake > 0 {
+			text += fmt.Sprintf(" (handshake completed in %s)", result.Handshake.Round(time.Microsecond))
+		}
+		return text
+	}
+
+	return fmt.Sprintf("Loopback test: PASS, handshake in %s, ping of the server tunnel address in %s.",
+		result.Handshake.Round(time.Microsecond), result.Ping.Round(time.Microsecond))
+}
+
+// loopbackTest tests the running server end to end from the server machine itself, before any real
+// device is provisioned: a temporary peer with a fresh key and a free tunnel address is added to the
+// running tunnel, a userspace client handshakes with the server on 127.0.0.1 and pings the IPv4
+// tunnel address of the server through the tunnel, and the peer is removed again. This proves the
+// server key, the listening port and the configuration the tunnel runs with. The temporary peer and
+// its key only exist in the running tunnel, never in the profile; it is removed when the test
+// fails or is interrupted too.
+//
+// Parameters:
+//     timeout (time.Duration): How long to wait for the handshake response and for the ping reply.
+//
+// Returns:
+//     loopbackResult: The outcome, PASS with the timings or FAIL with the reason.
+//
+// Usage:
+//     result := config.loopbackTest(5 * time.Second)
+func (config *appConfig) loopbackTest(timeout time.Duration) loopbackResult {
+	result := loopbackResult{Tunnel: config.tunnelName()}
+	fail := func(format string, args ...interface{}) loopbackResult {
+		result.Failure = fmt.Sprintf(format, args...)
+		return result
+	}
+
+	output, err := exec.Command("wg", "show", result.Tunnel, "listen-port").Output()
+	port, _ := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil || port == 0 {
+		return fail("the server tunnel %s isn't running, or 'wg' isn't installed to reach it; the loopback test "+
+			"needs a backend 'wg' manages, WireGuard for Windows or wg-quick", result.Tunnel)
+	}
+
+	var serverAddress net.IP
+	var subnet net.IPNet
+	for _, address := range config.Server.Address {
+		if address.IP.To4() != nil {
+			serverAddress = address.IP.To4()
+			subnet = net.IPNet{IP: address.IP.Mask(address.Mask), Mask: address.Mask}
+			break
+		}
+	}
+	if serverAddress == nil {
+		return fail("the server has no IPv4 tunnel address to ping")
+	}
+	address, err := config.nextFreeAddress(subnet)
+	if err != nil {
+		return fail("no free tunnel address for the temporary peer: %s", err)
+	}
+	address = address.To4()
+	result.Address = address.String()
+
+	key, err := newWireguardPrivateKey()
+	if err != nil {
+		return fail("can't generate the temporary key: %s", err)
+	}
+	publicKey := key.base64PublicKey()
+	serverPublicKey, err := base64PublicKeyFromPrivate(config.Server.PrivateKey)
+	if err != nil {
+		return fail("invalid server private key")
+	}
+	serverKey, _ := decodeKey(serverPublicKey)
+
+	if err = setLoopbackPeer(result.Tunnel, publicKey, address, false); err != nil {
+		return fail("can't add the temporary peer to the tunnel, run as administrator: %s", err)
+	}
+
+	// The temporary peer is removed however the test ends, an interruption included
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	finished := make(chan struct{})
+	removePeer := func() {
+		if err := setLoopbackPeer(result.Tunnel, publicKey, address, true); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: the temporary peer %s couldn't be removed from %s, remove it with "+
+				"'wg set %s peer %s remove': %s\n", publicKey, result.Tunnel, result.Tunnel, publicKey, err)
+		}
+	}
+	go func() {
+		select {
+		case <-interrupt:
+			removePeer()
+			fmt.Fprintln(os.Stderr, "Loopback test: interrupted, the temporary peer was removed")
+			os.Exit(exitInterrupted)
+		case <-finished:
+		}
+	}()
+	defer func() {
+		signal.Stop(interrupt)
+		close(finished)
+		removePeer()
+	}()
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return fail("%s", err)
+	}
+	defer conn.Close()
+
+	var index [4]byte
+	if _, err = rand.Read(index[:]); err != nil {
+		return fail("%s", err)
+	}
+	message, state, err := initiateHandshake(key[:], serverKey, binary.LittleEndian.Uint32(index[:]))
+	if err != nil {
+		return fail("%s", err)
+	}
+
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	if _, err = conn.Write(message); err != nil {
+		return fail("%s", err)
+	}
+	var session transportSession
+	buffer := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return fail("no handshake response from 127.0.0.1:%d within %s: %s", port, timeout, err)
+		}
+		if session, err = consumeHandshakeResponse(state, buffer[:n]); err == nil {
+			break
+		}
+	}
+	result.Handshake = time.Since(start)
+
+	id := uint16(state.senderIndex)
+	packet := icmpEchoRequest(address, serverAddress, id, 1)
+	start = time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	if _, err = conn.Write(session.seal(packet)); err != nil {
+		return fail("%s", err)
+	}
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return fail("no reply to the ping of %s through the tunnel within %s; the handshake works, check the "+
+				"firewall of the server allows ICMP echo requests on the tunnel interface", serverAddress, timeout)
+		}
+		if reply, err := session.open(buffer[:n]); err == nil && isIcmpEchoReply(reply, address, serverAddress, id, 1) {
+			break
+		}
+	}
+	result.Ping = time.Since(start)
+	result.Passed = true
+
+	return result
+}
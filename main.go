@@ -1,16 +1,17 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
-
-	"github.com/gonutz/w32/v2"
 )
 
 // startWireguardTunnel starts a Wireguard tunnel service using the provided
@@ -22,75 +23,276 @@ import (
 // private if the version of Windows being used is older than Windows 8.
 //
 // Parameters:
+//     ps (Executor): Runs the PowerShell scripts, see NewPowerShell.
 //     path (string): The file path to the server configuration file for the tunnel service.
+//     serverConfigFile (string): The file name of the server configuration, which names the tunnel.
+//
+// Returns:
+//     []SystemChange: The records of the tunnel service and the network category changes, for 'cleanup'.
+//     error: An error if the tunnel service could not be installed. Failing to make the network
+//     private is only reported.
 //
 // Usage:
-//     startWireguardTunnel("C:/path/to/config/")
-func startWireguardTunnel(path string) {
+//     changes, err := startWireguardTunnel(NewPowerShell(), "C:/path/to/config/", config.serverConfigFile())
+func startWireguardTunnel(ps Executor, path string, serverConfigFile string) ([]SystemChange, error) {
+	var changes []SystemChange
+	ctx := context.Background()
+
 	// Prints a message indicating that the Wireguard tunnel is starting.
 	fmt.Println("\nStarting Wireguard tunnel...")
 
-	// Creates a new PowerShell instance to install the tunnel service.
-	installTunnel := NewPowerShell()
+	// Gets the tunnel name from the server configuration file.
+	tunnelName := strings.TrimSuffix(serverConfigFile, ".conf")
 
-	// Formats the command to install the tunnel service.
-	installCommand := fmt.Sprintf("&\"wireguard.exe\" /installtunnelservice \"%s\"",
-		path+defaultServerConfigFile)
+	// A tunnel service installed by the user is never removed by 'cleanup'
+	existing := ps.Execute(ctx, fmt.Sprintf(
+		"Get-Service -Name 'WireGuardTunnel$%s' -ErrorAction SilentlyContinue | Select-Object -ExpandProperty Name",
+		tunnelName))
+	serviceExisted := strings.TrimSpace(existing.StdOut) != ""
+
+	// Formats the command to install the tunnel service. The path is a literal, a profile path may
+	// contain spaces, parentheses or characters PowerShell expands in double quotes, such as $.
+	installCommand := fmt.Sprintf("&\"wireguard.exe\" /installtunnelservice %s",
+		quotePowerShell(path+serverConfigFile))
 
 	// Executes the command to install the tunnel service and captures the output and error messages.
-	stdOut, stdErr, err := installTunnel.execute(installCommand)
+	progress := startSpinner("Installing Wireguard tunnel service")
+	install := ps.Execute(ctx, installCommand)
+	progress.Stop()
+	installErr := install.Err
+
+	// A service whose command line lost the path of the configuration installs but never starts
+	if installErr == nil && !serviceExisted {
+		if err := verifyTunnelService(ps, tunnelName, path+serverConfigFile); err != nil {
+			stopWireguardTunnel(ps, tunnelName)
+			return changes, err
+		}
+	}
+
+	if installErr == nil || serviceExisted {
+		changes = append(changes, newSystemChange(changeTunnelService, tunnelName, !serviceExisted,
+			fmt.Sprintf("&\"wireguard.exe\" /uninstalltunnelservice %s", tunnelName)))
+	}
 
 	// Prints the output and error messages if there is an error.
-	if err != nil {
+	if installErr != nil {
 		fmt.Printf("\nInstalling Wireguard tunnel:\nStdOut : '%s'\nStdErr: '%s'\nErr: %s",
-			strings.TrimSpace(stdOut), stdErr, err)
+			strings.TrimSpace(install.StdOut), install.StdErr, installErr)
 	}
 
 	// Gets the Windows version.
-	winVersion := w32.RtlGetVersion()
+	major, minor := windowsVersion()
 
 	// Don't try making WireGuard network private before Windows 8
-	if winVersion.MajorVersion < 6 || (winVersion.MajorVersion == 6 && winVersion.MinorVersion < 2) {
-		return
+	if installErr != nil || major < 6 || (major == 6 && minor < 2) {
+		return changes, installErr
 	}
 
 	// Prints a message indicating that the Wireguard tunnel network is being made private.
 	fmt.Println("\nTrying to make Wireguard tunnel network private...")
 
-	// Creates a new PowerShell instance to make the network private.
-	privateNetworkShell := NewPowerShell()
-
-	// Gets the tunnel name from the default server configuration file.
-	tunnelName := strings.Split(defaultServerConfigFile, ".")
-
 	// Formats the command to get the network connection profile.
 	networkProfile := fmt.Sprintf("$NetworkProfile = Get-NetConnectionProfile -InterfaceAlias \"%s\"",
-		tunnelName[0])
+		tunnelName)
 
-	// Formats the command to enable the private network.
+	// Formats the command to enable the private network, printing the previous category for 'cleanup'.
 	enablePrivate :=
-		`$NetworkProfile.NetworkCategory = "Private"
+		`$NetworkProfile.NetworkCategory.ToString()
+		$NetworkProfile.NetworkCategory = "Private"
 		Set-NetConnectionProfile -InputObject $NetworkProfile`
 
 	// Formats the script to enable the private network.
 	enablePrivateScript := fmt.Sprintf("%s\n%s", networkProfile, enablePrivate)
 
 	// Executes the script to enable the private network and captures the output and error messages.
-	stdOut, stdErr, err = privateNetworkShell.execute(enablePrivateScript)
+	progress = startSpinner("Making Wireguard tunnel network private")
+	result := ps.Execute(ctx, enablePrivateScript)
 
-	// Tries to execute the script up to 10 times if there is an error.
-	for i := 0; i < 10; i++ {
+	// Tries to execute the script up to 10 times if there is an error. Repeating a successful run
+	// would report the category as already private.
+	for i := 0; i < 10 && result.Err != nil; i++ {
+		progress.SetProgress(i+1, 10, "attempts")
 		time.Sleep(time.Second)
-		stdOut, stdErr, err = privateNetworkShell.execute(enablePrivateScript)
-		if err == nil {
-			break
-		}
+		result = ps.Execute(ctx, enablePrivateScript)
 	}
+	progress.Stop()
 
 	// Prints the output and error messages if there is an error.
-	if err != nil {
+	if result.Err != nil {
 		fmt.Printf("\nMake Wireguard tunnel network private:\nStdOut : '%s'\nStdErr: '%s'\nErr: %s",
-			strings.TrimSpace(stdOut), stdErr, err)
+			strings.TrimSpace(result.StdOut), result.StdErr, result.Err)
+		return changes, nil
+	}
+
+	previous := strings.TrimSpace(strings.Split(result.StdOut, "\n")[0])
+	if previous != "" {
+		changes = append(changes, newSystemChange(changeNetworkCategory, tunnelName, previous != "Private",
+			fmt.Sprintf("Set-NetConnectionProfile -InterfaceAlias \"%s\" -NetworkCategory %s", tunnelName, previous)))
+	}
+
+	return changes, nil
+}
+
+// splitCommandLine splits a Windows command line into its arguments, honoring double quotes, e.g.
+// the ImagePath of a service.
+func splitCommandLine(commandLine string) []string {
+	var args []string
+	var current strings.Builder
+	quoted, started := false, false
+	for _, r := range commandLine {
+		switch {
+		case r == '"':
+			quoted, started = !quoted, true
+		case (r == ' ' || r == '\t') && !quoted:
+			if started {
+				args = append(args, current.String())
+				current.Reset()
+			}
+			started = false
+		default:
+			current.WriteRune(r)
+			started = true
+		}
+	}
+	if started {
+		args = append(args, current.String())
+	}
+
+	return args
+}
+
+// verifyTunnelService checks after the installation that the command line Windows recorded for
+// the tunnel service, its ImagePath, runs an existing wireguard.exe with the configuration file
+// that was installed. A path mangled by quoting or a code page, e.g. C:\Users\José María\My
+// Configs, lets the service install but never start.
+//
+// Parameters:
+//     ps (Executor): Runs the registry query, see NewPowerShell.
+//     tunnelName (string): The name of the tunnel.
+//     configFile (string): The full path of the server configuration file that was installed.
+//
+// Returns:
+//     error: A dependency error telling how to move the profile to a path the service can use.
+//
+// Usage:
+//     err := verifyTunnelService(NewPowerShell(), "wiresock", configFilePath+"wiresock.conf")
+func verifyTunnelService(ps Executor, tunnelName string, configFile string) error {
+	result := ps.Execute(context.Background(), fmt.Sprintf(
+		"(Get-ItemProperty -LiteralPath %s -Name ImagePath).ImagePath",
+		quotePowerShell(`HKLM:\SYSTEM\CurrentControlSet\Services\WireGuardTunnel$`+tunnelName)))
+	imagePath := strings.TrimSpace(result.StdOut)
+	if result.Err != nil || imagePath == "" {
+		// The service may be registered differently, e.g. by a newer Wireguard, nothing to check
+		return nil
+	}
+
+	fix := fmt.Sprintf("the path of the profile %s likely contains characters the service command line doesn't "+
+		"carry, such as spaces, parentheses or non-ASCII letters: move the profile to a plain path, e.g. "+
+		"-config-path C:\\ProgramData\\wg-quick-config\\%s, and run -start again", filepath.Dir(configFile), tunnelName)
+
+	args := splitCommandLine(imagePath)
+	if len(args) == 0 {
+		return newError(errDependency, "the tunnel service %s was installed with an empty command line, %s", tunnelName, fix)
+	}
+	if _, err := os.Stat(args[0]); err != nil {
+		return newError(errDependency, "the tunnel service %s runs %s, which doesn't exist: %s", tunnelName, args[0], fix)
+	}
+	for i, arg := range args[1:] {
+		if !strings.EqualFold(arg, "/tunnelservice") || i+2 >= len(args) {
+			continue
+		}
+		recorded := args[i+2]
+		if _, err := os.Stat(recorded); err != nil || !strings.EqualFold(filepath.Clean(recorded), filepath.Clean(configFile)) {
+			return newError(errDependency, "the tunnel service %s points at the configuration %s instead of %s: %s",
+				tunnelName, recorded, configFile, fix)
+		}
+	}
+
+	return nil
+}
+
+// listenPortRetry bounds how long starting the tunnel waits for the listen port: a just-stopped
+// tunnel service can keep it for a few seconds, so an immediate start would fail spuriously.
+type listenPortRetry struct {
+	Attempts int
+	Backoff  time.Duration
+	// Sleep waits between the attempts, time.Sleep unless replaced, e.g. by a fake clock.
+	Sleep func(time.Duration)
+}
+
+// portRetry is the retry of checkListenPortAvailable, about 10 seconds in total by default. The
+// attempts and the backoff are set with -portretries and -portbackoff.
+var portRetry = listenPortRetry{Attempts: 10, Backoff: time.Second, Sleep: time.Sleep}
+
+// listenPortHolder tells who holds the listen port of the server, on the bind address if there is
+// one. A port held by the tunnel itself, if it is already running, counts as free.
+//
+// Returns:
+//     string: The description of the process holding the port, empty if the port is free.
+//     bool: Whether the port is likely released soon: it is held by a Wireguard instance, such as
+//         the previous tunnel service, or by no process the owner lookup can find any more.
+func listenPortHolder(ps Executor, address string, port int, tunnelName string) (string, bool) {
+	if _, err := CheckUdpPortOnAddress(udpFamilyDual, address, port); err == nil {
+		return "", false
+	}
+	name, found := wireguardPortOwner(ps, port)
+	if found && strings.EqualFold(name, tunnelName) {
+		return "", false
+	}
+	if found {
+		return fmt.Sprintf("the Wireguard instance '%s'", name), true
+	}
+
+	owner, found := udpPortOwner(ps, port)
+	if !found {
+		return "another application", true
+	}
+	return owner, false
+}
+
+// checkListenPortAvailable verifies before the tunnel service is installed that the listen port of
+// the server is still free, on the bind address if there is one, since the service would otherwise
+// fail without a visible error. The port may be held by the tunnel itself if it is already running.
+// While the port is held by a Wireguard instance, e.g. the tunnel service stopped by -restart or
+// 'cleanup' just before, the check is retried with a spinner until the attempts are exhausted. A
+// port held by an unrelated process fails at once.
+//
+// Parameters:
+//     ps (Executor): Runs the PowerShell query of the port owner, see udpPortOwner.
+//     address (string): The bind address of the server, empty for all addresses.
+//     port (int): The listen port of the server.
+//     tunnelName (string): The name of the tunnel service, see appConfig.tunnelName.
+//     retry (listenPortRetry): The attempts and the backoff, see portRetry.
+//
+// Returns:
+//     error: A conflict error naming the process holding the port, or nil.
+//
+// Usage:
+//     err := checkListenPortAvailable(NewPowerShell(), config.BindAddress, int(config.Server.ListenPort), config.tunnelName(), portRetry)
+func checkListenPortAvailable(ps Executor, address string, port int, tunnelName string, retry listenPortRetry) error {
+	var progress *spinner
+	for attempt := 1; ; attempt++ {
+		owner, lingering := listenPortHolder(ps, address, port, tunnelName)
+		if owner == "" || !lingering || attempt >= retry.Attempts {
+			if progress != nil {
+				progress.Stop()
+			}
+			if owner == "" {
+				return nil
+			}
+			if lingering && attempt > 1 {
+				return newError(errConflict, "UDP port %d of the server is still in use by %s after %d attempts, stop it "+
+					"or free the port before starting the tunnel", port, owner, attempt)
+			}
+			return newError(errConflict, "UDP port %d of the server is in use by %s, stop it or free the port "+
+				"before starting the tunnel", port, owner)
+		}
+
+		if progress == nil {
+			progress = startSpinner(fmt.Sprintf("Waiting for UDP port %d to be released", port))
+		}
+		progress.SetStatus(fmt.Sprintf("held by %s, attempt %d/%d", owner, attempt, retry.Attempts))
+		retry.Sleep(retry.Backoff)
 	}
 }
 
@@ -98,24 +300,57 @@ func startWireguardTunnel(path string) {
 // PowerShell command to uninstall the tunnel service.
 //
 // The function will log any errors that occur during the process,
-// including any output or error messages that are generated by the PowerShell command.
+// including any output or error messages that are generated by the PowerShell command,
+// and return the error.
+//
+// Parameters:
+//     ps (Executor): Runs the PowerShell scripts, see NewPowerShell.
+//     tunnelName (string): The name of the tunnel service, the server configuration file name without .conf.
 //
 // Usage:
-//     stopWireguardTunnel()
-func stopWireguardTunnel() {
+//     err := stopWireguardTunnel(NewPowerShell(), config.tunnelName())
+func stopWireguardTunnel(ps Executor, tunnelName string) error {
 	fmt.Println("Stopping Wireguard tunnel...")
-	tunnelName := strings.Split(defaultServerConfigFile, ".")
 
-	installTunnel := NewPowerShell()
 	installCommand := fmt.Sprintf("&\"wireguard.exe\" /uninstalltunnelservice %s",
-		tunnelName[0])
+		tunnelName)
 
-	stdOut, stdErr, err := installTunnel.execute(installCommand)
+	progress := startSpinner("Uninstalling Wireguard tunnel service")
+	result := ps.Execute(context.Background(), installCommand)
+	progress.Stop()
 
-	if err != nil {
-		fmt.Printf("\nEnable Private Network:\nStdOut : '%s'\nStdErr: '%s'\nErr: %s", strings.TrimSpace(stdOut),
-			stdErr, err)
+	if result.Err != nil {
+		fmt.Printf("\nEnable Private Network:\nStdOut : '%s'\nStdErr: '%s'\nErr: %s", strings.TrimSpace(result.StdOut),
+			result.StdErr, result.Err)
+	}
+
+	return result.Err
+}
+
+// checkTunnelDependencies verifies that the external programs required to start and stop the
+// Wireguard tunnel service, powershell.exe and wireguard.exe, can be found in the PATH.
+//
+// Returns:
+//     error: A dependency error naming the first missing program, or nil.
+//
+// Usage:
+//     if err := checkTunnelDependencies(); err != nil { ... }
+func checkTunnelDependencies() error {
+	for _, program := range []string{"powershell.exe", "wireguard.exe"} {
+		if _, err := exec.LookPath(program); err != nil {
+			return newError(errDependency, "%s was not found, please make sure it is installed and in the PATH", program)
+		}
 	}
+
+	return nil
+}
+
+// addResult is the result of the -add flag printed with -format json.
+type addResult struct {
+	Client     int
+	ConfigFile string
+	Address    string
+	PublicKey  string
 }
 
 // The main function is the entry point of the application. This function first parses command line arguments,
@@ -130,13 +365,33 @@ func stopWireguardTunnel() {
 //     -restart: Restarts the Wireguard server.
 //     -add: Adds a new Wireguard peer and client config file. Creates a server config file if not available.
 //     -qrcode: Displays the QR code for the specified configuration.
+//     -text: Also prints the configuration text together with the QR code (-add and -qrcode).
+//     -qrmaxversion: Largest QR code version to display, see defaultMaxQrVersion.
+//     -force: Overwrites existing configuration files not created by this tool without asking.
+//     -dnsonly: Makes the client added with -add route only its DNS servers through the tunnel.
+//     -serverfile: File name of the server configuration created with -add, wiresock.conf by default.
+//     -junk: Enables AmneziaWG junk packets with randomized parameters for the client added with -add.
+//     -group: Puts the client added with -add into a group, offering to create unknown groups.
+//     -role: Reachability role of the client added with -add, mobile or public, see applyClientRole.
+//     -serverkeepalive: PersistentKeepalive of the server peer entry of the client added with -add.
+//     -bind: Local address the server created with -add is bound to, see CheckUdpPortOnAddress.
+//     -portrange: Range of UDP ports preferred for the server created with -add, see selectServerPort.
+//     -quiet, -verbose, -yes, -no-roundtrip, -apply, -format, -proxy, -cloud-metadata: Global options accepted anywhere on the command line (see parseGlobalFlags).
+//
+// Without arguments on a console, the guided mode recommends the next steps for this host and runs
+// the chosen one as if its flags or subcommand had been typed, see runGuidedMode.
+//
+// Alternatively the first argument may name one of the subcommands listed in the commands table
+// (e.g. 'defaults'), in which case the remaining arguments are handed over to that subcommand.
+//
+// Failures terminate the program with one of the exit codes documented in exitcodes.go, so that
+// scripts can tell e.g. a usage error from a missing Administrator privilege.
 //
 // Usage:
 //     To use this program, run it from the command line with one or more of the defined flags.
 //     For example, to start the server, you would run:
 //         go run main.go -start
 func main() {
-	var config appConfig
 	configExists := false
 
 	startService := flag.Bool("start", false, "Starts Wireguard Server")
@@ -145,23 +400,119 @@ func main() {
 	addPeer := flag.Bool("add", false,
 		"Adds new Wireguard peer and client config file. Creates server config file if not available.")
 	configIdx := flag.Int("qrcode", -1, "Display QR code for the specified configuration")
+	showText := flag.Bool("text", false, "Also print the configuration text together with the QR code")
+	flag.IntVar(&maxQrVersion, "qrmaxversion", defaultMaxQrVersion,
+		"Largest QR code version (1-40) to display, longer configurations are not shown as QR code")
+	force := flag.Bool("force", false, "Overwrite existing configuration files without asking")
+	dnsOnly := flag.Bool("dnsonly", false, "With -add, route only the DNS servers of the new client through the tunnel")
+	serverFile := flag.String("serverfile", "",
+		"With -add creating a new configuration, file name of the server configuration (e.g. wg0.conf)")
+	junk := flag.Bool("junk", false, "With -add, send junk packets before the handshake (requires an AmneziaWG client)")
+	group := flag.String("group", "", "With -add, puts the new client into this group and applies the group defaults")
+	role := flag.String("role", clientRoleMobile,
+		"With -add, mobile for clients behind NAT or public for clients with a public endpoint, e.g. site-to-site routers")
+	serverKeepalive := flag.String("serverkeepalive", "",
+		"With -add, PersistentKeepalive in seconds of the server peer entry of the new client, for clients behind NAT")
+	flag.StringVar(&bindAddress, "bind", "",
+		"With -add creating a new configuration, local address the server is bound to (default all addresses)")
+	flag.StringVar(&servicePortRange, "portrange", defaultServicePortRange,
+		"With -add creating a new configuration, range of UDP ports preferred for the server")
+	flag.IntVar(&portRetry.Attempts, "portretries", portRetry.Attempts,
+		"With -start, how often to check a listen port still held by a just-stopped tunnel service")
+	flag.DurationVar(&portRetry.Backoff, "portbackoff", portRetry.Backoff,
+		"With -start, time to wait between the checks of the listen port")
+
+	// Global options, also accepted together with the subcommands
+	flag.BoolVar(&quietMode, "quiet", false,
+		"Suppresses informational output and prompts, accepting defaults and confirmations")
+	flag.BoolVar(&verboseMode, "verbose", false,
+		"Prints details for debugging, e.g. the size and QR code version of a client configuration")
+	flag.BoolVar(&assumeYes, "yes", false, "Answers yes to all confirmations")
+	flag.BoolVar(&skipRoundTrip, "no-roundtrip", false,
+		"Skips parsing every generated config back to check it, for very large bulk runs")
+	flag.BoolVar(&applyChanges, "apply", true,
+		"Writes the configuration files of a change right away, -apply=false stages it until 'apply'")
+	flag.StringVar(&outputFormat, "format", "text", "Output format of the results, text or json")
+	flag.StringVar(&configPathOverride, "config-path", "", "Profile directory of the state and configuration files")
+	flag.StringVar(&profileName, "profile", "",
+		"Named profile under %PROGRAMDATA%\\wg-quick-config (default %ALLUSERSPROFILE%\\NT KERNEL\\WireSock VPN Gateway)")
+	flag.StringVar(&proxySetting, "proxy", "",
+		"Proxy of the external IP detection and DDNS updates, a URL, system for the Windows settings or none (default HTTP(S)_PROXY)")
+	flag.StringVar(&cloudMetadataSetting, "cloud-metadata", cloudMetadataAuto,
+		"Instance metadata service asked for the external IP address first, auto for the cloud of the host, aws, azure, gcp, hetzner or off")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		printCommandsUsage()
+		printExitCodes()
+	}
 
-	if len(os.Args) == 1 {
+	args, err := parseGlobalFlags(os.Args[1:])
+	if err != nil {
+		fatal(err)
+	}
+	// The bare executable on a console starts the guided mode, elsewhere it prints the usage
+	guided := len(os.Args) == 1 && !quietMode && isTerminal(os.Stdin) && isTerminal(os.Stdout)
+	if len(os.Args) == 1 && !guided {
 		flag.Usage()
 		return
 	}
-	flag.Parse()
 
-	configFilePath := os.Getenv("ALLUSERSPROFILE") + "\\NT KERNEL\\WireSock VPN Gateway\\"
+	configFilePath, err := resolveProfileDir()
+	if err != nil {
+		fatal(err)
+	}
+	removeStaleTempFiles(configFilePath)
+
+	if guided {
+		if args = runGuidedMode(configFilePath); args == nil {
+			return
+		}
+	}
 
-	jsonConfig, err := ioutil.ReadFile(configFilePath + "config.json")
+	if len(args) > 0 {
+		if cmd := findCommand(args[0]); cmd != nil {
+			if cmd.readOnly == nil || !cmd.readOnly(args[1:]) {
+				if err = checkProfileWritable(configFilePath); err != nil {
+					fatal(fmt.Errorf("%s: %w", cmd.name, err))
+				}
+			}
+			err := cmd.run(configFilePath, args[1:])
+			if errors.Is(err, flag.ErrHelp) {
+				return
+			}
+			if err != nil {
+				fatal(fmt.Errorf("%s: %w", cmd.name, err))
+			}
+			return
+		}
+	}
 
-	if err == nil {
-		err = json.Unmarshal(jsonConfig, &config)
-		if err == nil {
-			fmt.Println("Existing configuration loaded successfully.")
-			configExists = true
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err = parseFlags(flag.CommandLine, "", args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
 		}
+		fatal(err)
+	}
+	if maxQrVersion < 1 || maxQrVersion > 40 {
+		fatal(newError(errUsage, "invalid -qrmaxversion %d, expected a number between 1 and 40", maxQrVersion))
+	}
+	if _, err = parsePortRange(servicePortRange); err != nil {
+		fatal(err)
+	}
+	if bindAddress != "" && net.ParseIP(bindAddress) == nil {
+		fatal(newError(errUsage, "invalid -bind address '%s', expected an IPv4 or IPv6 address", bindAddress))
+	}
+
+	config, err := loadAppConfig(configFilePath)
+	if errors.Is(err, errUnsupportedSchema) {
+		fatal(err)
+	}
+	if err == nil {
+		fmt.Println("Existing configuration loaded successfully.")
+		configExists = true
 	}
 
 	if *configIdx != -1 {
@@ -173,32 +524,135 @@ func main() {
 			fmt.Println("Can't display QR code. Requested client index does not exist.")
 			return
 		}
-		config.showClientQrCode(*configIdx - 1)
+		if *showText {
+			config.showClientConfigAndQrCode(*configIdx - 1)
+		} else {
+			config.showClientQrCode(*configIdx - 1)
+		}
+		if config.recordStatus(configFilePath, *configIdx-1, statusDelivered, "QR code shown", time.Now()) {
+			config.saveStatus(configFilePath)
+		}
 		return
 	}
 
+	// Everything below may change the profile
+	if err = checkProfileWritable(configFilePath); err != nil {
+		fatal(err)
+	}
+
 	if *addPeer {
 		if !configExists {
 			fmt.Println("Failed to load existing configuration. Starting creating a new one.!")
+			imported, err := checkForeignConfigFiles(configFilePath, *force)
+			if err != nil {
+				fatal(fmt.Errorf("Failed to generate new configuration: %w", err))
+			}
+			if imported {
+				if config, err = loadAppConfig(configFilePath); err != nil {
+					fatal(fmt.Errorf("failed to load the imported configuration: %w", err))
+				}
+				configExists = true
+			}
+		}
+		if !configExists {
+			if *serverFile != "" {
+				if err = validateServerConfigFileName(*serverFile); err != nil {
+					fatal(err)
+				}
+				config.ServerConfigFile = *serverFile
+			}
 			err = newConfig(&config)
 			if err != nil {
-				log.Fatalf("Failed to generate new configuration: %s", err.Error())
+				fatal(fmt.Errorf("Failed to generate new configuration: %w", err))
+			}
+			if err = checkArtifactCollisions(configFilePath, config); err != nil {
+				fatal(err)
+			}
+			for _, warning := range config.wireguardConflicts(newExecutor()) {
+				fmt.Println("Warning:", warning)
 			}
 		} else {
 			fmt.Println("Trying to add new Wireguard client.")
-			config.addClient()
+			if err = config.addClient(); err != nil {
+				fatal(fmt.Errorf("Failed to add new client: %w", err))
+			}
 		}
 
-		config.updateWireguardConfigFiles(configFilePath)
+		if *group != "" {
+			if err = config.ensureGroup(*group); err != nil {
+				fatal(err)
+			}
+			index := len(config.Clients) - 1
+			config.clientInfo(index).Group = *group
+			config.defaultsForGroup(*group).applyTo(&config.Clients[index])
+			config.ensureServerAddressAllowed(&config.Clients[index])
+		}
+		config.setClientExpiry(len(config.Clients)-1, time.Now())
+
+		if *dnsOnly {
+			if err = config.makeDnsOnlyClient(len(config.Clients) - 1); err != nil {
+				fatal(err)
+			}
+		}
+
+		if *junk {
+			client := &config.Clients[len(config.Clients)-1]
+			client.Jc, client.Jmin, client.Jmax = randomJunkParameters()
+		}
+
+		clientRole, err := parseClientRole(*role)
+		if err != nil {
+			fatal(err)
+		}
+		if clientRole != clientRoleMobile {
+			config.setClientRole(len(config.Clients)-1, clientRole)
+		}
+
+		if *serverKeepalive != "" {
+			keepalive, err := parsePersistentKeepalive(*serverKeepalive)
+			if err != nil {
+				fatal(err)
+			}
+			if err = config.Server.Peers[len(config.Server.Peers)-1].SetKeepalive(int(keepalive)); err != nil {
+				fatal(err)
+			}
+			config.clientInfo(len(config.Clients) - 1).addOverride("serverkeepalive")
+		}
+
+		for _, entry := range askClientMetadata() {
+			config.clientInfo(len(config.Clients) - 1).setMetadata(entry)
+		}
 
-		config.showClientQrCode(len(config.Clients) - 1)
+		if err = config.verifyConsistency(); err != nil {
+			fatal(fmt.Errorf("Inconsistent configuration: %w", err))
+		}
+
+		config.updateWireguardConfigFiles(configFilePath)
+		config.printDnsWarnings(len(config.Clients) - 1)
 
-		jsonConfig, err = json.MarshalIndent(config, "", " ")
-		if err == nil {
-			err = ioutil.WriteFile(configFilePath+"config.json", jsonConfig, 0666)
+		if *showText {
+			config.showClientConfigAndQrCode(len(config.Clients) - 1)
 		} else {
-			fmt.Println("Failed to store the application configuration into config.json!")
+			config.showClientQrCode(len(config.Clients) - 1)
+		}
+		config.recordStatus(configFilePath, len(config.Clients)-1, statusIssued, "add", time.Now())
+		config.recordStatus(configFilePath, len(config.Clients)-1, statusDelivered, "QR code shown", time.Now())
+
+		err = config.saveWithHistory(configFilePath, "add", *startService || *restartService)
+		if err != nil {
+			fatal(newError(errIO, "failed to store the application configuration: %w", err))
 		}
+		if err = appendAuditLog(configFilePath, "add", map[string]int{"Client": len(config.Clients)}); err != nil {
+			fatal(newError(errIO, "failed to write the audit log: %w", err))
+		}
+
+		result := addResult{
+			Client:     len(config.Clients),
+			ConfigFile: configFilePath + fmt.Sprintf(defaultClientConfigFile, len(config.Clients)),
+			Address:    joinIPNets(config.Clients[len(config.Clients)-1].Address),
+			PublicKey:  config.Server.Peers[len(config.Server.Peers)-1].PublicKey,
+		}
+		printResult(fmt.Sprintf("Added client %d: %s\n", result.Client, result.ConfigFile), result)
 
 		configExists = true
 	}
@@ -209,24 +663,55 @@ func main() {
 	}
 
 	if *startService || *stopService || *restartService {
-		_, elevated, err := IsAdminElevated() // Not correct on Windows 7, so show only a warning
-		if err != nil || !elevated {
-			fmt.Println("Please note to run this application as Administrator to use Start/Stop/Restart flags.")
-		}
 		if !configExists {
-			log.Fatalf("There is no existing configuration to start/stop/restart")
+			fatal(newError(errValidation, "There is no existing configuration to start/stop/restart"))
+		}
+		if *startService && config.staged() {
+			fatal(newError(errConflict, "There are unapplied changes, run 'apply' before starting the tunnel"))
+		}
+		if err = checkTunnelDependencies(); err != nil {
+			fatal(err)
 		}
 	}
 
+	// The elevation is checked right before each step, without it the step is queued for 'finish'
 	if *stopService {
-		stopWireguardTunnel()
+		// A tunnel service that isn't installed can't be stopped, -restart starts it anyway
+		config.runPrivilegedStep(configFilePath, stepStopTunnel)
 	}
 
 	if *restartService {
 		time.Sleep(time.Second)
 	}
 
+	var startErr error
 	if *startService {
-		startWireguardTunnel(configFilePath)
+		startErr = config.runPrivilegedStep(configFilePath, stepStartTunnel)
+	}
+
+	if *startService || *stopService {
+		// Keep the follow-up steps of the setup summary up to date
+		if err = config.save(configFilePath); err != nil {
+			fatal(newError(errIO, "failed to store the application configuration: %w", err))
+		}
+	}
+	if startErr != nil {
+		fatal(startErr)
+	}
+}
+
+// isElevated tells whether the process can run privileged steps such as installing the tunnel
+// service. The elevation isn't reported correctly on Windows 7, so the steps are attempted there
+// with a note.
+func isElevated() bool {
+	if _, elevated, err := IsAdminElevated(); err == nil && elevated {
+		return true
+	}
+
+	major, minor := windowsVersion()
+	if runtime.GOOS != "windows" || major > 6 || (major == 6 && minor >= 2) {
+		return false
 	}
+	fmt.Println("Please note to run this application as Administrator to use Start/Stop/Restart flags.")
+	return true
 }
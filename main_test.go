@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartWireguardTunnelCommands(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		existing    string
+		installErr  error
+		wantInstall string
+		wantChanges []SystemChange
+		wantErr     bool
+	}{
+		{
+			name:        "new service",
+			path:        `C:\wiresock\`,
+			wantInstall: `&"wireguard.exe" /installtunnelservice 'C:\wiresock\wiresock.conf'`,
+			wantChanges: []SystemChange{{Kind: changeTunnelService, Identifier: "wiresock", CreatedByUs: true,
+				Undo: `&"wireguard.exe" /uninstalltunnelservice wiresock`}},
+		},
+		{
+			name:        "path with spaces, parentheses and $",
+			path:        `C:\Program Files (x86)\My $Configs\`,
+			wantInstall: `&"wireguard.exe" /installtunnelservice 'C:\Program Files (x86)\My $Configs\wiresock.conf'`,
+			wantChanges: []SystemChange{{Kind: changeTunnelService, Identifier: "wiresock", CreatedByUs: true,
+				Undo: `&"wireguard.exe" /uninstalltunnelservice wiresock`}},
+		},
+		{
+			name:        "path with apostrophe and non-ASCII letters",
+			path:        `C:\Users\José O'Brien\`,
+			wantInstall: `&"wireguard.exe" /installtunnelservice 'C:\Users\José O''Brien\wiresock.conf'`,
+			wantChanges: []SystemChange{{Kind: changeTunnelService, Identifier: "wiresock", CreatedByUs: true,
+				Undo: `&"wireguard.exe" /uninstalltunnelservice wiresock`}},
+		},
+		{
+			name:        "pre-existing service is not ours",
+			path:        `C:\wiresock\`,
+			existing:    "WireGuardTunnel$wiresock\r\n",
+			installErr:  errors.New("exit status 1"),
+			wantInstall: `&"wireguard.exe" /installtunnelservice 'C:\wiresock\wiresock.conf'`,
+			wantChanges: []SystemChange{{Kind: changeTunnelService, Identifier: "wiresock", CreatedByUs: false,
+				Undo: `&"wireguard.exe" /uninstalltunnelservice wiresock`}},
+			wantErr: true,
+		},
+		{
+			name:        "failed installation records nothing",
+			path:        `C:\wiresock\`,
+			installErr:  errors.New("exit status 1"),
+			wantInstall: `&"wireguard.exe" /installtunnelservice 'C:\wiresock\wiresock.conf'`,
+			wantErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ps := &fakeExecutor{Rules: []fakeRule{
+				{Match: "Get-Service -Name 'WireGuardTunnel$wiresock'", Result: Result{StdOut: test.existing}},
+				{Match: "/installtunnelservice", Result: Result{Err: test.installErr}},
+			}}
+
+			changes, err := startWireguardTunnel(ps, test.path, "wiresock.conf")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("startWireguardTunnel() error = %v, want error %v", err, test.wantErr)
+			}
+			if len(ps.Scripts) < 2 || ps.Scripts[1] != test.wantInstall {
+				t.Fatalf("install command = %q, want %q", ps.Scripts, test.wantInstall)
+			}
+			for i := range changes {
+				if changes[i].Timestamp.IsZero() {
+					t.Errorf("change %d has no timestamp", i)
+				}
+				changes[i].Timestamp = time.Time{}
+			}
+			if !reflect.DeepEqual(changes, test.wantChanges) {
+				t.Errorf("changes = %+v, want %+v", changes, test.wantChanges)
+			}
+		})
+	}
+}
+
+func TestStopWireguardTunnelCommand(t *testing.T) {
+	ps := &fakeExecutor{}
+	if err := stopWireguardTunnel(ps, "office"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`&"wireguard.exe" /uninstalltunnelservice office`}
+	if !reflect.DeepEqual(ps.Scripts, want) {
+		t.Errorf("scripts = %q, want %q", ps.Scripts, want)
+	}
+
+	failing := &fakeExecutor{Rules: []fakeRule{{Match: "/uninstalltunnelservice", Result: Result{Err: errors.New("exit status 1")}}}}
+	if err := stopWireguardTunnel(failing, "office"); err == nil {
+		t.Error("stopWireguardTunnel() ignored the failure of wireguard.exe")
+	}
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		commandLine string
+		want        []string
+	}{
+		{`"C:\Program Files\WireGuard\wireguard.exe" /tunnelservice "C:\My Configs\wg0.conf"`,
+			[]string{`C:\Program Files\WireGuard\wireguard.exe`, "/tunnelservice", `C:\My Configs\wg0.conf`}},
+		{`C:\WireGuard\wireguard.exe /tunnelservice C:\wg\wg0.conf`,
+			[]string{`C:\WireGuard\wireguard.exe`, "/tunnelservice", `C:\wg\wg0.conf`}},
+		{`  a   ""  b  `, []string{"a", "", "b"}},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		if got := splitCommandLine(test.commandLine); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitCommandLine(%q) = %q, want %q", test.commandLine, got, test.want)
+		}
+	}
+}
+
+func TestVerifyTunnelService(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "José María (Configs)")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	wireguard := filepath.Join(dir, "wireguard.exe")
+	configFile := filepath.Join(dir, "wiresock.conf")
+	for _, fileName := range []string{wireguard, configFile} {
+		if err := ioutil.WriteFile(fileName, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		imagePath Result
+		wantErr   bool
+	}{
+		{"matching command line", Result{StdOut: fmt.Sprintf("\"%s\" /tunnelservice \"%s\"\r\n", wireguard, configFile)}, false},
+		{"query failed", Result{Err: errors.New("exit status 1")}, false},
+		{"no image path", Result{}, false},
+		{"path split at the space", Result{StdOut: fmt.Sprintf("\"%s\" /tunnelservice %s", wireguard, configFile)}, true},
+		{"mangled letters", Result{StdOut: fmt.Sprintf("\"%s\" /tunnelservice \"%s\"", wireguard,
+			strings.ReplaceAll(configFile, "é", "Ã©"))}, true},
+		{"missing program", Result{StdOut: fmt.Sprintf("\"%s\" /tunnelservice \"%s\"", wireguard+".old", configFile)}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ps := &fakeExecutor{Rules: []fakeRule{{Match: "ImagePath", Result: test.imagePath}}}
+			err := verifyTunnelService(ps, "wiresock", configFile)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("verifyTunnelService() error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil && exitCode(err) != exitDependency {
+				t.Errorf("exitCode(%v) = %d, want %d", err, exitCode(err), exitDependency)
+			}
+			want := `(Get-ItemProperty -LiteralPath 'HKLM:\SYSTEM\CurrentControlSet\Services\WireGuardTunnel$wiresock' -Name ImagePath).ImagePath`
+			if len(ps.Scripts) != 1 || ps.Scripts[0] != want {
+				t.Errorf("scripts = %q, want %q", ps.Scripts, want)
+			}
+		})
+	}
+}
+
+// holdUdpPort binds a free UDP port on the loopback address for the duration of the test.
+func holdUdpPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestCheckListenPortAvailable(t *testing.T) {
+	fakeWindowsHost(t)
+	port := holdUdpPort(t)
+
+	tests := []struct {
+		name       string
+		rules      []fakeRule
+		wantSleeps int
+		wantErr    string
+	}{
+		{
+			name: "held by the tunnel itself",
+			rules: []fakeRule{{Match: "Get-NetUDPEndpoint | ForEach-Object",
+				Result: Result{StdOut: fmt.Sprintf("wiresock\t%d\n", port)}}},
+		},
+		{
+			name: "held by a lingering tunnel service",
+			rules: []fakeRule{{Match: "Get-NetUDPEndpoint | ForEach-Object",
+				Result: Result{StdOut: fmt.Sprintf("wireguard\t%d\n", port)}}},
+			wantSleeps: 3,
+			wantErr:    "still in use by the Wireguard instance 'wireguard' after 4 attempts",
+		},
+		{
+			name: "held by an unrelated process",
+			rules: []fakeRule{{Match: fmt.Sprintf("Get-NetUDPEndpoint -LocalPort %d", port),
+				Result: Result{StdOut: "dnscrypt-proxy (PID 4242)\r\n"}}},
+			wantErr: "in use by dnscrypt-proxy (PID 4242), stop it",
+		},
+		{
+			name:       "owner gone",
+			wantSleeps: 3,
+			wantErr:    "still in use by another application after 4 attempts",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sleeps []time.Duration
+			retry := listenPortRetry{Attempts: 4, Backoff: 250 * time.Millisecond,
+				Sleep: func(d time.Duration) { sleeps = append(sleeps, d) }}
+
+			err := checkListenPortAvailable(&fakeExecutor{Rules: test.rules}, "127.0.0.1", port, "wiresock", retry)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("checkListenPortAvailable() = %v, want nil", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("checkListenPortAvailable() = %v, want %q", err, test.wantErr)
+			}
+			if err != nil && exitCode(err) != exitConflict {
+				t.Errorf("exitCode(%v) = %d, want %d", err, exitCode(err), exitConflict)
+			}
+			if len(sleeps) != test.wantSleeps {
+				t.Errorf("slept %d times, want %d", len(sleeps), test.wantSleeps)
+			}
+			for _, d := range sleeps {
+				if d != retry.Backoff {
+					t.Errorf("slept %v, want the backoff %v", d, retry.Backoff)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckListenPortAvailableFreePort(t *testing.T) {
+	fakeWindowsHost(t)
+	port := holdUdpPort(t)
+	ps := &fakeExecutor{}
+
+	// The port is free on an other address than the one held
+	retry := listenPortRetry{Attempts: 3, Sleep: func(time.Duration) { t.Error("slept on a free port") }}
+	if err := checkListenPortAvailable(ps, "127.0.0.2", port, "wiresock", retry); err != nil {
+		t.Skipf("127.0.0.2 isn't usable here: %v", err)
+	}
+	if len(ps.Scripts) != 0 {
+		t.Errorf("queried the port owner of a free port: %q", ps.Scripts)
+	}
+}
+
+func TestCheckListenPortAvailableReleased(t *testing.T) {
+	fakeWindowsHost(t)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	// The stopped tunnel service releases the port while the check waits
+	sleeps := 0
+	retry := listenPortRetry{Attempts: 5, Backoff: time.Second, Sleep: func(time.Duration) {
+		if sleeps++; sleeps == 2 {
+			conn.Close()
+		}
+	}}
+	ps := &fakeExecutor{Rules: []fakeRule{{Match: "Get-NetUDPEndpoint | ForEach-Object",
+		Result: Result{StdOut: fmt.Sprintf("wiresock-old\t%d\n", port)}}}}
+
+	if err = checkListenPortAvailable(ps, "127.0.0.1", port, "wiresock", retry); err != nil {
+		t.Fatalf("checkListenPortAvailable() = %v, want nil once the port is released", err)
+	}
+	if sleeps != 2 {
+		t.Errorf("slept %d times, want 2", sleeps)
+	}
+}
+
+func TestPortRetryDefault(t *testing.T) {
+	// A stopped tunnel service takes a few seconds to release the port, about 10s are waited
+	if total := time.Duration(portRetry.Attempts) * portRetry.Backoff; total < 5*time.Second || total > 15*time.Second {
+		t.Errorf("the default retry waits %v", total)
+	}
+}
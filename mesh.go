@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const defaultMeshConfigFile = "wsmesh_%d.conf"
+
+// NewWireguardMeshConfigs creates the configurations of a full mesh Wireguard network, where every
+// node has every other node as a peer. Unlike the server/client model there is no hub: each node
+// listens on the port of its own endpoint and connects directly to all the others.
+//
+// Node addresses are allocated sequentially from the first host address of the subnet. Each peer
+// entry allows only the /32 tunnel address of the corresponding node and uses its endpoint.
+//
+// Parameters:
+//     subnet (*net.IPNet): The IPv4 subnet the node addresses are allocated from.
+//     endpoints ([]string): The public "Host:Port" endpoint of every node, one per node.
+//     persistentKeepalive (uint32): The keepalive set on every peer entry, 0 disables it.
+//
+// Returns:
+//     []WireguardConfig: The configurations of the nodes, in the order of the endpoints.
+//     error: An error if the endpoints are invalid or the subnet is too small.
+//
+// Usage:
+//     configs, err := NewWireguardMeshConfigs(subnet, []string{"a.example.com:51820", "b.example.com:51820"}, 25)
+func NewWireguardMeshConfigs(subnet *net.IPNet, endpoints []string, persistentKeepalive uint32) ([]WireguardConfig, error) {
+	if len(endpoints) < 2 {
+		return nil, newError(errUsage, "a mesh requires at least two nodes")
+	}
+
+	keys := make([]WireguardPrivateKey, len(endpoints))
+	addresses := make([]net.IPNet, len(endpoints))
+	ports := make([]uint16, len(endpoints))
+
+	ip := subnet.IP
+	for i, endpoint := range endpoints {
+		_, portString, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			return nil, newError(errValidation, "invalid endpoint '%s': %w", endpoint, err)
+		}
+		var node Interface
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return nil, newError(errValidation, "invalid port in endpoint '%s'", endpoint)
+		}
+		if err = node.SetListenPort(port); err != nil {
+			return nil, newError(errValidation, "endpoint '%s': %w", endpoint, err)
+		}
+		ports[i] = node.ListenPort
+
+		// Allocate the next host address, leaving out the broadcast address
+		ip = NextIP(ip)
+		if !subnet.Contains(ip) || !subnet.Contains(NextIP(ip)) {
+			return nil, newError(errConflict, "subnet %s is too small for %d nodes", subnet.String(), len(endpoints))
+		}
+		addresses[i] = net.IPNet{IP: ip, Mask: subnet.Mask}
+
+		keys[i], err = newWireguardPrivateKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	configs := make([]WireguardConfig, len(endpoints))
+	for i := range configs {
+		configs[i] = NewWireguardServerConfig(keys[i].base64PrivateKey(), addresses[i:i+1], ports[i])
+
+		for j := range endpoints {
+			if i == j {
+				continue
+			}
+			peer := configs[i].AddPeer(keys[j].base64PublicKey(), clientIpNetToPeer(addresses[j:j+1]))
+			peer.Endpoint = endpoints[j]
+			peer.PersistentKeepalive = persistentKeepalive
+		}
+	}
+
+	return configs, nil
+}
+
+// runMeshCommand implements the 'mesh' command, which generates the configuration files of a full
+// mesh network into the configuration directory:
+//
+//     mesh 10.10.0.0/24 a.example.com:51820 b.example.com:51820 c.example.com:51820
+//
+// The generated files are independent of config.json and of the server/client configuration.
+func runMeshCommand(configPath string, args []string) error {
+	if len(args) < 3 {
+		return newError(errUsage, "usage: mesh <subnet> <endpoint> <endpoint>...")
+	}
+
+	_, subnet, err := net.ParseCIDR(args[0])
+	if err != nil || subnet.IP.To4() == nil {
+		return newError(errValidation, "invalid IPv4 subnet '%s'", args[0])
+	}
+
+	configs, err := NewWireguardMeshConfigs(subnet, args[1:], defaultPersistentKeepalive)
+	if err != nil {
+		return err
+	}
+
+	for i, config := range configs {
+		fileName := fmt.Sprintf(defaultMeshConfigFile, i+1)
+
+		content, _, err := config.Render(outputWgQuick)
+		if err == nil {
+			_, err = writeGeneratedFile(configPath+fileName, content, 0666)
+		}
+		if err != nil {
+			return fmt.Errorf("can't write mesh node config into %s: %w", configPath+fileName, err)
+		}
+		fmt.Printf("Successfully saved mesh node configuration for %s: %s\n", args[i+1], configPath+fileName)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNewWireguardMeshConfigs(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.10.0.0/24")
+	endpoints := []string{"a.example.com:51820", "b.example.com:51821", "[2606:4700:10::6816:1]:51822"}
+	configs, err := NewWireguardMeshConfigs(subnet, endpoints, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 3 {
+		t.Fatalf("%d configurations for 3 nodes", len(configs))
+	}
+
+	publicKeys := make([]string, len(configs))
+	for i, config := range configs {
+		if publicKeys[i], err = base64PublicKeyFromPrivate(config.PrivateKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every node listens on the port of its endpoint and has every other node as a peer, routing
+	// only the tunnel address of that node to it
+	wantAddresses := []string{"10.10.0.1/24", "10.10.0.2/24", "10.10.0.3/24"}
+	wantPorts := []uint16{51820, 51821, 51822}
+	for i, config := range configs {
+		if joinIPNets(config.Address) != wantAddresses[i] || config.ListenPort != wantPorts[i] {
+			t.Errorf("node %d: address %s, port %d, want %s and %d", i+1, joinIPNets(config.Address),
+				config.ListenPort, wantAddresses[i], wantPorts[i])
+		}
+
+		var peers []int
+		for j := range configs {
+			if j != i {
+				peers = append(peers, j)
+			}
+		}
+		if len(config.Peers) != len(peers) {
+			t.Fatalf("node %d has %d peers, want %d", i+1, len(config.Peers), len(peers))
+		}
+		for k, j := range peers {
+			peer := config.Peers[k]
+			wantAllowed := strings.Replace(wantAddresses[j], "/24", "/32", 1)
+			if peer.PublicKey != publicKeys[j] || joinIPNets(peer.AllowedIPs) != wantAllowed ||
+				peer.Endpoint != endpoints[j] || peer.PersistentKeepalive != 25 {
+				t.Errorf("node %d, peer %d: %+v, want node %d at %s through %s", i+1, k+1, peer, j+1, wantAllowed, endpoints[j])
+			}
+		}
+	}
+}
+
+func TestNewWireguardMeshConfigsErrors(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.10.0.0/30")
+	if _, err := NewWireguardMeshConfigs(subnet, []string{"a.example.com:51820"}, 25); exitCode(err) != exitUsage {
+		t.Errorf("a single node = %v, want a usage error", err)
+	}
+	// A /30 has room for two nodes
+	if _, err := NewWireguardMeshConfigs(subnet, []string{"a.example.com:51820", "b.example.com:51820"}, 25); err != nil {
+		t.Errorf("two nodes in a /30 = %v", err)
+	}
+	_, err := NewWireguardMeshConfigs(subnet, []string{"a.example.com:51820", "b.example.com:51820", "c.example.com:51820"}, 25)
+	if exitCode(err) != exitConflict || !strings.Contains(err.Error(), "too small for 3 nodes") {
+		t.Errorf("three nodes in a /30 = %v, want a conflict", err)
+	}
+	_, subnet, _ = net.ParseCIDR("10.10.0.0/24")
+	if _, err = NewWireguardMeshConfigs(subnet, []string{"a.example.com", "b.example.com:51820"}, 25); exitCode(err) != exitValidation {
+		t.Errorf("an endpoint without port = %v, want a validation error", err)
+	}
+}
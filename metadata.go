@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// metadataEntry is a free-form key/value annotation of a client, such as its location or owner.
+type metadataEntry struct {
+	Key   string
+	Value string
+}
+
+// String returns the entry as it is emitted in the configuration file comments.
+func (entry metadataEntry) String() string {
+	return fmt.Sprintf("%s: %s", entry.Key, entry.Value)
+}
+
+// parseMetadataEntry parses a "Key=Value" or "Key: Value" annotation.
+func parseMetadataEntry(input string) (metadataEntry, error) {
+	separator := strings.IndexAny(input, "=:")
+	if separator < 0 {
+		return metadataEntry{}, newError(errValidation, "invalid metadata '%s', expected Key=Value", input)
+	}
+
+	entry := metadataEntry{
+		Key:   strings.TrimSpace(input[:separator]),
+		Value: strings.TrimSpace(input[separator+1:]),
+	}
+	if entry.Key == "" || strings.ContainsAny(entry.Key+entry.Value, "\r\n") {
+		return metadataEntry{}, newError(errValidation, "invalid metadata '%s', expected Key=Value", input)
+	}
+
+	return entry, nil
+}
+
+// setMetadata adds the entry to the client metadata, replacing any entry with the same key.
+func (info *clientInfo) setMetadata(entry metadataEntry) {
+	for i := range info.Metadata {
+		if strings.EqualFold(info.Metadata[i].Key, entry.Key) {
+			info.Metadata[i] = entry
+			return
+		}
+	}
+
+	info.Metadata = append(info.Metadata, entry)
+}
+
+// metadataComments returns the group and the metadata of the client with the given index as
+// comment lines.
+func (config *appConfig) metadataComments(index int) []string {
+	if index >= len(config.ClientsInfo) {
+		return nil
+	}
+
+	var comments []string
+	if group := config.ClientsInfo[index].Group; group != "" {
+		comments = append(comments, "Group: "+group)
+	}
+	for _, entry := range config.ClientsInfo[index].Metadata {
+		comments = append(comments, entry.String())
+	}
+
+	return comments
+}
+
+// clientFileConfig returns the configuration of the client with the given index as it is written
+// into its file, with the client metadata emitted as header comments, followed by a reminder to add
+// the private key for clients with an external key. The secondary endpoints of the server are
+// listed above the [Peer] section of the server.
+func (config *appConfig) clientFileConfig(index int) WireguardConfig {
+	client := config.Clients[index]
+	client.Comments = append(config.metadataComments(index), client.Comments...)
+	if client.PrivateKey == "" {
+		client.Comments = append(client.Comments, "External key: add the PrivateKey of this device to the [Interface] section.")
+	}
+	if len(config.SecondaryEndpoints) > 0 && len(client.Peers) > 0 {
+		client.Peers = append([]Peer(nil), client.Peers...)
+		client.Peers[0].Comments = append(append([]string(nil), client.Peers[0].Comments...), config.alternateEndpointComments()...)
+	}
+
+	return client
+}
+
+// serverFileConfig returns the server configuration as it is written into its file, with the
+// metadata of every client emitted as comments above the corresponding [Peer] section, and the
+// masquerade rules of natRules, if enabled, in place of any stored PostUp and PostDown commands.
+// A bind address is noted in a header comment.
+func (config *appConfig) serverFileConfig() WireguardConfig {
+	server := config.Server
+	server.Peers = append([]Peer(nil), config.Server.Peers...)
+	if config.BindAddress != "" {
+		// Wireguard has no setting of its own for the bind address, keep it visible next to the port
+		server.Comments = append([]string{fmt.Sprintf("Bind address: %s, UDP port %d", config.BindAddress,
+			config.Server.ListenPort)}, server.Comments...)
+	}
+	if config.NatInterface != "" {
+		server.PostUp, server.PostDown = config.natRules()
+	}
+
+	for i := range server.Peers {
+		if i < len(config.Clients) {
+			server.Peers[i].Comments = append(config.metadataComments(i), server.Peers[i].Comments...)
+		}
+	}
+
+	return server
+}
+
+// readMetadataFile reads client metadata from a file holding one "Key: Value" or "Key=Value"
+// annotation per line. Empty lines and lines starting with '#' are ignored.
+func readMetadataFile(fileName string) ([]metadataEntry, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []metadataEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		entry, err := parseMetadataEntry(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fileName, line, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// runMetadataCommand implements the 'metadata' command, which shows or edits the free-form
+// annotations of a client and regenerates the affected configuration files:
+//
+//     metadata 2
+//     metadata 2 Location=NYC Owner=alice@corp
+//     metadata 2 --file annotations.txt
+//     metadata 2 --clear
+func runMetadataCommand(configPath string, args []string) error {
+	if len(args) < 1 {
+		return newError(errUsage, "usage: metadata <client> [--file path] [--clear] [Key=Value...]")
+	}
+
+	flags := flag.NewFlagSet("metadata", flag.ContinueOnError)
+	file := flags.String("file", "", "Read Key: Value annotations from this file, one per line")
+	clear := flags.Bool("clear", false, "Remove all the annotations of the client")
+
+	if err := parseFlags(flags, "metadata", args[1:]); err != nil {
+		return err
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	selected, err := config.parseClientSelection(args[0])
+	if err != nil {
+		return err
+	}
+	if len(selected) != 1 {
+		return newError(errUsage, "metadata applies to a single client")
+	}
+	index := selected[0]
+	info := config.clientInfo(index)
+
+	var entries []metadataEntry
+	if *file != "" {
+		if entries, err = readMetadataFile(*file); err != nil {
+			return err
+		}
+	}
+	for _, arg := range flags.Args() {
+		entry, err := parseMetadataEntry(arg)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+
+	if !*clear && len(entries) == 0 {
+		for _, entry := range info.Metadata {
+			fmt.Println(entry)
+		}
+		return nil
+	}
+
+	if *clear {
+		info.Metadata = nil
+	}
+	for _, entry := range entries {
+		info.setMetadata(entry)
+	}
+
+	clientFileName, err := config.writeClientConfigFile(configPath, index)
+	if err != nil {
+		return err
+	}
+	fmt.Println(config.savedMessage("client configuration", clientFileName))
+
+	serverFileName, err := config.writeServerConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println(config.savedMessage("server configuration", serverFileName))
+
+	if err = config.saveWithHistory(configPath, "metadata", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, "metadata", map[string]interface{}{"Client": index + 1, "Metadata": info.Metadata})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Bytes added by Wireguard to every tunneled packet, including the outer IP and UDP headers.
+const (
+	wireguardOverheadIPv4 = 60
+	wireguardOverheadIPv6 = 80
+)
+
+// wireguardDefaultMtu is the MTU Wireguard uses for an interface without an MTU setting.
+const wireguardDefaultMtu = 1420
+
+// pathMtuProbeTimeout bounds the whole path MTU probe, each ping waits at most a second.
+const pathMtuProbeTimeout = 30 * time.Second
+
+// effectiveMtu returns the MTU a Wireguard interface actually uses for the configured value.
+func effectiveMtu(mtu uint16) int {
+	if mtu == 0 {
+		return wireguardDefaultMtu
+	}
+
+	return int(mtu)
+}
+
+// suggestedMtu returns the largest tunnel MTU that doesn't fragment over a path with the given
+// MTU, e.g. 1432 for the 1492 bytes of a PPPoE line carrying IPv4.
+//
+// Parameters:
+//     pathMtu (int): The path MTU towards the endpoint.
+//     ipv6 (bool): Whether the tunnel is carried over IPv6.
+//
+// Returns:
+//     int: The suggested tunnel MTU.
+//
+// Usage:
+//     mtu := suggestedMtu(1492, false) // 1432
+func suggestedMtu(pathMtu int, ipv6 bool) int {
+	if ipv6 {
+		return pathMtu - wireguardOverheadIPv6
+	}
+
+	return pathMtu - wireguardOverheadIPv4
+}
+
+// pingDontFragment sends a single ping with the given payload size, which must not be
+// fragmented on the way, and reports whether it was answered within two seconds. On Windows
+// ping.exe is run through PowerShell, elsewhere the system ping.
+func pingDontFragment(ps Executor, ip net.IP, payload int) bool {
+	ipv6 := ip.To4() == nil
+	size := strconv.Itoa(payload)
+
+	if windowsHost {
+		// IPv6 routers never fragment, -f only exists for IPv4
+		args := "ping.exe -n 1 -w 1000 -l " + size
+		if ipv6 {
+			args += " -6 "
+		} else {
+			args += " -4 -f "
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		return ps.Execute(ctx, args+ip.String()+"; exit $LASTEXITCODE").Err == nil
+	}
+
+	args := []string{"-c", "1", "-W", "1", "-s", size, "-M", "do"}
+	if ipv6 {
+		args = append(args, "-6")
+	}
+	return exec.Command("ping", append(args, ip.String())...).Run() == nil
+}
+
+// probePathMtu finds the path MTU towards a host with a binary search over the size of
+// unfragmentable pings, bounded by pathMtuProbeTimeout. The probe is best effort: hosts or
+// networks that drop ICMP give no result, and a router in the path may still lower the MTU later.
+//
+// Parameters:
+//     ps (Executor): Runs ping.exe on Windows, see NewPowerShell.
+//     host (string): The host name or IP address to probe.
+//
+// Returns:
+//     int: The path MTU, including the IP header.
+//     bool: Whether the path is IPv6.
+//     error: An error if the host can't be resolved or doesn't answer pings.
+//
+// Usage:
+//     pathMtu, ipv6, err := probePathMtu(NewPowerShell(), "vpn.example.com")
+func probePathMtu(ps Executor, host string) (int, bool, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return 0, false, fmt.Errorf("can't resolve %s", host)
+		}
+		ip = ips[0]
+	}
+
+	// IP and ICMP header bytes on top of the ping payload
+	ipv6 := ip.To4() == nil
+	headers, low := 28, minMtu
+	if ipv6 {
+		headers, low = 48, 1280
+	}
+	high := 1500
+
+	progress := startSpinner("Probing the path MTU towards " + host)
+	defer progress.Stop()
+
+	deadline := time.Now().Add(pathMtuProbeTimeout)
+	if !pingDontFragment(ps, ip, low-headers) {
+		return 0, ipv6, fmt.Errorf("%s doesn't answer ping, the path MTU can't be probed", host)
+	}
+	for low < high && time.Now().Before(deadline) {
+		middle := (low + high + 1) / 2
+		if pingDontFragment(ps, ip, middle-headers) {
+			low = middle
+		} else {
+			high = middle - 1
+		}
+	}
+	if low < high {
+		return low, ipv6, fmt.Errorf("the probe timed out, the path MTU is at least %d", low)
+	}
+
+	return low, ipv6, nil
+}
+
+// mtuWarnings reports MTU settings of the server and the clients that don't fit together, and
+// clients whose MTU exceeds the suggestion derived from a probed path MTU, if one is given.
+//
+// Parameters:
+//     suggestion (int): The suggested client MTU, 0 if the path wasn't probed.
+//
+// Returns:
+//     []string: The warnings, empty if the MTUs are consistent.
+func (config *appConfig) mtuWarnings(suggestion int) []string {
+	var warnings []string
+
+	serverMtu := effectiveMtu(config.Server.MTU)
+	for i, client := range config.Clients {
+		clientMtu := effectiveMtu(client.MTU)
+		if clientMtu != serverMtu {
+			warnings = append(warnings, fmt.Sprintf("client %d uses MTU %d but the server uses %d, see 'set-server mtu=auto'",
+				i+1, clientMtu, serverMtu))
+		}
+		if suggestion > 0 && clientMtu > suggestion {
+			warnings = append(warnings, fmt.Sprintf("client %d uses MTU %d, more than the %d the probed path allows",
+				i+1, clientMtu, suggestion))
+		}
+	}
+	if suggestion > 0 && serverMtu > suggestion {
+		warnings = append(warnings, fmt.Sprintf("the server uses MTU %d, more than the %d the probed path allows",
+			serverMtu, suggestion))
+	}
+
+	return warnings
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Naming schemes of the artifacts derived from a profile, recorded in config.json so that an
+// existing profile keeps the names its tunnel service and firewall rule were created with.
+const (
+	// namingSchemeLegacy names the artifacts like a single instance per host: wiresock.conf, the
+	// wiresock tunnel and the "Wireguard <port>" firewall rule.
+	namingSchemeLegacy = 0
+	// namingSchemeInstance tags every artifact with the instance name, so that several instances
+	// coexist on one host: office.conf, the office tunnel and the "Wireguard office" firewall rule.
+	namingSchemeInstance = 1
+)
+
+// Kinds of artifacts derived from a profile, see artifactName.
+const (
+	artifactServerConfig  = "server config file"
+	artifactTunnelService = "tunnel service"
+	artifactFirewallRule  = "firewall rule"
+)
+
+// artifactKinds are the artifacts that must be unique on the host, checked by checkArtifactCollisions.
+var artifactKinds = []string{artifactTunnelService, artifactFirewallRule}
+
+// artifactName is the single place deriving the names of the artifacts of a profile on the host.
+// With namingSchemeInstance the names carry the instance name, otherwise the legacy names of a
+// single instance are kept. A server config file name chosen explicitly always wins, and the
+// tunnel service is named after that file.
+//
+// Parameters:
+//     kind (string): The artifact, e.g. artifactTunnelService.
+//
+// Returns:
+//     string: The name of the artifact, e.g. office for the tunnel service of the office instance.
+//
+// Usage:
+//     rule := config.artifactName(artifactFirewallRule)
+func (config *appConfig) artifactName(kind string) string {
+	tagged := config.NamingScheme >= namingSchemeInstance && config.Instance != ""
+
+	switch kind {
+	case artifactServerConfig:
+		switch {
+		case config.ServerConfigFile != "":
+			return config.ServerConfigFile
+		case tagged:
+			return config.Instance + ".conf"
+		}
+		return defaultServerConfigFile
+	case artifactTunnelService:
+		return strings.TrimSuffix(config.artifactName(artifactServerConfig), ".conf")
+	case artifactFirewallRule:
+		if tagged {
+			return "Wireguard " + config.Instance
+		}
+		return fmt.Sprintf("Wireguard %d", config.Server.ListenPort)
+	}
+
+	panic("unknown artifact kind " + kind)
+}
+
+// setInstance switches a new configuration to the instance naming scheme under the given name.
+// The tunnel is named after the instance, so a name Wireguard doesn't accept as tunnel name keeps
+// the legacy names, with a warning.
+func (config *appConfig) setInstance(name string) {
+	if err := validateServerConfigFileName(name + ".conf"); err != nil {
+		fmt.Printf("Warning: the instance name '%s' can't name its tunnel, keeping the default names: %s\n", name, err)
+		return
+	}
+
+	config.Instance = name
+	config.NamingScheme = namingSchemeInstance
+}
+
+// checkArtifactCollisions verifies that the artifacts of the configuration don't take the names of
+// the artifacts of another profile on this host, e.g. two instances both naming their tunnel
+// wiresock: installing one tunnel service would replace the other, and cleaning up one instance
+// would remove the tunnel of the other.
+//
+// Parameters:
+//     configPath (string): The profile directory of the configuration, skipped in the comparison.
+//     config (appConfig): The configuration to check.
+//
+// Returns:
+//     error: A conflict error naming the artifact and the profile already using the name.
+//
+// Usage:
+//     if err := checkArtifactCollisions(configPath, config); err != nil { return err }
+func checkArtifactCollisions(configPath string, config appConfig) error {
+	for _, profile := range listProfiles(configPath) {
+		if profile.Current || !profile.Configured {
+			continue
+		}
+		other, err := loadAppConfig(strings.TrimRight(profile.Path, `\/`) + string(filepath.Separator))
+		if err != nil {
+			continue
+		}
+		for _, kind := range artifactKinds {
+			if name := config.artifactName(kind); strings.EqualFold(name, other.artifactName(kind)) {
+				return newError(errConflict, "the %s name '%s' is already used by the profile %s (%s), "+
+					"give this instance another server config file name with 'set-server file=<name>.conf'",
+					kind, name, profile.Name, profile.Path)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// linuxRouteTable is the IPv4 routing table of Linux, one route per line with hexadecimal fields.
+const linuxRouteTable = "/proc/net/route"
+
+// parseDefaultRouteInterface returns the interface of the IPv4 default route from the content of
+// /proc/net/route, the route with destination and mask 00000000. With several default routes the
+// one with the lowest metric wins.
+//
+// Parameters:
+//     table (string): The content of /proc/net/route.
+//
+// Returns:
+//     string: The interface name, e.g. eth0, empty if there is no default route.
+//
+// Usage:
+//     iface := parseDefaultRouteInterface(string(content))
+func parseDefaultRouteInterface(table string) string {
+	best, bestMetric := "", -1
+
+	scanner := bufio.NewScanner(strings.NewReader(table))
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+
+		var metric int
+		if _, err := fmt.Sscanf(fields[6], "%d", &metric); err != nil {
+			continue
+		}
+		if bestMetric < 0 || metric < bestMetric {
+			best, bestMetric = fields[0], metric
+		}
+	}
+
+	return best
+}
+
+// detectOutboundInterface returns the name of the interface carrying the default route of this
+// host. On Linux the routing table is parsed, elsewhere the interface holding the local address
+// chosen for an Internet destination is looked up. Connecting a UDP socket sends no packets.
+func detectOutboundInterface() (string, error) {
+	if content, err := ioutil.ReadFile(linuxRouteTable); err == nil {
+		if iface := parseDefaultRouteInterface(string(content)); iface != "" {
+			return iface, nil
+		}
+	}
+
+	conn, err := net.Dial("udp", "8.8.8.8:53")
+	if err != nil {
+		return "", fmt.Errorf("no default route found: %w", err)
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range interfaces {
+		addresses, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			if ipNet, ok := address.(*net.IPNet); ok && ipNet.IP.Equal(local) {
+				return iface.Name, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no interface holds the local address %s", local)
+}
+
+// masqueradeRules returns the wg-quick PostUp and PostDown commands of a Linux server forwarding
+// the traffic of the tunnel subnet to the Internet: forwarding from and to the tunnel interface
+// (%i) is accepted, and the subnet is masqueraded behind the outbound interface.
+//
+// Parameters:
+//     outbound (string): The outbound interface, e.g. eth0.
+//     subnet (net.IPNet): The tunnel subnet.
+//
+// Returns:
+//     []string: The PostUp commands.
+//     []string: The PostDown commands, removing the rules again.
+//
+// Usage:
+//     postUp, postDown := masqueradeRules("eth0", subnet)
+func masqueradeRules(outbound string, subnet net.IPNet) ([]string, []string) {
+	rules := []string{
+		"FORWARD -i %i -j ACCEPT",
+		"FORWARD -o %i -j ACCEPT",
+		fmt.Sprintf("POSTROUTING -t nat -s %s -o %s -j MASQUERADE", subnet.String(), outbound),
+	}
+
+	command := "iptables"
+	if subnet.IP.To4() == nil {
+		command = "ip6tables"
+	}
+
+	var postUp, postDown []string
+	for _, rule := range rules {
+		postUp = append(postUp, command+" -A "+rule)
+		postDown = append(postDown, command+" -D "+rule)
+	}
+
+	return postUp, postDown
+}
+
+// natRules returns the PostUp and PostDown commands of the server for the configured outbound
+// interface, one set of rules per address family of the server addresses. Both are empty unless
+// NAT was enabled with 'set-server nat=...'.
+func (config *appConfig) natRules() ([]string, []string) {
+	var postUp, postDown []string
+	if config.NatInterface == "" {
+		return nil, nil
+	}
+
+	for _, address := range config.Server.Address {
+		subnet := net.IPNet{IP: address.IP.Mask(address.Mask), Mask: address.Mask}
+		up, down := masqueradeRules(config.NatInterface, subnet)
+		postUp = append(postUp, up...)
+		postDown = append(postDown, down...)
+	}
+
+	return postUp, postDown
+}
+
+// resolveNatSetting returns the outbound interface for the value of the 'nat' setting: "auto"
+// detects the default-route interface, "off" disables the rules, any other value is used as the
+// interface name.
+func resolveNatSetting(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch value {
+	case "off":
+		return "", nil
+	case "auto":
+		iface, err := detectOutboundInterface()
+		if err != nil {
+			return "", newError(errDependency, "failed to detect the outbound interface, set it explicitly with nat=<interface>: %w", err)
+		}
+		fmt.Println("Detected outbound interface:", iface)
+		return iface, nil
+	case "":
+		return "", newError(errValidation, "invalid nat setting, expected auto, off or an interface name")
+	}
+
+	if strings.ContainsAny(value, " \t;&|$`'\"\\/") || len(value) > 15 {
+		return "", newError(errValidation, "invalid interface name '%s'", value)
+	}
+	return value, nil
+}
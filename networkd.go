@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+const defaultNetworkdInterface = "wg0"
+
+// NetdevString renders the configuration as a systemd-networkd .netdev file defining a Wireguard
+// interface with the given name.
+//
+// The field mapping differs from wg-quick: the interface keys go into the [WireGuard] section and
+// every peer gets its own [WireGuardPeer] section. Addresses, DNS and MTU are not part of the
+// netdev and are rendered by NetworkString instead. If privateKeyFile is not empty, the private
+// key is referenced through PrivateKeyFile= rather than embedded, which lets the .netdev be world
+// readable as systemd-networkd recommends.
+//
+// Parameters:
+//     name (string): The name of the network interface, e.g. "wg0".
+//     privateKeyFile (string): The path of the file holding the private key, or "" to embed it.
+//
+// Returns:
+//     string: The content of the .netdev file.
+//
+// Usage:
+//     netdev := config.Server.NetdevString("wg0", "/etc/systemd/network/wg0.key")
+func (wc WireguardConfig) NetdevString(name string, privateKeyFile string) string {
+	result := fmt.Sprintf("[NetDev]\nName = %s\nKind = wireguard\n", name)
+
+	if wc.MTU != 0 {
+		result += fmt.Sprintf("MTUBytes = %d\n", wc.MTU)
+	}
+
+	result += "\n[WireGuard]\n"
+	if privateKeyFile != "" {
+		result += fmt.Sprintf("PrivateKeyFile = %s\n", privateKeyFile)
+	} else {
+		result += fmt.Sprintf("PrivateKey = %s\n", wc.PrivateKey)
+	}
+
+	if wc.ListenPort != 0 {
+		result += fmt.Sprintf("ListenPort = %d\n", wc.ListenPort)
+	}
+
+	for _, peer := range wc.Peers {
+		allowedIPs := make([]string, 0, len(peer.AllowedIPs))
+		for _, address := range peer.AllowedIPs {
+			allowedIPs = append(allowedIPs, address.String())
+		}
+
+		result += fmt.Sprintf("\n[WireGuardPeer]\nPublicKey = %s\nAllowedIPs = %s\n",
+			peer.PublicKey, strings.Join(allowedIPs, ", "))
+
+		if peer.Endpoint != "" {
+			result += fmt.Sprintf("Endpoint = %s\n", peer.Endpoint)
+		}
+
+		if peer.PersistentKeepalive != 0 {
+			result += fmt.Sprintf("PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+
+	return result
+}
+
+// NetworkString renders the companion systemd-networkd .network file, which matches the
+// Wireguard interface with the given name and assigns its addresses and DNS servers.
+//
+// Parameters:
+//     name (string): The name of the network interface, the same as passed to NetdevString.
+//
+// Returns:
+//     string: The content of the .network file.
+//
+// Usage:
+//     network := config.Server.NetworkString("wg0")
+func (wc WireguardConfig) NetworkString(name string) string {
+	result := fmt.Sprintf("[Match]\nName = %s\n\n[Network]\n", name)
+
+	for _, address := range wc.Address {
+		result += fmt.Sprintf("Address = %s\n", address.String())
+	}
+
+	for _, dns := range wc.DNS.servers() {
+		result += fmt.Sprintf("DNS = %s\n", dns.String())
+	}
+
+	if domains := wc.DNS.searchDomains(); len(domains) > 0 {
+		result += fmt.Sprintf("Domains = %s\n", strings.Join(domains, " "))
+	}
+
+	return result
+}
+
+// runExportNetworkdCommand implements 'export networkd' and its alias 'export-networkd', which
+// writes the server configuration as a systemd-networkd .netdev/.network pair into the
+// configuration directory:
+//
+//     export-networkd [--name wg0] [--private-key-file /etc/systemd/network/wg0.key]
+func runExportNetworkdCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("export-networkd", flag.ContinueOnError)
+	name := flags.String("name", defaultNetworkdInterface, "Name of the Wireguard network interface")
+	privateKeyFile := flags.String("private-key-file", "",
+		"Reference the private key from this file instead of embedding it")
+
+	if err := parseFlags(flags, "export-networkd", args); err != nil {
+		return err
+	}
+	if *name == "" || strings.ContainsAny(*name, "/\\ ") {
+		return newError(errUsage, "invalid interface name")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	// networkd knows the wg-quick keys only
+	server, warnings, _ := config.Server.ForProfile(outputWgQuick)
+	for _, warning := range warnings {
+		fmt.Println("Warning:", warning)
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{*name + ".netdev", server.NetdevString(*name, *privateKeyFile)},
+		{*name + ".network", server.NetworkString(*name)},
+	}
+
+	for _, file := range files {
+		_, err = writeGeneratedFile(configPath+file.name, file.content, 0640)
+		if err != nil {
+			return fmt.Errorf("can't write %s: %w", configPath+file.name, err)
+		}
+		fmt.Println("Successfully saved systemd-networkd configuration:", configPath+file.name)
+	}
+
+	if *privateKeyFile != "" {
+		fmt.Printf("Don't forget to store the server private key in %s.\n", *privateKeyFile)
+	}
+
+	return nil
+}
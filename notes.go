@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// absorbServerFileComments picks up the comments added by hand above the [Peer] sections of the
+// server configuration file, e.g. ticket numbers or owner emails, so that regenerating the file
+// keeps them. Comments are associated with the peers by public key, since the file holds the
+// applied clients while changes are staged, e.g. before a removal renumbered them; the client
+// metadata emitted by serverFileConfig is left out. Peers missing from the file keep their
+// comments. Files that can't be read or parsed are ignored.
+func (config *appConfig) absorbServerFileComments(configPath string) {
+	parsed, _, err := readWireguardConfigFile(configPath+config.serverConfigFile(), parseLenient)
+	if err != nil {
+		return
+	}
+
+	filePeers := map[string]int{}
+	for i, peer := range parsed.Peers {
+		filePeers[peer.PublicKey] = i
+	}
+
+	for i := range config.Server.Peers {
+		filePeer, found := filePeers[config.Server.Peers[i].PublicKey]
+		if !found {
+			continue
+		}
+
+		metadata := map[string]bool{}
+		for _, comment := range config.metadataComments(i) {
+			metadata[comment] = true
+		}
+
+		var comments []string
+		for _, comment := range parsed.Peers[filePeer].Comments {
+			if !metadata[comment] {
+				comments = append(comments, comment)
+			}
+		}
+		config.Server.Peers[i].Comments = comments
+	}
+}
+
+// runSetNoteCommand implements the 'set-note' command, which attaches a free-form note to a client:
+//
+//     set-note 2 "Ticket #1234, owner alice@corp"
+//     set-note 2 --clear
+//     set-note --store config
+//
+// With '--store config' the notes are stored as comments above the [Peer] section of the client
+// in the server configuration file, where admins can also edit them by hand. With '--store state',
+// the default, they are only kept in config.json. Client configuration files never contain notes.
+func runSetNoteCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: set-note <client> [--clear] [text] | --store config|state")
+	if len(args) == 0 {
+		return usage
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	if strings.HasPrefix(args[0], "-") {
+		flags := flag.NewFlagSet("set-note", flag.ContinueOnError)
+		store := flags.String("store", "", "Where notes are stored, config or state")
+		if err = parseFlags(flags, "set-note", args); err != nil {
+			return err
+		}
+		if (*store != "config" && *store != "state") || flags.NArg() != 0 {
+			return usage
+		}
+
+		config.NotesInConfig = *store == "config"
+		if err = config.saveWithHistory(configPath, "set-note --store", false); err != nil {
+			return fmt.Errorf("failed to store the application configuration: %w", err)
+		}
+		fmt.Printf("New notes are stored in the %s.\n", map[bool]string{true: "server configuration file",
+			false: "application state"}[config.NotesInConfig])
+		return appendAuditLog(configPath, "set-note --store", map[string]string{"Store": *store})
+	}
+
+	selected, err := config.parseClientSelection(args[0])
+	if err != nil {
+		return err
+	}
+	if len(selected) != 1 {
+		return newError(errUsage, "set-note applies to a single client")
+	}
+	index := selected[0]
+
+	flags := flag.NewFlagSet("set-note", flag.ContinueOnError)
+	clear := flags.Bool("clear", false, "Remove all the notes of the client")
+	if err = parseFlags(flags, "set-note", args[1:]); err != nil {
+		return err
+	}
+	note := strings.TrimSpace(strings.Join(flags.Args(), " "))
+	if strings.ContainsAny(note, "\r\n") {
+		return newError(errValidation, "a note must be a single line")
+	}
+
+	info := config.clientInfo(index)
+	if !*clear && note == "" {
+		for _, existing := range info.Notes {
+			fmt.Println(existing)
+		}
+		if index < len(config.Server.Peers) {
+			for _, comment := range config.Server.Peers[index].Comments {
+				fmt.Println(comment)
+			}
+		}
+		return nil
+	}
+
+	if *clear {
+		info.Notes = nil
+		if index < len(config.Server.Peers) {
+			config.Server.Peers[index].Comments = nil
+		}
+	}
+	if note != "" {
+		if config.NotesInConfig && index < len(config.Server.Peers) {
+			config.Server.Peers[index].Comments = append(config.Server.Peers[index].Comments, note)
+		} else {
+			info.Notes = append(info.Notes, note)
+		}
+	}
+
+	serverFileName, err := config.writeServerConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println(config.savedMessage("server configuration", serverFileName))
+
+	if err = config.saveWithHistory(configPath, "set-note", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, "set-note", map[string]interface{}{"Client": index + 1, "Note": note, "Clear": *clear})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestServerFileCommentsFollowTheirPeer checks that comments added by hand to the server
+// configuration file stay with their client when a staged removal renumbers the clients before
+// the file is written again.
+func TestServerFileCommentsFollowTheirPeer(t *testing.T) {
+	answer(t, true)
+	config, configPath := newTestProfile(t, 3)
+	serverFile := configPath + config.serverConfigFile()
+	content, err := ioutil.ReadFile(serverFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := string(content)
+	for i, peer := range config.Server.Peers {
+		key := "PublicKey = " + peer.PublicKey
+		before := edited[:strings.Index(edited, key)]
+		section := strings.LastIndex(before, "[Peer]")
+		edited = edited[:section] + "# Ticket " + strconv.Itoa(i+1) + "\n" + edited[section:]
+	}
+	if err = ioutil.WriteFile(serverFile, []byte(edited), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server file still lists the removed client first until the removal is applied
+	applyChanges = false
+	t.Cleanup(func() { applyChanges = true })
+	if err = runRemoveCommand(configPath, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	staged, err := loadAppConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"Ticket 2", "Ticket 3"} {
+		if comments := strings.Join(staged.Server.Peers[i].Comments, "\n"); !strings.Contains(comments, want) {
+			t.Errorf("client %d has the comments %q, want %q", i+1, comments, want)
+		}
+	}
+
+	if err = runApplyCommand(configPath, []string{"--no-restart"}); err != nil {
+		t.Fatal(err)
+	}
+	content, err = ioutil.ReadFile(serverFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "# Ticket 1") ||
+		!strings.Contains(string(content), "# Ticket 2\n[Peer]\nPublicKey = "+config.Server.Peers[1].PublicKey) {
+		t.Errorf("the applied server file lost the comments of its peers:\n%s", content)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// isPinned tells whether the config file of the client with the given zero-based index is frozen,
+// see runPinCommand.
+func (config *appConfig) isPinned(index int) bool {
+	return index < len(config.ClientsInfo) && config.ClientsInfo[index].Pinned
+}
+
+// pinnedStale tells whether the config file of a pinned client no longer matches what would be
+// generated from the configuration, because changes were made while the file was frozen.
+func (config *appConfig) pinnedStale(configPath string, index int) bool {
+	if !config.isPinned(index) {
+		return false
+	}
+	content, err := config.readClientFile(configPath, index)
+	if err != nil {
+		return false
+	}
+	rendering, err := config.clientRendering(index)
+
+	return err == nil && rendering != string(content)
+}
+
+// skipPinned tells whether a regeneration of all the clients has to leave the config file of the
+// client alone because it is pinned, warning when the frozen file is out of sync.
+func (config *appConfig) skipPinned(configPath string, index int) bool {
+	if !config.isPinned(index) {
+		return false
+	}
+	if config.pinnedStale(configPath, index) {
+		fmt.Printf("Warning: client %d is pinned, %s is kept but is now out of sync with the configuration, "+
+			"see 'show --diff %d'\n", index+1, fmt.Sprintf(defaultClientConfigFile, index+1), index+1)
+	}
+
+	return true
+}
+
+// runPinCommand implements the 'pin' command, which freezes the config file of a client, e.g. of
+// a vendor appliance provisioned once that can't be touched again:
+//
+//     pin 3
+//     pin 3 --unpin
+//
+// Regenerating all the clients, applying the defaults and changing the endpoint leave the file of
+// a pinned client alone and warn when it falls out of sync; the configuration itself still follows
+// the changes, so the server keeps matching. 'list --drift' reports such a file as pinned and stale
+// rather than modified. Unpinning regenerates the file from the configuration.
+func runPinCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: pin <client> [--unpin]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	flags := flag.NewFlagSet("pin", flag.ContinueOnError)
+	unpin := flags.Bool("unpin", false, "Unfreeze the config file and regenerate it")
+	if err := parseFlags(flags, "pin", args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return usage
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	index, err := config.findClient(args[0])
+	if err != nil {
+		return err
+	}
+
+	info := config.clientInfo(index)
+	if info.Pinned == !*unpin {
+		fmt.Printf("Client %d is already %s.\n", index+1, map[bool]string{true: "unpinned", false: "pinned"}[*unpin])
+		return nil
+	}
+	info.Pinned = !*unpin
+
+	if *unpin {
+		clientFileName, err := config.writeClientConfigFile(configPath, index)
+		if err != nil {
+			return err
+		}
+		fmt.Println(config.savedMessage("client configuration", clientFileName))
+	} else {
+		fmt.Printf("Client %d is pinned, its config file is no longer regenerated.\n", index+1)
+	}
+
+	if err = config.saveWithHistory(configPath, "pin", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, "pin", map[string]interface{}{"Client": index + 1, "Pinned": info.Pinned})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// serverSubnet returns the tunnel subnet of the server, derived from its first address.
+func (config *appConfig) serverSubnet() net.IPNet {
+	address := config.Server.Address[0]
+	return net.IPNet{IP: address.IP.Mask(address.Mask), Mask: address.Mask}
+}
+
+// capacityUnlimited is the number of free addresses above which a capacity is reported as
+// effectively unlimited rather than as a number nobody will exhaust, e.g. the 18 quintillion
+// addresses of an IPv6 /64.
+var capacityUnlimited = big.NewInt(1 << 32)
+
+// ipAtOffset returns the address with the given host number within the subnet, e.g. 10.9.0.11 for
+// offset 11 in 10.9.0.0/24.
+func ipAtOffset(subnet net.IPNet, offset int) net.IP {
+	return ipAtHostNumber(subnet, big.NewInt(int64(offset)))
+}
+
+// ipAtHostNumber is ipAtOffset for host numbers beyond the int range, as in large IPv6 subnets.
+func ipAtHostNumber(subnet net.IPNet, offset *big.Int) net.IP {
+	base := subnet.IP.To4()
+	if base == nil {
+		base = subnet.IP.To16()
+	}
+
+	ipb := big.NewInt(0).SetBytes(base)
+	ipb.Add(ipb, offset)
+
+	b := ipb.Bytes()
+	if len(b) > len(base) {
+		return nil
+	}
+	return net.IP(append(make([]byte, len(base)-len(b)), b...))
+}
+
+// checkHostAddress verifies that the address is a usable host address of the subnet: inside it,
+// and neither its network address nor its broadcast address.
+//
+// Parameters:
+//     role (string): What the address is for, e.g. "server address", used in the error.
+//     ip (net.IP): The address.
+//     subnet (net.IPNet): The subnet.
+//
+// Returns:
+//     error: A validation error naming the role if the address isn't a usable host address.
+//
+// Usage:
+//     err := checkHostAddress("server address", serverIP, *subnet)
+func checkHostAddress(role string, ip net.IP, subnet net.IPNet) error {
+	if ip4 := ip.To4(); ip4 != nil && len(subnet.IP) == net.IPv4len {
+		ip = ip4
+	}
+	if !subnet.Contains(ip) {
+		return newError(errValidation, "%s %s is outside of the subnet %s", role, ip.String(), subnet.String())
+	}
+
+	network := ip.Mask(subnet.Mask)
+	broadcast := make(net.IP, len(network))
+	for i := range network {
+		broadcast[i] = network[i] | ^subnet.Mask[len(subnet.Mask)-len(network)+i]
+	}
+	switch {
+	case ip.Equal(network):
+		return newError(errValidation, "%s %s is the network address of the subnet %s", role, ip.String(), subnet.String())
+	case ip.Equal(broadcast):
+		return newError(errValidation, "%s %s is the broadcast address of the subnet %s", role, ip.String(), subnet.String())
+	}
+
+	return nil
+}
+
+// allocationStart returns the lowest address addClient assigns to new clients, nil if clients are
+// allocated right after the server as usual.
+func (config *appConfig) allocationStart() net.IP {
+	if config.AllocationOffset == 0 {
+		return nil
+	}
+
+	return ipAtOffset(config.serverSubnet(), config.AllocationOffset)
+}
+
+// parseAllocationOffset parses the start of the client address pool, given either as a host number
+// within the subnet (11) or as an address (10.9.0.11), and checks that it leaves room for at least
+// one client: the start and the address after it, which must not be the broadcast address, are
+// inside the subnet, and the start isn't the server address.
+//
+// Parameters:
+//     value (string): The host number or address, 0 or "off" to allocate right after the server.
+//
+// Returns:
+//     int: The host number of the first client address, 0 when the pool is disabled.
+//     error: A validation error if the value is invalid or leaves no room for a client.
+//
+// Usage:
+//     offset, err := config.parseAllocationOffset("10.9.0.11")
+func (config *appConfig) parseAllocationOffset(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "off" || value == "0" {
+		return 0, nil
+	}
+
+	subnet := config.serverSubnet()
+	offset, err := strconv.Atoi(value)
+	if err != nil {
+		ip := net.ParseIP(value)
+		if ip == nil || !subnet.Contains(ip) {
+			return 0, newError(errValidation, "invalid pool start '%s', expected a host number or an address in %s", value, subnet.String())
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		base := subnet.IP.To4()
+		if base == nil {
+			base = subnet.IP.To16()
+		}
+		offset = int(big.NewInt(0).Sub(big.NewInt(0).SetBytes(ip), big.NewInt(0).SetBytes(base)).Int64())
+	}
+
+	start := ipAtOffset(subnet, offset)
+	switch {
+	case offset < 1 || start == nil || !subnet.Contains(start) || !subnet.Contains(NextIP(start)):
+		return 0, newError(errValidation, "pool start %s leaves no room for a client in %s", value, subnet.String())
+	case bytes.Equal(start.To16(), config.Server.Address[0].IP.To16()):
+		return 0, newError(errValidation, "pool start %s is the server address", start.String())
+	}
+
+	return offset, nil
+}
+
+// serverSubnets returns the tunnel subnets of the server, one per address family for dual-stack.
+func (config *appConfig) serverSubnets() []net.IPNet {
+	var subnets []net.IPNet
+	for _, address := range config.Server.Address {
+		subnet := normalizeIPNet(net.IPNet{IP: address.IP.Mask(address.Mask), Mask: address.Mask})
+		known := false
+		for _, other := range subnets {
+			known = known || other.String() == subnet.String()
+		}
+		if !known {
+			subnets = append(subnets, subnet)
+		}
+	}
+
+	return subnets
+}
+
+// hostNumber returns the host number of the address within the subnet, nil if it is outside.
+func hostNumber(subnet net.IPNet, ip net.IP) *big.Int {
+	subnet = normalizeIPNet(subnet)
+	if ip4 := ip.To4(); ip4 != nil && len(subnet.IP) == net.IPv4len {
+		ip = ip4
+	}
+	if !subnet.Contains(ip) {
+		return nil
+	}
+
+	return big.NewInt(0).Sub(big.NewInt(0).SetBytes(ip.To16()), big.NewInt(0).SetBytes(subnet.IP.To16()))
+}
+
+// lastHostNumber returns the host number of the last usable address of the subnet, the one before
+// the broadcast address, 0 if the subnet has no host addresses.
+func lastHostNumber(subnet net.IPNet) *big.Int {
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		return big.NewInt(0)
+	}
+
+	size := big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones))
+	return size.Sub(size, big.NewInt(2))
+}
+
+// usedHostNumbers returns the sorted host numbers of the server and client addresses within the
+// subnet. Its size follows the number of clients, never the size of the subnet.
+func (config *appConfig) usedHostNumbers(subnet net.IPNet) []*big.Int {
+	var used []*big.Int
+	addresses := append([]net.IPNet(nil), config.Server.Address...)
+	for _, client := range config.Clients {
+		addresses = append(addresses, client.Address...)
+	}
+	for _, address := range addresses {
+		if number := hostNumber(subnet, address.IP); number != nil {
+			used = append(used, number)
+		}
+	}
+
+	sort.Slice(used, func(i, j int) bool { return used[i].Cmp(used[j]) < 0 })
+	unique := used[:0]
+	for i, number := range used {
+		if i == 0 || number.Cmp(used[i-1]) != 0 {
+			unique = append(unique, number)
+		}
+	}
+
+	return unique
+}
+
+// firstPoolHostNumber returns the host number of the first address clients get in the subnet: the
+// start of the client pool in the main subnet (see allocationStart), 1 otherwise.
+func (config *appConfig) firstPoolHostNumber(subnet net.IPNet) *big.Int {
+	if config.AllocationOffset > 0 && len(config.Server.Address) > 0 {
+		main, subnet := normalizeIPNet(config.serverSubnet()), normalizeIPNet(subnet)
+		if main.String() == subnet.String() {
+			return big.NewInt(int64(config.AllocationOffset))
+		}
+	}
+
+	return big.NewInt(1)
+}
+
+// nextFreeAddress returns the address addClient assigns next in the subnet. It is the address
+// after the highest one in use (the high-water mark), and once that reached the end of the subnet
+// the lowest address freed below it, e.g. by a removed client. Only the addresses in use are
+// looked at, nothing is precomputed per address of the subnet, so allocating from an IPv6 /64
+// costs as little as from an IPv4 /24.
+//
+// Parameters:
+//     subnet (net.IPNet): The tunnel subnet, see serverSubnets.
+//
+// Returns:
+//     net.IP: The free address.
+//     error: A conflict error if the subnet is full.
+//
+// Usage:
+//     ip, err := config.nextFreeAddress(config.serverSubnet())
+func (config *appConfig) nextFreeAddress(subnet net.IPNet) (net.IP, error) {
+	used := config.usedHostNumbers(subnet)
+	first, last := config.firstPoolHostNumber(subnet), lastHostNumber(subnet)
+
+	next := first
+	if len(used) > 0 && used[len(used)-1].Cmp(first) >= 0 {
+		next = big.NewInt(0).Add(used[len(used)-1], big.NewInt(1))
+	}
+	if next.Cmp(last) > 0 {
+		// The high-water mark reached the end, look for a gap in the addresses in use
+		next = big.NewInt(0).Set(first)
+		for _, number := range used {
+			if number.Cmp(next) > 0 {
+				break
+			}
+			if number.Cmp(next) == 0 {
+				next.Add(next, big.NewInt(1))
+			}
+		}
+	}
+	if next.Cmp(last) > 0 {
+		return nil, newError(errConflict, "can't allocate IP address, subnet %s capacity has been reached", subnet.String())
+	}
+
+	return ipAtHostNumber(subnet, next), nil
+}
+
+// subnetCapacity is the address capacity of a tunnel subnet. The counts are decimal strings since
+// an IPv6 subnet holds more addresses than an integer can.
+type subnetCapacity struct {
+	Subnet string
+	// Hosts is the number of host addresses, without the network and broadcast addresses.
+	Hosts string
+	// Used is the number of addresses taken by the server and the clients.
+	Used int
+	// Free is the number of addresses left for new clients, above the start of the client pool.
+	Free string
+}
+
+// String returns the capacity as printed by 'server-info' and 'list', large counts as effectively
+// unlimited.
+func (capacity subnetCapacity) String() string {
+	free, _ := big.NewInt(0).SetString(capacity.Free, 10)
+	if free != nil && free.Cmp(capacityUnlimited) > 0 {
+		return fmt.Sprintf("%s: %d used, effectively unlimited free", capacity.Subnet, capacity.Used)
+	}
+
+	return fmt.Sprintf("%s: %d used, %s of %s free", capacity.Subnet, capacity.Used, capacity.Free, capacity.Hosts)
+}
+
+// addressCapacity returns the capacity of every tunnel subnet of the server, the IPv4 and the IPv6
+// subnet separately for dual-stack.
+//
+// Returns:
+//     []subnetCapacity: The capacity per subnet, in the order of the server addresses.
+//
+// Usage:
+//     for _, capacity := range config.addressCapacity() { fmt.Println(capacity) }
+func (config *appConfig) addressCapacity() []subnetCapacity {
+	var capacities []subnetCapacity
+	for _, subnet := range config.serverSubnets() {
+		used := config.usedHostNumbers(subnet)
+		first, last := config.firstPoolHostNumber(subnet), lastHostNumber(subnet)
+
+		free := big.NewInt(0)
+		if last.Cmp(first) >= 0 {
+			free.Sub(last, first).Add(free, big.NewInt(1))
+		}
+		for _, number := range used {
+			if number.Cmp(first) >= 0 && number.Cmp(last) <= 0 {
+				free.Sub(free, big.NewInt(1))
+			}
+		}
+
+		capacities = append(capacities, subnetCapacity{
+			Subnet: subnet.String(),
+			Hosts:  lastHostNumber(subnet).String(),
+			Used:   len(used),
+			Free:   free.String(),
+		})
+	}
+
+	return capacities
+}
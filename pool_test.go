@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckHostAddress(t *testing.T) {
+	tests := []struct {
+		ip      string
+		subnet  string
+		wantErr string
+	}{
+		{"10.9.0.1", "10.9.0.0/24", ""},
+		{"10.9.0.254", "10.9.0.0/24", ""},
+		{"10.9.0.0", "10.9.0.0/24", "is the network address of the subnet 10.9.0.0/24"},
+		{"10.9.0.255", "10.9.0.0/24", "is the broadcast address of the subnet 10.9.0.0/24"},
+		{"10.9.1.1", "10.9.0.0/24", "is outside of the subnet 10.9.0.0/24"},
+		{"10.9.0.5", "10.9.0.4/30", ""},
+		{"10.9.0.6", "10.9.0.4/30", ""},
+		{"10.9.0.4", "10.9.0.4/30", "is the network address"},
+		{"10.9.0.7", "10.9.0.4/30", "is the broadcast address"},
+		{"10.9.0.14", "10.9.0.8/29", ""},
+		{"10.9.0.15", "10.9.0.8/29", "is the broadcast address"},
+		{"fd00:9::1", "fd00:9::/64", ""},
+		{"fd00:9::", "fd00:9::/64", "is the network address"},
+	}
+
+	for _, test := range tests {
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		err := checkHostAddress("server address", net.ParseIP(test.ip), *subnet)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("checkHostAddress(%s, %s) = %v", test.ip, test.subnet, err)
+		}
+		if test.wantErr != "" && (exitCode(err) != exitValidation || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("checkHostAddress(%s, %s) = %v, want %q", test.ip, test.subnet, err, test.wantErr)
+		}
+	}
+}
+
+func TestInitializeAddresses(t *testing.T) {
+	tests := []struct {
+		server     string
+		subnet     string
+		wantClient string
+		wantErr    string
+	}{
+		// Host address input, the server keeps the entered address after confirmation
+		{"10.9.0.5", "10.9.0.5/24", "10.9.0.6/24", ""},
+		{"10.9.0.1", "10.9.0.0/24", "10.9.0.2/24", ""},
+		{"10.9.0.254", "10.9.0.0/24", "", "server address 10.9.0.254 leaves no room for clients in 10.9.0.0/24"},
+		{"10.9.0.255", "10.9.0.0/24", "", "server address 10.9.0.255 is the broadcast address"},
+		{"10.9.0.0", "10.9.0.0/24", "", "server address 10.9.0.0 is the network address"},
+		{"10.9.0.5", "10.9.0.4/30", "10.9.0.6/30", ""},
+		{"10.9.0.6", "10.9.0.4/30", "", "leaves no room for clients in 10.9.0.4/30"},
+		{"10.9.0.9", "10.9.0.8/29", "10.9.0.10/29", ""},
+		{"10.9.0.13", "10.9.0.8/29", "10.9.0.14/29", ""},
+		{"10.9.0.14", "10.9.0.8/29", "", "leaves no room for clients in 10.9.0.8/29"},
+		{"10.9.0.1", "10.9.0.0/31", "", "the subnet 10.9.0.0/31 is too small"},
+	}
+
+	for _, test := range tests {
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		var config appConfig
+		err := config.initialize("vpn.example.com:51820", 51820, net.ParseIP(test.server).To4(), subnet)
+		if test.wantErr != "" {
+			if exitCode(err) != exitValidation || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("initialize(%s, %s) = %v, want %q", test.server, test.subnet, err, test.wantErr)
+			}
+			// The checks run before any key is generated
+			if config.Server.PrivateKey != "" || len(config.Clients) != 0 {
+				t.Errorf("initialize(%s, %s) created the server before failing", test.server, test.subnet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("initialize(%s, %s) = %v", test.server, test.subnet, err)
+			continue
+		}
+		if client := joinIPNets(config.Clients[0].Address); client != test.wantClient {
+			t.Errorf("initialize(%s, %s): client address %s, want %s", test.server, test.subnet, client, test.wantClient)
+		}
+	}
+}
+
+func TestConfigureWireguardSubnetHostBits(t *testing.T) {
+	tests := []struct {
+		input      string
+		yes        bool
+		wantServer string
+		wantSubnet string
+	}{
+		{"10.9.0.5/24\n", true, "10.9.0.5", "10.9.0.0/24"},
+		{"10.9.0.5/24\nn\n", false, "10.9.0.1", "10.9.0.0/24"},
+		// The broadcast address isn't offered as the server address
+		{"10.9.0.255/24\n", true, "10.9.0.1", "10.9.0.0/24"},
+		{"10.9.0.6/30\n", true, "10.9.0.6", "10.9.0.4/30"},
+		{"10.9.0.7/30\n", true, "10.9.0.5", "10.9.0.4/30"},
+		{"10.9.0.11/29\n", true, "10.9.0.11", "10.9.0.8/29"},
+	}
+
+	for _, test := range tests {
+		scriptedInput(t, test.input, test.yes)
+		server, subnet, err := configureWireguardSubnet()
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if server.String() != test.wantServer || subnet.String() != test.wantSubnet {
+			t.Errorf("%q: server %s in %s, want %s in %s", test.input, server, subnet, test.wantServer, test.wantSubnet)
+		}
+	}
+}
+
+// newSubnetProfile returns a configuration with a server and a client in the given subnets, the
+// first one as created by initialize, the others added as for dual-stack.
+func newSubnetProfile(t testing.TB, subnets ...string) appConfig {
+	t.Helper()
+	var config appConfig
+	for i, cidr := range subnets {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := NextIP(subnet.IP)
+		if i == 0 {
+			if err = config.initialize("vpn.example.com:51820", 51820, server, subnet); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		client := net.IPNet{IP: NextIP(server), Mask: subnet.Mask}
+		config.Server.Address = append(config.Server.Address, net.IPNet{IP: server, Mask: subnet.Mask})
+		config.Clients[0].Address = append(config.Clients[0].Address, client)
+		config.Server.Peers[0].AllowedIPs = clientIpNetToPeer(config.Clients[0].Address)
+	}
+
+	return config
+}
+
+func TestAllocateIPv6Slash120(t *testing.T) {
+	config := newSubnetProfile(t, "fd00:9::/120")
+
+	// The server takes ::1 and the clients ::2 to ::fe, ::ff is left out as in IPv4
+	for len(config.Clients) < 253 {
+		if err := config.addClient(); err != nil {
+			t.Fatalf("client %d: %v", len(config.Clients)+1, err)
+		}
+	}
+	if last := config.Clients[252].Address[0].IP.String(); last != "fd00:9::fe" {
+		t.Errorf("last client got %s, want fd00:9::fe", last)
+	}
+	if err := config.addClient(); exitCode(err) != exitConflict {
+		t.Errorf("allocating from a full /120 = %v, want a conflict", err)
+	}
+	if capacity := config.addressCapacity(); len(capacity) != 1 || capacity[0].String() != "fd00:9::/120: 254 used, 0 of 254 free" {
+		t.Errorf("capacity = %v", capacity)
+	}
+
+	// Once the high-water mark reached the end, freed addresses are reused lowest first
+	config.Clients = append(config.Clients[:100:100], config.Clients[102:]...)
+	for _, want := range []string{"fd00:9::66", "fd00:9::67"} {
+		if ip, err := config.nextFreeAddress(config.serverSubnets()[0]); err != nil || ip.String() != want {
+			t.Fatalf("nextFreeAddress() = %v, %v, want %s", ip, err, want)
+		}
+		if err := config.addClient(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAllocateIPv6Slash64(t *testing.T) {
+	config := newSubnetProfile(t, "fd00:9::/64")
+	for i := 0; i < 3; i++ {
+		if err := config.addClient(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := config.Clients[3].Address[0].IP.String(); got != "fd00:9::5" {
+		t.Errorf("fourth client got %s, want fd00:9::5", got)
+	}
+	capacity := config.addressCapacity()
+	if len(capacity) != 1 || capacity[0].Free != "18446744073709551609" ||
+		capacity[0].String() != "fd00:9::/64: 5 used, effectively unlimited free" {
+		t.Errorf("capacity = %+v", capacity)
+	}
+
+	// A client at the end of the /64 doesn't make the allocator scan the subnet
+	_, subnet, _ := net.ParseCIDR("fd00:9::/64")
+	config.Clients[3].Address[0].IP = net.ParseIP("fd00:9::ffff:ffff:ffff:fffe")
+	if ip, err := config.nextFreeAddress(*subnet); err != nil || ip.String() != "fd00:9::5" {
+		t.Errorf("nextFreeAddress() = %v, %v, want the freed fd00:9::5", ip, err)
+	}
+}
+
+func TestAddressCapacityDualStack(t *testing.T) {
+	config := newSubnetProfile(t, "10.9.0.0/24", "fd00:9::/64")
+	if err := config.addClient(); err != nil {
+		t.Fatal(err)
+	}
+	if got := joinIPNets(config.Clients[1].Address); got != "10.9.0.3/24, fd00:9::3/64" {
+		t.Errorf("dual-stack client got %s", got)
+	}
+
+	var got []string
+	for _, capacity := range config.addressCapacity() {
+		got = append(got, capacity.String())
+	}
+	want := "10.9.0.0/24: 3 used, 251 of 254 free; fd00:9::/64: 3 used, effectively unlimited free"
+	if strings.Join(got, "; ") != want {
+		t.Errorf("capacity = %q, want %q", got, want)
+	}
+}
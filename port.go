@@ -1,37 +1,234 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"math/big"
 	"net"
 	"strconv"
+	"strings"
 )
 
+// UDP families accepted by GetUnusedUdpPort and CheckUdpPort. udpFamilyDual checks the port
+// on both IPv4 and IPv6, as for a server listening on all addresses, or only on IPv4 if the
+// host has no IPv6 support.
+const (
+	udpFamilyIPv4 = "udp4"
+	udpFamilyIPv6 = "udp6"
+	udpFamilyDual = "udp"
+)
+
+// maxUnusedUdpPortAttempts is how many ports GetUnusedUdpPort tries with udpFamilyDual before
+// giving up, the port chosen on IPv4 may be taken on IPv6.
+const maxUnusedUdpPortAttempts = 10
+
+// defaultServicePortRange is the range of UDP ports preferred for a new server, see selectServerPort.
+const defaultServicePortRange = "51820-51999"
+
+// ephemeralPortFloor is the start of the upper ephemeral range, whose ports the operating system
+// hands out to other applications, so that a server port chosen there may be taken after a reboot.
+const ephemeralPortFloor = 60000
+
+// bindAddress is the local address a new server is bound to, set with -bind. Empty binds to all
+// addresses.
+var bindAddress string
+
+// servicePortRange is the range of UDP ports the server port of a new configuration is picked
+// from, set with -portrange.
+var servicePortRange = defaultServicePortRange
+
+// portRange is an inclusive range of UDP ports.
+type portRange struct {
+	First int
+	Last  int
+}
+
+// String returns the range as parsed by parsePortRange, e.g. 51820-51999.
+func (r portRange) String() string {
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// parsePortRange parses a range of UDP ports such as 51820-51999, or a single port.
+func parsePortRange(value string) (portRange, error) {
+	first, last, found := strings.Cut(strings.TrimSpace(value), "-")
+	if !found {
+		last = first
+	}
+
+	var r portRange
+	var err error
+	if r.First, err = strconv.Atoi(strings.TrimSpace(first)); err == nil {
+		r.Last, err = strconv.Atoi(strings.TrimSpace(last))
+	}
+	if err != nil || r.First < 1 || r.Last > 65535 || r.First > r.Last {
+		return portRange{}, newError(errUsage, "invalid port range '%s', expected e.g. %s", value, defaultServicePortRange)
+	}
+
+	return r, nil
+}
+
+// udpListenFamily returns the UDP family the server will be reached on through the given
+// endpoint host: udp4 for an IPv4 address, udp6 for an IPv6 address and both for a host name.
+//
+// Parameters:
+//     host (string): The host part of the server endpoint.
+//
+// Returns:
+//     string: One of udpFamilyIPv4, udpFamilyIPv6 or udpFamilyDual.
+//
+// Usage:
+//     family := udpListenFamily("203.0.113.1")
+func udpListenFamily(host string) string {
+	ip := net.ParseIP(host)
+
+	switch {
+	case ip == nil:
+		return udpFamilyDual
+	case ip.To4() != nil:
+		return udpFamilyIPv4
+	default:
+		return udpFamilyIPv6
+	}
+}
+
 // GetUnusedUdpPort attempts to listen for UDP connections on an automatically
 // chosen available port and returns that port number. If an error occurs while
 // listening for a connection or parsing the port number, the function will return
 // an error alongside the value 0.
 //
+// With udpFamilyDual the port is chosen on IPv4 and then confirmed to be free on IPv6 too,
+// since a port free on one family may be taken on the other.
+//
+// Parameters:
+//     family (string): The UDP family to check, udpFamilyIPv4, udpFamilyIPv6 or udpFamilyDual.
+//
 // Returns:
 //     int: The number of the unused UDP port.
 //     error: An error object indicating any errors that occurred during the process.
 //
 // Usage:
-//     port, err := GetUnusedUdpPort()
-func GetUnusedUdpPort() (int, error) {
-	conn, err := net.ListenUDP("udp", nil)
+//     port, err := GetUnusedUdpPort(udpFamilyIPv4)
+func GetUnusedUdpPort(family string) (int, error) {
+	family = resolveUdpFamily(family)
+	if family != udpFamilyDual {
+		return listenUdpPort(family, 0)
+	}
 
-	if err != nil {
-		return 0, err
+	var err error
+	for i := 0; i < maxUnusedUdpPortAttempts; i++ {
+		var port int
+		if port, err = listenUdpPort(udpFamilyIPv4, 0); err != nil {
+			return 0, err
+		}
+		if _, err = listenUdpPort(udpFamilyIPv6, port); err == nil {
+			return port, nil
+		}
 	}
-	defer conn.Close()
-	hostString := conn.LocalAddr().String()
-	_, portString, err := net.SplitHostPort(hostString)
 
+	return 0, err
+}
+
+// GetUnusedUdpPortInRange returns the first port of the range that is free on the given UDP
+// family, or on the given bind address, trying the ports in ascending order so that the server
+// gets the same port again on an unchanged host.
+//
+// Parameters:
+//     family (string): The UDP family to check, udpFamilyIPv4, udpFamilyIPv6 or udpFamilyDual.
+//     address (string): The bind address, empty to check the wildcard address of the family.
+//     r (portRange): The ports to try.
+//
+// Returns:
+//     int: The number of the unused UDP port.
+//     error: A conflict error if every port of the range is in use.
+//
+// Usage:
+//     port, err := GetUnusedUdpPortInRange(udpFamilyDual, "", portRange{First: 51820, Last: 51999})
+func GetUnusedUdpPortInRange(family string, address string, r portRange) (int, error) {
+	for port := r.First; port <= r.Last; port++ {
+		if _, err := CheckUdpPortOnAddress(family, address, port); err == nil {
+			return port, nil
+		}
+	}
+
+	return 0, newError(errConflict, "all UDP ports of the range %s are in use", r.String())
+}
+
+// selectServerPort picks the UDP port of a new server: the first free port of the service range,
+// and only if the whole range is taken a random port chosen by the operating system, with a
+// warning since ports in the upper ephemeral range are often grabbed by other applications after
+// a reboot.
+//
+// Parameters:
+//     family (string): The UDP family to check, udpFamilyIPv4, udpFamilyIPv6 or udpFamilyDual.
+//     address (string): The bind address of the server, empty for all addresses of the family.
+//     r (portRange): The service range, see servicePortRange.
+//
+// Returns:
+//     int: The number of the unused UDP port.
+//     string: How the port was selected, shown in the setup summary.
+//     error: An error if no port at all could be obtained.
+//
+// Usage:
+//     port, policy, err := selectServerPort(udpFamilyIPv4, "", portRange{First: 51820, Last: 51999})
+func selectServerPort(family string, address string, r portRange) (int, string, error) {
+	if port, err := GetUnusedUdpPortInRange(family, address, r); err == nil {
+		return port, fmt.Sprintf("first free port of the service range %s", r.String()), nil
+	}
+
+	var port int
+	var err error
+	if address == "" {
+		port, err = GetUnusedUdpPort(family)
+	} else {
+		ip := net.ParseIP(address)
+		port, err = listenUdpAddress(udpListenFamily(address), ip, 0)
+	}
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 
-	return strconv.Atoi(portString)
+	fmt.Printf("Warning: all UDP ports of the service range %s are in use, falling back to the random port %d.\n",
+		r.String(), port)
+	if port >= ephemeralPortFloor {
+		fmt.Println("Ports above 60000 are often taken by other applications after a reboot, " +
+			"consider entering a fixed port below or choosing another range with -portrange.")
+	}
+
+	return port, fmt.Sprintf("random port, the service range %s was in use", r.String()), nil
+}
+
+// udpPortOwner describes the process listening on the given UDP port, e.g. "svchost (PID 1234)",
+// preferring the name of a running Wireguard instance. It is used to explain why a port is taken.
+//
+// Parameters:
+//     ps (Executor): Runs the PowerShell query of the UDP endpoints on Windows.
+//     port (int): The UDP port.
+//
+// Returns:
+//     string: The description of the owning process.
+//     bool: Whether the owner could be found.
+//
+// Usage:
+//     if owner, found := udpPortOwner(NewPowerShell(), 51820); found { ... }
+func udpPortOwner(ps Executor, port int) (string, bool) {
+	if name, found := wireguardPortOwner(ps, port); found {
+		return fmt.Sprintf("the Wireguard instance '%s'", name), true
+	}
+	if !windowsHost {
+		return "", false
+	}
+
+	script := fmt.Sprintf(`Get-NetUDPEndpoint -LocalPort %d -ErrorAction SilentlyContinue | Select-Object -First 1 | ForEach-Object {
+		$process = Get-Process -Id $_.OwningProcess -ErrorAction SilentlyContinue
+		"{0} (PID {1})" -f $process.ProcessName, $_.OwningProcess
+	}`, port)
+	result := ps.Execute(context.Background(), script)
+	owner := strings.TrimSpace(result.StdOut)
+	if result.Err != nil || owner == "" {
+		return "", false
+	}
+
+	return owner, true
 }
 
 // CheckUdpPort checks if a given UDP port is available by attempting to listen
@@ -39,6 +236,7 @@ func GetUnusedUdpPort() (int, error) {
 // the port number; otherwise, it returns an error.
 //
 // Parameters:
+//     family (string): The UDP family to check, udpFamilyIPv4, udpFamilyIPv6 or udpFamilyDual.
 //     Port (int): The number of the UDP port to check.
 //
 // Returns:
@@ -46,13 +244,131 @@ func GetUnusedUdpPort() (int, error) {
 //     error: An error object indicating any errors that occurred during the process, e.g., if the port is not available.
 //
 // Usage:
-//     port, err := CheckUdpPort(12345)
-func CheckUdpPort(Port int) (int, error) {
+//     port, err := CheckUdpPort(udpFamilyIPv4, 12345)
+func CheckUdpPort(family string, Port int) (int, error) {
+	family = resolveUdpFamily(family)
+	if family != udpFamilyDual {
+		return listenUdpPort(family, Port)
+	}
+
+	if _, err := listenUdpPort(udpFamilyIPv4, Port); err != nil {
+		return 0, err
+	}
+
+	return listenUdpPort(udpFamilyIPv6, Port)
+}
+
+// CheckUdpPortOnAddress checks like CheckUdpPort whether a UDP port is available, but on the
+// given local address only, as for a server bound to one of several network interfaces: a port
+// busy on one interface may be free on another. Without an address the wildcard address of the
+// family is checked, as CheckUdpPort does.
+//
+// Parameters:
+//     family (string): The UDP family checked without an address, see CheckUdpPort.
+//     address (string): The local IPv4 or IPv6 address, empty for all addresses.
+//     port (int): The number of the UDP port to check.
+//
+// Returns:
+//     int: The number of the checked UDP port if it is available.
+//     error: A conflict error naming the family and the address if the port can't be bound there.
+//
+// Usage:
+//     port, err := CheckUdpPortOnAddress(udpFamilyDual, "192.168.1.10", 51820)
+func CheckUdpPortOnAddress(family string, address string, port int) (int, error) {
+	if address == "" {
+		return CheckUdpPort(family, port)
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return 0, newError(errValidation, "invalid bind address '%s'", address)
+	}
+
+	familyName := "IPv4"
+	if ip.To4() == nil {
+		familyName = "IPv6"
+	}
+	if _, err := listenUdpAddress(udpListenFamily(address), ip, port); err != nil {
+		return 0, newError(errConflict, "UDP port %d is not available on the %s address %s: %w", port, familyName, address, err)
+	}
+
+	return port, nil
+}
+
+// checkBindAddress parses the bind address given to 'set-server bind=', "any" listening on all
+// addresses again, and checks that it is assigned to this host and that the listen port of the
+// server is free on it. A port held by the running Wireguard server itself is accepted.
+//
+// Parameters:
+//     value (string): The IPv4 or IPv6 address, or "any".
+//
+// Returns:
+//     string: The bind address, empty for all addresses.
+//     error: A validation error for an address not assigned to this host, or a conflict error if
+//         the port is taken by another process.
+//
+// Usage:
+//     address, err := config.checkBindAddress("192.168.1.10")
+func (config *appConfig) checkBindAddress(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "any" || value == "" {
+		return "", nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", newError(errValidation, "invalid bind address '%s', expected an IPv4 or IPv6 address or 'any'", value)
+	}
+	if _, err := listenUdpAddress(udpListenFamily(value), ip, 0); err != nil {
+		return "", newError(errValidation, "%s is not an address of this host: %w", value, err)
+	}
+
+	port := int(config.Server.ListenPort)
+	if _, err := CheckUdpPortOnAddress(udpFamilyDual, value, port); err != nil {
+		if name, found := wireguardPortOwner(newExecutor(), port); found {
+			fmt.Printf("UDP port %d is held by the running Wireguard instance '%s', restart it to apply the bind address.\n",
+				port, name)
+			return ip.String(), nil
+		}
+		if owner, found := udpPortOwner(newExecutor(), port); found {
+			return "", fmt.Errorf("%w, it is used by %s", err, owner)
+		}
+		return "", err
+	}
+
+	return ip.String(), nil
+}
+
+// resolveUdpFamily turns udpFamilyDual into udpFamilyIPv4 when the host can't listen on IPv6.
+func resolveUdpFamily(family string) string {
+	if family == udpFamilyDual {
+		if _, err := listenUdpPort(udpFamilyIPv6, 0); err != nil {
+			return udpFamilyIPv4
+		}
+	}
+
+	return family
+}
+
+// listenUdpPort listens on the port of a single UDP family, 0 picking any free port, and returns
+// the port that was bound.
+func listenUdpPort(family string, port int) (int, error) {
+	return listenUdpAddress(family, nil, port)
+}
+
+// listenUdpAddress listens on the port of the given local address, the wildcard address of the
+// family if nil, and returns the port that was bound.
+func listenUdpAddress(family string, ip net.IP, port int) (int, error) {
+	if family != udpFamilyIPv4 && family != udpFamilyIPv6 {
+		return 0, fmt.Errorf("unsupported UDP family '%s'", family)
+	}
+
 	address := net.UDPAddr{
-		Port: Port,
+		IP:   ip,
+		Port: port,
 	}
 
-	conn, err := net.ListenUDP("udp", &address)
+	conn, err := net.ListenUDP(family, &address)
 
 	if err != nil {
 		return 0, err
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUdpPortOwner(t *testing.T) {
+	fakeWindowsHost(t)
+
+	tests := []struct {
+		name      string
+		rules     []fakeRule
+		want      string
+		wantFound bool
+	}{
+		{
+			name:      "Wireguard instance",
+			rules:     []fakeRule{{Match: "Get-NetUDPEndpoint | ForEach-Object", Result: Result{StdOut: "wiresock\t51820\n"}}},
+			want:      "the Wireguard instance 'wiresock'",
+			wantFound: true,
+		},
+		{
+			name:      "other process",
+			rules:     []fakeRule{{Match: "Get-NetUDPEndpoint -LocalPort 51820", Result: Result{StdOut: "svchost (PID 1234)\r\n"}}},
+			want:      "svchost (PID 1234)",
+			wantFound: true,
+		},
+		{
+			name: "no owner",
+		},
+	}
+
+	for _, test := range tests {
+		ps := &fakeExecutor{Rules: test.rules}
+		owner, found := udpPortOwner(ps, 51820)
+		if owner != test.want || found != test.wantFound {
+			t.Errorf("%s: udpPortOwner() = %q, %v, want %q, %v", test.name, owner, found, test.want, test.wantFound)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    portRange
+		wantErr bool
+	}{
+		{"51820-51830", portRange{51820, 51830}, false},
+		{"1024-1024", portRange{1024, 1024}, false},
+		{"51830-51820", portRange{}, true},
+		{"0-100", portRange{}, true},
+		{"51820", portRange{51820, 51820}, false},
+		{"1-65536", portRange{}, true},
+		{"a-b", portRange{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := parsePortRange(test.value)
+		if (err != nil) != test.wantErr || (err == nil && got != test.want) {
+			t.Errorf("parsePortRange(%q) = %v, %v, want %v, error %v", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
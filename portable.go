@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// clientBundleFormat identifies the files written by 'export-client'.
+const clientBundleFormat = "wg-quick-config client bundle"
+
+// reprovisionMetadataKey is the metadata entry marking an imported client whose device still uses
+// the configuration of its previous server.
+const reprovisionMetadataKey = "Status"
+
+// clientBundle is a single client as moved between two separately managed servers by
+// 'export-client' and 'import-client': its keys, metadata, notes and group. The address, the
+// endpoint and the server key are not carried over, the receiving server assigns its own.
+type clientBundle struct {
+	// PrivateKey is empty for clients with an external key.
+	PrivateKey string `json:",omitempty"`
+	PublicKey  string
+	// Address and Server are the address of the client on the exporting server and the public key
+	// of that server, for reference only.
+	Address  string
+	Server   string
+	Metadata []metadataEntry `json:",omitempty"`
+	Notes    []string        `json:",omitempty"`
+	Group    string          `json:",omitempty"`
+	// Defaults are the defaults of the group on the exporting server.
+	Defaults map[string]string `json:",omitempty"`
+	Exported time.Time
+}
+
+// clientBundleFile is the content of a client bundle file, holding either the plain bundle or, if
+// exported with a passphrase, the bundle encrypted with XChaCha20-Poly1305 under a scrypt key.
+type clientBundleFile struct {
+	Format     string
+	Client     *clientBundle `json:",omitempty"`
+	Salt       []byte        `json:",omitempty"`
+	Nonce      []byte        `json:",omitempty"`
+	Ciphertext []byte        `json:",omitempty"`
+}
+
+// bundleKey derives the encryption key of a client bundle from the passphrase.
+func bundleKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, chacha20poly1305.KeySize)
+}
+
+// encodeClientBundle returns the content of the bundle file, encrypted if a passphrase is given.
+func encodeClientBundle(bundle clientBundle, passphrase string) ([]byte, error) {
+	file := clientBundleFile{Format: clientBundleFormat, Client: &bundle}
+
+	if passphrase != "" {
+		plaintext, err := json.Marshal(bundle)
+		if err != nil {
+			return nil, err
+		}
+
+		file.Client = nil
+		file.Salt = make([]byte, 16)
+		file.Nonce = make([]byte, chacha20poly1305.NonceSizeX)
+		if _, err = rand.Read(file.Salt); err != nil {
+			return nil, err
+		}
+		if _, err = rand.Read(file.Nonce); err != nil {
+			return nil, err
+		}
+
+		key, err := bundleKey(passphrase, file.Salt)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, err
+		}
+		file.Ciphertext = aead.Seal(nil, file.Nonce, plaintext, []byte(clientBundleFormat))
+	}
+
+	return json.MarshalIndent(file, "", " ")
+}
+
+// decodeClientBundle parses the content of a bundle file, decrypting it with the passphrase if it
+// is encrypted.
+func decodeClientBundle(content []byte, passphrase string) (clientBundle, error) {
+	var file clientBundleFile
+	if err := json.Unmarshal(content, &file); err != nil || file.Format != clientBundleFormat {
+		return clientBundle{}, newError(errValidation, "not a client bundle written by 'export client'")
+	}
+	if file.Client != nil {
+		return *file.Client, nil
+	}
+
+	if passphrase == "" {
+		return clientBundle{}, newError(errUsage, "the client bundle is encrypted, give its passphrase with --passphrase")
+	}
+	key, err := bundleKey(passphrase, file.Salt)
+	if err != nil {
+		return clientBundle{}, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil || len(file.Nonce) != aead.NonceSize() {
+		return clientBundle{}, newError(errValidation, "the client bundle is damaged")
+	}
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, []byte(clientBundleFormat))
+	if err != nil {
+		return clientBundle{}, newError(errValidation, "wrong passphrase or damaged client bundle")
+	}
+
+	var bundle clientBundle
+	if err = json.Unmarshal(plaintext, &bundle); err != nil {
+		return clientBundle{}, newError(errValidation, "the client bundle is damaged: %w", err)
+	}
+
+	return bundle, nil
+}
+
+// findClient returns the zero-based index of the client given by its number or by its Name
+// metadata, see clientName.
+func (config *appConfig) findClient(client string) (int, error) {
+	if _, err := strconv.Atoi(client); err == nil {
+		selected, err := config.parseClientSelection(client)
+		if err != nil {
+			return 0, err
+		}
+		return selected[0], nil
+	}
+
+	for i := range config.Clients {
+		if strings.EqualFold(config.clientName(i), client) {
+			return i, nil
+		}
+	}
+
+	return 0, newError(errUsage, "client '%s' does not exist", client)
+}
+
+// exportClientBundle collects the client with the given zero-based index into a bundle.
+func (config *appConfig) exportClientBundle(index int) clientBundle {
+	info := config.clientInfo(index)
+	bundle := clientBundle{
+		PrivateKey: config.Clients[index].PrivateKey,
+		PublicKey:  config.Server.Peers[index].PublicKey,
+		Address:    joinIPNets(config.Clients[index].Address),
+		Metadata:   info.Metadata,
+		Notes:      info.Notes,
+		Group:      info.Group,
+		Exported:   time.Now().UTC(),
+	}
+	if publicKey, err := base64PublicKeyFromPrivate(config.Server.PrivateKey); err == nil {
+		bundle.Server = publicKey
+	}
+	if group := config.findGroup(info.Group); group != nil {
+		bundle.Defaults = group.Defaults
+	}
+
+	return bundle
+}
+
+// importClientBundle adds the client of the bundle to this server: it gets a free address of the
+// local subnet and the local endpoint and server key like a client added with -add, together with
+// the metadata, notes and group of the bundle, and is marked as needing re-provisioning. The key of
+// the bundle is kept unless rotate is set, then the client gets a new one. It expires like a new
+// client of its group, see setClientExpiry.
+//
+// Parameters:
+//     bundle (clientBundle): The client exported from the other server.
+//     rotate (bool): Whether to generate a new key instead of reusing the one of the bundle.
+//
+// Returns:
+//     error: A conflict error if the key is already used here or the subnet is full, a validation
+//         error if the key of an external-key client is to be rotated.
+//
+// Usage:
+//     err := config.importClientBundle(bundle, false)
+func (config *appConfig) importClientBundle(bundle clientBundle, rotate bool) error {
+	if err := validateBase64Key(bundle.PublicKey); err != nil {
+		return newError(errValidation, "the client bundle holds an invalid public key")
+	}
+	if bundle.PrivateKey == "" && rotate {
+		return newError(errValidation, "the client uses an external key, which can only be rotated on the device")
+	}
+	for _, peer := range config.Server.Peers {
+		if peer.PublicKey == bundle.PublicKey && !rotate {
+			return newError(errConflict, "the key of the client is already used by a client of this server, "+
+				"use --rotate to import it with a new key")
+		}
+	}
+
+	if bundle.Group != "" && config.findGroup(bundle.Group) == nil {
+		if err := config.ensureGroup(bundle.Group); err != nil {
+			return err
+		}
+		if group := config.findGroup(bundle.Group); len(bundle.Defaults) > 0 {
+			fmt.Printf("Group '%s' created with the defaults of the other server.\n", bundle.Group)
+			group.Defaults = bundle.Defaults
+		}
+	}
+
+	if err := config.addClient(); err != nil {
+		return err
+	}
+	index := len(config.Clients) - 1
+	client := &config.Clients[index]
+
+	if !rotate {
+		client.PrivateKey = bundle.PrivateKey
+		config.Server.Peers[index].PublicKey = bundle.PublicKey
+	}
+
+	info := config.clientInfo(index)
+	info.Metadata = append([]metadataEntry(nil), bundle.Metadata...)
+	info.Notes = append([]string(nil), bundle.Notes...)
+	info.setMetadata(metadataEntry{Key: reprovisionMetadataKey, Value: "needs re-provisioning"})
+	if bundle.Group != "" {
+		info.Group = bundle.Group
+		config.defaultsForGroup(bundle.Group).applyTo(client)
+		config.ensureServerAddressAllowed(client)
+	}
+	config.setClientExpiry(index, time.Now())
+
+	return nil
+}
+
+// runExportClientCommand implements 'export client' and its alias 'export-client', which writes a
+// single client with its keys, metadata, notes and group into a bundle file, to be moved to another
+// server with 'import-client':
+//
+//     export-client 2 --out contractor.bundle
+//     export-client alice --out alice.bundle --passphrase "correct horse battery staple"
+//
+// Clients can be given by number or by their Name metadata. The bundle holds the private key of
+// the client; with --passphrase, or WGQC_EXPORT_CLIENT_PASSPHRASE, it is encrypted.
+func runExportClientCommand(configPath string, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return newError(errUsage, "usage: export-client <client> --out file.bundle [--passphrase text]")
+	}
+
+	flags := flag.NewFlagSet("export-client", flag.ContinueOnError)
+	out := flags.String("out", "", "File of the client bundle")
+	passphrase := flags.String("passphrase", "", "Encrypts the bundle with this passphrase")
+	if err := parseFlags(flags, "export-client", args[1:]); err != nil {
+		return err
+	}
+	if *out == "" || flags.NArg() != 0 {
+		return newError(errUsage, "usage: export-client <client> --out file.bundle [--passphrase text]")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	index, err := config.findClient(args[0])
+	if err != nil {
+		return err
+	}
+
+	content, err := encodeClientBundle(config.exportClientBundle(index), *passphrase)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(*out, content, 0600); err != nil {
+		return fmt.Errorf("can't write %s: %w", *out, err)
+	}
+
+	fmt.Printf("Successfully exported %s: %s\n", config.clientName(index), *out)
+	if *passphrase == "" && config.Clients[index].PrivateKey != "" {
+		fmt.Println("Warning: the bundle contains the private key of the client unencrypted, " +
+			"use --passphrase when it leaves this machine.")
+	}
+	fmt.Println("Remove the client here once it has been imported on the other server.")
+	return nil
+}
+
+// runImportClientCommand implements the 'import-client' command, which adds a client exported from
+// another server with 'export-client':
+//
+//     import-client contractor.bundle
+//     import-client alice.bundle --passphrase "correct horse battery staple" --rotate
+//
+// The client gets an address of the local subnet, the local endpoint and server key and the local
+// defaults, and keeps its metadata, notes and group. Since its device still uses the configuration
+// of the other server, it is marked "Status: needs re-provisioning" until that metadata is changed.
+// The key is kept by default, which is warned about as both servers then accept it, --rotate
+// generates a new one.
+func runImportClientCommand(configPath string, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return newError(errUsage, "usage: import-client <file> [--passphrase text] [--rotate]")
+	}
+
+	flags := flag.NewFlagSet("import-client", flag.ContinueOnError)
+	passphrase := flags.String("passphrase", "", "Passphrase of an encrypted bundle")
+	rotate := flags.Bool("rotate", false, "Generates a new key instead of reusing the one of the bundle")
+	if err := parseFlags(flags, "import-client", args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return newError(errUsage, "usage: import-client <file> [--passphrase text] [--rotate]")
+	}
+
+	content, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return newError(errValidation, "can't read %s: %w", args[0], err)
+	}
+	bundle, err := decodeClientBundle(content, *passphrase)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	if err = config.importClientBundle(bundle, *rotate); err != nil {
+		return err
+	}
+	index := len(config.Clients) - 1
+
+	if problems := config.Validate(); len(problems) > 0 {
+		return fmt.Errorf("refusing to write a configuration that isn't deployable: %w", validationFailure(problems))
+	}
+	clientFileName, err := config.writeClientConfigFile(configPath, index)
+	if err != nil {
+		return err
+	}
+	fmt.Println(config.savedMessage("client configuration", clientFileName))
+	serverFileName, err := config.writeServerConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println(config.savedMessage("server configuration", serverFileName))
+	config.printDnsWarnings(index)
+
+	if err = config.saveWithHistory(configPath, "import-client", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	imported := fmt.Sprintf("client %d", index+1)
+	if name := config.clientName(index); name != imported {
+		imported = fmt.Sprintf("%s as %s", name, imported)
+	}
+	fmt.Printf("Imported %s with address %s, replace the configuration on the device with %s.\n",
+		imported, joinIPNets(config.Clients[index].Address), clientFileName)
+	if !*rotate && bundle.PrivateKey != "" {
+		fmt.Println("Warning: the client keeps its key, so the other server accepts it as well until the client " +
+			"is removed there. Use --rotate to import it with a new key.")
+	}
+
+	return appendAuditLog(configPath, "import-client", map[string]interface{}{"Client": index + 1,
+		"PublicKey": config.Server.Peers[index].PublicKey, "Rotated": *rotate})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// portObservation is the listen port of the server as one source records or observes it, see
+// checkListenPorts.
+type portObservation struct {
+	Source string
+	Port   int
+	// Expected is the port the source should have, the listen port of config.json, or the relay
+	// port for the client endpoints behind a relay.
+	Expected int
+}
+
+// portCheck is the result of checkListenPorts: what every source says, the sources that couldn't
+// be checked and the commands that bring the diverging ones back in line.
+type portCheck struct {
+	ListenPort   int
+	Observations []portObservation
+	// Unverified are the sources that couldn't be checked, with the reason.
+	Unverified []string `json:",omitempty"`
+	Fixes      []string `json:",omitempty"`
+}
+
+// diverging returns the observations that don't match their expected port.
+func (check portCheck) diverging() []portObservation {
+	var diverging []portObservation
+	for _, observation := range check.Observations {
+		if observation.Port != observation.Expected {
+			diverging = append(diverging, observation)
+		}
+	}
+
+	return diverging
+}
+
+// String describes the check as a single finding for 'doctor', empty if every source agrees.
+func (check portCheck) String() string {
+	if len(check.diverging()) == 0 {
+		return ""
+	}
+
+	result := fmt.Sprintf("the listen port of the server diverges, config.json has %d:", check.ListenPort)
+	for _, observation := range check.Observations {
+		mark := "ok"
+		if observation.Port != observation.Expected {
+			mark = fmt.Sprintf("expected %d", observation.Expected)
+		}
+		result += fmt.Sprintf("\n  %-40s %5d  %s", observation.Source, observation.Port, mark)
+	}
+	for _, fix := range check.Fixes {
+		result += "\n  Fix: " + fix
+	}
+
+	return result
+}
+
+// endpointPortSources returns the ports the clients were told, read from their configuration files,
+// as one observation per port with the clients using it.
+func (config *appConfig) endpointPortSources(configPath string, expected int) ([]portObservation, []string) {
+	var unverified []string
+	clients := make(map[int][]string)
+	for i := range config.Clients {
+		content, err := config.readClientFile(configPath, i)
+		if err != nil {
+			unverified = append(unverified, fmt.Sprintf("the endpoint of client %d: %v", i+1, err))
+			continue
+		}
+		parsed, _, err := parseWireguardConfigText(string(content), fmt.Sprintf(defaultClientConfigFile, i+1), parseLenient)
+		if err != nil || len(parsed.Peers) == 0 {
+			unverified = append(unverified, fmt.Sprintf("the endpoint of client %d: the file doesn't parse", i+1))
+			continue
+		}
+		_, portString, err := net.SplitHostPort(parsed.Peers[0].Endpoint)
+		port, _ := strconv.Atoi(portString)
+		if err != nil || port == 0 {
+			unverified = append(unverified, fmt.Sprintf("the endpoint of client %d: no port in '%s'", i+1,
+				parsed.Peers[0].Endpoint))
+			continue
+		}
+		clients[port] = append(clients[port], strconv.Itoa(i+1))
+	}
+
+	var observations []portObservation
+	for port, numbers := range clients {
+		source := "endpoint of client " + numbers[0]
+		if len(numbers) > 1 {
+			source = "endpoint of clients " + strings.Join(numbers, ", ")
+		}
+		if len(source) > 40 {
+			source = fmt.Sprintf("endpoint of %d clients", len(numbers))
+		}
+		observations = append(observations, portObservation{Source: source, Port: port, Expected: expected})
+	}
+	sort.Slice(observations, func(i, j int) bool { return observations[i].Port < observations[j].Port })
+
+	return observations, unverified
+}
+
+// firewallRulePorts returns the UDP ports of the enabled inbound firewall rule of the server, named
+// after artifactName. A legacy rule is named after the port it was created for, so with the legacy
+// naming any "Wireguard <port>" rule is taken when the current name doesn't exist.
+func (config *appConfig) firewallRulePorts(ps Executor) (string, []int, error) {
+	if !windowsHost {
+		return "", nil, fmt.Errorf("not on Windows")
+	}
+
+	script := fmt.Sprintf("$rules = @(Get-NetFirewallRule -DisplayName %s -ErrorAction SilentlyContinue)\n",
+		quotePowerShell(config.artifactName(artifactFirewallRule)))
+	if config.NamingScheme < namingSchemeInstance || config.Instance == "" {
+		script += "if ($rules.Count -eq 0) { $rules = @(Get-NetFirewallRule -DisplayName 'Wireguard *' -ErrorAction SilentlyContinue) }\n"
+	}
+	script += `$rules | Where-Object { $_.Enabled -eq 'True' -and $_.Direction -eq 'Inbound' } | ForEach-Object {
+			$rule = $_
+			$rule | Get-NetFirewallPortFilter | Where-Object { $_.Protocol -eq 'UDP' } | ForEach-Object {
+				"{0}` + "`t" + `{1}" -f $rule.DisplayName, ($_.LocalPort -join ',')
+			}
+		}`
+
+	result := ps.Execute(context.Background(), script)
+	if result.Err != nil {
+		return "", nil, result.Err
+	}
+	var name string
+	var ports []int
+	for _, line := range strings.Split(strings.TrimSpace(result.StdOut), "\n") {
+		ruleName, list, found := strings.Cut(strings.TrimSpace(line), "\t")
+		if !found {
+			continue
+		}
+		if name == "" {
+			name = ruleName
+		}
+		for _, field := range strings.Split(list, ",") {
+			if port, err := strconv.Atoi(strings.TrimSpace(field)); err == nil {
+				ports = append(ports, port)
+			}
+		}
+	}
+	if name == "" {
+		return "", nil, fmt.Errorf("no enabled inbound rule '%s' found", config.artifactName(artifactFirewallRule))
+	}
+
+	return name, ports, nil
+}
+
+// runningListenPort returns the port the running tunnel is bound to: from 'wg show' where wg is on
+// the PATH, otherwise from the UDP endpoints owned by the process of the tunnel service.
+func (config *appConfig) runningListenPort(ps Executor) (int, string, error) {
+	if output, err := exec.Command("wg", "show", config.tunnelName(), "listen-port").Output(); err == nil {
+		if port, err := strconv.Atoi(strings.TrimSpace(string(output))); err == nil {
+			return port, "wg show", nil
+		}
+	}
+	if !windowsHost {
+		return 0, "", fmt.Errorf("the tunnel %s isn't running", config.tunnelName())
+	}
+
+	script := fmt.Sprintf(`$service = Get-CimInstance -ClassName Win32_Service -ErrorAction SilentlyContinue |
+			Where-Object { $_.Name -eq %s }
+		if ($service -and $service.ProcessId) {
+			"pid {0}" -f $service.ProcessId
+			Get-NetUDPEndpoint -OwningProcess $service.ProcessId -ErrorAction SilentlyContinue |
+				ForEach-Object { "port {0}" -f $_.LocalPort }
+		}`, quotePowerShell("WireGuardTunnel$"+config.tunnelName()))
+	result := ps.Execute(context.Background(), script)
+	if result.Err != nil {
+		return 0, "", result.Err
+	}
+
+	pid := ""
+	for _, line := range strings.Split(result.StdOut, "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch key {
+		case "pid":
+			pid = value
+		case "port":
+			if port, err := strconv.Atoi(value); err == nil {
+				return port, "service PID " + pid, nil
+			}
+		}
+	}
+	if pid == "" {
+		return 0, "", fmt.Errorf("the tunnel service %s isn't running", config.tunnelName())
+	}
+	return 0, "", fmt.Errorf("the tunnel service (PID %s) owns no UDP endpoint, the socket may belong to the "+
+		"WireGuardNT driver", pid)
+}
+
+// checkListenPorts cross-checks the listen port of the server in every place it is recorded or
+// observed, which drift apart when one of them is changed by hand: the ListenPort of the server
+// configuration file on disk, the Endpoint port of every client configuration file, the port of
+// the firewall rule, and the port the running tunnel is bound to. Behind a relay the clients are
+// expected to dial the relay port, and the relay to forward to the listen port. Sources that can't
+// be read, e.g. the firewall outside Windows or a stopped tunnel, are listed as unverified, the
+// others are still compared.
+//
+// Parameters:
+//     configPath (string): The profile directory.
+//     ps (Executor): Runs the firewall and service queries, see NewPowerShell.
+//
+// Returns:
+//     portCheck: The observations, the unverified sources and the fix commands.
+//
+// Usage:
+//     if finding := config.checkListenPorts(configPath, NewPowerShell()).String(); finding != "" { ... }
+func (config *appConfig) checkListenPorts(configPath string, ps Executor) portCheck {
+	listenPort := int(config.Server.ListenPort)
+	check := portCheck{ListenPort: listenPort}
+
+	if config.staged() {
+		check.Unverified = append(check.Unverified, "the configuration files: changes are staged, see 'status'")
+	} else {
+		server, _, err := readWireguardConfigFile(configPath+config.serverConfigFile(), parseLenient)
+		if err != nil {
+			check.Unverified = append(check.Unverified, fmt.Sprintf("%s: %v", config.serverConfigFile(), err))
+		} else {
+			check.Observations = append(check.Observations, portObservation{
+				Source: config.serverConfigFile() + " ListenPort", Port: int(server.ListenPort), Expected: listenPort})
+		}
+
+		clientPort := listenPort
+		if config.Relay != nil {
+			clientPort = relayPort(config.Relay.Endpoint)
+			check.Observations = append(check.Observations, portObservation{Source: "relay target",
+				Port: relayPort(config.Relay.Target), Expected: listenPort})
+		}
+		endpoints, unverified := config.endpointPortSources(configPath, clientPort)
+		check.Observations = append(check.Observations, endpoints...)
+		check.Unverified = append(check.Unverified, unverified...)
+	}
+
+	firewallRule, ports, err := config.firewallRulePorts(ps)
+	if err != nil {
+		check.Unverified = append(check.Unverified, "the firewall rule: "+err.Error())
+	} else if len(ports) > 0 {
+		// A rule allowing several ports is fine as long as one of them is the listen port
+		port := ports[0]
+		for _, candidate := range ports {
+			if candidate == listenPort {
+				port = candidate
+			}
+		}
+		check.Observations = append(check.Observations, portObservation{Source: fmt.Sprintf("firewall rule '%s'", firewallRule),
+			Port: port, Expected: listenPort})
+	}
+
+	if port, how, err := config.runningListenPort(ps); err != nil {
+		check.Unverified = append(check.Unverified, "the running tunnel: "+err.Error())
+	} else {
+		check.Observations = append(check.Observations, portObservation{Source: "running tunnel (" + how + ")",
+			Port: port, Expected: listenPort})
+	}
+
+	// One fix per kind of divergence
+	var files, running bool
+	for _, observation := range check.diverging() {
+		switch {
+		case strings.HasPrefix(observation.Source, "firewall rule"):
+			check.Fixes = append(check.Fixes, fmt.Sprintf("netsh advfirewall firewall set rule name=\"%s\" new localport=%d",
+				firewallRule, listenPort))
+		case strings.HasPrefix(observation.Source, "running tunnel"):
+			running = true
+		case observation.Source == "relay target":
+			host, _, _ := net.SplitHostPort(config.Relay.Target)
+			check.Fixes = append(check.Fixes, fmt.Sprintf("wg-quick-config relay set %s --target %s",
+				config.Relay.Endpoint, net.JoinHostPort(host, strconv.Itoa(listenPort))))
+		default:
+			files = true
+		}
+	}
+	if files && len(config.Clients) > 0 && len(config.Clients[0].Peers) > 0 {
+		check.Fixes = append(check.Fixes, "wg-quick-config set-endpoint "+config.Clients[0].Peers[0].Endpoint+
+			" (regenerates the configuration files, hand the clients their new files or QR codes)")
+	}
+	if running {
+		check.Fixes = append(check.Fixes, "wg-quick-config -restart")
+	}
+
+	return check
+}
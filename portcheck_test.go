@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFirewallRulePorts(t *testing.T) {
+	fakeWindowsHost(t)
+
+	tests := []struct {
+		name       string
+		instance   string
+		output     Result
+		wantScript []string
+		wantName   string
+		wantPorts  []int
+		wantErr    bool
+	}{
+		{
+			name:   "legacy naming",
+			output: Result{StdOut: "Wireguard 51820\t51820\r\n"},
+			wantScript: []string{"Get-NetFirewallRule -DisplayName 'Wireguard 51820'",
+				"if ($rules.Count -eq 0) { $rules = @(Get-NetFirewallRule -DisplayName 'Wireguard *'"},
+			wantName:  "Wireguard 51820",
+			wantPorts: []int{51820},
+		},
+		{
+			name:       "instance naming",
+			instance:   "office",
+			output:     Result{StdOut: "Wireguard office\t51820,51821\r\n"},
+			wantScript: []string{"Get-NetFirewallRule -DisplayName 'Wireguard office'"},
+			wantName:   "Wireguard office",
+			wantPorts:  []int{51820, 51821},
+		},
+		{
+			name:    "no rule",
+			output:  Result{StdOut: "\r\n"},
+			wantErr: true,
+		},
+		{
+			name:    "query failed",
+			output:  Result{Err: errors.New("exit status 1")},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := appConfig{}
+			config.Server.ListenPort = 51820
+			if test.instance != "" {
+				config.Instance, config.NamingScheme = test.instance, namingSchemeInstance
+			}
+			ps := &fakeExecutor{Rules: []fakeRule{{Match: "Get-NetFirewallRule", Result: test.output}}}
+
+			name, ports, err := config.firewallRulePorts(ps)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("firewallRulePorts() error = %v, want error %v", err, test.wantErr)
+			}
+			if name != test.wantName || !reflect.DeepEqual(ports, test.wantPorts) {
+				t.Errorf("firewallRulePorts() = %q, %v, want %q, %v", name, ports, test.wantName, test.wantPorts)
+			}
+			for _, command := range test.wantScript {
+				if !ps.ran(command) {
+					t.Errorf("no script runs %q: %q", command, ps.Scripts)
+				}
+			}
+			if test.instance != "" && ps.ran("'Wireguard *'") {
+				t.Errorf("the legacy rule names are searched with the instance naming: %q", ps.Scripts)
+			}
+		})
+	}
+}
+
+func TestRunningListenPort(t *testing.T) {
+	fakeWindowsHost(t)
+
+	tests := []struct {
+		name       string
+		output     string
+		wantPort   int
+		wantSource string
+		wantErr    string
+	}{
+		{"bound", "pid 4242\r\nport 51820\r\n", 51820, "service PID 4242", ""},
+		{"stopped", "", 0, "", "isn't running"},
+		{"driver socket", "pid 4242\r\n", 0, "", "owns no UDP endpoint"},
+	}
+
+	for _, test := range tests {
+		config := appConfig{}
+		config.Instance, config.NamingScheme = "zz-test-no-such-tunnel", namingSchemeInstance
+		ps := &fakeExecutor{Rules: []fakeRule{{Match: "Win32_Service", Result: Result{StdOut: test.output}}}}
+
+		port, source, err := config.runningListenPort(ps)
+		if port != test.wantPort || source != test.wantSource {
+			t.Errorf("%s: runningListenPort() = %d, %q, want %d, %q", test.name, port, source, test.wantPort, test.wantSource)
+		}
+		if (test.wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: runningListenPort() error = %v, want %q", test.name, err, test.wantErr)
+		}
+		if !ps.ran("Where-Object { $_.Name -eq 'WireGuardTunnel$zz-test-no-such-tunnel' }") {
+			t.Errorf("%s: the service wasn't looked up by name: %q", test.name, ps.Scripts)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// IsAdminElevated tells whether the process runs as root, the counterpart of the Windows
+// administrator check in windows.go. Root is both a member of the administrators and elevated.
+func IsAdminElevated() (bool, bool, error) {
+	root := os.Geteuid() == 0
+	return root, root, nil
+}
+
+// replaceFile renames a file over another one for writeFileAtomic, rename replaces the destination
+// atomically on POSIX. The directory entry is synced by writeFileAtomic.
+func replaceFile(from, to string) error {
+	return os.Rename(from, to)
+}
+
+// windowsVersion returns 0, 0, this isn't Windows.
+func windowsVersion() (int, int) {
+	return 0, 0
+}
+
+// disableConsoleEcho stops the terminal from echoing what is typed, so that readSecret doesn't show
+// a passphrase, the counterpart of the console mode change in windows.go. Lines are still read
+// whole and Ctrl+C still interrupts.
+//
+// Parameters:
+//     f (*os.File): The terminal, os.Stdin.
+//
+// Returns:
+//     func(): Restores the previous mode of the terminal.
+//     error: An error if the file isn't a terminal.
+//
+// Usage:
+//     restore, err := disableConsoleEcho(os.Stdin)
+func disableConsoleEcho(f *os.File) (func(), error) {
+	fd := int(f.Fd())
+	termios, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := *termios
+	termios.Lflag &^= unix.ECHO
+	termios.Lflag |= unix.ICANON | unix.ISIG
+	if err = unix.IoctlSetTermios(fd, ioctlWriteTermios, termios); err != nil {
+		return nil, err
+	}
+
+	return func() { unix.IoctlSetTermios(fd, ioctlWriteTermios, &previous) }, nil
+}
@@ -2,9 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"os/exec"
+	"runtime"
+	"unicode/utf16"
 )
 
+// Result is the outcome of a PowerShell script run by an Executor.
+type Result struct {
+	StdOut string
+	StdErr string
+	Err    error // Non-nil if the script couldn't be run or exited with a non-zero code
+}
+
+// Executor runs PowerShell scripts. The Windows helpers, e.g. startWireguardTunnel, take an
+// Executor instead of starting powershell.exe themselves, so that the scripts they generate can be
+// checked without a Windows machine.
+type Executor interface {
+	Execute(ctx context.Context, script string) Result
+}
+
 // PowerShell represents a PowerShell instance.
 type PowerShell struct {
 	powerShell string
@@ -26,34 +44,59 @@ func NewPowerShell() *PowerShell {
 	}
 }
 
-// execute runs a given PowerShell command and returns its standard output,
-// standard error, and any error that occurred during execution. The function
-// constructs the command using the PowerShell instance and the provided arguments.
+// newExecutor returns the Executor of the PowerShell scripts run on this host. It is NewPowerShell,
+// unless replaced to run the commands against a fake host, e.g. by an integration harness driving
+// the commands without Windows or administrator rights.
+var newExecutor = func() Executor { return NewPowerShell() }
+
+// windowsHost tells whether the helpers taking an Executor query this host through PowerShell. It
+// is true on Windows only, and is set by the tests to check the scripts of those helpers against a
+// fake Executor on any platform.
+var windowsHost = runtime.GOOS == "windows"
+
+// powerShellUtf8Output makes PowerShell write its output as UTF-8, so that e.g. paths with
+// non-ASCII characters survive whatever the console code page is.
+const powerShellUtf8Output = "[Console]::OutputEncoding = [System.Text.Encoding]::UTF8\n"
+
+// encodePowerShellCommand encodes a script for -EncodedCommand: base64 of its UTF-16LE form.
+func encodePowerShellCommand(script string) string {
+	var encoded []byte
+	for _, unit := range utf16.Encode([]rune(script)) {
+		encoded = append(encoded, byte(unit), byte(unit>>8))
+	}
+
+	return base64.StdEncoding.EncodeToString(encoded)
+}
+
+// Execute runs a PowerShell script and returns its standard output, standard error, and any
+// error that occurred during execution. The script is killed when the context is done.
 //
 // The '-NoProfile' and '-NonInteractive' flags are added to the command to
 // prevent the loading of the PowerShell profile and to ensure the command runs
 // without requiring interactive user input.
 //
+// The script is passed with '-EncodedCommand' rather than as a command line argument, so that
+// quotes, spaces and non-ASCII characters, e.g. in the path of a profile, reach PowerShell
+// unchanged whatever the code page. Its output is read as UTF-8.
+//
 // Parameters:
-//     args (string): Zero or more string arguments that represent the command to be run.
+//     ctx (context.Context): Bounds the run time of the script.
+//     script (string): The PowerShell script to run.
 //
 // Returns:
-//     stdOut (string): The standard output from the executed command.
-//     stdErr (string): The standard error from the executed command.
-//     err (error): An error object indicating any errors that occurred during command execution.
+//     Result: The standard output, standard error and error of the script.
 //
 // Usage:
-//     stdOut, stdErr, err := ps.execute("Get-Process")
-func (p *PowerShell) execute(args ...string) (stdOut string, stdErr string, err error) {
-	args = append([]string{"-NoProfile", "-NonInteractive"}, args...)
-	cmd := exec.Command(p.powerShell, args...)
+//     result := ps.Execute(context.Background(), "Get-Process")
+func (p *PowerShell) Execute(ctx context.Context, script string) Result {
+	cmd := exec.CommandContext(ctx, p.powerShell, "-NoProfile", "-NonInteractive", "-EncodedCommand",
+		encodePowerShellCommand(powerShellUtf8Output+script))
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	err = cmd.Run()
-	stdOut, stdErr = stdout.String(), stderr.String()
-	return
+	err := cmd.Run()
+	return Result{StdOut: stdout.String(), StdErr: stderr.String(), Err: err}
 }
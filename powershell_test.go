@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// fakeRule answers the scripts containing Match with Result.
+type fakeRule struct {
+	Match  string
+	Result Result
+}
+
+// fakeExecutor is an Executor that records the scripts it is given and answers them from canned
+// results instead of running PowerShell. A script gets the Result of the first rule whose Match it
+// contains, an empty successful Result if none matches.
+type fakeExecutor struct {
+	Rules   []fakeRule
+	Scripts []string
+}
+
+// Execute records the script and returns the canned result of the first matching rule.
+func (ps *fakeExecutor) Execute(ctx context.Context, script string) Result {
+	ps.Scripts = append(ps.Scripts, script)
+	for _, rule := range ps.Rules {
+		if strings.Contains(script, rule.Match) {
+			return rule.Result
+		}
+	}
+	return Result{}
+}
+
+// ran tells whether a recorded script contains the given command.
+func (ps *fakeExecutor) ran(command string) bool {
+	for _, script := range ps.Scripts {
+		if strings.Contains(script, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeWindowsHost makes the helpers taking an Executor query it as on Windows for the test.
+func fakeWindowsHost(t *testing.T) {
+	t.Helper()
+	previous := windowsHost
+	windowsHost = true
+	t.Cleanup(func() { windowsHost = previous })
+}
+
+func TestQuotePowerShell(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`C:\wiresock\wiresock.conf`, `'C:\wiresock\wiresock.conf'`},
+		{`C:\Program Files (x86)\My $Configs\`, `'C:\Program Files (x86)\My $Configs\'`},
+		{`C:\Users\O'Brien\`, `'C:\Users\O''Brien\'`},
+		{"C:\\Users\\O\u2019Brien\\", "'C:\\Users\\O\u2019\u2019Brien\\'"},
+		{"a\u2018b\u201ac\u201bd", "'a\u2018\u2018b\u201a\u201ac\u201b\u201bd'"},
+		{`C:\Users\José María\`, `'C:\Users\José María\'`},
+		{"", "''"},
+	}
+
+	for _, test := range tests {
+		if got := quotePowerShell(test.value); got != test.want {
+			t.Errorf("quotePowerShell(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+// decodePowerShellCommand decodes an -EncodedCommand argument back into the script.
+func decodePowerShellCommand(t *testing.T, encoded string) string {
+	t.Helper()
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("%q isn't base64: %v", encoded, err)
+	}
+	if len(decoded)%2 != 0 {
+		t.Fatalf("%q has an odd number of bytes", encoded)
+	}
+	units := make([]uint16, len(decoded)/2)
+	for i := range units {
+		units[i] = uint16(decoded[2*i]) | uint16(decoded[2*i+1])<<8
+	}
+
+	return string(utf16.Decode(units))
+}
+
+func TestEncodePowerShellCommand(t *testing.T) {
+	for _, script := range []string{"Get-Service", "Write-Host 'José € 😀'", ""} {
+		if decoded := decodePowerShellCommand(t, encodePowerShellCommand(script)); decoded != script {
+			t.Errorf("encodePowerShellCommand(%q) decodes to %q", script, decoded)
+		}
+	}
+}
+
+func TestPowerShellExecuteArguments(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stand-in for powershell.exe is a shell script")
+	}
+	// The stand-in prints every argument on its own line
+	powerShell := filepath.Join(t.TempDir(), "powershell")
+	if err := ioutil.WriteFile(powerShell, []byte("#!/bin/sh\nprintf '%s\\n' \"$@\"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	script := fmt.Sprintf(`&"wireguard.exe" /installtunnelservice %s`,
+		quotePowerShell(`C:\Users\José O'Brien\Configs (x86)\My $Configs\wiresock.conf`))
+	result := (&PowerShell{powerShell: powerShell}).Execute(context.Background(), script)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	args := strings.Split(strings.TrimSuffix(result.StdOut, "\n"), "\n")
+	if len(args) != 4 || args[0] != "-NoProfile" || args[1] != "-NonInteractive" || args[2] != "-EncodedCommand" {
+		t.Fatalf("arguments = %q, want the script as -EncodedCommand only", args)
+	}
+	if decoded := decodePowerShellCommand(t, args[3]); decoded != powerShellUtf8Output+script {
+		t.Errorf("the script arrives as %q, want %q", decoded, powerShellUtf8Output+script)
+	}
+
+	failing := filepath.Join(t.TempDir(), "powershell")
+	if err := ioutil.WriteFile(failing, []byte("#!/bin/sh\necho denied >&2\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if result = (&PowerShell{powerShell: failing}).Execute(context.Background(), "Get-Service"); result.Err == nil ||
+		result.StdErr != "denied\n" {
+		t.Errorf("failing script = %+v, want its error and stderr", result)
+	}
+}
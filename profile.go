@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// defaultProfileName is the profile used when neither -profile nor -config-path is given.
+const defaultProfileName = "default"
+
+// knownProfilesFile lists, in the profiles root, the directories selected with -config-path so that
+// 'list-profiles' can show them too.
+const knownProfilesFile = "known-profiles.json"
+
+// configPathOverride selects the profile directory directly, set with -config-path.
+var configPathOverride string
+
+// profileName selects a named profile under the profiles root, set with -profile.
+var profileName string
+
+// profilesRoot returns the directory holding the named profiles: %PROGRAMDATA%\wg-quick-config on
+// Windows and the user configuration directory (e.g. ~/.config/wg-quick-config) elsewhere.
+func profilesRoot() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("PROGRAMDATA"), "wg-quick-config")
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "wg-quick-config")
+}
+
+// defaultProfileDir returns the directory of the default profile. On Windows this is the directory
+// used by WireSock VPN Gateway, so that existing installations keep working.
+func defaultProfileDir() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ALLUSERSPROFILE"), "NT KERNEL", "WireSock VPN Gateway")
+	}
+
+	return filepath.Join(profilesRoot(), defaultProfileName)
+}
+
+// resolveProfileDir returns the profile directory every command works in, creating it on demand
+// with permissions restricted to its owner. The directory is selected by -config-path, then by
+// -profile, and is the default profile otherwise. A profile directory can be moved freely, nothing
+// in it refers to its own location.
+//
+// Returns:
+//     string: The profile directory, with a trailing path separator so file names can be appended.
+//     error: A usage error for an invalid profile name, or the error creating the directory.
+//
+// Usage:
+//     configPath, err := resolveProfileDir()
+func resolveProfileDir() (string, error) {
+	dir := defaultProfileDir()
+
+	switch {
+	case configPathOverride != "":
+		abs, err := filepath.Abs(configPathOverride)
+		if err != nil {
+			return "", err
+		}
+		dir = abs
+	case profileName != "" && profileName != defaultProfileName:
+		named, err := namedProfileDir(profileName)
+		if err != nil {
+			return "", err
+		}
+		dir = named
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("can't create the profile directory %s: %w", dir, err)
+	}
+	if configPathOverride != "" {
+		registerKnownProfile(dir)
+	}
+
+	return strings.TrimRight(dir, `\/`) + string(os.PathSeparator), nil
+}
+
+// namedProfileDir returns the directory of the named profile under the profiles root, without
+// creating it. Names can't contain path separators.
+func namedProfileDir(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `\/:`) || name == "." || name == ".." {
+		return "", newError(errUsage, "invalid profile name '%s'", name)
+	}
+
+	return filepath.Join(profilesRoot(), name), nil
+}
+
+// checkProfileWritable verifies up front that commands changing the profile can write it, so that
+// they don't fail halfway with a partially written configuration. Permission bits don't tell the
+// whole story on Windows, where ACLs decide, so a temporary file is actually created and deleted,
+// and the state file, if present, is opened for writing.
+//
+// Parameters:
+//     configPath (string): The profile directory, see resolveProfileDir.
+//
+// Returns:
+//     error: A privilege error explaining how to get write access, nil if the profile is writable.
+//
+// Usage:
+//     if err := checkProfileWritable(configPath); err != nil {
+//         fatal(err)
+//     }
+func checkProfileWritable(configPath string) error {
+	fix := "run it as the owner of the directory or with sudo, or change the owner with chown"
+	if runtime.GOOS == "windows" {
+		fix = "run it from an elevated prompt (Run as administrator), or grant your account write access with icacls"
+	}
+
+	probe, err := ioutil.TempFile(configPath, ".write-check-*")
+	if err != nil {
+		return newError(errPrivilege, "the profile directory %s is not writable, only read-only commands can be used: %s (%v)",
+			configPath, fix, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	stateFile, err := os.OpenFile(configPath+defaultAppConfigFile, os.O_WRONLY, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return newError(errPrivilege, "the state file %s is not writable, only read-only commands can be used: %s (%v)",
+			configPath+defaultAppConfigFile, fix, err)
+	}
+	if err == nil {
+		stateFile.Close()
+	}
+
+	return nil
+}
+
+// readKnownProfiles returns the directories previously selected with -config-path.
+func readKnownProfiles() []string {
+	var dirs []string
+
+	content, err := ioutil.ReadFile(filepath.Join(profilesRoot(), knownProfilesFile))
+	if err == nil {
+		json.Unmarshal(content, &dirs)
+	}
+
+	return dirs
+}
+
+// registerKnownProfile remembers a directory selected with -config-path. Failures are ignored,
+// the list is only informational.
+func registerKnownProfile(dir string) {
+	dirs := readKnownProfiles()
+	for _, known := range dirs {
+		if known == dir {
+			return
+		}
+	}
+
+	content, err := json.MarshalIndent(append(dirs, dir), "", " ")
+	if err != nil || os.MkdirAll(profilesRoot(), 0700) != nil {
+		return
+	}
+	writeFileAtomic(filepath.Join(profilesRoot(), knownProfilesFile), content, 0600)
+}
+
+// profileEntry is a profile printed by 'list-profiles'.
+type profileEntry struct {
+	Name       string
+	Path       string
+	Configured bool // The directory holds a config.json
+	Current    bool
+}
+
+// listProfiles enumerates the default profile, the named profiles and the directories previously
+// selected with -config-path, marking the one in configPath as current.
+func listProfiles(configPath string) []profileEntry {
+	var names []string
+	entries, _ := ioutil.ReadDir(profilesRoot())
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != defaultProfileName {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	profiles := []profileEntry{{Name: defaultProfileName, Path: defaultProfileDir()}}
+	for _, name := range names {
+		profiles = append(profiles, profileEntry{Name: name, Path: filepath.Join(profilesRoot(), name)})
+	}
+	for _, dir := range readKnownProfiles() {
+		profiles = append(profiles, profileEntry{Name: "-", Path: dir})
+	}
+
+	for i := range profiles {
+		profile := &profiles[i]
+		_, err := os.Stat(filepath.Join(profile.Path, defaultAppConfigFile))
+		profile.Configured = err == nil
+		profile.Current = strings.TrimRight(profile.Path, `\/`) == strings.TrimRight(configPath, `\/`)
+	}
+
+	return profiles
+}
+
+// runListProfilesCommand implements the 'list-profiles' command, which enumerates the default
+// profile, the named profiles and the directories previously selected with -config-path.
+func runListProfilesCommand(configPath string, args []string) error {
+	if len(args) != 0 {
+		return newError(errUsage, "usage: list-profiles")
+	}
+
+	profiles := listProfiles(configPath)
+	text := ""
+	for _, profile := range profiles {
+		marker := " "
+		if profile.Current {
+			marker = "*"
+		}
+		state := "empty"
+		if profile.Configured {
+			state = "configured"
+		}
+		text += fmt.Sprintf("%s %-16s %-10s %s\n", marker, profile.Name, state, profile.Path)
+	}
+	printResult(text, profiles)
+
+	return nil
+}
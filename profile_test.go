@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCheckProfileWritable(t *testing.T) {
+	configPath := t.TempDir() + string(os.PathSeparator)
+	if err := checkProfileWritable(configPath); err != nil {
+		t.Fatalf("checkProfileWritable() of an empty directory = %v", err)
+	}
+	if err := ioutil.WriteFile(configPath+defaultAppConfigFile, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkProfileWritable(configPath); err != nil {
+		t.Fatalf("checkProfileWritable() = %v", err)
+	}
+
+	// The probe file is deleted again
+	if matches, _ := filepath.Glob(configPath + ".write-check-*"); len(matches) > 0 {
+		t.Errorf("probe files left over: %q", matches)
+	}
+}
+
+func TestCheckProfileWritableReadOnlyDirectory(t *testing.T) {
+	// Root ignores the permission bits, the ACL case is covered on Windows
+	if os.Geteuid() == 0 || runtime.GOOS == "windows" {
+		t.Skip("the permission bits don't restrict this user")
+	}
+	configPath := t.TempDir() + string(os.PathSeparator)
+	if err := ioutil.WriteFile(configPath+defaultAppConfigFile, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(configPath, 0500); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(configPath, 0700) })
+
+	err := checkProfileWritable(configPath)
+	if exitCode(err) != exitPrivilege {
+		t.Fatalf("checkProfileWritable() = %v, want a privilege error", err)
+	}
+	if !strings.Contains(err.Error(), "only read-only commands can be used") || !strings.Contains(err.Error(), "chown") {
+		t.Errorf("checkProfileWritable() = %q, doesn't explain how to fix it", err)
+	}
+}
+
+func TestCheckProfileWritableReadOnlyStateFile(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("the permission bits don't restrict this user")
+	}
+	configPath := t.TempDir() + string(os.PathSeparator)
+	if err := ioutil.WriteFile(configPath+defaultAppConfigFile, []byte("{}"), 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	err := checkProfileWritable(configPath)
+	if exitCode(err) != exitPrivilege || !strings.Contains(err.Error(), "the state file") {
+		t.Errorf("checkProfileWritable() = %v, want a privilege error about the state file", err)
+	}
+}
+
+func TestCommandReadOnly(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"list"}, true},
+		{[]string{"list", "--group", "staff"}, true},
+		{[]string{"server-info"}, true},
+		{[]string{"doctor"}, true},
+		{[]string{"defaults", "show"}, true},
+		{[]string{"defaults", "set", "mtu=1280"}, false},
+		{[]string{"group", "list"}, true},
+		{[]string{"group", "create", "staff"}, false},
+		{[]string{"metadata", "2"}, true},
+		{[]string{"metadata", "2", "Owner=alice"}, false},
+		{[]string{"fsck"}, true},
+		{[]string{"fsck", "--repair"}, false},
+		{[]string{"cleanup", "--dry-run"}, true},
+		{[]string{"cleanup"}, false},
+		{[]string{"remove", "2"}, false},
+		{[]string{"rotate", "--group", "staff"}, false},
+	}
+
+	for _, test := range tests {
+		cmd := findCommand(test.args[0])
+		if cmd == nil {
+			t.Fatalf("no command %s", test.args[0])
+		}
+		got := cmd.readOnly != nil && cmd.readOnly(test.args[1:])
+		if got != test.want {
+			t.Errorf("%q read-only = %t, want %t", test.args, got, test.want)
+		}
+	}
+}
+
+func TestCommandReadOnlyFromEnvironment(t *testing.T) {
+	t.Setenv(flagEnvName("fsck", "repair"), "true")
+	if findCommand("fsck").readOnly(nil) {
+		t.Error("fsck with the repair flag set in the environment counts as read-only")
+	}
+}
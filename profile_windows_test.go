@@ -0,0 +1,41 @@
+//go:build windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// denyWrite denies the Everyone group write access to the directory with an ACL entry, which
+// applies to Administrators too, while the permission bits Go reports stay writable.
+func denyWrite(t *testing.T, dir string) {
+	t.Helper()
+	if output, err := exec.Command("icacls", dir, "/deny", "*S-1-1-0:(OI)(CI)(W,D,DC)").CombinedOutput(); err != nil {
+		t.Skipf("icacls can't change the ACL: %v %s", err, output)
+	}
+	t.Cleanup(func() { exec.Command("icacls", dir, "/remove:d", "*S-1-1-0").Run() })
+}
+
+func TestCheckProfileWritableDeniedAcl(t *testing.T) {
+	configPath := t.TempDir() + string(os.PathSeparator)
+	if err := ioutil.WriteFile(configPath+defaultAppConfigFile, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	denyWrite(t, configPath)
+
+	info, err := os.Stat(configPath)
+	if err != nil || info.Mode().Perm()&0200 == 0 {
+		t.Fatalf("the directory doesn't look writable from its mode: %v %v", info.Mode(), err)
+	}
+	err = checkProfileWritable(configPath)
+	if exitCode(err) != exitPrivilege {
+		t.Fatalf("checkProfileWritable() = %v, want a privilege error", err)
+	}
+	if !strings.Contains(err.Error(), "Run as administrator") {
+		t.Errorf("checkProfileWritable() = %q, doesn't explain how to fix it", err)
+	}
+}
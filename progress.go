@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spinnerFrames are the characters cycled through while an operation is in progress.
+const spinnerFrames = `|/-\`
+
+// spinner is a lightweight progress indicator for slow operations. It redraws a single status line
+// on stderr showing the elapsed time and, where known, a count such as "34/200 clients created".
+// It is disabled in quiet mode and when stderr is not a terminal, so piped or redirected output
+// stays clean.
+type spinner struct {
+	message string
+	start   time.Time
+	enabled bool
+
+	mu     sync.Mutex
+	status string
+	width  int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// isTerminal reports whether the file is an interactive console rather than a pipe or a file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startSpinner starts displaying the progress of an operation described by the message.
+//
+// Parameters:
+//     message (string): A short description of the operation, e.g. "Detecting external IP address".
+//
+// Returns:
+//     *spinner: The running spinner, which must be stopped with Stop once the operation completes.
+//
+// Usage:
+//     s := startSpinner("Detecting external IP address")
+//     defer s.Stop()
+func startSpinner(message string) *spinner {
+	s := &spinner{
+		message: message,
+		start:   time.Now(),
+		enabled: isTerminal(os.Stderr) && !quietMode,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if !s.enabled {
+		close(s.done)
+		return s
+	}
+
+	go s.run()
+	return s
+}
+
+// run redraws the status line until the spinner is stopped or the user interrupts the program.
+func (s *spinner) run() {
+	defer close(s.done)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for frame := 0; ; frame++ {
+		s.mu.Lock()
+		s.draw(frame)
+		s.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			s.mu.Lock()
+			s.clear()
+			s.mu.Unlock()
+			return
+		case <-interrupt:
+			s.mu.Lock()
+			s.clear()
+			s.mu.Unlock()
+			fmt.Fprintln(os.Stderr, s.message+": interrupted")
+			os.Exit(exitInterrupted)
+		}
+	}
+}
+
+// draw writes the status line, the caller must hold the lock.
+func (s *spinner) draw(frame int) {
+	line := fmt.Sprintf("%c %s... %s", spinnerFrames[frame%len(spinnerFrames)], s.message,
+		time.Since(s.start).Round(time.Second))
+	if s.status != "" {
+		line += " (" + s.status + ")"
+	}
+
+	padding := ""
+	if len(line) < s.width {
+		padding = strings.Repeat(" ", s.width-len(line))
+	}
+	s.width = len(line)
+
+	fmt.Fprint(os.Stderr, "\r"+line+padding)
+}
+
+// clear erases the status line, the caller must hold the lock.
+func (s *spinner) clear() {
+	fmt.Fprint(os.Stderr, "\r"+strings.Repeat(" ", s.width)+"\r")
+	s.width = 0
+}
+
+// SetStatus sets a free-form status shown next to the elapsed time, e.g. "1.2M keys/s".
+func (s *spinner) SetStatus(status string) {
+	s.mu.Lock()
+	s.status = status
+	s.mu.Unlock()
+}
+
+// SetProgress shows a count of the completed work items, e.g. "34/200 clients created".
+func (s *spinner) SetProgress(completed int, total int, unit string) {
+	s.SetStatus(fmt.Sprintf("%d/%d %s", completed, total, unit))
+}
+
+// Println prints a line of output while the spinner is running without garbling it: the status
+// line is erased first and redrawn on the next tick.
+func (s *spinner) Println(a ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.enabled {
+		s.clear()
+	}
+	fmt.Println(a...)
+}
+
+// Stop erases the status line and stops the spinner. It is safe to call more than once.
+func (s *spinner) Stop() {
+	s.mu.Lock()
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// provenanceHeader is written as the first line of every configuration file generated by this tool,
+// so that later runs can tell them apart from configuration files created by other means.
+const provenanceHeader = "# Generated by wg-quick-config. Manual changes may be overwritten.\n"
+
+// writeGeneratedFile writes the content prefixed with the provenance header into the file and
+// returns the hex encoded SHA-256 hash of what was written.
+func writeGeneratedFile(fileName string, content string, perm os.FileMode) (string, error) {
+	data := []byte(provenanceHeader + content)
+
+	if err := writeFileAtomic(fileName, data, perm); err != nil {
+		return "", err
+	}
+
+	return contentHash(data), nil
+}
+
+// contentHash returns the hex encoded SHA-256 hash of a file content, as recorded in FileHashes.
+func contentHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// isGeneratedFile reports whether the file content starts with the provenance header.
+func isGeneratedFile(content []byte) bool {
+	return strings.HasPrefix(string(content), provenanceHeader)
+}
+
+// recordFileHash remembers the hash of a file written into the configuration directory.
+func (config *appConfig) recordFileHash(fileName string, hash string) {
+	if config.FileHashes == nil {
+		config.FileHashes = make(map[string]string)
+	}
+
+	config.FileHashes[filepath.Base(fileName)] = hash
+}
+
+// findForeignConfigFiles returns the names of the Wireguard configuration files in the
+// configuration directory that were not generated by this tool.
+func findForeignConfigFiles(configPath string) ([]string, error) {
+	entries, err := ioutil.ReadDir(configPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var foreign []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".conf") {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(configPath + entry.Name())
+		if err != nil || !isGeneratedFile(content) {
+			foreign = append(foreign, entry.Name())
+		}
+	}
+
+	return foreign, nil
+}
+
+// checkForeignConfigFiles makes sure creating a new configuration does not silently overwrite
+// Wireguard configuration files that this tool did not generate, e.g. a wiresock.conf left from a
+// previous manual setup.
+//
+// If such files exist, they are listed and the user chooses between backing them up (renaming
+// them with a timestamped .bak suffix), importing a server configuration among them and aborting.
+// Importing takes over the server and its peers like 'adopt' instead of creating a new server, see
+// runAdoptCommand, and backs up the other files. Files carrying the provenance header are
+// considered ours and are overwritten as usual. The check is skipped when force is set, which is
+// meant for automation, and the files are backed up with -yes or -quiet.
+//
+// Parameters:
+//     configPath (string): The configuration directory the new configuration will be written into.
+//     force (bool): Skip the check and overwrite any existing files.
+//
+// Returns:
+//     bool: Whether a server configuration was imported, config.json then exists.
+//     error: An error if the user aborted, or the files could not be imported or backed up.
+//
+// Usage:
+//     imported, err := checkForeignConfigFiles(configPath, *force)
+func checkForeignConfigFiles(configPath string, force bool) (bool, error) {
+	if force {
+		return false, nil
+	}
+
+	foreign, err := findForeignConfigFiles(configPath)
+	if err != nil || len(foreign) == 0 {
+		return false, err
+	}
+
+	fmt.Println("\nThe configuration directory already contains Wireguard configuration files not created by this tool:")
+	var servers []string
+	for _, name := range foreign {
+		fmt.Println("\t" + configPath + name)
+		if server, _, err := readServerToAdopt(configPath + name); err == nil && server.PrivateKey != "" &&
+			server.ListenPort != 0 {
+			servers = append(servers, name)
+		}
+	}
+	if assumeYes || quietMode {
+		return false, backupFiles(configPath, foreign)
+	}
+
+	prompt := "Back them up and create a new configuration [b], or abort [a]?"
+	if len(servers) > 0 {
+		prompt = "Back them up and create a new configuration [b], import the existing server [i], or abort [a]?"
+	}
+	for {
+		switch strings.ToLower(readInput(prompt)) {
+		case "b", "backup":
+			return false, backupFiles(configPath, foreign)
+		case "i", "import":
+			if len(servers) == 0 {
+				continue
+			}
+			return true, importForeignServer(configPath, foreign, servers)
+		case "", "a", "abort":
+			return false, newError(errConflict, "aborted, existing configuration files were left untouched")
+		}
+	}
+}
+
+// importForeignServer adopts one of the foreign server configurations of the configuration
+// directory, asking which one if there are several, and backs up the other foreign files.
+func importForeignServer(configPath string, foreign []string, servers []string) error {
+	chosen := servers[0]
+	if len(servers) > 1 {
+		for i, name := range servers {
+			fmt.Printf("  %d. %s\n", i+1, name)
+		}
+		for {
+			answer := readInput("Server configuration to import [1]:")
+			if answer == "" {
+				answer = "1"
+			}
+			choice, err := strconv.Atoi(answer)
+			if err == nil && choice >= 1 && choice <= len(servers) {
+				chosen = servers[choice-1]
+				break
+			}
+			fmt.Printf("Please enter a number between 1 and %d.\n", len(servers))
+		}
+	}
+
+	if err := runAdoptCommand(configPath, []string{configPath + chosen}); err != nil {
+		return err
+	}
+
+	var others []string
+	for _, name := range foreign {
+		if name != chosen {
+			others = append(others, name)
+		}
+	}
+	return backupFiles(configPath, others)
+}
+
+// backupFiles renames the given files of the configuration directory with a timestamped .bak
+// suffix, e.g. wiresock.conf.20240131-120000.bak. Files that don't exist are skipped.
+func backupFiles(configPath string, names []string) error {
+	suffix := time.Now().Format(".20060102-150405.bak")
+	for _, name := range names {
+		if _, err := os.Stat(configPath + name); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(configPath+name, configPath+name+suffix); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", configPath+name, err)
+		}
+		fmt.Println("Backed up", configPath+name, "to", configPath+name+suffix)
+	}
+
+	return nil
+}
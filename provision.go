@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// provisionOptions are the inputs of a non-interactive setup, see provision. Unlike the
+// interactive setup nothing is detected: the endpoint has to be given, and the listen port
+// defaults to the port of the endpoint.
+type provisionOptions struct {
+	// Endpoint is the host:port the clients connect to, the port may be omitted if Port is set.
+	Endpoint string
+	// Port is the UDP port the server listens on, 0 for the port of the endpoint.
+	Port int
+	// Subnet is the Wireguard IPv4 subnet, defaultWireguardSubnet if empty. With host bits set,
+	// e.g. 10.9.0.5/24, the given address becomes the server address.
+	Subnet string
+	// DNS is the DNS setting of the clients, e.g. "10.9.0.1, corp.local", the built-in default if
+	// empty. See parseDnsList.
+	DNS string
+	// Clients is the number of clients to create, at least one and at least as many as Names.
+	Clients int
+	// Names are the names of the clients in order, stored as their Name metadata.
+	Names []string
+}
+
+// provisionedClient is a client created by provision, with everything needed to hand it out.
+type provisionedClient struct {
+	Name   string
+	Config string
+	QRCode []byte
+}
+
+// provisionResult is the outcome of provision: the configuration and all the files a setup
+// consists of, rendered but not written.
+type provisionResult struct {
+	Config       appConfig
+	ServerConfig string
+	Clients      []provisionedClient
+	// State is the config.json document of the configuration.
+	State []byte
+}
+
+// provision performs a complete setup from the options without touching the filesystem, the
+// console or the network, for installers embedding the setup: it creates the server and the
+// clients, validates the configuration and renders the server configuration, the client
+// configurations with their QR codes and the state document. The CLI 'provision' command stores
+// the result as a profile.
+//
+// Parameters:
+//     opts (provisionOptions): The setup options.
+//
+// Returns:
+//     provisionResult: The configuration and its rendered files.
+//     error: A validation error for invalid options or a configuration that isn't deployable.
+//
+// Usage:
+//     result, err := provision(provisionOptions{Endpoint: "vpn.example.com:51820", Names: []string{"laptop", "phone"}})
+func provision(opts provisionOptions) (provisionResult, error) {
+	if opts.Port < 0 || opts.Port > 65535 {
+		return provisionResult{}, checkRange("ListenPort", opts.Port, 1, 65535)
+	}
+	endpoint, err := parseEndpoint(opts.Endpoint, uint16(opts.Port))
+	if err != nil {
+		return provisionResult{}, err
+	}
+	port := opts.Port
+	if port == 0 {
+		_, portString, _ := net.SplitHostPort(endpoint)
+		port, _ = strconv.Atoi(portString)
+	}
+
+	subnetInput := opts.Subnet
+	if subnetInput == "" {
+		subnetInput = defaultWireguardSubnet
+	}
+	ip, subnet, err := net.ParseCIDR(subnetInput)
+	if err != nil || ip.To4() == nil {
+		return provisionResult{}, newError(errValidation, "invalid Wireguard IPv4 subnet '%s'", subnetInput)
+	}
+	serverAddress := ip.To4()
+	if serverAddress.Equal(subnet.IP) {
+		serverAddress = NextIP(subnet.IP)
+	}
+
+	var config appConfig
+	if opts.DNS != "" {
+		dns, err := parseDnsList(opts.DNS)
+		if err != nil {
+			return provisionResult{}, err
+		}
+		defaults := builtinClientDefaults()
+		defaults.DNS = dns
+		config.Defaults = &defaults
+	}
+
+	count := opts.Clients
+	if count < len(opts.Names) {
+		count = len(opts.Names)
+	}
+	if count < 1 {
+		count = 1
+	}
+
+	if err = config.initialize(endpoint, port, serverAddress, subnet); err != nil {
+		return provisionResult{}, err
+	}
+	for len(config.Clients) < count {
+		if err = config.addClient(); err != nil {
+			return provisionResult{}, err
+		}
+	}
+	for i, name := range opts.Names {
+		if name = strings.TrimSpace(name); name != "" {
+			entry, err := parseMetadataEntry("Name=" + name)
+			if err != nil {
+				return provisionResult{}, err
+			}
+			config.clientInfo(i).setMetadata(entry)
+		}
+	}
+
+	if problems := config.Validate(); len(problems) > 0 {
+		return provisionResult{}, validationFailure(problems)
+	}
+
+	result := provisionResult{Config: config}
+	if result.ServerConfig, err = config.renderConfig(config.serverFileConfig()); err != nil {
+		return provisionResult{}, err
+	}
+	for i := range config.Clients {
+		client := provisionedClient{Name: fmt.Sprintf("client %d", i+1)}
+		if i < len(opts.Names) && strings.TrimSpace(opts.Names[i]) != "" {
+			client.Name = strings.TrimSpace(opts.Names[i])
+		}
+		if client.Config, err = config.renderConfig(config.clientFileConfig(i)); err != nil {
+			return provisionResult{}, err
+		}
+		qrContent, _ := config.mobileQrContent(i)
+		qr, err := EncodeQR(qrContent, QROptions{Level: qrcode.Medium, MinLevel: qrcode.Low, PNGSize: handoutQrCodeSize})
+		if err != nil {
+			return provisionResult{}, fmt.Errorf("failed to encode the QR code of client %d: %w", i+1, err)
+		}
+		client.QRCode = qr.PNG
+		result.Clients = append(result.Clients, client)
+	}
+
+	config.SchemaVersion = stateSchemaVersion
+	config.WrittenBy = version
+	if result.State, err = json.MarshalIndent(config, "", " "); err != nil {
+		return provisionResult{}, err
+	}
+
+	return result, nil
+}
+
+// runProvisionCommand implements the 'provision' command, which sets up a new configuration
+// without any questions, for provisioning scripts:
+//
+//     provision --endpoint vpn.example.com:51820 --clients laptop,phone
+//     provision --endpoint 203.0.113.7 --port 51821 --subnet 10.20.0.0/24 --dns 10.20.0.1 --count 5
+//
+// The setup is done by provision, the command only stores the result as the profile and writes
+// the configuration files. Running it again against an existing configuration would replace the
+// server key and orphan every client, so it is refused unless one of these is given:
+//
+//     --add-instance name   creates a parallel instance in the named profile, its tunnel and
+//                           firewall rule named after it, see artifactName
+//     --reset               backs up the configuration files and starts fresh
+//     --force               overwrites the configuration
+//
+// Either way the replaced configuration is kept as a snapshot, so 'undo' brings it back, and the
+// decision is recorded in the audit log.
+func runProvisionCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("provision", flag.ContinueOnError)
+	endpoint := flags.String("endpoint", "", "Server endpoint the clients connect to, host:port")
+	port := flags.Int("port", 0, "UDP port the server listens on, the port of the endpoint by default")
+	subnet := flags.String("subnet", defaultWireguardSubnet, "Wireguard IPv4 subnet")
+	dns := flags.String("dns", "", "DNS servers and search domains of the clients")
+	names := flags.String("clients", "", "Comma-separated names of the clients to create")
+	count := flags.Int("count", 1, "Number of clients to create")
+	instance := flags.String("add-instance", "", "Create a parallel instance in the named profile")
+	reset := flags.Bool("reset", false, "Back up the existing configuration files and start fresh")
+	force := flags.Bool("force", false, "Overwrite an existing configuration")
+	if err := parseFlags(flags, "provision", args); err != nil {
+		return err
+	}
+	if *endpoint == "" {
+		return newError(errUsage, "usage: provision --endpoint host:port [--port n] [--subnet cidr] [--dns list] "+
+			"[--clients a,b | --count n] [--add-instance name | --reset | --force]")
+	}
+	if (*instance != "" && (*reset || *force)) || (*reset && *force) {
+		return newError(errUsage, "--add-instance, --reset and --force are mutually exclusive")
+	}
+
+	opts := provisionOptions{Endpoint: *endpoint, Port: *port, Subnet: *subnet, DNS: *dns, Clients: *count}
+	if *names != "" {
+		opts.Names = strings.Split(*names, ",")
+	}
+	result, err := provision(opts)
+	if err != nil {
+		return err
+	}
+	config := result.Config
+	for _, warning := range commonLanWarnings(config.serverSubnet()) {
+		fmt.Println("Warning:", warning)
+	}
+
+	existing, err := loadAppConfig(configPath)
+	exists := err == nil
+	if _, statErr := os.Stat(configPath + defaultAppConfigFile); statErr == nil && !exists {
+		return fmt.Errorf("a configuration exists in %s but can't be loaded: %w", configPath, err)
+	}
+
+	decision := "new"
+	switch {
+	case *instance != "":
+		if !exists {
+			return newError(errUsage, "there is no configuration in %s to add an instance to, provision it without --add-instance", configPath)
+		}
+		if err = checkParallelInstance(existing, config); err != nil {
+			return err
+		}
+		dir, err := namedProfileDir(*instance)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("can't create the profile directory %s: %w", dir, err)
+		}
+		configPath = strings.TrimRight(dir, `\/`) + string(os.PathSeparator)
+		if err = checkProfileWritable(configPath); err != nil {
+			return err
+		}
+		if _, err = os.Stat(configPath + defaultAppConfigFile); err == nil {
+			return newError(errConflict, "the instance '%s' already exists in %s", *instance, configPath)
+		}
+		config.setInstance(*instance)
+		decision = "add-instance"
+	case exists && *reset:
+		var files []string
+		for i := range existing.Clients {
+			files = append(files, fmt.Sprintf(defaultClientConfigFile, i+1))
+		}
+		if err = backupFiles(configPath, append(files, existing.serverConfigFile())); err != nil {
+			return err
+		}
+		decision = "reset"
+	case exists && *force:
+		decision = "force"
+	case exists:
+		return newError(errConflict, "a configuration with %d clients already exists in %s, provisioning again would "+
+			"replace the server key and orphan them: use --add-instance <name> for a parallel instance, --reset to "+
+			"back it up and start fresh, or --force to overwrite it", len(existing.Clients), configPath)
+	}
+
+	if decision == "new" && profileName != "" && profileName != defaultProfileName && configPathOverride == "" {
+		config.setInstance(profileName)
+	}
+	if err = checkArtifactCollisions(configPath, config); err != nil {
+		return err
+	}
+
+	if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+		return err
+	}
+	if err = config.saveWithHistory(configPath, "provision", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+	fmt.Printf("Provisioned a server listening on UDP port %d with %d clients in %s.\n",
+		config.Server.ListenPort, len(config.Clients), configPath)
+	if decision == "add-instance" {
+		fmt.Printf("Manage the new instance with -profile %s.\n", *instance)
+	}
+	if decision == "reset" || decision == "force" {
+		fmt.Println("The previous configuration was kept as a snapshot, use 'undo' to restore it.")
+	}
+
+	return appendAuditLog(configPath, "provision", map[string]interface{}{
+		"Endpoint": *endpoint,
+		"Clients":  len(config.Clients),
+		"Existing": decision,
+	})
+}
+
+// checkParallelInstance verifies that a new instance can run next to the existing one: both
+// servers can't listen on the same UDP port, and overlapping subnets break the routes of both.
+func checkParallelInstance(existing appConfig, config appConfig) error {
+	if existing.Server.ListenPort == config.Server.ListenPort {
+		return newError(errConflict, "the existing instance already listens on UDP port %d, choose another with --port",
+			existing.Server.ListenPort)
+	}
+	if len(existing.Server.Address) > 0 && len(config.Server.Address) > 0 {
+		a, b := existing.Server.Address[0], config.Server.Address[0]
+		if a.Contains(b.IP.Mask(b.Mask)) || b.Contains(a.IP.Mask(a.Mask)) {
+			return newError(errConflict, "the subnet %s overlaps the subnet %s of the existing instance, choose another with --subnet",
+				(&net.IPNet{IP: b.IP.Mask(b.Mask), Mask: b.Mask}).String(), (&net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask}).String())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lastAuditRecord returns the operation and details of the last record of the audit log.
+func lastAuditRecord(t *testing.T, configPath string) (string, map[string]interface{}) {
+	t.Helper()
+	content, err := ioutil.ReadFile(configPath + defaultAuditLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	var record struct {
+		Operation string
+		Details   map[string]interface{}
+	}
+	if err = json.Unmarshal([]byte(lines[len(lines)-1]), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	return record.Operation, record.Details
+}
+
+func TestProvisionCommandRefusesExistingConfiguration(t *testing.T) {
+	config, configPath := newTestProfile(t, 3)
+
+	err := runProvisionCommand(configPath, []string{"--endpoint", "203.0.113.7:51820"})
+	if exitCode(err) != exitConflict || !strings.Contains(err.Error(), "a configuration with 3 clients already exists") {
+		t.Fatalf("provisioning again = %v, want a conflict", err)
+	}
+	unchanged, err := loadAppConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged.Server.PrivateKey != config.Server.PrivateKey || len(unchanged.Clients) != 3 {
+		t.Error("the refused provisioning changed the configuration")
+	}
+
+	for _, args := range [][]string{{"--reset", "--force"}, {"--add-instance", "lab", "--force"}} {
+		err = runProvisionCommand(configPath, append([]string{"--endpoint", "203.0.113.7:51820"}, args...))
+		if exitCode(err) != exitUsage {
+			t.Errorf("provision %q = %v, want a usage error", args, err)
+		}
+	}
+}
+
+// TestProvisionCommandRecovery provisions over an existing configuration and checks that 'undo'
+// brings back the server key and every client, with their files.
+func TestProvisionCommandRecovery(t *testing.T) {
+	for _, flag := range []string{"--reset", "--force"} {
+		t.Run(flag, func(t *testing.T) {
+			config, configPath := newTestProfile(t, 3)
+			clientFile, err := ioutil.ReadFile(configPath + "wsclient_3.conf")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = runProvisionCommand(configPath, []string{"--endpoint", "203.0.113.7:51820", flag}); err != nil {
+				t.Fatal(err)
+			}
+			replaced, err := loadAppConfig(configPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replaced.Server.PrivateKey == config.Server.PrivateKey || len(replaced.Clients) != 1 {
+				t.Fatal("the configuration wasn't replaced")
+			}
+			if operation, details := lastAuditRecord(t, configPath); operation != "provision" ||
+				details["Existing"] != strings.TrimPrefix(flag, "--") {
+				t.Errorf("audit record %s %v, want the decision %s", operation, details, flag)
+			}
+
+			if flag == "--reset" {
+				// The files of the old configuration are kept next to the new ones
+				backups, _ := filepath.Glob(configPath + "wsclient_3.conf.*.bak")
+				if len(backups) != 1 {
+					t.Fatalf("backups of wsclient_3.conf: %q", backups)
+				}
+				if backup, _ := ioutil.ReadFile(backups[0]); string(backup) != string(clientFile) {
+					t.Error("the backup of wsclient_3.conf differs from the original")
+				}
+				if backups, _ = filepath.Glob(configPath + config.ServerConfigFile + ".*.bak"); len(backups) != 1 {
+					t.Errorf("backups of %s: %q", config.ServerConfigFile, backups)
+				}
+			}
+
+			if err = runUndoCommand(configPath, nil); err != nil {
+				t.Fatal(err)
+			}
+			restored, err := loadAppConfig(configPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored.Server.PrivateKey != config.Server.PrivateKey || len(restored.Clients) != 3 {
+				t.Fatalf("undo restored %d clients and the server key %t", len(restored.Clients),
+					restored.Server.PrivateKey == config.Server.PrivateKey)
+			}
+			for i := range config.Clients {
+				if restored.Clients[i].PrivateKey != config.Clients[i].PrivateKey ||
+					restored.Server.Peers[i].PublicKey != config.Server.Peers[i].PublicKey {
+					t.Errorf("client %d wasn't restored with its server peer", i+1)
+				}
+			}
+			if content, _ := ioutil.ReadFile(configPath + "wsclient_3.conf"); string(content) != string(clientFile) {
+				t.Error("wsclient_3.conf wasn't restored")
+			}
+		})
+	}
+}
+
+func TestProvisionCommandAddInstance(t *testing.T) {
+	config, configPath := newTestProfile(t, 2)
+
+	err := runProvisionCommand(configPath, []string{"--endpoint", "203.0.113.7:51820", "--add-instance", "lab"})
+	if exitCode(err) != exitConflict || !strings.Contains(err.Error(), "UDP port 51820") {
+		t.Errorf("instance on the same port = %v, want a conflict", err)
+	}
+	err = runProvisionCommand(configPath, []string{"--endpoint", "203.0.113.7:51821", "--add-instance", "lab"})
+	if exitCode(err) != exitConflict || !strings.Contains(err.Error(), "overlaps the subnet 10.9.0.0/24") {
+		t.Errorf("instance on the same subnet = %v, want a conflict", err)
+	}
+
+	err = runProvisionCommand(configPath, []string{"--endpoint", "203.0.113.7:51821", "--subnet", "10.77.0.0/24",
+		"--add-instance", "lab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, _ := namedProfileDir("lab")
+	instance, err := loadAppConfig(dir + string(os.PathSeparator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.Server.ListenPort != 51821 || instance.serverConfigFile() != "lab.conf" {
+		t.Errorf("instance listens on %d with %s", instance.Server.ListenPort, instance.serverConfigFile())
+	}
+	if existing, _ := loadAppConfig(configPath); existing.Server.PrivateKey != config.Server.PrivateKey ||
+		len(existing.Clients) != 2 {
+		t.Error("adding an instance changed the existing configuration")
+	}
+
+	err = runProvisionCommand(configPath, []string{"--endpoint", "203.0.113.7:51822", "--subnet", "10.78.0.0/24",
+		"--add-instance", "lab"})
+	if exitCode(err) != exitConflict || !strings.Contains(err.Error(), "the instance 'lab' already exists") {
+		t.Errorf("adding the instance again = %v, want a conflict", err)
+	}
+}
+
+// TestProvision checks that provision renders the files and the state document the profile
+// would hold, without writing anything.
+func TestProvision(t *testing.T) {
+	result, err := provision(provisionOptions{Endpoint: "Bücher.Example.:51820", DNS: "10.20.0.1, corp.local",
+		Subnet: "10.20.0.5/24", Names: []string{"laptop", "", "phone"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := result.Config
+	if len(config.Clients) != 3 || config.Server.ListenPort != 51820 || config.Server.Address[0].IP.String() != "10.20.0.5" {
+		t.Fatalf("provisioned %d clients, port %d, server %v", len(config.Clients), config.Server.ListenPort, config.Server.Address)
+	}
+	if server, _ := config.renderConfig(config.serverFileConfig()); server != result.ServerConfig {
+		t.Errorf("server configuration\n%s\nrendered as\n%s", result.ServerConfig, server)
+	}
+	for i, client := range result.Clients {
+		rendered, _ := config.renderConfig(config.clientFileConfig(i))
+		if rendered != client.Config || len(client.QRCode) == 0 {
+			t.Errorf("client %d configuration\n%s\nrendered as\n%s", i+1, client.Config, rendered)
+		}
+		if !strings.Contains(client.Config, "Endpoint = xn--bcher-kva.example:51820") {
+			t.Errorf("client %d doesn't connect to the normalized endpoint:\n%s", i+1, client.Config)
+		}
+	}
+	if result.Clients[0].Name != "laptop" || result.Clients[1].Name != "client 2" {
+		t.Errorf("clients named %q and %q", result.Clients[0].Name, result.Clients[1].Name)
+	}
+
+	var state appConfig
+	if err = json.Unmarshal(result.State, &state); err != nil || state.SchemaVersion != stateSchemaVersion ||
+		state.Server.PrivateKey != config.Server.PrivateKey || state.clientName(2) != "phone" {
+		t.Errorf("state document %s: %v", result.State, err)
+	}
+
+	// Nothing is set up from invalid options
+	for _, opts := range []provisionOptions{
+		{Endpoint: "vpn.example.com"},
+		{Endpoint: "vpn.example.com:51820", Subnet: "fd00::/64"},
+		{Endpoint: "vpn.example.com:51820", DNS: "10.9.0"},
+		{Endpoint: "vpn.example.com:51820", Port: 70000},
+	} {
+		if _, err = provision(opts); exitCode(err) != exitValidation {
+			t.Errorf("%+v = %v, want a validation error", opts, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Provisioning statuses of a client, in the order of its lifecycle, see clientInfo.status.
+const (
+	// statusIssued is the status of a client created but not handed out yet.
+	statusIssued = "issued"
+	// statusDelivered is recorded when the configuration of the client is handed out: its QR code
+	// shown, its file exported or its handout written.
+	statusDelivered = "delivered"
+	// statusConnected is recorded when a handshake of the client is first observed.
+	statusConnected = "connected"
+	// statusUnknown is reported, never recorded, for a client not known to be connected while no
+	// handshakes can be observed on this host, see observeHandshakes.
+	statusUnknown = "unknown"
+)
+
+// statusOrder lists the recorded statuses in the order of the lifecycle.
+var statusOrder = []string{statusIssued, statusDelivered, statusConnected}
+
+// statusTransition records when a client reached a provisioning status, kept in config.json.
+type statusTransition struct {
+	Status string    // One of statusOrder
+	Via    string    // What caused the transition, e.g. "QR code shown"
+	Time   time.Time // When the transition happened
+}
+
+// statusRank returns the position of a status in statusOrder.
+func statusRank(status string) int {
+	for i, other := range statusOrder {
+		if other == status {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// status returns the provisioning status of the client and the transition that led to it, nil for
+// clients created before the status was tracked, which count as issued.
+func (info *clientInfo) status() (string, *statusTransition) {
+	if len(info.Provisioning) == 0 {
+		return statusIssued, nil
+	}
+	last := &info.Provisioning[len(info.Provisioning)-1]
+
+	return last.Status, last
+}
+
+// recordStatus moves the client with the given zero-based index forward to a provisioning status
+// and logs the transition into the audit log. A client never moves back, e.g. showing the QR code
+// of a connected client again leaves it connected, and a client with an external key is never
+// delivered, since its configuration doesn't come from this tool. The caller saves the
+// configuration, see saveStatus.
+//
+// Parameters:
+//     configPath (string): The profile directory holding the audit log.
+//     index (int): The zero-based index of the client.
+//     status (string): statusIssued, statusDelivered or statusConnected.
+//     via (string): What caused the transition, shown by 'list' and kept in the audit log.
+//     at (time.Time): When the transition happened.
+//
+// Returns:
+//     bool: Whether the status changed.
+//
+// Usage:
+//     if config.recordStatus(configPath, index, statusDelivered, "handout exported", time.Now()) { ... }
+func (config *appConfig) recordStatus(configPath string, index int, status string, via string, at time.Time) bool {
+	info := config.clientInfo(index)
+	current, _ := info.status()
+	if len(info.Provisioning) > 0 && statusRank(status) <= statusRank(current) {
+		return false
+	}
+	if status == statusDelivered && config.Clients[index].PrivateKey == "" {
+		return false
+	}
+
+	info.Provisioning = append(info.Provisioning, statusTransition{Status: status, Via: via, Time: at.UTC()})
+	appendAuditLog(configPath, "status", map[string]interface{}{"Client": index + 1, "Status": status, "Via": via})
+
+	return true
+}
+
+// saveStatus stores the recorded status transitions. The commands handing out configurations
+// don't otherwise change the profile and keep working on a profile that can't be written, so a
+// failure is only reported.
+func (config *appConfig) saveStatus(configPath string) {
+	if err := config.save(configPath); err != nil {
+		fmt.Println("Note: the provisioning status couldn't be recorded:", err)
+	}
+}
+
+// observeHandshakes returns the latest handshake of every peer of the tunnel that completed one,
+// by public key, read from the running tunnel with 'wg show <tunnel> latest-handshakes'.
+//
+// Parameters:
+//     tunnel (string): The name of the tunnel, see tunnelName.
+//
+// Returns:
+//     map[string]time.Time: The latest handshake by public key of the peer.
+//     bool: Whether handshakes can be observed, false if wg isn't installed or the tunnel doesn't run.
+//
+// Usage:
+//     handshakes, observed := observeHandshakes(config.tunnelName())
+func observeHandshakes(tunnel string) (map[string]time.Time, bool) {
+	output, err := exec.Command("wg", "show", tunnel, "latest-handshakes").Output()
+	if err != nil {
+		return nil, false
+	}
+
+	handshakes := make(map[string]time.Time)
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		// Peers that never completed a handshake are listed with 0
+		seconds, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil && seconds > 0 {
+			handshakes[fields[0]] = time.Unix(seconds, 0)
+		}
+	}
+
+	return handshakes, true
+}
+
+// refreshConnected records the clients whose first handshake is observed as connected.
+//
+// Parameters:
+//     configPath (string): The profile directory.
+//
+// Returns:
+//     bool: Whether handshakes could be observed, see observeHandshakes.
+//
+// Usage:
+//     observed := config.refreshConnected(configPath)
+func (config *appConfig) refreshConnected(configPath string) bool {
+	handshakes, observed := observeHandshakes(config.tunnelName())
+	changed := false
+	for i := range config.Clients {
+		if i >= len(config.Server.Peers) {
+			break
+		}
+		if at, ok := handshakes[config.Server.Peers[i].PublicKey]; ok {
+			changed = config.recordStatus(configPath, i, statusConnected, "handshake observed", at) || changed
+		}
+	}
+	if changed {
+		config.saveStatus(configPath)
+	}
+
+	return observed
+}
+
+// parseStatusFilter parses the value of 'list --status'.
+func parseStatusFilter(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == statusUnknown || statusRank(value) >= 0 {
+		return value, nil
+	}
+
+	return "", newError(errValidation, "invalid status '%s', expected issued, delivered, connected or unknown", value)
+}
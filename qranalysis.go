@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// qrCodeLevel is the error correction level of the QR codes shown on the terminal. The lowest
+// level keeps the codes of long configurations small enough to be scanned.
+const qrCodeLevel = qrcode.Low
+
+// redactedValue replaces the secrets in the output of 'analyze' and the verbose QR code details.
+const redactedValue = "(redacted)"
+
+// secretKeys are the configuration keys whose values are never printed by redactSecrets.
+var secretKeys = []string{"PrivateKey", "PresharedKey"}
+
+// qrPayloadSize describes the content of a QR code: its size, how random it is and the QR code
+// version it needs.
+type qrPayloadSize struct {
+	Bytes      int     // Size of the content
+	Entropy    float64 // Shannon entropy of the content in bits per byte, about 6 for base64 keys
+	Version    int     // QR code version chosen for the content, 0 if it fits no version
+	Modules    int     // Width and height of the QR code in modules
+	Level      string  // Error correction level, see qrRecoveryLevels
+	MaxVersion int     // Largest version accepted, see -qrmaxversion
+	TooLarge   bool    // Whether the content needs a version above MaxVersion or fits none
+}
+
+// String describes the payload for the verbose output and 'analyze'.
+func (size qrPayloadSize) String() string {
+	result := fmt.Sprintf("%d bytes, entropy %.2f bits/byte, ", size.Bytes, size.Entropy)
+	switch {
+	case size.Version == 0:
+		result += "too large for any QR code version"
+	case size.TooLarge:
+		result += fmt.Sprintf("QR code version %d (%dx%d modules) above the limit of %d",
+			size.Version, size.Modules, size.Modules, size.MaxVersion)
+	default:
+		result += fmt.Sprintf("QR code version %d (%dx%d modules)", size.Version, size.Modules, size.Modules)
+	}
+
+	return result + fmt.Sprintf(", error correction %s", size.Level)
+}
+
+// measureQrPayload encodes the content into a QR code at qrCodeLevel and measures it, with the
+// oversize detection of EncodeQR that showClientQrCode uses, so that 'analyze' agrees with it on
+// when a configuration is too large.
+//
+// Parameters:
+//     content (string): The content to be encoded into the QR code.
+//     maxVersion (int): The largest acceptable QR code version, between 1 and 40.
+//
+// Returns:
+//     qrPayloadSize: The measurements, filled in even if the content is too large.
+//     error: An *ErrPayloadTooLarge if the version exceeds maxVersion or none fits.
+//
+// Usage:
+//     size, err := measureQrPayload(content, maxQrVersion)
+func measureQrPayload(content string, maxVersion int) (qrPayloadSize, error) {
+	size := qrPayloadSize{
+		Bytes:      len(content),
+		Entropy:    shannonEntropy(content),
+		Level:      qrRecoveryLevelName(qrCodeLevel),
+		MaxVersion: maxVersion,
+	}
+
+	qr, err := EncodeQR(content, QROptions{Level: qrCodeLevel, MinLevel: qrCodeLevel, MaxVersion: maxVersion})
+	var tooLarge *ErrPayloadTooLarge
+	if errors.As(err, &tooLarge) {
+		size.TooLarge = true
+		if tooLarge.NeededVersion != 0 {
+			size.Version, size.Modules = tooLarge.NeededVersion, 17+4*tooLarge.NeededVersion
+		}
+		return size, err
+	}
+	size.Version, size.Modules = qr.Version, qr.Modules
+
+	return size, err
+}
+
+// shannonEntropy returns the entropy of the bytes of the text in bits per byte.
+func shannonEntropy(text string) float64 {
+	if text == "" {
+		return 0
+	}
+
+	var counts [256]int
+	for i := 0; i < len(text); i++ {
+		counts[text[i]]++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(text))
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	return entropy
+}
+
+// redactSecrets replaces the values of the secretKeys lines of a configuration with redactedValue,
+// keeping everything else, so that the text can be shown for debugging.
+func redactSecrets(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		key, _, found := strings.Cut(line, "=")
+		for _, secret := range secretKeys {
+			if found && strings.EqualFold(strings.TrimSpace(key), secret) {
+				lines[i] = secret + " = " + redactedValue
+			}
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// printQrPayloadDetails prints the measurements and a redacted preview of the content of a QR code,
+// shown in verbose mode after generating a client configuration.
+func printQrPayloadDetails(content string) {
+	size, _ := measureQrPayload(content, maxQrVersion)
+	fmt.Println("QR code payload:", size.String())
+	fmt.Println("Redacted preview:")
+	for _, line := range strings.Split(strings.TrimRight(redactSecrets(content), "\n"), "\n") {
+		fmt.Println(strings.TrimRight("    "+line, " "))
+	}
+}
+
+// qrKeySize is the size of the lines of one key within a section, see qrSection.
+type qrKeySize struct {
+	Key   string
+	Bytes int
+}
+
+// qrSection is the size of the interface or of a peer within the QR code payload of a client.
+type qrSection struct {
+	Name  string
+	Bytes int
+	Keys  []qrKeySize
+}
+
+// qrAnalysis is the result of 'analyze'.
+type qrAnalysis struct {
+	Client   int
+	Name     string
+	Payload  qrPayloadSize
+	Sections []qrSection
+}
+
+// measureQrSection measures the text of a section, attributing every line to its key. Comments
+// and the section header are counted under "#" and the header itself.
+func measureQrSection(name string, text string) qrSection {
+	section := qrSection{Name: name, Bytes: len(text)}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		key, _, _ := strings.Cut(strings.TrimSpace(line), "=")
+		key = strings.TrimSpace(key)
+		switch {
+		case line == "":
+			continue
+		case key == "":
+			key = "(blank lines)"
+		case strings.HasPrefix(key, "#"):
+			key = "#"
+		}
+
+		found := false
+		for i := range section.Keys {
+			if section.Keys[i].Key == key {
+				section.Keys[i].Bytes += len(line)
+				found = true
+			}
+		}
+		if !found {
+			section.Keys = append(section.Keys, qrKeySize{Key: key, Bytes: len(line)})
+		}
+	}
+
+	return section
+}
+
+// analyzeQrPayload measures the QR code payload of a client per section, the interface and each
+// peer, and per key within them, so that the user can see what to trim from a configuration too
+// large for a QR code. Only sizes and key names are reported, never values.
+//
+// Parameters:
+//     index (int): The zero-based index of the client.
+//
+// Returns:
+//     qrAnalysis: The measurements, the sections add up to the whole payload.
+//
+// Usage:
+//     analysis := config.analyzeQrPayload(index)
+func (config *appConfig) analyzeQrPayload(index int) qrAnalysis {
+	mobile, _ := config.mobileQrConfig(index)
+	size, _ := measureQrPayload(mobile.String(), maxQrVersion)
+
+	peers := mobile.Peers
+	mobile.Peers = nil
+	analysis := qrAnalysis{Client: index + 1, Name: config.clientName(index), Payload: size}
+	analysis.Sections = append(analysis.Sections, measureQrSection("Interface", mobile.String()))
+	for i, peer := range peers {
+		name := fmt.Sprintf("Peer %d", i+1)
+		if peer.Endpoint != "" {
+			name += " (" + displayEndpoint(peer.Endpoint) + ")"
+		}
+		analysis.Sections = append(analysis.Sections, measureQrSection(name, peer.String()))
+	}
+
+	return analysis
+}
+
+// String prints the analysis as a table of the sections with the size of each key.
+func (analysis qrAnalysis) String() string {
+	result := fmt.Sprintf("QR code payload of client %d (%s): %s\n", analysis.Client, analysis.Name, analysis.Payload.String())
+	for _, section := range analysis.Sections {
+		share := 0.0
+		if analysis.Payload.Bytes > 0 {
+			share = 100 * float64(section.Bytes) / float64(analysis.Payload.Bytes)
+		}
+		result += fmt.Sprintf("  %-32s %6d bytes %5.1f%%\n", section.Name, section.Bytes, share)
+		for _, key := range section.Keys {
+			result += fmt.Sprintf("    %-30s %6d bytes\n", key.Key, key.Bytes)
+		}
+	}
+
+	return result
+}
+
+// runAnalyzeCommand implements the 'analyze' command, which shows how the QR code payload of a
+// client is made up, for debugging a QR code that doesn't scan or a configuration a device rejects:
+//
+//     analyze laptop --qrmaxversion 15
+//
+// The payload is measured like -qrcode does, against the same version limit, and broken down
+// into the interface and each peer. Secrets never appear in the output.
+func runAnalyzeCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: analyze <client> [--qrmaxversion n]")
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return usage
+	}
+
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	flags.IntVar(&maxQrVersion, "qrmaxversion", defaultMaxQrVersion, "Largest QR code version (1-40) considered scannable")
+	if err := parseFlags(flags, "analyze", args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return usage
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	index, err := config.findClient(args[0])
+	if err != nil {
+		return err
+	}
+
+	analysis := config.analyzeQrPayload(index)
+	text := analysis.String()
+	if analysis.Payload.TooLarge {
+		text += "The configuration is too large for a scannable QR code, trim the largest sections above.\n"
+	}
+	printResult(text, analysis)
+
+	return nil
+}
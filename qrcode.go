@@ -1,33 +1,239 @@
 package main
 
-import "github.com/skip2/go-qrcode"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 
-// QREncodeToSmallString encodes the given content into a QR code and returns
-// a small string representation of the QR code art. It uses the 'qrcode' package's
-// New and ToSmallString functions to generate and format the QR code.
+	"github.com/skip2/go-qrcode"
+)
+
+// defaultMaxQrVersion is the largest QR code version (117x117 modules) shown by default. Larger
+// codes printed on a terminal are too dense to be scanned reliably by a phone camera.
+const defaultMaxQrVersion = 25
+
+// maxQrVersion is the QR code version cap applied by showClientQrCode, set with -qrmaxversion.
+var maxQrVersion = defaultMaxQrVersion
+
+// errQrCodeTooLarge is matched by ErrPayloadTooLarge, the error of EncodeQR when the content needs a
+// QR code version above the requested cap.
+var errQrCodeTooLarge = errors.New("QR code too large to be scanned reliably")
+
+// QROptions configures EncodeQR. The zero value encodes at error correction low into the smallest
+// version that fits, without a PNG image.
+type QROptions struct {
+	// Level is the preferred error correction level, see parseQrRecoveryLevel.
+	Level qrcode.RecoveryLevel
+	// MinLevel is the lowest level EncodeQR steps down to when the content doesn't fit at Level.
+	// At or above Level the level is never lowered.
+	MinLevel qrcode.RecoveryLevel
+	// MaxVersion is the largest acceptable QR code version, 0 for 40. See -qrmaxversion.
+	MaxVersion int
+	// Version forces a QR code version between 1 and 40 for deterministic output, 0 for the
+	// smallest one that fits.
+	Version int
+	// PNGSize is the width and height of the PNG image in pixels, 0 for no image.
+	PNGSize int
+	// DisableBorder leaves the quiet zone around the code out.
+	DisableBorder bool
+	// Negative inverts the colors of the ASCII art, for light-on-dark terminals.
+	Negative bool
+}
+
+// QRResult is a QR code encoded by EncodeQR.
+type QRResult struct {
+	// Art is the code as ASCII art for a terminal, two modules per character.
+	Art string
+	// PNG is the code as image, nil unless QROptions.PNGSize was given.
+	PNG []byte
+	// Level is the error correction level used, SteppedDown tells whether it is below the
+	// preferred one.
+	Level       qrcode.RecoveryLevel
+	SteppedDown bool
+	// Version is the QR code version, Modules its width and height in modules.
+	Version int
+	Modules int
+}
+
+// ErrPayloadTooLarge is returned by EncodeQR when the content fits no acceptable version at any
+// acceptable level. It matches errQrCodeTooLarge and errValidation with errors.Is.
+type ErrPayloadTooLarge struct {
+	// Bytes is the size of the content.
+	Bytes int
+	// MaxBytes is the capacity in bytes of MaxVersion at Level, the lowest acceptable level.
+	MaxBytes   int
+	MaxVersion int
+	Level      qrcode.RecoveryLevel
+	// NeededVersion is the smallest version the content fits at Level, 0 if it fits none.
+	NeededVersion int
+}
+
+// Error implements the error interface.
+func (err *ErrPayloadTooLarge) Error() string {
+	needed := "it doesn't fit any version"
+	if err.NeededVersion != 0 {
+		needed = fmt.Sprintf("it needs at least version %d", err.NeededVersion)
+	}
+
+	return fmt.Sprintf("%s: the content has %d bytes, QR code version %d holds at most %d at error correction %s, %s",
+		errQrCodeTooLarge, err.Bytes, err.MaxVersion, err.MaxBytes, qrRecoveryLevelName(err.Level), needed)
+}
+
+// Is makes errors.Is match errQrCodeTooLarge and errValidation, see exitCode.
+func (err *ErrPayloadTooLarge) Is(target error) bool {
+	return target == errQrCodeTooLarge || target == errValidation
+}
+
+var (
+	qrCapacities      = make(map[[2]int]int)
+	qrCapacitiesMutex sync.Mutex
+)
+
+// qrByteCapacity returns the number of bytes of 8-bit content, such as a configuration, a QR code
+// version holds at an error correction level. go-qrcode doesn't export its capacity tables, so the
+// capacity is searched for once per version and level and cached.
+func qrByteCapacity(version int, level qrcode.RecoveryLevel) int {
+	qrCapacitiesMutex.Lock()
+	defer qrCapacitiesMutex.Unlock()
+
+	key := [2]int{version, int(level)}
+	if capacity, found := qrCapacities[key]; found {
+		return capacity
+	}
+
+	// Lowercase letters can't use the alphanumeric mode, the content is encoded as bytes
+	low, high := 0, 2953
+	for low < high {
+		middle := (low + high + 1) / 2
+		if _, err := qrcode.NewWithForcedVersion(strings.Repeat("a", middle), version, level); err == nil {
+			low = middle
+		} else {
+			high = middle - 1
+		}
+	}
+	qrCapacities[key] = low
+
+	return low
+}
+
+// EncodeQR encodes the content into the best QR code the options allow: at the preferred error
+// correction level if the content fits the acceptable versions there, otherwise stepping down one
+// level at a time to the lowest acceptable one, which the result reports. Every QR code of the
+// tool, on the terminal and in the exports, is encoded here.
+//
+// Parameters:
+//     content (string): The content to be encoded into the QR code.
+//     opts (QROptions): The levels, versions and image size, see QROptions.
+//
+// Returns:
+//     QRResult: The ASCII art, the PNG image if requested, and the level and version chosen.
+//     error: An *ErrPayloadTooLarge with the exact limits if the content doesn't fit, a validation
+//         error for an invalid version.
+//
+// Usage:
+//     qr, err := EncodeQR(content, QROptions{Level: qrcode.Medium, MinLevel: qrcode.Low, PNGSize: 1024})
+func EncodeQR(content string, opts QROptions) (QRResult, error) {
+	maxVersion := opts.MaxVersion
+	if opts.Version != 0 {
+		maxVersion = opts.Version
+	}
+	if maxVersion == 0 {
+		maxVersion = 40
+	}
+	if opts.Version < 0 || maxVersion < 1 || maxVersion > 40 {
+		return QRResult{}, newError(errValidation, "invalid QR code version %d, expected a number between 1 and 40",
+			maxVersion)
+	}
+	minLevel := opts.MinLevel
+	if minLevel > opts.Level {
+		minLevel = opts.Level
+	}
+
+	for level := opts.Level; level >= minLevel; level-- {
+		var q *qrcode.QRCode
+		var err error
+		if opts.Version != 0 {
+			q, err = qrcode.NewWithForcedVersion(content, opts.Version, level)
+		} else {
+			q, err = qrcode.New(content, level)
+		}
+		if err != nil || q.VersionNumber > maxVersion {
+			continue
+		}
+
+		q.DisableBorder = opts.DisableBorder
+		result := QRResult{
+			Art:         q.ToSmallString(opts.Negative),
+			Level:       level,
+			SteppedDown: level != opts.Level,
+			Version:     q.VersionNumber,
+			Modules:     17 + 4*q.VersionNumber,
+		}
+		if opts.PNGSize != 0 {
+			if result.PNG, err = q.PNG(opts.PNGSize); err != nil {
+				return QRResult{}, err
+			}
+		}
+		return result, nil
+	}
+
+	tooLarge := &ErrPayloadTooLarge{Bytes: len(content), MaxBytes: qrByteCapacity(maxVersion, minLevel),
+		MaxVersion: maxVersion, Level: minLevel}
+	if q, err := qrcode.New(content, minLevel); err == nil {
+		tooLarge.NeededVersion = q.VersionNumber
+	}
+	return QRResult{}, tooLarge
+}
+
+// QREncodeToSmallString encodes the given content into a QR code at error correction low and
+// returns its ASCII art, see EncodeQR.
 //
 // Parameters:
 //     content (string): The content to be encoded into the QR code.
 //     disableBorder (bool): If set to true, the border of the QR code will be disabled.
 //     negative (bool): If set to true, the colors of the QR code art will be inverted.
+//     maxVersion (int): The largest acceptable QR code version, between 1 and 40.
 //
 // Returns:
 //     string: A small string representation of the QR code art.
-//     error: An error object indicating any errors that occurred during QR code generation.
+//     error: An *ErrPayloadTooLarge if the content needs a version above maxVersion.
 //
 // Usage:
-//     qrArt, err := QREncodeToSmallString("Hello World", false, false)
-func QREncodeToSmallString(content string, disableBorder bool, negative bool) (string, error) {
-	var q *qrcode.QRCode
-	q, err := qrcode.New(content, qrcode.Low)
-	if err != nil {
-		return "", err
+//     qrArt, err := QREncodeToSmallString("Hello World", false, false, defaultMaxQrVersion)
+func QREncodeToSmallString(content string, disableBorder bool, negative bool, maxVersion int) (string, error) {
+	result, err := EncodeQR(content, QROptions{Level: qrCodeLevel, MinLevel: qrCodeLevel, MaxVersion: maxVersion,
+		DisableBorder: disableBorder, Negative: negative})
+	return result.Art, err
+}
+
+// qrRecoveryLevels maps the names accepted for QR code error correction levels to go-qrcode levels,
+// recovering from 7%, 15%, 25% and 30% of damage respectively.
+var qrRecoveryLevels = map[string]qrcode.RecoveryLevel{
+	"low":     qrcode.Low,
+	"medium":  qrcode.Medium,
+	"high":    qrcode.High,
+	"highest": qrcode.Highest,
+}
+
+// parseQrRecoveryLevel parses the name of a QR code error correction level: low, medium, high or
+// highest.
+func parseQrRecoveryLevel(name string) (qrcode.RecoveryLevel, error) {
+	level, found := qrRecoveryLevels[strings.ToLower(strings.TrimSpace(name))]
+	if !found {
+		return qrcode.Medium, newError(errValidation, "invalid QR code recovery level '%s', expected low, medium, high or highest", name)
 	}
 
-	if disableBorder {
-		q.DisableBorder = true
+	return level, nil
+}
+
+// qrRecoveryLevelName returns the name of a QR code error correction level, see qrRecoveryLevels.
+func qrRecoveryLevelName(level qrcode.RecoveryLevel) string {
+	for name, candidate := range qrRecoveryLevels {
+		if candidate == level {
+			return name
+		}
 	}
 
-	art := q.ToSmallString(negative)
-	return art, nil
+	return ""
 }
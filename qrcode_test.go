@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// qrLevels are the error correction levels from the lowest to the highest.
+var qrLevels = []qrcode.RecoveryLevel{qrcode.Low, qrcode.Medium, qrcode.High, qrcode.Highest}
+
+// publishedCapacities are the byte mode capacities of ISO/IEC 18004 for some versions, at the
+// levels of qrLevels.
+var publishedCapacities = map[int][4]int{
+	1:  {17, 14, 11, 7},
+	10: {271, 213, 151, 119},
+	25: {1273, 997, 715, 535},
+	40: {2953, 2331, 1663, 1273},
+}
+
+func TestQrByteCapacity(t *testing.T) {
+	for version, capacities := range publishedCapacities {
+		for i, level := range qrLevels {
+			if got := qrByteCapacity(version, level); got != capacities[i] {
+				t.Errorf("qrByteCapacity(%d, %s) = %d, want %d", version, qrRecoveryLevelName(level), got, capacities[i])
+			}
+		}
+	}
+}
+
+func TestEncodeQRCapacityBoundaries(t *testing.T) {
+	capacities := publishedCapacities[defaultMaxQrVersion]
+	for i, level := range qrLevels {
+		name := qrRecoveryLevelName(level)
+		full := strings.Repeat("a", capacities[i])
+
+		// The capacity fits the level, one byte more doesn't
+		qr, err := EncodeQR(full, QROptions{Level: level, MinLevel: level, MaxVersion: defaultMaxQrVersion})
+		if err != nil || qr.Level != level || qr.SteppedDown || qr.Version != defaultMaxQrVersion || qr.Modules != 117 {
+			t.Errorf("%s: %d bytes = %+v, %v, want version 25 at %s", name, len(full), qr, err, name)
+		}
+		_, err = EncodeQR(full+"a", QROptions{Level: level, MinLevel: level, MaxVersion: defaultMaxQrVersion})
+		var tooLarge *ErrPayloadTooLarge
+		if !errors.As(err, &tooLarge) || !errors.Is(err, errQrCodeTooLarge) || exitCode(err) != exitValidation {
+			t.Fatalf("%s: %d bytes = %v, want *ErrPayloadTooLarge", name, len(full)+1, err)
+		}
+		if *tooLarge != (ErrPayloadTooLarge{Bytes: capacities[i] + 1, MaxBytes: capacities[i],
+			MaxVersion: defaultMaxQrVersion, Level: level, NeededVersion: defaultMaxQrVersion + 1}) {
+			t.Errorf("%s: limits %+v", name, *tooLarge)
+		}
+
+		// Stepping down fits it at the next lower level
+		if i == 0 {
+			continue
+		}
+		qr, err = EncodeQR(full+"a", QROptions{Level: level, MinLevel: qrcode.Low, MaxVersion: defaultMaxQrVersion})
+		if err != nil || qr.Level != qrLevels[i-1] || !qr.SteppedDown {
+			t.Errorf("%s: %d bytes with step-down = level %s, %v, want %s", name, len(full)+1,
+				qrRecoveryLevelName(qr.Level), err, qrRecoveryLevelName(qrLevels[i-1]))
+		}
+	}
+
+	// Nothing fits above the capacity of version 40 at low
+	_, err := EncodeQR(strings.Repeat("a", 2954), QROptions{Level: qrcode.Highest})
+	var tooLarge *ErrPayloadTooLarge
+	if !errors.As(err, &tooLarge) || tooLarge.MaxBytes != 2953 || tooLarge.MaxVersion != 40 ||
+		tooLarge.Level != qrcode.Low || tooLarge.NeededVersion != 0 {
+		t.Errorf("2954 bytes = %v", err)
+	}
+	if !strings.HasSuffix(err.Error(), "holds at most 2953 at error correction low, it doesn't fit any version") {
+		t.Errorf("error message %q", err)
+	}
+}
+
+func TestEncodeQROptions(t *testing.T) {
+	// A forced version is used even for a smaller content
+	qr, err := EncodeQR("hello", QROptions{Level: qrcode.Medium, Version: 10, PNGSize: 256})
+	if err != nil || qr.Version != 10 || qr.Modules != 57 || !bytes.HasPrefix(qr.PNG, []byte("\x89PNG")) {
+		t.Fatalf("forced version 10 = version %d, %d modules, %v", qr.Version, qr.Modules, err)
+	}
+	_, err = EncodeQR(strings.Repeat("a", 272), QROptions{Level: qrcode.Low, Version: 10})
+	if !errors.Is(err, errQrCodeTooLarge) {
+		t.Errorf("272 bytes at forced version 10 = %v", err)
+	}
+	for _, version := range []int{-1, 41} {
+		if _, err = EncodeQR("hello", QROptions{Version: version}); exitCode(err) != exitValidation ||
+			!strings.Contains(err.Error(), "invalid QR code version") {
+			t.Errorf("version %d = %v", version, err)
+		}
+	}
+
+	// The zero value: error correction low, smallest version, no image, with the quiet zone
+	qr, err = EncodeQR("hello", QROptions{})
+	if err != nil || qr.Level != qrcode.Low || qr.Version != 1 || qr.PNG != nil {
+		t.Fatalf("zero options = %+v, %v", qr, err)
+	}
+	borderless, _ := EncodeQR("hello", QROptions{DisableBorder: true})
+	negative, _ := EncodeQR("hello", QROptions{Negative: true})
+	if len(borderless.Art) >= len(qr.Art) || negative.Art == qr.Art {
+		t.Error("DisableBorder or Negative had no effect on the art")
+	}
+
+	// A MinLevel above Level doesn't raise the level
+	if qr, err = EncodeQR("hello", QROptions{Level: qrcode.Low, MinLevel: qrcode.Highest}); err != nil ||
+		qr.Level != qrcode.Low || qr.SteppedDown {
+		t.Errorf("MinLevel above Level = %+v, %v", qr, err)
+	}
+}
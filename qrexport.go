@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// qrIndexFile is the index 'export-qr' writes next to the images, see qrIndexRow.
+const qrIndexFile = "index.csv"
+
+// qrIndexFlushInterval is the number of exported clients after which index.csv is rewritten, so
+// that an interrupted export resumes close to where it stopped.
+const qrIndexFlushInterval = 25
+
+// qrIndexHeader is the header line of index.csv.
+var qrIndexHeader = []string{"Client", "Name", "File", "Fingerprint", "PayloadHash", "FileHash"}
+
+// qrIndexRow is a line of index.csv, one per image: the client and the fingerprint of its public
+// key for the deployment team, and the hashes that let a later export skip the image.
+type qrIndexRow struct {
+	Client int
+	Name   string
+	File   string
+	// Fingerprint identifies the client public key, see keyFingerprint.
+	Fingerprint string
+	// PayloadHash is the hash of the configuration encoded in the image, FileHash the one of the
+	// image file, see contentHash.
+	PayloadHash string
+	FileHash    string
+}
+
+// qrExportJob is the QR code of a client to encode, handed to the workers of exportAllQrCodes.
+type qrExportJob struct {
+	index   int
+	name    string
+	payload string
+	key     string
+}
+
+// qrExportResult is the outcome of the export of the QR code of a client.
+type qrExportResult struct {
+	Client int
+	Name   string
+	Files  []string
+	// UpToDate tells whether the images of a previous export still matched and were kept.
+	UpToDate bool
+	Error    string `json:",omitempty"`
+	rows     []qrIndexRow
+}
+
+// readQrIndex reads the index.csv of a previous export, by client number. A missing or damaged
+// index gives no rows, everything is exported again.
+func readQrIndex(dir string) map[int][]qrIndexRow {
+	rows := make(map[int][]qrIndexRow)
+	file, err := os.Open(filepath.Join(dir, qrIndexFile))
+	if err != nil {
+		return rows
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return rows
+	}
+	for _, record := range records {
+		if len(record) != len(qrIndexHeader) {
+			continue
+		}
+		client, err := strconv.Atoi(record[0])
+		if err != nil {
+			// The header line
+			continue
+		}
+		rows[client] = append(rows[client], qrIndexRow{Client: client, Name: record[1], File: record[2],
+			Fingerprint: record[3], PayloadHash: record[4], FileHash: record[5]})
+	}
+
+	return rows
+}
+
+// writeQrIndex rewrites index.csv with the rows of every client, in client order.
+func writeQrIndex(dir string, rows map[int][]qrIndexRow, clients int) error {
+	var content bytes.Buffer
+	writer := csv.NewWriter(&content)
+	writer.Write(qrIndexHeader)
+	for client := 1; client <= clients; client++ {
+		for _, row := range rows[client] {
+			writer.Write([]string{strconv.Itoa(row.Client), row.Name, row.File, row.Fingerprint, row.PayloadHash,
+				row.FileHash})
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(dir, qrIndexFile), content.Bytes(), 0600)
+}
+
+// qrImagesUpToDate tells whether the images recorded in the index for a client were generated from
+// the same payload and are still unchanged on disk.
+func qrImagesUpToDate(dir string, rows []qrIndexRow, payloadHash string) bool {
+	if len(rows) == 0 {
+		return false
+	}
+	for _, row := range rows {
+		content, err := ioutil.ReadFile(filepath.Join(dir, row.File))
+		if err != nil || row.PayloadHash != payloadHash || contentHash(content) != row.FileHash {
+			return false
+		}
+	}
+
+	return true
+}
+
+// exportQrCode encodes the QR code images of a client and writes them into the directory, for a
+// worker of exportAllQrCodes.
+func exportQrCode(dir string, job qrExportJob, qrVersion int, qrLevel qrcode.RecoveryLevel) qrExportResult {
+	result := qrExportResult{Client: job.index + 1, Name: job.name}
+	baseName := strings.TrimSuffix(fmt.Sprintf(defaultClientConfigFile, job.index+1), ".conf")
+
+	names, images, err := qrCodeImages(baseName, job.payload, qrVersion, qrLevel)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for i, png := range images {
+		if err = writeFileAtomic(filepath.Join(dir, names[i]), png, 0600); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		result.Files = append(result.Files, names[i])
+		result.rows = append(result.rows, qrIndexRow{Client: result.Client, Name: job.name, File: names[i],
+			Fingerprint: keyFingerprint(job.key), PayloadHash: contentHash([]byte(job.payload)), FileHash: contentHash(png)})
+	}
+
+	return result
+}
+
+// exportAllQrCodes writes the QR code image of every client into a directory, with an index.csv
+// mapping the clients to their images and key fingerprints for the deployment team. Encoding is
+// CPU-bound, the clients are spread over a pool of workers. The export is resumable: images whose
+// payload and content still match the index of a previous export are kept, so an interrupted
+// export of a large profile resumes where it stopped, and a repeated export only rewrites the
+// clients that changed. A client that fails doesn't abort the export, the failures are returned
+// with the other results. Clients with an external key have no complete configuration to encode
+// and are left out.
+//
+// Parameters:
+//     dir (string): The target directory, created if needed.
+//     workers (int): The number of encoding workers, GOMAXPROCS if 0.
+//     qrVersion (int): The QR code version, 0 for automatic sizing, see qrCodeImages.
+//     qrLevel (qrcode.RecoveryLevel): The recovery level.
+//     force (bool): Whether to encode every image again, ignoring the previous index.
+//
+// Returns:
+//     []qrExportResult: The outcome of every exported client, in client order.
+//     error: An error if the directory or the index can't be written.
+//
+// Usage:
+//     results, err := config.exportAllQrCodes(`C:\rollout\qr`, 0, 0, qrcode.Medium, false)
+func (config *appConfig) exportAllQrCodes(dir string, workers int, qrVersion int, qrLevel qrcode.RecoveryLevel,
+	force bool) ([]qrExportResult, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	removeStaleTempFiles(dir)
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	rows := readQrIndex(dir)
+	for client := range rows {
+		if client > len(config.Clients) {
+			delete(rows, client)
+		}
+	}
+
+	// The payloads are rendered up front, the workers only encode and write
+	var results []qrExportResult
+	var jobs []qrExportJob
+	for i := range config.Clients {
+		if config.Clients[i].PrivateKey == "" || i >= len(config.Server.Peers) {
+			delete(rows, i+1)
+			continue
+		}
+		payload, _ := config.mobileQrContent(i)
+		job := qrExportJob{index: i, name: config.clientName(i), payload: payload, key: config.Server.Peers[i].PublicKey}
+		if !force && qrImagesUpToDate(dir, rows[i+1], contentHash([]byte(payload))) {
+			result := qrExportResult{Client: i + 1, Name: job.name, UpToDate: true}
+			for _, row := range rows[i+1] {
+				result.Files = append(result.Files, row.File)
+			}
+			results = append(results, result)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	progress := startSpinner("Exporting QR codes")
+	defer progress.Stop()
+
+	pending := make(chan qrExportJob)
+	done := make(chan qrExportResult, len(jobs))
+	for w := 0; w < workers; w++ {
+		go func() {
+			for job := range pending {
+				done <- exportQrCode(dir, job, qrVersion, qrLevel)
+			}
+		}()
+	}
+	go func() {
+		for _, job := range jobs {
+			pending <- job
+		}
+		close(pending)
+	}()
+
+	started := time.Now()
+	for completed := 1; completed <= len(jobs); completed++ {
+		result := <-done
+		if result.Error == "" {
+			rows[result.Client] = result.rows
+		} else {
+			delete(rows, result.Client)
+		}
+		results = append(results, result)
+
+		progress.SetStatus(fmt.Sprintf("%d/%d clients, %.1f/s", completed, len(jobs),
+			float64(completed)/time.Since(started).Seconds()))
+		if completed%qrIndexFlushInterval == 0 {
+			if err := writeQrIndex(dir, rows, len(config.Clients)); err != nil {
+				return results, fmt.Errorf("can't write %s: %w", qrIndexFile, err)
+			}
+		}
+	}
+	if err := writeQrIndex(dir, rows, len(config.Clients)); err != nil {
+		return results, fmt.Errorf("can't write %s: %w", qrIndexFile, err)
+	}
+
+	// The workers finish in any order
+	sort.Slice(results, func(i, j int) bool { return results[i].Client < results[j].Client })
+	return results, nil
+}
+
+// runExportQrCommand implements 'export qr' and its alias 'export-qr', which writes the QR code
+// image of every client and an index.csv into a directory, for large rollouts where the codes are
+// printed or distributed by a deployment team:
+//
+//     export-qr C:\rollout\qr
+//     export-qr --workers 4 --qr-level high C:\rollout\qr
+//     export-qr --force C:\rollout\qr
+//
+// Running it again keeps the images that are still up to date, so an interrupted export resumes,
+// --force encodes them all again. See exportAllQrCodes.
+func runExportQrCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: export-qr [--workers n] [--qr-version 1-40] "+
+		"[--qr-level low|medium|high|highest] [--force] <directory>")
+
+	flags := flag.NewFlagSet("export-qr", flag.ContinueOnError)
+	workers := flags.Int("workers", 0, "Number of encoding workers, the number of CPUs if 0")
+	qrVersion := flags.Int("qr-version", 0, "QR code version (1-40) of the images, automatic if 0")
+	qrLevelName := flags.String("qr-level", "medium", "QR code recovery level, low, medium, high or highest")
+	force := flags.Bool("force", false, "Encode every image again, even if it is up to date")
+	if err := parseFlags(flags, "export-qr", args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return usage
+	}
+	if *workers < 0 {
+		return newError(errValidation, "invalid number of workers %d", *workers)
+	}
+	if *qrVersion < 0 || *qrVersion > 40 {
+		return newError(errValidation, "invalid QR code version %d, expected a number between 1 and 40", *qrVersion)
+	}
+	qrLevel, err := parseQrRecoveryLevel(*qrLevelName)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	results, err := config.exportAllQrCodes(flags.Arg(0), *workers, *qrVersion, qrLevel, *force)
+	if err != nil {
+		return err
+	}
+
+	exported, upToDate, failures := 0, 0, ""
+	delivered := false
+	for _, result := range results {
+		switch {
+		case result.Error != "":
+			client := fmt.Sprintf("client %d", result.Client)
+			if result.Name != client {
+				client += " (" + result.Name + ")"
+			}
+			failures += fmt.Sprintf("  %s: %s\n", client, result.Error)
+		case result.UpToDate:
+			upToDate++
+		default:
+			exported++
+			delivered = config.recordStatus(configPath, result.Client-1, statusDelivered, "QR code exported",
+				time.Now()) || delivered
+		}
+	}
+	if delivered {
+		config.saveStatus(configPath)
+	}
+
+	text := fmt.Sprintf("%d QR codes exported into %s, %d up to date, see %s.\n", exported, flags.Arg(0), upToDate,
+		qrIndexFile)
+	if failures != "" {
+		text += "Failed:\n" + failures
+	}
+	text += "Warning: the QR codes contain private keys, only share them over a trusted channel.\n"
+	printResult(text, results)
+
+	if failures != "" {
+		return fmt.Errorf("%d QR codes couldn't be exported", len(results)-exported-upToDate)
+	}
+	return nil
+}
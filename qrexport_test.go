@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// exportedClients returns the results of an export by outcome: the clients encoded, kept up to
+// date and failed.
+func exportedClients(results []qrExportResult) (exported []int, upToDate []int, failed []int) {
+	for _, result := range results {
+		switch {
+		case result.Error != "":
+			failed = append(failed, result.Client)
+		case result.UpToDate:
+			upToDate = append(upToDate, result.Client)
+		default:
+			exported = append(exported, result.Client)
+		}
+	}
+
+	return exported, upToDate, failed
+}
+
+func TestExportAllQrCodes(t *testing.T) {
+	config, _ := newTestProfile(t, 5)
+	dir := filepath.Join(t.TempDir(), "qr")
+	// Client 4 has an external key, it has no configuration to encode
+	config.Clients[3].PrivateKey = ""
+
+	results, err := config.exportAllQrCodes(dir, 2, 0, qrcode.Medium, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, upToDate, failed := exportedClients(results)
+	if fmt.Sprint(exported, upToDate, failed) != "[1 2 3 5] [] []" {
+		t.Fatalf("exported %v, up to date %v, failed %v", exported, upToDate, failed)
+	}
+	rows := readQrIndex(dir)
+	if len(rows) != 4 || len(rows[4]) != 0 {
+		t.Fatalf("index rows = %v", rows)
+	}
+	for _, client := range exported {
+		row := rows[client][0]
+		if row.File != fmt.Sprintf("wsclient_%d.png", client) || row.Name != config.clientName(client-1) ||
+			row.Fingerprint != keyFingerprint(config.Server.Peers[client-1].PublicKey) {
+			t.Errorf("index row of client %d = %+v", client, row)
+		}
+	}
+
+	// A second export keeps every image, a changed image or configuration is exported again
+	if results, err = config.exportAllQrCodes(dir, 2, 0, qrcode.Medium, false); err != nil {
+		t.Fatal(err)
+	}
+	if exported, upToDate, _ = exportedClients(results); len(exported) != 0 || len(upToDate) != 4 {
+		t.Errorf("repeated export encoded %v", exported)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "wsclient_2.png"), []byte("damaged"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Clients[4].Peers[0].PersistentKeepalive = 15
+	if results, err = config.exportAllQrCodes(dir, 2, 0, qrcode.Medium, false); err != nil {
+		t.Fatal(err)
+	}
+	if exported, upToDate, _ = exportedClients(results); fmt.Sprint(exported, upToDate) != "[2 5] [1 3]" {
+		t.Errorf("export after changes encoded %v, kept %v", exported, upToDate)
+	}
+	if results, err = config.exportAllQrCodes(dir, 2, 0, qrcode.Medium, true); err != nil {
+		t.Fatal(err)
+	}
+	if exported, _, _ = exportedClients(results); len(exported) != 4 {
+		t.Errorf("forced export encoded %v", exported)
+	}
+}
+
+func TestExportAllQrCodesFailure(t *testing.T) {
+	config, _ := newTestProfile(t, 4)
+	dir := t.TempDir()
+	// The image of client 2 can't replace a directory
+	if err := os.Mkdir(filepath.Join(dir, "wsclient_2.png"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := config.exportAllQrCodes(dir, 0, 0, qrcode.Medium, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, _, failed := exportedClients(results)
+	if fmt.Sprint(exported, failed) != "[1 3 4] [2]" || results[1].Error == "" {
+		t.Fatalf("exported %v, failed %v", exported, failed)
+	}
+	if rows := readQrIndex(dir); len(rows) != 3 || len(rows[2]) != 0 {
+		t.Errorf("the index lists the failed client: %v", rows)
+	}
+
+	// Every client fails at a QR code version too small for a configuration, the batch still completes
+	if results, err = config.exportAllQrCodes(t.TempDir(), 0, 1, qrcode.Medium, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, failed = exportedClients(results); len(failed) != 4 {
+		t.Errorf("failed %v at version 1, want every client", failed)
+	}
+}
+
+// BenchmarkExportAllQrCodes encodes the QR codes of a synthetic profile of 1000 clients with a
+// growing number of workers. The clients per second should grow close to linearly up to the
+// number of CPUs:
+//
+//     go test -run '^$' -bench ExportAllQrCodes -benchtime 3x
+func BenchmarkExportAllQrCodes(b *testing.B) {
+	config := newSubnetProfile(b, "10.9.0.0/22")
+	for len(config.Clients) < 1000 {
+		if err := config.addClient(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	previousQuiet := quietMode
+	quietMode = true
+	defer func() { quietMode = previousQuiet }()
+
+	for workers := 1; workers <= runtime.GOMAXPROCS(0); workers *= 2 {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			dir := b.TempDir()
+			started := time.Now()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := config.exportAllQrCodes(dir, workers, 0, qrcode.Medium, true); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*len(config.Clients))/time.Since(started).Seconds(), "clients/s")
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// qrFramePrefix starts the header line of every frame of a multi-part QR code, see splitQrFrames.
+const qrFramePrefix = "WGQC-PART"
+
+// qrFrameSize is the number of payload bytes per frame. With its header a frame fits QR code
+// version 25 at the medium recovery level, which phones scan reliably.
+const qrFrameSize = 900
+
+// qrPayloadChecksum returns the checksum over the whole payload carried by the frame headers.
+func qrPayloadChecksum(payload string) string {
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:8])
+}
+
+// splitQrFrames splits a payload too large for a single QR code into frames of at most size bytes,
+// each starting with a header line "WGQC-PART <index>/<total> <length> <checksum>" with the length
+// of the chunk in the frame and a checksum over the whole payload, so that joinQrFrames can
+// reassemble the frames in any scan order, ignore a line break added when saving the scanned text,
+// and detect a missing or damaged frame.
+//
+// Parameters:
+//     payload (string): The content, e.g. a client configuration.
+//     size (int): The payload bytes per frame, see qrFrameSize.
+//
+// Returns:
+//     []string: The frames in order, each to be encoded into its own QR code.
+//
+// Usage:
+//     frames := splitQrFrames(content, qrFrameSize)
+func splitQrFrames(payload string, size int) []string {
+	var chunks []string
+	for len(payload) > size {
+		chunks = append(chunks, payload[:size])
+		payload = payload[size:]
+	}
+	chunks = append(chunks, payload)
+
+	checksum := qrPayloadChecksum(strings.Join(chunks, ""))
+	frames := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		frames[i] = fmt.Sprintf("%s %d/%d %d %s\n%s", qrFramePrefix, i+1, len(chunks), len(chunk), checksum, chunk)
+	}
+
+	return frames
+}
+
+// joinQrFrames reassembles the payload from the frames of a multi-part QR code, given in any
+// order, and verifies the checksum over the whole payload.
+//
+// Parameters:
+//     frames ([]string): The scanned text of every frame.
+//
+// Returns:
+//     string: The original payload.
+//     error: A validation error for a frame without header, frames of different codes, a missing
+//         or repeated frame, or a checksum mismatch.
+//
+// Usage:
+//     content, err := joinQrFrames(scanned)
+func joinQrFrames(frames []string) (string, error) {
+	var chunks []string
+	checksum := ""
+	for _, frame := range frames {
+		header, chunk, found := strings.Cut(strings.TrimPrefix(frame, "\ufeff"), "\n")
+		fields := strings.Fields(strings.TrimSuffix(header, "\r"))
+		if !found || len(fields) != 4 || fields[0] != qrFramePrefix {
+			return "", newError(errValidation, "not a frame of a multi-part QR code, the first line must start with %s", qrFramePrefix)
+		}
+		indexText, totalText, _ := strings.Cut(fields[1], "/")
+		index, err := strconv.Atoi(indexText)
+		total, err2 := strconv.Atoi(totalText)
+		if err != nil || err2 != nil || total < 1 || index < 1 || index > total {
+			return "", newError(errValidation, "invalid frame number '%s'", fields[1])
+		}
+		length, err := strconv.Atoi(fields[2])
+		if err != nil || length < 1 || length > len(chunk) {
+			return "", newError(errValidation, "frame %d/%d is incomplete", index, total)
+		}
+		chunk = chunk[:length]
+
+		if chunks == nil {
+			chunks, checksum = make([]string, total), fields[3]
+		}
+		if total != len(chunks) || fields[3] != checksum {
+			return "", newError(errValidation, "frame %d/%d belongs to another multi-part QR code", index, total)
+		}
+		if chunks[index-1] != "" {
+			return "", newError(errValidation, "frame %d/%d is given twice", index, total)
+		}
+		chunks[index-1] = chunk
+	}
+
+	var missing []string
+	for i, chunk := range chunks {
+		if chunk == "" {
+			missing = append(missing, strconv.Itoa(i+1))
+		}
+	}
+	if len(chunks) == 0 || len(missing) > 0 {
+		return "", newError(errValidation, "frames %s of %d are missing", strings.Join(missing, ", "), len(chunks))
+	}
+
+	payload := strings.Join(chunks, "")
+	if qrPayloadChecksum(payload) != checksum {
+		return "", newError(errValidation, "the checksum of the reassembled content doesn't match, a frame was scanned incorrectly")
+	}
+
+	return payload, nil
+}
+
+// showQrFrames displays the frames of a multi-part QR code one after another, waiting for Enter
+// between them so that each can be scanned.
+func showQrFrames(frames []string) error {
+	for i, frame := range frames {
+		qr, err := EncodeQR(frame, QROptions{Level: qrcode.Medium, MinLevel: qrcode.Low})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nPart %d of %d:\n", i+1, len(frames))
+		fmt.Print(qr.Art)
+		if i < len(frames)-1 {
+			readInput("Press Enter to show the next part:")
+		}
+	}
+
+	return nil
+}
+
+// qrFramePNGs encodes the frames of a multi-part QR code into one PNG image each, see EncodeQR.
+func qrFramePNGs(frames []string, size int) ([][]byte, error) {
+	var images [][]byte
+	for _, frame := range frames {
+		qr, err := EncodeQR(frame, QROptions{Level: qrcode.Medium, MinLevel: qrcode.Low, PNGSize: size})
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, qr.PNG)
+	}
+
+	return images, nil
+}
+
+// runJoinQrCommand implements the 'join-qr' command, which reassembles a configuration shown as a
+// multi-part QR code from the scanned text of its parts, one file per part in any order:
+//
+//     join-qr part1.txt part2.txt part3.txt --out laptop.conf
+//
+// The result is only written if the checksum over the whole configuration matches.
+func runJoinQrCommand(configPath string, args []string) error {
+	var files []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		files, args = append(files, args[0]), args[1:]
+	}
+
+	flags := flag.NewFlagSet("join-qr", flag.ContinueOnError)
+	out := flags.String("out", "", "File to write the reassembled configuration into")
+	if err := parseFlags(flags, "join-qr", args); err != nil {
+		return err
+	}
+	files = append(files, flags.Args()...)
+	if len(files) == 0 || *out == "" {
+		return newError(errUsage, "usage: join-qr <part.txt>... --out file.conf")
+	}
+
+	var frames []string
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return newError(errValidation, "can't read %s: %w", file, err)
+		}
+		frames = append(frames, string(content))
+	}
+
+	payload, err := joinQrFrames(frames)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(*out, []byte(payload), 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("Reassembled %d parts into %s, the checksum matches.\n", len(frames), *out)
+	return nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Formats of 'relay export', the forwarding set up on the relay host.
+const (
+	// relaySocat is a socat command line.
+	relaySocat = "socat"
+	// relaySystemd is a systemd service running socat.
+	relaySystemd = "systemd"
+	// relayNftables is an nftables ruleset forwarding the port with DNAT in the kernel.
+	relayNftables = "nftables"
+)
+
+// relayIdleTimeout is the time in seconds after which socat drops the forwarding of a client that
+// stopped sending, well above the keepalive the clients need behind a relay.
+const relayIdleTimeout = 300
+
+// relaySettings describes a relay in front of the server, e.g. a cheap VPS forwarding the UDP
+// traffic to a home server behind carrier-grade NAT: the clients dial the relay, which forwards
+// to the server. Set with 'relay set'.
+type relaySettings struct {
+	// Endpoint is the host:port on the relay the clients dial.
+	Endpoint string
+	// Target is the host:port the relay forwards to, the server as the relay reaches it, e.g. its
+	// IPv6 address or the name of another tunnel.
+	Target string
+	// DirectEndpoint is the endpoint of the clients before the relay was set, restored by 'relay
+	// clear'.
+	DirectEndpoint string `json:",omitempty"`
+	// LastAddresses are the addresses the relay host resolved to at the last check of
+	// 'watch-endpoint', see checkRelay.
+	LastAddresses []string `json:",omitempty"`
+}
+
+// String describes the relay for 'relay show' and the setup summary.
+func (relay relaySettings) String() string {
+	return fmt.Sprintf("%s, forwarding to %s", displayEndpoint(relay.Endpoint), displayEndpoint(relay.Target))
+}
+
+// relayPort returns the port of an endpoint.
+func relayPort(endpoint string) int {
+	_, port, _ := net.SplitHostPort(endpoint)
+	number, _ := strconv.Atoi(port)
+
+	return number
+}
+
+// socatCommand returns the socat command line forwarding the relay port to the server. fork gives
+// every client its own forwarding, which socat drops after relayIdleTimeout of silence.
+func (relay relaySettings) socatCommand() string {
+	return fmt.Sprintf("socat -T %d UDP-LISTEN:%d,fork,reuseaddr UDP:%s", relayIdleTimeout, relayPort(relay.Endpoint),
+		relay.Target)
+}
+
+// systemdUnit returns a systemd service running the socat forwarding on the relay host.
+func (relay relaySettings) systemdUnit(service string) string {
+	result := fmt.Sprintf("# Generated by wg-quick-config: Wireguard UDP relay forwarding port %d to %s.\n",
+		relayPort(relay.Endpoint), relay.Target)
+	result += fmt.Sprintf("# Install as /etc/systemd/system/%s, then run:\n", service)
+	result += fmt.Sprintf("#   systemctl daemon-reload && systemctl enable --now %s\n", service)
+	result += "[Unit]\n"
+	result += fmt.Sprintf("Description=Wireguard UDP relay to %s\n", relay.Target)
+	result += "After=network-online.target\nWants=network-online.target\n\n"
+	result += "[Service]\n"
+	result += "ExecStart=/usr/bin/" + relay.socatCommand() + "\n"
+	result += "Restart=always\nRestartSec=5\nDynamicUser=yes\n"
+	if relayPort(relay.Endpoint) < 1024 {
+		result += "AmbientCapabilities=CAP_NET_BIND_SERVICE\n"
+	}
+	result += "\n[Install]\nWantedBy=multi-user.target\n"
+
+	return result
+}
+
+// nftablesRules returns an nftables ruleset forwarding the relay port to the server with DNAT.
+// Replies have to come back through the relay, so the forwarded packets are masqueraded as well.
+// DNAT needs an address: a target host name is resolved now and the ruleset has to be exported
+// again when its address changes. DNAT doesn't translate between IPv4 and IPv6, the clients have
+// to reach the relay in the address family of the target, socat does translate.
+//
+// Returns:
+//     string: The ruleset, to be loaded with 'nft -f'.
+//     error: A validation error if the target host can't be resolved.
+func (relay relaySettings) nftablesRules() (string, error) {
+	host, port, err := net.SplitHostPort(relay.Target)
+	if err != nil {
+		return "", newError(errValidation, "invalid relay target '%s'", relay.Target)
+	}
+	ip := net.ParseIP(host)
+	resolved := ""
+	if ip == nil {
+		addresses, err := net.LookupIP(host)
+		if err != nil || len(addresses) == 0 {
+			return "", newError(errValidation, "can't resolve the relay target %s, DNAT needs its address", host)
+		}
+		ip = addresses[0]
+		resolved = fmt.Sprintf("# %s resolved to %s, export the rules again when its address changes.\n", host, ip)
+	}
+
+	family, address, forwarding := "ip", ip.String(), "net.ipv4.ip_forward=1"
+	if ip.To4() == nil {
+		family, address, forwarding = "ip6", "["+ip.String()+"]", "net.ipv6.conf.all.forwarding=1"
+	}
+	result := fmt.Sprintf("# Generated by wg-quick-config: Wireguard UDP relay forwarding port %d to %s.\n",
+		relayPort(relay.Endpoint), relay.Target)
+	result += resolved
+	result += fmt.Sprintf("# Load with 'nft -f', IP forwarding has to be enabled: sysctl -w %s\n", forwarding)
+	result += fmt.Sprintf("table %s wgrelay {\n", family)
+	result += "\tchain prerouting {\n\t\ttype nat hook prerouting priority dstnat; policy accept;\n"
+	result += fmt.Sprintf("\t\tudp dport %d dnat to %s:%s\n\t}\n", relayPort(relay.Endpoint), address, port)
+	result += "\tchain postrouting {\n\t\ttype nat hook postrouting priority srcnat; policy accept;\n"
+	result += fmt.Sprintf("\t\t%s daddr %s udp dport %s masquerade\n\t}\n}\n", family, ip, port)
+
+	return result, nil
+}
+
+// relayKeepalive enables the PersistentKeepalive of the clients that have none: the relay keeps
+// no NAT mapping of its own, socat drops a silent client after relayIdleTimeout and the NAT of the
+// client expires even sooner. The keepalive of the client defaults is used, or the default one.
+//
+// Returns:
+//     []fieldChange: The enabled keepalives.
+func (config *appConfig) relayKeepalive() []fieldChange {
+	var changes []fieldChange
+	for i := range config.Clients {
+		client := &config.Clients[i]
+		if len(client.Peers) == 0 || client.Peers[0].PersistentKeepalive != 0 {
+			continue
+		}
+		keepalive := config.defaultsForClient(i).PersistentKeepalive
+		if keepalive == 0 {
+			// Kept by 'apply-defaults', which would disable it again
+			keepalive = defaultPersistentKeepalive
+			config.clientInfo(i).addOverride("keepalive")
+		}
+		client.Peers[0].PersistentKeepalive = keepalive
+		changes = append(changes, fieldChange{Client: i + 1, Field: "keepalive", Before: "0",
+			After: strconv.Itoa(int(keepalive))})
+	}
+
+	return changes
+}
+
+// checkRelayKeepalive returns a validation error if the client with the given zero-based index has
+// no PersistentKeepalive while the clients connect through a relay, see relayKeepalive.
+func (config *appConfig) checkRelayKeepalive(index int) error {
+	client := config.Clients[index]
+	if config.Relay == nil || len(client.Peers) == 0 || client.Peers[0].PersistentKeepalive != 0 {
+		return nil
+	}
+
+	return newError(errValidation, "PersistentKeepalive is required behind the relay %s, which keeps no NAT mapping "+
+		"of its own", displayEndpoint(config.Relay.Endpoint))
+}
+
+// resolveRelay returns the sorted addresses of the relay host, the address itself if the relay
+// endpoint is an IP address.
+func (relay relaySettings) resolveRelay() ([]string, error) {
+	host, _, err := net.SplitHostPort(relay.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}, nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	sort.Strings(addresses)
+
+	return addresses, nil
+}
+
+// checkRelay runs one check of 'watch-endpoint' for a server behind a relay. The external IP
+// address of the server doesn't matter then, the clients dial the relay: the check resolves the
+// relay host and logs when its addresses change or it stops resolving, e.g. after the VPS was
+// moved, so that the forwarding and firewall rules bound to its address can be updated.
+//
+// Parameters:
+//     configPath (string): The profile directory.
+//
+// Returns:
+//     error: An error if the relay host can't be resolved or the configuration can't be saved.
+//
+// Usage:
+//     err := config.checkRelay(configPath)
+func (config *appConfig) checkRelay(configPath string) error {
+	addresses, err := config.Relay.resolveRelay()
+	if err != nil {
+		return newError(errDependency, "can't resolve the relay %s: %w", displayEndpoint(config.Relay.Endpoint), err)
+	}
+	if strings.Join(addresses, ",") == strings.Join(config.Relay.LastAddresses, ",") {
+		return nil
+	}
+
+	previous := strings.Join(config.Relay.LastAddresses, ", ")
+	if previous == "" {
+		previous = "unknown"
+	}
+	watchLog("Relay %s now resolves to %s (was %s), the clients follow; update the rules bound to its address.",
+		displayEndpoint(config.Relay.Endpoint), strings.Join(addresses, ", "), previous)
+	for _, address := range addresses {
+		if scope := classifyEndpointAddress(net.ParseIP(address)); scope != endpointPublic {
+			watchLog("Warning: "+endpointScopeWarnings[scope], address)
+		}
+	}
+
+	previousAddresses := config.Relay.LastAddresses
+	config.Relay.LastAddresses = addresses
+	if err = config.saveWithHistory(configPath, "watch-endpoint", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, "watch-endpoint", map[string]interface{}{
+		"Relay": config.Relay.Endpoint, "Previous": previousAddresses, "Addresses": addresses})
+}
+
+// runRelayCommand implements the 'relay' command, which declares a relay in front of the server
+// for servers that aren't reachable themselves, e.g. behind carrier-grade NAT:
+//
+//     relay set vps.example.com:51820 --target home.example.net:51820
+//     relay show
+//     relay export systemd --out wg-relay.service
+//     relay clear
+//
+// 'set' points the clients at the relay and records where the relay forwards to, by default the
+// current endpoint with the server listen port. The relay keeps no NAT mapping of its own, so the
+// clients without PersistentKeepalive get the default one, and Validate refuses configurations
+// where a client has none. 'export' prints, or writes with --out, the forwarding for the relay
+// host: a socat command line, a systemd service running it or an nftables DNAT ruleset. 'clear'
+// points the clients at the direct endpoint again. While a relay is set, 'watch-endpoint' watches
+// the addresses of the relay host instead of the external IP address, see checkRelay.
+func runRelayCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: relay set <host:port> [--target host:port] | show | "+
+		"export socat|systemd|nftables [--out file] | clear")
+	if len(args) == 0 {
+		return usage
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	var changes []fieldChange
+	switch args[0] {
+	case "set":
+		if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+			return usage
+		}
+		flags := flag.NewFlagSet("relay", flag.ContinueOnError)
+		target := flags.String("target", "", "Address the relay forwards to, the current endpoint by default")
+		if err = parseFlags(flags, "relay", args[2:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 0 {
+			return usage
+		}
+
+		relay := relaySettings{DirectEndpoint: config.currentEndpoint()}
+		if config.Relay != nil {
+			relay.DirectEndpoint = config.Relay.DirectEndpoint
+		}
+		if relay.Endpoint, err = parseEndpoint(args[1], config.Server.ListenPort); err != nil {
+			return err
+		}
+		if *target == "" {
+			host, _, err := net.SplitHostPort(relay.DirectEndpoint)
+			if err != nil {
+				return newError(errUsage, "the clients have no endpoint the relay could forward to, see --target")
+			}
+			*target = net.JoinHostPort(host, strconv.Itoa(int(config.Server.ListenPort)))
+		}
+		if relay.Target, err = parseEndpoint(*target, config.Server.ListenPort); err != nil {
+			return err
+		}
+		if sameEndpoint(relay.Endpoint, relay.Target) {
+			return newError(errValidation, "the relay can't forward to itself, %s", relay.Endpoint)
+		}
+		if host, _, _ := net.SplitHostPort(relay.Endpoint); !confirmEndpointReachable(host) {
+			return newError(errValidation, "relay %s rejected", relay.Endpoint)
+		}
+
+		config.Relay = &relay
+		changes = append(config.setServerEndpoint(relay.Endpoint), config.relayKeepalive()...)
+		for _, change := range changes {
+			if change.Field == "keepalive" {
+				fmt.Printf("Client %d had no PersistentKeepalive, it gets %s seconds: the relay keeps no NAT mapping "+
+					"of its own.\n", change.Client, change.After)
+			}
+		}
+		if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+			return err
+		}
+		fmt.Printf("The clients now connect through the relay %s. Set up the forwarding on the relay host with "+
+			"'export relay'.\n", config.Relay.String())
+
+	case "show":
+		if config.Relay == nil {
+			fmt.Println("No relay is set, the clients connect to the server directly.")
+			return nil
+		}
+		text := fmt.Sprintf("Relay:      %s\nTarget:     %s\n", displayEndpoint(config.Relay.Endpoint),
+			displayEndpoint(config.Relay.Target))
+		if config.Relay.DirectEndpoint != "" {
+			text += fmt.Sprintf("Direct:     %s (restored by 'relay clear')\n", displayEndpoint(config.Relay.DirectEndpoint))
+		}
+		if addresses, err := config.Relay.resolveRelay(); err == nil {
+			text += fmt.Sprintf("Addresses:  %s\n", strings.Join(addresses, ", "))
+		} else {
+			text += fmt.Sprintf("Addresses:  can't be resolved, %s\n", err)
+		}
+		text += fmt.Sprintf("Forwarding: %s\n", config.Relay.socatCommand())
+		printResult(text, config.Relay)
+		return nil
+
+	case "export":
+		if len(args) < 2 {
+			return usage
+		}
+		flags := flag.NewFlagSet("relay", flag.ContinueOnError)
+		out := flags.String("out", "", "File to write the forwarding into instead of printing it")
+		if err = parseFlags(flags, "relay", args[2:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 0 {
+			return usage
+		}
+		if config.Relay == nil {
+			return newError(errValidation, "no relay is set, see 'relay set'")
+		}
+
+		var content string
+		switch strings.ToLower(args[1]) {
+		case relaySocat:
+			content = config.Relay.socatCommand() + "\n"
+		case relaySystemd:
+			content = config.Relay.systemdUnit(config.tunnelName() + "-relay.service")
+		case relayNftables:
+			if content, err = config.Relay.nftablesRules(); err != nil {
+				return err
+			}
+		default:
+			return newError(errValidation, "unknown relay export '%s', expected socat, systemd or nftables", args[1])
+		}
+		if *out == "" {
+			fmt.Print(content)
+			return nil
+		}
+		if err = writeFileAtomic(*out, []byte(content), 0644); err != nil {
+			return fmt.Errorf("can't write %s: %w", *out, err)
+		}
+		fmt.Println("Successfully saved relay forwarding:", *out)
+		return nil
+
+	case "clear":
+		if len(args) != 1 {
+			return usage
+		}
+		if config.Relay == nil {
+			fmt.Println("No relay is set.")
+			return nil
+		}
+		if config.Relay.DirectEndpoint != "" {
+			changes = config.setServerEndpoint(config.Relay.DirectEndpoint)
+			fmt.Println("The clients connect to the server directly again:", displayEndpoint(config.Relay.DirectEndpoint))
+		} else {
+			fmt.Println("Warning: the direct endpoint isn't known, set it with 'set-endpoint'.")
+		}
+		config.Relay = nil
+		if err = config.writeAllWireguardConfigFiles(configPath); err != nil {
+			return err
+		}
+
+	default:
+		return usage
+	}
+
+	operation := "relay " + args[0]
+	if err = config.saveWithHistory(configPath, operation, false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, operation, map[string]interface{}{"Relay": config.Relay, "Changes": changes})
+}
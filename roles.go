@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Reachability roles of a client, see clientInfo.Role. Mobile clients are behind NAT and need to
+// send keepalives to keep their NAT mapping open, clients with a public endpoint, such as
+// site-to-site routers, don't.
+const (
+	clientRoleMobile = "mobile"
+	clientRolePublic = "public"
+)
+
+// parseClientRole parses a client role, accepting "nat" for mobile and "site" for public.
+func parseClientRole(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case clientRoleMobile, "nat", "":
+		return clientRoleMobile, nil
+	case clientRolePublic, "site":
+		return clientRolePublic, nil
+	}
+
+	return "", newError(errValidation, "invalid client role '%s', expected %s or %s", value, clientRoleMobile, clientRolePublic)
+}
+
+// role returns the role of the client with the given zero-based index, mobile unless set.
+func (config *appConfig) role(index int) string {
+	if role := config.clientInfo(index).Role; role != "" {
+		return role
+	}
+
+	return clientRoleMobile
+}
+
+// detectServerBehindNat tells whether the server is reached through NAT: either its external IP
+// address isn't assigned to any local interface, i.e. a router forwards the port, or a local
+// address lies in the carrier-grade NAT range. Detection is best effort, if the external address
+// can't be detected the server is assumed not to be behind NAT.
+//
+// Returns:
+//     bool: Whether the server is behind NAT.
+//     string: The reason, for display.
+//
+// Usage:
+//     behindNat, reason := detectServerBehindNat()
+func detectServerBehindNat() (bool, string) {
+	addresses, err := localAddresses()
+	if err != nil {
+		return false, "the local addresses can't be listed"
+	}
+	for _, address := range addresses {
+		if ipNet, ok := address.(*net.IPNet); ok && classifyEndpointAddress(ipNet.IP) == endpointSharedNat {
+			return true, fmt.Sprintf("the local address %s is a carrier-grade NAT address", ipNet.IP.String())
+		}
+	}
+
+	externalIP, err := detectExternalIP()
+	if err != nil {
+		return false, "the external IP address can't be detected"
+	}
+	for _, address := range addresses {
+		if ipNet, ok := address.(*net.IPNet); ok && ipNet.IP.Equal(externalIP) {
+			return false, fmt.Sprintf("the external IP address %s is assigned to this host", externalIP.String())
+		}
+	}
+
+	return true, fmt.Sprintf("the external IP address %s isn't assigned to this host", externalIP.String())
+}
+
+// applyClientRole sets the keepalives of the client with the given zero-based index according to
+// its role: mobile clients get the keepalive of their defaults and public clients none, see
+// defaultsForClient, while the server sends keepalives to public clients only when it is behind
+// NAT itself. Mobile clients keep the server's NAT mapping open on their own, and keepalives
+// towards them would only cost battery. Keepalives set explicitly with 'set-client' are kept.
+//
+// Parameters:
+//     index (int): The zero-based index of the client.
+//     serverBehindNat (bool): Whether the server is behind NAT, see detectServerBehindNat.
+//
+// Usage:
+//     config.applyClientRole(len(config.Clients)-1, false)
+func (config *appConfig) applyClientRole(index int, serverBehindNat bool) {
+	info := config.clientInfo(index)
+	defaults := config.defaultsForClient(index)
+
+	if !info.hasOverride("keepalive") {
+		defaults.applyFieldTo(&config.Clients[index], "keepalive")
+	}
+
+	if !info.hasOverride("serverkeepalive") && index < len(config.Server.Peers) {
+		keepalive := uint32(0)
+		if config.role(index) == clientRolePublic && serverBehindNat {
+			keepalive = config.defaultsForGroup(info.Group).PersistentKeepalive
+		}
+		config.Server.Peers[index].PersistentKeepalive = keepalive
+	}
+}
+
+// setClientRole changes the role of the client with the given zero-based index and applies it,
+// detecting whether the server is behind NAT for public clients.
+func (config *appConfig) setClientRole(index int, role string) {
+	config.clientInfo(index).Role = role
+	if role == clientRoleMobile {
+		config.clientInfo(index).Role = ""
+	}
+
+	serverBehindNat := false
+	if role == clientRolePublic {
+		var reason string
+		serverBehindNat, reason = detectServerBehindNat()
+		if serverBehindNat {
+			fmt.Printf("The server is behind NAT (%s), it sends keepalives to client %d.\n", reason, index+1)
+		} else {
+			fmt.Printf("The server is not behind NAT (%s), no keepalives are needed for client %d.\n", reason, index+1)
+		}
+	}
+
+	config.applyClientRole(index, serverBehindNat)
+}
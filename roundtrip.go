@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// modelLines describes a configuration one field per line, e.g. "Peer 2 Endpoint = host:51820",
+// in a canonical form: networks are masked like the parser does and private keys are replaced by
+// a fingerprint, so that the lines can be compared and printed. See checkRoundTrip.
+func modelLines(wc WireguardConfig) string {
+	var lines []string
+	add := func(section string, field string, value interface{}) {
+		lines = append(lines, fmt.Sprintf("%s %s = %v", section, field, value))
+	}
+	addUnknown := func(section string, unknown []string) {
+		for _, line := range unknown {
+			key, value, _ := strings.Cut(line, "=")
+			add(section, strings.TrimSpace(key), strings.TrimSpace(value))
+		}
+	}
+
+	for _, comment := range wc.Comments {
+		add("Interface", "#", comment)
+	}
+	if wc.PrivateKey != "" {
+		add("Interface", "PrivateKey", "fingerprint "+qrPayloadChecksum(wc.PrivateKey))
+	}
+	add("Interface", "Address", joinIPNets(wc.Address))
+	add("Interface", "ListenPort", wc.ListenPort)
+	add("Interface", "DNS", strings.Join(wc.DNS, ", "))
+	add("Interface", "MTU", wc.MTU)
+	add("Interface", "Junk", wc.junkString())
+	for _, command := range wc.PostUp {
+		add("Interface", "PostUp", command)
+	}
+	for _, command := range wc.PostDown {
+		add("Interface", "PostDown", command)
+	}
+	addUnknown("Interface", wc.Unknown)
+
+	for i, peer := range wc.Peers {
+		section := fmt.Sprintf("Peer %d", i+1)
+		for _, comment := range peer.Comments {
+			add(section, "#", comment)
+		}
+		var allowedIPs []string
+		for _, network := range peer.AllowedIPs {
+			masked := normalizeIPNet(network)
+			allowedIPs = append(allowedIPs, masked.String())
+		}
+		add(section, "PublicKey", peer.PublicKey)
+		add(section, "AllowedIPs", strings.Join(allowedIPs, ", "))
+		add(section, "Endpoint", peer.Endpoint)
+		add(section, "PersistentKeepalive", peer.PersistentKeepalive)
+		addUnknown(section, peer.Unknown)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// checkRoundTrip is the self-check of the file-writing path: the rendered configuration is parsed
+// back and the resulting model compared with the one it was rendered from, so that a serializer
+// bug, e.g. a list joined wrongly or a value that needs escaping, is caught before the file reaches
+// a device instead of by Wireguard on the device. It is cheap enough to run on every write,
+// -no-roundtrip disables it for huge bulk runs.
+//
+// Parameters:
+//     fileName (string): The file about to be written, for the error message.
+//     wc (WireguardConfig): The configuration the content was rendered from.
+//     content (string): The rendered configuration.
+//
+// Returns:
+//     error: An internal error naming the mismatching fields if the content doesn't parse back into
+//         the same configuration, nil otherwise.
+//
+// Usage:
+//     if err := checkRoundTrip(fileName, wc, wc.String()); err != nil { return err }
+func checkRoundTrip(fileName string, wc WireguardConfig, content string) error {
+	if skipRoundTrip {
+		return nil
+	}
+
+	parsed, _, err := parseWireguardConfigText(content, filepath.Base(fileName), parseRoundTrip)
+	if err != nil {
+		return fmt.Errorf("internal error, the generated configuration doesn't parse back, %s was left unchanged, "+
+			"please report this: %v", fileName, err)
+	}
+
+	if mismatches := diffLines(modelLines(wc), modelLines(parsed)); len(mismatches) > 0 {
+		return fmt.Errorf("internal error, the generated configuration parses back differently, %s was left "+
+			"unchanged, please report this:\n%s", fileName, strings.Join(mismatches, "\n"))
+	}
+
+	return nil
+}
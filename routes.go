@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Reach of a client through the tunnel, see clientRoutes.
+const (
+	reachInternet = "internet"
+	reachSubnet   = "tunnel subnet"
+	reachNetworks = "networks"
+	reachServer   = "server only"
+)
+
+// routedNetwork is a network a client routes through the tunnel besides the tunnel subnet. Via is
+// the one-based number of the client the server forwards it to, i.e. the site-to-site client with
+// the network behind it, 0 if it is reached through the server itself.
+type routedNetwork struct {
+	Network string
+	Via     int `json:",omitempty"`
+}
+
+// clientRoutes is the reachability of a client in the hub configuration, as printed by
+// 'report routes'.
+type clientRoutes struct {
+	Client  int
+	Name    string
+	Address string
+	// Reach is reachInternet, reachSubnet, reachNetworks or reachServer.
+	Reach string
+	// TunnelSubnet tells whether the client routes the whole tunnel subnet, i.e. the other clients.
+	TunnelSubnet bool
+	Networks     []routedNetwork `json:",omitempty"`
+	// Sites are the networks behind the client, routed to it by the server besides its address.
+	Sites []string `json:",omitempty"`
+	// FullTunnelSite tells whether a full tunnel of a site-to-site client was confirmed with
+	// 'set-client fulltunnel=true', see siteFullTunnelWarnings.
+	FullTunnelSite bool `json:",omitempty"`
+	// ReachableBy are the clients routing the address of the client through the tunnel while it
+	// routes theirs back.
+	ReachableBy []int
+}
+
+// routeConflict is a network claimed by several clients: the server routes it to only one of them.
+type routeConflict struct {
+	Network string
+	Clients []int
+}
+
+// String returns the conflict as reported by Validate and 'report routes'.
+func (conflict routeConflict) String() string {
+	return fmt.Sprintf("clients %d and %d both claim %s, the server routes it to only one of them",
+		conflict.Clients[0], conflict.Clients[1], conflict.Network)
+}
+
+// routeReport is the reachability of all the clients of the configuration.
+type routeReport struct {
+	Clients   []clientRoutes
+	Conflicts []routeConflict
+}
+
+// networksOverlap tells whether two networks of the same address family share addresses.
+func networksOverlap(a net.IPNet, b net.IPNet) bool {
+	a, b = normalizeIPNet(a), normalizeIPNet(b)
+	return len(a.IP) == len(b.IP) && (a.Contains(b.IP) || b.Contains(a.IP))
+}
+
+// clientSites returns the networks the server peer of the client with the given zero-based index
+// routes besides the tunnel addresses of the client, the LANs behind a site-to-site client.
+func (config *appConfig) clientSites(index int) []net.IPNet {
+	if index >= len(config.Server.Peers) {
+		return nil
+	}
+
+	var sites []net.IPNet
+	for _, allowed := range config.Server.Peers[index].AllowedIPs {
+		own := false
+		for _, address := range config.Clients[index].Address {
+			if ones, bits := allowed.Mask.Size(); ones == bits && allowed.IP.Equal(address.IP) {
+				own = true
+			}
+		}
+		if !own {
+			sites = append(sites, allowed)
+		}
+	}
+
+	return sites
+}
+
+// routesEverything tells whether the AllowedIPs hold the IPv4 or the IPv6 default route, a full
+// tunnel.
+func routesEverything(allowedIPs []net.IPNet) bool {
+	for _, allowed := range allowedIPs {
+		if isDefaultRoute(allowed, false) || isDefaultRoute(allowed, true) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// siteAllowedIPs returns the AllowedIPs a site-to-site client gets instead of a full tunnel, which
+// would send the whole WAN traffic of its LAN through the server: the tunnel subnets and the
+// networks behind the other site-to-site clients, except those overlapping its own.
+func (config *appConfig) siteAllowedIPs(index int) []net.IPNet {
+	allowedIPs := config.serverSubnets()
+	own := config.clientSites(index)
+	for j := range config.Clients {
+		if j == index {
+			continue
+		}
+		for _, site := range config.clientSites(j) {
+			overlaps := false
+			for _, network := range own {
+				overlaps = overlaps || networksOverlap(site, network)
+			}
+			if !overlaps {
+				allowedIPs = append(allowedIPs, site)
+			}
+		}
+	}
+
+	return allowedIPs
+}
+
+// adjustSiteAllowedIPs keeps a site-to-site client off the full tunnel after its LANs, its
+// AllowedIPs or its fulltunnel setting changed: a full tunnel is replaced with siteAllowedIPs,
+// unless the client confirmed it with 'set-client fulltunnel=true'. AllowedIPs set explicitly in
+// the same command aren't replaced but refused. Clients without an allowedips override get their
+// defaults again, see defaultsForClient, so that they follow the LANs of the other sites.
+//
+// Parameters:
+//     index (int): The zero-based index of the client.
+//     explicit (bool): Whether the AllowedIPs of the client were just set explicitly.
+//
+// Returns:
+//     error: A validation error if explicit AllowedIPs make a site-to-site client a full tunnel.
+//
+// Usage:
+//     err := config.adjustSiteAllowedIPs(index, false)
+func (config *appConfig) adjustSiteAllowedIPs(index int, explicit bool) error {
+	client := &config.Clients[index]
+	info := config.clientInfo(index)
+	sites := config.clientSites(index)
+	if len(sites) == 0 || info.FullTunnelSite || len(client.Peers) == 0 || !routesEverything(client.Peers[0].AllowedIPs) {
+		if !explicit && !info.hasOverride("allowedips") {
+			config.defaultsForClient(index).applyFieldTo(client, "allowedips")
+			config.ensureServerAddressAllowed(client)
+		}
+		return nil
+	}
+	if explicit {
+		return newError(errValidation, "client %d has %s behind it, a full tunnel would send the whole WAN traffic "+
+			"of the site through the server; add fulltunnel=true to combine both", index+1, joinIPNets(sites))
+	}
+
+	config.defaultsForClient(index).applyFieldTo(client, "allowedips")
+	config.ensureServerAddressAllowed(client)
+	fmt.Printf("Client %d has %s behind it, its AllowedIPs are now %s instead of a full tunnel ('fulltunnel=true' "+
+		"keeps the full tunnel).\n", index+1, joinIPNets(sites), clientFieldValue(*client, "allowedips"))
+	return nil
+}
+
+// siteFullTunnelWarnings warns about the site-to-site clients that route everything into the tunnel
+// without having confirmed it with 'set-client fulltunnel=true', e.g. adopted routers: the WAN
+// traffic of their whole site goes through the server, which is rarely intended and slows it down.
+func (config *appConfig) siteFullTunnelWarnings() []string {
+	var warnings []string
+	for i, client := range config.Clients {
+		sites := config.clientSites(i)
+		if len(sites) == 0 || config.clientInfo(i).FullTunnelSite || len(client.Peers) == 0 ||
+			!routesEverything(client.Peers[0].AllowedIPs) {
+			continue
+		}
+		var allowedIPs []string
+		for _, network := range config.siteAllowedIPs(i) {
+			allowedIPs = append(allowedIPs, network.String())
+		}
+		warnings = append(warnings, fmt.Sprintf("client %d has %s behind it but a full tunnel (AllowedIPs %s), the "+
+			"whole WAN traffic of the site goes through the server: run 'set-client %d allowedips=%s', or "+
+			"'set-client %d fulltunnel=true' if intended", i+1, joinIPNets(sites), clientFieldValue(client, "allowedips"),
+			i+1, strings.Join(allowedIPs, ","), i+1))
+	}
+
+	return warnings
+}
+
+// routeConflicts returns the networks the server peers of several clients claim, e.g. two
+// site-to-site clients with the same LAN behind them, or a LAN covering the address of another
+// client. Wireguard routes each address to a single peer, so the other client loses the traffic.
+//
+// Returns:
+//     []routeConflict: A conflict per pair of clients, in client order.
+//
+// Usage:
+//     for _, conflict := range config.routeConflicts() { fmt.Println("Warning:", conflict) }
+func (config *appConfig) routeConflicts() []routeConflict {
+	var conflicts []routeConflict
+	for i := 0; i < len(config.Server.Peers); i++ {
+		for j := i + 1; j < len(config.Server.Peers); j++ {
+			found := false
+			for _, a := range config.Server.Peers[i].AllowedIPs {
+				for _, b := range config.Server.Peers[j].AllowedIPs {
+					if !found && networksOverlap(a, b) {
+						// Report the narrower network, the one both clients claim entirely
+						network := normalizeIPNet(a)
+						onesA, _ := a.Mask.Size()
+						onesB, _ := b.Mask.Size()
+						if onesA < onesB {
+							network = normalizeIPNet(b)
+						}
+						conflicts = append(conflicts, routeConflict{Network: network.String(), Clients: []int{i + 1, j + 1}})
+						found = true
+					}
+				}
+			}
+		}
+	}
+
+	return conflicts
+}
+
+// clientRouteReport analyses the reachability of the client with the given zero-based index from
+// its AllowedIPs and the server peers, without looking at the network: firewall rules on the server
+// and the clients can restrict it further.
+func (config *appConfig) clientRouteReport(index int) clientRoutes {
+	client := config.Clients[index]
+	routes := clientRoutes{
+		Client:      index + 1,
+		Name:        config.clientName(index),
+		Address:     joinIPNets(client.Address),
+		ReachableBy: []int{},
+	}
+	for _, site := range config.clientSites(index) {
+		site = normalizeIPNet(site)
+		routes.Sites = append(routes.Sites, site.String())
+	}
+	routes.FullTunnelSite = len(routes.Sites) > 0 && config.clientInfo(index).FullTunnelSite
+
+	var allowedIPs []net.IPNet
+	if len(client.Peers) > 0 {
+		allowedIPs = collapseAllowedIPs(client.Peers[0].AllowedIPs)
+	}
+	subnet := config.serverSubnet()
+	for _, allowed := range allowedIPs {
+		ones, _ := allowed.Mask.Size()
+		subnetOnes, _ := subnet.Mask.Size()
+		switch {
+		case isDefaultRoute(allowed, false) || isDefaultRoute(allowed, true):
+			routes.Reach = reachInternet
+		case networksOverlap(allowed, subnet) && ones <= subnetOnes:
+			routes.TunnelSubnet = true
+		case networksOverlap(allowed, subnet):
+			// Part of the tunnel subnet, e.g. only the server address
+		default:
+			network := routedNetwork{Network: allowed.String()}
+			for j := range config.Clients {
+				for _, site := range config.clientSites(j) {
+					if j != index && network.Via == 0 && networksOverlap(allowed, site) {
+						network.Via = j + 1
+					}
+				}
+			}
+			routes.Networks = append(routes.Networks, network)
+		}
+	}
+	switch {
+	case routes.Reach != "":
+	case len(routes.Networks) > 0:
+		routes.Reach = reachNetworks
+	case routes.TunnelSubnet:
+		routes.Reach = reachSubnet
+	default:
+		routes.Reach = reachServer
+	}
+
+	// Both clients have to route the address of the other through the tunnel for the replies
+	routedBy := func(routing WireguardConfig, addresses []net.IPNet) bool {
+		for _, address := range addresses {
+			for _, peer := range routing.Peers {
+				for _, allowed := range peer.AllowedIPs {
+					if allowed.Contains(address.IP) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	for j, other := range config.Clients {
+		if j != index && routedBy(other, client.Address) && routedBy(client, other.Address) {
+			routes.ReachableBy = append(routes.ReachableBy, j+1)
+		}
+	}
+
+	return routes
+}
+
+// routeReport analyses which destinations every client reaches through the tunnel and which
+// clients reach it, derived from the configuration alone. See clientRouteReport and routeConflicts.
+//
+// Returns:
+//     routeReport: The reachability of the clients and the conflicting routes.
+//
+// Usage:
+//     report := config.routeReport()
+func (config *appConfig) routeReport() routeReport {
+	report := routeReport{Clients: []clientRoutes{}, Conflicts: config.routeConflicts()}
+	for i := range config.Clients {
+		report.Clients = append(report.Clients, config.clientRouteReport(i))
+	}
+
+	return report
+}
+
+// String returns the report as printed by 'report routes'.
+func (report routeReport) String() string {
+	joinClients := func(clients []int) string {
+		if len(clients) == 0 {
+			return "no other client"
+		}
+		var numbers []string
+		for _, client := range clients {
+			numbers = append(numbers, fmt.Sprint(client))
+		}
+		return "clients " + strings.Join(numbers, ", ")
+	}
+
+	result := ""
+	for _, routes := range report.Clients {
+		result += fmt.Sprintf("Client %d (%s) %s\n", routes.Client, routes.Name, routes.Address)
+		var reaches []string
+		switch {
+		case routes.Reach == reachInternet && routes.FullTunnelSite:
+			reaches = append(reaches, "everything, full tunnel through the server, the WAN traffic of its site included")
+		case routes.Reach == reachInternet && len(routes.Sites) > 0:
+			reaches = append(reaches, "everything, full tunnel through the server, the WAN traffic of its site "+
+				"included, likely unintended (see 'fsck')")
+		case routes.Reach == reachInternet:
+			reaches = append(reaches, "everything, full tunnel through the server")
+		case routes.Reach == reachServer:
+			reaches = append(reaches, "the server only")
+		case routes.TunnelSubnet:
+			reaches = append(reaches, "the tunnel subnet")
+		}
+		for _, network := range routes.Networks {
+			if network.Via != 0 {
+				reaches = append(reaches, fmt.Sprintf("%s behind client %d", network.Network, network.Via))
+			} else {
+				reaches = append(reaches, network.Network+" through the server")
+			}
+		}
+		result += "  Reaches:      " + strings.Join(reaches, "\n                ") + "\n"
+		if len(routes.Sites) > 0 {
+			result += "  Networks:     " + strings.Join(routes.Sites, ", ") + " behind the client\n"
+		}
+		result += "  Reachable by: " + joinClients(routes.ReachableBy) + "\n"
+	}
+
+	if len(report.Conflicts) > 0 {
+		result += "\nConflicts:\n"
+		for _, conflict := range report.Conflicts {
+			result += "  " + conflict.String() + "\n"
+		}
+	}
+
+	return result
+}
+
+// runReportCommand implements the 'report' command, which prints reports derived from the
+// configuration. 'report routes' tells for every client what it reaches through the tunnel, which
+// other clients reach it, and the networks several clients claim:
+//
+//     report routes
+//     -format json report routes
+func runReportCommand(configPath string, args []string) error {
+	if len(args) != 1 || args[0] != "routes" {
+		return newError(errUsage, "usage: report routes")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	if len(config.Server.Address) == 0 {
+		return newError(errValidation, "the server has no tunnel address")
+	}
+
+	report := config.routeReport()
+	printResult(report.String(), report)
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// matchAllowedIPs makes the routing decision of Wireguard for a destination address: the packet is
+// sent to the peer whose AllowedIPs hold the longest prefix containing the address. Wireguard
+// keeps each prefix for a single peer, the last one configured with it, so of two peers listing
+// the same prefix the later one wins. The same table filters incoming packets, a packet from a
+// peer is accepted only if this lookup of its source address yields that peer.
+//
+// Parameters:
+//     peers ([]Peer): The peers of the configuration, in configuration order.
+//     destination (net.IP): The destination address, IPv4 or IPv6.
+//
+// Returns:
+//     int: The zero-based index of the peer, -1 if no AllowedIPs contain the address.
+//     net.IPNet: The matching prefix, normalized, see normalizeIPNet.
+//
+// Usage:
+//     peer, prefix := matchAllowedIPs(client.Peers, net.ParseIP("192.168.50.7"))
+func matchAllowedIPs(peers []Peer, destination net.IP) (int, net.IPNet) {
+	if ip := destination.To4(); ip != nil {
+		destination = ip
+	}
+
+	match, longest, prefix := -1, -1, net.IPNet{}
+	for i, peer := range peers {
+		for _, allowed := range peer.AllowedIPs {
+			network := normalizeIPNet(allowed)
+			ones, _ := network.Mask.Size()
+			if len(network.IP) == len(destination) && network.Contains(destination) && ones >= longest {
+				match, longest, prefix = i, ones, network
+			}
+		}
+	}
+
+	return match, prefix
+}
+
+// routeTest is the result of 'route-test', the simulated path of a packet from a client.
+type routeTest struct {
+	Client      int
+	Destination string
+	// Reached tells whether the packet reaches the destination through the tunnel and its replies
+	// make it back to the client.
+	Reached bool
+	Steps   []string
+}
+
+// String prints the steps numbered, followed by the verdict.
+func (test routeTest) String() string {
+	result := fmt.Sprintf("Packet from client %d to %s:\n", test.Client, test.Destination)
+	for i, step := range test.Steps {
+		result += fmt.Sprintf("  %d. %s\n", i+1, step)
+	}
+	if test.Reached {
+		return result + "Result: reached through the tunnel, and the replies find their way back.\n"
+	}
+
+	return result + "Result: not reached through the tunnel.\n"
+}
+
+// sourceAddress returns the tunnel address of the client in the address family of the destination,
+// nil if the client has none.
+func sourceAddress(client WireguardConfig, destination net.IP) net.IP {
+	for _, address := range client.Address {
+		if (address.IP.To4() == nil) == (destination.To4() == nil) {
+			return address.IP
+		}
+	}
+
+	return nil
+}
+
+// testRoute simulates the path of a packet from a client to a destination with the routing
+// decisions of Wireguard, see matchAllowedIPs: which peer the client sends it to, whether the
+// server accepts it and where the server forwards it, and whether the replies are routed back to
+// the client. The decisions only depend on the configuration, firewalls, IP forwarding and NAT
+// on the server and the devices can still drop the packet.
+//
+// Parameters:
+//     index (int): The zero-based index of the client.
+//     destination (net.IP): The destination address.
+//
+// Returns:
+//     routeTest: The decisions step by step.
+//
+// Usage:
+//     test := config.testRoute(index, net.ParseIP("192.168.50.7"))
+func (config *appConfig) testRoute(index int, destination net.IP) routeTest {
+	client := config.Clients[index]
+	test := routeTest{Client: index + 1, Destination: destination.String()}
+	step := func(format string, args ...interface{}) {
+		test.Steps = append(test.Steps, fmt.Sprintf(format, args...))
+	}
+
+	source := sourceAddress(client, destination)
+	if source == nil {
+		step("Client %d has no tunnel address of the address family of %s, the packet can't use the tunnel.", index+1, destination)
+		return test
+	}
+
+	peer, prefix := matchAllowedIPs(client.Peers, destination)
+	if peer < 0 {
+		step("No AllowedIPs of client %d contain %s, the device sends the packet outside the tunnel, "+
+			"through its regular route.", index+1, destination)
+		return test
+	}
+	serverKey, _ := base64PublicKeyFromPrivate(config.Server.PrivateKey)
+	if client.Peers[peer].PublicKey != serverKey {
+		step("Client %d sends the packet to its peer %d, %s, by its AllowedIPs %s. This peer isn't the server, "+
+			"the rest of the path isn't managed by this configuration.", index+1, peer+1,
+			displayEndpoint(client.Peers[peer].Endpoint), prefix.String())
+		return test
+	}
+	step("Client %d sends the packet to the server, the longest matching prefix of its AllowedIPs is %s, "+
+		"with %s as source address.", index+1, prefix.String(), source)
+
+	// The server accepts the packet only if its source belongs to the client
+	if sender, _ := matchAllowedIPs(config.Server.Peers, source); sender != index {
+		step("The server drops the packet: its source address %s isn't in the AllowedIPs of client %d on the server.",
+			source, index+1)
+		return test
+	}
+	step("The server accepts the packet, %s is in the AllowedIPs of client %d on the server.", source, index+1)
+
+	for _, address := range config.Server.Address {
+		if address.IP.Equal(destination) {
+			step("%s is the tunnel address of the server, the server itself receives the packet.", destination)
+			test.Reached = true
+			return test
+		}
+	}
+
+	target, targetPrefix := matchAllowedIPs(config.Server.Peers, destination)
+	if target < 0 {
+		step("No client on the server claims %s, the server forwards the packet out of the tunnel through its "+
+			"own route; this needs IP forwarding, and NAT unless the network routes %s back to the server.",
+			destination, source)
+		step("The replies to %s reach the server, which sends them to client %d: its AllowedIPs on the server "+
+			"contain the address.", source, index+1)
+		test.Reached = true
+		return test
+	}
+	if target == index || target >= len(config.Clients) {
+		step("The server routes %s to its peer %d, by its AllowedIPs %s, which isn't another client.",
+			destination, target+1, targetPrefix.String())
+		return test
+	}
+	step("The server forwards the packet to client %d (%s), the longest matching prefix of the server peers is %s.",
+		target+1, config.clientName(target), targetPrefix.String())
+
+	// The receiving client filters the source and has to route its replies to the server
+	receiver := config.Clients[target]
+	back, backPrefix := matchAllowedIPs(receiver.Peers, source)
+	if back < 0 || receiver.Peers[back].PublicKey != serverKey {
+		step("Client %d drops the packet and can't reply: %s isn't in the AllowedIPs of its server peer. "+
+			"Add %s, or the tunnel subnet, to the AllowedIPs of client %d.", target+1, source, source, target+1)
+		return test
+	}
+	step("Client %d accepts the packet and routes its replies to %s back to the server by its AllowedIPs %s, "+
+		"which forwards them to client %d.", target+1, source, backPrefix.String(), index+1)
+	test.Reached = true
+
+	return test
+}
+
+// runRouteTestCommand implements the 'route-test' command, which explains step by step how a packet
+// from a client to a destination is routed through the tunnel, since AllowedIPs are both the
+// routing table and the filter of incoming packets:
+//
+//     route-test laptop 192.168.50.7
+//     route-test 2 fd00:9::5
+func runRouteTestCommand(configPath string, args []string) error {
+	if len(args) != 2 {
+		return newError(errUsage, "usage: route-test <client> <destination-ip>")
+	}
+	destination := net.ParseIP(strings.TrimSpace(args[1]))
+	if destination == nil {
+		return newError(errValidation, "invalid destination address '%s'", args[1])
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	index, err := config.findClient(args[0])
+	if err != nil {
+		return err
+	}
+
+	test := config.testRoute(index, destination)
+	printResult(test.String(), test)
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMatchAllowedIPs(t *testing.T) {
+	var peers []Peer
+	for _, allowed := range [][]string{
+		{"0.0.0.0/0", "::/0"},
+		{"10.9.0.0/24", "fd00:9::/64"},
+		{"10.9.0.7/32", "192.168.50.0/24", "fd00:9::7/128"},
+		{"192.168.50.128/25", "2001:db8:50::/48"},
+		// Host bits are ignored, as by Wireguard, and the later peer takes the duplicated prefix
+		{"192.168.50.200/25"},
+	} {
+		var peer Peer
+		for _, cidr := range allowed {
+			peer.AllowedIPs = append(peer.AllowedIPs, mustParseCIDR(t, cidr))
+		}
+		peers = append(peers, peer)
+	}
+
+	tests := []struct {
+		destination string
+		wantPeer    int
+		wantPrefix  string
+	}{
+		{"8.8.8.8", 0, "0.0.0.0/0"},
+		{"10.9.0.5", 1, "10.9.0.0/24"},
+		{"10.9.0.7", 2, "10.9.0.7/32"},
+		{"192.168.50.7", 2, "192.168.50.0/24"},
+		{"192.168.50.130", 4, "192.168.50.128/25"},
+		{"::ffff:10.9.0.7", 2, "10.9.0.7/32"},
+		{"2001:4860::8888", 0, "::/0"},
+		{"fd00:9::5", 1, "fd00:9::/64"},
+		{"fd00:9::7", 2, "fd00:9::7/128"},
+		{"2001:db8:50:1::1", 3, "2001:db8:50::/48"},
+	}
+
+	for _, test := range tests {
+		peer, prefix := matchAllowedIPs(peers, net.ParseIP(test.destination))
+		if peer != test.wantPeer || prefix.String() != test.wantPrefix {
+			t.Errorf("matchAllowedIPs(%s) = %d %s, want %d %s", test.destination, peer, prefix.String(),
+				test.wantPeer, test.wantPrefix)
+		}
+	}
+
+	// Without a default route, addresses outside every prefix and the other address family have no peer
+	for _, destination := range []string{"8.8.8.8", "10.10.0.1", "fd00:9::5"} {
+		if peer, _ := matchAllowedIPs(peers[2:3], net.ParseIP(destination)); peer != -1 {
+			t.Errorf("matchAllowedIPs(%s) = %d without a matching prefix", destination, peer)
+		}
+	}
+	if peer, _ := matchAllowedIPs(peers[3:4], net.ParseIP("192.168.50.1")); peer != -1 {
+		t.Errorf("an IPv6 prefix matched an IPv4 address: %d", peer)
+	}
+}
+
+func TestTestRoute(t *testing.T) {
+	tests := []struct {
+		name        string
+		change      func(config *appConfig)
+		client      int
+		destination string
+		wantReached bool
+		wantStep    string
+	}{
+		{"internet", nil, 0, "8.8.8.8", true, "The replies to 10.9.0.2 reach the server"},
+		{"server", nil, 0, "10.9.0.1", true, "the server itself receives the packet"},
+		{"other client", nil, 0, "10.9.0.3", true, "routes its replies to 10.9.0.2 back to the server"},
+		{"site behind a client", func(config *appConfig) {
+			config.Server.Peers[2].AllowedIPs = append(config.Server.Peers[2].AllowedIPs,
+				mustParseCIDR(t, "192.168.50.0/24"))
+		}, 0, "192.168.50.7", true, "routes its replies to 10.9.0.2 back to the server"},
+		{"split tunnel receiver", func(config *appConfig) {
+			config.Clients[1].Peers[0].AllowedIPs = []net.IPNet{mustParseCIDR(t, "10.9.0.1/32")}
+		}, 0, "10.9.0.3", false, "Client 2 drops the packet and can't reply"},
+		{"split tunnel sender", func(config *appConfig) {
+			config.Clients[1].Peers[0].AllowedIPs = []net.IPNet{mustParseCIDR(t, "10.9.0.1/32")}
+		}, 1, "8.8.8.8", false, "the device sends the packet outside the tunnel"},
+		{"source not allowed", func(config *appConfig) {
+			config.Server.Peers[0].AllowedIPs = []net.IPNet{mustParseCIDR(t, "10.9.0.99/32")}
+		}, 0, "8.8.8.8", false, "The server drops the packet"},
+		{"other peer", func(config *appConfig) {
+			config.Clients[0].Peers = append(config.Clients[0].Peers,
+				Peer{PublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", Endpoint: "198.51.100.7:51820",
+					AllowedIPs: []net.IPNet{mustParseCIDR(t, "192.168.60.0/24")}})
+		}, 0, "192.168.60.1", false, "This peer isn't the server"},
+		{"address family", nil, 0, "2001:db8::1", false, "has no tunnel address of the address family"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, _ := newTestProfile(t, 3)
+			if test.change != nil {
+				test.change(&config)
+			}
+			route := config.testRoute(test.client, net.ParseIP(test.destination))
+			last := route.Steps[len(route.Steps)-1]
+			if route.Reached != test.wantReached || !strings.Contains(last, test.wantStep) {
+				t.Errorf("reached %t, want %t:\n%s", route.Reached, test.wantReached, route)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// tunnelNamePattern matches the names Wireguard accepts for a tunnel, which is the server
+// configuration file name without the .conf extension.
+var tunnelNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,15}$`)
+
+// reservedFileNames are device names Windows doesn't allow as file names, with any extension.
+var reservedFileNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// serverConfigFile returns the file name of the server configuration, wiresock.conf or the
+// instance name unless another name was chosen. See artifactName.
+func (config *appConfig) serverConfigFile() string {
+	return config.artifactName(artifactServerConfig)
+}
+
+// tunnelName returns the name of the tunnel service, the server configuration file name without
+// the .conf extension.
+func (config *appConfig) tunnelName() string {
+	return config.artifactName(artifactTunnelService)
+}
+
+// validateServerConfigFileName checks that a server configuration file name is safe to use: a
+// plain file name ending with .conf, whose tunnel name is valid for Wireguard (at most 15 letters,
+// digits or _=+.- characters), that isn't a reserved Windows device name and doesn't collide with
+// the client configuration files.
+//
+// Parameters:
+//     name (string): The file name, e.g. wg0.conf.
+//
+// Returns:
+//     error: A validation error describing why the name can't be used.
+//
+// Usage:
+//     err := validateServerConfigFileName("wg0.conf")
+func validateServerConfigFileName(name string) error {
+	tunnel := strings.TrimSuffix(name, ".conf")
+	switch {
+	case !strings.HasSuffix(name, ".conf"):
+		return newError(errValidation, "invalid server config file name '%s', it must end with .conf", name)
+	case !tunnelNamePattern.MatchString(tunnel) || tunnel == "." || tunnel == "..":
+		return newError(errValidation, "invalid server config file name '%s', expected up to 15 letters, digits or _=+.- before .conf", name)
+	case reservedFileNames[strings.ToLower(strings.Split(tunnel, ".")[0])]:
+		return newError(errValidation, "invalid server config file name '%s', %s is a reserved Windows name", name, tunnel)
+	}
+
+	var index int
+	if n, err := fmt.Sscanf(name, defaultClientConfigFile, &index); n == 1 && err == nil {
+		return newError(errValidation, "invalid server config file name '%s', it is used by the client configurations", name)
+	}
+
+	return nil
+}
+
+// renameServerConfigFile switches the configuration to a new server configuration file name,
+// writing the new file and removing the old one. A foreign file at the new name is never
+// overwritten, renaming is refused while the tunnel service runs under the old name, and the new
+// tunnel name can't be one another profile on this host uses.
+func (config *appConfig) renameServerConfigFile(configPath string, name string) error {
+	if err := validateServerConfigFileName(name); err != nil {
+		return err
+	}
+	if config.ServiceInstalled {
+		return newError(errConflict, "the tunnel service '%s' is installed, stop it with -stop before renaming", config.tunnelName())
+	}
+	if content, err := ioutil.ReadFile(configPath + name); err == nil && !isGeneratedFile(content) {
+		return newError(errConflict, "%s already exists and was not created by wg-quick-config", configPath+name)
+	}
+
+	oldName, chosen := config.serverConfigFile(), config.ServerConfigFile
+	// The name derived from the naming scheme isn't recorded as chosen
+	config.ServerConfigFile = ""
+	if name == config.serverConfigFile() {
+		name = ""
+	}
+	config.ServerConfigFile = name
+	if err := checkArtifactCollisions(configPath, *config); err != nil {
+		config.ServerConfigFile = chosen
+		return err
+	}
+
+	serverFileName, err := config.writeServerConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println(config.savedMessage("server configuration", serverFileName))
+
+	if oldName != config.serverConfigFile() {
+		if err = os.Remove(configPath + oldName); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Warning: failed to remove the old server configuration %s: %s\n", configPath+oldName, err)
+		}
+		delete(config.FileHashes, oldName)
+	}
+
+	return nil
+}
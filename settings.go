@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables mirroring the command line flags, e.g.
+// WGQC_YES for -yes or WGQC_FSCK_REPAIR for 'fsck --repair'.
+const envPrefix = "WGQC_"
+
+// settingSource records where the effective value of a flag came from, for 'config sources'.
+type settingSource struct {
+	Name   string
+	Value  string
+	Source string // "flag", "env" or "default"
+	Env    string
+}
+
+// settingSources lists the flags resolved so far by parseFlags, keyed by environment variable name.
+var settingSources = map[string]settingSource{}
+
+// flagEnvName returns the environment variable mirroring a flag. Flags of a subcommand include the
+// command name, so that e.g. 'apply-defaults --all' is WGQC_APPLY_DEFAULTS_ALL.
+func flagEnvName(command string, name string) string {
+	if command != "" {
+		name = command + "_" + name
+	}
+
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// parseFlags parses the command line arguments into the flag set and then fills the flags not
+// given on the command line from their WGQC_ environment variables. The precedence is thus
+// flag > environment > default. Environment values are parsed exactly like flag values, e.g.
+// WGQC_YES=true or WGQC_QRCODE=2.
+//
+// Parameters:
+//     flags (*flag.FlagSet): The flag set to parse.
+//     command (string): The subcommand owning the flags, empty for the global and legacy flags.
+//     args ([]string): The command line arguments.
+//
+// Returns:
+//     error: A usage error if an argument or an environment value is invalid.
+//
+// Usage:
+//     if err := parseFlags(flags, "fsck", args); err != nil { ... }
+func parseFlags(flags *flag.FlagSet, command string, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return newError(errUsage, "%w", err)
+	}
+
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		// Single letter aliases such as -q share the variable of their long name
+		if len(f.Name) == 1 || err != nil {
+			return
+		}
+
+		envName := flagEnvName(command, f.Name)
+		if _, resolved := settingSources[envName]; resolved {
+			return
+		}
+
+		source := "default"
+		if given[f.Name] || (f.Name == "quiet" && given["q"]) || (f.Name == "yes" && given["y"]) {
+			source = "flag"
+		} else if value, found := os.LookupEnv(envName); found {
+			if err = flags.Set(f.Name, value); err != nil {
+				err = newError(errUsage, "invalid value '%s' for %s: %w", value, envName, err)
+				return
+			}
+			source = "env"
+		}
+
+		settingSources[envName] = settingSource{Name: f.Name, Value: f.Value.String(), Source: source, Env: envName}
+	})
+
+	return err
+}
+
+// runConfigCommand implements the 'config sources' command, which shows for each effective
+// global and legacy setting its value and whether it came from a flag, the environment or
+// the built-in default.
+func runConfigCommand(configPath string, args []string) error {
+	if len(args) != 1 || args[0] != "sources" {
+		return newError(errUsage, "usage: config sources")
+	}
+
+	// The legacy flags are not parsed when a subcommand runs, resolve them from the environment
+	if err := parseFlags(flag.CommandLine, "", nil); err != nil {
+		return err
+	}
+
+	var sources []settingSource
+	for _, source := range settingSources {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Env < sources[j].Env
+	})
+
+	text := ""
+	for _, source := range sources {
+		text += fmt.Sprintf("%s=%s (%s, %s)\n", source.Name, source.Value, source.Source, source.Env)
+	}
+	printResult(text, sources)
+
+	return nil
+}
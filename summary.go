@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const defaultSummaryTextFile = "setup-summary.txt"
+const defaultSummaryJsonFile = "setup-summary.json"
+
+// serverInfo describes the public facts about the server, as printed by 'server-info'. It never
+// holds private keys.
+type serverInfo struct {
+	Endpoint   string
+	Alternates []string `json:",omitempty"`
+	ListenPort uint16
+	Subnet     string
+	Address    string
+	PublicKey  string
+	MTU        uint16           `json:",omitempty"`
+	PoolStart  string           `json:",omitempty"`
+	PortPolicy string           `json:",omitempty"`
+	Source     string           `json:",omitempty"`
+	Bind       string           `json:",omitempty"`
+	ManagedBy  string           `json:",omitempty"`
+	Relay      string           `json:",omitempty"`
+	Capacity   []subnetCapacity `json:",omitempty"`
+}
+
+// clientEntry describes a client, as printed by 'list'. It never holds private keys.
+type clientEntry struct {
+	Client     int
+	Address    string
+	ConfigFile string
+	PublicKey  string
+	Group      string          `json:",omitempty"`
+	Metadata   []metadataEntry `json:",omitempty"`
+	Drift      string          `json:",omitempty"`
+	Pinned     bool            `json:",omitempty"`
+	Status     string
+	Since      *time.Time `json:",omitempty"`
+	Expires    *time.Time `json:",omitempty"`
+	// Connection is statusUnknown when the client isn't known to be connected and handshakes
+	// can't be observed, see runListCommand.
+	Connection string `json:",omitempty"`
+}
+
+// followUpStep is a manual or automated step needed to make the server reachable.
+type followUpStep struct {
+	Description string
+	Command     string
+	Done        bool
+}
+
+// setupSummary is the content of the setup summary files written alongside the configurations.
+type setupSummary struct {
+	Server  serverInfo
+	Clients []clientEntry
+	// FileEncryption explains which files are encrypted at rest, empty if none are.
+	FileEncryption string `json:",omitempty"`
+	FollowUp       []followUpStep
+}
+
+// serverInfo collects the public facts about the server from the configuration.
+func (config *appConfig) serverInfo() serverInfo {
+	info := serverInfo{
+		ListenPort: config.Server.ListenPort,
+		Address:    joinIPNets(config.Server.Address),
+		MTU:        config.Server.MTU,
+		PortPolicy: config.PortSelection,
+		Source:     config.EndpointSource,
+		Bind:       config.BindAddress,
+	}
+	info.ManagedBy, _ = config.endpointPolicy()
+	if config.Relay != nil {
+		info.Relay = config.Relay.String()
+	}
+
+	if len(config.Server.Address) > 0 {
+		address := config.Server.Address[0]
+		info.Subnet = (&net.IPNet{IP: address.IP.Mask(address.Mask), Mask: address.Mask}).String()
+		if start := config.allocationStart(); start != nil {
+			info.PoolStart = start.String()
+		}
+		info.Capacity = config.addressCapacity()
+	}
+	if publicKey, err := base64PublicKeyFromPrivate(config.Server.PrivateKey); err == nil {
+		info.PublicKey = publicKey
+	}
+	if len(config.Clients) > 0 && len(config.Clients[0].Peers) > 0 {
+		info.Endpoint = displayEndpoint(config.Clients[0].Peers[0].Endpoint)
+	}
+	// Internationalized host names are shown in their Unicode form, see displayEndpoint
+	for _, endpoint := range config.SecondaryEndpoints {
+		info.Alternates = append(info.Alternates, displayEndpoint(endpoint))
+	}
+
+	return info
+}
+
+// String returns the server information as printed by 'server-info'.
+func (info serverInfo) String() string {
+	result := fmt.Sprintf("Endpoint:   %s\nUDP port:   %d\nSubnet:     %s\nAddress:    %s\nPublic key: %s\n",
+		info.Endpoint, info.ListenPort, info.Subnet, info.Address, info.PublicKey)
+	for _, endpoint := range info.Alternates {
+		result += fmt.Sprintf("Alternate:  %s\n", endpoint)
+	}
+	if info.Source != "" {
+		result += fmt.Sprintf("Source:     %s\n", info.Source)
+	}
+	if info.MTU != 0 {
+		result += fmt.Sprintf("MTU:        %d\n", info.MTU)
+	}
+	if info.PoolStart != "" {
+		result += fmt.Sprintf("Pool start: %s\n", info.PoolStart)
+	}
+	if info.PortPolicy != "" {
+		result += fmt.Sprintf("Port:       %s\n", info.PortPolicy)
+	}
+	if info.Bind != "" {
+		result += fmt.Sprintf("Bound to:   %s\n", info.Bind)
+	}
+	if info.ManagedBy != "" {
+		result += fmt.Sprintf("Managed by: %s\n", info.ManagedBy)
+	}
+	if info.Relay != "" {
+		result += fmt.Sprintf("Relay:      %s\n", info.Relay)
+	}
+	for _, capacity := range info.Capacity {
+		result += fmt.Sprintf("Addresses:  %s\n", capacity.String())
+	}
+
+	return result
+}
+
+// clientEntries lists the clients of the configuration. The public keys are taken from the
+// matching server peers.
+func (config *appConfig) clientEntries() []clientEntry {
+	entries := make([]clientEntry, 0, len(config.Clients))
+
+	for i, client := range config.Clients {
+		entry := clientEntry{
+			Client:     i + 1,
+			Address:    joinIPNets(client.Address),
+			ConfigFile: fmt.Sprintf(defaultClientConfigFile, i+1),
+			Group:      config.clientInfo(i).Group,
+			Metadata:   config.clientInfo(i).Metadata,
+			Pinned:     config.clientInfo(i).Pinned,
+			Expires:    config.clientInfo(i).Expires,
+		}
+		status, transition := config.clientInfo(i).status()
+		entry.Status = status
+		if transition != nil {
+			entry.Since = &transition.Time
+		}
+		if i < len(config.Server.Peers) {
+			entry.PublicKey = config.Server.Peers[i].PublicKey
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// formatClientEntries returns the clients as a table, as printed by 'list'.
+func formatClientEntries(entries []clientEntry) string {
+	result := ""
+	for _, entry := range entries {
+		var metadata []string
+		if entry.Group != "" {
+			metadata = append(metadata, "Group: "+entry.Group)
+		}
+		for _, item := range entry.Metadata {
+			metadata = append(metadata, item.String())
+		}
+		if entry.Pinned {
+			metadata = append(metadata, "Pinned")
+		}
+		if entry.Expires != nil && entry.Expires.After(time.Now()) {
+			metadata = append(metadata, "Expires "+entry.Expires.Local().Format("2006-01-02"))
+		} else if entry.Expires != nil {
+			metadata = append(metadata, "Expired "+entry.Expires.Local().Format("2006-01-02"))
+		}
+		status := "Provisioning: " + entry.Status
+		if entry.Since != nil {
+			status += " " + entry.Since.Local().Format("2006-01-02 15:04")
+		}
+		if entry.Connection != "" {
+			status += ", connection " + entry.Connection
+		}
+		metadata = append(metadata, status)
+		if entry.Drift != "" {
+			metadata = append(metadata, "Drift: file "+entry.Drift)
+		}
+
+		line := fmt.Sprintf("%3d  %-18s  %-16s  %s  %s", entry.Client, entry.Address, entry.ConfigFile,
+			entry.PublicKey, strings.Join(metadata, "; "))
+		result += strings.TrimRight(line, " ") + "\n"
+	}
+
+	return result
+}
+
+// setupSummary collects the summary of the setup from the same data as 'server-info' and 'list',
+// together with the follow-up steps and whether this tool has performed them.
+func (config *appConfig) setupSummary() setupSummary {
+	server := config.serverInfo()
+
+	// The firewall rule covers the same interface the server is bound to
+	localIP := ""
+	if server.Bind != "" {
+		localIP = " localip=" + server.Bind
+	}
+
+	encryption := ""
+	if config.ClientFileEncryption != nil {
+		encryption = fmt.Sprintf("The client config files are encrypted, use 'decrypt' to hand them out. "+
+			"%s is not, WireSock must be able to read it.", config.serverConfigFile())
+	}
+
+	// A start deferred while not elevated is completed by 'finish'
+	startCommand := "wg-quick-config -start"
+	for _, step := range config.PendingSteps {
+		if step.Step == stepStartTunnel {
+			startCommand = "wg-quick-config finish --elevated"
+		}
+	}
+
+	forwarding := fmt.Sprintf("Forward UDP port %d on your router or VPS provider to this machine", server.ListenPort)
+	if config.Relay != nil {
+		forwarding = fmt.Sprintf("Forward UDP port %d on the relay %s to this machine, see 'export relay'",
+			relayPort(config.Relay.Endpoint), displayEndpoint(config.Relay.Endpoint))
+	}
+
+	return setupSummary{
+		Server:         server,
+		Clients:        config.clientEntries(),
+		FileEncryption: encryption,
+		FollowUp: []followUpStep{
+			{
+				Description: forwarding,
+			},
+			{
+				Description: "Allow the incoming Wireguard traffic through the Windows firewall",
+				Command: fmt.Sprintf("netsh advfirewall firewall add rule name=\"%s\" dir=in action=allow protocol=UDP localport=%d%s",
+					config.artifactName(artifactFirewallRule), server.ListenPort, localIP),
+			},
+			{
+				Description: "Install and start the Wireguard tunnel service",
+				Command:     startCommand,
+				Done:        config.ServiceInstalled,
+			},
+		},
+	}
+}
+
+// String returns the setup summary as written into setup-summary.txt.
+func (summary setupSummary) String() string {
+	result := "Server\n\n" + summary.Server.String()
+	result += "\nClients\n\n" + formatClientEntries(summary.Clients)
+	if summary.FileEncryption != "" {
+		result += "\nFile encryption\n\n" + summary.FileEncryption + "\n"
+	}
+	result += "\nFollow-up steps\n\n"
+
+	for i, step := range summary.FollowUp {
+		status := "not run by wg-quick-config"
+		if step.Done {
+			status = "done"
+		}
+		result += fmt.Sprintf("%d. %s (%s)\n", i+1, step.Description, status)
+		if step.Command != "" {
+			result += fmt.Sprintf("   %s\n", step.Command)
+		}
+	}
+
+	return result
+}
+
+// writeSetupSummary writes setup-summary.txt and setup-summary.json into the configuration
+// directory. It is called whenever the configuration is saved, so the summary never gets stale.
+func (config *appConfig) writeSetupSummary(configPath string) error {
+	summary := config.setupSummary()
+
+	if _, err := writeGeneratedFile(configPath+defaultSummaryTextFile, summary.String(), 0666); err != nil {
+		return err
+	}
+
+	jsonSummary, err := json.MarshalIndent(summary, "", " ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(configPath+defaultSummaryJsonFile, jsonSummary, 0666)
+}
+
+// runServerInfoCommand implements the 'server-info' command, which prints the server endpoint,
+// port, subnet and public key.
+func runServerInfoCommand(configPath string, args []string) error {
+	if len(args) != 0 {
+		return newError(errUsage, "usage: server-info")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	info := config.serverInfo()
+	printResult(info.String(), info)
+	return nil
+}
+
+// runListCommand implements the 'list' command, which prints the clients with their address,
+// configuration file, public key, group and metadata, optionally only those of a group:
+//
+//     list
+//     list --group contractors
+//     list --drift
+//     list --status issued
+//
+// --drift marks the clients whose config file no longer holds what this tool last wrote, see
+// 'show --diff' and 'accept-drift'. Every client shows its provisioning status, see recordStatus;
+// the clients whose first handshake is observed on the running tunnel are recorded as connected
+// first. Without wg on this host the others report their connection as unknown, which --status
+// unknown selects.
+func runListCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	group := flags.String("group", "", "Only list the clients of this group")
+	drift := flags.Bool("drift", false, "Mark the clients whose config file was changed since it was generated")
+	statusFilter := flags.String("status", "", "Only list the clients with this status, issued, delivered, connected or unknown")
+	if err := parseFlags(flags, "list", args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return newError(errUsage, "usage: list [--group name] [--drift] [--status issued|delivered|connected|unknown]")
+	}
+	if *statusFilter != "" {
+		var err error
+		if *statusFilter, err = parseStatusFilter(*statusFilter); err != nil {
+			return err
+		}
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	observed := config.refreshConnected(configPath)
+	entries := config.clientEntries()
+	for i := range entries {
+		if !observed && entries[i].Status != statusConnected {
+			entries[i].Connection = statusUnknown
+		}
+		if *drift {
+			entries[i].Drift = config.clientDrift(configPath, i)
+		}
+	}
+	if *group != "" {
+		if config.findGroup(*group) == nil {
+			return newError(errValidation, "group '%s' does not exist, existing groups: %s", *group,
+				strings.Join(config.groupNames(), ", "))
+		}
+		members := make([]clientEntry, 0)
+		for _, index := range config.groupMembers(*group) {
+			members = append(members, entries[index])
+		}
+		entries = members
+	}
+	if *statusFilter != "" {
+		matching := make([]clientEntry, 0)
+		for _, entry := range entries {
+			if entry.Status == *statusFilter || entry.Connection == *statusFilter {
+				matching = append(matching, entry)
+			}
+		}
+		entries = matching
+	}
+	text := formatClientEntries(entries)
+	if len(config.Server.Address) > 0 {
+		for _, capacity := range config.addressCapacity() {
+			text += "Addresses: " + capacity.String() + "\n"
+		}
+	}
+	printResult(text, entries)
+	return nil
+}
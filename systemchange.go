@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kinds of system changes recorded in config.json.
+const (
+	changeTunnelService   = "tunnel-service"
+	changeNetworkCategory = "network-category"
+)
+
+// SystemChange records a modification of the system made by a helper, e.g. installing the tunnel
+// service, so that 'cleanup' can revert exactly what was done. Objects that already existed are
+// recorded as not created by us and are never removed.
+type SystemChange struct {
+	Kind        string    // One of the change kinds, e.g. changeTunnelService
+	Identifier  string    // Name of the changed object, e.g. the tunnel name
+	CreatedByUs bool      // False if the object existed before and is left in place by 'cleanup'
+	Timestamp   time.Time // When the change was made
+	Undo        string    `json:",omitempty"` // PowerShell command reverting the change
+}
+
+// newSystemChange returns a change record with the current time as timestamp.
+func newSystemChange(kind string, identifier string, createdByUs bool, undo string) SystemChange {
+	return SystemChange{
+		Kind:        kind,
+		Identifier:  identifier,
+		CreatedByUs: createdByUs,
+		Timestamp:   time.Now().UTC(),
+		Undo:        undo,
+	}
+}
+
+// String describes the change for the 'cleanup' output.
+func (change SystemChange) String() string {
+	owner := "created by wg-quick-config"
+	if !change.CreatedByUs {
+		owner = "pre-existing"
+	}
+
+	return fmt.Sprintf("%s %s (%s, %s)", change.Kind, change.Identifier, owner,
+		change.Timestamp.Local().Format("2006-01-02 15:04:05"))
+}
+
+// forgetSystemChanges drops the records of the given kinds, once the objects are gone anyway,
+// e.g. after the tunnel service has been uninstalled with -stop.
+func (config *appConfig) forgetSystemChanges(kinds ...string) {
+	remaining := config.SystemChanges[:0]
+	for _, change := range config.SystemChanges {
+		forget := false
+		for _, kind := range kinds {
+			forget = forget || change.Kind == kind
+		}
+		if !forget {
+			remaining = append(remaining, change)
+		}
+	}
+
+	config.SystemChanges = remaining
+}
+
+// revertSystemChanges runs the undo commands of the recorded system changes created by us, newest
+// first, and keeps only the records whose undo command failed. Records of pre-existing objects
+// are dropped without touching the objects. With dryRun nothing is run or changed.
+//
+// The elevation is checked right before the first change needing it (see changeNeedsElevation).
+// Without elevation that change and the older ones are kept, so that they are still reverted in
+// order once elevated.
+//
+// Parameters:
+//     ps (Executor): Runs the undo commands, see NewPowerShell.
+//     dryRun (bool): Only list the changes that would be reverted.
+//
+// Returns:
+//     []SystemChange: The reverted changes.
+//     int: The number of changes kept for an elevated run, 0 if none needed elevation.
+func (config *appConfig) revertSystemChanges(ps Executor, dryRun bool) ([]SystemChange, int) {
+	var kept, reverted []SystemChange
+	deferred, checked := 0, false
+	for i := len(config.SystemChanges) - 1; i >= 0; i-- {
+		change := config.SystemChanges[i]
+		if !dryRun && change.CreatedByUs && change.Undo != "" && changeNeedsElevation[change.Kind] && !checked {
+			checked = true
+			if !isElevated() {
+				deferred = i + 1
+			}
+		}
+
+		switch {
+		case deferred > 0 && change.CreatedByUs:
+			fmt.Println("Needs elevation:", change.String())
+			kept = append([]SystemChange{change}, kept...)
+		case deferred > 0:
+			// Dropping the record of a pre-existing object needs no elevation, but the order is kept
+			kept = append([]SystemChange{change}, kept...)
+		case !change.CreatedByUs || change.Undo == "":
+			fmt.Println("Leaving in place:", change.String())
+		case dryRun:
+			fmt.Println("Would revert:", change.String())
+		default:
+			result := ps.Execute(context.Background(), change.Undo)
+			if result.Err != nil {
+				fmt.Printf("Failed to revert %s:\nStdOut : '%s'\nStdErr: '%s'\nErr: %s\n", change.String(),
+					strings.TrimSpace(result.StdOut), result.StdErr, result.Err)
+				kept = append([]SystemChange{change}, kept...)
+				continue
+			}
+			fmt.Println("Reverted:", change.String())
+			reverted = append(reverted, change)
+			if change.Kind == changeTunnelService {
+				config.ServiceInstalled = false
+			}
+		}
+	}
+
+	if !dryRun {
+		config.SystemChanges = kept
+	}
+	return reverted, deferred
+}
+
+// runCleanupCommand implements the 'cleanup' command, which reverts the recorded system changes
+// in reverse order:
+//
+//     cleanup
+//     cleanup --dry-run
+//
+// Only the changes recorded in this profile are reverted, so cleaning up one instance leaves the
+// tunnels of the others alone, see artifactName. Only the objects created by wg-quick-config are
+// removed, pre-existing ones are left in place and their records dropped. Records whose undo command fails are kept so that 'cleanup' can be retried.
+func runCleanupCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Only list the changes that would be reverted")
+	if err := parseFlags(flags, "cleanup", args); err != nil {
+		return err
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	if len(config.SystemChanges) == 0 {
+		fmt.Println("There are no recorded system changes to revert.")
+		return nil
+	}
+
+	reverted, deferred := config.revertSystemChanges(newExecutor(), *dryRun)
+
+	if *dryRun {
+		return nil
+	}
+
+	if deferred > 0 {
+		if err = config.queuePrivilegedStep(configPath, stepCleanup); err != nil {
+			return err
+		}
+	}
+	if err = config.saveWithHistory(configPath, "cleanup", true); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+	appendAuditLog(configPath, "cleanup", reverted)
+
+	if len(config.SystemChanges) > deferred {
+		return fmt.Errorf("%d system changes couldn't be reverted, run 'cleanup' again to retry", len(config.SystemChanges))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRevertSystemChanges(t *testing.T) {
+	if !isElevated() {
+		t.Skip("reverting the tunnel service needs an elevated process")
+	}
+
+	service := newSystemChange(changeTunnelService, "wiresock", true, `&"wireguard.exe" /uninstalltunnelservice wiresock`)
+	category := newSystemChange(changeNetworkCategory, "wiresock", true,
+		`Set-NetConnectionProfile -InterfaceAlias "wiresock" -NetworkCategory Public`)
+	userService := newSystemChange(changeTunnelService, "home", false, `&"wireguard.exe" /uninstalltunnelservice home`)
+	private := newSystemChange(changeNetworkCategory, "home", true, "")
+
+	tests := []struct {
+		name         string
+		changes      []SystemChange
+		rules        []fakeRule
+		dryRun       bool
+		wantScripts  []string
+		wantReverted []SystemChange
+		wantKept     []SystemChange
+	}{
+		{
+			name:         "newest first",
+			changes:      []SystemChange{service, category},
+			wantScripts:  []string{category.Undo, service.Undo},
+			wantReverted: []SystemChange{category, service},
+		},
+		{
+			name:    "pre-existing objects are left in place",
+			changes: []SystemChange{userService, private, service},
+			// Only the record of the tunnel service created by us is reverted
+			wantScripts:  []string{service.Undo},
+			wantReverted: []SystemChange{service},
+		},
+		{
+			name:        "failed undo is kept for a retry",
+			changes:     []SystemChange{service, category},
+			rules:       []fakeRule{{Match: "/uninstalltunnelservice", Result: Result{Err: errors.New("exit status 1")}}},
+			wantScripts: []string{category.Undo, service.Undo},
+			// The network category was reverted, the service is kept
+			wantReverted: []SystemChange{category},
+			wantKept:     []SystemChange{service},
+		},
+		{
+			name:     "dry run",
+			changes:  []SystemChange{service, category},
+			dryRun:   true,
+			wantKept: []SystemChange{service, category},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := appConfig{SystemChanges: append([]SystemChange(nil), test.changes...), ServiceInstalled: true}
+			ps := &fakeExecutor{Rules: test.rules}
+
+			reverted, deferred := config.revertSystemChanges(ps, test.dryRun)
+			if deferred != 0 {
+				t.Errorf("deferred %d changes in an elevated process", deferred)
+			}
+			if !reflect.DeepEqual(ps.Scripts, test.wantScripts) {
+				t.Errorf("scripts = %q, want %q", ps.Scripts, test.wantScripts)
+			}
+			if !reflect.DeepEqual(reverted, test.wantReverted) {
+				t.Errorf("reverted = %v, want %v", reverted, test.wantReverted)
+			}
+			if config.ServiceInstalled != (len(reverted) == 0 || reverted[len(reverted)-1].Kind != changeTunnelService) {
+				t.Errorf("ServiceInstalled = %v after reverting %v", config.ServiceInstalled, reverted)
+			}
+			if len(config.SystemChanges) != 0 || len(test.wantKept) != 0 {
+				if !reflect.DeepEqual(config.SystemChanges, test.wantKept) {
+					t.Errorf("kept = %v, want %v", config.SystemChanges, test.wantKept)
+				}
+			}
+		})
+	}
+}
+
+func TestForgetSystemChanges(t *testing.T) {
+	service := newSystemChange(changeTunnelService, "wiresock", true, "undo service")
+	category := newSystemChange(changeNetworkCategory, "wiresock", true, "undo category")
+	config := appConfig{SystemChanges: []SystemChange{service, category, service}}
+
+	config.forgetSystemChanges(changeTunnelService)
+	if want := []SystemChange{category}; !reflect.DeepEqual(config.SystemChanges, want) {
+		t.Errorf("SystemChanges = %v, want %v", config.SystemChanges, want)
+	}
+}
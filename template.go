@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// templateData is the data a user-supplied configuration template is executed with. It embeds the
+// configuration, so all of its fields (PrivateKey, ListenPort, Address, DNS, MTU, Peers...) are
+// available, and adds values derived from them.
+type templateData struct {
+	WireguardConfig
+	PublicKey     string // Public key derived from PrivateKey
+	AddressString string // Comma-separated Address list
+	DNSString     string // Comma-separated DNS list
+}
+
+// templateFuncs are the helper functions available to configuration templates in addition to the
+// text/template builtins, mainly to format the address lists of peers.
+var templateFuncs = template.FuncMap{
+	"joinNets": joinIPNets,
+	"joinIPs":  joinIPs,
+}
+
+// joinIPNets formats a list of networks as a comma-separated string.
+func joinIPNets(nets []net.IPNet) string {
+	result := make([]string, 0, len(nets))
+	for _, ipNet := range nets {
+		result = append(result, ipNet.String())
+	}
+
+	return strings.Join(result, ", ")
+}
+
+// joinIPs formats a list of addresses as a comma-separated string.
+func joinIPs(ips []net.IP) string {
+	result := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		result = append(result, ip.String())
+	}
+
+	return strings.Join(result, ", ")
+}
+
+// RenderTemplate renders the configuration through a user-supplied text/template, for
+// organizations with their own configuration layout and comment standards.
+//
+// Parameters:
+//     tmpl (*template.Template): The parsed template, see loadConfigTemplate.
+//
+// Returns:
+//     string: The rendered configuration.
+//     error: An error object indicating any errors that occurred while executing the template.
+//
+// Usage:
+//     text, err := config.Clients[0].RenderTemplate(tmpl)
+func (wc WireguardConfig) RenderTemplate(tmpl *template.Template) (string, error) {
+	data := templateData{
+		WireguardConfig: wc,
+		AddressString:   joinIPNets(wc.Address),
+		DNSString:       wc.DNS.String(),
+	}
+
+	if publicKey, err := base64PublicKeyFromPrivate(wc.PrivateKey); err == nil {
+		data.PublicKey = publicKey
+	}
+
+	var result bytes.Buffer
+	if err := tmpl.Execute(&result, data); err != nil {
+		return "", err
+	}
+
+	return result.String(), nil
+}
+
+// loadConfigTemplate parses the configuration template stored in the given file.
+func loadConfigTemplate(fileName string) (*template.Template, error) {
+	return template.New(filepath.Base(fileName)).Funcs(templateFuncs).ParseFiles(fileName)
+}
+
+// renderConfig renders a configuration for writing into a file, through the configured template
+// if there is one and with the built-in String() otherwise.
+func (config *appConfig) renderConfig(wc WireguardConfig) (string, error) {
+	if config.Template == "" {
+		return wc.String(), nil
+	}
+
+	tmpl, err := loadConfigTemplate(config.Template)
+	if err != nil {
+		return "", fmt.Errorf("failed to load config template: %w", err)
+	}
+
+	return wc.RenderTemplate(tmpl)
+}
+
+// checkRenderedConfig parses the output of a config template strictly before it overwrites the
+// file, so that a template producing an invalid configuration leaves the previous file in place.
+// The built-in format must parse back into the configuration it was rendered from, see
+// checkRoundTrip.
+func (config *appConfig) checkRenderedConfig(fileName string, wc WireguardConfig, content string) error {
+	if config.Template == "" {
+		return checkRoundTrip(fileName, wc, content)
+	}
+
+	if _, _, err := parseWireguardConfigText(content, filepath.Base(fileName), parseStrict); err != nil {
+		return fmt.Errorf("the config template renders an invalid configuration, %s was left unchanged: %w", fileName, err)
+	}
+
+	return nil
+}
+
+// runTemplateCommand implements the 'template' command, which selects the text/template used to
+// render the configuration files, or with --clear goes back to the built-in format:
+//
+//     template C:\templates\corporate.tmpl
+//     template --clear
+//
+// The template is validated against the server configuration before it is stored. Existing
+// files are re-rendered the next time they are written.
+func runTemplateCommand(configPath string, args []string) error {
+	if len(args) != 1 {
+		return newError(errUsage, "usage: template <file> | --clear")
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	if args[0] == "--clear" {
+		config.Template = ""
+	} else {
+		fileName, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+
+		tmpl, err := loadConfigTemplate(fileName)
+		if err != nil {
+			return err
+		}
+		if _, err = config.Server.RenderTemplate(tmpl); err != nil {
+			return newError(errValidation, "template can't render the server configuration: %w", err)
+		}
+
+		config.Template = fileName
+	}
+
+	if err = config.saveWithHistory(configPath, "template", false); err != nil {
+		return fmt.Errorf("failed to store the application configuration: %w", err)
+	}
+
+	return appendAuditLog(configPath, "template", map[string]string{"Template": config.Template})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// commonLanNetworks are the LAN subnets consumer routers use out of the box. A tunnel subnet
+// overlapping one of them breaks the clients on such networks, see commonLanWarnings. Add a row
+// for other widespread defaults.
+var commonLanNetworks = []struct {
+	network net.IPNet
+	gear    string
+}{
+	{net.IPNet{IP: net.IPv4(192, 168, 0, 0).To4(), Mask: net.CIDRMask(24, 32)}, "many home routers, e.g. TP-Link, D-Link and Netgear"},
+	{net.IPNet{IP: net.IPv4(192, 168, 1, 0).To4(), Mask: net.CIDRMask(24, 32)}, "most home routers, e.g. Linksys, ASUS and ISP boxes"},
+	{net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(24, 32)}, "Apple routers and many cable ISP gateways"},
+	{net.IPNet{IP: net.IPv4(192, 168, 178, 0).To4(), Mask: net.CIDRMask(24, 32)}, "AVM FRITZ!Box routers"},
+}
+
+// alternateWireguardSubnet is suggested instead of defaultWireguardSubnet when the latter collides
+// with the network of a client, see suggestedSubnet.
+const alternateWireguardSubnet = "10.147.19.0/24"
+
+// suggestedSubnet returns a tunnel subnet that overlaps neither the given network nor the common
+// LAN subnets.
+func suggestedSubnet(avoid net.IPNet) string {
+	_, subnet, _ := net.ParseCIDR(defaultWireguardSubnet)
+	if networksOverlap(*subnet, avoid) {
+		return alternateWireguardSubnet
+	}
+
+	return defaultWireguardSubnet
+}
+
+// commonLanWarnings warns when the tunnel subnet overlaps a LAN subnet that is extremely common on
+// consumer gear: clients connecting from such a network can't tell their local hosts from the
+// tunnel. It is a heuristic, the LAN of each client isn't known.
+//
+// Parameters:
+//     subnet (net.IPNet): The tunnel subnet.
+//
+// Returns:
+//     []string: A warning per overlapping common LAN subnet, recommending a less common subnet.
+//
+// Usage:
+//     for _, warning := range commonLanWarnings(*subnet) { fmt.Println("Warning:", warning) }
+func commonLanWarnings(subnet net.IPNet) []string {
+	var warnings []string
+	for _, lan := range commonLanNetworks {
+		if networksOverlap(subnet, lan.network) {
+			warnings = append(warnings, fmt.Sprintf("the tunnel subnet %s overlaps %s, the LAN of %s: clients on such "+
+				"a network lose either their local devices or the tunnel, prefer a less common subnet such as %s",
+				subnet.String(), lan.network.String(), lan.gear, suggestedSubnet(subnet)))
+		}
+	}
+
+	return warnings
+}
+
+// lanCollisions checks the LAN subnet a client device reports against its tunnel: the tunnel
+// subnet, the AllowedIPs and the DNS servers of the client.
+//
+// Parameters:
+//     index (int): The zero-based index of the client.
+//     lan (net.IPNet): The LAN subnet the device is connected to.
+//
+// Returns:
+//     []string: A finding with targeted advice per collision, empty if there is none.
+//
+// Usage:
+//     findings := config.lanCollisions(1, lan)
+func (config *appConfig) lanCollisions(index int, lan net.IPNet) []string {
+	var findings []string
+	client := config.Clients[index]
+	subnet := config.serverSubnet()
+
+	if networksOverlap(lan, subnet) {
+		findings = append(findings, fmt.Sprintf("the LAN %s overlaps the tunnel subnet %s, so the device can't tell "+
+			"local hosts from tunnel addresses and its tunnel address %s may even be taken locally: renumber the LAN, "+
+			"or provision the server on a less common subnet such as %s", lan.String(), subnet.String(),
+			joinIPNets(client.Address), suggestedSubnet(lan)))
+	}
+
+	if len(client.Peers) > 0 {
+		subnetOnes, _ := subnet.Mask.Size()
+		for _, allowed := range client.Peers[0].AllowedIPs {
+			ones, _ := allowed.Mask.Size()
+			switch {
+			case !networksOverlap(allowed, lan):
+			case subnet.Contains(allowed.IP) && ones >= subnetOnes:
+				// Within the tunnel subnet, reported above
+			case isDefaultRoute(allowed, false):
+				findings = append(findings, fmt.Sprintf("the full tunnel (AllowedIPs %s) also covers the LAN %s: local "+
+					"devices such as printers may be unreachable while the tunnel is up, e.g. with the kill switch of "+
+					"the official client; with WireSock add 'DisallowedIPs = %s' to keep the LAN local",
+					allowed.String(), lan.String(), lan.String()))
+			default:
+				findings = append(findings, fmt.Sprintf("AllowedIPs %s overlaps the LAN %s, so traffic to local "+
+					"devices is sent into the tunnel: remove it with 'set-client %d allowedips=...' or renumber the LAN",
+					allowed.String(), lan.String(), index+1))
+			}
+		}
+	}
+
+	for _, dns := range client.DNS.servers() {
+		if !lan.Contains(dns) {
+			continue
+		}
+		routed := false
+		for _, peer := range client.Peers {
+			for _, allowed := range peer.AllowedIPs {
+				routed = routed || allowed.Contains(dns)
+			}
+		}
+		if routed {
+			findings = append(findings, fmt.Sprintf("the DNS server %s is in the LAN %s but routed through the tunnel, "+
+				"where the local resolver isn't reachable: use the server tunnel address %s or a public resolver with "+
+				"'set-client %d dns=...'", dns.String(), lan.String(), config.Server.Address[0].IP.String(), index+1))
+		}
+	}
+
+	return findings
+}
+
+// lanTroubleshooting is the result of 'troubleshoot client' for -format json.
+type lanTroubleshooting struct {
+	Client   int
+	LAN      string
+	Findings []string
+}
+
+// runTroubleshootCommand implements the 'troubleshoot' command, which diagnoses a client that
+// can't connect or loses its local network, given the LAN subnet the device reports:
+//
+//     troubleshoot client laptop --lan 192.168.1.0/24
+//
+// The LAN is asked for if it isn't given. Collisions with the tunnel subnet, the AllowedIPs and
+// the DNS servers of the client are printed with targeted advice, see lanCollisions.
+func runTroubleshootCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: troubleshoot client <client> [--lan cidr]")
+	if len(args) < 2 || args[0] != "client" || strings.HasPrefix(args[1], "-") {
+		return usage
+	}
+
+	flags := flag.NewFlagSet("troubleshoot", flag.ContinueOnError)
+	lanInput := flags.String("lan", "", "LAN subnet the device is connected to, e.g. 192.168.1.0/24")
+	if err := parseFlags(flags, "troubleshoot", args[2:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return usage
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+	index, err := config.findClient(args[1])
+	if err != nil {
+		return err
+	}
+	if len(config.Server.Address) == 0 {
+		return newError(errValidation, "the server has no tunnel address")
+	}
+
+	if *lanInput == "" {
+		*lanInput = readInput("Enter the LAN subnet of the device, e.g. 192.168.1.0/24 (see ipconfig or the Wi-Fi details):")
+	}
+	_, lan, err := net.ParseCIDR(strings.TrimSpace(*lanInput))
+	if err != nil {
+		return newError(errValidation, "invalid LAN subnet '%s', expected e.g. 192.168.1.0/24", *lanInput)
+	}
+
+	result := lanTroubleshooting{Client: index + 1, LAN: lan.String(), Findings: []string{}}
+	result.Findings = append(result.Findings, config.lanCollisions(index, *lan)...)
+	text := fmt.Sprintf("No collision between the LAN %s and the tunnel of client %d.\n", lan.String(), index+1)
+	if len(result.Findings) > 0 {
+		text = fmt.Sprintf("The LAN %s collides with the tunnel of client %d:\n", lan.String(), index+1)
+		for _, finding := range result.Findings {
+			text += "  - " + finding + "\n"
+		}
+	}
+	printResult(text, result)
+
+	if len(result.Findings) > 0 {
+		return newError(errConflict, "%d collisions found", len(result.Findings))
+	}
+	return nil
+}
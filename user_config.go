@@ -1,15 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"log"
 	"net"
-	"os"
 	"strconv"
 	"strings"
-
-	externalip "github.com/glendc/go-external-ip"
 )
 
 // configureWireguardSubnet asks the user to input a Wireguard IPv4 subnet through the console and
@@ -22,30 +17,60 @@ import (
 //
 // The function then tries to parse the user's input (or the default subnet) into the net.IP and
 // net.IPNet types that can be used with the rest of the net package's IP networking functions.
+// The server gets the first address of the subnet. If the input has host bits set, e.g.
+// 10.9.0.5/24, the user is told that the network is 10.9.0.0/24 and may use the entered address
+// as the server address instead. A subnet overlapping a LAN range common on consumer routers is
+// warned about, see commonLanWarnings, and one overlapping another Wireguard interface of this host
+// is only used after confirmation, see findSubnetOverlaps.
 //
 // Returns:
-//     net.IP: The IP address part of the inputted subnet.
+//     net.IP: The server address within the subnet.
 //     net.IPNet: The network and mask part of the inputted subnet.
 //     error: An error object indicating any errors that occurred during parsing.
 //
 // Usage:
-//     ip, subnet, err := configureWireguardSubnet()
+//     serverIP, subnet, err := configureWireguardSubnet()
 func configureWireguardSubnet() (net.IP, *net.IPNet, error) {
 	fmt.Println("\nConfigure the Wireguard IPv4 subnet:")
 	fmt.Println("\t1. You can use any IPv4 subnet if it does not conflict with local addresses.")
 	fmt.Println("\t2. It is recommended to use private IPv4 subnet, e.g 10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16.")
-	fmt.Printf("Enter the Wireguard IPv4 subnet or press Enter to use the suggested one [%s]:",
-		defaultWireguardSubnet)
-
-	reader := bufio.NewReader(os.Stdin)
-	input, _ := reader.ReadString('\n')
-	input = strings.TrimSpace(input)
+	input := readInput(fmt.Sprintf("Enter the Wireguard IPv4 subnet or press Enter to use the suggested one [%s]:",
+		defaultWireguardSubnet))
 
 	if input == "" {
-		return net.ParseCIDR(defaultWireguardSubnet)
+		input = defaultWireguardSubnet
+	}
+
+	ip, subnet, err := net.ParseCIDR(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Clients on a home network using the same range lose their local devices or the tunnel
+	for _, warning := range commonLanWarnings(*subnet) {
+		fmt.Println("Warning:", warning)
+	}
+
+	// Another tunnel on an overlapping subnet breaks the routes of both
+	if overlaps := findSubnetOverlaps(detectWireguardInterfaces(newExecutor()), *subnet, ""); len(overlaps) > 0 {
+		for _, overlap := range overlaps {
+			fmt.Println("Warning:", overlap)
+		}
+		if !askConfirmation("Use this subnet anyway?") {
+			return nil, nil, newError(errConflict, "the subnet %s overlaps another Wireguard tunnel", subnet.String())
+		}
+	}
+
+	if !ip.Equal(subnet.IP) {
+		fmt.Printf("%s has host bits set, the Wireguard subnet is %s.\n", input, subnet.String())
+		if err = checkHostAddress("the entered address", ip, *subnet); err != nil {
+			fmt.Printf("Note: %s, the server gets %s.\n", err.Error(), NextIP(subnet.IP).String())
+		} else if askConfirmation(fmt.Sprintf("Use %s as the Wireguard Server address?", ip.String())) {
+			return ip, subnet, nil
+		}
 	}
 
-	return net.ParseCIDR(input)
+	return NextIP(subnet.IP), subnet, nil
 }
 
 // configureWireguardEndpoint asks the user to input a Wireguard server endpoint through the console and
@@ -53,55 +78,193 @@ func configureWireguardSubnet() (net.IP, *net.IPNet, error) {
 // guidance about endpoint configuration and allows the user to either input a custom endpoint or accept the
 // suggested one.
 //
-// This function first gets the external IP using the externalip package and finds an unused UDP port.
+// This function first gets the external IP from the cloud metadata service or the public IP services (see
+// detectExternalIPWithSource) and finds an unused UDP port
+// on the IP family of that address, or on the -bind address, preferring the service range (see selectServerPort), offering instead the port of a Wireguard instance already running
+// on this host, if any.
 // Then it constructs the endpoint string in the format IP:Port and reads user's input from the console.
 // If the user types something, it parses the input to extract the hostname and port and uses them to update
-// the endpoint and serverPort values.
+// the endpoint and serverPort values. Endpoints remote clients can't reach, such as a LAN address, are
+// only accepted after confirmation, otherwise the user is asked again. Without a detected address
+// nothing is suggested: the endpoint has to be entered, and -quiet or -yes, which would accept the
+// suggestion, terminate the program with a usage error.
 //
 // Returns:
 //     string: The final endpoint, in the format of "IP:Port" or "Hostname:Port".
 //     int: The final server port.
+//     string: How the port was selected, shown in the setup summary.
+//     string: Where the address of the endpoint came from, shown in the setup summary.
 //
 // Usage:
-//     endpoint, serverPort := configureWireguardEndpoint()
-func configureWireguardEndpoint() (string, int) {
-	// Create the default consensus,
-	// using the default configuration and no logger.
-	consensus := externalip.DefaultConsensus(nil, nil)
+//     endpoint, serverPort, portSelection, endpointSource := configureWireguardEndpoint()
+func configureWireguardEndpoint() (string, int, string, string) {
 	// Get your IP,
 	// which is never <nil> when err is <nil>.
-	externalIP, err := consensus.ExternalIP()
+	externalIP, detectedSource, err := detectExternalIPWithSource()
 	if err != nil {
-		fmt.Println(externalIP.String()) // print IPv4/IPv6 in string format
+		fmt.Println("Warning: failed to detect the external IP address:", err)
+		externalIP = nil
+	} else {
+		fmt.Printf("External IP address %s, from %s.\n", externalIP.String(), detectedSource)
 	}
+	detectedIP := externalIP
 
-	serverPort, err := GetUnusedUdpPort()
+	// Multi-homed servers have several uplinks, let the user choose which one clients use
+	externalIP = selectExternalAddress(externalAddressCandidates(externalIP), externalIP)
+	if externalIP == nil && (quietMode || assumeYes) {
+		fatal(newError(errUsage, "no external IP address was detected to suggest as the endpoint, run without "+
+			"-quiet and -yes to enter it, or set up the server with 'provision --endpoint host:port'"))
+	}
+
+	// -portrange is validated by main
+	serviceRange, _ := parsePortRange(servicePortRange)
+	serverPort, portSelection, err := selectServerPort(udpListenFamily(externalIP.String()), bindAddress, serviceRange)
 	if err != nil {
-		log.Fatalf("Failed to obtain available UDP port")
+		fatal(newError(errConflict, "Failed to obtain available UDP port: %w", err))
 	}
 
-	endpoint := fmt.Sprintf("%s:%d", externalIP.String(), serverPort)
+	// When reconfiguring a server, the running Wireguard instance holds "our" port
+	for _, listener := range detectWireguardListeners(newExecutor()) {
+		fmt.Printf("\nDetected running Wireguard instance '%s' listening on UDP port %d.\n",
+			listener.Name, listener.Port)
+		if askConfirmation("Reuse this port for the Wireguard Server?") {
+			serverPort = listener.Port
+			portSelection = fmt.Sprintf("reused from the running Wireguard instance '%s'", listener.Name)
+			break
+		}
+	}
 
-	reader := bufio.NewReader(os.Stdin)
+	endpoint := ""
+	if externalIP != nil {
+		endpoint = net.JoinHostPort(externalIP.String(), strconv.Itoa(serverPort))
+	}
 
 	fmt.Println("\nConfigure the Wireguard Server endpoint:")
 	fmt.Println("\t1. You can enter DNS or dynamic DNS host name if you have one configured.")
 	fmt.Println("\t2. Don't forget to map the chosen UDP port on your router or VPS provider.")
-	fmt.Println("\t3. Enter the Wireguard Server endpoint below or just press Enter to use the suggested one.")
-	fmt.Printf("Auto-detected external IP address and UDP port [%s]:", endpoint)
-
-	input, _ := reader.ReadString('\n')
-	input = strings.TrimSpace(input)
-
-	if input != "" {
-		hostString, portString, err := net.SplitHostPort(input)
-		if err == nil {
-			port, err := strconv.Atoi(portString)
-			if err == nil {
-				endpoint = fmt.Sprintf("%s:%s", hostString, portString)
-				serverPort = port
+	if endpoint != "" {
+		fmt.Println("\t3. Enter the Wireguard Server endpoint below or just press Enter to use the suggested one.")
+	} else {
+		fmt.Println("\t3. No external IP address was detected, enter the Wireguard Server endpoint below.")
+	}
+	suggestedEndpoint, suggestedPort, suggestedSelection := endpoint, serverPort, portSelection
+	for {
+		endpoint, serverPort, portSelection = suggestedEndpoint, suggestedPort, suggestedSelection
+		var input string
+		if suggestedEndpoint != "" {
+			input = readInput(fmt.Sprintf("Auto-detected external IP address and UDP port [%s]:", endpoint))
+		} else if input = readInput(fmt.Sprintf("Wireguard Server endpoint, host or host:port [port %d]:", serverPort)); input == "" {
+			fmt.Println("Please enter the endpoint, there is no detected address to suggest.")
+			continue
+		}
+
+		if input != "" {
+			// A pasted endpoint that can't be used is entered again rather than replaced by the suggestion
+			parsed, err := parseEndpoint(input, uint16(serverPort))
+			if err != nil {
+				fmt.Println(err.Error())
+				continue
+			}
+			hostString, portString, _ := net.SplitHostPort(parsed)
+			port, _ := strconv.Atoi(portString)
+			endpoint = parsed
+			if port != serverPort {
+				portSelection = "entered manually"
+			}
+			serverPort = port
+
+			if _, err = CheckUdpPortOnAddress(udpListenFamily(hostString), bindAddress, port); err != nil {
+				if name, found := wireguardPortOwner(newExecutor(), port); found {
+					fmt.Printf("UDP port %d is held by the running Wireguard instance '%s' and will be reused.\n",
+						port, name)
+				} else if owner, found := udpPortOwner(newExecutor(), port); found {
+					fmt.Printf("Warning: UDP port %d is in use by %s.\n", port, owner)
+				} else {
+					fmt.Printf("Warning: UDP port %d is in use by another application.\n", port)
+				}
+			}
+		}
+
+		// Remote clients can't reach e.g. the LAN address of the server, ask again unless confirmed
+		hostString, _, _ := net.SplitHostPort(endpoint)
+		if confirmEndpointReachable(hostString) {
+			endpointSource := "entered manually"
+			if detectedIP != nil && detectedIP.Equal(net.ParseIP(hostString)) {
+				endpointSource = "detected from " + detectedSource
+			} else if input == "" {
+				endpointSource = "local interface address"
 			}
+			return endpoint, serverPort, portSelection, endpointSource
 		}
 	}
-	return endpoint, serverPort
+}
+
+// configureServerConfigFile asks the user for the file name of the server configuration, which
+// also names the tunnel service, e.g. wg0.conf on Linux. Pressing Enter keeps the given default,
+// wiresock.conf or the one of the instance (see artifactName), and the question is repeated until
+// the name is valid (see validateServerConfigFileName).
+func configureServerConfigFile(defaultName string) string {
+	for {
+		input := readInput(fmt.Sprintf("Enter the server configuration file name or press Enter to use the default one [%s]:",
+			defaultName))
+		if input == "" {
+			return defaultName
+		}
+		if err := validateServerConfigFileName(input); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		return input
+	}
+}
+
+// askConfirmation prints the question and reads a yes/no answer from the console. Anything other
+// than "y" or "yes" is treated as a no. With -yes or in quiet mode the answer is always yes.
+//
+// Parameters:
+//     question (string): The question to display, without the trailing answer hint.
+//
+// Returns:
+//     bool: True if the user confirmed.
+//
+// Usage:
+//     if askConfirmation("Apply these changes?") { ... }
+func askConfirmation(question string) bool {
+	if assumeYes || quietMode {
+		return true
+	}
+
+	input := strings.ToLower(readInput(fmt.Sprintf("%s [y/N]:", question)))
+
+	return input == "y" || input == "yes"
+}
+
+// askClientMetadata asks the user to annotate the new client with free-form metadata, such as its
+// location or owner, which is emitted as comments in the configuration files.
+//
+// Returns:
+//     []metadataEntry: The entered annotations, empty if the user skipped the question.
+//
+// Usage:
+//     metadata := askClientMetadata()
+func askClientMetadata() []metadataEntry {
+	fmt.Println("\nDescribe the new client (optional):")
+	fmt.Println("\tEnter Key=Value pairs separated by ';', e.g. Location=NYC; Owner=alice@corp")
+	input := readInput("Client metadata or press Enter to skip:")
+
+	var entries []metadataEntry
+	for _, token := range strings.Split(input, ";") {
+		if strings.TrimSpace(token) == "" {
+			continue
+		}
+
+		entry, err := parseMetadataEntry(token)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validate runs all the sanity checks that make a configuration deployable and returns every
+// problem found rather than just the first, so that the operator sees the full list at once:
+//
+//   - the server and client private keys and the peer public keys are valid, and the server peers
+//     match their clients (see verifyClientKeys);
+//   - no two clients share a private key and no two server peers share a public key;
+//   - the client addresses are unique and inside the server subnet;
+//   - the server endpoint of every client is set, has a valid port and isn't a tunnel address;
+//   - the listen port of the server is set;
+//   - DNS servers inside the tunnel subnet are routed through the tunnel by AllowedIPs;
+//   - the junk packet parameters of the clients are within range;
+//   - no two server peers claim overlapping networks, see routeConflicts.
+//
+// DNS servers outside the tunnel subnet that AllowedIPs don't route are only warned about, see
+// Warnings, since some setups intentionally resolve outside the tunnel.
+//
+// Returns:
+//     []error: The problems found, as validation errors, empty if the configuration is deployable.
+//
+// Usage:
+//     if problems := config.Validate(); len(problems) > 0 { ... }
+func (config *appConfig) Validate() []error {
+	var problems []error
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, newError(errValidation, format, args...))
+	}
+
+	if err := validateBase64Key(config.Server.PrivateKey); err != nil {
+		report("the server private key is invalid")
+	}
+	if config.Server.ListenPort == 0 {
+		report("the server listen port is not set")
+	}
+	if len(config.Server.Address) == 0 {
+		report("the server has no tunnel address")
+		return problems
+	}
+	subnet := net.IPNet{IP: config.Server.Address[0].IP.Mask(config.Server.Address[0].Mask), Mask: config.Server.Address[0].Mask}
+	serverPublicKey, _ := base64PublicKeyFromPrivate(config.Server.PrivateKey)
+
+	if len(config.Server.Peers) != len(config.Clients) {
+		report("the server has %d peers but there are %d clients", len(config.Server.Peers), len(config.Clients))
+	}
+
+	publicKeys := make(map[string]int, len(config.Server.Peers))
+	for i, peer := range config.Server.Peers {
+		if err := validateBase64Key(peer.PublicKey); err != nil {
+			report("server peer %d has an invalid public key", i+1)
+		}
+		if j, found := publicKeys[peer.PublicKey]; found {
+			report("server peers %d and %d share the same public key %s", j+1, i+1, keyFingerprint(peer.PublicKey))
+		}
+		publicKeys[peer.PublicKey] = i
+	}
+
+	privateKeys := make(map[string]int, len(config.Clients))
+	addresses := map[string]int{}
+	for _, address := range config.Server.Address {
+		addresses[address.IP.String()] = -1
+	}
+	for i, client := range config.Clients {
+		if client.PrivateKey != "" {
+			if err := validateBase64Key(client.PrivateKey); err != nil {
+				report("client %d has an invalid private key", i+1)
+			}
+			if j, found := privateKeys[client.PrivateKey]; found {
+				report("clients %d and %d share the same private key", j+1, i+1)
+			}
+			privateKeys[client.PrivateKey] = i
+		}
+
+		for _, address := range client.Address {
+			// A dual-stack server has a subnet per address family
+			inside := subnet.Contains(address.IP)
+			for _, other := range config.serverSubnets() {
+				inside = inside || other.Contains(address.IP)
+			}
+			if !inside {
+				report("client %d address %s is outside of the server subnet %s", i+1, address.IP.String(), subnet.String())
+			}
+			if j, found := addresses[address.IP.String()]; found {
+				if j < 0 {
+					report("client %d uses the server address %s", i+1, address.IP.String())
+				} else {
+					report("clients %d and %d share the address %s", j+1, i+1, address.IP.String())
+				}
+			}
+			addresses[address.IP.String()] = i
+		}
+
+		problems = append(problems, config.validateClientPeer(i, subnet, serverPublicKey)...)
+	}
+
+	for _, conflict := range config.routeConflicts() {
+		report("%s", conflict.String())
+	}
+
+	for _, mismatch := range config.verifyClientKeys() {
+		problems = append(problems, newError(errValidation, "%w", mismatch))
+	}
+
+	return problems
+}
+
+// validateClientPeer checks the server peer of a client: its public key, endpoint, its keepalive
+// behind a relay, and that the DNS servers inside the tunnel subnet are routed through the tunnel.
+func (config *appConfig) validateClientPeer(index int, subnet net.IPNet, serverPublicKey string) []error {
+	var problems []error
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, newError(errValidation, "client %d: "+format, append([]interface{}{index + 1}, args...)...))
+	}
+
+	client := config.Clients[index]
+	if err := validateJunkParameters(client.Jc, client.Jmin, client.Jmax); err != nil {
+		report("%s", err.Error())
+	}
+	if len(client.Peers) == 0 {
+		report("the server peer is missing")
+		return problems
+	}
+	peer := client.Peers[0]
+
+	if serverPublicKey != "" && peer.PublicKey != serverPublicKey {
+		report("the server public key %s doesn't match the server private key", keyFingerprint(peer.PublicKey))
+	}
+
+	host, portString, err := net.SplitHostPort(peer.Endpoint)
+	if peer.Endpoint == "" {
+		report("the server endpoint is not set")
+	} else if err != nil {
+		report("invalid server endpoint '%s'", peer.Endpoint)
+	} else {
+		if port, err := strconv.Atoi(portString); err != nil || port < 1 || port > 65535 {
+			report("invalid port in the server endpoint '%s'", peer.Endpoint)
+		}
+		if ip := net.ParseIP(host); ip != nil && subnet.Contains(ip) {
+			report("the server endpoint %s is a tunnel address, the tunnel can't be established through itself", host)
+		}
+	}
+	if err := config.checkRelayKeepalive(index); err != nil {
+		report("%s", err.Error())
+	}
+
+	for _, dns := range client.DNS.servers() {
+		if !subnet.Contains(dns) {
+			continue
+		}
+		routed := false
+		for _, allowed := range peer.AllowedIPs {
+			if allowed.Contains(dns) {
+				routed = true
+				break
+			}
+		}
+		if !routed {
+			report("DNS server %s is in the tunnel subnet but not routed by AllowedIPs", dns.String())
+		}
+	}
+
+	return problems
+}
+
+// unroutedDnsServers returns the DNS servers of the client that are not covered by the AllowedIPs
+// of any of its peers, so that its DNS queries bypass the tunnel.
+func unroutedDnsServers(client WireguardConfig) []net.IP {
+	var unrouted []net.IP
+
+	for _, dns := range client.DNS.servers() {
+		routed := false
+		for _, peer := range client.Peers {
+			for _, allowed := range peer.AllowedIPs {
+				if allowed.Contains(dns) {
+					routed = true
+				}
+			}
+		}
+		if !routed {
+			unrouted = append(unrouted, dns)
+		}
+	}
+
+	return unrouted
+}
+
+// dnsWarnings reports the DNS servers of the client with the given zero-based index that its
+// AllowedIPs don't route through the tunnel, e.g. DNS = 8.8.8.8 on a client routing only
+// 10.9.0.0/24: its DNS queries leave outside the tunnel, or fail where the local network blocks
+// them. Servers inside the tunnel subnet are left to Validate, which treats them as a problem.
+// Nothing is reported if out-of-tunnel DNS is allowed, see appConfig.AllowOutOfTunnelDns.
+//
+// Parameters:
+//     index (int): The zero-based index of the client.
+//
+// Returns:
+//     []string: A warning per DNS server outside the tunnel, with the two ways to fix it.
+//
+// Usage:
+//     for _, warning := range config.dnsWarnings(1) { fmt.Println("Warning:", warning) }
+func (config *appConfig) dnsWarnings(index int) []string {
+	if config.AllowOutOfTunnelDns || len(config.Server.Address) == 0 {
+		return nil
+	}
+
+	var warnings []string
+	subnet := config.serverSubnet()
+	for _, dns := range unroutedDnsServers(config.Clients[index]) {
+		if subnet.Contains(dns) {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("client %d sends its DNS queries to %s outside the tunnel, since its "+
+			"AllowedIPs don't cover it: add %s/32 to its AllowedIPs or use the server tunnel address %s as resolver "+
+			"('set-server dnscheck=off' silences this)", index+1, dns.String(), dns.String(),
+			config.Server.Address[0].IP.String()))
+	}
+
+	return warnings
+}
+
+// Warnings returns the findings that don't make the configuration undeployable, unlike the
+// problems of Validate, but likely don't work as intended: DNS servers outside the tunnel, see
+// dnsWarnings, site-to-site clients with a full tunnel, see siteFullTunnelWarnings, and expired
+// clients still accepted by the server, see expiryWarnings.
+func (config *appConfig) Warnings() []string {
+	var warnings []string
+	for i := range config.Clients {
+		warnings = append(warnings, config.dnsWarnings(i)...)
+	}
+	warnings = append(warnings, config.siteFullTunnelWarnings()...)
+
+	return append(warnings, config.expiryWarnings(time.Now())...)
+}
+
+// printDnsWarnings prints the DNS warnings of the given clients after their configuration has
+// been assembled.
+func (config *appConfig) printDnsWarnings(indexes ...int) {
+	for _, index := range indexes {
+		for _, warning := range config.dnsWarnings(index) {
+			fmt.Println("Warning:", warning)
+		}
+	}
+}
+
+// validationFailure combines the problems returned by Validate into a single validation error.
+func validationFailure(problems []error) error {
+	lines := make([]string, len(problems))
+	for i, problem := range problems {
+		lines[i] = "\t" + problem.Error()
+	}
+
+	return newError(errValidation, "%d problems found:\n%s", len(problems), strings.Join(lines, "\n"))
+}
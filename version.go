@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+)
+
+// Build metadata, injected at build time with:
+//
+//     go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=2023-06-23"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// stateSchemaVersion is the version of the config.json layout this build reads and writes. It must
+// be incremented, with a matching entry in stateMigrations, whenever the layout changes in a way
+// older builds can't read or newer builds must convert.
+const stateSchemaVersion = 22
+
+// noMigration migrates from a schema version that only lacks optional fields: the files load
+// unchanged and the missing fields keep their zero value, which is the behavior of the builds
+// writing that version. The version is still incremented, since older builds would silently drop
+// the new fields when saving.
+func noMigration(config *appConfig) error { return nil }
+
+// stateMigrations converts a configuration from schema version N to N+1, stateMigrations[N] being
+// applied to configurations loaded with SchemaVersion N. Version 0 is a configuration written
+// before the schema version was introduced. Every version has a fixture in testdata/state.
+var stateMigrations = map[int]func(config *appConfig) error{
+	0: noMigration,
+	// Version 2 added ServerConfigFile, NatInterface, SystemChanges, the client notes, the junk
+	// packet parameters and the PostUp and PostDown commands
+	1: noMigration,
+	// Version 3 added the client groups, Groups and the Group of the clients
+	2: noMigration,
+	// Version 4 added the dynamic DNS settings, DDNS
+	3: noMigration,
+	// Version 5 added the start of the client address pool, AllocationOffset
+	4: noMigration,
+	// Version 6 added how the server port was chosen, PortSelection
+	5: noMigration,
+	// Version 7 added the bind address of the server, BindAddress
+	6: noMigration,
+	// Version 8 added AllowOutOfTunnelDns
+	7: noMigration,
+	// Version 9 added the reachability Role of the clients, empty for mobile clients
+	8: noMigration,
+	// Version 10 added the alternate endpoints, SecondaryEndpoints
+	9: noMigration,
+	// Version 11 added the encryption of the client files, ClientFileEncryption
+	10: noMigration,
+	// Version 12 added Instance and NamingScheme, older profiles keep namingSchemeLegacy
+	11: noMigration,
+	// Version 13 added the privileged steps queued for 'finish', PendingSteps
+	12: noMigration,
+	// Version 14 added the endpoint policy, EndpointManagedBy and DetectedIP
+	13: noMigration,
+	// Version 15 added the Pinned clients
+	14: noMigration,
+	// Version 16 added the Provisioning status of the clients
+	15: noMigration,
+	// Version 17 added when a client took an ExternalKey
+	16: noMigration,
+	// Version 18 added the Relay in front of the server
+	17: noMigration,
+	// Version 19 added the staged operations, Unapplied
+	18: noMigration,
+	// Version 20 added the confirmation of full tunnels of site-to-site clients, FullTunnelSite.
+	// Unconfirmed ones are reported by fsck and doctor, and only changed with set-client.
+	19: noMigration,
+	// Version 21 added where the endpoint address came from, EndpointSource
+	20: noMigration,
+	// Version 22 added the expiry of the clients, Expires, and its default, ExpiryDays
+	21: noMigration,
+}
+
+// errUnsupportedSchema is returned when loading a config.json written by a newer version of the tool.
+var errUnsupportedSchema = errors.New("unsupported config.json schema version")
+
+// migrateAppConfig upgrades a configuration loaded from config.json to the current schema version,
+// refusing configurations written by a newer version of the tool instead of misparsing them.
+func migrateAppConfig(config *appConfig) error {
+	if config.SchemaVersion > stateSchemaVersion {
+		writtenBy := ""
+		if config.WrittenBy != "" {
+			writtenBy = ", written by wg-quick-config " + config.WrittenBy + ","
+		}
+		return fmt.Errorf("%w: config.json uses schema version %d%s but this build of wg-quick-config (%s) "+
+			"only supports up to version %d, please upgrade", errUnsupportedSchema, config.SchemaVersion, writtenBy,
+			version, stateSchemaVersion)
+	}
+
+	for config.SchemaVersion < stateSchemaVersion {
+		migrate, found := stateMigrations[config.SchemaVersion]
+		if !found {
+			return fmt.Errorf("no migration from config.json schema version %d", config.SchemaVersion)
+		}
+		if err := migrate(config); err != nil {
+			return fmt.Errorf("failed to migrate config.json from schema version %d: %w", config.SchemaVersion, err)
+		}
+		config.SchemaVersion++
+	}
+
+	return nil
+}
+
+// versionInfo is the output of the 'version' command.
+type versionInfo struct {
+	Version       string
+	Commit        string
+	BuildDate     string
+	GoVersion     string
+	Platform      string
+	SchemaVersion int
+	// Schema version and tool version of the config.json of the profile, if there is one.
+	StateSchemaVersion int    `json:",omitempty"`
+	StateWrittenBy     string `json:",omitempty"`
+}
+
+// runVersionCommand implements the 'version' command, which prints the build metadata and the
+// config.json schema version, as JSON with -format json. If the profile has a config.json, the
+// schema version it uses and the version of the tool that wrote it are shown as well, read
+// without migrating it.
+func runVersionCommand(configPath string, args []string) error {
+	if len(args) != 0 {
+		return newError(errUsage, "usage: version")
+	}
+
+	info := versionInfo{
+		Version:       version,
+		Commit:        commit,
+		BuildDate:     buildDate,
+		GoVersion:     runtime.Version(),
+		Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+		SchemaVersion: stateSchemaVersion,
+	}
+
+	text := fmt.Sprintf("wg-quick-config %s (commit %s, built %s)\n%s %s\nconfig.json schema version %d\n",
+		info.Version, info.Commit, info.BuildDate, info.GoVersion, info.Platform, info.SchemaVersion)
+
+	var state struct {
+		SchemaVersion int
+		WrittenBy     string
+	}
+	if content, err := ioutil.ReadFile(configPath + defaultAppConfigFile); err == nil && json.Unmarshal(content, &state) == nil {
+		info.StateSchemaVersion, info.StateWrittenBy = state.SchemaVersion, state.WrittenBy
+		if state.WrittenBy == "" {
+			state.WrittenBy = "unknown"
+		}
+		text += fmt.Sprintf("%s: schema version %d, written by wg-quick-config %s\n",
+			configPath+defaultAppConfigFile, state.SchemaVersion, state.WrittenBy)
+	}
+
+	printResult(text, info)
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// schemaFields checks the fields added by each schema version in the fixtures of testdata/state,
+// schema-N.json being the layout of version N with every field known to it set.
+var schemaFields = []struct {
+	version int
+	fields  string
+	check   func(config appConfig) bool
+}{
+	{0, "client metadata, defaults and file hashes", func(config appConfig) bool {
+		return len(config.ClientsInfo) == 2 && len(config.ClientsInfo[0].Metadata) == 1 &&
+			config.ClientsInfo[0].Metadata[0] == metadataEntry{"Owner", "alice"} && config.Defaults != nil &&
+			config.Defaults.PersistentKeepalive == 25 && config.FileHashes["wiresock.conf"] != ""
+	}},
+	{2, "ServerConfigFile, NatInterface, SystemChanges and notes", func(config appConfig) bool {
+		return config.ServerConfigFile == "wg0.conf" && config.NatInterface == "eth0" && len(config.SystemChanges) == 1 &&
+			config.SystemChanges[0].Kind == changeTunnelService && config.SystemChanges[0].CreatedByUs &&
+			len(config.ClientsInfo[1].Notes) == 1
+	}},
+	{3, "Groups", func(config appConfig) bool {
+		return len(config.Groups) == 1 && config.Groups[0].Defaults["dns"] == "10.9.0.1" &&
+			config.ClientsInfo[0].Group == "staff"
+	}},
+	{4, "DDNS", func(config appConfig) bool {
+		return config.DDNS != nil && config.DDNS.Provider == ddnsDuckDns && config.DDNS.LastIP == "203.0.113.10"
+	}},
+	{5, "AllocationOffset", func(config appConfig) bool { return config.AllocationOffset == 10 }},
+	{6, "PortSelection", func(config appConfig) bool { return config.PortSelection != "" }},
+	{7, "BindAddress", func(config appConfig) bool { return config.BindAddress == "203.0.113.10" }},
+	{8, "AllowOutOfTunnelDns", func(config appConfig) bool { return config.AllowOutOfTunnelDns }},
+	{9, "Role", func(config appConfig) bool {
+		return config.role(1) == clientRolePublic && config.role(0) == clientRoleMobile
+	}},
+	{10, "SecondaryEndpoints", func(config appConfig) bool { return len(config.SecondaryEndpoints) == 1 }},
+	{11, "ClientFileEncryption", func(config appConfig) bool {
+		return config.ClientFileEncryption != nil && string(config.ClientFileEncryption.Salt) == "saltsaltsaltsalt"
+	}},
+	{12, "Instance and NamingScheme", func(config appConfig) bool {
+		return config.Instance == "office" && config.NamingScheme == namingSchemeInstance
+	}},
+	{13, "PendingSteps", func(config appConfig) bool {
+		return len(config.PendingSteps) == 1 && config.PendingSteps[0].Step == stepStartTunnel
+	}},
+	{14, "EndpointManagedBy and DetectedIP", func(config appConfig) bool {
+		policy, explicit := config.endpointPolicy()
+		return policy == endpointByDdns && explicit && config.DetectedIP == "203.0.113.10"
+	}},
+	{15, "Pinned", func(config appConfig) bool { return config.ClientsInfo[0].Pinned && !config.ClientsInfo[1].Pinned }},
+	{16, "Provisioning", func(config appConfig) bool {
+		return len(config.ClientsInfo[0].Provisioning) == 1 && config.ClientsInfo[0].Provisioning[0].Status == statusDelivered
+	}},
+	{17, "ExternalKey", func(config appConfig) bool { return config.ClientsInfo[1].ExternalKey != nil }},
+	{18, "Relay", func(config appConfig) bool {
+		return config.Relay != nil && config.Relay.DirectEndpoint == "vpn.example.com:51820"
+	}},
+	{19, "Unapplied", func(config appConfig) bool { return config.staged() && config.Unapplied[0].Operation == "add" }},
+	{20, "FullTunnelSite", func(config appConfig) bool { return config.ClientsInfo[1].FullTunnelSite }},
+	{21, "EndpointSource", func(config appConfig) bool { return config.EndpointSource != "" }},
+}
+
+// readTestdata returns the content of the named file of testdata/dir, e.g. a malformed
+// configuration of testdata/parse.
+func readTestdata(t *testing.T, dir string, name string) string {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join("testdata", dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+// loadFixture loads a config.json fixture of testdata/state through loadAppConfig from a new
+// profile directory.
+func loadFixture(t *testing.T, name string) (appConfig, string, error) {
+	t.Helper()
+	configPath := t.TempDir() + string(os.PathSeparator)
+	if err := ioutil.WriteFile(configPath+defaultAppConfigFile, []byte(readTestdata(t, "state", name)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadAppConfig(configPath)
+	return config, configPath, err
+}
+
+func TestStateMigrations(t *testing.T) {
+	for schema := 0; schema < stateSchemaVersion; schema++ {
+		if stateMigrations[schema] == nil {
+			t.Errorf("no migration from schema version %d", schema)
+		}
+	}
+
+	for schema := 0; schema < stateSchemaVersion; schema++ {
+		t.Run(fmt.Sprintf("schema %d", schema), func(t *testing.T) {
+			config, configPath, err := loadFixture(t, fmt.Sprintf("schema-%d.json", schema))
+			if err != nil {
+				t.Fatalf("loadAppConfig() = %v", err)
+			}
+			if config.SchemaVersion != stateSchemaVersion {
+				t.Errorf("SchemaVersion = %d, want %d", config.SchemaVersion, stateSchemaVersion)
+			}
+			if len(config.Clients) != 2 || len(config.Server.Peers) != 2 || config.Server.ListenPort != 51820 {
+				t.Fatalf("the server and clients weren't loaded: %+v", config.Server)
+			}
+			for _, fields := range schemaFields {
+				if fields.version <= schema && !fields.check(config) {
+					t.Errorf("%s of schema version %d weren't kept", fields.fields, fields.version)
+				}
+			}
+
+			// Saving writes the newest schema, which loads back unchanged
+			if err = config.save(configPath); err != nil {
+				t.Fatal(err)
+			}
+			saved, err := loadAppConfig(configPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := ioutil.ReadFile(configPath + defaultAppConfigFile)
+			if !strings.Contains(string(content), fmt.Sprintf(`"SchemaVersion": %d,`, stateSchemaVersion)) {
+				t.Errorf("config.json wasn't saved with schema version %d", stateSchemaVersion)
+			}
+			for _, fields := range schemaFields {
+				if fields.version <= schema && !fields.check(saved) {
+					t.Errorf("%s of schema version %d were lost when saving", fields.fields, fields.version)
+				}
+			}
+		})
+	}
+}
+
+func TestNewerSchemaRefused(t *testing.T) {
+	config := appConfig{SchemaVersion: stateSchemaVersion + 1, WrittenBy: "9.0.0"}
+
+	err := migrateAppConfig(&config)
+	if !errors.Is(err, errUnsupportedSchema) {
+		t.Fatalf("migrateAppConfig() = %v, want %v", err, errUnsupportedSchema)
+	}
+	for _, want := range []string{fmt.Sprintf("schema version %d", stateSchemaVersion+1), "written by wg-quick-config 9.0.0",
+		"please upgrade"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("migrateAppConfig() = %q, want it to mention %q", err, want)
+		}
+	}
+	if config.SchemaVersion != stateSchemaVersion+1 {
+		t.Errorf("the refused configuration was changed to schema version %d", config.SchemaVersion)
+	}
+}
@@ -9,8 +9,18 @@ type Interface struct {
 	PrivateKey string
 	ListenPort uint16
 	Address    []net.IPNet
-	DNS        []net.IP
+	DNS        dnsList
 	MTU        uint16
+	// Junk packets sent before the handshake by AmneziaWG, see junk.go. Zero disables them.
+	Jc   uint16 `json:",omitempty"`
+	Jmin uint16 `json:",omitempty"`
+	Jmax uint16 `json:",omitempty"`
+	// Commands run by wg-quick after bringing the interface up and down, e.g. NAT rules.
+	PostUp   []string `json:",omitempty"`
+	PostDown []string `json:",omitempty"`
+	// Unknown holds the "Key = Value" lines kept unchanged by lenient parsing, see
+	// parseWireguardConfigText.
+	Unknown []string `json:",omitempty"`
 }
 
 type Peer struct {
@@ -18,11 +28,70 @@ type Peer struct {
 	AllowedIPs          []net.IPNet
 	Endpoint            string
 	PersistentKeepalive uint32
+	Comments            []string `json:",omitempty"`
+	Unknown             []string `json:",omitempty"`
+}
+
+// rangeError reports a numeric setting outside of the range its field can hold, e.g. port 70000,
+// see checkRange. Values are checked as int before they are stored, so that they can never be
+// silently truncated into the uint16 and uint32 fields.
+type rangeError struct {
+	Field string
+	Value int
+	Min   int
+	Max   int
+}
+
+func (e *rangeError) Error() string {
+	return fmt.Sprintf("invalid %s %d, expected a number between %d and %d", e.Field, e.Value, e.Min, e.Max)
+}
+
+// checkRange returns a validation error wrapping a rangeError if the value is outside of min..max.
+func checkRange(field string, value int, min int, max int) error {
+	if value < min || value > max {
+		return newError(errValidation, "%w", &rangeError{Field: field, Value: value, Min: min, Max: max})
+	}
+
+	return nil
+}
+
+// SetListenPort sets the UDP port the interface listens on, 1 to 65535. Every input path sets the
+// port through here.
+func (iface *Interface) SetListenPort(port int) error {
+	if err := checkRange("listen port", port, 1, 65535); err != nil {
+		return err
+	}
+
+	iface.ListenPort = uint16(port)
+	return nil
+}
+
+// SetMTU sets the MTU of the interface, minMtu to maxMtu, or 0 for the Wireguard default.
+func (iface *Interface) SetMTU(mtu int) error {
+	if mtu != 0 {
+		if err := checkRange("MTU", mtu, minMtu, maxMtu); err != nil {
+			return err
+		}
+	}
+
+	iface.MTU = uint16(mtu)
+	return nil
+}
+
+// SetKeepalive sets the persistent keepalive interval of the peer in seconds, 0 disables it.
+func (peer *Peer) SetKeepalive(seconds int) error {
+	if err := checkRange("persistent keepalive", seconds, 0, maxPersistentKeepalive); err != nil {
+		return err
+	}
+
+	peer.PersistentKeepalive = uint32(seconds)
+	return nil
 }
 
 type WireguardConfig struct {
 	Interface
-	Peers []Peer
+	Peers    []Peer
+	Comments []string `json:",omitempty"`
 }
 
 // AddPeer is a method on the WireguardConfig type that adds a new peer to the Wireguard configuration.
@@ -89,9 +158,11 @@ func NewWireguardClientConfig(PrivateKey string, Address []net.IPNet, PublicKey
 //
 // The String method does the following:
 // - It loops over the AllowedIPs slice and creates a comma-separated string representation of it.
+// - It emits each of the Comments as a "# " comment line right above the [Peer] section header.
 // - It then creates a string using the PublicKey and the string representation of AllowedIPs.
 // - If the Endpoint of the peer is not an empty string, it appends the Endpoint to the resulting string.
 // - If the PersistentKeepalive of the peer is not 0, it appends the PersistentKeepalive to the resulting string.
+// - It appends the Unknown lines kept by lenient parsing unchanged.
 //
 // The resulting string is in a format that can be directly included in a Wireguard configuration file.
 //
@@ -117,8 +188,13 @@ func (peer Peer) String() string {
 		}
 	}
 
-	result := fmt.Sprintf(
-		"\n[Peer]\nPublicKey = %s\nAllowedIPs = %s\n",
+	result := "\n"
+	for _, comment := range peer.Comments {
+		result += fmt.Sprintf("# %s\n", comment)
+	}
+
+	result += fmt.Sprintf(
+		"[Peer]\nPublicKey = %s\nAllowedIPs = %s\n",
 		peer.PublicKey, allowedString)
 
 	if peer.Endpoint != "" {
@@ -131,6 +207,10 @@ func (peer Peer) String() string {
 		result += fmt.Sprintf("PersistentKeepalive = %d\n", peer.PersistentKeepalive)
 	}
 
+	for _, line := range peer.Unknown {
+		result += line + "\n"
+	}
+
 	return result
 }
 
@@ -139,11 +219,17 @@ func (peer Peer) String() string {
 //
 // The String method does the following:
 // - It loops over the Address slice and creates a comma-separated string representation of it.
-// - It loops over the DNS slice and creates a comma-separated string representation of it.
-// - It creates a string using the PrivateKey, the string representation of Address.
+// - It loops over the DNS slice, resolver addresses and search domains in their order, and creates
+//   a comma-separated string representation of it.
+// - It emits each of the Comments as a "# " comment line at the top of the configuration.
+// - It creates a string using the PrivateKey, the string representation of Address. The PrivateKey
+//   is omitted for clients with an external key, whose owner adds it on the device.
 // - If the ListenPort of the configuration is not 0, it appends the ListenPort to the resulting string.
 // - If the DNS is not an empty string, it appends the DNS to the resulting string.
 // - If the MTU of the configuration is not 0, it appends the MTU to the resulting string.
+// - If junk packets are enabled (Jc is not 0), it appends the Jc, Jmin and Jmax parameters.
+// - It appends a PostUp and PostDown line for each of the PostUp and PostDown commands, followed by
+//   the Unknown lines kept by lenient parsing.
 // - It then loops over the Peers slice and appends the string representation of each peer (generated by calling the String method on the Peer struct) to the resulting string.
 //
 // The resulting string is in a format that can be directly used as a Wireguard configuration file.
@@ -174,17 +260,24 @@ func (wc WireguardConfig) String() string {
 		}
 	}
 
-	for i, address := range wc.DNS {
+	for i, entry := range wc.DNS {
 		if i != (len(wc.DNS) - 1) {
-			dnsString += address.String() + ", "
+			dnsString += entry + ", "
 		} else {
-			dnsString += address.String()
+			dnsString += entry
 		}
 	}
 
-	result := fmt.Sprintf(
-		"[Interface]\nPrivateKey = %s\nAddress = %s\n",
-		wc.PrivateKey, addressString)
+	var result string
+	for _, comment := range wc.Comments {
+		result += fmt.Sprintf("# %s\n", comment)
+	}
+
+	result += "[Interface]\n"
+	if wc.PrivateKey != "" {
+		result += fmt.Sprintf("PrivateKey = %s\n", wc.PrivateKey)
+	}
+	result += fmt.Sprintf("Address = %s\n", addressString)
 
 	if wc.ListenPort != 0 {
 		result += fmt.Sprintf("ListenPort = %d\n", wc.ListenPort)
@@ -198,6 +291,22 @@ func (wc WireguardConfig) String() string {
 		result += fmt.Sprintf("MTU = %d\n", wc.MTU)
 	}
 
+	if wc.Jc != 0 {
+		result += fmt.Sprintf("Jc = %d\nJmin = %d\nJmax = %d\n", wc.Jc, wc.Jmin, wc.Jmax)
+	}
+
+	for _, command := range wc.PostUp {
+		result += fmt.Sprintf("PostUp = %s\n", command)
+	}
+
+	for _, command := range wc.PostDown {
+		result += fmt.Sprintf("PostDown = %s\n", command)
+	}
+
+	for _, line := range wc.Unknown {
+		result += line + "\n"
+	}
+
 	for _, peer := range wc.Peers {
 		result += peer.String()
 	}
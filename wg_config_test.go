@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"testing"
+)
+
+func TestRangeCheckedSetters(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(iface *Interface, peer *Peer) error
+		get     func(iface Interface, peer Peer) int
+		value   int
+		wantErr string
+	}{
+		{"port 0", func(i *Interface, p *Peer) error { return i.SetListenPort(0) },
+			func(i Interface, p Peer) int { return int(i.ListenPort) }, 0,
+			"invalid listen port 0, expected a number between 1 and 65535"},
+		{"port 65535", func(i *Interface, p *Peer) error { return i.SetListenPort(65535) },
+			func(i Interface, p Peer) int { return int(i.ListenPort) }, 65535, ""},
+		{"port 70000", func(i *Interface, p *Peer) error { return i.SetListenPort(70000) },
+			func(i Interface, p Peer) int { return int(i.ListenPort) }, 70000,
+			"invalid listen port 70000, expected a number between 1 and 65535"},
+		{"MTU 0", func(i *Interface, p *Peer) error { return i.SetMTU(0) },
+			func(i Interface, p Peer) int { return int(i.MTU) }, 0, ""},
+		{"MTU 575", func(i *Interface, p *Peer) error { return i.SetMTU(575) },
+			func(i Interface, p Peer) int { return int(i.MTU) }, 575,
+			"invalid MTU 575, expected a number between 576 and 65535"},
+		{"MTU 65536", func(i *Interface, p *Peer) error { return i.SetMTU(65536) },
+			func(i Interface, p Peer) int { return int(i.MTU) }, 65536,
+			"invalid MTU 65536, expected a number between 576 and 65535"},
+		{"keepalive 0", func(i *Interface, p *Peer) error { return p.SetKeepalive(0) },
+			func(i Interface, p Peer) int { return int(p.PersistentKeepalive) }, 0, ""},
+		{"keepalive -1", func(i *Interface, p *Peer) error { return p.SetKeepalive(-1) },
+			func(i Interface, p Peer) int { return int(p.PersistentKeepalive) }, -1,
+			"invalid persistent keepalive -1, expected a number between 0 and 65535"},
+		{"keepalive 999999", func(i *Interface, p *Peer) error { return p.SetKeepalive(999999) },
+			func(i Interface, p Peer) int { return int(p.PersistentKeepalive) }, 999999,
+			"invalid persistent keepalive 999999, expected a number between 0 and 65535"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			iface := Interface{ListenPort: 51820, MTU: 1420}
+			peer := Peer{PersistentKeepalive: 25}
+			err := test.set(&iface, &peer)
+
+			if test.wantErr == "" {
+				if err != nil || test.get(iface, peer) != test.value {
+					t.Errorf("set %d: %v, stored %d", test.value, err, test.get(iface, peer))
+				}
+				return
+			}
+			var outOfRange *rangeError
+			if err == nil || err.Error() != test.wantErr || !errors.As(err, &outOfRange) || exitCode(err) != exitValidation {
+				t.Fatalf("set %d: %v, want the validation error %q", test.value, err, test.wantErr)
+			}
+			// The previous value is kept instead of a truncated one
+			if iface.ListenPort != 51820 || iface.MTU != 1420 || peer.PersistentKeepalive != 25 {
+				t.Errorf("set %d changed the fields: %+v %+v", test.value, iface, peer)
+			}
+		})
+	}
+}
+
+// wantRangeError checks that an input path rejected a value with the rangeError of the setters.
+func wantRangeError(t *testing.T, path string, err error, field string, value int) {
+	t.Helper()
+	var outOfRange *rangeError
+	if !errors.As(err, &outOfRange) || outOfRange.Field != field || outOfRange.Value != value {
+		t.Errorf("%s: %v, want the range error of %s %d", path, err, field, value)
+	}
+	if exitCode(err) != exitValidation {
+		t.Errorf("%s: exit code %d, want %d", path, exitCode(err), exitValidation)
+	}
+}
+
+func TestRangeCheckedInputPaths(t *testing.T) {
+	config, configPath := newTestProfile(t, 2)
+
+	_, _, err := parseWireguardConfigText("[Interface]\nListenPort = 70000\n", "wiresock.conf", parseStrict)
+	wantRangeError(t, "config file", err, "listen port", 70000)
+
+	_, err = parseEndpoint("vpn.example.com:70000", 51820)
+	wantRangeError(t, "endpoint prompt", err, "listen port", 70000)
+
+	_, subnet, _ := net.ParseCIDR("10.10.0.0/24")
+	_, err = NewWireguardMeshConfigs(subnet, []string{"a.example.com:51820", "b.example.com:70000"}, 25)
+	wantRangeError(t, "mesh endpoints", err, "listen port", 70000)
+
+	// -serverkeepalive is parsed like its WGQC_SERVERKEEPALIVE variable
+	envName := flagEnvName("", "serverkeepalive")
+	t.Setenv(envName, "999999")
+	delete(settingSources, envName)
+	t.Cleanup(func() { delete(settingSources, envName) })
+	flags := flag.NewFlagSet("wg-quick-config", flag.ContinueOnError)
+	serverKeepalive := flags.String("serverkeepalive", "", "")
+	if err = parseFlags(flags, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err = parsePersistentKeepalive(*serverKeepalive)
+	wantRangeError(t, "environment", err, "persistent keepalive", 999999)
+
+	var defaults clientDefaults
+	wantRangeError(t, "defaults set", defaults.set("keepalive", "999999"), "persistent keepalive", 999999)
+	wantRangeError(t, "defaults set", defaults.set("mtu", "70000"), "MTU", 70000)
+	wantRangeError(t, "group set", config.findGroup("staff").setGroupDefaults([]string{"keepalive=999999"}),
+		"persistent keepalive", 999999)
+
+	err = runSetClientCommand(configPath, []string{"2", "serverkeepalive=999999"})
+	wantRangeError(t, "set-client", err, "persistent keepalive", 999999)
+	err = runSetServerCommand(configPath, []string{"mtu=70000"})
+	wantRangeError(t, "set-server", err, "MTU", 70000)
+
+	unchanged, err := loadAppConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged.Server.MTU != config.Server.MTU || unchanged.Server.Peers[1].PersistentKeepalive != 0 {
+		t.Errorf("rejected values were stored: MTU %d, keepalive %d", unchanged.Server.MTU,
+			unchanged.Server.Peers[1].PersistentKeepalive)
+	}
+}
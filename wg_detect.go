@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// wireguardListener is a running Wireguard instance and the UDP port it listens on.
+type wireguardListener struct {
+	Name string // Interface or process name
+	Port int
+}
+
+// parseWireguardListeners parses "name<TAB>port" lines, the format of 'wg show all listen-port'
+// and of the PowerShell query used by detectWireguardListeners.
+func parseWireguardListeners(output string) []wireguardListener {
+	var listeners []wireguardListener
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		port, err := strconv.Atoi(fields[1])
+		if err != nil || port <= 0 {
+			continue
+		}
+		listeners = append(listeners, wireguardListener{Name: fields[0], Port: port})
+	}
+
+	return listeners
+}
+
+// detectWireguardListeners returns the Wireguard instances running on this host together with the
+// UDP ports they listen on.
+//
+// The 'wg' tool is queried first on every platform ('wg show all listen-port'). On Windows, where
+// wg.exe may not be on the PATH, the UDP endpoints owned by WireGuard or WireSock processes are also
+// looked up through PowerShell. Detection is best-effort: failures are treated as "nothing running".
+//
+// Returns:
+//     []wireguardListener: The detected instances, without duplicate ports.
+//
+// Usage:
+//     listeners := detectWireguardListeners(NewPowerShell())
+func detectWireguardListeners(ps Executor) []wireguardListener {
+	var listeners []wireguardListener
+
+	if output, err := exec.Command("wg", "show", "all", "listen-port").Output(); err == nil {
+		listeners = append(listeners, parseWireguardListeners(string(output))...)
+	}
+
+	if windowsHost {
+		script := `Get-NetUDPEndpoint | ForEach-Object {
+			$process = Get-Process -Id $_.OwningProcess -ErrorAction SilentlyContinue
+			if ($process.ProcessName -match 'wireguard|wiresock') {
+				"{0}` + "`t" + `{1}" -f $process.ProcessName, $_.LocalPort
+			}
+		}`
+
+		if result := ps.Execute(context.Background(), script); result.Err == nil {
+			listeners = append(listeners, parseWireguardListeners(result.StdOut)...)
+		}
+	}
+
+	unique := listeners[:0]
+	seen := make(map[int]bool)
+	for _, listener := range listeners {
+		if !seen[listener.Port] {
+			seen[listener.Port] = true
+			unique = append(unique, listener)
+		}
+	}
+
+	return unique
+}
+
+// wireguardPortOwner returns the name of the running Wireguard instance listening on the given UDP
+// port, if there is one.
+func wireguardPortOwner(ps Executor, port int) (string, bool) {
+	for _, listener := range detectWireguardListeners(ps) {
+		if listener.Port == port {
+			return listener.Name, true
+		}
+	}
+
+	return "", false
+}
+
+// wireguardImplementation is a Wireguard implementation found on this host, a service or a process.
+type wireguardImplementation struct {
+	Kind    string // "service" or "process"
+	Name    string
+	Running bool
+}
+
+// parseWireguardImplementations parses "kind<TAB>name<TAB>status" lines, the format of the
+// PowerShell query used by detectWireguardImplementations.
+func parseWireguardImplementations(output string) []wireguardImplementation {
+	var implementations []wireguardImplementation
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), "\t")
+		if len(fields) != 3 || (fields[0] != "service" && fields[0] != "process") {
+			continue
+		}
+		implementations = append(implementations, wireguardImplementation{
+			Kind:    fields[0],
+			Name:    fields[1],
+			Running: strings.EqualFold(fields[2], "Running"),
+		})
+	}
+
+	return implementations
+}
+
+// detectWireguardImplementations enumerates the Wireguard implementations installed or running on
+// this host: the WireSock services, the WireGuardTunnel$* and WireGuardManager services of the
+// official client, TunSafe, and wireguard.exe, WireSock and TunSafe processes. Detection is
+// best-effort, on failure nothing is returned.
+//
+// Parameters:
+//     ps (Executor): Runs the service and process enumeration, see NewPowerShell.
+//
+// Returns:
+//     []wireguardImplementation: The services and processes found.
+//
+// Usage:
+//     implementations := detectWireguardImplementations(NewPowerShell())
+func detectWireguardImplementations(ps Executor) []wireguardImplementation {
+	if !windowsHost {
+		return nil
+	}
+
+	script := `Get-Service | Where-Object { $_.Name -match '^WireGuard(Tunnel\$|Manager)|wiresock|tunsafe' } | ForEach-Object {
+			"service` + "`t" + `{0}` + "`t" + `{1}" -f $_.Name, $_.Status
+		}
+		Get-Process -ErrorAction SilentlyContinue | Where-Object { $_.ProcessName -match '^(wireguard|wiresock|tunsafe)' } | ForEach-Object {
+			"process` + "`t" + `{0}` + "`t" + `Running" -f $_.ProcessName
+		}`
+
+	result := ps.Execute(context.Background(), script)
+	if result.Err != nil {
+		return nil
+	}
+	return parseWireguardImplementations(result.StdOut)
+}
+
+// findWireguardConflicts reports the running Wireguard implementations that clash with the tunnel
+// service of this configuration: other tunnels, WireSock and TunSafe, and any Wireguard instance
+// holding the listen port. The tunnel service of this configuration itself is not a conflict.
+// Only running implementations are reported, installed but stopped ones don't clash.
+//
+// Parameters:
+//     implementations ([]wireguardImplementation): The implementations found on this host.
+//     listeners ([]wireguardListener): The running instances and their UDP ports.
+//     tunnelName (string): The name of the tunnel service of this configuration.
+//     listenPort (int): The UDP port the server listens on, 0 if not chosen yet.
+//
+// Returns:
+//     []string: A warning per conflict naming the service or process and how to stop it.
+func findWireguardConflicts(implementations []wireguardImplementation, listeners []wireguardListener,
+	tunnelName string, listenPort int) []string {
+	var warnings []string
+	ownService := "WireGuardTunnel$" + tunnelName
+	ownRunning, officialServices := false, false
+
+	for _, implementation := range implementations {
+		if !implementation.Running {
+			continue
+		}
+
+		lower := strings.ToLower(implementation.Name)
+		if implementation.Kind == "service" && strings.HasPrefix(lower, "wireguard") {
+			officialServices = true
+		}
+
+		switch {
+		case strings.EqualFold(implementation.Name, ownService):
+			ownRunning = true
+		case implementation.Kind == "service" && strings.HasPrefix(lower, "wireguardmanager"):
+			// The manager of the official client doesn't hold any port or adapter
+		case implementation.Kind == "service":
+			warnings = append(warnings, fmt.Sprintf("service '%s' is running and may clash with the tunnel, "+
+				"stop it with: Stop-Service '%s'", implementation.Name, implementation.Name))
+		case lower == "wireguard":
+			// wireguard.exe also runs the tunnel services and the manager, reported above
+		default:
+			warnings = append(warnings, fmt.Sprintf("process '%s' is running and may clash with the tunnel, "+
+				"close it or stop it with: Stop-Process -Name '%s'", implementation.Name, implementation.Name))
+		}
+	}
+
+	// wireguard.exe runs the services of the official client, alone it runs a tunnel by hand
+	if !officialServices {
+		for _, implementation := range implementations {
+			if implementation.Kind == "process" && strings.EqualFold(implementation.Name, "wireguard") {
+				warnings = append(warnings, "wireguard.exe is running a tunnel outside of a tunnel service, "+
+					"deactivate it in the Wireguard client")
+				break
+			}
+		}
+	}
+
+	for _, listener := range listeners {
+		// The port is expected to be held while the tunnel of this configuration runs
+		if listenPort != 0 && listener.Port == listenPort && !ownRunning {
+			warnings = append(warnings, fmt.Sprintf("Wireguard instance '%s' already listens on UDP port %d, "+
+				"stop it or choose another port", listener.Name, listenPort))
+		}
+	}
+
+	return warnings
+}
+
+// wireguardConflicts detects the Wireguard implementations and instances running on this host and
+// reports those clashing with the tunnel service and listen port of the configuration.
+func (config *appConfig) wireguardConflicts(ps Executor) []string {
+	return findWireguardConflicts(detectWireguardImplementations(ps), detectWireguardListeners(ps),
+		config.tunnelName(), int(config.Server.ListenPort))
+}
+
+// wireguardInterface is a Wireguard network interface of this host with the subnets of its
+// addresses.
+type wireguardInterface struct {
+	Name    string
+	Subnets []net.IPNet
+}
+
+// parseWireguardInterfaces parses "name<TAB>address/prefix" lines, the format of the PowerShell
+// query used by detectWireguardInterfaces, into interfaces with the subnets of their addresses.
+func parseWireguardInterfaces(output string) []wireguardInterface {
+	var interfaces []wireguardInterface
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(fields[1])
+		if err != nil {
+			continue
+		}
+
+		if len(interfaces) == 0 || interfaces[len(interfaces)-1].Name != fields[0] {
+			interfaces = append(interfaces, wireguardInterface{Name: fields[0]})
+		}
+		last := &interfaces[len(interfaces)-1]
+		last.Subnets = append(last.Subnets, *subnet)
+	}
+
+	return interfaces
+}
+
+// detectWireguardInterfaces returns the Wireguard network interfaces of this host with their
+// subnets: on Linux the interfaces listed by 'wg show interfaces', on Windows the network adapters
+// of WireGuard, WireSock and Wintun found through PowerShell. Detection is best-effort, failures
+// are treated as "no interfaces".
+//
+// Parameters:
+//     ps (Executor): Runs the adapter query on Windows, see NewPowerShell.
+//
+// Returns:
+//     []wireguardInterface: The interfaces found, with the subnets of their IPv4 and IPv6 addresses.
+//
+// Usage:
+//     interfaces := detectWireguardInterfaces(NewPowerShell())
+func detectWireguardInterfaces(ps Executor) []wireguardInterface {
+	if windowsHost {
+		script := `Get-NetAdapter -IncludeHidden -ErrorAction SilentlyContinue |
+			Where-Object { $_.InterfaceDescription -match 'WireGuard|WireSock|Wintun' } | ForEach-Object {
+				$alias = $_.Name
+				Get-NetIPAddress -InterfaceIndex $_.ifIndex -ErrorAction SilentlyContinue | ForEach-Object {
+					"{0}` + "`t" + `{1}/{2}" -f $alias, $_.IPAddress, $_.PrefixLength
+				}
+			}`
+
+		result := ps.Execute(context.Background(), script)
+		if result.Err != nil {
+			return nil
+		}
+		return parseWireguardInterfaces(result.StdOut)
+	}
+
+	output, err := exec.Command("wg", "show", "interfaces").Output()
+	if err != nil {
+		return nil
+	}
+
+	var interfaces []wireguardInterface
+	for _, name := range strings.Fields(string(output)) {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			continue
+		}
+		addresses, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		wgInterface := wireguardInterface{Name: name}
+		for _, address := range addresses {
+			if ipNet, ok := address.(*net.IPNet); ok {
+				wgInterface.Subnets = append(wgInterface.Subnets, net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask})
+			}
+		}
+		interfaces = append(interfaces, wgInterface)
+	}
+
+	return interfaces
+}
+
+// findSubnetOverlaps reports the Wireguard interfaces whose subnets overlap the given tunnel subnet,
+// since two tunnels on overlapping subnets fight over the routes. The interface of this
+// configuration itself is skipped.
+//
+// Parameters:
+//     interfaces ([]wireguardInterface): The Wireguard interfaces of this host.
+//     subnet (net.IPNet): The tunnel subnet of this configuration.
+//     tunnelName (string): The name of the tunnel of this configuration, empty if not known yet.
+//
+// Returns:
+//     []string: A warning per overlap naming the interface and its subnet.
+func findSubnetOverlaps(interfaces []wireguardInterface, subnet net.IPNet, tunnelName string) []string {
+	var warnings []string
+
+	for _, iface := range interfaces {
+		if tunnelName != "" && strings.EqualFold(iface.Name, tunnelName) {
+			continue
+		}
+		for _, other := range iface.Subnets {
+			if other.Contains(subnet.IP) || subnet.Contains(other.IP) {
+				warnings = append(warnings, fmt.Sprintf("the tunnel subnet %s overlaps the subnet %s of the Wireguard "+
+					"interface '%s', the two tunnels would break each other's routes", subnet.String(), other.String(), iface.Name))
+			}
+		}
+	}
+
+	return warnings
+}
+
+// subnetConflicts detects the Wireguard interfaces of this host and reports those whose subnets
+// overlap the tunnel subnet of the configuration.
+func (config *appConfig) subnetConflicts(ps Executor) []string {
+	if len(config.Server.Address) == 0 {
+		return nil
+	}
+
+	return findSubnetOverlaps(detectWireguardInterfaces(ps), config.serverSubnet(), config.tunnelName())
+}
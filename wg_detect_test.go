@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseWireguardListeners(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []wireguardListener
+	}{
+		{"wg show", "wg0\t51820\nwg1\t51821\n", []wireguardListener{{"wg0", 51820}, {"wg1", 51821}}},
+		{"PowerShell with CRLF", "wireguard\t51820\r\nwiresock-client\t1194\r\n",
+			[]wireguardListener{{"wireguard", 51820}, {"wiresock-client", 1194}}},
+		{"stopped interface", "wg0\t0\nwg1\toff\n", nil},
+		{"garbage", "Get-NetUDPEndpoint : Access denied\n\n", nil},
+	}
+
+	for _, test := range tests {
+		if got := parseWireguardListeners(test.output); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseWireguardListeners() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseWireguardImplementations(t *testing.T) {
+	output := "service\tWireGuardTunnel$office\tRunning\r\n" +
+		"service\twiresock-client-service\tStopped\r\n" +
+		"process\twireguard\tRunning\r\n" +
+		"driver\twintun\tRunning\r\n" +
+		"service\tbroken\n"
+	want := []wireguardImplementation{
+		{"service", "WireGuardTunnel$office", true},
+		{"service", "wiresock-client-service", false},
+		{"process", "wireguard", true},
+	}
+
+	if got := parseWireguardImplementations(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseWireguardImplementations() = %+v, want %+v", got, want)
+	}
+}
+
+func TestDetectWireguardImplementations(t *testing.T) {
+	fakeWindowsHost(t)
+
+	ps := &fakeExecutor{Rules: []fakeRule{{Match: "Get-Service", Result: Result{StdOut: "service\ttunsafe\tRunning\n"}}}}
+	want := []wireguardImplementation{{"service", "tunsafe", true}}
+	if got := detectWireguardImplementations(ps); !reflect.DeepEqual(got, want) {
+		t.Errorf("detectWireguardImplementations() = %+v, want %+v", got, want)
+	}
+	if len(ps.Scripts) != 1 || !strings.Contains(ps.Scripts[0], `$_.Name -match '^WireGuard(Tunnel\$|Manager)|wiresock|tunsafe'`) ||
+		!strings.Contains(ps.Scripts[0], `$_.ProcessName -match '^(wireguard|wiresock|tunsafe)'`) {
+		t.Errorf("scripts = %q, want the service and process enumeration", ps.Scripts)
+	}
+
+	failing := &fakeExecutor{Rules: []fakeRule{{Match: "Get-Service", Result: Result{StdOut: "service\ttunsafe\tRunning\n",
+		Err: errors.New("exit status 1")}}}}
+	if got := detectWireguardImplementations(failing); got != nil {
+		t.Errorf("detectWireguardImplementations() = %+v on failure, want nil", got)
+	}
+}
+
+func TestFindWireguardConflicts(t *testing.T) {
+	tests := []struct {
+		name            string
+		implementations []wireguardImplementation
+		listeners       []wireguardListener
+		want            []string
+	}{
+		{
+			name: "own tunnel running",
+			implementations: []wireguardImplementation{{"service", "WireGuardTunnel$wiresock", true},
+				{"service", "WireGuardManager", true}, {"process", "wireguard", true}},
+			listeners: []wireguardListener{{"wiresock", 51820}},
+		},
+		{
+			name:            "stopped services don't clash",
+			implementations: []wireguardImplementation{{"service", "WireGuardTunnel$home", false}},
+		},
+		{
+			name:            "other tunnel holding the port",
+			implementations: []wireguardImplementation{{"service", "WireGuardTunnel$home", true}},
+			listeners:       []wireguardListener{{"home", 51820}},
+			want: []string{"service 'WireGuardTunnel$home' is running and may clash with the tunnel, stop it with: " +
+				"Stop-Service 'WireGuardTunnel$home'",
+				"Wireguard instance 'home' already listens on UDP port 51820, stop it or choose another port"},
+		},
+		{
+			name:            "wireguard.exe alone",
+			implementations: []wireguardImplementation{{"process", "wireguard", true}, {"process", "tunsafe", true}},
+			want: []string{"process 'tunsafe' is running and may clash with the tunnel, close it or stop it with: " +
+				"Stop-Process -Name 'tunsafe'",
+				"wireguard.exe is running a tunnel outside of a tunnel service, deactivate it in the Wireguard client"},
+		},
+	}
+
+	for _, test := range tests {
+		got := findWireguardConflicts(test.implementations, test.listeners, "wiresock", 51820)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: findWireguardConflicts() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseWireguardInterfaces(t *testing.T) {
+	output := "wiresock\t10.9.0.1/24\r\nwiresock\tfd00:9::1/64\r\nhome\t10.8.0.1/24\r\nhome\tnot-an-address\r\n"
+	got := parseWireguardInterfaces(output)
+	if len(got) != 2 || got[0].Name != "wiresock" || len(got[0].Subnets) != 2 || got[1].Name != "home" ||
+		len(got[1].Subnets) != 1 {
+		t.Fatalf("parseWireguardInterfaces() = %+v", got)
+	}
+	if got[0].Subnets[0].String() != "10.9.0.0/24" || got[0].Subnets[1].String() != "fd00:9::/64" ||
+		got[1].Subnets[0].String() != "10.8.0.0/24" {
+		t.Errorf("parseWireguardInterfaces() subnets = %v %v", got[0].Subnets, got[1].Subnets)
+	}
+}
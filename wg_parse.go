@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// unsupportedConfigKeys are valid wg-quick keys that WireguardConfig can't represent. Parsing a
+// configuration using them fails instead of silently dropping them.
+var unsupportedConfigKeys = map[string]bool{
+	"table": true, "preup": true, "predown": true,
+	"saveconfig": true, "fwmark": true, "presharedkey": true,
+}
+
+// Parse modes of parseWireguardConfigText. Strict parsing rejects anything it can't represent,
+// lenient parsing, for configurations inherited from other tools, keeps unknown keys unchanged and
+// skips malformed optional values with a warning. Round-trip parsing, for the self-check of the
+// generated files, is strict about the known keys but keeps the unknown keys the model carries.
+const (
+	parseStrict = iota
+	parseLenient
+	parseRoundTrip
+)
+
+// requiredConfigKeys are the keys whose malformed values are errors even in lenient mode: without
+// them the configuration doesn't describe a tunnel.
+var requiredConfigKeys = map[string]bool{
+	"privatekey": true, "address": true, "publickey": true, "allowedips": true,
+}
+
+// canonicalConfigKeys maps the lowercase keys to their usual spelling, used in parse errors.
+var canonicalConfigKeys = map[string]string{
+	"privatekey": "PrivateKey", "address": "Address", "listenport": "ListenPort", "dns": "DNS", "mtu": "MTU",
+	"jc": "Jc", "jmin": "Jmin", "jmax": "Jmax", "postup": "PostUp", "postdown": "PostDown",
+	"publickey": "PublicKey", "allowedips": "AllowedIPs", "endpoint": "Endpoint",
+	"persistentkeepalive": "PersistentKeepalive",
+}
+
+// parseError locates a problem in a configuration file, printed e.g. as
+// "wiresock.conf:17 [Peer] AllowedIPs: invalid CIDR '10.9.0.300/32'". File, Section and Key are
+// left out when unknown.
+type parseError struct {
+	File    string
+	Line    int
+	Section string
+	Key     string
+	Err     error
+}
+
+func (e *parseError) Error() string {
+	var location string
+	switch {
+	case e.File != "" && e.Line > 0:
+		location = fmt.Sprintf("%s:%d", e.File, e.Line)
+	case e.File != "":
+		location = e.File
+	case e.Line > 0:
+		location = fmt.Sprintf("line %d", e.Line)
+	}
+	if e.Section != "" {
+		location += " [" + e.Section + "]"
+	}
+	if e.Key != "" {
+		location += " " + e.Key
+	}
+
+	location = strings.TrimSpace(location)
+	if location == "" {
+		return e.Err.Error()
+	}
+	return location + ": " + e.Err.Error()
+}
+
+func (e *parseError) Unwrap() error { return e.Err }
+
+// ParseWireguardConfig parses the text of a Wireguard configuration file strictly, see
+// parseWireguardConfigText.
+//
+// Usage:
+//     wc, err := ParseWireguardConfig(string(content))
+func ParseWireguardConfig(text string) (WireguardConfig, error) {
+	wc, _, err := parseWireguardConfigText(text, "", parseStrict)
+	return wc, err
+}
+
+// readWireguardConfigFile reads and parses a Wireguard configuration file, see
+// parseWireguardConfigText. Errors and warnings are located by the file name as given.
+func readWireguardConfigFile(fileName string, mode int) (WireguardConfig, []string, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return WireguardConfig{}, nil, newError(errValidation, "can't read %s: %w", fileName, err)
+	}
+
+	return parseWireguardConfigText(string(content), fileName, mode)
+}
+
+// parseWireguardConfigText parses the text of a Wireguard configuration file, the reverse of
+// WireguardConfig.String(). The '#' comment lines right above a [Peer] section header are
+// associated with that peer and those above the [Interface] section with the configuration, so
+// that "# text" comments round-trip unchanged. Other comments and the provenance header are ignored.
+//
+// Every problem is reported as a validation error wrapping a parseError with the file name, line
+// number, section and key, e.g. "wiresock.conf:17 [Peer] AllowedIPs: invalid CIDR '10.9.0.300/32'".
+// In strict mode unknown or unsupported keys, lines that aren't Key = Value and invalid values are
+// errors. In lenient mode unknown and unsupported keys are kept unchanged in Interface.Unknown and
+// Peer.Unknown, and such lines and invalid values of optional keys are skipped, all with a warning.
+// Round-trip mode keeps unknown and unsupported keys like lenient mode and fails otherwise.
+// Keys outside of a section, unknown sections, invalid required values (see requiredConfigKeys), a
+// peer without PublicKey and a missing or repeated [Interface] section are errors in both modes.
+//
+// Parameters:
+//     text (string): The content of the configuration file.
+//     file (string): The file name used in errors and warnings, may be empty.
+//     mode (int): parseStrict, parseLenient or parseRoundTrip.
+//
+// Returns:
+//     WireguardConfig: The parsed configuration.
+//     []string: The warnings of lenient mode, one per skipped or kept line.
+//     error: A validation error describing the first problem found.
+//
+// Usage:
+//     wc, warnings, err := parseWireguardConfigText(string(content), "wg0.conf", parseLenient)
+func parseWireguardConfigText(text string, file string, mode int) (WireguardConfig, []string, error) {
+	var wc WireguardConfig
+	var warnings []string
+	var peer *Peer
+	var peerLines []int
+	section := ""
+	interfaces := 0
+	var comments []string
+
+	locate := func(line int, key string, err error) *parseError {
+		name := ""
+		switch section {
+		case "interface":
+			name = "Interface"
+		case "peer":
+			name = "Peer"
+		}
+		return &parseError{File: file, Line: line, Section: name, Key: key, Err: err}
+	}
+	fail := func(line int, key string, format string, args ...interface{}) error {
+		return newError(errValidation, "%w", locate(line, key, fmt.Errorf(format, args...)))
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") && line != strings.TrimSpace(provenanceHeader) {
+			comment := strings.TrimPrefix(line, "#")
+			comments = append(comments, strings.TrimPrefix(comment, " "))
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+				interfaces++
+				if interfaces > 1 {
+					return wc, warnings, fail(number, "", "repeated [Interface] section")
+				}
+				wc.Comments = comments
+			case "peer":
+				wc.Peers = append(wc.Peers, Peer{Comments: comments})
+				peer = &wc.Peers[len(wc.Peers)-1]
+				peerLines = append(peerLines, number)
+			default:
+				section = ""
+				return wc, warnings, fail(number, "", "unknown section %s", line)
+			}
+			comments = nil
+			continue
+		}
+		comments = nil
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			if mode == parseLenient && section != "" {
+				warnings = append(warnings, locate(number, "", fmt.Errorf("skipped '%s', expected Key = Value", line)).Error())
+				continue
+			}
+			return wc, warnings, fail(number, "", "expected Key = Value")
+		}
+		name := strings.TrimSpace(key)
+		key = strings.ToLower(name)
+		value = strings.TrimSpace(value)
+		if canonical, known := canonicalConfigKeys[key]; known {
+			name = canonical
+		}
+		if section == "" {
+			return wc, warnings, fail(number, name, "key outside of a section")
+		}
+
+		var err error
+		switch section {
+		case "interface":
+			err = parseInterfaceKey(&wc.Interface, key, value)
+		case "peer":
+			err = parsePeerKey(peer, key, value)
+		}
+		if unsupportedConfigKeys[key] {
+			err = fmt.Errorf("not supported by wg-quick-config")
+		}
+		if err == nil {
+			continue
+		}
+
+		_, known := canonicalConfigKeys[key]
+		switch {
+		case mode == parseStrict || (known && (mode == parseRoundTrip || requiredConfigKeys[key])):
+			return wc, warnings, newError(errValidation, "%w", locate(number, name, err))
+		case !known:
+			if section == "interface" {
+				wc.Unknown = append(wc.Unknown, name+" = "+value)
+			} else {
+				peer.Unknown = append(peer.Unknown, name+" = "+value)
+			}
+			warnings = append(warnings, locate(number, name, fmt.Errorf("%s, kept unchanged", err.Error())).Error())
+		default:
+			warnings = append(warnings, locate(number, name, fmt.Errorf("%s, skipped", err.Error())).Error())
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return wc, warnings, err
+	}
+	section = ""
+	if interfaces == 0 {
+		return wc, warnings, fail(0, "", "missing [Interface] section")
+	}
+	if err := validateJunkParameters(wc.Jc, wc.Jmin, wc.Jmax); err != nil {
+		section = "interface"
+		return wc, warnings, newError(errValidation, "%w", locate(0, "", err))
+	}
+	section = "peer"
+	for i, p := range wc.Peers {
+		if p.PublicKey == "" {
+			return wc, warnings, fail(peerLines[i], "", "peer %d has no PublicKey", i+1)
+		}
+	}
+
+	return wc, warnings, nil
+}
+
+// parseInterfaceKey sets one [Interface] key of the configuration.
+func parseInterfaceKey(iface *Interface, key string, value string) error {
+	var err error
+
+	switch key {
+	case "privatekey":
+		if err = validateBase64Key(value); err == nil {
+			iface.PrivateKey = value
+		}
+	case "address":
+		iface.Address, err = parseInterfaceAddresses(value)
+	case "listenport":
+		var port int
+		if port, err = strconv.Atoi(value); err != nil {
+			return newError(errValidation, "invalid port '%s'", value)
+		}
+		err = iface.SetListenPort(port)
+	case "dns":
+		iface.DNS, err = parseDnsList(value)
+	case "mtu":
+		iface.MTU, err = parseMtu(value)
+	case "jc", "jmin", "jmax":
+		var n uint64
+		if n, err = strconv.ParseUint(value, 10, 16); err != nil {
+			return newError(errValidation, "invalid number '%s'", value)
+		}
+		switch key {
+		case "jc":
+			iface.Jc = uint16(n)
+		case "jmin":
+			iface.Jmin = uint16(n)
+		default:
+			iface.Jmax = uint16(n)
+		}
+	case "postup":
+		iface.PostUp = append(iface.PostUp, value)
+	case "postdown":
+		iface.PostDown = append(iface.PostDown, value)
+	default:
+		return newError(errValidation, "unknown key")
+	}
+
+	return err
+}
+
+// parsePeerKey sets one [Peer] key of the peer.
+func parsePeerKey(peer *Peer, key string, value string) error {
+	var err error
+
+	switch key {
+	case "publickey":
+		if err = validateBase64Key(value); err == nil {
+			peer.PublicKey = value
+		}
+	case "allowedips":
+		peer.AllowedIPs, err = parseAllowedIps(value)
+	case "endpoint":
+		if _, _, err = net.SplitHostPort(value); err != nil {
+			return newError(errValidation, "invalid endpoint '%s', expected host:port", value)
+		}
+		peer.Endpoint = value
+	case "persistentkeepalive":
+		peer.PersistentKeepalive, err = parsePersistentKeepalive(value)
+	default:
+		return newError(errValidation, "unknown key")
+	}
+
+	return err
+}
+
+// parseInterfaceAddresses parses a comma separated list of interface addresses in CIDR notation,
+// keeping the host address together with the subnet mask.
+func parseInterfaceAddresses(input string) ([]net.IPNet, error) {
+	var addresses []net.IPNet
+
+	for _, token := range strings.Split(input, ",") {
+		ip, ipNet, err := net.ParseCIDR(strings.TrimSpace(token))
+		if err != nil {
+			return nil, newError(errValidation, "invalid CIDR '%s'", strings.TrimSpace(token))
+		}
+		addresses = append(addresses, net.IPNet{IP: ip, Mask: ipNet.Mask})
+	}
+
+	return addresses, nil
+}
+
+// validateBase64Key checks that the key is a base64 encoded 32 bytes Curve25519 key.
+func validateBase64Key(key string) error {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != WireguardPrivateKeySize {
+		return newError(errValidation, "invalid key '%s'", key)
+	}
+
+	return nil
+}
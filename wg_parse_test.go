@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseErrorLocations(t *testing.T) {
+	tests := []struct {
+		file    string
+		strict  string
+		lenient string
+		warning string
+	}{
+		{file: "allowedips-cidr.conf",
+			strict: "wiresock.conf:16 [Peer] AllowedIPs: invalid CIDR '10.9.0.300/32'"},
+		{file: "address-cidr.conf",
+			strict: "wiresock.conf:4 [Interface] Address: invalid CIDR '10.9.0.1'"},
+		{file: "private-key.conf",
+			strict: "wiresock.conf:3 [Interface] PrivateKey: invalid key 'SKUHgk/fFP++mj7T6BFF'"},
+		{file: "public-key-missing.conf",
+			strict: "wiresock.conf:14 [Peer]: peer 2 has no PublicKey"},
+		{file: "listen-port-range.conf",
+			strict:  "wiresock.conf:5 [Interface] ListenPort: invalid listen port 70000, expected a number between 1 and 65535",
+			warning: "wiresock.conf:5 [Interface] ListenPort: invalid listen port 70000, expected a number between 1 and 65535, skipped"},
+		{file: "listen-port-number.conf",
+			strict:  "wiresock.conf:5 [Interface] ListenPort: invalid port '51820/udp'",
+			warning: "wiresock.conf:5 [Interface] ListenPort: invalid port '51820/udp', skipped"},
+		{file: "mtu-range.conf",
+			strict:  "wiresock.conf:6 [Interface] MTU: invalid MTU 100, expected a number between 576 and 65535",
+			warning: "wiresock.conf:6 [Interface] MTU: invalid MTU 100, expected a number between 576 and 65535, skipped"},
+		{file: "keepalive-range.conf",
+			strict: "wiresock.conf:12 [Peer] PersistentKeepalive: invalid persistent keepalive 999999, " +
+				"expected a number between 0 and 65535",
+			warning: "wiresock.conf:12 [Peer] PersistentKeepalive: invalid persistent keepalive 999999, " +
+				"expected a number between 0 and 65535, skipped"},
+		{file: "endpoint.conf",
+			strict:  "wiresock.conf:12 [Peer] Endpoint: invalid endpoint 'vpn.example.com', expected host:port",
+			warning: "wiresock.conf:12 [Peer] Endpoint: invalid endpoint 'vpn.example.com', expected host:port, skipped"},
+		{file: "dns.conf",
+			strict:  "wiresock.conf:7 [Interface] DNS: invalid DNS server IPv4 address or search domain '10.9.0.999'",
+			warning: "wiresock.conf:7 [Interface] DNS: invalid DNS server IPv4 address or search domain '10.9.0.999', skipped"},
+		{file: "junk-number.conf",
+			strict:  "wiresock.conf:7 [Interface] Jc: invalid number '70000'",
+			warning: "wiresock.conf:7 [Interface] Jc: invalid number '70000', skipped"},
+		{file: "junk-range.conf",
+			strict: "wiresock.conf [Interface]: invalid Jmin 900 and Jmax 100, expected 0 <= Jmin < Jmax <= 1280"},
+		{file: "unsupported-key.conf",
+			strict:  "wiresock.conf:7 [Interface] Table: not supported by wg-quick-config",
+			warning: "wiresock.conf:7 [Interface] Table: not supported by wg-quick-config, kept unchanged"},
+		{file: "unknown-key.conf",
+			strict:  "wiresock.conf:12 [Peer] Comment: unknown key",
+			warning: "wiresock.conf:12 [Peer] Comment: unknown key, kept unchanged"},
+		{file: "missing-equals.conf",
+			strict:  "wiresock.conf:12 [Peer]: expected Key = Value",
+			warning: "wiresock.conf:12 [Peer]: skipped 'PersistentKeepalive 25', expected Key = Value"},
+		{file: "unknown-section.conf",
+			strict: "wiresock.conf:14: unknown section [Peers]"},
+		{file: "key-outside-section.conf",
+			strict: "wiresock.conf:1 ListenPort: key outside of a section"},
+		{file: "repeated-interface.conf",
+			strict: "wiresock.conf:17 [Interface]: repeated [Interface] section"},
+		{file: "missing-interface.conf",
+			strict: "wiresock.conf: missing [Interface] section"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			text := readTestdata(t, "parse", test.file)
+
+			_, _, err := parseWireguardConfigText(text, "wiresock.conf", parseStrict)
+			if err == nil || err.Error() != test.strict {
+				t.Errorf("strict: %v, want %q", err, test.strict)
+			}
+			var located *parseError
+			if exitCode(err) != exitValidation || !errors.As(err, &located) {
+				t.Errorf("strict: %v isn't a located validation error", err)
+			}
+
+			// Lenient parsing skips what the strict one rejects, unless the value is required
+			_, warnings, err := parseWireguardConfigText(text, "wiresock.conf", parseLenient)
+			if test.warning == "" {
+				if err == nil || err.Error() != test.strict {
+					t.Errorf("lenient: %v, want %q", err, test.strict)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("lenient: %v, want the warning %q", err, test.warning)
+			}
+			if !reflect.DeepEqual(warnings, []string{test.warning}) {
+				t.Errorf("lenient warnings = %q, want %q", warnings, test.warning)
+			}
+		})
+	}
+}
+
+func TestParseLenientKeepsUnknownKeys(t *testing.T) {
+	wc, _, err := parseWireguardConfigText(readTestdata(t, "parse", "unsupported-key.conf"), "", parseLenient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(wc.Unknown, []string{"Table = off"}) {
+		t.Errorf("Interface.Unknown = %q", wc.Unknown)
+	}
+
+	wc, _, err = parseWireguardConfigText(readTestdata(t, "parse", "unknown-key.conf"), "", parseLenient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wc.Peers) != 2 || !reflect.DeepEqual(wc.Peers[0].Unknown, []string{"Comment = laptop"}) {
+		t.Errorf("Peers = %+v", wc.Peers)
+	}
+	if wc.Peers[0].Comments[0] != "alice" || wc.Peers[1].Comments[0] != "bob" {
+		t.Errorf("peer comments = %q, %q", wc.Peers[0].Comments, wc.Peers[1].Comments)
+	}
+}
+
+func TestParseWithoutFileName(t *testing.T) {
+	_, err := ParseWireguardConfig(readTestdata(t, "parse", "allowedips-cidr.conf"))
+	if want := "line 16 [Peer] AllowedIPs: invalid CIDR '10.9.0.300/32'"; err == nil || err.Error() != want {
+		t.Errorf("ParseWireguardConfig() = %v, want %q", err, want)
+	}
+
+	_, _, err = readWireguardConfigFile(filepath.Join("testdata", "parse", "mtu-range.conf"), parseStrict)
+	if want := filepath.Join("testdata", "parse", "mtu-range.conf") + ":6 [Interface] MTU: "; err == nil ||
+		!strings.HasPrefix(err.Error(), want) {
+		t.Errorf("readWireguardConfigFile() = %v, want it located in %s", err, want)
+	}
+}
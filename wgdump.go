@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// wgDumpNone is the value 'wg show dump' prints for an unset field.
+const wgDumpNone = "(none)"
+
+// isWgDump tells whether the text is 'wg show dump' output rather than a configuration file,
+// such as the output of 'wg showconf': its first line holds tab-separated fields instead of a
+// section header or a comment.
+func isWgDump(text string) bool {
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			fields := len(strings.Split(line, "\t"))
+			return (fields == 4 || fields == 5) && !strings.HasPrefix(line, "[") && !strings.HasPrefix(line, "#")
+		}
+	}
+
+	return false
+}
+
+// parseWgDump parses the output of 'wg show <interface> dump', the live state of a Wireguard
+// interface: a header line with the private key, public key, listen port and fwmark of the
+// interface, then a line per peer with its public key, preshared key, endpoint, allowed ips,
+// latest handshake, received and sent bytes and persistent keepalive. The output of
+// 'wg show all dump', which prefixes every line with the interface name, is accepted for a single
+// interface. The dump has no tunnel address, preshared keys are kept as PresharedKey lines of the
+// peers since the model has no field for them.
+//
+// Parameters:
+//     text (string): The dump output.
+//
+// Returns:
+//     WireguardConfig: The interface with its peers, without Address.
+//     error: A validation error naming the line that can't be parsed.
+//
+// Usage:
+//     server, err := parseWgDump(string(output))
+func parseWgDump(text string) (WireguardConfig, error) {
+	var wc WireguardConfig
+	header := true
+	iface := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+
+		// 'wg show all dump' starts every line with the interface name
+		if (header && len(fields) == 5) || (iface != "" && (len(fields) == 9 || len(fields) == 5)) {
+			if iface != "" && fields[0] != iface {
+				return wc, newError(errValidation, "line %d: the dump has several interfaces, "+
+					"dump a single one with 'wg show %s dump'", number, iface)
+			}
+			iface = fields[0]
+			fields = fields[1:]
+		}
+
+		if header {
+			if len(fields) != 4 {
+				return wc, newError(errValidation, "line %d: expected the interface line with private key, public "+
+					"key, listen port and fwmark", number)
+			}
+			if err := validateBase64Key(fields[0]); err != nil {
+				return wc, newError(errValidation, "line %d: invalid private key", number)
+			}
+			wc.PrivateKey = fields[0]
+			port, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return wc, newError(errValidation, "line %d: invalid listen port '%s'", number, fields[2])
+			}
+			if err = wc.SetListenPort(port); err != nil {
+				return wc, newError(errValidation, "line %d: %w", number, err)
+			}
+			if fields[3] != "off" && fields[3] != "0" {
+				wc.Unknown = append(wc.Unknown, "FwMark = "+fields[3])
+			}
+			header = false
+			continue
+		}
+
+		if len(fields) != 8 {
+			return wc, newError(errValidation, "line %d: expected a peer line with 8 fields, found %d", number, len(fields))
+		}
+		peer := Peer{PublicKey: fields[0]}
+		if err := validateBase64Key(peer.PublicKey); err != nil {
+			return wc, newError(errValidation, "line %d: invalid peer public key", number)
+		}
+		if fields[1] != wgDumpNone {
+			if err := validateBase64Key(fields[1]); err != nil {
+				return wc, newError(errValidation, "line %d: invalid preshared key", number)
+			}
+			peer.Unknown = append(peer.Unknown, "PresharedKey = "+fields[1])
+		}
+		if fields[2] != wgDumpNone {
+			peer.Endpoint = fields[2]
+		}
+		if fields[3] != wgDumpNone {
+			allowedIPs, err := parseAllowedIps(fields[3])
+			if err != nil {
+				return wc, newError(errValidation, "line %d: %w", number, err)
+			}
+			peer.AllowedIPs = allowedIPs
+		}
+		if fields[7] != "off" {
+			keepalive, err := strconv.Atoi(fields[7])
+			if err == nil {
+				err = peer.SetKeepalive(keepalive)
+			}
+			if err != nil {
+				return wc, newError(errValidation, "line %d: invalid persistent keepalive '%s'", number, fields[7])
+			}
+		}
+		wc.Peers = append(wc.Peers, peer)
+	}
+
+	if header {
+		return wc, newError(errValidation, "the dump is empty")
+	}
+
+	return wc, nil
+}
+
+// readServerToAdopt reads the server configuration to adopt from a file, which may be a Wireguard
+// configuration file, 'wg showconf' output or 'wg show dump' output. The two latter have no
+// Address, the caller has to ask for it.
+//
+// Returns:
+//     WireguardConfig: The server configuration.
+//     []string: The warnings of the lenient parsing of a configuration file.
+//     error: A validation error if the file can't be read or parsed.
+func readServerToAdopt(fileName string) (WireguardConfig, []string, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return WireguardConfig{}, nil, newError(errValidation, "can't read %s: %w", fileName, err)
+	}
+	if isWgDump(string(content)) {
+		server, err := parseWgDump(string(content))
+		if err != nil {
+			return server, nil, newError(errValidation, "%s: %w", fileName, err)
+		}
+		return server, nil, nil
+	}
+
+	return parseWireguardConfigText(string(content), fileName, parseLenient)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsWgDump(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"wg0.dump", true},
+		{"all.dump", true},
+		{"wg0-showconf.conf", false},
+	}
+
+	for _, test := range tests {
+		if got := isWgDump(readTestdata(t, "adopt", test.name)); got != test.want {
+			t.Errorf("isWgDump(%s) = %t, want %t", test.name, got, test.want)
+		}
+	}
+	if isWgDump("# wiresock.conf\n[Interface]\n") || isWgDump("") {
+		t.Error("a configuration file was taken for a dump")
+	}
+}
+
+func TestParseWgDump(t *testing.T) {
+	for _, name := range []string{"wg0.dump", "all.dump"} {
+		t.Run(name, func(t *testing.T) {
+			server, err := parseWgDump(readTestdata(t, "adopt", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if server.PrivateKey != "GGtuTwnvmq+ybtel0oiSsmqJhYyQgZSPVdIaf2bp4kg=" || server.ListenPort != 51820 ||
+				len(server.Unknown) != 0 || len(server.Address) != 0 {
+				t.Errorf("interface = %+v", server.Interface)
+			}
+			if len(server.Peers) != 4 {
+				t.Fatalf("%d peers, want 4", len(server.Peers))
+			}
+
+			tests := []struct {
+				endpoint   string
+				allowedIPs string
+				keepalive  uint32
+				preshared  []string
+			}{
+				{"198.51.100.7:41820", "10.9.0.2/32", 0, []string{"PresharedKey = CM9diaIA/0QlwELBfZIYb2WMjHzKyDxjO+7OfuKwdlo="}},
+				{"[2001:db8::42]:53211", "10.9.0.3/32, fd00:9::3/128", 25, nil},
+				{"", "10.9.0.4/32, 192.168.50.0/24, 2001:db8:50::/48", 25,
+					[]string{"PresharedKey = IFyKM9XReUkeb+aDbsKNwGcV5jFgBqQ5U7ER7dgjAGw="}},
+				{"", "10.9.0.5/32", 0, nil},
+			}
+			for i, test := range tests {
+				peer := server.Peers[i]
+				if peer.Endpoint != test.endpoint || joinIPNets(peer.AllowedIPs) != test.allowedIPs ||
+					peer.PersistentKeepalive != test.keepalive || !reflect.DeepEqual(peer.Unknown, test.preshared) {
+					t.Errorf("peer %d = %s %s %q %d, want %s %s %q %d", i+1, peer.Endpoint, joinIPNets(peer.AllowedIPs),
+						peer.Unknown, peer.PersistentKeepalive, test.endpoint, test.allowedIPs, test.preshared, test.keepalive)
+				}
+			}
+		})
+	}
+}
+
+func TestParseWgDumpErrors(t *testing.T) {
+	dump := readTestdata(t, "adopt", "wg0.dump")
+	all := readTestdata(t, "adopt", "all.dump")
+	lines := strings.Split(dump, "\n")
+
+	tests := []struct {
+		name    string
+		text    string
+		wantErr string
+	}{
+		{"empty", "\n", "the dump is empty"},
+		{"several interfaces", all + strings.Replace(strings.Split(all, "\n")[1], "wg0", "wg1", 1) + "\n",
+			"line 6: the dump has several interfaces"},
+		{"peer line first", strings.Join(lines[1:], "\n"), "line 1: expected the interface line"},
+		{"truncated peer", lines[0] + "\n" + strings.Join(strings.Split(lines[1], "\t")[:6], "\t") + "\n",
+			"line 2: expected a peer line with 8 fields, found 6"},
+		{"listen port", strings.Replace(dump, "\t51820\t", "\t70000\t", 1),
+			"line 1: invalid listen port 70000"},
+		{"allowed ips", strings.Replace(dump, "10.9.0.5/32", "10.9.0.500/32", 1), "line 5:"},
+	}
+
+	for _, test := range tests {
+		_, err := parseWgDump(test.text)
+		if exitCode(err) != exitValidation || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: parseWgDump() = %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestAdoptCommandLinuxServer(t *testing.T) {
+	for _, name := range []string{"wg0.dump", "wg0-showconf.conf"} {
+		t.Run(name, func(t *testing.T) {
+			isolateProfiles(t)
+			configPath := t.TempDir() + string(os.PathSeparator)
+			err := runAdoptCommand(configPath, []string{filepath.Join("testdata", "adopt", name),
+				"--address", "10.9.0.1/24", "--endpoint", "vpn.example.com:51820"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := loadAppConfig(configPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(config.Clients) != 4 || joinIPNets(config.Server.Address) != "10.9.0.1/24" {
+				t.Fatalf("%d clients, server address %s", len(config.Clients), joinIPNets(config.Server.Address))
+			}
+			for i, client := range config.Clients {
+				if client.PrivateKey != "" || client.Peers[0].Endpoint != "vpn.example.com:51820" {
+					t.Errorf("client %d isn't an external-key client of vpn.example.com", i+1)
+				}
+			}
+			if psk := config.Clients[0].Peers[0].Unknown; len(psk) != 1 || !strings.HasPrefix(psk[0], "PresharedKey = CM9d") {
+				t.Errorf("client 1 didn't get the preshared key of its peer: %q", psk)
+			}
+
+			// Networks besides the tunnel address make a site-to-site client
+			if sites := joinIPNets(config.clientSites(2)); sites != "192.168.50.0/24, 2001:db8:50::/48" {
+				t.Errorf("client 3 routes %q", sites)
+			}
+			if sites := config.clientSites(3); len(sites) != 0 {
+				t.Errorf("client 4 routes %v", sites)
+			}
+		})
+	}
+}
+
+func TestAdoptCommandMerge(t *testing.T) {
+	config, configPath := newTestProfile(t, 2)
+	dump := filepath.Join("testdata", "adopt", "wg0.dump")
+
+	if err := runAdoptCommand(configPath, []string{dump}); exitCode(err) != exitConflict {
+		t.Errorf("adopting over a configuration = %v, want a conflict", err)
+	}
+	// The peers 10.9.0.2 and 10.9.0.3 take the addresses of the existing clients
+	err := runAdoptCommand(configPath, []string{dump, "--merge"})
+	if err == nil || !strings.Contains(err.Error(), "clients 1 and 3 share the address 10.9.0.2") {
+		t.Errorf("merging clashing addresses = %v, want a validation failure", err)
+	}
+	if unchanged, _ := loadAppConfig(configPath); len(unchanged.Clients) != 2 {
+		t.Fatalf("%d clients after the refused merge", len(unchanged.Clients))
+	}
+
+	dump = filepath.Join(t.TempDir(), "wg0.dump")
+	moved := strings.NewReplacer("10.9.0.2/", "10.9.0.12/", "10.9.0.3/", "10.9.0.13/", "10.9.0.4/", "10.9.0.14/",
+		"10.9.0.5/", "10.9.0.15/").Replace(readTestdata(t, "adopt", "wg0.dump"))
+	if err = ioutil.WriteFile(dump, []byte(moved), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = runAdoptCommand(configPath, []string{dump, "--merge"}); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := loadAppConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Clients) != 6 || merged.Server.PrivateKey != config.Server.PrivateKey {
+		t.Fatalf("%d clients after merging, server key kept %t", len(merged.Clients),
+			merged.Server.PrivateKey == config.Server.PrivateKey)
+	}
+	if merged.Clients[5].Peers[0].Endpoint != config.Clients[0].Peers[0].Endpoint ||
+		joinIPNets(merged.Clients[5].Address) != "10.9.0.15/24" {
+		t.Errorf("merged client %s connects to %s", joinIPNets(merged.Clients[5].Address),
+			merged.Clients[5].Peers[0].Endpoint)
+	}
+
+	// Merging again finds every peer known
+	if err = runAdoptCommand(configPath, []string{dump, "--merge"}); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loadAppConfig(configPath); len(again.Clients) != 6 {
+		t.Errorf("%d clients after merging twice", len(again.Clients))
+	}
+}
@@ -1,6 +1,11 @@
+//go:build windows
+
 package main
 
 import (
+	"os"
+
+	"github.com/gonutz/w32/v2"
 	"golang.org/x/sys/windows"
 )
 
@@ -42,3 +47,57 @@ func IsAdminElevated() (bool, bool, error) {
 	// For elevation see https://github.com/mozey/run-as-admin
 	return member, token.IsElevated(), nil
 }
+
+// replaceFile renames a file over another one for writeFileAtomic. MoveFileEx replaces an existing
+// destination, which os.Rename also does, but only MOVEFILE_WRITE_THROUGH makes it return once the
+// rename is flushed to disk.
+func replaceFile(from, to string) error {
+	fromPtr, err := windows.UTF16PtrFromString(from)
+	if err != nil {
+		return err
+	}
+	toPtr, err := windows.UTF16PtrFromString(to)
+	if err != nil {
+		return err
+	}
+
+	err = windows.MoveFileEx(fromPtr, toPtr, windows.MOVEFILE_REPLACE_EXISTING|windows.MOVEFILE_WRITE_THROUGH)
+	if err != nil {
+		return &os.LinkError{Op: "replace", Old: from, New: to, Err: err}
+	}
+
+	return nil
+}
+
+// windowsVersion returns the major and minor version of Windows, e.g. 6 and 1 for Windows 7.
+func windowsVersion() (int, int) {
+	winVersion := w32.RtlGetVersion()
+	return int(winVersion.MajorVersion), int(winVersion.MinorVersion)
+}
+
+// disableConsoleEcho stops the console from echoing what is typed, so that readSecret doesn't show
+// a passphrase. Lines are still read whole and Ctrl+C still interrupts.
+//
+// Parameters:
+//     f (*os.File): The console input, os.Stdin.
+//
+// Returns:
+//     func(): Restores the previous mode of the console.
+//     error: An error if the file isn't a console.
+//
+// Usage:
+//     restore, err := disableConsoleEcho(os.Stdin)
+func disableConsoleEcho(f *os.File) (func(), error) {
+	handle := windows.Handle(f.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		return nil, err
+	}
+
+	hidden := mode&^windows.ENABLE_ECHO_INPUT | windows.ENABLE_LINE_INPUT | windows.ENABLE_PROCESSED_INPUT
+	if err := windows.SetConsoleMode(handle, hidden); err != nil {
+		return nil, err
+	}
+
+	return func() { windows.SetConsoleMode(handle, mode) }, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// wireguardTunnelNamePattern matches the tunnel names WireGuard for Windows accepts, the file name
+// of the configuration without .conf.
+var wireguardTunnelNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_=+.-]{1,32}$`)
+
+// windowsImportScript returns a PowerShell script that installs the configuration of a client into
+// WireGuard for Windows on the target machine, without clicking "Import tunnel". The configuration
+// is restricted to the wg-quick keys, see ForProfile, since WireGuard rejects the WireSock
+// extensions, and embedded as a single-quoted PowerShell string, see quotePowerShell, so that none
+// of its characters is interpreted. The script writes it into the Data\Configurations folder of
+// WireGuard, which only SYSTEM and the Administrators can read, and then either installs the tunnel
+// service with 'wireguard.exe /installtunnelservice', or with drop only leaves the file there. The
+// WireGuard manager encrypts the plain .conf files of that folder with DPAPI for the SYSTEM account
+// the next time it lists the tunnels, no other account can encrypt them for it.
+//
+// Parameters:
+//     index (int): The zero-based index of the client.
+//     tunnel (string): The tunnel name on the target machine, see wireguardTunnelNamePattern.
+//     drop (bool): Whether to only drop the configuration file instead of installing the service.
+//
+// Returns:
+//     string: The PowerShell script, which contains the private key of the client.
+//     []string: A warning per WireSock extension left out.
+//     error: An error if the client has an external key or its configuration can't be rendered.
+//
+// Usage:
+//     script, warnings, err := config.windowsImportScript(1, "office", false)
+func (config *appConfig) windowsImportScript(index int, tunnel string, drop bool) (string, []string, error) {
+	if config.Clients[index].PrivateKey == "" {
+		return "", nil, newError(errValidation, "client %d has an external key, there is no complete configuration to import",
+			index+1)
+	}
+	wc, warnings, _ := config.clientFileConfig(index).ForProfile(outputWgQuick)
+	content, err := config.renderConfig(wc)
+	if err != nil {
+		return "", nil, err
+	}
+
+	script := fmt.Sprintf(`# Installs the Wireguard tunnel '%s' of %s into WireGuard for Windows.
+# Generated by wg-quick-config on %s.
+#
+# WARNING: this script contains the private key of the client. Copy it to the target machine over
+# a trusted channel, run it there as Administrator and delete it afterwards.
+#Requires -RunAsAdministrator
+$ErrorActionPreference = 'Stop'
+
+$tunnel = %s
+$config = %s
+
+$wireguard = Join-Path $env:ProgramFiles 'WireGuard\wireguard.exe'
+if (-not (Test-Path $wireguard)) {
+    throw 'WireGuard for Windows is not installed, get it from https://www.wireguard.com/install/'
+}
+
+# Only SYSTEM and the Administrators can read the configuration folder of WireGuard
+$folder = Join-Path $env:ProgramFiles 'WireGuard\Data\Configurations'
+New-Item -ItemType Directory -Force -Path $folder | Out-Null
+if (Test-Path (Join-Path $folder ($tunnel + '.conf.dpapi'))) {
+    throw "A tunnel named $tunnel already exists, remove it in WireGuard first"
+}
+$path = Join-Path $folder ($tunnel + '.conf')
+[System.IO.File]::WriteAllText($path, $config)
+`, tunnel, config.clientName(index), time.Now().Format("2006-01-02"), quotePowerShell(tunnel), quotePowerShell(content))
+
+	if drop {
+		script += `
+# The WireGuard manager encrypts the plain .conf files of the folder with DPAPI for the SYSTEM
+# account, the only account able to decrypt them, and replaces them with .conf.dpapi files. It
+# does so whenever it lists the tunnels, so restart it if it runs, otherwise this happens the next
+# time WireGuard is opened. Until then the private key is stored unencrypted.
+if ((Get-Service -Name WireGuardManager -ErrorAction SilentlyContinue).Status -eq 'Running') {
+    Restart-Service -Name WireGuardManager
+}
+Write-Host "Tunnel $tunnel added to WireGuard, activate it in the WireGuard app."
+`
+	} else {
+		script += `
+# Installs and starts the tunnel service WireGuardTunnel$<tunnel>, which starts with Windows. The
+# WireGuard manager encrypts the file with DPAPI for the SYSTEM account the next time it lists the
+# tunnels, the tunnel service keeps working with the encrypted file.
+& $wireguard /installtunnelservice $path
+if ($LASTEXITCODE -ne 0) {
+    throw "wireguard.exe failed to install the tunnel service of $tunnel"
+}
+Write-Host "Tunnel $tunnel installed and started."
+`
+	}
+
+	return script, warnings, nil
+}
+
+// runExportWindowsImportCommand implements 'export windows-import', which writes a PowerShell
+// script per client that installs the tunnel silently into WireGuard for Windows on the target
+// machine, for provisioning many Windows desktops, see windowsImportScript:
+//
+//     export windows-import 2 --out office.ps1
+//     export windows-import 2 --out office.ps1 --tunnel office --drop
+//     export windows-import 2,3,5 --out C:\rollout\scripts
+//     export windows-import --all --out C:\rollout\scripts
+//
+// A single client is written to the --out file, several clients into the --out directory, one
+// script named after each client configuration file. The tunnel is named after the client
+// configuration file, e.g. wsclient_2, unless --tunnel names the tunnel of a single client. Clients
+// with an external key are skipped. The scripts contain private keys and are written readable by
+// the owner only.
+func runExportWindowsImportCommand(configPath string, args []string) error {
+	usage := newError(errUsage, "usage: export windows-import <client>[,<client>...] | --all --out file.ps1|directory "+
+		"[--tunnel name] [--drop]")
+
+	selection := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		selection, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := flags.String("out", "", "File of the script, or directory of the scripts with several clients")
+	all := flags.Bool("all", false, "Write a script for every client")
+	tunnel := flags.String("tunnel", "", "Tunnel name on the target machine, the client file name by default")
+	drop := flags.Bool("drop", false, "Only drop the configuration into WireGuard instead of installing the tunnel service")
+	if err := parseFlags(flags, "export", args); err != nil {
+		return err
+	}
+	if *out == "" || flags.NArg() != 0 || (selection == "") == !*all {
+		return usage
+	}
+	if *tunnel != "" && !wireguardTunnelNamePattern.MatchString(*tunnel) {
+		return newError(errValidation, "invalid tunnel name '%s', WireGuard accepts up to 32 letters, digits and _=+.-",
+			*tunnel)
+	}
+
+	config, err := loadAppConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load existing configuration: %w", err)
+	}
+
+	var selected []int
+	if *all {
+		for i := range config.Clients {
+			selected = append(selected, i)
+		}
+	} else if selected, err = config.parseClientSelection(selection); err != nil {
+		return err
+	}
+	batch := *all || len(selected) > 1
+	if batch && *tunnel != "" {
+		return newError(errUsage, "--tunnel names the tunnel of a single client")
+	}
+	if batch {
+		if err = os.MkdirAll(*out, 0700); err != nil {
+			return err
+		}
+	}
+
+	delivered, written := false, 0
+	for _, index := range selected {
+		baseName := strings.TrimSuffix(fmt.Sprintf(defaultClientConfigFile, index+1), ".conf")
+		name := *tunnel
+		if name == "" {
+			name = baseName
+		}
+		script, warnings, err := config.windowsImportScript(index, name, *drop)
+		if err != nil {
+			if batch {
+				fmt.Println("Skipped:", err)
+				continue
+			}
+			return err
+		}
+
+		fileName := *out
+		if batch {
+			fileName = filepath.Join(*out, baseName+".ps1")
+		}
+		// Windows PowerShell reads scripts without a byte order mark in the ANSI code page
+		if err = writeFileAtomic(fileName, []byte("\ufeff"+strings.ReplaceAll(script, "\n", "\r\n")), 0600); err != nil {
+			return fmt.Errorf("can't write %s: %w", fileName, err)
+		}
+		fmt.Println("Successfully saved import script:", fileName)
+		for _, warning := range warnings {
+			fmt.Printf("Warning: client %d: %s\n", index+1, warning)
+		}
+		written++
+		delivered = config.recordStatus(configPath, index, statusDelivered, "Windows import script exported",
+			time.Now()) || delivered
+	}
+	if delivered {
+		config.saveStatus(configPath)
+	}
+
+	if written > 0 {
+		fmt.Println("Warning: the scripts contain private keys, only share them over a trusted channel and delete them after use.")
+	}
+	return nil
+}
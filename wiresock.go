@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// wireSockFeature is a configuration extension of WireSock that older releases reject, with the
+// first release supporting it.
+type wireSockFeature struct {
+	Name string
+	// Keys are the lowercase "section.key" names of the configuration keys using the feature.
+	Keys       []string
+	MinVersion string
+}
+
+// wireSockFeatures maps the WireSock extensions to the release introducing them. Add a row when a
+// release adds a configuration key.
+var wireSockFeatures = []wireSockFeature{
+	{"application filtering", []string{"interface.allowedapps", "interface.disallowedapps"}, "1.2.10"},
+	{"excluded addresses", []string{"interface.disallowedips", "peer.disallowedips"}, "1.2.22"},
+	{"SOCKS5 proxy", []string{"interface.socks5proxy", "peer.socks5proxy"}, "1.2.27"},
+	{"SOCKS5 proxy authentication", []string{"interface.socks5proxyusername", "interface.socks5proxypassword",
+		"peer.socks5proxyusername", "peer.socks5proxypassword"}, "1.2.37"},
+	{"AmneziaWG junk packets", []string{"interface.jc", "interface.jmin", "interface.jmax"}, "1.4.0"},
+}
+
+// wireSockVersionPattern matches a dotted release number such as 1.2.37.
+var wireSockVersionPattern = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// compareVersions compares two dotted release numbers numerically, returning -1, 0 or 1. Missing
+// components count as zero, so 1.4 equals 1.4.0.
+func compareVersions(a string, b string) int {
+	partsA, partsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var x, y int
+		if i < len(partsA) {
+			x, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			y, _ = strconv.Atoi(partsB[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// detectWireSockVersion returns the version of the WireSock client or gateway installed on this
+// host, read from the uninstall entries of the registry, empty if WireSock isn't installed or
+// detection fails.
+//
+// Parameters:
+//     ps (Executor): Runs the registry query, see NewPowerShell.
+//
+// Returns:
+//     string: The installed version, e.g. 1.2.37.
+//
+// Usage:
+//     installed := detectWireSockVersion(NewPowerShell())
+func detectWireSockVersion(ps Executor) string {
+	if !windowsHost {
+		return ""
+	}
+
+	script := `Get-ItemProperty 'HKLM:\Software\Microsoft\Windows\CurrentVersion\Uninstall\*',
+			'HKLM:\Software\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall\*' -ErrorAction SilentlyContinue |
+		Where-Object { $_.DisplayName -match 'WireSock' } | Select-Object -First 1 -ExpandProperty DisplayVersion`
+
+	result := ps.Execute(context.Background(), script)
+	if result.Err != nil {
+		return ""
+	}
+	return wireSockVersionPattern.FindString(result.StdOut)
+}
+
+// wireSockFeaturesUsed returns the WireSock features the configuration uses, in the order of
+// wireSockFeatures.
+func wireSockFeaturesUsed(wc WireguardConfig) []wireSockFeature {
+	keys := map[string]bool{}
+	if wc.Jc != 0 {
+		keys["interface.jc"] = true
+	}
+	for _, line := range wc.Unknown {
+		key, _, _ := strings.Cut(line, "=")
+		keys["interface."+strings.ToLower(strings.TrimSpace(key))] = true
+	}
+	for _, peer := range wc.Peers {
+		for _, line := range peer.Unknown {
+			key, _, _ := strings.Cut(line, "=")
+			keys["peer."+strings.ToLower(strings.TrimSpace(key))] = true
+		}
+	}
+
+	var used []wireSockFeature
+	for _, feature := range wireSockFeatures {
+		for _, key := range feature.Keys {
+			if keys[key] {
+				used = append(used, feature)
+				break
+			}
+		}
+	}
+
+	return used
+}
+
+// wireSockFeatureReport checks the WireSock features used by the server and the clients against
+// the installed WireSock version. The server configuration runs on this host, so a feature the
+// installed version lacks is a problem. Clients usually run on other devices, for them it is only
+// reported. Without an installation the features are only noted with the version they need.
+//
+// Parameters:
+//     installed (string): The installed WireSock version, empty if none, see detectWireSockVersion.
+//
+// Returns:
+//     []string: The problems, features of the server configuration the installed version lacks.
+//     []string: The remaining findings, warnings with an installation and notes without one.
+//
+// Usage:
+//     problems, notes := config.wireSockFeatureReport(detectWireSockVersion(NewPowerShell()))
+func (config *appConfig) wireSockFeatureReport(installed string) ([]string, []string) {
+	var problems, notes []string
+	check := func(wc WireguardConfig, owner string, local bool) {
+		for _, feature := range wireSockFeaturesUsed(wc) {
+			switch {
+			case installed == "":
+				notes = append(notes, fmt.Sprintf("%s uses %s, supported by WireSock %s and later",
+					owner, feature.Name, feature.MinVersion))
+			case compareVersions(installed, feature.MinVersion) >= 0:
+			case local:
+				problems = append(problems, fmt.Sprintf("%s uses %s, which needs WireSock %s or later, "+
+					"the installed version is %s: upgrade WireSock", owner, feature.Name, feature.MinVersion, installed))
+			default:
+				notes = append(notes, fmt.Sprintf("%s uses %s, which needs WireSock %s or later, the version "+
+					"installed here is %s: make sure the device runs a recent one", owner, feature.Name, feature.MinVersion, installed))
+			}
+		}
+	}
+
+	check(config.Server, "the server configuration", true)
+	for i, client := range config.Clients {
+		check(client, fmt.Sprintf("client %d", i+1), false)
+	}
+
+	return problems, notes
+}
+
+// checkWireSockFeatures detects the installed WireSock version and refuses to generate a server
+// configuration it would reject. Client findings are printed, as warnings if WireSock is
+// installed and as notes otherwise.
+func (config *appConfig) checkWireSockFeatures() error {
+	installed := detectWireSockVersion(newExecutor())
+	problems, notes := config.wireSockFeatureReport(installed)
+
+	label := "Note:"
+	if installed != "" {
+		label = "Warning:"
+	}
+	for _, note := range notes {
+		fmt.Println(label, note)
+	}
+	if len(problems) > 0 {
+		return newError(errDependency, "%s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.37", "1.2.37", 0},
+		{"1.4", "1.4.0", 0},
+		{"1.2.9", "1.2.10", -1},
+		{"1.10.0", "1.9.99", 1},
+		{"2", "1.99.99", 1},
+	}
+
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%s, %s) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestDetectWireSockVersion(t *testing.T) {
+	fakeWindowsHost(t)
+
+	tests := []struct {
+		name   string
+		result Result
+		want   string
+	}{
+		{"installed", Result{StdOut: "1.2.37.1\r\n"}, "1.2.37.1"},
+		{"not installed", Result{}, ""},
+		{"query failed", Result{StdOut: "1.2.37", Err: errors.New("exit status 1")}, ""},
+	}
+
+	for _, test := range tests {
+		ps := &fakeExecutor{Rules: []fakeRule{{Match: "DisplayName -match 'WireSock'", Result: test.result}}}
+		if got := detectWireSockVersion(ps); got != test.want {
+			t.Errorf("%s: detectWireSockVersion() = %q, want %q", test.name, got, test.want)
+		}
+		if !ps.ran(`HKLM:\Software\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall\*`) {
+			t.Errorf("%s: the 32-bit uninstall entries weren't queried: %q", test.name, ps.Scripts)
+		}
+	}
+}
+
+func TestWireSockFeatureTable(t *testing.T) {
+	seen := map[string]bool{}
+	for i, feature := range wireSockFeatures {
+		if !wireSockVersionPattern.MatchString(feature.MinVersion) || wireSockVersionPattern.FindString(feature.MinVersion) != feature.MinVersion {
+			t.Errorf("%s: invalid minimum version %q", feature.Name, feature.MinVersion)
+		}
+		if i > 0 && compareVersions(wireSockFeatures[i-1].MinVersion, feature.MinVersion) > 0 {
+			t.Errorf("%s: the table isn't ordered by release", feature.Name)
+		}
+		for _, key := range feature.Keys {
+			section, name, found := strings.Cut(key, ".")
+			if !found || (section != "interface" && section != "peer") || name != strings.ToLower(name) || seen[key] {
+				t.Errorf("%s: invalid or repeated key %q", feature.Name, key)
+			}
+			seen[key] = true
+		}
+	}
+}
+
+func TestWireSockFeaturesUsed(t *testing.T) {
+	tests := []struct {
+		name string
+		wc   WireguardConfig
+		want []string
+	}{
+		{"plain", WireguardConfig{Peers: []Peer{{}}}, nil},
+		{"application filtering", WireguardConfig{Interface: Interface{Unknown: []string{"AllowedApps = firefox"}}},
+			[]string{"application filtering"}},
+		{"excluded addresses of a peer", WireguardConfig{Peers: []Peer{{}, {Unknown: []string{"DisallowedIPs = 192.168.0.0/16"}}}},
+			[]string{"excluded addresses"}},
+		{"junk packets", WireguardConfig{Interface: Interface{Jc: 4, Jmin: 40, Jmax: 70}},
+			[]string{"AmneziaWG junk packets"}},
+		{"unknown keys", WireguardConfig{Interface: Interface{Unknown: []string{"FutureKey = 1"}}}, nil},
+		{"every feature", compatFixture(t, "extensions.conf"), []string{"application filtering", "excluded addresses",
+			"SOCKS5 proxy", "SOCKS5 proxy authentication", "AmneziaWG junk packets"}},
+	}
+
+	for _, test := range tests {
+		var got []string
+		for _, feature := range wireSockFeaturesUsed(test.wc) {
+			got = append(got, feature.Name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: wireSockFeaturesUsed() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWireSockFeatureReport(t *testing.T) {
+	var config appConfig
+	config.Server.Unknown = []string{"Socks5Proxy = 127.0.0.1:1080"}
+	config.Clients = []WireguardConfig{{}, compatFixture(t, "extensions.conf")}
+
+	tests := []struct {
+		installed    string
+		wantProblems []string
+		wantNotes    int
+		wantNote     string
+	}{
+		// Configurations generated for another machine are only noted
+		{installed: "", wantNotes: 6, wantNote: "client 2 uses AmneziaWG junk packets, supported by WireSock 1.4.0 and later"},
+		{installed: "1.2.20", wantProblems: []string{"the server configuration uses SOCKS5 proxy, which needs WireSock " +
+			"1.2.27 or later, the installed version is 1.2.20: upgrade WireSock"}, wantNotes: 4,
+			wantNote: "client 2 uses excluded addresses, which needs WireSock 1.2.22 or later, the version installed " +
+				"here is 1.2.20: make sure the device runs a recent one"},
+		{installed: "1.2.37", wantNotes: 1, wantNote: "client 2 uses AmneziaWG junk packets, which needs WireSock 1.4.0"},
+		{installed: "1.4.2"},
+	}
+
+	for _, test := range tests {
+		problems, notes := config.wireSockFeatureReport(test.installed)
+		if !reflect.DeepEqual(problems, test.wantProblems) {
+			t.Errorf("installed %q: problems = %q, want %q", test.installed, problems, test.wantProblems)
+		}
+		if len(notes) != test.wantNotes {
+			t.Errorf("installed %q: %d notes, want %d: %q", test.installed, len(notes), test.wantNotes, notes)
+		}
+		if test.wantNote != "" && !strings.Contains(strings.Join(notes, "\n"), test.wantNote) {
+			t.Errorf("installed %q: notes %q, want %q", test.installed, notes, test.wantNote)
+		}
+	}
+}